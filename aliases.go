@@ -0,0 +1,117 @@
+package gofiledb
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb/collection"
+)
+
+/********************************************************************************
+* A L I A S E S
+*********************************************************************************/
+
+// An alias is another name for a collection, which can be used wherever the name of the collection can. AddAlias can
+// point an existing alias at another collection, which takes effect for all the operations that start after it, so an
+// application can keep using the alias while the collection behind it is swapped, e.g. for a monthly rollover:
+//
+//	client.AddCollection(CollectionProps{Name: "events202407", ...})
+//	client.AddAlias("eventscurrent", "events202407") // was pointing at events202406
+//
+// Aliases are saved with the client. A collection can't be removed while aliases point to it, and aliases follow the
+// collection they point to when it is renamed.
+
+var ErrAliasIsExist = fmt.Errorf("An alias with this name already exists")
+var ErrAliasIsNotExist = fmt.Errorf("Alias not found")
+var ErrCollectionHasAliases = fmt.Errorf("The collection can not be removed while aliases point to it")
+
+// AddAlias makes alias another name for the collection collectionName. If alias exists already, it is pointed at
+// collectionName instead. If collectionName is itself an alias, alias points to the same collection as it does.
+func (c *Client) AddAlias(alias string, collectionName string) error {
+	if c.isReadOnly() {
+		return ErrClientIsReadOnly
+	}
+
+	alias = collection.NormalizeName(alias)
+	err := c.nameRules.Validate(alias)
+	if err != nil {
+		return err
+	}
+
+	c.collections.Lock()
+	err = c.addAlias(alias, collection.NormalizeName(collectionName))
+	c.collections.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return c.save()
+}
+
+// addAlias does the work for AddAlias. It should be called while holding the lock of c.collections.
+func (c *Client) addAlias(alias string, collectionName string) error {
+	if c.collections.has(alias) {
+		return collection.ErrCollectionIsExist
+	}
+	if target, isAlias := c.collections.Aliases[collectionName]; isAlias {
+		collectionName = target
+	}
+	if !c.collections.has(collectionName) {
+		return collection.ErrCollectionIsNotExist
+	}
+
+	if c.collections.Aliases == nil {
+		c.collections.Aliases = make(map[string]string)
+	}
+	c.collections.Aliases[alias] = collectionName
+	return nil
+}
+
+// RemoveAlias removes alias. The collection it points to is left as it is.
+func (c *Client) RemoveAlias(alias string) error {
+	if c.isReadOnly() {
+		return ErrClientIsReadOnly
+	}
+
+	alias = collection.NormalizeName(alias)
+	c.collections.Lock()
+	_, hasKey := c.collections.Aliases[alias]
+	delete(c.collections.Aliases, alias)
+	c.collections.Unlock()
+	if !hasKey {
+		return ErrAliasIsNotExist
+	}
+
+	return c.save()
+}
+
+// GetAliases returns all the aliases of the client, along with the names of the collections they point to
+func (c *Client) GetAliases() map[string]string {
+	c.collections.RLock()
+	defer c.collections.RUnlock()
+
+	aliases := make(map[string]string, len(c.collections.Aliases))
+	for alias, collectionName := range c.collections.Aliases {
+		aliases[alias] = collectionName
+	}
+	return aliases
+}
+
+// hasAliases tells whether any alias points to the collection collectionName. It should be called while holding the lock
+// of c.collections.
+func (c *Client) hasAliases(collectionName string) bool {
+	for _, target := range c.collections.Aliases {
+		if target == collectionName {
+			return true
+		}
+	}
+	return false
+}
+
+// moveAliases points the aliases of the collection oldName to newName. It should be called while holding the lock of
+// c.collections.
+func (c *Client) moveAliases(oldName string, newName string) {
+	for alias, target := range c.collections.Aliases {
+		if target == oldName {
+			c.collections.Aliases[alias] = newName
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package gofiledb
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/util"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/********************************************************************************
+* B A C K U P S
+*********************************************************************************/
+
+// Backup writes a tar.gz archive of the whole warehouse: every file in the warehouse dir, including the databases, other
+// than the snapshots (see Snapshot) and the temp files. The warehouse records where it is, so it can only be restored in
+// the same place: extracting the archive into the DocumentRoot of the client, once the client is closed and the warehouse
+// dir has been removed, gives back the warehouse as it was when the backup was taken.
+//
+// The archive is consistent: the writes to all the loaded collections are paused while it is written (see
+// Collection.PauseWrites), and collections and databases can't be loaded, added, removed or changed until it is done.
+// The collections that haven't been loaded don't change until they are. Documents can still be read in the meantime.
+//
+// BackupCollection writes the archive of a single collection, which is laid out like a snapshot (see
+// Collection.Backup), and only pauses the writes to that collection.
+//
+// The archive of the warehouse ends with a manifest, BACKUP_MANIFEST_FILE_NAME in the warehouse dir, that lists every
+// file in it with its size and SHA-256, so that VerifyBackup can check the archive without restoring it.
+
+const BACKUP_MANIFEST_FILE_NAME string = "backup_manifest.json"
+const BACKUP_MANIFEST_FORMAT_NAME string = "gofiledb-backup-manifest"
+const BACKUP_MANIFEST_FORMAT_VERSION int = 1
+
+type backupManifest struct {
+	Format    string         `json:"format"`
+	Version   int            `json:"version"`
+	CreatedAt time.Time      `json:"created_at"`
+	Files     []util.TarFile `json:"files"`
+}
+
+// Backup writes a tar.gz archive of a consistent copy of the warehouse to w
+func (c *Client) Backup(w io.Writer) error {
+	resume, err := c.pauseWrites()
+	if err != nil {
+		return err
+	}
+	defer resume()
+
+	err = c.savePaused()
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	namePrefix := filepath.Base(c.getDocumentRoot()) + "/"
+	files, err := util.WriteTarDir(c.fs(), tw, c.getDocumentRoot(), namePrefix, isLeftOutOfBackup)
+	if err != nil {
+		return err
+	}
+
+	manifest := backupManifest{
+		Format:    BACKUP_MANIFEST_FORMAT_NAME,
+		Version:   BACKUP_MANIFEST_FORMAT_VERSION,
+		CreatedAt: time.Now(),
+		Files:     files,
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     namePrefix + BACKUP_MANIFEST_FILE_NAME,
+		Mode:     util.FILE_PERM,
+		Size:     int64(len(data)),
+		ModTime:  manifest.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	if err != nil {
+		return err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// BackupCollection writes a tar.gz archive of a consistent copy of the collection to w
+func (c *Client) BackupCollection(collectionName string, w io.Writer) error {
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+	return cl.Backup(w)
+}
+
+// pauseWrites pauses the writes to the loaded collections of the client and of its open databases, and keeps collections
+// and databases from being loaded, added, removed or changed, until the returned func is called
+func (c *Client) pauseWrites() (func(), error) {
+	var resumes []func()
+	resume := func() {
+		for i := len(resumes) - 1; i >= 0; i-- {
+			resumes[i]()
+		}
+	}
+
+	c.collections.RLock()
+	resumes = append(resumes, c.collections.RUnlock)
+	for _, name := range c.collections.getNames() {
+		cl, isLoaded := c.collections.Store[name]
+		if !isLoaded {
+			continue
+		}
+		r, err := cl.PauseWrites()
+		if err != nil {
+			resume()
+			return nil, fmt.Errorf("could not pause the writes to collection %s: %w", name, err)
+		}
+		resumes = append(resumes, r)
+	}
+
+	if c.databases != nil {
+		c.databases.Lock()
+		resumes = append(resumes, c.databases.Unlock)
+		var dbNames []string
+		for dbName := range c.databases.Store {
+			dbNames = append(dbNames, dbName)
+		}
+		sort.Strings(dbNames)
+		for _, dbName := range dbNames {
+			r, err := c.databases.Store[dbName].pauseWrites()
+			if err != nil {
+				resume()
+				return nil, fmt.Errorf("database %s: %w", dbName, err)
+			}
+			resumes = append(resumes, r)
+		}
+	}
+
+	return resume, nil
+}
+
+// pausedClient gob-encodes a client while pauseWrites holds its collections, which GobEncode would lock again
+type pausedClient struct {
+	*Client
+}
+
+func (p pausedClient) GobEncode() ([]byte, error) {
+	return p.gobEncodeLocked()
+}
+
+// savePaused saves the meta of the client and of its open databases while their writes are paused by pauseWrites. The
+// meta has the IndexStores of the collections, which change with every write but are only saved now and then, and
+// would otherwise not match the indexes in the backup.
+func (c *Client) savePaused() error {
+	if c.isReadOnly() {
+		return nil
+	}
+	err := c.setMeta("globalClient.gob", pausedClient{c})
+	if err != nil {
+		return err
+	}
+	if c.databases == nil {
+		return nil
+	}
+	for dbName, db := range c.databases.Store {
+		err = db.savePaused()
+		if err != nil {
+			return fmt.Errorf("database %s: %w", dbName, err)
+		}
+	}
+	return nil
+}
+
+// isLeftOutOfBackup tells whether the file or dir at relPath, relative to the document root, is left out of a backup
+func isLeftOutOfBackup(relPath string, info os.FileInfo) bool {
+	if strings.HasPrefix(info.Name(), collection.TEMP_FILE_PREFIX) {
+		return true
+	}
+	// left behind by a snapshot restore, see getRestorePaths
+	if strings.Contains(info.Name(), "."+collection.TEMP_FILE_PREFIX) {
+		return true
+	}
+	if relPath == SNAPSHOTS_DIR_NAME || relPath == BACKUP_MANIFEST_FILE_NAME { // a manifest of a restored backup
+		return true
+	}
+	isDBSnapshots, _ := filepath.Match(util.JoinPath(DATABASES_DIR_NAME, "*", SNAPSHOTS_DIR_NAME), relPath)
+	return isDBSnapshots
+}
@@ -0,0 +1,282 @@
+package gofiledb
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/util"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/********************************************************************************
+* B A C K U P  V E R I F I C A T I O N
+*********************************************************************************/
+
+// VerifyBackup reads an archive written by Backup and checks, without restoring it, that it can be: that the archive
+// isn't cut short, that every file in its manifest is there with the same SHA-256, that the meta of the client and of
+// every database can be decoded, and that the file of every index is there. The indexes that aren't encrypted are read
+// too, and every document they point to must have its file in the archive (with STORAGE_FILES, and unless documents may
+// have been moved to the cold dir).
+//
+// Whatever is wrong is listed in the Problems of the report, so that a backup job can fail on a backup that isn't
+// restorable, and tell why. VerifyBackup only returns an error if r isn't a gzip stream at all.
+
+const (
+	BACKUP_PROBLEM_UNREADABLE_ARCHIVE  string = "unreadable_archive"  // the archive is cut short or corrupted
+	BACKUP_PROBLEM_MISSING_MANIFEST    string = "missing_manifest"    // e.g. written by an older version of gofiledb
+	BACKUP_PROBLEM_INVALID_MANIFEST    string = "invalid_manifest"    // the manifest can't be read, or is in a newer version
+	BACKUP_PROBLEM_MISSING_FILE        string = "missing_file"        // in the manifest, but not in the archive
+	BACKUP_PROBLEM_UNLISTED_FILE       string = "unlisted_file"       // in the archive, but not in the manifest
+	BACKUP_PROBLEM_CHECKSUM_MISMATCH   string = "checksum_mismatch"   // the SHA-256 of the file is not the one in the manifest
+	BACKUP_PROBLEM_MISSING_CLIENT_META string = "missing_client_meta" // the archive has no client meta to restore from
+	BACKUP_PROBLEM_UNREADABLE_META     string = "unreadable_meta"     // the client meta or a collection in it can't be decoded
+	BACKUP_PROBLEM_MISSING_INDEX       string = "missing_index"       // the file of an index is not in the archive
+	BACKUP_PROBLEM_UNREADABLE_INDEX    string = "unreadable_index"    // the file of an index can't be decoded
+	BACKUP_PROBLEM_DANGLING_INDEX_KEY  string = "dangling_index_key"  // an index points to a document that is not in the archive
+)
+
+var ErrInvalidBackup = fmt.Errorf("The data is not a backup archive")
+
+type BackupReport struct {
+	CreatedAt      time.Time // when the backup was taken, from its manifest
+	NumFiles       int
+	NumCollections int
+	NumDocuments   int // the document files, of the collections with STORAGE_FILES
+	NumIndexes     int
+	Problems       []BackupProblem
+}
+
+// BackupProblem is something wrong with a backup archive, Type being one of the BACKUP_PROBLEM_ constants
+type BackupProblem struct {
+	Type        string
+	Name        string // the name of the file in the archive, or of the collection, the problem is about
+	Description string
+}
+
+// IsRestorable returns whether no problem was found with the backup
+func (r BackupReport) IsRestorable() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *BackupReport) addProblem(problemType, name, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, BackupProblem{Type: problemType, Name: name, Description: fmt.Sprintf(format, args...)})
+}
+
+// VerifyBackup checks the backup archive read from r, see BackupReport
+func VerifyBackup(r io.Reader) (BackupReport, error) {
+	var report BackupReport
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return report, fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+	}
+	defer gz.Close()
+
+	// The files are hashed as they are read, and only the metas and the indexes are kept, since the documents are only
+	// checked against their checksums
+	sums := make(map[string]string)       // file name -> SHA-256
+	metas := make(map[string][]byte)      // file name -> client meta
+	indexFiles := make(map[string][]byte) // file name -> index
+	var manifestData []byte
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			report.addProblem(BACKUP_PROBLEM_UNREADABLE_ARCHIVE, "", "reading the archive: %s", err)
+			break
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		isManifest := strings.Count(hdr.Name, "/") == 1 && strings.HasSuffix(hdr.Name, "/"+BACKUP_MANIFEST_FILE_NAME)
+		isMeta := strings.HasSuffix(hdr.Name, "/"+util.META_DIR_NAME+"/globalClient.gob")
+		isIndex := strings.Contains(hdr.Name, "/"+collection.META_DIR_NAME+"/"+collection.INDEX_DIR_NAME+"/")
+		h := sha256.New()
+		var buf bytes.Buffer
+		w := io.Writer(h)
+		if isManifest || isMeta || isIndex {
+			w = io.MultiWriter(h, &buf)
+		}
+		_, err = io.Copy(w, tr)
+		if err != nil {
+			report.addProblem(BACKUP_PROBLEM_UNREADABLE_ARCHIVE, hdr.Name, "reading the file: %s", err)
+			break
+		}
+
+		switch {
+		case isManifest:
+			manifestData = buf.Bytes()
+			continue
+		case isMeta:
+			metas[hdr.Name] = buf.Bytes()
+		case isIndex:
+			indexFiles[hdr.Name] = buf.Bytes()
+		}
+		sums[hdr.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+	report.NumFiles = len(sums)
+
+	verifyBackupManifest(&report, manifestData, sums)
+
+	if len(metas) == 0 {
+		report.addProblem(BACKUP_PROBLEM_MISSING_CLIENT_META, "", "the archive has no client meta")
+	}
+	metaNames := make([]string, 0, len(metas))
+	for name := range metas {
+		metaNames = append(metaNames, name)
+	}
+	sort.Strings(metaNames)
+	for _, name := range metaNames {
+		verifyBackupClientMeta(&report, name, metas[name], sums, indexFiles)
+	}
+
+	return report, nil
+}
+
+// verifyBackupManifest checks the files read from the archive (file name -> SHA-256) against its manifest
+func verifyBackupManifest(report *BackupReport, data []byte, sums map[string]string) {
+	if data == nil {
+		report.addProblem(BACKUP_PROBLEM_MISSING_MANIFEST, "", "the archive has no %s", BACKUP_MANIFEST_FILE_NAME)
+		return
+	}
+	var manifest backupManifest
+	err := json.Unmarshal(data, &manifest)
+	if err != nil || manifest.Format != BACKUP_MANIFEST_FORMAT_NAME {
+		report.addProblem(BACKUP_PROBLEM_INVALID_MANIFEST, BACKUP_MANIFEST_FILE_NAME, "the manifest can't be read")
+		return
+	}
+	if manifest.Version > BACKUP_MANIFEST_FORMAT_VERSION {
+		report.addProblem(BACKUP_PROBLEM_INVALID_MANIFEST, BACKUP_MANIFEST_FILE_NAME, "version %d of the manifest is not supported", manifest.Version)
+		return
+	}
+	report.CreatedAt = manifest.CreatedAt
+
+	listed := make(map[string]bool, len(manifest.Files))
+	for _, f := range manifest.Files {
+		listed[f.Name] = true
+		sum, isInArchive := sums[f.Name]
+		if !isInArchive {
+			report.addProblem(BACKUP_PROBLEM_MISSING_FILE, f.Name, "the file is in the manifest but not in the archive")
+			continue
+		}
+		if sum != f.SHA256 {
+			report.addProblem(BACKUP_PROBLEM_CHECKSUM_MISMATCH, f.Name, "the SHA-256 of the file is %s, not %s", sum, f.SHA256)
+		}
+	}
+	var unlisted []string
+	for name := range sums {
+		if !listed[name] {
+			unlisted = append(unlisted, name)
+		}
+	}
+	sort.Strings(unlisted)
+	for _, name := range unlisted {
+		report.addProblem(BACKUP_PROBLEM_UNLISTED_FILE, name, "the file is in the archive but not in the manifest")
+	}
+}
+
+// verifyBackupClientMeta checks that the collections in the client meta metaName, that of the warehouse or of a
+// database, have their indexes in the archive, and that the indexes only point to documents in the archive
+func verifyBackupClientMeta(report *BackupReport, metaName string, data []byte, sums map[string]string, indexFiles map[string][]byte) {
+	// the dir of the warehouse or database in the archive, which the paths in its meta are relative to
+	prefix := strings.TrimSuffix(metaName, util.META_DIR_NAME+"/globalClient.gob")
+
+	var meta Client
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&meta)
+	if err != nil {
+		report.addProblem(BACKUP_PROBLEM_UNREADABLE_META, metaName, "decoding the client meta: %s", err)
+		return
+	}
+	var cls []*collection.Collection
+	for _, cl := range meta.collections.Store {
+		cls = append(cls, cl)
+	}
+	for name, clData := range meta.collections.Unloaded {
+		cl := new(collection.Collection)
+		err = cl.GobDecode(clData)
+		if err != nil {
+			report.addProblem(BACKUP_PROBLEM_UNREADABLE_META, name, "decoding collection %s in %s: %s", name, metaName, err)
+			continue
+		}
+		cls = append(cls, cl)
+	}
+	sort.Slice(cls, func(i, j int) bool { return cls[i].Name < cls[j].Name })
+
+	for _, cl := range cls {
+		report.NumCollections++
+		toArchiveName := func(path string) (string, error) {
+			relPath, err := filepath.Rel(meta.documentRoot, path)
+			if err != nil {
+				return "", err
+			}
+			return prefix + filepath.ToSlash(relPath), nil
+		}
+		clDirName, err := toArchiveName(cl.DirPath)
+		if err != nil {
+			report.addProblem(BACKUP_PROBLEM_UNREADABLE_META, cl.Name, "the dir of the collection is not in the warehouse: %s", err)
+			continue
+		}
+		dataDirName := clDirName + "/" + collection.DATA_DIR_NAME + "/"
+		hasDocFiles := cl.StorageEngine == collection.STORAGE_FILES && cl.NumPartitions > 0
+		if hasDocFiles {
+			for name := range sums {
+				if strings.HasPrefix(name, dataDirName) {
+					report.NumDocuments++
+				}
+			}
+		}
+
+		fieldLocators := make([]string, 0, len(cl.IndexStore.Store))
+		for fieldLocator := range cl.IndexStore.Store {
+			fieldLocators = append(fieldLocators, fieldLocator)
+		}
+		sort.Strings(fieldLocators)
+		for _, fieldLocator := range fieldLocators {
+			report.NumIndexes++
+			idxName, err := toArchiveName(cl.IndexStore.Store[fieldLocator].FilePath)
+			if err != nil {
+				report.addProblem(BACKUP_PROBLEM_UNREADABLE_META, cl.Name, "the file of index %s is not in the warehouse: %s", fieldLocator, err)
+				continue
+			}
+			idxData, isInArchive := indexFiles[idxName]
+			if !isInArchive {
+				report.addProblem(BACKUP_PROBLEM_MISSING_INDEX, idxName, "the index of collection %s on %s is not in the archive", cl.Name, fieldLocator)
+				continue
+			}
+			if cl.EncryptIndexes && cl.IsMissingEncryptionKey() {
+				continue // it can't be read without the key
+			}
+			var idx collection.Index
+			err = json.Unmarshal(idxData, &idx)
+			if err != nil {
+				report.addProblem(BACKUP_PROBLEM_UNREADABLE_INDEX, idxName, "decoding the index of collection %s on %s: %s", cl.Name, fieldLocator, err)
+				continue
+			}
+			if !hasDocFiles || cl.ColdAfter > 0 {
+				continue
+			}
+			for k := range idx.KeyValues {
+				docDirName := dataDirName + k.GetPartitionDirName(cl.NumPartitions) + "/"
+				_, isInArchive := sums[docDirName+k.GetFileName(cl.Name, false)]
+				_, isGzippedInArchive := sums[docDirName+k.GetFileName(cl.Name, true)]
+				if !isInArchive && !isGzippedInArchive {
+					report.addProblem(BACKUP_PROBLEM_DANGLING_INDEX_KEY, idxName, "the index of collection %s on %s has document %d, which is not in the archive", cl.Name, fieldLocator, k)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package gofiledb
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/util"
+	"os"
+	"sync"
+	"time"
+)
+
+/********************************************************************************
+* B Y T E  B U D G E T
+*********************************************************************************/
+
+// With ClientInitOptions.ByteBudget set, the client keeps the whole warehouse (every file in the document root,
+// including the databases, indexes and meta files) within that many bytes, so that collections used as a cache can't
+// take the disk space that the rest of the application needs. Every ByteBudgetCheckInterval, and whenever
+// EnforceByteBudget is called, the size of the warehouse is measured, and if it is over the budget, documents are evicted
+// from the collections marked Evictable, one at a time from each in turn, each by its EvictionPolicy (see
+// Collection.EvictNext), until it is within the budget again. Every collection that documents were evicted from is
+// reported to ClientInitOptions.ByteBudgetHandler, and GetByteBudgetStats tells how much has been evicted.
+//
+// The collections that haven't been loaded since the client was initialized (see loadCollection) are not evicted from,
+// since they haven't grown since. Read-only clients don't enforce a budget.
+
+const DEFAULT_BYTE_BUDGET_CHECK_INTERVAL time.Duration = time.Minute
+
+var ErrByteBudgetNotSet = fmt.Errorf("The client does not have a ByteBudget")
+
+// ByteBudgetEviction tells that documents have been evicted from a collection to keep the warehouse within its budget
+type ByteBudgetEviction struct {
+	Collection string // "<database>/<collection>" for the collections of a database
+	NumEvicted int
+	NumBytes   int64 // the stored size of the documents evicted
+}
+
+// ByteBudgetStats are the numbers of the byte budget of a client, since it was initialized
+type ByteBudgetStats struct {
+	ByteBudget      int64
+	UsedBytes       int64     // the size of the warehouse, as of the last check
+	LastCheckAt     time.Time // zero if the warehouse hasn't been checked yet
+	NumOverBudget   int64     // checks that found the warehouse over its budget
+	NumEvicted      int64     // documents evicted
+	NumEvictedBytes int64     // the stored size of the documents evicted
+}
+
+type byteBudget struct {
+	maxBytes    int64
+	interval    time.Duration
+	handler     func(e ByteBudgetEviction)
+	stats       ByteBudgetStats
+	statsLock   sync.Mutex
+	enforceLock sync.Mutex    // held while enforcing the budget, so that it isn't enforced twice at the same time
+	stop        chan struct{} // closed to stop the background checks, see startByteBudget
+	done        chan struct{} // closed once they have stopped
+}
+
+// evictableCollection is a collection that EnforceByteBudget may evict documents from
+type evictableCollection struct {
+	name string
+	cl   *collection.Collection
+}
+
+// newByteBudget returns the byte budget set in p, or nil if there is none
+func newByteBudget(p ClientInitOptions) *byteBudget {
+	if p.ByteBudget <= 0 {
+		return nil
+	}
+	interval := p.ByteBudgetCheckInterval
+	if interval <= 0 {
+		interval = DEFAULT_BYTE_BUDGET_CHECK_INTERVAL
+	}
+	return &byteBudget{
+		maxBytes: p.ByteBudget,
+		interval: interval,
+		handler:  p.ByteBudgetHandler,
+		stats:    ByteBudgetStats{ByteBudget: p.ByteBudget},
+	}
+}
+
+// startByteBudget starts checking the byte budget in the background, if the client has one
+func (c *Client) startByteBudget() {
+	b := c.budget
+	if b == nil || c.isReadOnly() {
+		return
+	}
+	b.stop, b.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(b.done)
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, err := c.EnforceByteBudget()
+				if err != nil {
+					util.Warnf("Error while enforcing the byte budget in the background: %s", err)
+				}
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopByteBudget stops the background checks of the byte budget, and waits for the one in progress to finish
+func (c *Client) stopByteBudget() {
+	b := c.budget
+	if b == nil || b.stop == nil {
+		return
+	}
+	close(b.stop)
+	<-b.done
+	b.stop = nil
+}
+
+// EnforceByteBudget measures the size of the warehouse, and evicts documents from the Evictable collections until it is
+// within the ByteBudget of the client. It returns the number of documents evicted.
+func (c *Client) EnforceByteBudget() (int, error) {
+	b := c.budget
+	if b == nil {
+		return 0, ErrByteBudgetNotSet
+	}
+	if c.isReadOnly() {
+		return 0, ErrClientIsReadOnly
+	}
+
+	b.enforceLock.Lock()
+	defer b.enforceLock.Unlock()
+
+	usedBytes, err := c.getWarehouseSize()
+	if err != nil {
+		return 0, err
+	}
+	isOver := usedBytes > b.maxBytes
+
+	var evictions []ByteBudgetEviction
+	var numEvicted int
+	var numEvictedBytes int64
+	var evictErr error
+	if isOver {
+		candidates := c.getEvictableCollections()
+		evictions = make([]ByteBudgetEviction, len(candidates))
+		isDone := make([]bool, len(candidates))
+		numLeft := len(candidates)
+		excessBytes := usedBytes - b.maxBytes
+		for i := 0; excessBytes > 0 && numLeft > 0; i = (i + 1) % len(candidates) {
+			if isDone[i] {
+				continue
+			}
+			n, ok, err := candidates[i].cl.EvictNext()
+			if err != nil && err != collection.ErrCollectionIsFrozen && evictErr == nil {
+				evictErr = fmt.Errorf("could not evict from collection %s: %w", candidates[i].name, err)
+			}
+			if err != nil || !ok {
+				isDone[i] = true
+				numLeft--
+				continue
+			}
+			evictions[i].Collection = candidates[i].name
+			evictions[i].NumEvicted++
+			evictions[i].NumBytes += n
+			numEvicted++
+			numEvictedBytes += n
+			excessBytes -= n
+		}
+
+		if numEvicted > 0 {
+			usedBytes, err = c.getWarehouseSize()
+			if err != nil {
+				return numEvicted, err
+			}
+		}
+		if usedBytes > b.maxBytes {
+			util.Warnf("The warehouse takes %d bytes, over its budget of %d bytes, and there is nothing left to evict", usedBytes, b.maxBytes)
+		}
+	}
+
+	b.statsLock.Lock()
+	b.stats.UsedBytes = usedBytes
+	b.stats.LastCheckAt = time.Now()
+	if isOver {
+		b.stats.NumOverBudget++
+	}
+	b.stats.NumEvicted += int64(numEvicted)
+	b.stats.NumEvictedBytes += numEvictedBytes
+	b.statsLock.Unlock()
+
+	for _, e := range evictions {
+		if e.NumEvicted == 0 {
+			continue
+		}
+		util.Infof("Evicted %d documents (%d bytes) from collection %s to stay within the byte budget", e.NumEvicted, e.NumBytes, e.Collection)
+		if b.handler != nil {
+			b.handler(e)
+		}
+	}
+
+	return numEvicted, evictErr
+}
+
+// GetByteBudgetStats returns the numbers of the byte budget of the client
+func (c *Client) GetByteBudgetStats() (ByteBudgetStats, error) {
+	b := c.budget
+	if b == nil {
+		return ByteBudgetStats{}, ErrByteBudgetNotSet
+	}
+	b.statsLock.Lock()
+	defer b.statsLock.Unlock()
+	return b.stats, nil
+}
+
+// getWarehouseSize returns the total size of the files in the document root
+func (c *Client) getWarehouseSize() (int64, error) {
+	var size int64
+	err := util.Walk(c.fs(), c.getDocumentRoot(), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) { // removed while walking
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// getEvictableCollections returns the loaded collections marked Evictable, of the client and of its open databases
+func (c *Client) getEvictableCollections() []evictableCollection {
+	var candidates []evictableCollection
+	add := func(prefix string, store *collectionStore) {
+		store.RLock()
+		defer store.RUnlock()
+		for _, name := range store.getNames() {
+			if cl, ok := store.Store[name]; ok && cl.Evictable {
+				candidates = append(candidates, evictableCollection{name: prefix + name, cl: cl})
+			}
+		}
+	}
+
+	add("", c.collections)
+	if c.databases != nil {
+		c.databases.Lock()
+		for dbName, db := range c.databases.Store {
+			add(dbName+"/", db.collections)
+		}
+		c.databases.Unlock()
+	}
+	return candidates
+}
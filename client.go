@@ -2,13 +2,15 @@ package gofiledb
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"fmt"
-	"github.com/teejays/clog"
 	"github.com/teejays/gofiledb/collection"
 	"github.com/teejays/gofiledb/key"
 	"github.com/teejays/gofiledb/util"
+	"go.opentelemetry.io/otel/trace"
 	"io"
+	"io/fs"
 	"math/rand"
 	"os"
 	"reflect"
@@ -26,6 +28,7 @@ var globalClientLock sync.RWMutex
 // Errors
 var ErrClientAlreadyInitialized error = fmt.Errorf("Attempted to initialie GoFileDb client more than once")
 var ErrClientNotInitialized error = fmt.Errorf("GoFiledb client fetched called without initializing the client")
+var ErrAlterCannotRename error = fmt.Errorf("AlterCollection cannot change the name of a collection, use RenameCollection instead")
 
 /********************************************************************************
 * C L I E N T
@@ -35,11 +38,46 @@ var ErrClientNotInitialized error = fmt.Errorf("GoFiledb client fetched called w
 type Client struct {
 	isInitialized bool // IsInitialized ensures that we don't initialize the client more than once, since doing that could lead to issues
 	collections   *collectionStore
+	lock          *documentRootLock // lock on the document root, held until the client is closed
+	auditActor    string            // see ClientInitOptions.AuditActor
+	// see ClientInitOptions.WriteErrorHandler
+	writeErrorHandler func(collectionName string, k Key, err error)
+	ioLimiter         *collection.IOLimiter // only used if ClientInitOptions.MaxConcurrentIO is set
+	walArchiver       WALArchiver           // see ClientInitOptions.WALArchiver
+	// see ClientInitOptions.DefaultNumPartitions
+	defaultNumPartitions int
+	// see ClientInitOptions.HealthMinFreeBytes
+	healthMinFreeBytes uint64
+	// see ClientInitOptions.CollectionNameRules
+	nameRules  collection.NameRules
+	isInMemory bool    // see ClientInitOptions.InMemory and removeMemoryData
+	fsys       util.FS // see ClientInitOptions.FS, or the util.MemFS of an in-memory client
+	// see Use
+	hooks *hookStore
+	// see Subscribe
+	subscriptions *subscriptionStore
+	// see DB. Only set for the main client, as databases can't be nested.
+	databases *databaseStore
+	// see ClientInitOptions.EncryptionKeys, kept for the collections that haven't been loaded yet, and the ones of the
+	// databases that haven't been opened yet
+	encryptionKeys         map[string][]byte
+	previousEncryptionKeys map[string][]byte
+	// see ClientInitOptions.ByteBudget. Only set for the main client, as it covers the databases.
+	budget *byteBudget
+	// see ScheduleSnapshots
+	snapshotSchedules *snapshotScheduleStore
+	// see AddWebhook
+	webhooks *webhookStore
+	// see MetricsHandler
+	metrics *metricsStore
+	tracer  trace.Tracer // see ClientInitOptions.TracerProvider
 	ClientParams
 }
 
 type collectionStore struct {
-	Store map[string]collection.Collection
+	Store    map[string]*collection.Collection // the collections that have been loaded
+	Unloaded map[string][]byte                 // name -> encoded collection, for the ones that haven't, see loadCollection
+	Aliases  map[string]string                 // alias -> collection name, see AddAlias
 	sync.RWMutex
 }
 
@@ -51,6 +89,13 @@ type clientParamsGob struct {
 	DocumentRoot string
 }
 
+type clientGob struct {
+	Params         ClientParams
+	Collections    map[string]*collection.Collection // only set in the metas saved before layout version 3
+	CollectionGobs map[string][]byte                 // name -> encoded collection
+	Aliases        map[string]string
+}
+
 func NewClientParams(documentRoot string) ClientParams {
 	var params ClientParams = ClientParams{
 		documentRoot: documentRoot,
@@ -58,14 +103,14 @@ func NewClientParams(documentRoot string) ClientParams {
 	return params
 }
 
-func (p ClientParams) validate() error {
+func (p ClientParams) validate(fsys util.FS) error {
 	// documentRoot shall not be totally white
 	if strings.TrimSpace(p.documentRoot) == "" {
 		return fmt.Errorf("Empty documentRoot field provided")
 	}
 
 	// documentRoot shall exist as a directory
-	info, err := os.Stat(p.documentRoot)
+	info, err := fsys.Stat(p.documentRoot)
 	if os.IsNotExist(err) {
 		return fmt.Errorf("no directory found at path %s", p.documentRoot)
 	}
@@ -117,12 +162,96 @@ func (p *ClientParams) GobDecode(b []byte) error {
 	return nil
 }
 
-// GetClient returns the current instance of the client for the application. It panics if the client has not been initialized.
-func GetClient() *Client {
+// Client embeds ClientParams, and would otherwise use its GobEncode function and only save the params.
+// We also need to save the registered collections.
+func (c Client) GobEncode() ([]byte, error) {
+	if c.collections != nil {
+		c.collections.RLock()
+		defer c.collections.RUnlock()
+	}
+	return c.gobEncodeLocked()
+}
+
+// gobEncodeLocked does the work for GobEncode. It should be called while holding a lock on c.collections.
+func (c Client) gobEncodeLocked() ([]byte, error) {
+	var cGob clientGob = clientGob{
+		Params: c.ClientParams,
+	}
+	if c.collections != nil {
+		cGob.CollectionGobs = make(map[string][]byte, len(c.collections.Store)+len(c.collections.Unloaded))
+		// Collections that haven't been loaded can't have changed
+		for name, data := range c.collections.Unloaded {
+			cGob.CollectionGobs[name] = data
+		}
+		for name, cl := range c.collections.Store {
+			data, err := cl.GobEncode()
+			if err != nil {
+				return nil, err
+			}
+			cGob.CollectionGobs[name] = data
+		}
+		cGob.Aliases = make(map[string]string, len(c.collections.Aliases))
+		for alias, collectionName := range c.collections.Aliases {
+			cGob.Aliases[alias] = collectionName
+		}
+	}
+
+	buff := bytes.NewBuffer(nil)
+	enc := gob.NewEncoder(buff)
+	err := enc.Encode(cGob)
+	if err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+func (c *Client) GobDecode(b []byte) error {
+	var cGob clientGob
+
+	buff := bytes.NewBuffer(b)
+	dec := gob.NewDecoder(buff)
+	err := dec.Decode(&cGob)
+	if err != nil {
+		// Before layout version 1, only the params were saved (with the GobEncode of ClientParams), and the collections
+		// are registered from their dirs by the layout migration
+		var params ClientParams
+		if params.GobDecode(b) != nil {
+			return err
+		}
+		cGob = clientGob{Params: params}
+	}
+
+	c.ClientParams = cGob.Params
+	c.collections = new(collectionStore)
+	c.collections.Store = cGob.Collections
+	if c.collections.Store == nil {
+		c.collections.Store = make(map[string]*collection.Collection)
+	}
+	c.collections.Unloaded = cGob.CollectionGobs
+	c.collections.Aliases = cGob.Aliases
+	// only an initialized client is ever saved
+	c.isInitialized = true
+
+	return nil
+}
+
+// GetClientE returns the current instance of the client for the application, or ErrClientNotInitialized if the client
+// has not been initialized.
+func GetClientE() (*Client, error) {
 	if !(&globalClient).isInitialized {
-		panic("GoFiledb client fetched called without initializing the client")
+		return nil, ErrClientNotInitialized
+	}
+	return &globalClient, nil
+}
+
+// GetClient is GetClientE for callers that know the client has been initialized. It panics if it hasn't. It is kept for
+// backward compatibility, and new code should use GetClientE.
+func GetClient() *Client {
+	c, err := GetClientE()
+	if err != nil {
+		panic(err.Error())
 	}
-	return &globalClient
+	return c
 }
 
 /*** Local Getters & Setters ***/
@@ -137,22 +266,78 @@ func (c *Client) getCollections() *collectionStore {
 	return c.collections
 }
 
+// setupCollection applies the client settings that are not saved with a collection, for a collection that is being
+// added to the client
+func (c *Client) setupCollection(cl *collection.Collection) {
+	if c.auditActor != "" {
+		cl.SetAuditActor(c.auditActor)
+	}
+	if c.writeErrorHandler != nil {
+		fn, collectionName := c.writeErrorHandler, cl.Name
+		cl.SetWriteErrorHandler(func(k key.Key, err error) { fn(collectionName, Key(k), err) })
+	}
+	if c.ioLimiter != nil {
+		cl.SetIOLimiter(c.ioLimiter)
+	}
+	if c.walArchiver != nil {
+		fn, collectionName := c.walArchiver, cl.Name
+		cl.SetWALArchiver(func(segmentName string, r io.Reader) error { return fn(collectionName, segmentName, r) })
+	}
+	if c.fsys != nil {
+		cl.SetFS(c.fsys)
+	}
+	if c.subscriptions != nil {
+		cl.SetChangeHandler(c.subscriptions.getChangeHandler(cl.Name))
+	}
+}
+
+// getCollectionByName returns the collection collectionName, which can also be an alias. The collection is loaded if it
+// hasn't been used yet, see loadCollection.
 func (c *Client) getCollectionByName(_collectionName string) (*collection.Collection, error) {
-	c.collections.RLock()
-	defer c.collections.RUnlock()
+	collectionName := collection.NormalizeName(_collectionName)
 
-	collectionName := strings.ToLower(_collectionName)
+	c.collections.RLock()
+	if target, isAlias := c.collections.Aliases[collectionName]; isAlias {
+		collectionName = target
+	}
 	cl, hasKey := c.collections.Store[collectionName]
-	if !hasKey {
+	_, isUnloaded := c.collections.Unloaded[collectionName]
+	c.collections.RUnlock()
+	if hasKey {
+		return cl, nil
+	}
+	if !isUnloaded {
 		return nil, collection.ErrCollectionIsNotExist
 	}
-	return &cl, nil
+	return c.loadCollection(collectionName)
 }
 
 func (c *Client) Destroy() error {
+	if c.isReadOnly() {
+		return ErrClientIsReadOnly
+	}
+
 	// remove everything related to this client, and refresh it
-	clog.Debugf("Destroying all the data at: %s", c.documentRoot)
-	err := os.RemoveAll(c.getDocumentRoot())
+	util.Debugf("Destroying all the data at: %s", c.documentRoot)
+
+	// Stop any background work of the collections before removing their data
+	c.closeDatabases()
+	if c.collections != nil {
+		c.collections.RLock()
+		for _, cl := range c.collections.Store {
+			err := cl.Close()
+			if err != nil {
+				util.Warnf("Error while closing collection %s: %s", cl.Name, err)
+			}
+		}
+		c.collections.RUnlock()
+	}
+
+	err := c.fs().RemoveAll(c.getDocumentRoot())
+	if err != nil {
+		return err
+	}
+	err = c.lock.unlock()
 	if err != nil {
 		return err
 	}
@@ -161,49 +346,222 @@ func (c *Client) Destroy() error {
 }
 
 func (c *Client) FlushAll() error {
-	return os.RemoveAll(c.documentRoot)
+	if c.isReadOnly() {
+		return ErrClientIsReadOnly
+	}
+	return c.fs().RemoveAll(c.documentRoot)
 }
 
 func (c *Client) save() error {
-	return c.setMeta("globalClient.gob", globalClient)
+	if c.isReadOnly() {
+		return ErrClientIsReadOnly
+	}
+	return c.setMeta("globalClient.gob", c)
 }
 
+// The client meta is written to a temp file which is then renamed into place, so a crash while saving can never leave
+// a partially written meta behind. The previous version of the meta is kept (with META_PREVIOUS_FILE_EXTENSION), and
+// is used if the current one can't be read.
+
+const META_PREVIOUS_FILE_EXTENSION string = ".prev"
+
+// RENAME_META_NAME is the client meta that records a collection rename in progress, see RenameCollection
+const RENAME_META_NAME string = "rename.gob"
+
+// ALTER_META_NAME is the client meta that records a collection alteration in progress, see AlterCollection
+const ALTER_META_NAME string = "alter.gob"
+
 func (c *Client) setMeta(metaName string, v interface{}) error {
-	clog.Debugf("Saving client meta: %s", metaName)
-	file, err := os.Create(util.JoinPath(c.getDocumentRoot(), util.META_DIR_NAME, metaName))
+	util.Debugf("Saving client meta: %s", metaName)
+	dirPath := util.JoinPath(c.getDocumentRoot(), util.META_DIR_NAME)
+	path := util.JoinPath(dirPath, metaName)
+
+	file, err := util.TempFile(c.fs(), dirPath, collection.TEMP_FILE_PREFIX+metaName)
 	if err != nil {
 		return err
 	}
+	tmpPath := file.Name()
 
 	enc := gob.NewEncoder(file)
 	err = enc.Encode(v)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		c.fs().Remove(tmpPath)
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		c.fs().Remove(tmpPath)
+		return err
+	}
+
+	// Keep the current meta as the previous generation. It is linked rather than moved, so that there is a current meta
+	// at all times.
+	prevPath := path + META_PREVIOUS_FILE_EXTENSION
+	err = c.fs().Remove(prevPath)
+	if err != nil && !os.IsNotExist(err) {
+		c.fs().Remove(tmpPath)
+		return err
+	}
+	err = c.fs().Link(path, prevPath)
+	if err != nil && !os.IsNotExist(err) {
+		c.fs().Remove(tmpPath)
+		return err
+	}
+
+	err = c.fs().Rename(tmpPath, path)
 	if err != nil {
+		c.fs().Remove(tmpPath)
 		return err
 	}
+	return util.SyncFile(c.fs(), dirPath)
+}
+
+// removeMeta removes a client meta, along with its previous version
+func (c *Client) removeMeta(metaName string) error {
+	path := util.JoinPath(c.getDocumentRoot(), util.META_DIR_NAME, metaName)
+	for _, p := range []string{path, path + META_PREVIOUS_FILE_EXTENSION} {
+		err := c.fs().Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	return nil
 }
 
 func (c *Client) getMeta(metaName string, v interface{}) error {
-	clog.Debugf("Getting client meta: %s", metaName)
-	file, err := os.Open(util.JoinPath(c.getDocumentRoot(), util.META_DIR_NAME, metaName))
+	util.Debugf("Getting client meta: %s", metaName)
+	path := util.JoinPath(c.getDocumentRoot(), util.META_DIR_NAME, metaName)
+
+	err := c.decodeMetaFile(path, v)
+	if err == nil {
+		return nil
+	}
+
+	// Fall back to the previous generation, unless there has never been a meta
+	prevErr := c.decodeMetaFile(path+META_PREVIOUS_FILE_EXTENSION, v)
+	if prevErr == nil {
+		util.Warnf("Could not read client meta %s, using its previous version instead: %s", metaName, err)
+		return nil
+	}
+	if os.IsNotExist(prevErr) {
+		return err
+	}
+	return fmt.Errorf("could not read client meta %s (%w), or its previous version (%w)", metaName, err, prevErr)
+}
+
+func (c *Client) decodeMetaFile(path string, v interface{}) error {
+	file, err := c.fs().Open(path)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
+
 	dec := gob.NewDecoder(file)
-	err = dec.Decode(v)
+	return dec.Decode(v)
+}
+
+// recover runs the crash recovery pass on the client and the collections that have been loaded, once it has been loaded
+// from disk. The other collections are recovered when they are loaded, see loadCollection.
+func (c *Client) recover() error {
+	n, err := c.removeTempFiles()
 	if err != nil {
 		return err
 	}
+	if n > 0 {
+		util.Warnf("Recovery: removed %d temp files left behind by interrupted operations", n)
+	}
+
+	n, err = c.recoverRestores()
+	if err != nil {
+		return fmt.Errorf("error while recovering snapshot restores: %w", err)
+	}
+	if n > 0 {
+		util.Warnf("Recovery: recovered %d interrupted snapshot restores", n)
+	}
+
+	err = c.recoverRename()
+	if err != nil {
+		return fmt.Errorf("error while recovering a collection rename: %w", err)
+	}
+
+	err = c.recoverAlter()
+	if err != nil {
+		return fmt.Errorf("error while recovering a collection alteration: %w", err)
+	}
+
+	// i.e. the ones loaded by the passes above, or all of them if the meta predates lazy loading
+	c.collections.RLock()
+	var cls []*collection.Collection
+	for _, cl := range c.collections.Store {
+		cls = append(cls, cl)
+	}
+	c.collections.RUnlock()
+
+	var save bool
+	for _, cl := range cls {
+		isFixed, err := c.recoverCollection(cl)
+		if err != nil {
+			return err
+		}
+		if isFixed {
+			save = true // index info may have changed
+		}
+	}
+
+	if save {
+		return c.save()
+	}
 	return nil
 }
 
+// removeTempFiles removes the temp files and dirs that the client (rather than a collection) creates, which are left
+// behind if the process crashes before they are renamed into place. It returns the number of files and dirs removed.
+func (c *Client) removeTempFiles() (int, error) {
+	var numRemoved int
+
+	for _, dirPath := range []string{util.JoinPath(c.documentRoot, util.META_DIR_NAME), c.getSnapshotsDirPath()} {
+		fileInfos, err := util.ReadDir(c.fs(), dirPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return numRemoved, err
+		}
+
+		for _, fileInfo := range fileInfos {
+			if !strings.HasPrefix(fileInfo.Name(), collection.TEMP_FILE_PREFIX) {
+				continue
+			}
+			path := util.JoinPath(dirPath, fileInfo.Name())
+			util.Warnf("Recovery: removing temp file left behind by an interrupted operation: %s", path)
+			err = c.fs().RemoveAll(path)
+			if err != nil {
+				return numRemoved, err
+			}
+			numRemoved++
+		}
+	}
+
+	return numRemoved, nil
+}
+
 /********************************************************************************
 * C L I E N T  <->  C O L L E C T I O N
 *********************************************************************************/
 
 func (c *Client) AddCollection(_p CollectionProps) error {
+	if c.isReadOnly() {
+		return ErrClientIsReadOnly
+	}
 
 	p := collection.CollectionProps(_p)
+	if p.NumPartitions == 0 {
+		p.NumPartitions = c.defaultNumPartitions
+	}
 
 	// Sanitize the collection props
 	p = p.Sanitize()
@@ -213,33 +571,42 @@ func (c *Client) AddCollection(_p CollectionProps) error {
 	if err != nil {
 		return err
 	}
+	err = c.nameRules.Validate(p.Name)
+	if err != nil {
+		return err
+	}
 
 	// Create a Colelction and add to registered collections
-	var cl collection.Collection
+	cl := new(collection.Collection)
 	cl.CollectionProps = p
+	c.setupCollection(cl)
 
 	// Don't repeat collection names
 	c.collections.RLock()
-	_, hasKey := c.collections.Store[p.Name]
+	hasKey := c.collections.has(p.Name)
+	_, isAlias := c.collections.Aliases[p.Name]
 	c.collections.RUnlock()
 	if hasKey {
 		return collection.ErrCollectionIsExist
 	}
+	if isAlias {
+		return ErrAliasIsExist
+	}
 
 	// Create the required dir paths for this collection
 	cl.DirPath = c.getDirPathForCollection(p.Name)
 
 	// create the dirs for the collection
-	err = util.CreateDirIfNotExist(util.JoinPath(cl.DirPath, util.DATA_DIR_NAME))
+	err = util.CreateDirIfNotExist(c.fs(), util.JoinPath(cl.DirPath, util.DATA_DIR_NAME))
 	if err != nil {
 		return err
 	}
-	err = util.CreateDirIfNotExist(util.JoinPath(cl.DirPath, util.META_DIR_NAME))
+	err = util.CreateDirIfNotExist(c.fs(), util.JoinPath(cl.DirPath, util.META_DIR_NAME))
 	if err != nil {
 		return err
 	}
 
-	err = util.CreateDirIfNotExist(cl.GetDirPathForIndexes())
+	err = util.CreateDirIfNotExist(c.fs(), cl.GetDirPathForIndexes())
 	if err != nil {
 		return err
 	}
@@ -247,16 +614,26 @@ func (c *Client) AddCollection(_p CollectionProps) error {
 	// Initialize the IndexStore, which stores info on the indexes associated with this Collection
 	cl.IndexStore.Store = make(map[string]collection.IndexInfo)
 
+	// If we crashed while applying an op the last time this collection was used, apply it now
+	if cl.EnableWAL {
+		n, err := cl.ReplayWAL()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			util.Warnf("Replayed %d uncommitted ops from the WAL of collection %s", n, p.Name)
+		}
+	}
+
 	// Register the Collection
 
 	c.collections.Lock()
-	defer c.collections.Unlock()
-
 	// Initialize the collection store if not initialized (but it should already be initialized because of the Initialize() function)
 	if c.collections.Store == nil {
-		c.collections.Store = make(map[string]collection.Collection)
+		c.collections.Store = make(map[string]*collection.Collection)
 	}
 	c.collections.Store[p.Name] = cl
+	c.collections.Unlock()
 
 	// Save the client to disk
 	err = c.save()
@@ -267,22 +644,48 @@ func (c *Client) AddCollection(_p CollectionProps) error {
 	return nil
 }
 
+// addCollectionWithProps adds the collection with props taken from elsewhere, e.g. from another client, unless it
+// exists already. The encryption keys are the ones given to the client for the collection, if any, since they are never
+// taken along with the props.
+func (c *Client) addCollectionWithProps(collectionName string, props collection.CollectionProps) error {
+	_, err := c.getCollectionByName(collectionName)
+	if err != ErrCollectionIsNotExist {
+		return err
+	}
+	props.Name = collectionName
+	p := ClientInitOptions{EncryptionKeys: c.encryptionKeys, PreviousEncryptionKeys: c.previousEncryptionKeys}
+	props.EncryptionKey, props.PreviousEncryptionKey = getEncryptionKeysFromOptions(p, collection.NormalizeName(collectionName))
+	if len(props.EncryptionKey) == 0 {
+		props.EncryptIndexes = false
+	}
+	return c.AddCollection(CollectionProps(props))
+}
+
 func (c *Client) RemoveCollection(collectionName string) error {
 
-	cl, err := c.getCollectionByName(collectionName)
+	cl, err := c.getWritableCollectionByName(collectionName)
 	if err != nil {
 		return err
 	}
 
 	// Unregister the collection from the Client's Collection Store
+	util.Infof("Removing collection registration...")
 	c.collections.Lock()
-	defer c.collections.Unlock()
-	clog.Infof("Removing collection registration...")
-	delete(c.collections.Store, collectionName)
+	if c.hasAliases(cl.Name) {
+		c.collections.Unlock()
+		return ErrCollectionHasAliases
+	}
+	delete(c.collections.Store, cl.Name)
+	c.collections.Unlock()
+
+	err = cl.Close()
+	if err != nil {
+		return err
+	}
 
 	// Delete all the data & meta dirs for that collection
-	clog.Infof("Deleting data at %s...", cl.DirPath)
-	err = os.RemoveAll(cl.DirPath)
+	util.Infof("Deleting data at %s...", cl.DirPath)
+	err = c.fs().RemoveAll(cl.DirPath)
 	if err != nil {
 		return err
 	}
@@ -296,113 +699,670 @@ func (c *Client) RemoveCollection(collectionName string) error {
 	return nil
 }
 
-func (c *Client) IsCollectionExist(collectionName string) (bool, error) {
-	collectionName = strings.TrimSpace(collectionName)
-	collectionName = strings.ToLower(collectionName)
+// RenameCollection renames a collection, along with its dir and the files of its documents. Snapshots taken before the
+// rename still restore the collection under its old name, and the encryption key of an encrypted collection needs to be
+// provided under the new name from then on. Looking up any collection of the client waits until the rename is done.
+func (c *Client) RenameCollection(oldName string, newName string) error {
 
-	_, err := c.getCollectionByName(collectionName)
+	cl, err := c.getWritableCollectionByName(oldName)
+	if err != nil {
+		return err
+	}
 
-	if err == collection.ErrCollectionIsNotExist {
-		return false, nil
+	p := cl.CollectionProps
+	p.Name = newName
+	p = p.Sanitize()
+	err = p.Validate()
+	if err != nil {
+		return err
+	}
+	if p.Name == cl.Name {
+		return nil
 	}
+	err = c.nameRules.Validate(p.Name)
 	if err != nil {
-		return false, err
+		return err
 	}
-	return true, nil
 
-}
+	// The rename is recorded first, so that the recovery pass can finish it if it is interrupted
+	c.collections.Lock()
+	if c.collections.has(p.Name) {
+		c.collections.Unlock()
+		return collection.ErrCollectionIsExist
+	}
+	if _, isAlias := c.collections.Aliases[p.Name]; isAlias {
+		c.collections.Unlock()
+		return ErrAliasIsExist
+	}
+	err = c.setMeta(RENAME_META_NAME, renameInfo{OldName: cl.Name, NewName: p.Name})
+	if err == nil {
+		err = c.finishRename(cl, p.Name)
+	}
+	c.collections.Unlock()
+	if err != nil {
+		return err
+	}
 
-/********************************************************************************
-* W R I T E R S
-*********************************************************************************/
+	err = c.save()
+	if err != nil {
+		return err
+	}
+	return c.removeMeta(RENAME_META_NAME)
+}
 
-func (c *Client) Set(collectionName string, k Key, data []byte) error {
+// renameInfo is what is recorded about a rename in progress, see RenameCollection
+type renameInfo struct {
+	OldName string
+	NewName string
+}
 
-	cl, err := c.getCollectionByName(collectionName)
+// finishRename renames cl to newName, and registers it under its new name. It should be called while holding the lock of
+// c.collections. It can be called again if it is interrupted.
+func (c *Client) finishRename(cl *collection.Collection, newName string) error {
+	err := cl.Close()
+	if err != nil {
+		return err
+	}
+	err = cl.Rename(newName, c.getDirPathForCollection(newName))
 	if err != nil {
 		return err
 	}
 
-	return cl.Set(key.Key(k), data)
+	for name, other := range c.collections.Store {
+		if other == cl {
+			delete(c.collections.Store, name)
+			c.moveAliases(name, newName)
+		}
+	}
+	c.collections.Store[newName] = cl
+	return nil
 }
 
-func (c *Client) SetStruct(collectionName string, k Key, v interface{}) error {
+// recoverRename finishes a RenameCollection that was interrupted
+func (c *Client) recoverRename() error {
+	var info renameInfo
+	err := c.getMeta(RENAME_META_NAME, &info)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-	cl, err := c.getCollectionByName(collectionName)
+	c.collections.Lock()
+	cl, hasKey, err := c.getCollectionLocked(info.OldName)
+	if err == nil && !hasKey {
+		cl, hasKey, err = c.getCollectionLocked(info.NewName)
+	}
+	if err == nil && hasKey {
+		util.Warnf("Recovery: finishing the interrupted rename of collection %s to %s", info.OldName, info.NewName)
+		err = c.finishRename(cl, info.NewName)
+	}
+	c.collections.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = c.save()
 	if err != nil {
 		return err
 	}
+	return c.removeMeta(RENAME_META_NAME)
+}
 
-	return cl.SetFromStruct(key.Key(k), v)
+// CloneOptions changes how the clone made by CloneCollection stores its documents. The zero value keeps everything the
+// same as in the source collection.
+type CloneOptions struct {
+	NumPartitions         int   // if > 0, the clone uses this many partitions
+	EnableGzipCompression *bool // if set, whether the clone gzip compresses its documents
 }
 
-/********************************************************************************
-* R E A D E R S
-*********************************************************************************/
+// CloneCollection adds a collection named dst, with the props, documents, indexes and meta entries of the collection
+// src. Documents that are written to src while it is being cloned may or may not make it to the clone, and revisions,
+// audit trails and quarantined documents are not cloned. The clone of an encrypted collection uses the same key, which
+// needs to be provided under the name of the clone from then on. If cloning fails, the partial clone is removed.
+func (c *Client) CloneCollection(src string, dst string, opts CloneOptions) error {
 
-func (c *Client) GetFile(collectionName string, k Key) (*os.File, error) {
-	cl, err := c.getCollectionByName(collectionName)
+	srcCl, err := c.getCollectionByName(src)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return cl.GetFile(key.Key(k))
-}
-
-func (c *Client) Get(collectionName string, k Key) ([]byte, error) {
+	p := CollectionProps(srcCl.CollectionProps)
+	p.Name = dst
+	// these can be changed while the collection is in use, see ApplyConfig
+	p.CacheMaxEntries, p.CacheMaxBytes = srcCl.GetCacheLimits()
+	p.Durability, p.FsyncInterval = srcCl.GetDurability()
+	if opts.NumPartitions > 0 {
+		p.NumPartitions = opts.NumPartitions
+	}
+	if opts.EnableGzipCompression != nil {
+		p.EnableGzipCompression = *opts.EnableGzipCompression
+	}
+	err = c.AddCollection(p)
+	if err != nil {
+		return err
+	}
 
-	cl, err := c.getCollectionByName(collectionName)
+	err = c.fillClone(srcCl, dst)
 	if err != nil {
-		return nil, err
+		util.Errorf("Cloning collection %s to %s: %s. Removing the partial clone...", src, dst, err)
+		if rErr := c.RemoveCollection(dst); rErr != nil {
+			util.Errorf("Removing the partial clone %s: %s", dst, rErr)
+		}
+		return err
 	}
 
-	return cl.GetFileData(key.Key(k))
+	return c.save()
 }
 
-func (c *Client) GetIfExist(collectionName string, k Key) ([]byte, error) {
-
-	data, err := c.Get(collectionName, k)
-	if os.IsNotExist(err) { // if doesn't exist, return nil
-		return nil, nil
+// fillClone copies the documents of srcCl to the newly added collection dst, and builds the indexes of srcCl for it
+func (c *Client) fillClone(srcCl *collection.Collection, dst string) error {
+	dstCl, err := c.getWritableCollectionByName(dst)
+	if err != nil {
+		return err
 	}
-	return data, err
-}
 
-func (c *Client) GetStruct(collectionName string, k Key, dest interface{}) error {
+	n, err := srcCl.CopyTo(dstCl)
+	if err != nil {
+		return err
+	}
+	err = dstCl.Flush()
+	if err != nil {
+		return err
+	}
+	util.Infof("Copied %d documents from collection %s to %s", n, srcCl.Name, dstCl.Name)
 
-	cl, err := c.getCollectionByName(collectionName)
+	err = srcCl.CopyMetaTo(dstCl)
 	if err != nil {
 		return err
 	}
 
-	return cl.GetIntoStruct(key.Key(k), dest)
+	for _, fieldLocator := range srcCl.GetIndexFieldLocators() {
+		err = dstCl.AddIndex(fieldLocator)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (c *Client) GetStructIfExists(collectionName string, k Key, dest interface{}) (bool, error) {
+// AlterCollection changes the props of a collection to newProps, migrating all its documents to the new layout and format
+// (e.g. the number of partitions, the encoding or the gzip compression) and rebuilding its indexes. A NumPartitions of 0
+// keeps the current number of partitions. The name and the encryption keys can't be changed this way: see
+// RenameCollection and RotateEncryptionKey. Revisions, the audit trail and quarantined documents are dropped. Looking up
+// any collection of the client waits until the alteration is done.
+func (c *Client) AlterCollection(name string, newProps CollectionProps) error {
 
-	err := c.GetStruct(collectionName, k, dest)
-	if os.IsNotExist(err) {
-		return false, nil
+	cl, err := c.getWritableCollectionByName(name)
+	if err != nil {
+		return err
 	}
-	return true, err
-}
 
-func (c *Client) GetIntoWriter(collectionName string, k Key, dest io.Writer) error {
+	p := collection.CollectionProps(newProps)
+	if p.NumPartitions == 0 {
+		p.NumPartitions = cl.NumPartitions
+	}
+	p = p.Sanitize()
+	err = p.Validate()
+	if err != nil {
+		return err
+	}
+	if p.Name != cl.Name {
+		return ErrAlterCannotRename
+	}
+	p.EncryptionKey, p.PreviousEncryptionKey = cl.EncryptionKey, cl.PreviousEncryptionKey
 
-	cl, err := c.getCollectionByName(collectionName)
+	// The alteration is recorded first, so that the recovery pass can finish (or abandon) it if it is interrupted
+	c.collections.Lock()
+	err = c.setMeta(ALTER_META_NAME, newAlterInfo(p))
+	if err == nil {
+		err = c.alter(cl, p)
+	}
+	c.collections.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = c.save()
 	if err != nil {
 		return err
 	}
-	return cl.GetIntoWriter(key.Key(k), dest)
+	return c.removeMeta(ALTER_META_NAME)
 }
 
-/********************************************************************************
-* Q U E R Y (B E T A)
-*********************************************************************************/
+// RepartitionOptions changes how RepartitionCollection goes about it. The zero value repartitions the collection.
+type RepartitionOptions struct {
+	DryRun bool // if true, nothing is moved, and the report lists the documents that would be
+	// if set, called with the progress of the repartitioning every time a partition dir has been gone through
+	OnProgress func(p RepartitionProgress)
+}
 
-type SearchResponse struct {
-	Collection   string
-	Query        string
+type RepartitionReport struct {
+	NumMoved     int               // the number of documents moved by this call (not by the writes made meanwhile)
+	PlannedMoves []RepartitionMove // the documents that would be moved, for a DryRun
+}
+
+// RepartitionCollection changes the number of partitions of a collection to newNumPartitions, moving the files of its
+// documents (and of their revisions and cold copies) into the new partition dirs in place. Unlike with AlterCollection,
+// the documents aren't rewritten, and nothing else about the collection changes: its indexes, revisions, audit trail and
+// quarantined documents are kept. The collection can be read and written while its documents are being moved, see
+// collection.StartRepartition. A collection is only repartitioned by one call at a time (see ErrIsRepartitioning), but
+// different collections can be repartitioned at the same time. If it is interrupted, the collection can still be used,
+// and calling RepartitionCollection again with the same newNumPartitions carries on from where it was. Its progress can
+// be followed with opts.OnProgress, or looked up with GetRepartitionProgress.
+func (c *Client) RepartitionCollection(name string, newNumPartitions int, opts RepartitionOptions) (RepartitionReport, error) {
+	var report RepartitionReport
+	if newNumPartitions < 1 {
+		return report, fmt.Errorf("the number of partitions must be > 0, got %d", newNumPartitions)
+	}
+
+	cl, err := c.getWritableCollectionByName(name)
+	if err != nil {
+		return report, err
+	}
+
+	if opts.DryRun {
+		moves, err := cl.PlanRepartition(newNumPartitions)
+		if err != nil {
+			return report, err
+		}
+		for _, m := range moves {
+			report.PlannedMoves = append(report.PlannedMoves, RepartitionMove(m))
+		}
+		return report, nil
+	}
+
+	unlock, err := lockRepartition(util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME))
+	if err != nil {
+		return report, err
+	}
+	defer unlock()
+
+	// The old number of partitions is saved with the collection before any document is moved, so that the documents
+	// can still be found if the repartitioning is interrupted
+	err = cl.StartRepartition(newNumPartitions)
+	if err != nil {
+		return report, err
+	}
+	err = c.save()
+	if err != nil {
+		return report, err
+	}
+
+	var onProgress func(collection.RepartitionProgress)
+	if opts.OnProgress != nil {
+		onProgress = func(p collection.RepartitionProgress) { opts.OnProgress(RepartitionProgress(p)) }
+	}
+	report.NumMoved, err = cl.FinishRepartition(onProgress)
+	if err != nil {
+		return report, err
+	}
+	return report, c.save()
+}
+
+// GetRepartitionProgress returns how far the repartitioning of a collection has got, and false if it isn't being
+// repartitioned, e.g. because it is done. A repartitioning that has been interrupted, and not resumed yet, doesn't
+// have its dirs counted.
+func (c *Client) GetRepartitionProgress(collectionName string) (RepartitionProgress, bool, error) {
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return RepartitionProgress{}, false, err
+	}
+	p, ok := cl.GetRepartitionProgress()
+	return RepartitionProgress(p), ok, nil
+}
+
+// SetGzipCompression turns the gzip compression of a collection on or off, and rewrites its documents accordingly, in
+// place. Unlike with AlterCollection, the collection can be used all along, and nothing else about it changes. It returns
+// the number of documents that were rewritten. If it is interrupted, it can be called again to finish the job.
+func (c *Client) SetGzipCompression(collectionName string, enabled bool) (int, error) {
+
+	cl, err := c.getWritableCollectionByName(collectionName)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := cl.SetGzipCompression(enabled)
+
+	// The setting has changed even if not all the documents could be rewritten
+	sErr := c.save()
+	if err != nil {
+		return n, err
+	}
+	return n, sErr
+}
+
+// ChangeEncoding changes the encoding of a collection to encodingType, re-encoding its documents in place and then
+// rebuilding its indexes. docType is a value of the type that the documents decode into (e.g. the struct passed to
+// SetStruct), and is needed to re-encode documents from or to ENCODING_GOB. It can be nil otherwise, in which case the
+// documents are re-encoded through generic values. The collection can be used all along. It returns the number of
+// documents that were re-encoded. If it is interrupted, it can be called again to finish the job.
+func (c *Client) ChangeEncoding(collectionName string, encodingType uint, docType interface{}) (int, error) {
+
+	cl, err := c.getWritableCollectionByName(collectionName)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := cl.ChangeEncoding(encodingType, newDocFunc(docType))
+
+	// The setting has changed even if not all the documents could be re-encoded
+	sErr := c.save()
+	if err != nil {
+		return n, err
+	}
+	return n, sErr
+}
+
+// newDocFunc returns a func that returns a pointer to a new value of the type of docType (or of the type it points to), or
+// nil if docType is nil
+func newDocFunc(docType interface{}) func() interface{} {
+	if docType == nil {
+		return nil
+	}
+	t := reflect.TypeOf(docType)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return func() interface{} { return reflect.New(t).Interface() }
+}
+
+// alter alters cl to p. If that fails, the alteration is finished or abandoned right away if possible, rather than by the
+// recovery pass. It should be called while holding the lock of c.collections.
+func (c *Client) alter(cl *collection.Collection, p collection.CollectionProps) error {
+	err := cl.Close()
+	if err == nil {
+		err = cl.Alter(p)
+	}
+	if err == nil {
+		return nil
+	}
+
+	altered, rErr := cl.RecoverAlter(p)
+	if rErr != nil {
+		util.Errorf("Could not recover from altering collection %s: %s", cl.Name, rErr)
+		return err
+	}
+	if altered {
+		return nil
+	}
+	if rErr := c.removeMeta(ALTER_META_NAME); rErr != nil {
+		util.Errorf("Could not remove the record of altering collection %s: %s", cl.Name, rErr)
+	}
+	return err
+}
+
+// alterInfo is what is recorded about an alteration in progress, see AlterCollection
+type alterInfo struct {
+	Name  string
+	Props collection.CollectionProps
+}
+
+// newAlterInfo returns the alterInfo for altering a collection to p. The encryption keys are left out, since they are never
+// saved: they are provided again when the client is initialized.
+func newAlterInfo(p collection.CollectionProps) alterInfo {
+	p.EncryptionKey, p.PreviousEncryptionKey = nil, nil
+	return alterInfo{Name: p.Name, Props: p}
+}
+
+// recoverAlter finishes an AlterCollection that was interrupted while the collection dirs were being swapped, or abandons
+// it if it was interrupted before that
+func (c *Client) recoverAlter() error {
+	var info alterInfo
+	err := c.getMeta(ALTER_META_NAME, &info)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	c.collections.Lock()
+	cl, hasKey, err := c.getCollectionLocked(info.Name)
+	var altered bool
+	if err == nil && hasKey {
+		p := info.Props
+		p.EncryptionKey, p.PreviousEncryptionKey = cl.EncryptionKey, cl.PreviousEncryptionKey
+		altered, err = cl.RecoverAlter(p)
+	}
+	c.collections.Unlock()
+	if err != nil {
+		return err
+	}
+	if altered {
+		util.Warnf("Recovery: finished the interrupted alteration of collection %s", info.Name)
+	} else if hasKey {
+		util.Warnf("Recovery: abandoned the interrupted alteration of collection %s", info.Name)
+	}
+
+	err = c.save()
+	if err != nil {
+		return err
+	}
+	return c.removeMeta(ALTER_META_NAME)
+}
+
+func (c *Client) IsCollectionExist(collectionName string) (bool, error) {
+	collectionName = collection.NormalizeName(collectionName)
+
+	_, err := c.getCollectionByName(collectionName)
+
+	if err == collection.ErrCollectionIsNotExist {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+
+}
+
+/********************************************************************************
+* W R I T E R S
+*********************************************************************************/
+
+func (c *Client) Set(collectionName string, k Key, data []byte) error {
+	return c.SetCtx(context.Background(), collectionName, k, data)
+}
+
+// SetCtx is Set, which gives up with ctx.Err() if ctx is done before the write starts
+func (c *Client) SetCtx(ctx context.Context, collectionName string, k Key, data []byte) error {
+	op := &Op{Type: OP_SET, Collection: collectionName, Key: k, Data: data}
+	return c.runOp(ctx, op, func(ctx context.Context, op *Op) error {
+
+		cl, err := c.getWritableCollectionByName(op.Collection)
+		if err != nil {
+			return err
+		}
+
+		return cl.SetCtx(ctx, key.Key(op.Key), op.Data)
+	})
+}
+
+func (c *Client) SetStruct(collectionName string, k Key, v interface{}) error {
+	return c.SetStructCtx(context.Background(), collectionName, k, v)
+}
+
+// SetStructCtx is SetStruct, which gives up with ctx.Err() if ctx is done before the write starts
+func (c *Client) SetStructCtx(ctx context.Context, collectionName string, k Key, v interface{}) error {
+	op := &Op{Type: OP_SET, Collection: collectionName, Key: k, Value: v}
+	return c.runOp(ctx, op, func(ctx context.Context, op *Op) error {
+
+		cl, err := c.getWritableCollectionByName(op.Collection)
+		if err != nil {
+			return err
+		}
+
+		return cl.SetFromStructCtx(ctx, key.Key(op.Key), op.Value)
+	})
+}
+
+// SetWithTTL is Set for a document that expires after ttl, and is then deleted by ReapExpired. Writing the document again
+// without a TTL makes it not expire.
+func (c *Client) SetWithTTL(collectionName string, k Key, data []byte, ttl time.Duration) error {
+	op := &Op{Type: OP_SET, Collection: collectionName, Key: k, Data: data, TTL: ttl}
+	return c.runOp(context.Background(), op, func(ctx context.Context, op *Op) error {
+
+		cl, err := c.getWritableCollectionByName(op.Collection)
+		if err != nil {
+			return err
+		}
+
+		return cl.SetWithTTLCtx(ctx, key.Key(op.Key), op.Data, op.TTL)
+	})
+}
+
+// SetStructWithTTL is SetStruct for a document that expires after ttl, see SetWithTTL
+func (c *Client) SetStructWithTTL(collectionName string, k Key, v interface{}, ttl time.Duration) error {
+	op := &Op{Type: OP_SET, Collection: collectionName, Key: k, Value: v, TTL: ttl}
+	return c.runOp(context.Background(), op, func(ctx context.Context, op *Op) error {
+
+		cl, err := c.getWritableCollectionByName(op.Collection)
+		if err != nil {
+			return err
+		}
+
+		return cl.SetFromStructWithTTLCtx(ctx, key.Key(op.Key), op.Value, op.TTL)
+	})
+}
+
+func (c *Client) Delete(collectionName string, k Key) error {
+	return c.DeleteCtx(context.Background(), collectionName, k)
+}
+
+// DeleteCtx is Delete, which gives up with ctx.Err() if ctx is done before the document is deleted. Once started, the
+// delete is carried out regardless.
+func (c *Client) DeleteCtx(ctx context.Context, collectionName string, k Key) error {
+	op := &Op{Type: OP_DELETE, Collection: collectionName, Key: k}
+	return c.runOp(ctx, op, func(ctx context.Context, op *Op) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		cl, err := c.getWritableCollectionByName(op.Collection)
+		if err != nil {
+			return err
+		}
+
+		return cl.Delete(key.Key(op.Key))
+	})
+}
+
+/********************************************************************************
+* R E A D E R S
+*********************************************************************************/
+
+func (c *Client) GetFile(collectionName string, k Key) (File, error) {
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cl.GetFile(key.Key(k))
+}
+
+// CollectionFS returns a read-only io/fs view of the documents of the collection, with a file for every document named
+// after its key, e.g. to serve them with http.FileServer(http.FS(fsys)). See collection.Collection.FS.
+func (c *Client) CollectionFS(collectionName string) (fs.FS, error) {
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return nil, err
+	}
+	return cl.FS(), nil
+}
+
+func (c *Client) Get(collectionName string, k Key) ([]byte, error) {
+	return c.GetCtx(context.Background(), collectionName, k)
+}
+
+// GetCtx is Get, which stops reading the document with ctx.Err() as soon as ctx is done
+func (c *Client) GetCtx(ctx context.Context, collectionName string, k Key) ([]byte, error) {
+	op := &Op{Type: OP_GET, Collection: collectionName, Key: k}
+	err := c.runOp(ctx, op, func(ctx context.Context, op *Op) error {
+
+		cl, err := c.getCollectionByName(op.Collection)
+		if err != nil {
+			return err
+		}
+
+		op.Data, err = cl.GetFileDataCtx(ctx, key.Key(op.Key))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return op.Data, nil
+}
+
+func (c *Client) GetIfExist(collectionName string, k Key) ([]byte, error) {
+
+	data, err := c.Get(collectionName, k)
+	if os.IsNotExist(err) { // if doesn't exist, return nil
+		return nil, nil
+	}
+	return data, err
+}
+
+func (c *Client) GetStruct(collectionName string, k Key, dest interface{}) error {
+	return c.GetStructCtx(context.Background(), collectionName, k, dest)
+}
+
+// GetStructCtx is GetStruct, which stops reading the document with ctx.Err() as soon as ctx is done
+func (c *Client) GetStructCtx(ctx context.Context, collectionName string, k Key, dest interface{}) error {
+	op := &Op{Type: OP_GET, Collection: collectionName, Key: k, Value: dest}
+	return c.runOp(ctx, op, func(ctx context.Context, op *Op) error {
+
+		cl, err := c.getCollectionByName(op.Collection)
+		if err != nil {
+			return err
+		}
+
+		return cl.GetIntoStructCtx(ctx, key.Key(op.Key), op.Value)
+	})
+}
+
+func (c *Client) GetStructIfExists(collectionName string, k Key, dest interface{}) (bool, error) {
+
+	err := c.GetStruct(collectionName, k, dest)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return true, err
+}
+
+func (c *Client) GetIntoWriter(collectionName string, k Key, dest io.Writer) error {
+	return c.GetIntoWriterCtx(context.Background(), collectionName, k, dest)
+}
+
+// GetIntoWriterCtx is GetIntoWriter, which stops copying the document with ctx.Err() as soon as ctx is done
+func (c *Client) GetIntoWriterCtx(ctx context.Context, collectionName string, k Key, dest io.Writer) error {
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+	return cl.GetIntoWriterCtx(ctx, key.Key(k), dest)
+}
+
+// GetRawIntoWriter writes the document to dest without decompressing it. The returned bool tells whether the bytes
+// written are gzip compressed.
+func (c *Client) GetRawIntoWriter(collectionName string, k Key, dest io.Writer) (bool, error) {
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return false, err
+	}
+	return cl.GetRawIntoWriter(key.Key(k), dest)
+}
+
+/********************************************************************************
+* Q U E R Y (B E T A)
+*********************************************************************************/
+
+type SearchResponse struct {
+	Collection   string
+	Query        string
 	Error        error
 	TimeTaken    time.Duration
 	NumDocuments int
@@ -410,6 +1370,11 @@ type SearchResponse struct {
 }
 
 func (c *Client) Search(collectionName string, query string) (SearchResponse, error) {
+	return c.SearchCtx(context.Background(), collectionName, query)
+}
+
+// SearchCtx is Search, which gives up with ctx.Err() as soon as ctx is done
+func (c *Client) SearchCtx(ctx context.Context, collectionName string, query string) (SearchResponse, error) {
 
 	start := time.Now()
 	var resp SearchResponse = SearchResponse{}
@@ -421,13 +1386,18 @@ func (c *Client) Search(collectionName string, query string) (SearchResponse, er
 	resp.Query = query
 	resp.Collection = collectionName
 
-	cl, err := c.getCollectionByName(collectionName)
-	if err != nil {
-		resp.Error = err
-		return resp, err
-	}
+	op := &Op{Type: OP_SEARCH, Collection: collectionName, Query: query}
+	err := c.runOp(ctx, op, func(ctx context.Context, op *Op) error {
+
+		cl, err := c.getCollectionByName(op.Collection)
+		if err != nil {
+			return err
+		}
 
-	resp.Result, err = cl.Search(query)
+		op.Result, err = cl.SearchCtx(ctx, op.Query)
+		return err
+	})
+	resp.Result = op.Result
 	if err != nil {
 		resp.Error = err
 		return resp, err
@@ -440,13 +1410,21 @@ func (c *Client) Search(collectionName string, query string) (SearchResponse, er
 }
 
 func (c *Client) AddIndex(collectionName string, fieldLocator string) error {
+	return c.AddIndexCtx(context.Background(), collectionName, fieldLocator)
+}
 
-	cl, err := c.getCollectionByName(collectionName)
+// AddIndexCtx is AddIndex, which stops building the index with ctx.Err() as soon as ctx is done. The index is then not
+// added.
+func (c *Client) AddIndexCtx(ctx context.Context, collectionName string, fieldLocator string) (err error) {
+	ctx, span := c.startSpan(ctx, TRACE_SPAN_ADD_INDEX, collectionName, TRACE_ATTR_FIELD.String(fieldLocator))
+	defer func() { endSpan(span, err) }()
+
+	cl, err := c.getWritableCollectionByName(collectionName)
 	if err != nil {
 		return err
 	}
 
-	err = cl.AddIndex(fieldLocator)
+	err = cl.AddIndexCtx(ctx, fieldLocator)
 	if err != nil {
 		return err
 	}
@@ -457,31 +1435,794 @@ func (c *Client) AddIndex(collectionName string, fieldLocator string) error {
 }
 
 /********************************************************************************
-* N A V I G A T I O N   H E L P E R S
+* E N C R Y P T I O N
 *********************************************************************************/
 
-func (c *Client) getDirPathForCollection(collectionName string) string {
-	dirs := []string{c.documentRoot, util.DATA_DIR_NAME, collectionName}
-	return strings.Join(dirs, string(os.PathSeparator))
+// RotateEncryptionKey re-encrypts all the data of the collection using newKey. If it is interrupted, it can be called
+// again with the same newKey to resume.
+func (c *Client) RotateEncryptionKey(collectionName string, newKey []byte) error {
+
+	cl, err := c.getWritableCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+
+	return cl.RotateEncryptionKey(newKey)
 }
 
 /********************************************************************************
-* E N T I T Y  C R E A T O R S
+* R E V I S I O N S
 *********************************************************************************/
 
-// GetNewEntityID generates a unique pk.ID for the given collection
-func (c *Client) GetNewEntityID(collection string) (Key, error) {
+// ListRevisions returns the previous versions kept for the document, oldest first. Revisions are only kept for
+// collections with NumRevisions set.
+func (c *Client) ListRevisions(collectionName string, k Key) ([]Revision, error) {
 
-	// Get an random ID
-	id := getNewID()
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return nil, err
+	}
 
-	// Check if it already exists
-	_, err := c.GetFile(collection, Key(id))
-	if IsNotExist(err) { // If the file doesn't exist, we're good to go
-		return id, nil
+	revisions, err := cl.ListRevisions(key.Key(k))
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Revision
+	for _, r := range revisions {
+		results = append(results, Revision(r))
 	}
+
+	return results, nil
+}
+
+// GetRevision returns the data of revision n of the document, as Get does for the current version
+func (c *Client) GetRevision(collectionName string, k Key, n int) ([]byte, error) {
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cl.GetRevision(key.Key(k), n)
+}
+
+// RevertTo makes revision n the current version of the document. The replaced version is kept as a new revision.
+func (c *Client) RevertTo(collectionName string, k Key, n int) error {
+
+	cl, err := c.getWritableCollectionByName(collectionName)
 	if err != nil {
-		return id, fmt.Errorf("generated the new id %d but could not verify that it is unique: %v", id, err)
+		return err
+	}
+
+	return cl.RevertTo(key.Key(k), n)
+}
+
+// PruneRevisions removes the revisions of the collection that are no longer allowed by NumRevisions and RevisionMaxAge,
+// and returns the number of revisions removed
+func (c *Client) PruneRevisions(collectionName string) (int, error) {
+
+	cl, err := c.getWritableCollectionByName(collectionName)
+	if err != nil {
+		return 0, err
+	}
+
+	return cl.PruneRevisions()
+}
+
+/********************************************************************************
+* Q U A R A N T I N E
+*********************************************************************************/
+
+// ListQuarantined returns the reports of the documents of the collection that have been quarantined because their data
+// was found to be corrupted
+func (c *Client) ListQuarantined(collectionName string) ([]QuarantinedDoc, error) {
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	docs, err := cl.ListQuarantined()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []QuarantinedDoc
+	for _, doc := range docs {
+		results = append(results, QuarantinedDoc(doc))
+	}
+
+	return results, nil
+}
+
+// DeleteQuarantined permanently deletes a quarantined document
+func (c *Client) DeleteQuarantined(collectionName string, k Key) error {
+
+	cl, err := c.getWritableCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+
+	return cl.DeleteQuarantined(key.Key(k))
+}
+
+// RestoreQuarantined moves a quarantined document back into the collection, e.g. once its file has been fixed
+func (c *Client) RestoreQuarantined(collectionName string, k Key) error {
+
+	cl, err := c.getWritableCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+
+	return cl.RestoreQuarantined(key.Key(k))
+}
+
+/********************************************************************************
+* V E R I F Y
+*********************************************************************************/
+
+// Verify checks the files of the collection for problems, e.g. corrupted documents or indexes that reference missing
+// documents. If repair is true, it also fixes what it can. The report lists all the problems found.
+func (c *Client) Verify(collectionName string, repair bool) (VerifyReport, error) {
+	if repair && c.isReadOnly() {
+		return VerifyReport{}, ErrClientIsReadOnly
+	}
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+
+	report, err := cl.Verify(repair)
+	if err != nil {
+		return VerifyReport(report), err
+	}
+
+	// Repairs may have changed the index info, which is saved with the client
+	if report.NumRepaired() > 0 {
+		err = c.save()
+		if err != nil {
+			return VerifyReport(report), err
+		}
+	}
+
+	return VerifyReport(report), nil
+}
+
+// NumRepaired returns the number of problems that were repaired
+func (r VerifyReport) NumRepaired() int {
+	return collection.VerifyReport(r).NumRepaired()
+}
+
+/********************************************************************************
+* V A C U U M
+*********************************************************************************/
+
+// Vacuum removes the empty partition dirs, the leftover temp files, the files of the indexes that have been removed,
+// and the files that aren't documents from the partition dirs of a collection, which reclaims space and keeps the scans
+// fast. The files that aren't documents are listed in the report. It can be run while the collection is in use: the temp
+// and index files that have been changed in the last collection.VACUUM_MIN_AGE are left alone.
+func (c *Client) Vacuum(collectionName string) (VacuumReport, error) {
+
+	cl, err := c.getWritableCollectionByName(collectionName)
+	if err != nil {
+		return VacuumReport{}, err
+	}
+
+	report, err := cl.Vacuum()
+	return VacuumReport(report), err
+}
+
+/********************************************************************************
+* A U D I T
+*********************************************************************************/
+
+// GetAuditTrail returns all the recorded changes to the document, oldest first. Changes are only recorded for
+// collections with EnableAuditLog set.
+func (c *Client) GetAuditTrail(collectionName string, k Key) ([]AuditEntry, error) {
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := cl.GetAuditTrail(key.Key(k))
+	if err != nil {
+		return nil, err
+	}
+
+	var results []AuditEntry
+	for _, e := range entries {
+		results = append(results, AuditEntry(e))
+	}
+
+	return results, nil
+}
+
+/********************************************************************************
+* C H A N G E  F E E D
+*********************************************************************************/
+
+// ChangeIterator reads the changes of the change feed of a collection in order, see Changes. It should be closed once it
+// is done with.
+type ChangeIterator struct {
+	it *collection.ChangeIterator
+}
+
+// Changes returns an iterator over the changes to the collection after the one with sequence number since, which is 0 to
+// start from the first one. The feed is kept on disk, so a consumer that keeps the sequence number of the last change it
+// has handled can carry on from there after a restart. Changes are only recorded for collections with EnableChangeFeed
+// set.
+func (c *Client) Changes(collectionName string, since Sequence) (*ChangeIterator, error) {
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return nil, err
+	}
+	it, err := cl.Changes(since)
+	if err != nil {
+		return nil, err
+	}
+	return &ChangeIterator{it: it}, nil
+}
+
+// Next moves the iterator to the next change, and tells whether there is one
+func (it *ChangeIterator) Next() bool {
+	return it.it.Next()
+}
+
+// Change returns the change that the iterator is at
+func (it *ChangeIterator) Change() Change {
+	return Change(it.it.Change())
+}
+
+// Err returns the error that stopped the iterator, if any
+func (it *ChangeIterator) Err() error {
+	return it.it.Err()
+}
+
+// Close releases the files that the iterator has open
+func (it *ChangeIterator) Close() error {
+	return it.it.Close()
+}
+
+// GetLastChangeSeq returns the sequence number of the last change to the collection in its change feed, or 0 if there is
+// none
+func (c *Client) GetLastChangeSeq(collectionName string) (Sequence, error) {
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return 0, err
+	}
+	return cl.GetLastChangeSeq()
+}
+
+// PruneChanges removes the changes to the collection up to the one with sequence number before from its change feed, a
+// file at a time, and returns the number of files removed. The changes in the current file are kept.
+func (c *Client) PruneChanges(collectionName string, before Sequence) (int, error) {
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return 0, err
+	}
+	return cl.PruneChanges(before)
+}
+
+/********************************************************************************
+* D U R A B I L I T Y
+*********************************************************************************/
+
+// Flush makes all the writes to the collection that have returned so far durable, regardless of its Durability
+// setting. It should be called before e.g. an external backup of the collection is taken.
+func (c *Client) Flush(collectionName string) error {
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+
+	err = cl.Flush()
+	if err != nil {
+		return err
+	}
+
+	// The client meta is always fsynced when saved, but the dir of a newly added collection may not be
+	return util.SyncFile(c.fs(), util.JoinPath(c.documentRoot, util.DATA_DIR_NAME))
+}
+
+// Sync makes all the writes to all the collections that have returned so far durable, along with the client meta
+func (c *Client) Sync() error {
+	c.collections.RLock()
+	var cls []*collection.Collection
+	for _, cl := range c.collections.Store {
+		cls = append(cls, cl)
+	}
+	c.collections.RUnlock()
+
+	for _, cl := range cls {
+		err := cl.Flush()
+		if err != nil {
+			return fmt.Errorf("error while flushing collection %s: %w", cl.Name, err)
+		}
+	}
+
+	for _, dirPath := range []string{util.DATA_DIR_NAME, util.META_DIR_NAME} {
+		err := util.SyncFile(c.fs(), util.JoinPath(c.documentRoot, dirPath))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/********************************************************************************
+* C A C H E
+*********************************************************************************/
+
+// Preload reads all the documents of the collection into its cache, e.g. at startup so that the first requests don't
+// have to wait on the disk. The collection needs to have CacheMaxEntries or CacheMaxBytes set.
+func (c *Client) Preload(collectionName string) error {
+	return c.PreloadRecent(collectionName, 0)
+}
+
+// PreloadRecent is like Preload, but only reads the n most recently written documents
+func (c *Client) PreloadRecent(collectionName string, n int) error {
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+
+	return cl.Preload(n)
+}
+
+// GetCacheStats returns the number of documents in the cache of a collection and their size, along with the numbers of
+// reads that hit and missed the cache since the collection was loaded
+func (c *Client) GetCacheStats(collectionName string) (CacheStats, error) {
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return CacheStats{}, err
+	}
+
+	stats, err := cl.GetCacheStats()
+	return CacheStats(stats), err
+}
+
+/********************************************************************************
+* S E G M E N T S
+*********************************************************************************/
+
+// Compact compacts the segments of a collection with StorageEngine set to STORAGE_SEGMENTS, which reclaims the space
+// used by overwritten and deleted documents. It returns the number of segments compacted.
+func (c *Client) Compact(collectionName string) (int, error) {
+
+	cl, err := c.getWritableCollectionByName(collectionName)
+	if err != nil {
+		return 0, err
+	}
+
+	return cl.Compact()
+}
+
+// PruneBlobs removes the blobs of a collection with StorageEngine set to STORAGE_CONTENT_ADDRESSED that no document
+// points to anymore, which reclaims the space used by overwritten and deleted documents. It returns the number of blobs
+// removed.
+func (c *Client) PruneBlobs(collectionName string) (int, error) {
+
+	cl, err := c.getWritableCollectionByName(collectionName)
+	if err != nil {
+		return 0, err
+	}
+
+	return cl.PruneBlobs()
+}
+
+/********************************************************************************
+* M A N I F E S T S
+*********************************************************************************/
+
+// Count returns the number of documents in a collection. For collections with EnableManifests, this reads the partition
+// manifests rather than listing the partition dirs.
+func (c *Client) Count(collectionName string) (int, error) {
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return 0, err
+	}
+
+	return cl.Count()
+}
+
+/********************************************************************************
+* T I E R I N G
+*********************************************************************************/
+
+// MoveColdDocuments moves the documents of a collection that haven't been read for ColdAfter into the cold dir of the
+// collection. They are moved back as soon as they are fetched. It returns the number of documents moved.
+func (c *Client) MoveColdDocuments(collectionName string) (int, error) {
+
+	cl, err := c.getWritableCollectionByName(collectionName)
+	if err != nil {
+		return 0, err
+	}
+
+	return cl.MoveColdDocuments()
+}
+
+/********************************************************************************
+* I O  L I M I T S
+*********************************************************************************/
+
+// GetIOStats tells how many reads and writes have gone through the client, and how long they have waited for their turn
+// because of ClientInitOptions.MaxConcurrentIO. It is all zeroes if MaxConcurrentIO is not set.
+func (c *Client) GetIOStats() IOStats {
+	return IOStats(c.ioLimiter.GetStats())
+}
+
+/********************************************************************************
+* S T A T S
+*********************************************************************************/
+
+// CollectionStats returns the number of documents of a collection and their size, raw and as stored, along with the
+// number of documents in each partition, the size of each index and when the collection was last written to. The stats
+// are gathered by the first call, which goes through all the documents, and are then kept up to date by every write, so
+// that later calls are cheap. Revisions, the audit log and other meta files are not counted.
+func (c *Client) CollectionStats(collectionName string) (CollectionStats, error) {
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return CollectionStats{}, err
+	}
+
+	stats, err := cl.GetStats()
+	return CollectionStats(stats), err
+}
+
+/********************************************************************************
+* C O L L E C T I O N  M E T A
+*********************************************************************************/
+
+// SetCollectionMeta saves v as the meta entry metaName of a collection, so applications can keep their own metadata
+// about it (e.g. a schema version or a sync cursor) along with it. v is gob encoded, and can be read back into a value of
+// the same type using GetCollectionMeta. Meta entries are renamed, snapshotted, cloned and altered along with the
+// collection. They are not encrypted.
+func (c *Client) SetCollectionMeta(collectionName string, metaName string, v interface{}) error {
+
+	cl, err := c.getWritableCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+
+	return cl.SetMeta(metaName, v)
+}
+
+// GetCollectionMeta decodes the meta entry metaName of a collection into v, which should be a pointer. It returns
+// ErrMetaIsNotExist if the collection has no such entry.
+func (c *Client) GetCollectionMeta(collectionName string, metaName string, v interface{}) error {
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+
+	return cl.GetMeta(metaName, v)
+}
+
+// DeleteCollectionMeta removes the meta entry metaName of a collection. It returns ErrMetaIsNotExist if the collection
+// has no such entry.
+func (c *Client) DeleteCollectionMeta(collectionName string, metaName string) error {
+
+	cl, err := c.getWritableCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+
+	return cl.DeleteMeta(metaName)
+}
+
+// ListCollectionMeta returns the names of the meta entries of a collection, sorted
+func (c *Client) ListCollectionMeta(collectionName string) ([]string, error) {
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cl.ListMeta()
+}
+
+/********************************************************************************
+* E X P O R T
+*********************************************************************************/
+
+// ExportCollection streams all the documents of a collection to w in format, so they can be loaded into other systems
+// or inspected with standard tools: EXPORT_FORMAT_JSONL writes an ExportRecord per line, with the key and the document
+// as JSON (or its data, base64 encoded, if it can't be expressed as JSON), and EXPORT_FORMAT_TAR writes a tar archive
+// with a file for each document. Documents that are written or deleted while the export is in progress may or may not
+// be exported.
+func (c *Client) ExportCollection(collectionName string, w io.Writer, format ExportFormat) error {
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+
+	n, err := cl.Export(w, uint(format))
+	if err != nil {
+		return err
+	}
+	util.Infof("Exported %d documents from collection %s", n, collectionName)
+	return nil
+}
+
+/********************************************************************************
+* I M P O R T
+*********************************************************************************/
+
+type ImportOptions struct {
+	Format   ImportFormat // one of the IMPORT_FORMAT_ constants
+	KeyField string       // field locator of the key of the documents, if empty, keys are generated
+	// a value of the type that the documents decode into (e.g. the struct passed to SetStruct). It is needed for
+	// collections with ENCODING_GOB. Otherwise, if provided, documents that don't decode into it are not imported.
+	DocType interface{}
+}
+
+// ImportCollection bulk-loads the documents read from r into a collection. With IMPORT_FORMAT_JSONL, each line is a JSON
+// document, and with IMPORT_FORMAT_CSV, each record is a document whose field names are in the first record. The key of
+// each document is taken from the field at opts.KeyField, or generated if it is empty. IMPORT_FORMAT_EXPORT_JSONL loads
+// what ExportCollection writes with EXPORT_FORMAT_JSONL, keys included. Documents are converted to the encoding of the
+// collection, and index changes are batched until the import is done. Rows that can't be imported are reported in the
+// result, rather than stopping the import, so the error is only for problems with r or opts.
+func (c *Client) ImportCollection(collectionName string, r io.Reader, opts ImportOptions) (ImportResult, error) {
+
+	cl, err := c.getWritableCollectionByName(collectionName)
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	result, err := cl.Import(r, collection.ImportOptions{
+		Format:   uint(opts.Format),
+		KeyField: opts.KeyField,
+		NewDoc:   newDocFunc(opts.DocType),
+	})
+	util.Infof("Imported %d documents into collection %s, %d could not be imported", result.NumImported, collectionName, len(result.Errors))
+	return ImportResult(result), err
+}
+
+/********************************************************************************
+* F R E E Z I N G
+*********************************************************************************/
+
+// FreezeCollection makes a collection reject all changes with ErrCollectionIsFrozen (writes, deletes, new indexes,
+// meta entries, renaming, removing it...), while the other collections remain writable and it can still be read. It
+// waits for the writes in progress to be done, so once it returns the collection is guaranteed to stay as it is, e.g.
+// after it has been archived, or while it is being migrated. The collection stays frozen across restarts, until
+// UnfreezeCollection is called.
+func (c *Client) FreezeCollection(collectionName string) error {
+	if c.isReadOnly() {
+		return ErrClientIsReadOnly
+	}
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+
+	err = cl.Freeze()
+	if err != nil {
+		return err
+	}
+	util.Infof("Froze collection %s", collectionName)
+
+	return c.save()
+}
+
+// UnfreezeCollection makes a collection frozen by FreezeCollection writable again
+func (c *Client) UnfreezeCollection(collectionName string) error {
+	if c.isReadOnly() {
+		return ErrClientIsReadOnly
+	}
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+
+	cl.Unfreeze()
+	util.Infof("Unfroze collection %s", collectionName)
+
+	return c.save()
+}
+
+// IsCollectionFrozen tells whether a collection has been frozen by FreezeCollection
+func (c *Client) IsCollectionFrozen(collectionName string) (bool, error) {
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return false, err
+	}
+
+	return cl.IsFrozen(), nil
+}
+
+/********************************************************************************
+* E X P I R A T I O N
+*********************************************************************************/
+
+// GetExpiry returns the time a document written with SetWithTTL expires at, or the zero time if it doesn't expire
+func (c *Client) GetExpiry(collectionName string, k Key) (time.Time, error) {
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return cl.GetExpiry(key.Key(k))
+}
+
+// Touch makes a document expire after ttl from now, without rewriting it, e.g. for a session store with sliding
+// expiration. It returns an error that satisfies IsNotExist if the document doesn't exist, or has already expired.
+func (c *Client) Touch(collectionName string, k Key, ttl time.Duration) error {
+
+	cl, err := c.getWritableCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+
+	return cl.Touch(key.Key(k), ttl)
+}
+
+// ReapExpired deletes the expired documents of a collection, along with their index entries, and returns how many it
+// deleted. With CollectionProps.ReapInterval set, this is also done in the background.
+func (c *Client) ReapExpired(collectionName string) (int, error) {
+
+	cl, err := c.getWritableCollectionByName(collectionName)
+	if err != nil {
+		return 0, err
+	}
+
+	return cl.ReapExpired()
+}
+
+// GetReapStats returns the numbers of the expired documents of a collection that have been deleted since it was loaded
+func (c *Client) GetReapStats(collectionName string) (ReapStats, error) {
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return ReapStats{}, err
+	}
+
+	return ReapStats(cl.GetReapStats()), nil
+}
+
+/********************************************************************************
+* E X T E R N A L  C H A N G E S
+*********************************************************************************/
+
+// WatchExternalChanges has the client watch the files of the documents of a collection for changes made by other
+// processes, and update the indexes, the cache and the stats of the collection for them every interval (see
+// SyncExternalChanges). The partition dirs are watched with fsnotify, and if that's not possible, all the files are
+// checked every interval instead. fn, if not nil, is called with the changes found by every run, which are also
+// delivered to the subscribers of the collection. Watchers aren't saved, so they need to be set up again every time the
+// client is initialized, and they stop when the collection is closed.
+func (c *Client) WatchExternalChanges(collectionName string, interval time.Duration, fn func(changes []ExternalChange)) error {
+
+	cl, err := c.getWritableCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+
+	var handler collection.ExternalChangeHandler
+	if fn != nil {
+		handler = func(changes []collection.ExternalChange) { fn(getExternalChanges(changes)) }
+	}
+	return cl.WatchExternalChanges(interval, handler)
+}
+
+// StopWatchingExternalChanges stops the watcher of a collection started by WatchExternalChanges, if there is one
+func (c *Client) StopWatchingExternalChanges(collectionName string) error {
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+
+	cl.StopWatchingExternalChanges()
+	return nil
+}
+
+// SyncExternalChanges updates a collection for the documents that have been added, modified or removed by other
+// processes since it was last called (or since the collection started to be watched), and returns those changes. The
+// first call only takes note of the files of the documents. External changes are found by comparing the sizes and the
+// modification times of all the files, see WatchExternalChanges for a watcher that is notified of them.
+func (c *Client) SyncExternalChanges(collectionName string) ([]ExternalChange, error) {
+
+	cl, err := c.getWritableCollectionByName(collectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := cl.SyncExternalChanges()
+	return getExternalChanges(changes), err
+}
+
+func getExternalChanges(changes []collection.ExternalChange) []ExternalChange {
+	var result []ExternalChange
+	for _, change := range changes {
+		result = append(result, ExternalChange(change))
+	}
+	return result
+}
+
+/********************************************************************************
+* S T A L E  W H I L E  R E V A L I D A T E
+*********************************************************************************/
+
+// Loader returns the fresh data of the document for k of a collection, see RegisterLoader
+type Loader func(ctx context.Context, k Key) ([]byte, error)
+
+// RegisterLoader sets the func that GetStaleWhileRevalidate uses to refresh the documents of a collection. Loaders
+// aren't saved, so they need to be registered again every time the client is initialized.
+func (c *Client) RegisterLoader(collectionName string, fn Loader) error {
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+
+	if fn == nil {
+		cl.SetLoader(nil)
+		return nil
+	}
+	cl.SetLoader(func(ctx context.Context, k key.Key) ([]byte, error) {
+		return fn(ctx, Key(k))
+	})
+	return nil
+}
+
+// GetStaleWhileRevalidate is Get for collections used as a cache, with a SoftTTL and a Loader (see RegisterLoader). A
+// document that is past its SoftTTL is returned right away, and refreshed in the background with the Loader; the
+// returned bool tells whether it was stale. A document that doesn't exist is loaded with the Loader, written and
+// returned.
+func (c *Client) GetStaleWhileRevalidate(ctx context.Context, collectionName string, k Key) ([]byte, bool, error) {
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return cl.GetStaleWhileRevalidate(ctx, key.Key(k))
+}
+
+/********************************************************************************
+* N A V I G A T I O N   H E L P E R S
+*********************************************************************************/
+
+func (c *Client) getDirPathForCollection(collectionName string) string {
+	dirs := []string{c.documentRoot, util.DATA_DIR_NAME, collectionName}
+	return strings.Join(dirs, string(os.PathSeparator))
+}
+
+/********************************************************************************
+* E N T I T Y  C R E A T O R S
+*********************************************************************************/
+
+// GetNewEntityID generates a unique pk.ID for the given collection
+func (c *Client) GetNewEntityID(collection string) (Key, error) {
+
+	// Get an random ID
+	id := getNewID()
+
+	// Check if it already exists
+	cl, err := c.getCollectionByName(collection)
+	if err != nil {
+		return id, err
+	}
+	exists, err := cl.IsDocExist(key.Key(id))
+	if err != nil {
+		return id, fmt.Errorf("generated the new id %d but could not verify that it is unique: %w", id, err)
+	}
+	if !exists { // If the document doesn't exist, we're good to go
+		return id, nil
 	}
 
 	return c.GetNewEntityID(collection)
@@ -528,14 +2269,13 @@ func (c *Client) SaveNewEntity(collection string, entity interface{}) (Key, erro
 	vID := reflect.ValueOf(id)
 	// conver the vID to type of fv
 	vID = vID.Convert(fv.Type())
-	clog.Debugf("[gofiledb] SaveNewEntity: id converted to %v with value %v", fv.Type(), vID)
+	util.Debugf("[gofiledb] SaveNewEntity: id converted to %v with value %v", fv.Type(), vID)
 	fv.Set(vID)
 	
 	// Save the new entity
 	entity = v.Interface()
-	clog.Debugf("[gofiledb] Saving the new entity: %v", entity)
-	cl := GetClient()
-	err = cl.SetStruct(collection, Key(id), entity)
+	util.Debugf("[gofiledb] Saving the new entity: %v", entity)
+	err = c.SetStruct(collection, Key(id), entity)
 	if err != nil {
 		return id, err
 	}
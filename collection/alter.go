@@ -0,0 +1,183 @@
+package collection
+
+import (
+	"github.com/teejays/gofiledb/util"
+	"os"
+	"sync/atomic"
+)
+
+/********************************************************************************
+* A L T E R I N G
+*********************************************************************************/
+
+// Props such as the number of partitions, the encoding or the compression of a collection decide how every document is
+// stored, so changing them means migrating all the documents. Alter writes the documents into a new dir next to the
+// collection's (ALTER_NEW_DIR_SUFFIX), as a collection with the new props, and builds the indexes there. The dir of the
+// collection is then swapped with the new one, keeping the old one aside (ALTER_OLD_DIR_SUFFIX) until the swap is done.
+// Once the old dir has been set aside, the alteration can only be finished, and before that, it can only be abandoned.
+//
+// Revisions, the audit trail and quarantined documents are in the format of the old props, and they are dropped.
+
+const ALTER_NEW_DIR_SUFFIX string = ".alter_new"
+const ALTER_OLD_DIR_SUFFIX string = ".alter_old"
+
+// Alter migrates all the documents of the collection to the layout and format of p, rebuilds its indexes, and then
+// changes its props to p. The collection should have been closed. If Alter fails, the collection is left as it was,
+// unless the dirs were being swapped, in which case RecoverAlter should be called with the same p to finish it.
+func (cl *Collection) Alter(p CollectionProps) error {
+	// wait for any writes that are still in progress
+	cl.readSnapshotsLock.Lock()
+	defer cl.readSnapshotsLock.Unlock()
+
+	newDirPath := cl.DirPath + ALTER_NEW_DIR_SUFFIX
+	err := cl.fs().RemoveAll(newDirPath) // left behind by an earlier attempt
+	if err != nil {
+		return err
+	}
+
+	err = cl.fillAlteredDir(p, newDirPath)
+	if err != nil {
+		if rErr := cl.fs().RemoveAll(newDirPath); rErr != nil {
+			util.Errorf("Could not remove %s after altering collection %s failed: %s", newDirPath, cl.Name, rErr)
+		}
+		return err
+	}
+
+	// Anything that was opened while reading the documents points into the old dir
+	err = cl.closeSegmentStore()
+	if err != nil {
+		return err
+	}
+	err = cl.closeManifests()
+	if err != nil {
+		return err
+	}
+
+	err = cl.fs().Rename(cl.DirPath, cl.DirPath+ALTER_OLD_DIR_SUFFIX)
+	if err != nil {
+		return err
+	}
+	return cl.finishAlter(p)
+}
+
+// RecoverAlter finishes an Alter that was interrupted while the dirs were being swapped, or abandons it if it was
+// interrupted before that. It returns whether the collection has been altered. It is a no-op if no Alter was interrupted.
+func (cl *Collection) RecoverAlter(p CollectionProps) (bool, error) {
+	cl.readSnapshotsLock.Lock()
+	defer cl.readSnapshotsLock.Unlock()
+
+	_, err := cl.fs().Stat(cl.DirPath + ALTER_OLD_DIR_SUFFIX)
+	if os.IsNotExist(err) {
+		return false, cl.fs().RemoveAll(cl.DirPath + ALTER_NEW_DIR_SUFFIX)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, cl.finishAlter(p)
+}
+
+// fillAlteredDir copies the documents of the collection into a new collection with props p at dirPath, and builds the
+// indexes of the collection for it
+func (cl *Collection) fillAlteredDir(p CollectionProps, dirPath string) error {
+	// Nothing needs to be logged or kept for the writes of the copy itself
+	copyProps := p
+	copyProps.EnableWAL = false
+	copyProps.EnableAuditLog = false
+	copyProps.NumRevisions = 0
+	copyProps.WriteBehindQueueSize = 0
+	copyProps.IndexFlushOps = 0
+	copyProps.IndexFlushInterval = 0
+	copyProps.ReapInterval = 0
+
+	altered := &Collection{DirPath: dirPath, CollectionProps: copyProps}
+	altered.IndexStore.Store = make(map[string]IndexInfo)
+	altered.SetFS(cl.fs())
+	cl.ioLimiterLock.Lock()
+	l := cl.ioLimiter
+	cl.ioLimiterLock.Unlock()
+	altered.SetIOLimiter(l)
+	defer altered.Close()
+
+	for _, path := range []string{altered.getDataPath(), altered.GetDirPathForIndexes()} {
+		err := util.CreateDirIfNotExist(cl.fs(), path)
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := cl.CopyTo(altered)
+	if err != nil {
+		return err
+	}
+	for _, fieldLocator := range cl.GetIndexFieldLocators() {
+		err = altered.AddIndex(fieldLocator)
+		if err != nil {
+			return err
+		}
+	}
+	util.Infof("Altering collection %s: copied %d documents", cl.Name, n)
+
+	err = cl.CopyMetaTo(altered)
+	if err != nil {
+		return err
+	}
+	err = cl.copyExpiriesTo(altered)
+	if err != nil {
+		return err
+	}
+
+	return altered.Flush()
+}
+
+// finishAlter moves the new dir into place, and switches the collection over to it. It can be called again if it is
+// interrupted.
+func (cl *Collection) finishAlter(p CollectionProps) error {
+	newDirPath := cl.DirPath + ALTER_NEW_DIR_SUFFIX
+	_, err := cl.fs().Stat(newDirPath)
+	if err == nil {
+		err = cl.fs().Rename(newDirPath, cl.DirPath)
+	}
+	// if the new dir isn't there anymore, it has been moved already
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	cl.settingsLock.Lock()
+	cl.CollectionProps = p
+	cl.settingsLock.Unlock()
+	cl.resetState()
+
+	// The indexes have been rebuilt, so the info on them needs to be loaded again
+	for _, fieldLocator := range cl.GetIndexFieldLocators() {
+		idx, err := cl.loadIndex(fieldLocator)
+		if err != nil {
+			return err
+		}
+		cl.IndexStore.Lock()
+		cl.IndexStore.Store[fieldLocator] = idx.IndexInfo
+		cl.IndexStore.Unlock()
+	}
+
+	return cl.fs().RemoveAll(cl.DirPath + ALTER_OLD_DIR_SUFFIX)
+}
+
+// resetState drops everything the collection has kept in memory about its documents and indexes, which are not the same
+// anymore after an Alter
+func (cl *Collection) resetState() {
+	cl.cacheLock.Lock()
+	cl.cache = nil
+	cl.cacheLock.Unlock()
+
+	cl.indexCacheLock.Lock()
+	cl.indexCache = nil
+	cl.indexCacheGeneration++
+	cl.indexCacheLock.Unlock()
+
+	cl.readTimesLock.Lock()
+	cl.readTimes = nil
+	cl.readTimesLock.Unlock()
+	atomic.StoreInt32(&cl.coldState, coldStateUnknown)
+	cl.dropStats()
+	cl.dropExpiries()
+}
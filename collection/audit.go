@@ -0,0 +1,238 @@
+package collection
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/********************************************************************************
+* A U D I T  L O G
+*********************************************************************************/
+
+// When EnableAuditLog is set, every change to a document is recorded in the audit log of the collection: when it
+// happened, who made it, what the op was, and the sha256 of the document data that was written. The log is kept under
+// meta/audit/ as JSON lines. Once the current log grows beyond AUDIT_LOG_MAX_SIZE it is rotated, i.e. renamed to
+// audit.log.<n>, and a new one is started. Rotated logs are never removed by gofiledb.
+//
+// Note that the hash is of the plaintext data, even for encrypted collections, so it can be used to check whether a
+// document had some known content.
+
+const AUDIT_DIR_NAME string = "audit"
+const AUDIT_LOG_FILE_NAME string = "audit.log"
+const AUDIT_LOG_MAX_SIZE int64 = 4 * 1024 * 1024
+
+const (
+	AUDIT_OP_SET        string = "set"
+	AUDIT_OP_DELETE     string = "delete"
+	AUDIT_OP_REVERT     string = "revert"
+	AUDIT_OP_QUARANTINE string = "quarantine"
+)
+
+type AuditEntry struct {
+	Time        time.Time
+	Actor       string
+	Op          string
+	Key         key.Key
+	PayloadHash string `json:",omitempty"` // hex encoded sha256 of the document data, for ops that write data
+}
+
+// SetAuditActor sets who the changes to the collection are attributed to in the audit log. By default, this is the OS
+// user and host name of the process.
+func (cl *Collection) SetAuditActor(actor string) {
+	cl.auditLock.Lock()
+	cl.auditActor = actor
+	cl.auditLock.Unlock()
+}
+
+func getDefaultAuditActor() string {
+	var name string = "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s@%s", name, host)
+}
+
+func (cl *Collection) getAuditDirPath() string {
+	return util.JoinPath(cl.DirPath, META_DIR_NAME, AUDIT_DIR_NAME)
+}
+
+// audit records op on the document for k in the audit log, if it is enabled. data is the document data that was
+// written, if any.
+func (cl *Collection) audit(op string, k key.Key, data []byte) error {
+	if !cl.EnableAuditLog {
+		return nil
+	}
+
+	e := AuditEntry{
+		Time: time.Now(),
+		Op:   op,
+		Key:  k,
+	}
+	if data != nil {
+		sum := sha256.Sum256(data)
+		e.PayloadHash = hex.EncodeToString(sum[:])
+	}
+
+	cl.auditLock.Lock()
+	defer cl.auditLock.Unlock()
+
+	if cl.auditActor == "" {
+		cl.auditActor = getDefaultAuditActor()
+	}
+	e.Actor = cl.auditActor
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	dirPath := cl.getAuditDirPath()
+	err = util.CreateDirIfNotExist(cl.fs(), dirPath)
+	if err != nil {
+		return err
+	}
+	path := util.JoinPath(dirPath, AUDIT_LOG_FILE_NAME)
+
+	err = cl.rotateAuditLog(path)
+	if err != nil {
+		return err
+	}
+
+	file, err := cl.fs().OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, util.FILE_PERM)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if err == nil {
+		err = cl.syncFile(file)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// rotateAuditLog renames the log at path to the next rotated log name if it has grown too big. It should be called
+// while holding auditLock.
+func (cl *Collection) rotateAuditLog(path string) error {
+	info, err := cl.fs().Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() < AUDIT_LOG_MAX_SIZE {
+		return nil
+	}
+
+	numbers, err := cl.getRotatedAuditLogNumbers()
+	if err != nil {
+		return err
+	}
+	var next int = 1
+	if len(numbers) > 0 {
+		next = numbers[len(numbers)-1] + 1
+	}
+
+	rotatedPath := path + "." + strconv.Itoa(next)
+	err = cl.fs().Rename(path, rotatedPath)
+	if err != nil {
+		return err
+	}
+	return cl.syncRenamed(rotatedPath)
+}
+
+// getRotatedAuditLogNumbers returns the numbers of the rotated logs, in increasing order i.e. oldest first
+func (cl *Collection) getRotatedAuditLogNumbers() ([]int, error) {
+	names, err := cl.getDirNames(cl.getAuditDirPath())
+	if err != nil {
+		return nil, err
+	}
+
+	var numbers []int
+	prefix := AUDIT_LOG_FILE_NAME + "."
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(name, prefix))
+		if err != nil {
+			continue
+		}
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	return numbers, nil
+}
+
+// GetAuditTrail returns all the entries in the audit log for the document k, oldest first
+func (cl *Collection) GetAuditTrail(k key.Key) ([]AuditEntry, error) {
+	cl.auditLock.Lock()
+	defer cl.auditLock.Unlock()
+
+	numbers, err := cl.getRotatedAuditLogNumbers()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	path := util.JoinPath(cl.getAuditDirPath(), AUDIT_LOG_FILE_NAME)
+	for _, n := range numbers {
+		paths = append(paths, path+"."+strconv.Itoa(n))
+	}
+	paths = append(paths, path)
+
+	var entries []AuditEntry
+	for _, path := range paths {
+		err = cl.readAuditLog(path, func(e AuditEntry) {
+			if e.Key == k {
+				entries = append(entries, e)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+// readAuditLog calls fn with each entry in the log at path. Lines that can't be parsed, e.g. one that was only partially
+// written because of a crash, are skipped.
+func (cl *Collection) readAuditLog(path string, fn func(e AuditEntry)) error {
+	file, err := cl.fs().Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e AuditEntry
+		err = json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			continue
+		}
+		fn(e)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,82 @@
+package collection
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"github.com/teejays/gofiledb/util"
+	"io"
+	"os"
+	"time"
+)
+
+/********************************************************************************
+* B A C K U P S
+*********************************************************************************/
+
+// A backup of a collection is a tar.gz archive laid out like a snapshot (see Snapshot): it has the files of the collection
+// dir that a snapshot has, and the collection info in SNAPSHOT_COLLECTION_FILE_NAME, so an extracted backup can be
+// restored with RestoreSnapshot. Rather than copying the collection first, Backup pauses the writes to it while the
+// archive is written (see PauseWrites): it takes no extra disk space, but writers wait for it, so it should be given a w
+// that keeps up. Reads carry on.
+
+// PauseWrites waits for the writes in progress (including the ones queued for write-behind), saves the batched index
+// changes, and then blocks the writes to the collection until the returned func is called. The files of the collection
+// don't change in the meantime, other than the ones that are replaced as a whole (see writeFile), e.g. by Flush.
+func (cl *Collection) PauseWrites() (func(), error) {
+	cl.waitForAllWrites()
+
+	cl.readSnapshotsLock.Lock()
+	err := cl.FlushIndexes()
+	if err != nil {
+		cl.readSnapshotsLock.Unlock()
+		return nil, err
+	}
+	return cl.readSnapshotsLock.Unlock, nil
+}
+
+// Backup writes a tar.gz archive of a consistent copy of the collection to w
+func (cl *Collection) Backup(w io.Writer) error {
+	resume, err := cl.PauseWrites()
+	if err != nil {
+		return err
+	}
+	defer resume()
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	_, err = util.WriteTarDir(cl.fs(), tw, cl.DirPath, "", func(relPath string, info os.FileInfo) bool {
+		return !info.IsDir() && cl.getSnapshotFileMode(relPath) == snapshotFileSkip
+	})
+	if err != nil {
+		return err
+	}
+
+	// GobEncode leaves out the encryption keys
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(cl)
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     SNAPSHOT_COLLECTION_FILE_NAME,
+		Mode:     util.FILE_PERM,
+		Size:     int64(buf.Len()),
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,183 @@
+package collection
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"os"
+	"path/filepath"
+)
+
+/********************************************************************************
+* C O N T E N T  A D D R E S S E D  S T O R A G E
+*********************************************************************************/
+
+// With STORAGE_CONTENT_ADDRESSED, the content of each document file (the doc header and the data) is stored in a blob
+// named after its SHA-256 hash, under blobs/<first 2 hex digits of the hash>/<hash>, and the file of the document in its
+// partition dir is a small pointer to the blob. Documents with the same content share a blob, and a blob never changes
+// once it has been written, so tools like rsync or a backup that dedupes by file only ever transfer a blob once, and only
+// the pointers of the documents that have changed. Encrypted documents never share a blob, since they are encrypted with
+// a random nonce.
+//
+// A pointer is BLOB_POINTER_PREFIX followed by the hash. Any other file in a partition dir, e.g. a document that was
+// quarantined (see quarantine) and restored, or that was written before the collection was altered to
+// STORAGE_CONTENT_ADDRESSED, is read as a document file of its own. Blobs are not removed along with the documents that
+// point to them, since other documents may, and PruneBlobs removes the ones that no document points to anymore.
+
+const BLOBS_DIR_NAME string = "blobs"
+const BLOB_POINTER_PREFIX string = "GFDBREF"
+
+const blobPointerLen int = len(BLOB_POINTER_PREFIX) + sha256.Size*2
+
+var ErrContentAddressingIsNotEnabled = fmt.Errorf("The collection does not use STORAGE_CONTENT_ADDRESSED")
+
+func (cl *Collection) isContentAddressed() bool {
+	return cl.StorageEngine == STORAGE_CONTENT_ADDRESSED
+}
+
+func (cl *Collection) getBlobsDirPath() string {
+	return util.JoinPath(cl.DirPath, BLOBS_DIR_NAME)
+}
+
+func (cl *Collection) getBlobPath(hash string) string {
+	return util.JoinPath(cl.getBlobsDirPath(), hash[:2], hash)
+}
+
+// parseBlobPointer returns the hash of the blob that data points to, and whether it is a pointer at all
+func parseBlobPointer(data []byte) (string, bool) {
+	if len(data) != blobPointerLen || !bytes.HasPrefix(data, []byte(BLOB_POINTER_PREFIX)) {
+		return "", false
+	}
+	return string(data[len(BLOB_POINTER_PREFIX):]), true
+}
+
+// storeBlob stores fileData in its blob, unless it is stored already, and returns the pointer to it
+func (cl *Collection) storeBlob(fileData []byte) ([]byte, error) {
+	sum := sha256.Sum256(fileData)
+	hash := hex.EncodeToString(sum[:])
+	path := cl.getBlobPath(hash)
+
+	err := util.CreateDirIfNotExist(cl.fs(), filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	err = cl.writeNewFile(path, fileData)
+	if err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	return []byte(BLOB_POINTER_PREFIX + hash), nil
+}
+
+// resolveBlobPointer returns the content of the blob if data is a pointer to one, and data otherwise. A blob that is
+// missing makes the document corrupted.
+func (cl *Collection) resolveBlobPointer(data []byte) ([]byte, error) {
+	hash, isPointer := parseBlobPointer(data)
+	if !isPointer {
+		return data, nil
+	}
+	blob, err := util.ReadFile(cl.fs(), cl.getBlobPath(hash))
+	if os.IsNotExist(err) {
+		return nil, ErrDocumentIsCorrupted
+	}
+	return blob, err
+}
+
+// resolveDocPath returns the path of the blob that the document file at path points to, or path if it is not a pointer
+func (cl *Collection) resolveDocPath(path string) (string, error) {
+	info, err := cl.fs().Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Size() != int64(blobPointerLen) {
+		return path, nil
+	}
+	data, err := util.ReadFile(cl.fs(), path)
+	if err != nil {
+		return "", err
+	}
+	hash, isPointer := parseBlobPointer(data)
+	if !isPointer {
+		return path, nil
+	}
+	blobPath := cl.getBlobPath(hash)
+	if _, err := cl.fs().Stat(blobPath); os.IsNotExist(err) {
+		return "", ErrDocumentIsCorrupted
+	}
+	return blobPath, nil
+}
+
+// materializeDocFile replaces the document file at path, if it is a pointer, with the content of its blob, so that it
+// can be moved out of the partition dir on its own, e.g. into quarantine
+func (cl *Collection) materializeDocFile(path string) error {
+	data, err := util.ReadFile(cl.fs(), path)
+	if err != nil {
+		return err
+	}
+	if _, isPointer := parseBlobPointer(data); !isPointer {
+		return nil
+	}
+	blob, err := cl.resolveBlobPointer(data)
+	if err == ErrDocumentIsCorrupted { // nothing to keep but the pointer
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return cl.writeFile(path, blob)
+}
+
+// PruneBlobs removes the blobs that no document points to anymore, and returns the number of blobs removed. The writes
+// to the collection are paused while it runs (see PauseWrites), so that a blob can't be pointed to again while it is
+// being removed.
+func (cl *Collection) PruneBlobs() (int, error) {
+	if !cl.isContentAddressed() {
+		return 0, ErrContentAddressingIsNotEnabled
+	}
+	resume, err := cl.PauseWrites()
+	if err != nil {
+		return 0, err
+	}
+	defer resume()
+
+	pointedTo := make(map[string]bool)
+	err = cl.forEachDoc(func(k key.Key, docPath string) error {
+		data, err := util.ReadFile(cl.fs(), docPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hash, isPointer := parseBlobPointer(data); isPointer {
+			pointedTo[hash] = true
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	var n int
+	err = util.Walk(cl.fs(), cl.getBlobsDirPath(), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == cl.getBlobsDirPath() { // no blobs yet
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || pointedTo[info.Name()] {
+			return nil
+		}
+		// a blob left behind by a write that failed before its pointer was written is just as unused
+		err = cl.fs().Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,246 @@
+package collection
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/********************************************************************************
+* C A C H E
+*********************************************************************************/
+
+// If CacheMaxEntries or CacheMaxBytes is set, the decompressed (and decrypted) data of the documents that are read is
+// kept in memory, so that hot keys don't need to be read from disk every time. When the cache is full, the least
+// recently used documents are evicted. A document is removed from the cache whenever it is changed, deleted or
+// quarantined.
+//
+// A read that misses the cache can race with a write to the same document: the read may get the old data from disk
+// after the write has already removed the document from the cache. To avoid caching the old data in that case, every
+// removal bumps a generation number, and data read from disk is only cached if the generation hasn't changed since the
+// read started.
+
+var ErrCacheIsNotEnabled = fmt.Errorf("The collection does not have a cache, since neither CacheMaxEntries nor CacheMaxBytes is set")
+
+type docCache struct {
+	maxEntries int   // 0 means no limit on the number of entries
+	maxBytes   int64 // 0 means no limit on the total size of the data
+	numBytes   int64
+	generation uint64
+	lru        *list.List // of *docCacheEntry, most recently used first
+	entries    map[key.Key]*list.Element
+	numHits    int64
+	numMisses  int64
+	sync.Mutex
+}
+
+// CacheStats describes the cache of a collection, see GetCacheStats
+type CacheStats struct {
+	NumEntries int
+	NumBytes   int64
+	NumHits    int64 // reads of documents that were in the cache, since the collection was loaded
+	NumMisses  int64 // reads of documents that were not
+}
+
+type docCacheEntry struct {
+	k    key.Key
+	h    docHeader
+	data []byte
+}
+
+func newDocCache(maxEntries int, maxBytes int64) *docCache {
+	return &docCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		lru:        list.New(),
+		entries:    make(map[key.Key]*list.Element),
+	}
+}
+
+// getCache returns the cache of the collection, or nil if caching is not enabled
+func (cl *Collection) getCache() *docCache {
+	maxEntries, maxBytes := cl.GetCacheLimits()
+	if maxEntries <= 0 && maxBytes <= 0 {
+		return nil
+	}
+
+	cl.cacheLock.Lock()
+	defer cl.cacheLock.Unlock()
+
+	if cl.cache == nil {
+		cl.cache = newDocCache(maxEntries, maxBytes)
+	}
+	return cl.cache
+}
+
+// uncache removes the document for k from the cache. It should be called once a change to the document is on disk.
+func (cl *Collection) uncache(k key.Key) {
+	c := cl.getCache()
+	if c == nil {
+		return
+	}
+	c.remove(k)
+}
+
+// GetCacheStats returns the size of the cache of the collection, and how often it has been hit
+func (cl *Collection) GetCacheStats() (CacheStats, error) {
+	c := cl.getCache()
+	if c == nil {
+		return CacheStats{}, ErrCacheIsNotEnabled
+	}
+	c.Lock()
+	defer c.Unlock()
+	return CacheStats{NumEntries: c.lru.Len(), NumBytes: c.numBytes, NumHits: c.numHits, NumMisses: c.numMisses}, nil
+}
+
+// get returns the cached header and data for k. The data should not be modified.
+func (c *docCache) get(k key.Key) (docHeader, []byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.entries[k]
+	if !ok {
+		c.numMisses++
+		return docHeader{}, nil, false
+	}
+	c.numHits++
+	c.lru.MoveToFront(el)
+	e := el.Value.(*docCacheEntry)
+	return e.h, e.data, true
+}
+
+// getGeneration returns the current generation, which should be passed to add along with the data read after this call
+func (c *docCache) getGeneration() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.generation
+}
+
+// add caches data for k, unless a document has been removed from the cache since generation. The cache keeps data, so
+// it shouldn't be modified afterwards.
+func (c *docCache) add(k key.Key, h docHeader, data []byte, generation uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	if c.maxBytes > 0 && int64(len(data)) > c.maxBytes {
+		return
+	}
+
+	if el, ok := c.entries[k]; ok {
+		c.removeElement(el)
+	}
+	c.entries[k] = c.lru.PushFront(&docCacheEntry{k: k, h: h, data: data})
+	c.numBytes += int64(len(data))
+
+	c.evict()
+}
+
+// evict removes the least recently used entries until the cache is within its limits again. It should be called while
+// holding the lock.
+func (c *docCache) evict() {
+	for (c.maxEntries > 0 && c.lru.Len() > c.maxEntries) || (c.maxBytes > 0 && c.numBytes > c.maxBytes) {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// setLimits changes the limits of the cache, evicting the least recently used entries if it is over the new ones
+func (c *docCache) setLimits(maxEntries int, maxBytes int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.maxEntries = maxEntries
+	c.maxBytes = maxBytes
+	c.evict()
+}
+
+func (c *docCache) remove(k key.Key) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.generation++
+	if el, ok := c.entries[k]; ok {
+		c.removeElement(el)
+	}
+}
+
+// removeElement should be called while holding the lock
+func (c *docCache) removeElement(el *list.Element) {
+	e := c.lru.Remove(el).(*docCacheEntry)
+	delete(c.entries, e.k)
+	c.numBytes -= int64(len(e.data))
+}
+
+// Preload reads the n most recently written documents of the collection into the cache, or all of them if n <= 0, so
+// that the first reads after startup don't have to go to disk. If the cache is too small for all of them, the most
+// recent ones are the ones that stay in the cache. The indexes are loaded into the index cache as well.
+func (cl *Collection) Preload(n int) error {
+	c := cl.getCache()
+	if c == nil {
+		return ErrCacheIsNotEnabled
+	}
+
+	type doc struct {
+		k       key.Key
+		modTime time.Time
+	}
+	var docs []doc
+	err := cl.forEachDoc(func(k key.Key, docPath string) error {
+		info, err := cl.fs().Stat(docPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		docs = append(docs, doc{k, info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// load the most recent ones last, so that they are the most recently used
+	// documents in the same segment share its mod time, but forEachDoc gives them in the order they were written
+	sort.SliceStable(docs, func(i, j int) bool { return docs[i].modTime.Before(docs[j].modTime) })
+	if n > 0 && len(docs) > n {
+		docs = docs[len(docs)-n:]
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	for _, d := range docs {
+		buf.Reset()
+		_, err = cl.readDocData(context.Background(), d.k, buf)
+		// the document may have been deleted or quarantined since we listed it
+		if os.IsNotExist(err) || err == ErrDocumentIsCorrupted {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	cl.IndexStore.RLock()
+	var fieldLocators []string
+	for fieldLocator := range cl.IndexStore.Store {
+		fieldLocators = append(fieldLocators, fieldLocator)
+	}
+	cl.IndexStore.RUnlock()
+
+	for _, fieldLocator := range fieldLocators {
+		_, err = cl.getCachedIndex(fieldLocator)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
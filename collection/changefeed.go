@@ -0,0 +1,382 @@
+package collection
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/********************************************************************************
+* C H A N G E  F E E D
+*********************************************************************************/
+
+// When EnableChangeFeed is set, every change to a document is recorded in the change feed of the collection, with a
+// sequence number that is one more than the one of the change before. A consumer, e.g. a search indexer in another
+// service, reads the changes since the last one it has seen with Changes, and keeps the sequence number of that one, so
+// that it can carry on from there after a restart, without missing or repeating a change.
+//
+// The feed is kept under meta/changes/ as JSON lines, like the audit log. Once the current file grows beyond
+// CHANGE_FEED_MAX_SIZE it is rotated, i.e. renamed to changes.log.<the sequence number of its last change>, and a new one
+// is started. Rotated files are kept until they are removed with PruneChanges. A change is recorded once it has been
+// applied, while the document is still locked, so the changes to a document are in the feed in the order they were made
+// in. Like the audit log, the feed is fsynced as per the Durability setting of the collection.
+
+const CHANGE_FEED_DIR_NAME string = "changes"
+const CHANGE_FEED_FILE_NAME string = "changes.log"
+const CHANGE_FEED_MAX_SIZE int64 = 4 * 1024 * 1024
+
+var ErrChangeFeedNotEnabled = fmt.Errorf("The collection does not have a change feed, see EnableChangeFeed")
+
+// Sequence is the sequence number of a change in the change feed. The first change has sequence number 1.
+type Sequence uint64
+
+// Change is a change to a document, as recorded in the change feed
+type Change struct {
+	Seq  Sequence
+	Time time.Time
+	Op   string // one of the AUDIT_OP_ constants
+	Key  key.Key
+}
+
+type changeFeed struct {
+	lastSeq  Sequence
+	isLoaded bool // whether lastSeq has been read from the feed, see loadChangeFeed
+	sync.Mutex
+}
+
+func (cl *Collection) getChangeFeedDirPath() string {
+	return util.JoinPath(cl.DirPath, META_DIR_NAME, CHANGE_FEED_DIR_NAME)
+}
+
+func (cl *Collection) getChangeFeedPath() string {
+	return util.JoinPath(cl.getChangeFeedDirPath(), CHANGE_FEED_FILE_NAME)
+}
+
+// recordAppliedChange records op on the document for k in the change feed, once the write has been applied. The write
+// has happened by then, so the error it returns says so, and the caller should still commit the write.
+func (cl *Collection) recordAppliedChange(op string, k key.Key) error {
+	err := cl.recordChange(op, k)
+	if err != nil {
+		return fmt.Errorf("the %s of document %s was applied, but could not be recorded in the change feed: %w", op, k, err)
+	}
+	return nil
+}
+
+// recordChange records op on the document for k in the change feed, if it is enabled
+func (cl *Collection) recordChange(op string, k key.Key) error {
+	if !cl.EnableChangeFeed {
+		return nil
+	}
+
+	f := &cl.changeFeed
+	f.Lock()
+	defer f.Unlock()
+
+	err := cl.loadChangeFeed()
+	if err != nil {
+		return err
+	}
+	c := Change{Seq: f.lastSeq + 1, Time: time.Now(), Op: op, Key: k}
+	line, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	err = util.CreateDirIfNotExist(cl.fs(), cl.getChangeFeedDirPath())
+	if err != nil {
+		return err
+	}
+	path := cl.getChangeFeedPath()
+	err = cl.rotateChangeFeed(path)
+	if err != nil {
+		return err
+	}
+
+	file, err := cl.fs().OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, util.FILE_PERM)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if err == nil {
+		err = cl.syncFile(file)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	f.lastSeq = c.Seq
+	return nil
+}
+
+// loadChangeFeed reads the sequence number of the last change from the feed, the first time it is needed. A change that
+// was only partly written, by a process that crashed while writing it, is removed, so that the next one starts on a line
+// of its own. It should be called while holding the lock of cl.changeFeed.
+func (cl *Collection) loadChangeFeed() error {
+	f := &cl.changeFeed
+	if f.isLoaded {
+		return nil
+	}
+
+	path := cl.getChangeFeedPath()
+	data, err := util.ReadFile(cl.fs(), path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	complete := data[:bytes.LastIndexByte(data, '\n')+1]
+	if len(complete) < len(data) {
+		err = cl.fs().Truncate(path, int64(len(complete)))
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(complete) > 0 {
+		lines := bytes.Split(bytes.TrimSuffix(complete, []byte("\n")), []byte("\n"))
+		var c Change
+		err = json.Unmarshal(lines[len(lines)-1], &c)
+		if err != nil {
+			return fmt.Errorf("could not read the last change of the change feed: %w", err)
+		}
+		f.lastSeq = c.Seq
+	} else {
+		// Just rotated, or never written
+		seqs, err := cl.getRotatedChangeFeedSeqs()
+		if err != nil {
+			return err
+		}
+		if len(seqs) > 0 {
+			f.lastSeq = seqs[len(seqs)-1]
+		}
+	}
+
+	f.isLoaded = true
+	return nil
+}
+
+// rotateChangeFeed renames the feed at path after the sequence number of its last change, if it has grown too big. It
+// should be called while holding the lock of cl.changeFeed.
+func (cl *Collection) rotateChangeFeed(path string) error {
+	info, err := cl.fs().Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() < CHANGE_FEED_MAX_SIZE {
+		return nil
+	}
+
+	rotatedPath := path + "." + strconv.FormatUint(uint64(cl.changeFeed.lastSeq), 10)
+	err = cl.fs().Rename(path, rotatedPath)
+	if err != nil {
+		return err
+	}
+	return cl.syncRenamed(rotatedPath)
+}
+
+// getRotatedChangeFeedSeqs returns the sequence numbers that the rotated files of the feed are named after, in
+// increasing order i.e. oldest first
+func (cl *Collection) getRotatedChangeFeedSeqs() ([]Sequence, error) {
+	names, err := cl.getDirNames(cl.getChangeFeedDirPath())
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []Sequence
+	prefix := CHANGE_FEED_FILE_NAME + "."
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimPrefix(name, prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, Sequence(n))
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	return seqs, nil
+}
+
+// GetLastChangeSeq returns the sequence number of the last change in the change feed, or 0 if there is none
+func (cl *Collection) GetLastChangeSeq() (Sequence, error) {
+	if !cl.EnableChangeFeed {
+		return 0, ErrChangeFeedNotEnabled
+	}
+	f := &cl.changeFeed
+	f.Lock()
+	defer f.Unlock()
+	err := cl.loadChangeFeed()
+	return f.lastSeq, err
+}
+
+// ChangeIterator reads the changes of a change feed in order, see Changes. It should be closed once it is done with.
+type ChangeIterator struct {
+	cl      *Collection
+	since   Sequence
+	paths   []string  // the rotated files of the feed that are left to read
+	current util.File // the current file of the feed, read once the rotated ones are
+	file    util.File // the file being read
+	r       *bufio.Reader
+	change  Change
+	err     error
+}
+
+// Changes returns an iterator over the changes of the change feed after the change with sequence number since, up to
+// the last one recorded by the time the iterator gets to it. Once it is done, Changes can be called again with the
+// sequence number of the last change it returned to get the changes recorded since. The changes that have been pruned
+// (see PruneChanges) are skipped.
+func (cl *Collection) Changes(since Sequence) (*ChangeIterator, error) {
+	if !cl.EnableChangeFeed {
+		return nil, ErrChangeFeedNotEnabled
+	}
+
+	// The current file is opened right away, so that no change is missed if it is rotated before it is read
+	cl.changeFeed.Lock()
+	defer cl.changeFeed.Unlock()
+	seqs, err := cl.getRotatedChangeFeedSeqs()
+	if err != nil {
+		return nil, err
+	}
+	path := cl.getChangeFeedPath()
+	current, err := cl.fs().Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Rotated files only have changes up to the sequence number they are named after
+	it := &ChangeIterator{cl: cl, since: since, current: current}
+	for _, seq := range seqs {
+		if seq > since {
+			it.paths = append(it.paths, path+"."+strconv.FormatUint(uint64(seq), 10))
+		}
+	}
+	return it, nil
+}
+
+// Next moves the iterator to the next change, and tells whether there is one. It returns false once there are no more
+// changes, or if there was an error, see Err.
+func (it *ChangeIterator) Next() bool {
+	for it.err == nil {
+		if it.r == nil {
+			switch {
+			case len(it.paths) > 0:
+				file, err := it.cl.fs().Open(it.paths[0])
+				if os.IsNotExist(err) { // pruned since the iterator was created
+					it.paths = it.paths[1:]
+					continue
+				}
+				if err != nil {
+					it.err = err
+					return false
+				}
+				it.file = file
+				it.paths = it.paths[1:]
+			case it.current != nil:
+				it.file, it.current = it.current, nil
+			default:
+				return false
+			}
+			it.r = bufio.NewReader(it.file)
+		}
+
+		line, err := it.r.ReadBytes('\n')
+		if err == io.EOF {
+			// The rest of the file, if any, is a change that is still being written
+			it.closeFile()
+			continue
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		var c Change
+		err = json.Unmarshal(line, &c)
+		if err != nil {
+			it.err = fmt.Errorf("could not read a change of the change feed of collection %s: %w", it.cl.Name, err)
+			return false
+		}
+		if c.Seq <= it.since {
+			continue
+		}
+		it.change = c
+		return true
+	}
+	return false
+}
+
+// Change returns the change that the iterator is at
+func (it *ChangeIterator) Change() Change {
+	return it.change
+}
+
+// Err returns the error that stopped the iterator, if any
+func (it *ChangeIterator) Err() error {
+	return it.err
+}
+
+// Close releases the files that the iterator has open
+func (it *ChangeIterator) Close() error {
+	it.paths = nil
+	if it.current != nil {
+		it.current.Close()
+		it.current = nil
+	}
+	return it.closeFile()
+}
+
+func (it *ChangeIterator) closeFile() error {
+	if it.file == nil {
+		return nil
+	}
+	err := it.file.Close()
+	it.file, it.r = nil, nil
+	return err
+}
+
+// PruneChanges removes the rotated files of the change feed that only have changes up to the one with sequence number
+// before, e.g. once every consumer has read them, and returns the number of files removed
+func (cl *Collection) PruneChanges(before Sequence) (int, error) {
+	if !cl.EnableChangeFeed {
+		return 0, ErrChangeFeedNotEnabled
+	}
+
+	cl.changeFeed.Lock()
+	defer cl.changeFeed.Unlock()
+	seqs, err := cl.getRotatedChangeFeedSeqs()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	path := cl.getChangeFeedPath()
+	for _, seq := range seqs {
+		if seq > before {
+			break
+		}
+		err = cl.fs().Remove(path + "." + strconv.FormatUint(uint64(seq), 10))
+		if err != nil && !os.IsNotExist(err) {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
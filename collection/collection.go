@@ -2,17 +2,20 @@ package collection
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
+	"encoding/gob"
 	"encoding/json"
 	"fmt"
+	"github.com/fxamacker/cbor/v2"
 	"github.com/teejays/gofiledb/key"
 	"github.com/teejays/gofiledb/util"
+	"github.com/vmihailenco/msgpack"
+	"go.mongodb.org/mongo-driver/bson"
 	"io"
-	"io/ioutil"
 	"os"
-	"regexp"
-	"strings"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
 /********************************************************************************
@@ -23,6 +26,9 @@ const (
 	ENCODING_NONE uint = iota
 	ENCODING_JSON
 	ENCODING_GOB
+	ENCODING_MSGPACK
+	ENCODING_CBOR
+	ENCODING_BSON // field names follow the bson package rules, i.e. lowercased unless a `bson` struct tag is provided
 )
 
 const DATA_DIR_NAME string = "data"
@@ -34,6 +40,63 @@ type (
 		DirPath    string
 		IndexStore IndexStore
 		CollectionProps
+		syncer     *syncer // only used if Durability is DURABILITY_FSYNC_INTERVAL, created on first write
+		syncerLock sync.Mutex
+		wal        *wal       // only used if EnableWAL is true, opened on first write
+		walLock    sync.Mutex // guards wal and indexJournal
+		// indexJournal is only used if EnableWAL is false and the collection has indexes, opened on first write
+		indexJournal    *wal
+		walArchiver     WALArchiver // see SetWALArchiver
+		walArchiverLock sync.Mutex
+		// requiresEncryptionKey is set when an encrypted collection is loaded from disk, since keys are not saved
+		requiresEncryptionKey bool
+		readSnapshots         map[*readSnapshot]bool // snapshots that are in use by queries
+		readSnapshotsLock     sync.RWMutex           // held for reading by writers, and for writing when taking a snapshot
+		isReadOnly            bool                   // set for the collections of a read-only client, see SetReadOnly
+		auditActor            string                 // who changes are attributed to in the audit log, see SetAuditActor
+		auditLock             sync.Mutex
+		keyLocks              keyLocks   // serializes writes to the same document, see lockKey
+		indexWriteLock        sync.Mutex // held while an index file is loaded, changed and saved by a document write
+		cache                 *docCache  // only used if CacheMaxEntries or CacheMaxBytes is set, created on first use
+		cacheLock             sync.Mutex
+		indexCache            map[string]*cachedIndex // field locator -> index, used by searches, see getCachedIndex
+		indexCacheGeneration  uint64
+		indexCacheLock        sync.RWMutex
+		segments              *segmentStore // only used if StorageEngine is STORAGE_SEGMENTS, loaded on first use
+		segmentsLock          sync.Mutex
+		indexBatch            *indexBatch                   // only used if index changes are batched, guarded by indexWriteLock
+		numBulkLoads          int32                         // see BeginBulkLoad, accessed atomically
+		manifests             map[string]*partitionManifest // partition dir name -> manifest, see EnableManifests
+		manifestsDirty        bool                          // whether the dirty marker exists, see markManifestsDirty
+		manifestsLock         sync.Mutex
+		writeBehind           *writeBehind      // only used if WriteBehindQueueSize is set, started on first write
+		writeErrorHandler     WriteErrorHandler // see SetWriteErrorHandler
+		writeBehindLock       sync.Mutex
+		paths                 *pathCache // partition dir paths of the collection, see getPathCache
+		pathsLock             sync.Mutex
+		prevNumPartitions     int32               // the NumPartitions before a repartitioning that isn't finished, see StartRepartition, accessed atomically
+		repartitionProgress   RepartitionProgress // see GetRepartitionProgress
+		repartitionLock       sync.Mutex
+		coldState             int32                 // one of the coldState constants, see mayHaveColdDocs
+		coldLock              sync.Mutex            // held while a document is moved to or from the cold dir
+		readTimes             map[key.Key]time.Time // only used if ColdAfter is set, see noteRead
+		readTimesLock         sync.Mutex
+		ioLimiter             *IOLimiter // shared with the other collections of the client, see SetIOLimiter
+		ioLimiterLock         sync.Mutex
+		fsys                  util.FS // see SetFS
+		changes               changeNotifier
+		settingsLock          sync.RWMutex     // guards the props that can be changed while the collection is in use, see SetDurability
+		stats                 *collectionStats // gathered on first use, see GetStats
+		statsLock             sync.Mutex
+		isFrozen              int32        // see Freeze, accessed atomically
+		freezeLock            sync.RWMutex // held for reading by writes, see beginWrite
+		expiries              *expiryStore // loaded on first use, see getExpiries
+		expiriesLock          sync.Mutex
+		reapStats             ReapStats
+		reapStatsLock         sync.Mutex
+		refresher             refresher       // see GetStaleWhileRevalidate
+		changeFeed            changeFeed      // see Changes
+		watcher               externalWatcher // see SyncExternalChanges
 	}
 
 	CollectionProps struct {
@@ -41,6 +104,33 @@ type (
 		EncodingType          uint
 		EnableGzipCompression bool
 		NumPartitions         int
+		EncryptionKey         []byte        // if provided, documents are encrypted on disk using AES-GCM. Must be 16, 24 or 32 bytes long.
+		EncryptIndexes        bool          // if true (and EncryptionKey is provided), index files are encrypted as well
+		PreviousEncryptionKey []byte        // if provided, used to read data that hasn't been re-encrypted since a key rotation
+		EnableWAL             bool          // if true, writes and deletes are logged in a write-ahead log before being applied
+		RetainWAL             bool          // if true (with EnableWAL), the WAL is kept once applied, see RestoreToTime
+		Durability            uint          // one of the DURABILITY_ constants, defaults to DURABILITY_NONE
+		FsyncInterval         time.Duration // used with DURABILITY_FSYNC_INTERVAL, defaults to DEFAULT_FSYNC_INTERVAL
+		NumRevisions          int           // if > 0, this many previous versions of each document are kept as revisions
+		RevisionMaxAge        time.Duration // if > 0, revisions older than this are pruned
+		EnableAuditLog        bool          // if true, every change to a document is recorded in an audit log, see GetAuditTrail
+		EnableChangeFeed      bool          // if true, every change to a document is recorded in a change feed, see Changes
+		CacheMaxEntries       int           // if > 0, up to this many recently read documents are cached in memory
+		CacheMaxBytes         int64         // if > 0, recently read documents are cached in memory, up to this many bytes of data
+		StorageEngine         uint          // one of the STORAGE_ constants, defaults to STORAGE_FILES
+		SegmentMaxBytes       int64         // used with STORAGE_SEGMENTS, defaults to DEFAULT_SEGMENT_MAX_BYTES
+		IndexFlushOps         int           // if > 0, index changes are kept in memory and saved once every this many writes
+		IndexFlushInterval    time.Duration // if > 0, index changes are kept in memory and saved this often, see FlushIndexes
+		WriteBehindQueueSize  int           // if > 0, Set and Delete return once the write is queued, see SetWriteErrorHandler
+		EnableManifests       bool          // if true, scans and counts use a manifest of each partition instead of listing its dir
+		ColdAfter             time.Duration // if > 0, documents not read for this long are moved to the cold dir by MoveColdDocuments
+		MaxDocs               int           // if > 0, writes that would take the collection over this many documents fail
+		MaxBytes              int64         // if > 0, writes that would take the documents over this many bytes fail, see checkQuota
+		Capped                bool          // if true, the oldest documents are deleted instead to stay within MaxDocs and MaxBytes
+		ReapInterval          time.Duration // if > 0, expired documents are deleted in the background this often, see ReapExpired
+		EvictionPolicy        uint          // one of the EVICTION_POLICY_ constants, which puts the collection in cache mode if set
+		Evictable             bool          // if true, documents may be evicted to keep the client within its ByteBudget, see EvictNext
+		SoftTTL               time.Duration // if > 0, documents are stale this long after they are written, see GetStaleWhileRevalidate
 	}
 
 	IndexStore struct {
@@ -51,47 +141,268 @@ type (
 
 var ErrCollectionIsNotExist = fmt.Errorf("Collection not found")
 var ErrCollectionIsExist = fmt.Errorf("Collection with this name already exists")
+var ErrStructNotSupported = fmt.Errorf("Struct operations are not supported for collections with ENCODING_NONE")
+var ErrIndexNotSupported = fmt.Errorf("Indexing is not supported for the encoding type of this collection")
+var ErrDecode = fmt.Errorf("Document data could not be decoded into the given value")
 
 /********************************************************************************
 * W R I T E R S
 *********************************************************************************/
 
 func (cl *Collection) Set(k key.Key, data []byte) error {
+	return cl.SetCtx(context.Background(), k, data)
+}
+
+// SetCtx is Set, which gives up with ctx.Err() if ctx is done before the write starts, e.g. while it waits for another
+// write to the same document or for room in the write-behind queue. Once started, the write is carried out regardless.
+func (cl *Collection) SetCtx(ctx context.Context, k key.Key, data []byte) error {
+	return cl.setWithExpiry(ctx, k, data, time.Time{})
+}
+
+// SetWithTTLCtx is SetCtx for a document that expires after ttl, see ReapExpired
+func (cl *Collection) SetWithTTLCtx(ctx context.Context, k key.Key, data []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return cl.setWithExpiry(ctx, k, data, time.Now().Add(ttl))
+}
+
+// setWithExpiry does the work for SetCtx and SetWithTTLCtx. The document expires at expiresAt, unless it is zero.
+func (cl *Collection) setWithExpiry(ctx context.Context, k key.Key, data []byte, expiresAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := cl.checkFrozen(); err != nil {
+		return err
+	}
+	if cl.isWriteBehind() {
+		// data belongs to the caller, who may reuse it as soon as we return
+		return cl.enqueueWrite(ctx, writeBehindOp{k: k, data: append([]byte(nil), data...), expiresAt: expiresAt})
+	}
+	return cl.setNow(ctx, k, data, expiresAt)
+}
 
-	// Get the full path for the file & create the partition dir if it doesn't exist already
-	dirPath := util.JoinPath(cl.DirPath, DATA_DIR_NAME, k.GetPartitionDirName(cl.NumPartitions))
-	err := util.CreateDirIfNotExist(dirPath)
+// setNow does the work for Set, without going through the write-behind queue
+func (cl *Collection) setNow(ctx context.Context, k key.Key, data []byte, expiresAt time.Time) error {
+	unlock := cl.lockKey(k)
+	err := cl.setLocked(ctx, k, data, expiresAt)
+	unlock()
 	if err != nil {
-		return fmt.Errorf("error while creating the dir at path %s: %s", dirPath, err)
+		return err
 	}
-	path := cl.getFilePath(k)
+	return cl.evict(k)
+}
 
-	// If Gzip is enabled, we should gzip compress
-	if cl.EnableGzipCompression {
+// setLocked writes data as the document for k. It should be called while holding the key lock for k.
+func (cl *Collection) setLocked(ctx context.Context, k key.Key, data []byte, expiresAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Prepare the exact bytes that will go in the file, so they can be logged in the WAL if needed
+	buf := getBuffer()
+	defer putBuffer(buf)
+	err := cl.writeDoc(buf, cl.newDocHeader(), k, data)
+	if err != nil {
+		return fmt.Errorf("error while writing file: %w", err)
+	}
 
-		// Open the file
-		f, err := os.Create(path)
+	err = cl.setFileData(k, buf.Bytes(), AUDIT_OP_SET)
+	if err != nil {
+		return err
+	}
+	err = cl.setExpiry(k, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	cl.notifyChange(AUDIT_OP_SET, k)
+	return cl.audit(AUDIT_OP_SET, k, data)
+}
+
+// setFileData writes fileData (which includes the doc header) as the document for k, through the WAL if it is enabled,
+// and records changeOp on it in the change feed. With the WAL, the change is recorded before the op is committed, so
+// that if the process crashes in between, ReplayWAL records it. The op is committed even if the change can't be
+// recorded, since replaying it later could undo newer writes to k; the error is returned once the op is committed.
+func (cl *Collection) setFileData(k key.Key, fileData []byte, changeOp string) error {
+	endWrite, err := cl.beginWrite()
+	if err != nil {
+		return err
+	}
+	defer endWrite()
+
+	err = cl.checkQuota(k, int64(len(fileData)))
+	if err != nil {
+		return err
+	}
+
+	if !cl.EnableWAL {
+		err = cl.withIndexJournal(k, func() error { return cl.applySet(k, fileData) })
 		if err != nil {
 			return err
 		}
-		gz := gzip.NewWriter(f)
-		gz.Write(data)
-		gz.Close()
+		return cl.recordAppliedChange(changeOp, k)
+	}
+
+	w, err := cl.getWAL()
+	if err != nil {
+		return err
+	}
+	seq, err := w.begin(WAL_OP_SET, k, fileData)
+	if err != nil {
+		return err
+	}
+	err = cl.applySet(k, fileData)
+	if err != nil {
+		w.abort(seq)
+		return err
+	}
+	feedErr := cl.recordAppliedChange(changeOp, k)
+	err = cl.commitAfterIndexFlush(w, seq)
+	if err != nil {
+		return err
+	}
+	return feedErr
+}
+
+// applySet writes fileData (which includes the doc header) as the document for k, and updates the indexes
+func (cl *Collection) applySet(k key.Key, fileData []byte) error {
+
+	// Writes shouldn't be visible to queries that are already running
+	cl.readSnapshotsLock.RLock()
+	defer cl.readSnapshotsLock.RUnlock()
+	err := cl.preserveForReadSnapshots(k)
+	if err != nil {
+		return err
+	}
+
+	// Keep the version we're about to overwrite
+	err = cl.saveRevision(k)
+	if err != nil {
+		return fmt.Errorf("error while saving revision: %w", err)
+	}
 
-		if err = f.Close(); err != nil {
+	err = cl.storeDocFile(k, fileData)
+	if err != nil {
+		return err
+	}
+	cl.uncache(k)
+
+	if cl.canIndex() {
+		err = cl.addDocToIndexes(k)
+		if err != nil {
 			return err
 		}
+	}
 
-	} else {
+	return nil
+}
 
-		err = ioutil.WriteFile(path, data, util.FILE_PERM)
+// Delete removes the document for k, and removes it from all the indexes
+func (cl *Collection) Delete(k key.Key) error {
+	if err := cl.checkFrozen(); err != nil {
+		return err
+	}
+	if cl.isWriteBehind() {
+		// Still report documents that don't exist, once the writes queued before are taken into account
+		cl.waitForWrites(k)
+		err := cl.checkDocExists(k)
 		if err != nil {
-			return fmt.Errorf("error while writing file: %s", err)
+			return err
 		}
+		return cl.enqueueWrite(context.Background(), writeBehindOp{k: k, isDelete: true})
+	}
+	return cl.deleteNow(k)
+}
+
+// deleteNow does the work for Delete, without going through the write-behind queue
+func (cl *Collection) deleteNow(k key.Key) error {
+	defer cl.lockKey(k)()
+	return cl.deleteLocked(k)
+}
+
+// deleteLocked removes the document for k, while holding the key lock for k
+func (cl *Collection) deleteLocked(k key.Key) error {
+	endWrite, err := cl.beginWrite()
+	if err != nil {
+		return err
+	}
+	defer endWrite()
+
+	// Make sure that the document exists, so we don't log an op that can't be applied
+	err = cl.checkDocExists(k)
+	if err != nil {
+		return err
+	}
+
+	if !cl.EnableWAL {
+		err = cl.withIndexJournal(k, func() error { return cl.applyDelete(k) })
+		if err == nil {
+			err = cl.recordAppliedChange(AUDIT_OP_DELETE, k)
+		}
+	} else {
+		err = cl.deleteWithWAL(k)
+	}
+	if err != nil {
+		return err
+	}
+	err = cl.setExpiry(k, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	cl.notifyChange(AUDIT_OP_DELETE, k)
+	return cl.audit(AUDIT_OP_DELETE, k, nil)
+}
+
+func (cl *Collection) deleteWithWAL(k key.Key) error {
+	w, err := cl.getWAL()
+	if err != nil {
+		return err
+	}
+	seq, err := w.begin(WAL_OP_DELETE, k, nil)
+	if err != nil {
+		return err
+	}
+	err = cl.applyDelete(k)
+	if err != nil {
+		w.abort(seq)
+		return err
+	}
+	feedErr := cl.recordAppliedChange(AUDIT_OP_DELETE, k) // see setFileData
+	err = cl.commitAfterIndexFlush(w, seq)
+	if err != nil {
+		return err
+	}
+	return feedErr
+}
+
+// applyDelete removes the document for k (under both the gzip and non-gzip file names), and removes it from the
+// indexes. It is a no-op if the document doesn't exist, so that it can be safely replayed.
+func (cl *Collection) applyDelete(k key.Key) error {
+
+	// Deletes shouldn't be visible to queries that are already running
+	cl.readSnapshotsLock.RLock()
+	defer cl.readSnapshotsLock.RUnlock()
+	err := cl.preserveForReadSnapshots(k)
+	if err != nil {
+		return err
+	}
+
+	// Keep the version we're about to delete, so the delete can be undone
+	err = cl.saveRevision(k)
+	if err != nil {
+		return fmt.Errorf("error while saving revision: %w", err)
+	}
+
+	err = cl.removeDocFile(k)
+	if err != nil {
+		return err
 	}
+	cl.uncache(k)
 
 	if cl.canIndex() {
-		err = cl.addDocToIndexes(k)
+		err := cl.removeDocFromIndexes(k)
 		if err != nil {
 			return err
 		}
@@ -100,21 +411,170 @@ func (cl *Collection) Set(k key.Key, data []byte) error {
 	return nil
 }
 
-func (cl *Collection) SetFromStruct(k key.Key, v interface{}) error {
+// storeDocFile makes fileData (which includes the doc header) the content of the file for the document for k
+func (cl *Collection) storeDocFile(k key.Key, fileData []byte) error {
+	if cl.isSegmented() {
+		s, err := cl.getSegmentStore()
+		if err != nil {
+			return err
+		}
+		err = s.put(k, fileData)
+		if err != nil {
+			return err
+		}
+		cl.noteStoredDoc(k, cl.getSegmentDocFileName(k), fileData)
+		return nil
+	}
+
+	// Get the full path for the file & create the partition dir if it isn't known to exist already
+	dirPath, err := cl.ensurePartitionDir(k)
+	if err != nil {
+		return fmt.Errorf("error while creating the dir at path %s: %w", dirPath, err)
+	}
+	path := cl.getFilePath(k)
 
-	var data []byte
-	var err error
+	// With STORAGE_CONTENT_ADDRESSED, the file only points to the blob that has the content
+	content := fileData
+	if cl.isContentAddressed() {
+		content, err = cl.storeBlob(fileData)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = cl.writeFile(path, content)
+	if err != nil && os.IsNotExist(err) {
+		// The partition dir has gone away since it was last seen, so create it again
+		cl.forgetPartitionDir(k)
+		dirPath, err = cl.ensurePartitionDir(k)
+		if err != nil {
+			return fmt.Errorf("error while creating the dir at path %s: %w", dirPath, err)
+		}
+		err = cl.writeFile(path, content)
+	}
+	if err != nil {
+		return fmt.Errorf("error while writing file: %w", err)
+	}
+
+	// The cold copy, if any, has to go before the alt file, so that restoring it can't bring back either
+	err = cl.removeColdDocFile(k)
+	if err != nil {
+		return err
+	}
+
+	// If the gzip setting of the collection has changed, an older copy of the document could exist under the other file name
+	err = cl.fs().Remove(cl.getAltFilePath(k))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	cl.noteStoredDoc(k, path, fileData)
+	cl.noteOwnDocChange(k)
+	return cl.refreshManifestEntry(k)
+}
+
+// removeDocFile removes the file for the document for k (under both the gzip and non-gzip file names). It is a no-op if
+// the document doesn't exist.
+func (cl *Collection) removeDocFile(k key.Key) error {
+	if cl.isSegmented() {
+		s, err := cl.getSegmentStore()
+		if err != nil {
+			return err
+		}
+		err = s.remove(k)
+		if err != nil {
+			return err
+		}
+		cl.noteRemovedDoc(k)
+		return nil
+	}
+
+	// The cold copy, if any, goes first, so that restoring it can't bring back the document
+	err := cl.removeColdDocFile(k)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range []string{cl.getFilePath(k), cl.getAltFilePath(k)} {
+		err := cl.fs().Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			err = cl.syncRenamed(path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	cl.noteRemovedDoc(k)
+	cl.noteOwnDocChange(k)
+	return cl.refreshManifestEntry(k)
+}
+
+// writeDoc writes the header, followed by the data to w. The data is gzip compressed and/or encrypted if the header
+// says so.
+func (cl *Collection) writeDoc(w io.Writer, h docHeader, k key.Key, data []byte) error {
+	_, err := w.Write(h.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if h.IsGzipped {
+		buf := getBuffer()
+		defer putBuffer(buf)
+		gz := getGzipWriter(buf)
+		defer putGzipWriter(gz)
+		_, err = gz.Write(data)
+		if err != nil {
+			gz.Close()
+			return err
+		}
+		if err = gz.Close(); err != nil {
+			return err
+		}
+		err = checkGzipFooter(buf.Bytes(), data)
+		if err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
 
-	if cl.EncodingType == ENCODING_JSON {
-		data, err = json.Marshal(v)
+	if h.IsEncrypted {
+		encryptionKey, _ := cl.getEncryptionKeys()
+		data, err = seal(encryptionKey, data, docAdditionalData(h, k))
 		if err != nil {
 			return err
 		}
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+func (cl *Collection) SetFromStruct(k key.Key, v interface{}) error {
+	return cl.SetFromStructCtx(context.Background(), k, v)
+}
 
-		return cl.Set(k, data)
+// SetFromStructCtx is SetFromStruct, which gives up with ctx.Err() if ctx is done before the write starts, see SetCtx
+func (cl *Collection) SetFromStructCtx(ctx context.Context, k key.Key, v interface{}) error {
+
+	data, err := cl.encode(v)
+	if err != nil {
+		return err
 	}
 
-	return fmt.Errorf("Encoding logic for the encoding type not implemented")
+	return cl.SetCtx(ctx, k, data)
+}
+
+// SetFromStructWithTTLCtx is SetFromStructCtx for a document that expires after ttl, see ReapExpired
+func (cl *Collection) SetFromStructWithTTLCtx(ctx context.Context, k key.Key, v interface{}, ttl time.Duration) error {
+
+	data, err := cl.encode(v)
+	if err != nil {
+		return err
+	}
+
+	return cl.SetWithTTLCtx(ctx, k, data, ttl)
 }
 
 // Deprectaing this since this is not very widely used, and difficult to implement with the GZIP compression
@@ -122,14 +582,14 @@ func (cl *Collection) SetFromStruct(k key.Key, v interface{}) error {
 
 // 	// create the partition dir if it doesn't exist already
 // 	dirPath := util.JoinPath(cl.DirPath, DATA_DIR_NAME, k.GetPartitionDirName(cl.NumPartitions))
-// 	err := util.CreateDirIfNotExist(dirPath)
+// 	err := util.CreateDirIfNotExist(cl.fs(), dirPath)
 // 	if err != nil {
 // 		return fmt.Errorf("error while creating the dir at path %s: %s", dirPath, err)
 // 	}
 // 	path := cl.getFilePath(k)
 
 // 	// open the file (copied from https://golang.org/src/io/ioutil/ioutil.go?s=2534:2602#L69)
-// 	file, err := os.Create(path)
+// 	file, err := util.Create(cl.fs(), path)
 // 	if err != nil {
 // 		return err
 // 	}
@@ -160,89 +620,415 @@ func (cl *Collection) SetFromStruct(k key.Key, v interface{}) error {
 * R E A D E R S
 *********************************************************************************/
 
-func (cl *Collection) GetFile(k key.Key) (*os.File, error) {
+// GetFile opens the file for the document. The file includes the document header, and may be gzip compressed. It is not
+// supported for collections with STORAGE_SEGMENTS.
+func (cl *Collection) GetFile(k key.Key) (util.File, error) {
+	cl.waitForWrites(k)
+	err := cl.noteRead(k)
+	if err != nil {
+		return nil, err
+	}
+	return cl.openFile(k)
+}
+
+// openFile does the work for GetFile. A cold document is moved back to its partition dir first, since it has no file
+// that can be opened as it is.
+func (cl *Collection) openFile(k key.Key) (util.File, error) {
+	if cl.isSegmented() {
+		return nil, ErrSegmentStorageNotSupported
+	}
+	f, err := cl.openExistingFile(k)
+	if os.IsNotExist(err) && cl.mayHaveColdDocs() {
+		err = cl.restoreColdDoc(k)
+		if err != nil {
+			return nil, err
+		}
+		f, err = cl.openExistingFile(k)
+	}
+	return f, err
+}
+
+// openExistingFile opens the file of the document for k, see getExistingFilePath. If the file was found at another path
+// than its own, and has been moved away before it could be opened (e.g. to its new partition by migrateDoc, or to its
+// other file name by SetGzipCompression), it is looked up once more.
+func (cl *Collection) openExistingFile(k key.Key) (util.File, error) {
+	for i := 0; ; i++ {
+		path, err := cl.getExistingFilePath(k)
+		isElsewhere := err == nil && path != cl.getFilePath(k)
+		if err == nil && cl.isContentAddressed() {
+			path, err = cl.resolveDocPath(path)
+		}
+		var f util.File
+		if err == nil {
+			f, err = cl.fs().Open(path)
+		}
+		if !os.IsNotExist(err) || !isElsewhere || i > 0 {
+			return f, err
+		}
+	}
+}
+
+// getExistingFilePath returns the path at which the document for k exists. If it doesn't exist, the returned error
+// satisfies os.IsNotExist.
+func (cl *Collection) getExistingFilePath(k key.Key) (string, error) {
 	path := cl.getFilePath(k)
-	return os.Open(path)
+	_, err := cl.fs().Stat(path)
+	if os.IsNotExist(err) {
+		// the document may have been written before the gzip setting of the collection was changed
+		altPath := cl.getAltFilePath(k)
+		if _, altErr := cl.fs().Stat(altPath); altErr == nil {
+			return altPath, nil
+		}
+		// or it may not have been moved to its new partition yet, see StartRepartition
+		if oldPath := cl.getOldPartitionPath(cl.getDataPath(), k, filepath.Base(path)); oldPath != "" {
+			if _, oldErr := cl.fs().Stat(oldPath); oldErr == nil {
+				return oldPath, nil
+			}
+		}
+		// or it may have just been rewritten from one file name to the other (see SetGzipCompression), or moved
+		_, err = cl.fs().Stat(path)
+	}
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// checkDocExists returns nil if the document for k exists, and an error that satisfies os.IsNotExist if it doesn't
+func (cl *Collection) checkDocExists(k key.Key) error {
+	if cl.isSegmented() {
+		s, err := cl.getSegmentStore()
+		if err != nil {
+			return err
+		}
+		if !s.has(k) {
+			return os.ErrNotExist
+		}
+		return nil
+	}
+	_, err := cl.getExistingFilePath(k)
+	if os.IsNotExist(err) && cl.mayHaveColdDocs() {
+		_, err = cl.getExistingColdFilePath(k)
+	}
+	return err
+}
+
+// IsDocExist tells whether there is a document for k in the collection
+func (cl *Collection) IsDocExist(k key.Key) (bool, error) {
+	cl.waitForWrites(k)
+	err := cl.checkNotExpired(k)
+	if err == nil {
+		err = cl.checkDocExists(k)
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// readDocFile returns the name and the content of the file for the document for k. With STORAGE_SEGMENTS, the content
+// is read from the segment the document is in, and the name is the one its file would have with STORAGE_FILES. If the
+// document doesn't exist, the returned error satisfies os.IsNotExist.
+func (cl *Collection) readDocFile(k key.Key) (string, []byte, error) {
+	defer cl.acquireIO()()
+
+	if cl.isSegmented() {
+		data, err := cl.readSegmentDoc(k, false)
+		return cl.getSegmentDocFileName(k), data, err
+	}
+
+	path, err := cl.getExistingFilePath(k)
+	if os.IsNotExist(err) && cl.mayHaveColdDocs() {
+		return cl.readColdDocFile(k)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := util.ReadFile(cl.fs(), path)
+	if os.IsNotExist(err) && path != cl.getFilePath(k) {
+		// the file has been moved away since it was found, see openExistingFile
+		path, err = cl.getExistingFilePath(k)
+		if err == nil {
+			data, err = util.ReadFile(cl.fs(), path)
+		}
+	}
+	if err == nil && cl.isContentAddressed() {
+		data, err = cl.resolveBlobPointer(data)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return path, data, nil
 }
 
 func (cl *Collection) GetFileData(k key.Key) ([]byte, error) {
-	file, err := cl.GetFile(k)
+	return cl.GetFileDataCtx(context.Background(), k)
+}
+
+// GetFileDataCtx is GetFileData, which stops reading the document with ctx.Err() as soon as ctx is done
+func (cl *Collection) GetFileDataCtx(ctx context.Context, k key.Key) ([]byte, error) {
+	cl.waitForWrites(k)
+	err := cl.noteRead(k)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	_, data, err := cl.getDocData(ctx, k)
+	return data, err
+}
 
+// getDocData returns the decompressed data of the document, along with the header that tells how it was encoded
+func (cl *Collection) getDocData(ctx context.Context, k key.Key) (docHeader, []byte, error) {
 	buf := bytes.NewBuffer(nil)
+	h, err := cl.readDocData(ctx, k, buf)
+	if err != nil {
+		return h, nil, err
+	}
+	return h, buf.Bytes(), nil
+}
 
-	if cl.EnableGzipCompression {
-		gz, err := gzip.NewReader(file)
-		if err != nil {
-			return nil, err
-		}
-		defer gz.Close()
+// readDocData is like getDocData, but reads the decompressed data of the document into buf. The data is served from the
+// cache if possible, and added to it otherwise.
+func (cl *Collection) readDocData(ctx context.Context, k key.Key, buf *bytes.Buffer) (docHeader, error) {
+	if err := ctx.Err(); err != nil {
+		return docHeader{}, err
+	}
 
-		_, err = io.Copy(buf, gz) // the first discarded returnable is the number of bytes copied
-		if err != nil {
-			return nil, err
+	c := cl.getCache()
+	var generation uint64
+	if c != nil {
+		if h, data, ok := c.get(k); ok {
+			buf.Write(data)
+			return h, nil
 		}
+		generation = c.getGeneration()
+	}
 
-	} else {
-		_, err = io.Copy(buf, file) // the first discarded returnable is the number of bytes copied
-		if err != nil {
-			return nil, err
-		}
+	h, r, err := cl.openDoc(k, true)
+	if err != nil {
+		return h, cl.quarantineIfCorrupted(k, err)
 	}
 
-	return buf.Bytes(), nil
+	_, err = io.Copy(buf, withContext(ctx, r)) // the first discarded returnable is the number of bytes copied
+	r.Close()                                  // before quarantining, which needs an IO slot of its own
+	if err != nil {
+		return h, cl.quarantineIfCorrupted(k, err)
+	}
+
+	if c != nil {
+		c.add(k, h, append([]byte(nil), buf.Bytes()...), generation)
+	}
+
+	return h, nil
 }
 
 func (cl *Collection) GetIntoStruct(k key.Key, dest interface{}) error {
+	return cl.GetIntoStructCtx(context.Background(), k, dest)
+}
 
-	data, err := cl.GetFileData(k)
+// GetIntoStructCtx is GetIntoStruct, which stops reading the document with ctx.Err() as soon as ctx is done
+func (cl *Collection) GetIntoStructCtx(ctx context.Context, k key.Key, dest interface{}) error {
+	cl.waitForWrites(k)
+	err := cl.noteRead(k)
 	if err != nil {
 		return err
 	}
+	return cl.getIntoStruct(ctx, k, dest)
+}
 
-	if cl.EncodingType == ENCODING_JSON {
-		return json.Unmarshal(data, dest)
+// getIntoStruct does the work for GetIntoStruct. It is used by the writes themselves, e.g. to update the indexes, which
+// shouldn't wait for the write-behind queue.
+func (cl *Collection) getIntoStruct(ctx context.Context, k key.Key, dest interface{}) error {
+
+	// Raw byte collections have no notion of structure, so fail before touching the disk
+	if cl.getEncodingType() == ENCODING_NONE {
+		return ErrStructNotSupported
 	}
 
-	return fmt.Errorf("Decoding logic for the encoding type not implemented")
+	// With the cache, the data is held in memory anyway, so it is decoded from there
+	if cl.getCache() == nil {
+		return cl.streamIntoStruct(ctx, k, dest)
+	}
+
+	return cl.readIntoStruct(ctx, k, dest)
 }
 
-// getIntoWriter does not take care of GZIP encoding
-func (cl *Collection) GetIntoWriter(k key.Key, dest io.Writer) error {
-	file, err := cl.GetFile(k)
+// readIntoStruct is GetIntoStruct for when the data has to be in memory: it is read in full, and then decoded.
+func (cl *Collection) readIntoStruct(ctx context.Context, k key.Key, dest interface{}) error {
+	// The data is only needed until it has been decoded, so it can be read into a pooled buffer
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	h, err := cl.readDocData(ctx, k, buf)
+	if err != nil {
+		return err
+	}
+
+	// bson can decode into e.g. bson.Raw without copying, which would leave dest referring to the pooled buffer
+	data := buf.Bytes()
+	if h.EncodingType == ENCODING_BSON {
+		data = append([]byte(nil), data...)
+	}
+
+	return cl.quarantineIfCorrupted(k, decodeDoc(h, data, dest))
+}
+
+// streamIntoStruct is GetIntoStruct for when the data doesn't need to be kept. JSON documents are decoded while they are
+// read (and decompressed), without a copy of all the data in between. Other encodings are read in full first.
+func (cl *Collection) streamIntoStruct(ctx context.Context, k key.Key, dest interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	h, r, err := cl.openDoc(k, true)
+	if err != nil {
+		return cl.quarantineIfCorrupted(k, err)
+	}
+	if h.EncodingType != ENCODING_JSON {
+		r.Close()
+		return cl.readIntoStruct(ctx, k, dest)
+	}
+
+	err = decodeJSONStream(withContext(ctx, r), dest)
+	r.Close()
+	if _, ok := err.(corruptionError); ok || err == nil {
+		return cl.quarantineIfCorrupted(k, err)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// Telling whether the data is corrupted or just doesn't fit dest needs all of it, see decodeDoc. This is rare enough
+	// that reading the document again is fine.
+	return cl.readIntoStruct(ctx, k, dest)
+}
+
+// decodeJSONStream decodes the JSON value read from r into dest, and makes sure that nothing but whitespace follows it,
+// which json.Unmarshal would check as well. Reading up to the end also has the gzip reader verify its checksum.
+func decodeJSONStream(r io.Reader, dest interface{}) error {
+	dec := json.NewDecoder(r)
+	err := dec.Decode(dest)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	_, err = dec.Token()
+	if err == io.EOF {
+		return nil
+	}
+	if err == nil {
+		return fmt.Errorf("invalid character after top-level value")
+	}
+	return err
+}
+
+// decodeDoc decodes the data of a document into dest. If the data can't be decoded at all, a corruptionError is returned.
+// If it just doesn't fit dest, the error wraps ErrDecode.
+func decodeDoc(h docHeader, data []byte, dest interface{}) error {
+	// decode using the encoding the document was stored with, which may differ from the current collection setting
+	err := decode(h.EncodingType, data, dest)
+	if err == nil || err == ErrStructNotSupported {
+		return err
+	}
+	if !isDecodable(h.EncodingType, data) {
+		return corruptionError{err}
+	}
+	return fmt.Errorf("%w: %w", ErrDecode, err)
+}
 
-	_, err = io.Copy(dest, file)
+// GetIntoWriter copies the document into dest, decompressing it first if it was stored with GZIP compression
+func (cl *Collection) GetIntoWriter(k key.Key, dest io.Writer) error {
+	return cl.GetIntoWriterCtx(context.Background(), k, dest)
+}
+
+// GetIntoWriterCtx is GetIntoWriter, which stops copying the document with ctx.Err() as soon as ctx is done. Whatever
+// was copied into dest by then stays there.
+func (cl *Collection) GetIntoWriterCtx(ctx context.Context, k key.Key, dest io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cl.waitForWrites(k)
+	err := cl.noteRead(k)
 	if err != nil {
 		return err
 	}
 
+	// Documents are streamed from disk rather than added to the cache, since they can be big, but a cached one can be used
+	if c := cl.getCache(); c != nil {
+		if _, data, ok := c.get(k); ok {
+			_, err := dest.Write(data)
+			return err
+		}
+	}
+
+	_, r, err := cl.openDoc(k, true)
+	if err != nil {
+		return cl.quarantineIfCorrupted(k, err)
+	}
+
+	_, err = io.Copy(dest, withContext(ctx, r))
+	r.Close() // before quarantining, which needs an IO slot of its own
+	if err != nil {
+		return cl.quarantineIfCorrupted(k, err)
+	}
+
 	return nil
 }
 
+// GetRawIntoWriter copies the document into dest as it is stored on disk (minus the header), without decompressing it.
+// It returns true if the bytes written are gzip compressed, e.g. so that an HTTP handler can set the Content-Encoding
+// header and let the client do the decompression.
+func (cl *Collection) GetRawIntoWriter(k key.Key, dest io.Writer) (bool, error) {
+	cl.waitForWrites(k)
+	err := cl.noteRead(k)
+	if err != nil {
+		return false, err
+	}
+	h, r, err := cl.openDoc(k, false)
+	if err != nil {
+		return false, cl.quarantineIfCorrupted(k, err)
+	}
+	defer r.Close()
+
+	_, err = io.Copy(dest, r)
+	if err != nil {
+		return false, err
+	}
+
+	return h.IsGzipped, nil
+}
+
 /********************************************************************************
 * C O L L E C T I O N  <-> I N D E X
 *********************************************************************************/
 
+// canIndex tells whether documents of the collection can be decoded into a map[string]interface{}, which the index builder needs
 func (cl *Collection) canIndex() bool {
-	if cl.EncodingType != ENCODING_JSON {
-		return false
+	return canIndex(cl.getEncodingType())
+}
+
+// canIndex tells whether documents with the encoding type can be decoded into maps, which indexing needs
+func canIndex(encodingType uint) bool {
+	switch encodingType {
+	case ENCODING_JSON, ENCODING_MSGPACK, ENCODING_CBOR, ENCODING_BSON:
+		return true
 	}
-	return true
+	return false
 }
 
 // fieldLocator could be fieldA.fieldB, Components.Basic.Data.OrgId
 func (cl *Collection) AddIndex(fieldLocator string) error {
+	return cl.AddIndexCtx(context.Background(), fieldLocator)
+}
+
+// AddIndexCtx is AddIndex, which stops building the index with ctx.Err() as soon as ctx is done. The index is then not
+// added.
+func (cl *Collection) AddIndexCtx(ctx context.Context, fieldLocator string) error {
 
-	// Only enabed JSON indexing
-	if cl.EncodingType != ENCODING_JSON {
-		return fmt.Errorf("Indexing only supported for JSON encoded data")
+	// Only enable indexing for encodings that can be decoded into maps
+	if !cl.canIndex() {
+		return ErrIndexNotSupported
 	}
 
 	// check that the index doesn't exist already before
@@ -254,7 +1040,10 @@ func (cl *Collection) AddIndex(fieldLocator string) error {
 
 	// Go through all the docs in the collection and create the maps...
 	// get path for where all the collection data is
-	err := idx.build()
+	err := idx.build(ctx)
+	if err != nil {
+		return err
+	}
 
 	err = idx.save()
 	if err != nil {
@@ -279,22 +1068,41 @@ func (cl *Collection) GetDirPathForIndexes() string {
 
 func (cl *Collection) addDocToIndexes(k key.Key) error {
 
-	// get all the indexes
-	indexStore := cl.IndexStore.Store
+	cl.IndexStore.RLock()
+	var fieldLocators []string
+	for fieldLocator := range cl.IndexStore.Store {
+		fieldLocators = append(fieldLocators, fieldLocator)
+	}
+	cl.IndexStore.RUnlock()
+
+	if len(fieldLocators) == 0 {
+		return nil
+	}
+
+	// Read the document before taking indexWriteLock, since a corrupted document is quarantined on read, which removes it
+	// from the indexes
+	var data map[string]interface{}
+	err := cl.getIntoStruct(context.Background(), k, &data)
+	if err != nil {
+		return err
+	}
+
+	cl.indexWriteLock.Lock()
+	defer cl.indexWriteLock.Unlock()
 
-	for fieldLocator := range indexStore {
+	for _, fieldLocator := range fieldLocators {
 
-		idx, err := cl.loadIndex(fieldLocator)
+		idx, err := cl.loadIndexForWrite(fieldLocator)
 		if err != nil {
 			return err
 		}
 
-		err = idx.addDoc(k, cl.getFilePath(k))
+		err = idx.addData(k, data)
 		if err != nil {
 			return err
 		}
 
-		err = idx.save()
+		err = cl.saveIndexForWrite(idx)
 		if err != nil {
 			return err
 		}
@@ -304,7 +1112,41 @@ func (cl *Collection) addDocToIndexes(k key.Key) error {
 		cl.IndexStore.Unlock()
 	}
 
-	return nil
+	return cl.endIndexWrite()
+}
+
+func (cl *Collection) removeDocFromIndexes(k key.Key) error {
+
+	cl.IndexStore.RLock()
+	var fieldLocators []string
+	for fieldLocator := range cl.IndexStore.Store {
+		fieldLocators = append(fieldLocators, fieldLocator)
+	}
+	cl.IndexStore.RUnlock()
+
+	cl.indexWriteLock.Lock()
+	defer cl.indexWriteLock.Unlock()
+
+	for _, fieldLocator := range fieldLocators {
+
+		idx, err := cl.loadIndexForWrite(fieldLocator)
+		if err != nil {
+			return err
+		}
+
+		idx.removeKey(k)
+
+		err = cl.saveIndexForWrite(idx)
+		if err != nil {
+			return err
+		}
+
+		cl.IndexStore.Lock()
+		cl.IndexStore.Store[idx.FieldLocator] = idx.IndexInfo
+		cl.IndexStore.Unlock()
+	}
+
+	return cl.endIndexWrite()
 }
 
 func (cl *Collection) getIndexInfo(fieldLocator string) (IndexInfo, error) {
@@ -332,18 +1174,30 @@ func (cl *Collection) loadIndex(fieldLocator string) (Index, error) {
 	// index exists, so let's read it.
 	idxPersistPath := util.JoinPath(cl.GetDirPathForIndexes(), fieldLocator)
 
-	file, err := os.Open(idxPersistPath)
+	release := cl.acquireIO()
+	file, err := cl.fs().Open(idxPersistPath)
 	if err != nil {
+		release()
 		return idx, err
 	}
 
 	buff := bytes.NewBuffer(nil)
 	_, err = io.Copy(buff, file)
+	file.Close()
+	release()
 	if err != nil {
 		return idx, err
 	}
+	idxJson := buff.Bytes()
+
+	if cl.shouldEncryptIndexes() {
+		idxJson, err = cl.decrypt(idxJson, []byte(fieldLocator))
+		if err != nil {
+			return idx, err
+		}
+	}
 
-	err = json.Unmarshal(buff.Bytes(), &idx)
+	err = json.Unmarshal(idxJson, &idx)
 	if err != nil {
 		return idx, err
 	}
@@ -351,6 +1205,10 @@ func (cl *Collection) loadIndex(fieldLocator string) (Index, error) {
 	// When we saved (json marshaled) the Index struct, we long the unexported field cl i.e. a pointer to the parent collection.
 	// We should therefore put it back when we read (json unmarshal) from disk.
 	idx.cl = cl
+	// The index may have been saved before the collection was renamed
+	idx.CollectionName = cl.Name
+	idx.FilePath = idxPersistPath
+	idx.internValues()
 
 	return idx, nil
 }
@@ -367,12 +1225,170 @@ func (cl *Collection) isIndexExist(fieldLocator string) bool {
 * O T H E R S
 *********************************************************************************/
 
+// encode converts v into the bytes that should be stored on disk, based on the EncodingType of the collection.
+// Gzip compression, if enabled, is applied later by Set.
+func (cl *Collection) encode(v interface{}) ([]byte, error) {
+	return encode(cl.getEncodingType(), v)
+}
+
+func encode(encodingType uint, v interface{}) ([]byte, error) {
+	switch encodingType {
+	case ENCODING_NONE:
+		return nil, ErrStructNotSupported
+	case ENCODING_JSON:
+		return json.Marshal(v)
+	case ENCODING_GOB:
+		buff := bytes.NewBuffer(nil)
+		enc := gob.NewEncoder(buff)
+		err := enc.Encode(v)
+		if err != nil {
+			return nil, err
+		}
+		return buff.Bytes(), nil
+	case ENCODING_MSGPACK:
+		return msgpack.Marshal(v)
+	case ENCODING_CBOR:
+		return cbor.Marshal(v)
+	case ENCODING_BSON:
+		return bson.Marshal(v)
+	}
+	return nil, fmt.Errorf("Encoding logic for the encoding type not implemented")
+}
+
+// decode is the reverse of encode. It expects data to have already been gzip decompressed (done by GetFileData).
+func decode(encodingType uint, data []byte, dest interface{}) error {
+	switch encodingType {
+	case ENCODING_NONE:
+		return ErrStructNotSupported
+	case ENCODING_JSON:
+		return json.Unmarshal(data, dest)
+	case ENCODING_GOB:
+		buff := bytes.NewBuffer(data)
+		dec := gob.NewDecoder(buff)
+		return dec.Decode(dest)
+	case ENCODING_MSGPACK:
+		return msgpack.Unmarshal(data, dest)
+	case ENCODING_CBOR:
+		return cbor.Unmarshal(data, dest)
+	case ENCODING_BSON:
+		return bson.Unmarshal(data, dest)
+	}
+	return fmt.Errorf("Decoding logic for the encoding type not implemented")
+}
+
 func (cl *Collection) getDataPath() string {
 	return util.JoinPath(cl.DirPath, DATA_DIR_NAME)
 }
 
+// forEachDoc calls fn for every document in the collection, one partition dir at a time. It stops at the first error.
+// With STORAGE_SEGMENTS, docPath is the path of the segment the document is in. Cold documents come last, and docPath is
+// the path of their cold file.
+func (cl *Collection) forEachDoc(fn func(k key.Key, docPath string) error) error {
+
+	if cl.isSegmented() {
+		return cl.forEachSegmentDoc(fn)
+	}
+
+	pDirPaths, err := cl.getPartitionDirPaths()
+	if err != nil {
+		return err
+	}
+
+	for _, pDirPath := range pDirPaths {
+		err = cl.forEachDocInPartitionDir(pDirPath, fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cl.mayHaveColdDocs() {
+		return cl.forEachColdDoc(fn)
+	}
+	return nil
+}
+
+// ForEachKey calls fn with the key of every document in the collection, see forEachDoc. It stops at the first error.
+func (cl *Collection) ForEachKey(fn func(k key.Key) error) error {
+	return cl.forEachDoc(func(k key.Key, docPath string) error {
+		return fn(k)
+	})
+}
+
+// getPartitionDirPaths returns the paths of all the partition dirs of the collection
+func (cl *Collection) getPartitionDirPaths() ([]string, error) {
+
+	// where are all the documents?
+	dataPath := cl.getDataPath()
+
+	// open the data dir, which has all the partition dirs
+	dataDir, err := cl.fs().Open(dataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// get all the names of the partition dirs so we can open them
+	partitionDirNames, err := dataDir.Readdirnames(-1)
+	dataDir.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// make sure that each of them is a dir
+	var pDirPaths []string
+	for _, pDirName := range partitionDirNames {
+
+		pDirPath := util.JoinPath(dataPath, pDirName)
+		fileInfo, err := cl.fs().Stat(pDirPath)
+		if err != nil {
+			return nil, err
+		}
+		if !fileInfo.IsDir() {
+			util.Warnf("%s: not a directory", pDirPath)
+			continue
+		}
+		pDirPaths = append(pDirPaths, pDirPath)
+	}
+
+	return pDirPaths, nil
+}
+
+// forEachDocInPartition calls fn for every document in the partition dir at pDirPath. It stops at the first error.
+func (cl *Collection) forEachDocInPartition(pDirPath string, fn func(k key.Key, docPath string) error) error {
+
+	pDir, err := cl.fs().Open(pDirPath)
+	if err != nil {
+		return err
+	}
+
+	docNames, err := pDir.Readdirnames(-1)
+	pDir.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, docName := range docNames {
+
+		k, err := key.GetKeyFromFileName(docName)
+		if err != nil {
+			return err
+		}
+
+		err = fn(k, util.JoinPath(pDirPath, docName))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (cl *Collection) getFilePath(k key.Key) string {
-	return util.JoinPath(cl.getDataPath(), k.GetPartitionDirName(cl.NumPartitions), k.GetFileName(cl.Name, cl.EnableGzipCompression))
+	return util.JoinPath(cl.getPartitionDirPath(k), cl.getDocFileName(k, cl.isGzipEnabled()))
+}
+
+// getAltFilePath gives the path the document would have if the gzip setting of the collection was flipped
+func (cl *Collection) getAltFilePath(k key.Key) string {
+	return util.JoinPath(cl.getPartitionDirPath(k), cl.getDocFileName(k, !cl.isGzipEnabled()))
 }
 
 /********************************************************************************
@@ -380,8 +1396,7 @@ func (cl *Collection) getFilePath(k key.Key) string {
 *********************************************************************************/
 
 func (p CollectionProps) Sanitize() CollectionProps {
-	p.Name = strings.TrimSpace(p.Name)
-	p.Name = strings.ToLower(p.Name)
+	p.Name = NormalizeName(p.Name)
 
 	if p.NumPartitions == 0 { // default value should mean we have one partition
 		p.NumPartitions = 1
@@ -389,28 +1404,14 @@ func (p CollectionProps) Sanitize() CollectionProps {
 	return p
 }
 
+// Validate checks the props of a collection. New names also need to follow the NameRules of the client, which it does
+// not check, so that existing collections can still be loaded if the rules change.
 func (p CollectionProps) Validate() error {
-	if strings.TrimSpace(p.Name) == "" {
-		return fmt.Errorf("Collection name cannot be empty")
-	}
-
-	// Special Characters check
-	rgx := regexp.MustCompile("[^a-zA-Z0-9]+")
-	hasSpecialCharacters := rgx.MatchString(p.Name)
-	if hasSpecialCharacters {
-		fmt.Errorf("Collection name cannot have any special characters")
+	if p.Name == "" {
+		return fmt.Errorf("%w: it cannot be empty", ErrInvalidCollectionName)
 	}
 
-	const collectionNameLenMax int = 50
-	const collectionNameLenMin int = 2
-	if len(p.Name) < collectionNameLenMin {
-		fmt.Errorf("Collection name needs to be a minimum of %d chars", collectionNameLenMin)
-	}
-	if len(p.Name) > collectionNameLenMax {
-		fmt.Errorf("Collection name can be a max of %d chars", collectionNameLenMin)
-	}
-
-	var supportedEncodings []uint = []uint{ENCODING_NONE, ENCODING_JSON, ENCODING_GOB}
+	var supportedEncodings []uint = []uint{ENCODING_NONE, ENCODING_JSON, ENCODING_GOB, ENCODING_MSGPACK, ENCODING_CBOR, ENCODING_BSON}
 	var isValidEncoding bool
 	for _, enc := range supportedEncodings {
 		if p.EncodingType == enc {
@@ -425,5 +1426,78 @@ func (p CollectionProps) Validate() error {
 		return fmt.Errorf("Number of paritions requested can not be negative")
 	}
 
+	if len(p.EncryptionKey) > 0 && !isValidEncryptionKeyLen(len(p.EncryptionKey)) {
+		return fmt.Errorf("EncryptionKey should be 16, 24 or 32 bytes long, but it is %d bytes", len(p.EncryptionKey))
+	}
+	if len(p.PreviousEncryptionKey) > 0 && !isValidEncryptionKeyLen(len(p.PreviousEncryptionKey)) {
+		return fmt.Errorf("PreviousEncryptionKey should be 16, 24 or 32 bytes long, but it is %d bytes", len(p.PreviousEncryptionKey))
+	}
+	if p.RetainWAL && !p.EnableWAL {
+		return fmt.Errorf("RetainWAL requires EnableWAL")
+	}
+	if p.Durability > DURABILITY_FSYNC_INTERVAL {
+		return fmt.Errorf("Invalid durability setting")
+	}
+	if p.FsyncInterval < 0 {
+		return fmt.Errorf("FsyncInterval can not be negative")
+	}
+
+	if p.NumRevisions < 0 {
+		return fmt.Errorf("NumRevisions can not be negative")
+	}
+	if p.RevisionMaxAge < 0 {
+		return fmt.Errorf("RevisionMaxAge can not be negative")
+	}
+
+	if p.EncryptIndexes && len(p.EncryptionKey) == 0 {
+		return fmt.Errorf("EncryptIndexes requires an EncryptionKey")
+	}
+
+	if p.StorageEngine > STORAGE_CONTENT_ADDRESSED {
+		return fmt.Errorf("Invalid storage engine")
+	}
+	if p.ColdAfter > 0 && p.StorageEngine == STORAGE_CONTENT_ADDRESSED {
+		return fmt.Errorf("ColdAfter is not supported with STORAGE_CONTENT_ADDRESSED")
+	}
+	if p.WriteBehindQueueSize < 0 {
+		return fmt.Errorf("WriteBehindQueueSize can not be negative")
+	}
+	if p.IndexFlushOps < 0 {
+		return fmt.Errorf("IndexFlushOps can not be negative")
+	}
+	if p.ReapInterval < 0 {
+		return fmt.Errorf("ReapInterval can not be negative")
+	}
+	if p.SoftTTL < 0 {
+		return fmt.Errorf("SoftTTL can not be negative")
+	}
+	if p.SoftTTL > 0 && p.StorageEngine == STORAGE_SEGMENTS {
+		return fmt.Errorf("SoftTTL is not supported with STORAGE_SEGMENTS")
+	}
+	if p.IndexFlushInterval < 0 {
+		return fmt.Errorf("IndexFlushInterval can not be negative")
+	}
+	if p.SegmentMaxBytes < 0 {
+		return fmt.Errorf("SegmentMaxBytes can not be negative")
+	}
+	if p.MaxDocs < 0 {
+		return fmt.Errorf("MaxDocs can not be negative")
+	}
+	if p.MaxBytes < 0 {
+		return fmt.Errorf("MaxBytes can not be negative")
+	}
+	if p.Capped && p.MaxDocs == 0 && p.MaxBytes == 0 {
+		return fmt.Errorf("Capped requires MaxDocs or MaxBytes")
+	}
+	if p.EvictionPolicy > EVICTION_POLICY_LFU {
+		return fmt.Errorf("Invalid eviction policy")
+	}
+	if p.EvictionPolicy != EVICTION_POLICY_NONE && p.MaxDocs == 0 && p.MaxBytes == 0 && !p.Evictable {
+		return fmt.Errorf("EvictionPolicy requires MaxDocs, MaxBytes or Evictable")
+	}
+	if p.EvictionPolicy != EVICTION_POLICY_NONE && p.Capped {
+		return fmt.Errorf("Capped and EvictionPolicy can not both be set")
+	}
+
 	return nil
 }
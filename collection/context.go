@@ -0,0 +1,48 @@
+package collection
+
+import (
+	"context"
+	"io"
+)
+
+/********************************************************************************
+* C O N T E X T
+*********************************************************************************/
+
+// ctxReader is an io.Reader that stops reading with ctx.Err() as soon as ctx is done, so that copying or decoding a large
+// document can be given up part way through
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// withContext returns a reader that reads from r until ctx is done. If ctx can never be done, r is returned as it is, so
+// that io.Copy can still use its WriteTo.
+func withContext(ctx context.Context, r io.Reader) io.Reader {
+	if ctx.Done() == nil {
+		return r
+	}
+	return ctxReader{ctx: ctx, r: r}
+}
+
+type queryPlanHandlerKey struct{}
+
+// WithQueryPlanHandler returns a copy of ctx with which SearchCtx calls fn with the plan of the query, once it has been
+// planned, e.g. to add a summary of it to a trace
+func WithQueryPlanHandler(ctx context.Context, fn func(plan QueryPlan)) context.Context {
+	return context.WithValue(ctx, queryPlanHandlerKey{}, fn)
+}
+
+// reportQueryPlan calls the handler set with WithQueryPlanHandler, if there is one
+func reportQueryPlan(ctx context.Context, plan QueryPlan) {
+	if fn, ok := ctx.Value(queryPlanHandlerKey{}).(func(plan QueryPlan)); ok {
+		fn(plan)
+	}
+}
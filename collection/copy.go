@@ -0,0 +1,240 @@
+package collection
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"math"
+	"os"
+)
+
+/********************************************************************************
+* C O P Y I N G
+*********************************************************************************/
+
+var ErrReencodeNotSupported = fmt.Errorf("Documents can only be re-encoded between ENCODING_JSON, ENCODING_MSGPACK, ENCODING_CBOR and ENCODING_BSON, unless the type of the documents is provided")
+
+// CopyTo writes all the documents of the collection to dst, as they would be returned by GetFileData, and returns the
+// number of documents copied. Documents are stored the way dst is set up to store them, so dst can use a different
+// partitioning, compression or storage engine. If dst uses a different encoding, documents are re-encoded, see reencode. Documents that are written or deleted while the copy is in progress may
+// or may not be copied, and corrupted documents are quarantined and skipped. Revisions and indexes are not copied.
+func (cl *Collection) CopyTo(dst *Collection) (int, error) {
+	var n int
+	err := cl.forEachDoc(func(k key.Key, docPath string) error {
+		h, data, err := cl.getDocData(context.Background(), k)
+		if os.IsNotExist(err) { // it has been deleted since it was listed
+			return nil
+		}
+		if err == ErrDocumentIsCorrupted {
+			util.Warnf("Copying collection %s: skipping document %d, since it is corrupted", cl.Name, k)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if h.EncodingType != dst.getEncodingType() {
+			data, err = reencode(data, h.EncodingType, dst.getEncodingType(), nil)
+			if err != nil {
+				return fmt.Errorf("re-encoding document %d: %w", k, err)
+			}
+		}
+		err = dst.Set(k, data)
+		if err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if os.IsNotExist(err) { // no documents have been written yet
+		return 0, nil
+	}
+	return n, err
+}
+
+// ForEachDocData calls fn with the data of every document of the collection, as GetFileData returns it, along with the
+// encoding type of the data, which is the one of the collection unless the document was written before it was changed.
+// Documents that are deleted while it runs are skipped, and so are corrupted documents, which are quarantined. It stops
+// at the first error.
+func (cl *Collection) ForEachDocData(fn func(k key.Key, encodingType uint, data []byte) error) error {
+	err := cl.forEachDoc(func(k key.Key, docPath string) error {
+		h, data, err := cl.getDocData(context.Background(), k)
+		if os.IsNotExist(err) { // it has been deleted since it was listed
+			return nil
+		}
+		if err == ErrDocumentIsCorrupted {
+			util.Warnf("Reading collection %s: skipping document %d, since it is corrupted", cl.Name, k)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(k, h.EncodingType, data)
+	})
+	if os.IsNotExist(err) { // no documents have been written yet
+		return nil
+	}
+	return err
+}
+
+// ForEachDocReader calls fn with a reader of the data of every document of the collection that hasn't expired, as
+// GetIntoWriter copies it. Unlike ForEachDocData, the documents are streamed from disk rather than read into memory, and
+// are neither added to the cache nor noted as read, so that going through all of them doesn't push the documents in use
+// out of the cache or keep cold documents warm. fn should return the errors of reading r as they are, so that corrupted
+// documents can be told apart: those are skipped, and quarantined, and so are the documents that are deleted while it
+// runs. It stops at the first error.
+func (cl *Collection) ForEachDocReader(fn func(k key.Key, r io.Reader) error) error {
+	err := cl.forEachDoc(func(k key.Key, docPath string) error {
+		err := cl.checkNotExpired(k)
+		if err == nil {
+			var r *docReader
+			_, r, err = cl.openDoc(k, true)
+			if err == nil {
+				err = fn(k, r)
+				r.Close() // before quarantining, which needs an IO slot of its own
+			}
+		}
+		if os.IsNotExist(err) { // it has expired, or has been deleted since it was listed
+			return nil
+		}
+		err = cl.quarantineIfCorrupted(k, err)
+		if err == ErrDocumentIsCorrupted {
+			util.Warnf("Reading collection %s: skipping document %d, since it is corrupted", cl.Name, k)
+			return nil
+		}
+		return err
+	})
+	if os.IsNotExist(err) { // no documents have been written yet
+		return nil
+	}
+	return err
+}
+
+// SetEncoded is Set for data encoded with encodingType, which is re-encoded with the encoding of the collection first if
+// that is another one, see Reencode
+func (cl *Collection) SetEncoded(k key.Key, data []byte, encodingType uint) error {
+	data, err := cl.Reencode(data, encodingType)
+	if err != nil {
+		return fmt.Errorf("re-encoding document %d: %w", k, err)
+	}
+	return cl.Set(k, data)
+}
+
+// Reencode returns data, which is encoded with encodingType, encoded with the encoding of the collection, see reencode
+func (cl *Collection) Reencode(data []byte, encodingType uint) ([]byte, error) {
+	if encodingType == cl.getEncodingType() {
+		return data, nil
+	}
+	return reencode(data, encodingType, cl.getEncodingType(), nil)
+}
+
+// canReencode tells whether documents can be re-encoded from one encoding type to the other. Only the encodings that
+// describe themselves can be: a document can be decoded into generic values without knowing the type it was encoded from.
+func canReencode(from, to uint) bool {
+	for _, encodingType := range []uint{from, to} {
+		switch encodingType {
+		case ENCODING_JSON, ENCODING_MSGPACK, ENCODING_CBOR, ENCODING_BSON:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// reencode decodes data with one encoding type, and encodes it with the other. If newDoc is provided, data is decoded into
+// the value it returns (which should be a pointer), so any encoding type other than ENCODING_NONE can be used. Otherwise,
+// data is decoded into generic values. Struct fields are matched by name regardless of case by all the encodings that
+// allow that, so documents can still be decoded into the same structs.
+func reencode(data []byte, from, to uint, newDoc func() interface{}) ([]byte, error) {
+	if newDoc != nil {
+		if from == ENCODING_NONE || to == ENCODING_NONE {
+			return nil, ErrReencodeNotSupported
+		}
+		v := newDoc()
+		err := decode(from, data, v)
+		if err != nil {
+			return nil, err
+		}
+		return encode(to, v)
+	}
+
+	if !canReencode(from, to) {
+		return nil, ErrReencodeNotSupported
+	}
+
+	var v map[string]interface{}
+	var err error
+	if from == ENCODING_JSON {
+		// numbers would all be decoded as float64 otherwise, which some encodings can't decode into integer fields
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&v)
+	} else {
+		err = decode(from, data, &v)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return encode(to, normalizeValue(v))
+}
+
+// normalizeValue converts the values that the decoders produce, but that not every encoder can handle (e.g. maps with
+// non-string keys, which JSON can't encode), into plain maps, slices and numbers
+func normalizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = normalizeValue(e)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = normalizeValue(e)
+		}
+		return m
+	case primitive.D:
+		m := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			m[e.Key] = normalizeValue(e.Value)
+		}
+		return m
+	case primitive.M:
+		return normalizeValue(map[string]interface{}(v))
+	case primitive.A:
+		return normalizeValue([]interface{}(v))
+	case []interface{}:
+		for i, e := range v {
+			v[i] = normalizeValue(e)
+		}
+		return v
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, err := v.Float64()
+		if err != nil || math.IsInf(f, 0) {
+			return v.String()
+		}
+		return f
+	}
+	return v
+}
+
+// GetIndexFieldLocators returns the field locators of all the indexes of the collection
+func (cl *Collection) GetIndexFieldLocators() []string {
+	cl.IndexStore.RLock()
+	defer cl.IndexStore.RUnlock()
+
+	var fieldLocators []string
+	for fieldLocator := range cl.IndexStore.Store {
+		fieldLocators = append(fieldLocators, fieldLocator)
+	}
+	return fieldLocators
+}
@@ -0,0 +1,361 @@
+package collection
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+/********************************************************************************
+* E N C R Y P T I O N
+*********************************************************************************/
+
+// Documents (and optionally indexes) of a collection with an EncryptionKey are encrypted and authenticated on disk
+// using AES-GCM. The encrypted payload is stored as: | nonce | ciphertext + tag |. Data is compressed before it is
+// encrypted, since encrypted data does not compress.
+
+var ErrEncryptionKeyMissing = fmt.Errorf("Data is encrypted but no EncryptionKey has been provided for the collection")
+var ErrDecryptionFailed = fmt.Errorf("Could not decrypt data: either the EncryptionKey is wrong or the data has been tampered with")
+
+const KEY_ROTATION_PROGRESS_FILE_NAME string = "key_rotation_progress"
+
+// keyRotationProgressHeader starts the first line of the key rotation progress file, followed by the fingerprint of the
+// key that the listed documents have been rotated to
+const keyRotationProgressHeader string = "key "
+
+// getEncryptionKeys returns EncryptionKey and PreviousEncryptionKey, which RotateEncryptionKey changes while the
+// collection is in use
+func (cl *Collection) getEncryptionKeys() ([]byte, []byte) {
+	cl.settingsLock.RLock()
+	defer cl.settingsLock.RUnlock()
+	return cl.EncryptionKey, cl.PreviousEncryptionKey
+}
+
+func (cl *Collection) isEncrypted() bool {
+	encryptionKey, _ := cl.getEncryptionKeys()
+	return len(encryptionKey) > 0
+}
+
+func (cl *Collection) shouldEncryptIndexes() bool {
+	return cl.isEncrypted() && cl.EncryptIndexes
+}
+
+func isValidEncryptionKeyLen(n int) bool {
+	// AES-128, AES-192 or AES-256
+	return n == 16 || n == 24 || n == 32
+}
+
+func newGCM(encryptionKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext. additionalData is not encrypted, but is authenticated, so it can be used to bind the
+// ciphertext to its context (e.g. the document key) so that encrypted files can't be swapped around.
+func seal(encryptionKey []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	// appending to nonce means the output starts with the nonce
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open is the reverse of seal
+func open(encryptionKey []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	if len(encryptionKey) == 0 {
+		return nil, ErrEncryptionKeyMissing
+	}
+
+	gcm, err := newGCM(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, ErrDecryptionFailed
+	}
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+
+	return plaintext, nil
+}
+
+// decrypt opens ciphertext using the EncryptionKey of the collection. If that fails, it tries the PreviousEncryptionKey
+// so that data which hasn't been re-encrypted since a key rotation can still be read.
+func (cl *Collection) decrypt(ciphertext []byte, additionalData []byte) ([]byte, error) {
+	encryptionKey, previousEncryptionKey := cl.getEncryptionKeys()
+	plaintext, err := open(encryptionKey, ciphertext, additionalData)
+	if (err == ErrDecryptionFailed || err == ErrEncryptionKeyMissing) && len(previousEncryptionKey) > 0 {
+		return open(previousEncryptionKey, ciphertext, additionalData)
+	}
+	return plaintext, err
+}
+
+/********************************************************************************
+* K E Y  R O T A T I O N
+*********************************************************************************/
+
+// RotateEncryptionKey makes newKey the EncryptionKey of the collection, and re-encrypts all the documents, their
+// revisions (and indexes, if EncryptIndexes is set) with it. Until the rotation completes, documents that still use the
+// old key are readable since the old key becomes the PreviousEncryptionKey.
+//
+// Progress is saved after every document, along with a fingerprint of newKey. If a rotation is interrupted, calling
+// RotateEncryptionKey again with the same newKey resumes it, as long as the old key is still available as either the
+// EncryptionKey or the PreviousEncryptionKey. The progress of an interrupted rotation to a different key is discarded,
+// and every document is rotated. If the collection is not encrypted, this encrypts it.
+func (cl *Collection) RotateEncryptionKey(newKey []byte) error {
+	if !isValidEncryptionKeyLen(len(newKey)) {
+		return fmt.Errorf("EncryptionKey should be 16, 24 or 32 bytes long, but it is %d bytes", len(newKey))
+	}
+
+	// If newKey is already the EncryptionKey, we're resuming a rotation and the old key should be the PreviousEncryptionKey
+	cl.settingsLock.Lock()
+	if !bytes.Equal(newKey, cl.EncryptionKey) {
+		cl.PreviousEncryptionKey = cl.EncryptionKey
+		cl.EncryptionKey = newKey
+	}
+	cl.settingsLock.Unlock()
+
+	// Cold files can't be re-encrypted in place, so the cold documents are moved back to be re-encrypted with the rest
+	err := cl.restoreAllColdDocs()
+	if err != nil {
+		return err
+	}
+
+	progressPath := util.JoinPath(cl.DirPath, META_DIR_NAME, KEY_ROTATION_PROGRESS_FILE_NAME)
+	fingerprint := getKeyFingerprint(newKey)
+	rotated, err := cl.readKeyRotationProgress(progressPath, fingerprint)
+	if err != nil {
+		return err
+	}
+	if len(rotated) > 0 {
+		util.Infof("Resuming key rotation for collection %s: %d documents already rotated", cl.Name, len(rotated))
+	}
+
+	var progressFile util.File
+	if rotated != nil {
+		progressFile, err = cl.fs().OpenFile(progressPath, os.O_WRONLY|os.O_APPEND, util.FILE_PERM)
+	} else {
+		progressFile, err = util.Create(cl.fs(), progressPath)
+		if err == nil {
+			_, err = fmt.Fprintln(progressFile, keyRotationProgressHeader+fingerprint)
+		}
+	}
+	if progressFile != nil {
+		defer progressFile.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	err = cl.forEachDoc(func(k key.Key, docPath string) error {
+		if rotated[k] {
+			return nil
+		}
+
+		var err error
+		if cl.isSegmented() {
+			err = cl.reencryptSegmentDoc(k)
+		} else {
+			err = cl.reencryptDoc(k, docPath)
+			if err == nil {
+				err = cl.refreshManifestEntry(k)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		// record that this doc is done, so we can skip it if we have to resume
+		_, err = fmt.Fprintln(progressFile, k.String())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Revisions are complete document files, so they are re-encrypted the same way. They are not tracked in the progress
+	// file, since re-encrypting one again when resuming is harmless.
+	err = cl.forEachRevision(func(k key.Key, revPath string) error {
+		return cl.reencryptDoc(k, revPath)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Indexes are re-encrypted simply by loading (using either key) and saving them again
+	if cl.shouldEncryptIndexes() {
+		err = cl.FlushIndexes()
+		if err != nil {
+			return err
+		}
+
+		cl.IndexStore.RLock()
+		var fieldLocators []string
+		for fieldLocator := range cl.IndexStore.Store {
+			fieldLocators = append(fieldLocators, fieldLocator)
+		}
+		cl.IndexStore.RUnlock()
+
+		for _, fieldLocator := range fieldLocators {
+			idx, err := cl.loadIndex(fieldLocator)
+			if err != nil {
+				return err
+			}
+			err = idx.save()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// All done
+	err = progressFile.Close()
+	if err != nil {
+		return err
+	}
+	err = cl.fs().Remove(progressPath)
+	if err != nil {
+		return err
+	}
+	cl.settingsLock.Lock()
+	cl.PreviousEncryptionKey = nil
+	cl.settingsLock.Unlock()
+
+	return nil
+}
+
+// reencryptDoc rewrites the document at docPath using the current EncryptionKey. The new file is written using writeFile,
+// so an interruption doesn't leave a half written document behind.
+func (cl *Collection) reencryptDoc(k key.Key, docPath string) error {
+	defer cl.lockKey(k)()
+
+	file, err := cl.fs().Open(docPath)
+	if os.IsNotExist(err) { // deleted since it was listed
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	fileData, err := cl.reencrypt(k, file, docPath)
+	if err != nil {
+		return err
+	}
+
+	return cl.writeFile(docPath, fileData)
+}
+
+// reencryptSegmentDoc is reencryptDoc for collections with STORAGE_SEGMENTS. The re-encrypted document is appended to
+// the segments, so an interruption leaves the previous version in place.
+func (cl *Collection) reencryptSegmentDoc(k key.Key) error {
+	defer cl.lockKey(k)()
+
+	fileName, data, err := cl.readDocFile(k)
+	if os.IsNotExist(err) { // deleted since it was listed
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	fileData, err := cl.reencrypt(k, ioutil.NopCloser(bytes.NewReader(data)), fileName)
+	if err != nil {
+		return err
+	}
+
+	return cl.storeDocFile(k, fileData)
+}
+
+// reencrypt reads the document file content from src, which is closed once read, and returns it encrypted using the
+// current EncryptionKey
+func (cl *Collection) reencrypt(k key.Key, src io.ReadCloser, fileName string) ([]byte, error) {
+	h, r, err := cl.openDocReader(src, fileName, k, true)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(nil)
+	_, err = io.Copy(buf, r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	h.IsEncrypted = true
+	fileData := bytes.NewBuffer(nil)
+	err = cl.writeDoc(fileData, h, k, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return fileData.Bytes(), nil
+}
+
+// getKeyFingerprint returns a fingerprint of an encryption key, which tells keys apart without revealing them
+func getKeyFingerprint(encryptionKey []byte) string {
+	sum := sha256.Sum256(append([]byte("gofiledb key fingerprint:"), encryptionKey...))
+	return hex.EncodeToString(sum[:16])
+}
+
+// readKeyRotationProgress returns the keys of the documents that have already been rotated to the key with fingerprint,
+// as recorded at path. It returns nil if there is no progress for that key, in which case any progress file for another
+// key is removed.
+func (cl *Collection) readKeyRotationProgress(path string, fingerprint string) (map[key.Key]bool, error) {
+	file, err := cl.fs().Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() || scanner.Text() != keyRotationProgressHeader+fingerprint {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		// the documents listed may have been rotated to another key, so they need to be rotated again
+		util.Warnf("Discarding key rotation progress file %s: it is for a different key", path)
+		file.Close()
+		return nil, cl.fs().Remove(path)
+	}
+
+	var rotated map[key.Key]bool = make(map[key.Key]bool)
+	for scanner.Scan() {
+		k, err := key.ParseKey(scanner.Text())
+		if err != nil {
+			// the last line may be incomplete if we were interrupted while writing it
+			util.Warnf("Ignoring invalid line in key rotation progress file %s: %s", path, err)
+			continue
+		}
+		rotated[k] = true
+	}
+
+	return rotated, scanner.Err()
+}
@@ -0,0 +1,232 @@
+package collection
+
+import (
+	"bytes"
+	"github.com/teejays/gofiledb/key"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+)
+
+/********************************************************************************
+* F S  V I E W
+*********************************************************************************/
+
+// FS presents the documents of a collection as a read-only io/fs file system, so that they can be served with
+// http.FileServer(http.FS(...)) or gone through with fs.WalkDir. It has a single dir, the root ".", with a file for every
+// document, named after its key (e.g. "42"). Reading a file gives the data of the document as Get does: decompressed,
+// decrypted, and from the cache if it is there. The file is read into memory when it is opened, so that it can be
+// seeked, which http.FileServer needs.
+//
+// The view is live: listing the root lists the documents as they are then, and opening a file reads the document as it
+// is then. The modification time of a file is when its document was last written, which is not known for
+// STORAGE_SEGMENTS.
+
+// DOC_FS_FILE_MODE is the mode of the files of the documents in the FS of a collection
+const DOC_FS_FILE_MODE fs.FileMode = 0444
+
+// DOC_FS_DIR_MODE is the mode of the root dir of the FS of a collection
+const DOC_FS_DIR_MODE fs.FileMode = fs.ModeDir | 0555
+
+type docFS struct {
+	cl *Collection
+}
+
+// FS returns a read-only view of the documents of the collection, as files named after their keys
+func (cl *Collection) FS() fs.FS {
+	return docFS{cl: cl}
+}
+
+func (fsys docFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return &docFSDir{fsys: fsys}, nil
+	}
+
+	k, err := fsys.getKey("open", name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := fsys.cl.GetFileData(k)
+	if err != nil {
+		return nil, fsys.pathError("open", name, err)
+	}
+	info := docFSFileInfo{name: name, size: int64(len(data)), modTime: fsys.getModTime(k)}
+	return &docFSFile{Reader: bytes.NewReader(data), info: info}, nil
+}
+
+func (fsys docFS) Stat(name string) (fs.FileInfo, error) {
+	f, err := fsys.Open(name)
+	if pErr, ok := err.(*fs.PathError); ok {
+		pErr.Op = "stat"
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+func (fsys docFS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrInvalid}
+	}
+	k, err := fsys.getKey("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := fsys.cl.GetFileData(k)
+	if err != nil {
+		return nil, fsys.pathError("readfile", name, err)
+	}
+	return data, nil
+}
+
+func (fsys docFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	if name != "." {
+		// the files of the documents are the only other files, and they aren't dirs
+		if _, err := fsys.getKey("readdir", name); err != nil {
+			return nil, err
+		}
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	return fsys.getDirEntries()
+}
+
+// getDirEntries returns an entry for every document of the collection, ordered by name as fs.ReadDir does
+func (fsys docFS) getDirEntries() ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	err := fsys.cl.ForEachKey(func(k key.Key) error {
+		entries = append(entries, docFSDirEntry{fsys: fsys, k: k})
+		return nil
+	})
+	if os.IsNotExist(err) { // nothing has been written yet
+		err = nil
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: ".", Err: err}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// getKey returns the key of the document that the file name is for. There are no other files than the root dir and the
+// files of the documents, so any other name doesn't exist.
+func (fsys docFS) getKey(op string, name string) (key.Key, error) {
+	k, err := key.ParseKey(name)
+	if err != nil || k.String() != name { // e.g. "+1" or "01"
+		return 0, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return k, nil
+}
+
+func (fsys docFS) pathError(op string, name string, err error) error {
+	if os.IsNotExist(err) {
+		err = fs.ErrNotExist
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// getModTime returns when the document for k was last written, or the zero time if that isn't known
+func (fsys docFS) getModTime(k key.Key) time.Time {
+	if fsys.cl.isSegmented() {
+		return time.Time{}
+	}
+	modTime, err := fsys.cl.getWriteTime(k)
+	if err != nil {
+		return time.Time{}
+	}
+	return modTime
+}
+
+// docFSFile is an open file of a document, with the data of the document in memory
+type docFSFile struct {
+	*bytes.Reader
+	info docFSFileInfo
+}
+
+func (f *docFSFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *docFSFile) Close() error               { return nil }
+
+// docFSDir is the open root dir, which lists the documents when it is first read
+type docFSDir struct {
+	fsys    docFS
+	entries []fs.DirEntry // nil until first read
+	offset  int
+}
+
+func (d *docFSDir) Stat() (fs.FileInfo, error) {
+	return docFSFileInfo{name: ".", isDir: true}, nil
+}
+
+func (d *docFSDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: ".", Err: fs.ErrInvalid}
+}
+
+func (d *docFSDir) Close() error { return nil }
+
+// ReadDir behaves as fs.ReadDirFile says: with n > 0 it returns at most n entries, and io.EOF once there are none left
+func (d *docFSDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.entries == nil {
+		entries, err := d.fsys.getDirEntries()
+		if err != nil {
+			return nil, err
+		}
+		d.entries = append([]fs.DirEntry{}, entries...)
+	}
+
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
+
+// docFSDirEntry is the entry of a document in the root dir. Its info is only read when asked for.
+type docFSDirEntry struct {
+	fsys docFS
+	k    key.Key
+}
+
+func (e docFSDirEntry) Name() string      { return e.k.String() }
+func (e docFSDirEntry) IsDir() bool       { return false }
+func (e docFSDirEntry) Type() fs.FileMode { return 0 }
+
+func (e docFSDirEntry) Info() (fs.FileInfo, error) {
+	return e.fsys.Stat(e.Name())
+}
+
+type docFSFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (fi docFSFileInfo) Name() string       { return fi.name }
+func (fi docFSFileInfo) Size() int64        { return fi.size }
+func (fi docFSFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi docFSFileInfo) IsDir() bool        { return fi.isDir }
+func (fi docFSFileInfo) Sys() interface{}   { return nil }
+
+func (fi docFSFileInfo) Mode() fs.FileMode {
+	if fi.isDir {
+		return DOC_FS_DIR_MODE
+	}
+	return DOC_FS_FILE_MODE
+}
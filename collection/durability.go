@@ -0,0 +1,300 @@
+package collection
+
+import (
+	"github.com/teejays/gofiledb/util"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/********************************************************************************
+* D U R A B I L I T Y
+*********************************************************************************/
+
+const (
+	DURABILITY_NONE           uint = iota // leave it to the OS to flush writes to the disk
+	DURABILITY_FSYNC_ON_WRITE             // fsync every written file (and its parent dir) before the write returns
+	DURABILITY_FSYNC_INTERVAL             // fsync written files (and their parent dirs) in the background, every FsyncInterval
+)
+
+const DEFAULT_FSYNC_INTERVAL time.Duration = time.Second
+
+// syncer keeps track of the files that have been written but not fsynced yet, and fsyncs them periodically. It is
+// used by collections with the DURABILITY_FSYNC_INTERVAL setting.
+type syncer struct {
+	pending map[string]bool // paths of the files that need to be fsynced
+	stop    chan struct{}
+	fsys    util.FS
+	sync.Mutex
+}
+
+func newSyncer(fsys util.FS, interval time.Duration) *syncer {
+	s := &syncer{
+		pending: make(map[string]bool),
+		stop:    make(chan struct{}),
+		fsys:    fsys,
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.flush(); err != nil {
+					util.Warnf("Error while fsyncing files in the background: %s", err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *syncer) add(path string) {
+	s.Lock()
+	s.pending[path] = true
+	s.Unlock()
+}
+
+// flush fsyncs all the pending files, and then their parent dirs
+func (s *syncer) flush() error {
+	s.Lock()
+	pending := s.pending
+	s.pending = make(map[string]bool)
+	s.Unlock()
+
+	var dirs map[string]bool = make(map[string]bool)
+	for path := range pending {
+		err := util.SyncFile(s.fsys, path)
+		if os.IsNotExist(err) { // the file has been removed since it was written, nothing to do
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		dirs[filepath.Dir(path)] = true
+	}
+
+	for dir := range dirs {
+		err := util.SyncFile(s.fsys, dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// close stops the background goroutine, and fsyncs anything that is still pending
+func (s *syncer) close() error {
+	close(s.stop)
+	return s.flush()
+}
+
+func (cl *Collection) getSyncer() *syncer {
+	cl.syncerLock.Lock()
+	defer cl.syncerLock.Unlock()
+
+	if cl.syncer == nil {
+		_, interval := cl.GetDurability()
+		if interval <= 0 {
+			interval = DEFAULT_FSYNC_INTERVAL
+		}
+		cl.syncer = newSyncer(cl.fs(), interval)
+	}
+	return cl.syncer
+}
+
+// syncFile makes the latest writes to f durable, as per the Durability setting of the collection. It should be called
+// before f is closed.
+func (cl *Collection) syncFile(f util.File) error {
+	durability, _ := cl.GetDurability()
+	switch durability {
+	case DURABILITY_FSYNC_ON_WRITE:
+		err := f.Sync()
+		if err != nil {
+			return err
+		}
+		return util.SyncFile(cl.fs(), filepath.Dir(f.Name()))
+	case DURABILITY_FSYNC_INTERVAL:
+		cl.getSyncer().add(f.Name())
+	}
+	return nil
+}
+
+// syncRenamed makes a rename of a file to path durable, as per the Durability setting of the collection. The contents
+// of the file should have already been synced using syncFile.
+func (cl *Collection) syncRenamed(path string) error {
+	durability, _ := cl.GetDurability()
+	switch durability {
+	case DURABILITY_FSYNC_ON_WRITE:
+		return util.SyncFile(cl.fs(), filepath.Dir(path))
+	case DURABILITY_FSYNC_INTERVAL:
+		cl.getSyncer().add(path)
+	}
+	return nil
+}
+
+// writeFile replaces the file at path with data. The data is written to a temp file first, which is then renamed into
+// place, so readers never see a partially written file and any hard links to the old file (e.g. from a snapshot) are
+// left untouched.
+func (cl *Collection) writeFile(path string, data []byte) error {
+	tmpPath, err := cl.writeTempFile(data)
+	if err != nil {
+		return err
+	}
+
+	err = cl.fs().Rename(tmpPath, path)
+	if err != nil {
+		cl.fs().Remove(tmpPath)
+		return err
+	}
+	return cl.syncRenamed(path)
+}
+
+// writeNewFile is like writeFile, but fails if a file already exists at path. The error then satisfies os.IsExist.
+func (cl *Collection) writeNewFile(path string, data []byte) error {
+	tmpPath, err := cl.writeTempFile(data)
+	if err != nil {
+		return err
+	}
+
+	// unlike a rename, a link never replaces an existing file
+	err = cl.fs().Link(tmpPath, path)
+	cl.fs().Remove(tmpPath)
+	if err != nil {
+		return err
+	}
+	return cl.syncRenamed(path)
+}
+
+// writeTempFile writes data into a new temp file in the meta dir, and returns its path
+func (cl *Collection) writeTempFile(data []byte) (string, error) {
+	defer cl.acquireIO()()
+
+	tmpFile, err := util.TempFile(cl.fs(), util.JoinPath(cl.DirPath, META_DIR_NAME), TEMP_FILE_PREFIX)
+	if err != nil {
+		return "", err
+	}
+	tmpPath := tmpFile.Name()
+
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = cl.syncFile(tmpFile)
+	}
+	if err != nil {
+		tmpFile.Close()
+		cl.fs().Remove(tmpPath)
+		return "", err
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		cl.fs().Remove(tmpPath)
+		return "", err
+	}
+	return tmpPath, nil
+}
+
+// Flush makes all the writes to the collection that have returned so far durable, regardless of the Durability setting:
+// documents, indexes, revisions and the logs are fsynced, along with the dirs they are in. Queued writes are applied, and
+// batched index changes are saved first.
+func (cl *Collection) Flush() error {
+	cl.waitForAllWrites()
+
+	err := cl.saveAccessLog()
+	if err != nil {
+		return err
+	}
+	err = cl.FlushIndexes()
+	if err != nil {
+		return err
+	}
+
+	for _, w := range cl.getOpenLogs() {
+		err := w.sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	durability, _ := cl.GetDurability()
+	switch durability {
+	case DURABILITY_FSYNC_ON_WRITE:
+		return nil
+	case DURABILITY_FSYNC_INTERVAL:
+		cl.syncerLock.Lock()
+		s := cl.syncer
+		cl.syncerLock.Unlock()
+		if s == nil {
+			return nil
+		}
+		return s.flush()
+	}
+
+	// Nothing has been fsynced, and we don't know what has been written, so fsync everything
+	return util.Walk(cl.fs(), cl.DirPath, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) { // removed while we were walking, e.g. a temp file
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		err = util.SyncFile(cl.fs(), path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// Close releases any background resources and open files held by the collection, making sure that any pending fsyncs
+// are done.
+func (cl *Collection) Close() error {
+	cl.StopWatchingExternalChanges()
+	cl.stopRefreshes()
+	cl.closeWriteBehind()
+	cl.dropExpiries()
+
+	err := cl.saveAccessLog()
+	if err != nil {
+		return err
+	}
+	// Batched index changes commit entries in the logs, so they go first
+	err = cl.closeIndexBatch()
+	if err != nil {
+		return err
+	}
+	err = cl.closeWAL()
+	if err != nil {
+		return err
+	}
+	err = cl.closeIndexJournal()
+	if err != nil {
+		return err
+	}
+	err = cl.closeSegmentStore()
+	if err != nil {
+		return err
+	}
+	err = cl.closeManifests()
+	if err != nil {
+		return err
+	}
+
+	cl.syncerLock.Lock()
+	s := cl.syncer
+	cl.syncer = nil
+	cl.syncerLock.Unlock()
+
+	if s == nil {
+		return nil
+	}
+	return s.close()
+}
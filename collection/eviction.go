@@ -0,0 +1,206 @@
+package collection
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"os"
+)
+
+/********************************************************************************
+* E V I C T I O N
+*********************************************************************************/
+
+// A collection with an EvictionPolicy is in cache mode: like a capped collection, it makes room for new documents once
+// it is over MaxDocs or MaxBytes (if set), but it evicts the documents that have been used the least recently (LRU), or the least
+// often (LFU, the least recently used one first among equals), rather than the oldest ones. Reading a document (other
+// than by a search) and writing it both count as using it.
+//
+// The uses are tracked with the stats of the collection (see getStats): the documents are kept in the order they were
+// last used in, and with the number of times they have been used. This only costs a list move per read. Picking a
+// document to evict is cheap with LRU, while LFU goes through all the documents. The uses are saved to a small access
+// log in the meta dir (ACCESS_LOG_FILE_NAME) by Flush and Close, and are taken from it when the stats are gathered
+// again, e.g. by a new client. The documents that aren't in the access log count as used when they were last written.
+//
+// Documents can also be evicted one at a time by EvictNext, which is how the client keeps the whole warehouse within its
+// ByteBudget: it evicts from the collections marked Evictable, by their EvictionPolicy, whether they are in cache mode
+// or not.
+
+const (
+	EVICTION_POLICY_NONE uint = iota // documents are only evicted if the collection is Capped, oldest first
+	EVICTION_POLICY_LRU              // the least recently used documents are evicted first
+	EVICTION_POLICY_LFU              // the least frequently used documents are evicted first
+)
+
+const ACCESS_LOG_FILE_NAME string = "access.gob"
+
+// accessRecord is how the uses of a document are saved in the access log
+type accessRecord struct {
+	K       key.Key
+	NumUses int64
+}
+
+func (cl *Collection) getEvictionPolicy() uint {
+	cl.settingsLock.RLock()
+	defer cl.settingsLock.RUnlock()
+	return cl.EvictionPolicy
+}
+
+func (cl *Collection) getAccessLogPath() string {
+	return util.JoinPath(cl.DirPath, META_DIR_NAME, ACCESS_LOG_FILE_NAME)
+}
+
+// noteUse records that the document for k is being read. It is a no-op unless the collection has an EvictionPolicy.
+func (cl *Collection) noteUse(k key.Key) error {
+	if cl.getEvictionPolicy() == EVICTION_POLICY_NONE {
+		return nil
+	}
+	s, err := cl.getStats()
+	if err != nil {
+		return err
+	}
+
+	cl.statsLock.Lock()
+	s.use(k)
+	cl.statsLock.Unlock()
+	return nil
+}
+
+// use makes the document for k, if it is in the stats, the most recently used one, and counts the use
+func (s *collectionStats) use(k key.Key) {
+	d, ok := s.docs[k]
+	if !ok {
+		return
+	}
+	s.usage.MoveToBack(d.usageElem)
+	d.numUses++
+	s.docs[k] = d
+}
+
+// EvictNext evicts the document that the EvictionPolicy of the collection evicts first (the oldest one, if it has
+// none), and returns the stored size it had. It returns false if the collection has no documents.
+func (cl *Collection) EvictNext() (int64, bool, error) {
+	policy := cl.getEvictionPolicy()
+	for {
+		s, err := cl.getStats()
+		if err != nil {
+			return 0, false, err
+		}
+
+		cl.statsLock.Lock()
+		evictee, found := s.pickEvictee(policy, nil)
+		storedBytes := s.docs[evictee].storedBytes
+		cl.statsLock.Unlock()
+		if !found {
+			return 0, false, nil
+		}
+
+		err = cl.deleteNow(evictee)
+		if os.IsNotExist(err) { // deleted by someone else meanwhile, or the stats are behind
+			cl.noteRemovedDoc(evictee)
+			continue
+		}
+		if err != nil {
+			return 0, false, fmt.Errorf("evicting document %d: %w", evictee, err)
+		}
+		return storedBytes, true, nil
+	}
+}
+
+// pickEvictee returns the document that policy evicts first, other than the one for k if k is not nil, and false if
+// there is none. It should be called while holding statsLock.
+func (s *collectionStats) pickEvictee(policy uint, k *key.Key) (key.Key, bool) {
+	isExcluded := func(ek key.Key) bool { return k != nil && ek == *k }
+
+	switch policy {
+	case EVICTION_POLICY_LRU:
+		for e := s.usage.Front(); e != nil; e = e.Next() {
+			if !isExcluded(e.Value.(key.Key)) {
+				return e.Value.(key.Key), true
+			}
+		}
+		return 0, false
+
+	case EVICTION_POLICY_LFU:
+		var evictee key.Key
+		var minUses int64
+		var found bool
+		for e := s.usage.Front(); e != nil; e = e.Next() {
+			ek := e.Value.(key.Key)
+			if isExcluded(ek) {
+				continue
+			}
+			if n := s.docs[ek].numUses; !found || n < minUses {
+				evictee, minUses, found = ek, n, true
+			}
+		}
+		return evictee, found
+	}
+
+	for e := s.order.Front(); e != nil; e = e.Next() {
+		if !isExcluded(e.Value.(key.Key)) {
+			return e.Value.(key.Key), true
+		}
+	}
+	return 0, false
+}
+
+// saveAccessLog saves the uses of the documents to the access log, if the collection has an EvictionPolicy and its
+// stats have been gathered
+func (cl *Collection) saveAccessLog() error {
+	if cl.getEvictionPolicy() == EVICTION_POLICY_NONE || cl.isReadOnly {
+		return nil
+	}
+
+	cl.statsLock.Lock()
+	s := cl.stats
+	var records []accessRecord
+	if s != nil {
+		records = make([]accessRecord, 0, len(s.docs))
+		for e := s.usage.Front(); e != nil; e = e.Next() {
+			k := e.Value.(key.Key)
+			records = append(records, accessRecord{K: k, NumUses: s.docs[k].numUses})
+		}
+	}
+	cl.statsLock.Unlock()
+	if s == nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(records)
+	if err != nil {
+		return err
+	}
+	return cl.writeFile(cl.getAccessLogPath(), buf.Bytes())
+}
+
+// applyAccessLog takes the uses of the documents in s from the access log, if there is one. The documents that are in it
+// go first, in the order they were last used in, and the others keep the order they were written in after them.
+func (cl *Collection) applyAccessLog(s *collectionStats) error {
+	data, err := util.ReadFile(cl.fs(), cl.getAccessLogPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var records []accessRecord
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&records)
+	if err != nil {
+		return err
+	}
+
+	for i := len(records) - 1; i >= 0; i-- {
+		d, ok := s.docs[records[i].K]
+		if !ok { // deleted since the access log was saved
+			continue
+		}
+		s.usage.MoveToFront(d.usageElem)
+		d.numUses = records[i].NumUses
+		s.docs[records[i].K] = d
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package collection
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"os"
+	"strconv"
+	"time"
+)
+
+/********************************************************************************
+* E X P I R A T I O N
+*********************************************************************************/
+
+// A document can be written with a TTL (see SetWithTTLCtx), after which it expires. The time a document expires at is
+// kept in a small file of its own in EXPIRY_DIR_NAME in the meta dir, named after its key, and all the expiration times
+// of a collection are loaded into memory the first time one is needed. Writing a document without a TTL, or deleting
+// it, clears its expiration time, while Touch sets a new one without rewriting it. The expiration time is saved once the
+// document has been written, so a crash in between leaves the document without one.
+//
+// A document that has expired is gone as far as reads are concerned, even before it is deleted: reading it fails as if
+// it didn't exist, IsDocExist reports it missing and searches leave it out. Count still counts it until it is deleted.
+//
+// Expired documents are deleted, along with their index entries, by ReapExpired. With ReapInterval set, a background
+// reaper calls it that often, from the time the expiration times of the collection are loaded (i.e. its first write)
+// until it is closed. GetReapStats tells how many documents have been reaped.
+
+const EXPIRY_DIR_NAME string = "expiry"
+
+var ErrInvalidTTL = fmt.Errorf("The TTL of a document needs to be positive")
+
+type (
+	// ReapStats are the numbers of the documents deleted by ReapExpired, since the collection was loaded
+	ReapStats struct {
+		NumReaped     int64     // documents deleted because they had expired
+		NumErrors     int64     // expired documents that could not be deleted, and are tried again by the next run
+		LastRunAt     time.Time // when ReapExpired last ran, zero if it hasn't
+		LastNumReaped int       // documents deleted by the last run
+	}
+
+	// expiryStore has the expiration times of the documents of a collection, see getExpiries
+	expiryStore struct {
+		expiresAt map[key.Key]time.Time
+		stop      chan struct{} // closed to stop the reaper, nil if there is none
+	}
+)
+
+func (cl *Collection) getExpiryDirPath() string {
+	return util.JoinPath(cl.DirPath, META_DIR_NAME, EXPIRY_DIR_NAME)
+}
+
+func (cl *Collection) getExpiryFilePath(k key.Key) string {
+	return util.JoinPath(cl.getExpiryDirPath(), k.String())
+}
+
+// getExpiries returns the expiration times of the collection, loading them and starting the reaper if needed. It
+// should be called while holding expiriesLock.
+func (cl *Collection) getExpiries() (*expiryStore, error) {
+	if cl.expiries != nil {
+		return cl.expiries, nil
+	}
+
+	s := &expiryStore{expiresAt: make(map[key.Key]time.Time)}
+	names, err := cl.getDirNames(cl.getExpiryDirPath())
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		n, err := strconv.ParseInt(name, 10, 64)
+		if err != nil { // not an expiry file
+			continue
+		}
+		k := key.Key(n)
+		data, err := util.ReadFile(cl.fs(), cl.getExpiryFilePath(k))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(data) != 8 {
+			util.Warnf("Ignoring the invalid expiration time of document %d of collection %s", k, cl.Name)
+			continue
+		}
+		s.expiresAt[k] = time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+	}
+
+	if interval := cl.getReapInterval(); interval > 0 {
+		s.stop = make(chan struct{})
+		go cl.runReaper(interval, s.stop)
+	}
+
+	cl.expiries = s
+	return s, nil
+}
+
+// setExpiry saves expiresAt as the time the document for k expires, or clears it if expiresAt is zero. It should be
+// called while holding the key lock for k.
+func (cl *Collection) setExpiry(k key.Key, expiresAt time.Time) error {
+	cl.expiriesLock.Lock()
+	defer cl.expiriesLock.Unlock()
+
+	s, err := cl.getExpiries()
+	if err != nil {
+		return err
+	}
+
+	if expiresAt.IsZero() {
+		if _, ok := s.expiresAt[k]; !ok {
+			return nil
+		}
+		err = cl.fs().Remove(cl.getExpiryFilePath(k))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(s.expiresAt, k)
+		return nil
+	}
+
+	err = util.CreateDirIfNotExist(cl.fs(), cl.getExpiryDirPath())
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(expiresAt.UnixNano()))
+	err = cl.writeFile(cl.getExpiryFilePath(k), data)
+	if err != nil {
+		return err
+	}
+	s.expiresAt[k] = expiresAt
+	return nil
+}
+
+// Touch makes the document for k expire after ttl from now, without rewriting it, e.g. to keep a session alive for as
+// long as it is used. It doesn't matter whether the document had a TTL before. A document that has already expired can't
+// be touched: the returned error then satisfies os.IsNotExist, as it does if there is no document for k.
+func (cl *Collection) Touch(k key.Key, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	cl.waitForWrites(k)
+	defer cl.lockKey(k)()
+
+	endWrite, err := cl.beginWrite()
+	if err != nil {
+		return err
+	}
+	defer endWrite()
+
+	err = cl.checkDocExists(k)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	isExpired, err := cl.isExpired(k, now)
+	if err != nil {
+		return err
+	}
+	if isExpired {
+		return os.ErrNotExist
+	}
+	return cl.setExpiry(k, now.Add(ttl))
+}
+
+// GetExpiry returns the time the document for k expires at, or the zero time if it doesn't expire
+func (cl *Collection) GetExpiry(k key.Key) (time.Time, error) {
+	cl.expiriesLock.Lock()
+	defer cl.expiriesLock.Unlock()
+
+	s, err := cl.getExpiries()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return s.expiresAt[k], nil
+}
+
+// isExpired tells whether the document for k has expired
+func (cl *Collection) isExpired(k key.Key, now time.Time) (bool, error) {
+	expiresAt, err := cl.GetExpiry(k)
+	if err != nil {
+		return false, err
+	}
+	return !expiresAt.IsZero() && !now.Before(expiresAt), nil
+}
+
+// checkNotExpired returns an error that satisfies os.IsNotExist if the document for k has expired
+func (cl *Collection) checkNotExpired(k key.Key) error {
+	isExpired, err := cl.isExpired(k, time.Now())
+	if err != nil {
+		return err
+	}
+	if isExpired {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// getExpiredKeys returns the keys of the documents that have expired by now, in no particular order
+func (cl *Collection) getExpiredKeys(now time.Time) ([]key.Key, error) {
+	cl.expiriesLock.Lock()
+	defer cl.expiriesLock.Unlock()
+
+	s, err := cl.getExpiries()
+	if err != nil {
+		return nil, err
+	}
+	var keys []key.Key
+	for k, expiresAt := range s.expiresAt {
+		if !now.Before(expiresAt) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+// ReapExpired deletes the documents that have expired, along with their index entries, and returns how many it
+// deleted. Documents that can't be deleted are logged and counted in ReapStats.NumErrors, and left for the next run.
+func (cl *Collection) ReapExpired() (int, error) {
+	now := time.Now()
+	keys, err := cl.getExpiredKeys(now)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	var numErrors int64
+	for _, k := range keys {
+		reaped, err := cl.reapDoc(k, now)
+		if err == ErrCollectionIsFrozen {
+			break
+		}
+		if err != nil {
+			util.Warnf("Could not delete the expired document %d of collection %s: %s", k, cl.Name, err)
+			numErrors++
+			continue
+		}
+		if reaped {
+			n++
+		}
+	}
+
+	cl.reapStatsLock.Lock()
+	cl.reapStats.NumReaped += int64(n)
+	cl.reapStats.NumErrors += numErrors
+	cl.reapStats.LastRunAt = now
+	cl.reapStats.LastNumReaped = n
+	cl.reapStatsLock.Unlock()
+	return n, nil
+}
+
+// reapDoc deletes the document for k if it has still expired by now, which it may not have if it has been written again
+// since it was listed
+func (cl *Collection) reapDoc(k key.Key, now time.Time) (bool, error) {
+	defer cl.lockKey(k)()
+
+	isExpired, err := cl.isExpired(k, now)
+	if err != nil || !isExpired {
+		return false, err
+	}
+	err = cl.deleteLocked(k)
+	if os.IsNotExist(err) { // the document is gone, but its expiration time is left behind
+		return false, cl.setExpiry(k, time.Time{})
+	}
+	return err == nil, err
+}
+
+// GetReapStats returns the numbers of the documents deleted by ReapExpired since the collection was loaded
+func (cl *Collection) GetReapStats() ReapStats {
+	cl.reapStatsLock.Lock()
+	defer cl.reapStatsLock.Unlock()
+	return cl.reapStats
+}
+
+func (cl *Collection) getReapInterval() time.Duration {
+	cl.settingsLock.RLock()
+	defer cl.settingsLock.RUnlock()
+	return cl.ReapInterval
+}
+
+// runReaper calls ReapExpired every interval, until stop is closed
+func (cl *Collection) runReaper(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := cl.ReapExpired()
+			if err != nil {
+				util.Warnf("Error while deleting the expired documents of collection %s in the background: %s", cl.Name, err)
+			}
+			if n > 0 {
+				util.Debugf("Deleted %d expired documents of collection %s", n, cl.Name)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// dropExpiries stops the reaper, and drops the expiration times kept in memory, which are loaded again when they are
+// next needed
+func (cl *Collection) dropExpiries() {
+	cl.expiriesLock.Lock()
+	s := cl.expiries
+	cl.expiries = nil
+	cl.expiriesLock.Unlock()
+	if s != nil && s.stop != nil {
+		close(s.stop)
+	}
+}
+
+// copyExpiriesTo copies the expiration times of the documents of the collection to dst
+func (cl *Collection) copyExpiriesTo(dst *Collection) error {
+	cl.expiriesLock.Lock()
+	s, err := cl.getExpiries()
+	var expiresAt map[key.Key]time.Time
+	if err == nil {
+		expiresAt = make(map[key.Key]time.Time, len(s.expiresAt))
+		for k, t := range s.expiresAt {
+			expiresAt[k] = t
+		}
+	}
+	cl.expiriesLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for k, t := range expiresAt {
+		err := dst.setExpiry(k, t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
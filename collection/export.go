@@ -0,0 +1,145 @@
+package collection
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"io"
+	"os"
+	"time"
+)
+
+/********************************************************************************
+* E X P O R T I N G
+*********************************************************************************/
+
+// A collection can be exported in a format that other tools understand, with one of the EXPORT_FORMAT_ constants:
+//
+// - EXPORT_FORMAT_JSONL writes one ExportRecord per line. Documents that can be expressed as JSON (the ones of
+//   collections with ENCODING_JSON, ENCODING_MSGPACK, ENCODING_CBOR or ENCODING_BSON) are written as JSON, and the data
+//   of the others is written base64 encoded.
+// - EXPORT_FORMAT_TAR writes a tar archive with a file for each document, named <collection name>/<key><extension>,
+//   where the extension depends on the encoding (see getExportFileExtension). The files have the data of the documents,
+//   as GetFileData returns it.
+
+const (
+	EXPORT_FORMAT_JSONL uint = iota
+	EXPORT_FORMAT_TAR
+)
+
+var ErrInvalidExportFormat = fmt.Errorf("Invalid export format")
+
+// ExportRecord is a line of an EXPORT_FORMAT_JSONL export. Either Doc or Data is set, unless the document is empty.
+type ExportRecord struct {
+	Key  key.Key         `json:"key"`
+	Doc  json.RawMessage `json:"doc,omitempty"`  // the document, if it can be expressed as JSON
+	Data []byte          `json:"data,omitempty"` // the data of the document otherwise
+}
+
+// Export writes all the documents of the collection to w in format, and returns the number of documents written.
+// Documents that are written or deleted while the export is in progress may or may not be exported, and corrupted
+// documents are quarantined and skipped.
+func (cl *Collection) Export(w io.Writer, format uint) (int, error) {
+	var writeDoc func(k key.Key, h docHeader, data []byte, modTime time.Time) error
+	var finish func() error
+	switch format {
+	case EXPORT_FORMAT_JSONL:
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		enc.SetEscapeHTML(false)
+		writeDoc = func(k key.Key, h docHeader, data []byte, modTime time.Time) error {
+			return enc.Encode(newExportRecord(k, h.EncodingType, data))
+		}
+		finish = bw.Flush
+	case EXPORT_FORMAT_TAR:
+		tw := tar.NewWriter(w)
+		writeDoc = func(k key.Key, h docHeader, data []byte, modTime time.Time) error {
+			err := tw.WriteHeader(&tar.Header{
+				Name:    cl.Name + "/" + k.String() + getExportFileExtension(h.EncodingType),
+				Mode:    0644,
+				Size:    int64(len(data)),
+				ModTime: modTime,
+			})
+			if err != nil {
+				return err
+			}
+			_, err = tw.Write(data)
+			return err
+		}
+		finish = tw.Close
+	default:
+		return 0, ErrInvalidExportFormat
+	}
+
+	var n int
+	err := cl.forEachDoc(func(k key.Key, docPath string) error {
+		info, err := cl.fs().Stat(docPath)
+		if err == nil {
+			var h docHeader
+			var data []byte
+			h, data, err = cl.getDocData(context.Background(), k)
+			if err == nil {
+				err = writeDoc(k, h, data, info.ModTime())
+			}
+		}
+		if os.IsNotExist(err) { // it has been deleted since it was listed
+			return nil
+		}
+		if err == ErrDocumentIsCorrupted {
+			util.Warnf("Exporting collection %s: skipping document %d, since it is corrupted", cl.Name, k)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) { // no documents have been written yet
+		return n, err
+	}
+	return n, finish()
+}
+
+// newExportRecord returns the ExportRecord for the document for k, with data encoded with encodingType
+func newExportRecord(k key.Key, encodingType uint, data []byte) ExportRecord {
+	r := ExportRecord{Key: k}
+
+	var doc []byte
+	switch {
+	case encodingType == ENCODING_JSON:
+		doc = data
+	case canReencode(encodingType, ENCODING_JSON):
+		doc, _ = reencode(data, encodingType, ENCODING_JSON, nil) // exported as data if that fails
+	}
+	// the record has to fit on one line
+	var buf bytes.Buffer
+	if len(doc) > 0 && json.Compact(&buf, doc) == nil {
+		r.Doc = buf.Bytes()
+	} else {
+		r.Data = data
+	}
+	return r
+}
+
+// getExportFileExtension returns the extension of the files of the documents in an EXPORT_FORMAT_TAR export
+func getExportFileExtension(encodingType uint) string {
+	switch encodingType {
+	case ENCODING_JSON:
+		return ".json"
+	case ENCODING_GOB:
+		return ".gob"
+	case ENCODING_MSGPACK:
+		return ".msgpack"
+	case ENCODING_CBOR:
+		return ".cbor"
+	case ENCODING_BSON:
+		return ".bson"
+	}
+	return ""
+}
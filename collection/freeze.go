@@ -0,0 +1,61 @@
+package collection
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+/********************************************************************************
+* F R E E Z I N G
+*********************************************************************************/
+
+// A frozen collection rejects the writes and deletes of documents with ErrCollectionIsFrozen, while it can still be read
+// and searched. This guarantees that the collection stops changing, e.g. once it has been archived, or while it is the
+// source of a migration. Writes that are in progress when Freeze is called are finished (including the ones queued for
+// write-behind) before it returns, and no write starts after that. The frozen state is saved with the client meta.
+//
+// Replaying the WAL is not a write in this sense: it only completes the writes that were made before the collection
+// was frozen.
+
+var ErrCollectionIsFrozen = fmt.Errorf("Attempted to make changes to a frozen collection")
+
+// Freeze makes the collection reject writes, once the writes in progress are done
+func (cl *Collection) Freeze() error {
+	cl.waitForAllWrites()
+
+	// Wait for the writes that have passed checkFrozen, see beginWrite
+	cl.freezeLock.Lock()
+	atomic.StoreInt32(&cl.isFrozen, 1)
+	cl.freezeLock.Unlock()
+
+	return cl.Flush()
+}
+
+// Unfreeze makes the collection accept writes again
+func (cl *Collection) Unfreeze() {
+	atomic.StoreInt32(&cl.isFrozen, 0)
+}
+
+// IsFrozen tells whether the collection rejects writes, see Freeze
+func (cl *Collection) IsFrozen() bool {
+	return atomic.LoadInt32(&cl.isFrozen) != 0
+}
+
+func (cl *Collection) checkFrozen() error {
+	if cl.IsFrozen() {
+		return ErrCollectionIsFrozen
+	}
+	return nil
+}
+
+// beginWrite returns ErrCollectionIsFrozen if the collection is frozen. Otherwise, it returns the func that should be
+// called once the write is done, and until then Freeze waits for it.
+func (cl *Collection) beginWrite() (func(), error) {
+	cl.freezeLock.RLock()
+	err := cl.checkFrozen()
+	if err != nil {
+		cl.freezeLock.RUnlock()
+		return nil, err
+	}
+	return cl.freezeLock.RUnlock, nil
+}
@@ -0,0 +1,23 @@
+package collection
+
+import (
+	"github.com/teejays/gofiledb/util"
+)
+
+/********************************************************************************
+* F I L E  S Y S T E M
+*********************************************************************************/
+
+// SetFS makes the collection keep its files in fsys rather than in the local file system. It should be called before
+// the collection is used, and fsys should already have the files of the collection, if it has any.
+func (cl *Collection) SetFS(fsys util.FS) {
+	cl.fsys = fsys
+}
+
+// fs returns the file system that the files of the collection are in, see SetFS
+func (cl *Collection) fs() util.FS {
+	if cl.fsys == nil {
+		return util.OSFS{}
+	}
+	return cl.fsys
+}
@@ -0,0 +1,409 @@
+package collection
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+/********************************************************************************
+* D O C U M E N T  H E A D E R
+*********************************************************************************/
+
+// Every document file starts with a small uncompressed header which records how the rest of the file was stored. This
+// allows us to read a document correctly even if the EncodingType or EnableGzipCompression setting of the collection
+// has changed since it was written. Files written before headers were introduced don't have one, and are read using
+// the current settings of the collection.
+//
+// Layout: | magic (4 bytes) | version (1 byte) | encoding type (1 byte) | flags (1 byte) |
+const (
+	DOC_HEADER_MAGIC   string = "GFDB"
+	DOC_HEADER_VERSION byte   = 1
+	DOC_HEADER_LEN     int    = len(DOC_HEADER_MAGIC) + 3
+
+	docHeaderFlagGzip      byte = 1 << 0
+	docHeaderFlagEncrypted byte = 1 << 1
+)
+
+// ErrGzipIsIncomplete is the reason given for a gzipped document being corrupted when its gzip data stops before the
+// end of the gzip member, which is what an interrupted (torn) write leaves behind
+var ErrGzipIsIncomplete = fmt.Errorf("gzip data of the document is incomplete, probably because a write to it was interrupted")
+
+type docHeader struct {
+	EncodingType uint
+	IsGzipped    bool
+	IsEncrypted  bool
+}
+
+func (cl *Collection) newDocHeader() docHeader {
+	return docHeader{
+		EncodingType: cl.getEncodingType(),
+		IsGzipped:    cl.isGzipEnabled(),
+		IsEncrypted:  cl.isEncrypted(),
+	}
+}
+
+func (h docHeader) Bytes() []byte {
+	var flags byte
+	if h.IsGzipped {
+		flags |= docHeaderFlagGzip
+	}
+	if h.IsEncrypted {
+		flags |= docHeaderFlagEncrypted
+	}
+	b := []byte(DOC_HEADER_MAGIC)
+	return append(b, DOC_HEADER_VERSION, byte(h.EncodingType), flags)
+}
+
+// readDocHeader reads the header from r if there is one. If r doesn't start with a header (i.e. a legacy file), nothing
+// is consumed from r and false is returned.
+func readDocHeader(r *bufio.Reader) (docHeader, bool, error) {
+	var h docHeader
+
+	b, err := r.Peek(DOC_HEADER_LEN)
+	if err == io.EOF { // file is too short to have a header
+		return h, false, nil
+	}
+	if err != nil {
+		return h, false, err
+	}
+	if !bytes.Equal(b[:len(DOC_HEADER_MAGIC)], []byte(DOC_HEADER_MAGIC)) {
+		return h, false, nil
+	}
+
+	version := b[len(DOC_HEADER_MAGIC)]
+	if version != DOC_HEADER_VERSION {
+		return h, false, corruptionError{fmt.Errorf("unsupported document header version %d", version)}
+	}
+	h.EncodingType = uint(b[len(DOC_HEADER_MAGIC)+1])
+	h.IsGzipped = b[len(DOC_HEADER_MAGIC)+2]&docHeaderFlagGzip != 0
+	h.IsEncrypted = b[len(DOC_HEADER_MAGIC)+2]&docHeaderFlagEncrypted != 0
+
+	_, err = r.Discard(DOC_HEADER_LEN)
+	if err != nil {
+		return h, false, err
+	}
+
+	return h, true, nil
+}
+
+// docReader reads the (decompressed) data of a document, and closes all the underlying readers when closed
+type docReader struct {
+	io.Reader
+	closers      []io.Closer
+	decompressed bool          // whether Reader is a gzip reader
+	br           *bufio.Reader // the reader over src that the header was read from
+	file         util.File     // src, if it is a file
+}
+
+// Read marks errors caused by the compressed data being invalid as corruption, so that they can be told apart from
+// errors caused by e.g. the disk
+func (r *docReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if r.decompressed && isGzipCorruptionError(err) {
+		err = newGzipCorruptionError(err)
+	}
+	return n, err
+}
+
+// newGzipCorruptionError wraps err, which is from reading gzip data, as a corruptionError. Data that ends early is
+// reported as ErrGzipIsIncomplete.
+func newGzipCorruptionError(err error) corruptionError {
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return corruptionError{ErrGzipIsIncomplete}
+	}
+	return corruptionError{err}
+}
+
+func isGzipCorruptionError(err error) bool {
+	if err == gzip.ErrChecksum || err == gzip.ErrHeader || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(flate.CorruptInputError)
+	return ok
+}
+
+// Close closes the underlying readers. Some of them are given back to a pool when closed, so calling Close again does
+// nothing.
+// WriteTo is used by io.Copy. If the rest of the file is the document data as it is, it is copied from the file directly,
+// so that a dest like a net.Conn or an *os.File can use sendfile or copy_file_range rather than copying through
+// userspace buffers.
+func (r *docReader) WriteTo(w io.Writer) (int64, error) {
+	if r.file == nil || r.Reader != r.br {
+		// hide WriteTo from io.Copy, which would call it again
+		return io.Copy(w, struct{ io.Reader }{r})
+	}
+
+	// The bufio reader has read ahead of the header, so what it has buffered goes first
+	n, err := io.CopyN(w, r.br, int64(r.br.Buffered()))
+	if err != nil {
+		return n, err
+	}
+	m, err := io.Copy(w, r.file)
+	return n + m, err
+}
+
+func (r *docReader) Close() error {
+	var err error
+	// close in the reverse order of opening i.e. gzip reader before the file
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if _err := r.closers[i].Close(); _err != nil && err == nil {
+			err = _err
+		}
+	}
+	r.closers = nil
+	return err
+}
+
+// openDoc opens the document for k, and returns a reader positioned at the start of the document data. If decompress
+// is true, the data is gzip decompressed if needed. The returned docHeader describes how the document was stored.
+func (cl *Collection) openDoc(k key.Key, decompress bool) (docHeader, *docReader, error) {
+	// The IO slot is held until the reader is closed
+	release := cl.acquireIO()
+	h, r, err := cl.openDocUnlimited(k, decompress)
+	if err != nil {
+		release()
+		return h, nil, err
+	}
+	r.closers = append([]io.Closer{closerFunc(func() error { release(); return nil })}, r.closers...)
+	return h, r, nil
+}
+
+// openDocUnlimited does the work for openDoc, without waiting for an IO slot
+func (cl *Collection) openDocUnlimited(k key.Key, decompress bool) (docHeader, *docReader, error) {
+	if cl.isSegmented() {
+		return cl.openSegmentDoc(k, decompress)
+	}
+	file, err := cl.openExistingFile(k)
+	// the document may be cold (or have just been made cold), in which case it is read from the cold dir
+	if os.IsNotExist(err) && cl.mayHaveColdDocs() {
+		return cl.openColdDoc(k, decompress)
+	}
+	if err != nil {
+		return docHeader{}, nil, err
+	}
+	return cl.openDocFile(file, k, decompress)
+}
+
+// openDocFile is like openDoc, but for an already opened document file. The file is closed when the returned reader is
+// closed, or if there is an error.
+func (cl *Collection) openDocFile(file util.File, k key.Key, decompress bool) (docHeader, *docReader, error) {
+	return cl.openDocReader(file, file.Name(), k, decompress)
+}
+
+// openDocReader is like openDocFile, but reads the document file content from src. fileName is the name of the file
+// the content is from, which is needed to read legacy files.
+func (cl *Collection) openDocReader(src io.ReadCloser, fileName string, k key.Key, decompress bool) (docHeader, *docReader, error) {
+	var h docHeader
+
+	br := getBufioReader(src)
+	r := &docReader{closers: []io.Closer{src, closerFunc(func() error { putBufioReader(br); return nil })}, br: br}
+	if file, ok := src.(util.File); ok {
+		r.file = file
+	}
+
+	h, hasHeader, err := readDocHeader(br)
+	if err != nil {
+		r.Close()
+		return h, nil, err
+	}
+	if !hasHeader {
+		// legacy file: assume the current encoding, and rely on the file name to tell whether it is gzipped
+		h = cl.newDocHeader()
+		h.IsGzipped = strings.HasSuffix(fileName, key.GZIP_FILE_EXTENSION)
+	}
+	r.Reader = br
+
+	// Encrypted data can only be authenticated once it has all been read, so there is no streaming here
+	if h.IsEncrypted {
+		buf := getBuffer()
+		_, err := io.Copy(buf, br)
+		if err != nil {
+			putBuffer(buf)
+			r.Close()
+			return h, nil, err
+		}
+		plaintext, err := cl.decrypt(buf.Bytes(), docAdditionalData(h, k))
+		putBuffer(buf)
+		if err != nil {
+			r.Close()
+			return h, nil, err
+		}
+		r.Reader = bytes.NewReader(plaintext)
+	}
+
+	if h.IsGzipped && decompress {
+		gz, err := getGzipReader(r.Reader)
+		if err != nil {
+			r.Close()
+			return h, nil, newGzipCorruptionError(err)
+		}
+		r.Reader = gz
+		r.closers = append(r.closers, closerFunc(func() error { return putGzipReader(gz) }))
+		r.decompressed = true
+	}
+
+	return h, r, nil
+}
+
+// AddMissingHeaders gives the legacy document files of the collection a header, so that they keep being read the same
+// way if EncodingType or EnableGzipCompression is changed. The header records what the file is read as without one: the
+// current encoding, and whether it is gzipped going by its name. It returns the number of files that were rewritten.
+func (cl *Collection) AddMissingHeaders() (int, error) {
+	// segments were introduced after headers, so all their records have one
+	if cl.isSegmented() {
+		return 0, nil
+	}
+
+	var n int
+	err := cl.forEachDoc(func(k key.Key, docPath string) error {
+		// cold files were introduced after headers as well, and have the whole document file in them
+		if strings.HasSuffix(docPath, COLD_FILE_EXTENSION) {
+			return nil
+		}
+		added, err := cl.addMissingHeader(k, docPath)
+		if err != nil {
+			return err
+		}
+		if added {
+			n++
+		}
+		return nil
+	})
+	if n > 0 { // the files are not the same size anymore
+		cl.dropStats()
+	}
+	return n, err
+}
+
+// addMissingHeader rewrites the document file at docPath with a header, if it doesn't have one yet
+func (cl *Collection) addMissingHeader(k key.Key, docPath string) (bool, error) {
+	defer cl.lockKey(k)()
+
+	data, err := util.ReadFile(cl.fs(), docPath)
+	if os.IsNotExist(err) { // deleted since it was listed
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, hasHeader, err := readDocHeader(bufio.NewReader(bytes.NewReader(data)))
+	if _, ok := err.(corruptionError); ok { // left for Verify and the quarantine to deal with
+		return false, nil
+	}
+	if err != nil || hasHeader {
+		return false, err
+	}
+
+	h := cl.newDocHeader()
+	h.IsGzipped = strings.HasSuffix(docPath, key.GZIP_FILE_EXTENSION)
+	err = cl.writeFile(docPath, append(h.Bytes(), data...))
+	if err != nil {
+		return false, err
+	}
+	return true, cl.refreshManifestEntry(k)
+}
+
+// ErrStoredFileDataHasNoHeader is returned by SetStoredFileData for data that doesn't start with a document header
+var ErrStoredFileDataHasNoHeader = fmt.Errorf("Stored document file data does not start with a document header")
+
+// GetStoredFileData returns the file content of the document for k as it is stored: the header followed by the data,
+// still compressed and encrypted if it is. It is meant for copying documents elsewhere without their plaintext, see
+// SetStoredFileData, so unlike GetFileData it isn't counted as a read. A legacy file is given a header.
+func (cl *Collection) GetStoredFileData(k key.Key) ([]byte, error) {
+	cl.waitForWrites(k)
+	fileName, fileData, err := cl.readDocFile(k)
+	if err != nil {
+		return nil, err
+	}
+	_, hasHeader, err := readDocHeader(bufio.NewReader(bytes.NewReader(fileData)))
+	if err != nil || hasHeader {
+		return fileData, err
+	}
+	h := cl.newDocHeader()
+	h.IsGzipped = strings.HasSuffix(fileName, key.GZIP_FILE_EXTENSION)
+	return append(h.Bytes(), fileData...), nil
+}
+
+// SetStoredFileData writes fileData, as returned by GetStoredFileData, as the document for k, byte for byte. The data is
+// read first to make sure that the collection can read it, e.g. that it is encrypted with its EncryptionKey, for k.
+func (cl *Collection) SetStoredFileData(k key.Key, fileData []byte) error {
+	if err := cl.checkFrozen(); err != nil {
+		return err
+	}
+	// The write shouldn't be overwritten by the writes that are still queued
+	cl.waitForWrites(k)
+	err := cl.setStoredFileDataLocked(k, fileData)
+	if err != nil {
+		return err
+	}
+	return cl.evict(k)
+}
+
+// setStoredFileDataLocked does the work for SetStoredFileData, while holding the key lock for k
+func (cl *Collection) setStoredFileDataLocked(k key.Key, fileData []byte) error {
+	defer cl.lockKey(k)()
+
+	_, hasHeader, err := readDocHeader(bufio.NewReader(bytes.NewReader(fileData)))
+	if err != nil {
+		return err
+	}
+	if !hasHeader {
+		return ErrStoredFileDataHasNoHeader
+	}
+	_, r, err := cl.openDocReader(ioutil.NopCloser(bytes.NewReader(fileData)), "", k, true)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	err = cl.setFileData(k, fileData, AUDIT_OP_SET)
+	if err != nil {
+		return err
+	}
+	err = cl.setExpiry(k, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	cl.notifyChange(AUDIT_OP_SET, k)
+	return cl.audit(AUDIT_OP_SET, k, data)
+}
+
+// checkGzipFooter makes sure that gzData, the gzip compressed form of data, ends with a complete footer that matches
+// data. This catches a gzip writer that wasn't fully flushed before the document is written.
+func checkGzipFooter(gzData []byte, data []byte) error {
+	// the footer is the crc32 of the data followed by its size mod 2^32, both little endian
+	if len(gzData) < gzipMinLen {
+		return fmt.Errorf("gzip data is too short (%d bytes) to be complete", len(gzData))
+	}
+	footer := gzData[len(gzData)-gzipFooterLen:]
+	if binary.LittleEndian.Uint32(footer[0:4]) != crc32.ChecksumIEEE(data) || binary.LittleEndian.Uint32(footer[4:8]) != uint32(len(data)) {
+		return fmt.Errorf("gzip footer does not match the data that was compressed")
+	}
+	return nil
+}
+
+const gzipFooterLen int = 8
+const gzipMinLen int = 10 + gzipFooterLen // header + footer
+
+// docAdditionalData is the data that is authenticated along with an encrypted document, so that the encrypted data
+// can't be moved to another document or have its header altered
+func docAdditionalData(h docHeader, k key.Key) []byte {
+	return append(h.Bytes(), []byte(k.String())...)
+}
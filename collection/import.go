@@ -0,0 +1,322 @@
+package collection
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+)
+
+/********************************************************************************
+* I M P O R T I N G
+*********************************************************************************/
+
+// Documents can be loaded into a collection in bulk, in one of the IMPORT_FORMAT_ formats:
+//
+// - IMPORT_FORMAT_JSONL reads a JSON document per line.
+// - IMPORT_FORMAT_CSV reads a document per record. The first record has the field names, and values that look like
+//   integers, numbers or booleans are read as such (as long as they are written the way JSON would write them, so that
+//   e.g. "007" stays a string).
+// - IMPORT_FORMAT_EXPORT_JSONL reads the ExportRecords written by Export with EXPORT_FORMAT_JSONL, keys included.
+//
+// Documents are converted to the encoding of the collection, which needs the type of the documents for ENCODING_GOB.
+// The key of a document is taken from the field at ImportOptions.KeyField, or generated otherwise: generated keys
+// follow on from the largest key in the collection when the import starts. Rows that can't be imported are reported in
+// ImportResult.Errors, and the import goes on with the next row. Index changes are batched until the import is done.
+
+const (
+	IMPORT_FORMAT_JSONL uint = iota
+	IMPORT_FORMAT_CSV
+	IMPORT_FORMAT_EXPORT_JSONL
+)
+
+var ErrInvalidImportFormat = fmt.Errorf("Invalid import format")
+var ErrImportKeyIsMissing = fmt.Errorf("The document does not have an integer value for the key field")
+var ErrImportDocIsNotObject = fmt.Errorf("The document is not a JSON object")
+
+type (
+	ImportOptions struct {
+		Format   uint   // one of the IMPORT_FORMAT_ constants
+		KeyField string // field locator of the key of the documents, if empty, keys are generated
+		// if provided, documents are decoded into the value it returns (which should be a pointer) before being encoded
+		// with the encoding of the collection. It is required for ENCODING_GOB.
+		NewDoc func() interface{}
+	}
+
+	ImportResult struct {
+		NumImported int
+		Errors      []ImportError
+	}
+
+	// ImportError is the error for a row that could not be imported
+	ImportError struct {
+		Line int // the line the row starts at, starting at 1
+		Err  error
+	}
+
+	// importRow is a document read by an import
+	importRow struct {
+		line    int
+		k       key.Key
+		hasKey  bool
+		jsonDoc []byte                 // the document as JSON, if it is one
+		doc     map[string]interface{} // the document as generic values, if it is one
+		data    []byte                 // otherwise, the data of the document as it is to be stored
+	}
+)
+
+func (e ImportError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+// Import writes the documents read from r into the collection, as per opts. It only returns an error if r can't be
+// read, or opts are invalid: rows that can't be imported are reported in the result.
+func (cl *Collection) Import(r io.Reader, opts ImportOptions) (ImportResult, error) {
+	var result ImportResult
+
+	var readRows func(fn func(row importRow, err error) error) error
+	switch opts.Format {
+	case IMPORT_FORMAT_JSONL, IMPORT_FORMAT_EXPORT_JSONL:
+		readRows = func(fn func(row importRow, err error) error) error { return readJSONLRows(r, opts.Format, fn) }
+	case IMPORT_FORMAT_CSV:
+		readRows = func(fn func(row importRow, err error) error) error { return readCSVRows(r, fn) }
+	default:
+		return result, ErrInvalidImportFormat
+	}
+	if cl.getEncodingType() == ENCODING_GOB && opts.NewDoc == nil {
+		return result, ErrReencodeNotSupported
+	}
+
+	var nextKey key.Key
+	if opts.KeyField == "" && opts.Format != IMPORT_FORMAT_EXPORT_JSONL {
+		maxKey, err := cl.getMaxKey()
+		if err != nil {
+			return result, err
+		}
+		nextKey = maxKey + 1
+	}
+
+	endBulkLoad := cl.BeginBulkLoad()
+	err := readRows(func(row importRow, err error) error {
+		if err == nil {
+			err = cl.importRow(row, opts, &nextKey)
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, ImportError{row.line, err})
+			return nil
+		}
+		result.NumImported++
+		return nil
+	})
+	if fErr := endBulkLoad(); err == nil {
+		err = fErr
+	}
+	return result, err
+}
+
+// importRow writes the document of row into the collection. If it needs a generated key, it gets nextKey, which is then
+// moved on.
+func (cl *Collection) importRow(row importRow, opts ImportOptions, nextKey *key.Key) error {
+	if row.doc != nil && opts.KeyField != "" {
+		row.k, row.hasKey = getImportKey(row.doc, opts.KeyField)
+		if !row.hasKey {
+			return ErrImportKeyIsMissing
+		}
+	}
+	if !row.hasKey {
+		row.k = *nextKey
+		*nextKey++
+	}
+
+	data := row.data
+	if data == nil {
+		var err error
+		data, err = cl.encodeImportedDoc(row, opts.NewDoc)
+		if err != nil {
+			return err
+		}
+	}
+	return cl.Set(row.k, data)
+}
+
+// readJSONLRows reads the rows of a IMPORT_FORMAT_JSONL or IMPORT_FORMAT_EXPORT_JSONL import from r, and calls fn for
+// each of them, along with the error if it could not be parsed
+func readJSONLRows(r io.Reader, format uint, fn func(row importRow, err error) error) error {
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(bytes.TrimSpace(b)) > 0 {
+			row, pErr := parseJSONLRow(b, format)
+			row.line = line
+			fErr := fn(row, pErr)
+			if fErr != nil {
+				return fErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// parseJSONLRow parses b, a line of a IMPORT_FORMAT_JSONL or IMPORT_FORMAT_EXPORT_JSONL import
+func parseJSONLRow(b []byte, format uint) (importRow, error) {
+	var row importRow
+	if format == IMPORT_FORMAT_EXPORT_JSONL {
+		var r ExportRecord
+		err := json.Unmarshal(b, &r)
+		if err != nil {
+			return row, err
+		}
+		row.k, row.hasKey = r.Key, true
+		if r.Doc == nil {
+			row.data = r.Data
+			if row.data == nil {
+				row.data = []byte{}
+			}
+			return row, nil
+		}
+		b = r.Doc
+	}
+
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	err := dec.Decode(&doc)
+	if err == nil && doc == nil {
+		err = ErrImportDocIsNotObject
+	}
+	if err != nil {
+		return row, err
+	}
+	var buf bytes.Buffer
+	err = json.Compact(&buf, b)
+	if err != nil {
+		return row, err
+	}
+	row.jsonDoc = buf.Bytes()
+	row.doc = normalizeValue(doc).(map[string]interface{})
+	return row, nil
+}
+
+// readCSVRows reads the rows of a IMPORT_FORMAT_CSV import from r, and calls fn for each of them, along with the error
+// if it could not be parsed
+func readCSVRows(r io.Reader, fn func(row importRow, err error) error) error {
+	cr := csv.NewReader(r)
+	fieldNames, err := cr.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if pErr, ok := err.(*csv.ParseError); ok { // including records with the wrong number of fields
+			fErr := fn(importRow{line: pErr.StartLine}, pErr.Err)
+			if fErr != nil {
+				return fErr
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := cr.FieldPos(0)
+
+		row := importRow{line: line, doc: make(map[string]interface{}, len(fieldNames))}
+		for i, name := range fieldNames {
+			row.doc[name] = parseCSVValue(record[i])
+		}
+		row.jsonDoc, err = json.Marshal(row.doc)
+		err = fn(row, err)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseCSVValue returns the value that s, a field of a IMPORT_FORMAT_CSV import, stands for
+func parseCSVValue(s string) interface{} {
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(n, 10) == s {
+		return n
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && json.Valid([]byte(s)) {
+		return f
+	}
+	return s
+}
+
+// getImportKey returns the value of the field at fieldLocator of doc, as a key
+func getImportKey(doc map[string]interface{}, fieldLocator string) (key.Key, bool) {
+	values, err := util.GetNestedFieldValuesOfStruct(doc, fieldLocator)
+	if err != nil || len(values) != 1 || !values[0].CanInterface() {
+		return 0, false
+	}
+	v := reflect.ValueOf(values[0].Interface())
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return key.Key(v.Int()), true
+	case reflect.Float32, reflect.Float64:
+		if f := v.Float(); f == float64(int64(f)) {
+			return key.Key(int64(f)), true
+		}
+	}
+	return 0, false
+}
+
+// encodeImportedDoc returns the data of the document of row, encoded with the encoding of the collection
+func (cl *Collection) encodeImportedDoc(row importRow, newDoc func() interface{}) ([]byte, error) {
+	encodingType := cl.getEncodingType()
+	if newDoc != nil && encodingType != ENCODING_NONE {
+		v := newDoc()
+		err := json.Unmarshal(row.jsonDoc, v)
+		if err != nil {
+			return nil, err
+		}
+		return encode(encodingType, v)
+	}
+
+	switch encodingType {
+	case ENCODING_JSON, ENCODING_NONE:
+		return row.jsonDoc, nil
+	case ENCODING_GOB:
+		return nil, ErrReencodeNotSupported
+	}
+	return encode(encodingType, row.doc)
+}
+
+// getMaxKey returns the largest key in the collection, or 0 if it has no documents
+func (cl *Collection) getMaxKey() (key.Key, error) {
+	var maxKey key.Key
+	err := cl.forEachDoc(func(k key.Key, docPath string) error {
+		if k > maxKey {
+			maxKey = k
+		}
+		return nil
+	})
+	if os.IsNotExist(err) { // no documents have been written yet
+		return 0, nil
+	}
+	return maxKey, err
+}
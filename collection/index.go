@@ -2,14 +2,15 @@ package collection
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
-	"github.com/teejays/clog"
 	"github.com/teejays/gofiledb/key"
 	"github.com/teejays/gofiledb/util"
-	"os"
 	"reflect"
+	"sync"
+	"sync/atomic"
 )
 
 type (
@@ -35,9 +36,11 @@ type (
 
 // CollectionStore has issues when being encoded into Gob, because of the sync.RWMutex
 // Therefore, we need to define our own GobEncode/GobDecode functions for it.
-func (s IndexStore) GobEncode() ([]byte, error) {
+func (s *IndexStore) GobEncode() ([]byte, error) {
 
+	s.RLock()
 	_s := IndexStoreGobFriendly{s.Store}
+	s.RUnlock()
 	// for _, i := range _s.Store {
 	// 	i.Collection = nil
 	// }
@@ -52,7 +55,7 @@ func (s *IndexStore) GobDecode(b []byte) error {
 
 	buff := bytes.NewBuffer(b)
 	dec := gob.NewDecoder(buff)
-	err := dec.Decode(_s)
+	err := dec.Decode(&_s)
 	if err != nil {
 		return err
 	}
@@ -60,6 +63,10 @@ func (s *IndexStore) GobDecode(b []byte) error {
 	return nil
 }
 
+// INDEX_BUILD_MAX_WORKERS is the max number of partitions that are read in parallel when an index is built. Building an
+// index is mostly waiting on reads, so this can be more than the number of CPUs.
+const INDEX_BUILD_MAX_WORKERS int = 8
+
 var ErrIndexIsExist error = fmt.Errorf("Index already exists")
 var ErrIndexIsNotExist error = fmt.Errorf("Index does not exist")
 var ErrIndexHasNoCollection error = fmt.Errorf("Index has no linked parent collection")
@@ -86,76 +93,146 @@ func (idx *Index) getCollection() (*Collection, error) {
 	return idx.cl, nil
 }
 
-// build builds an index from scratch, going through all the documents one by one.
-func (idx *Index) build() error {
-	clog.Debugf("Building index for '%s' collection at field: %s", idx.CollectionName, idx.FieldLocator)
+// build builds an index from scratch, going through all the documents of the collection. The partitions are processed
+// in parallel by up to INDEX_BUILD_MAX_WORKERS workers, each of which builds a partial index for the partition, and the
+// partial indexes are then merged into idx. The build stops with ctx.Err() as soon as ctx is done.
+func (idx *Index) build(ctx context.Context) error {
+	util.Debugf("Building index for '%s' collection at field: %s", idx.CollectionName, idx.FieldLocator)
 
 	cl, err := idx.getCollection()
 	if err != nil {
 		return err
 	}
 
-	// where are all the documents that need to be added?
-	dataPath := cl.getDataPath()
+	// Documents in segments are not split by partition, so they are all read by one worker
+	if cl.isSegmented() {
+		partial, err := idx.buildFrom(ctx, cl.forEachDoc)
+		if err != nil {
+			return err
+		}
+		return idx.merge(partial)
+	}
 
-	// open the data dir, which has all the partition dirs
-	dataDir, err := os.Open(dataPath)
+	pDirPaths, err := cl.getPartitionDirPaths()
 	if err != nil {
 		return err
 	}
-	defer dataDir.Close()
 
-	// get all the names of the partition dirs so we can open them
-	partitionDirNames, err := dataDir.Readdirnames(-1)
-	if err != nil {
-		return err
+	numWorkers := INDEX_BUILD_MAX_WORKERS
+	if len(pDirPaths) < numWorkers {
+		numWorkers = len(pDirPaths)
 	}
 
-	// for each partition dir, open it, make sures it's a Dir, and get all the files within it.
-	for _, pDirName := range partitionDirNames {
+	// partials[i] and errs[i] are for pDirPaths[i], so the merge happens in the same order regardless of which worker
+	// finishes first
+	var partials []*Index = make([]*Index, len(pDirPaths))
+	var errs []error = make([]error, len(pDirPaths))
+	var failed int32
+
+	var jobs chan int = make(chan int, len(pDirPaths))
+	for i := range pDirPaths {
+		jobs <- i
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				// no need to go on once a partition has failed, since the whole build fails
+				if atomic.LoadInt32(&failed) != 0 {
+					return
+				}
+				partials[i], errs[i] = idx.buildPartition(ctx, pDirPaths[i])
+				if errs[i] != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
 
-		pDirPath := util.JoinPath(dataPath, pDirName)
-		fileInfo, err := os.Stat(pDirPath)
+	for _, err := range errs {
 		if err != nil {
 			return err
 		}
-		if !fileInfo.IsDir() {
-			clog.Warnf("%s: not a directory", pDirPath)
-			continue
-		}
+	}
 
-		pDir, err := os.Open(pDirPath)
+	for _, partial := range partials {
+		err = idx.merge(partial)
 		if err != nil {
 			return err
 		}
-		defer pDir.Close()
+	}
 
-		docNames, err := pDir.Readdirnames(-1)
+	// Cold documents are not in any partition dir, so they are read separately
+	if cl.mayHaveColdDocs() {
+		partial, err := idx.buildFrom(ctx, cl.forEachColdDoc)
 		if err != nil {
 			return err
 		}
+		return idx.merge(partial)
+	}
+
+	return nil
+}
 
-		// open each of the doc, and add it to index
-		for _, docName := range docNames {
+// buildPartition builds a new index, for the same field as idx, with just the documents in the partition dir at pDirPath
+func (idx *Index) buildPartition(ctx context.Context, pDirPath string) (*Index, error) {
+	return idx.buildFrom(ctx, func(fn func(k key.Key, docPath string) error) error {
+		return idx.cl.forEachDocInPartitionDir(pDirPath, fn)
+	})
+}
 
-			docPath := util.JoinPath(pDirPath, docName)
+// buildFrom builds a new index, for the same field as idx, with the documents that forEach goes through
+func (idx *Index) buildFrom(ctx context.Context, forEach func(fn func(k key.Key, docPath string) error) error) (*Index, error) {
+	partial := idx.cl.NewIndex(idx.FieldLocator)
 
-			k, err := key.GetKeyFromFileName(docName)
-			if err != nil {
-				return err
-			}
-			err = idx.addDoc(k, docPath)
-			if err != nil {
-				return err
-			}
+	err := forEach(func(k key.Key, docPath string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := partial.addDoc(ctx, k, docPath)
+		if err == ErrDocumentIsCorrupted { // it has been quarantined, so it doesn't belong in the index
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return partial, nil
+}
+
+// merge adds all the data in the partial index to idx. The partial index should not have any keys that are in idx.
+func (idx *Index) merge(partial *Index) error {
+	if partial.FieldType != "" {
+		if idx.FieldType == "" {
+			idx.FieldType = partial.FieldType
 		}
+		if idx.FieldType != partial.FieldType {
+			return fmt.Errorf("Field locator %s corresponds to more than one data type. Cannot create an index.", idx.FieldLocator)
+		}
+	}
+
+	for k, values := range partial.KeyValues {
+		idx.KeyValues[k] = values
+	}
+	for v, keys := range partial.ValueKeys {
+		idx.ValueKeys[v] = append(idx.ValueKeys[v], keys...)
 	}
 
+	idx.NumValues = len(idx.ValueKeys)
+
 	return nil
 }
+
 func (idx *Index) addDocDir(path string) error {
 
-	fileInfo, err := os.Stat(path)
+	fileInfo, err := idx.cl.fs().Stat(path)
 	if err != nil {
 		return err
 	}
@@ -163,7 +240,7 @@ func (idx *Index) addDocDir(path string) error {
 		return fmt.Errorf("directory not found at %s", path)
 	}
 
-	pDir, err := os.Open(path)
+	pDir, err := idx.cl.fs().Open(path)
 	if err != nil {
 		return err
 	}
@@ -191,7 +268,7 @@ func (idx *Index) addDocDir(path string) error {
 			return err
 		}
 
-		err = idx.addDoc(k, docPath)
+		err = idx.addDoc(context.Background(), k, docPath)
 		if err != nil {
 			return err
 		}
@@ -199,8 +276,8 @@ func (idx *Index) addDocDir(path string) error {
 
 	return nil
 }
-func (idx *Index) addDoc(k key.Key, path string) error {
-	clog.Debugf("Adding document to %s collection in %s index: %s", idx.CollectionName, idx.FieldLocator, k)
+func (idx *Index) addDoc(ctx context.Context, k key.Key, path string) error {
+	util.Debugf("Adding document to %s collection in %s index: %s", idx.CollectionName, idx.FieldLocator, k)
 	// Get Collection
 
 	cl, err := idx.getCollection()
@@ -208,15 +285,15 @@ func (idx *Index) addDoc(k key.Key, path string) error {
 		return err
 	}
 
-	// Ensure that collection is for JSON
-	if cl.EncodingType != ENCODING_JSON {
-		return fmt.Errorf("Indexing only supported for JSON encoded data")
+	// Ensure that collection data can be decoded into a map
+	if !cl.canIndex() {
+		return ErrIndexNotSupported
 	}
 
 	// Get the file from collection into a map[string]interface
 	var data map[string]interface{}
 
-	err = cl.GetIntoStruct(k, &data)
+	err = cl.getIntoStruct(ctx, k, &data)
 	if err != nil {
 		return err
 	}
@@ -233,15 +310,7 @@ func (idx *Index) addDoc(k key.Key, path string) error {
 func (idx *Index) addData(k key.Key, data map[string]interface{}) error {
 
 	// Remove the existing data in the index for this Key
-	// Remove the data from the ValueKeys map
-	oldValues := idx.KeyValues[k]
-	for _, v := range oldValues {
-		for i, _k := range idx.ValueKeys[v] {
-			if _k == k {
-				idx.ValueKeys[v] = append(idx.ValueKeys[v][:i], idx.ValueKeys[v][i+1:]...)
-			}
-		}
-	}
+	idx.removeKey(k)
 	// Reset the KeyValues Map for k
 	idx.KeyValues[k] = []string{}
 
@@ -256,7 +325,7 @@ func (idx *Index) addData(k key.Key, data map[string]interface{}) error {
 	for _, v := range values {
 		// Todo: make sure that the values are hashable (i.e. string, int, float etc. and not map, channels etc.)?
 		if v.CanInterface() {
-			v_i := v.Interface()
+			v_i := normalizeIndexValue(v.Interface())
 			v_str := fmt.Sprintf("%v", v_i)
 
 			// theoretically, values that correspond to the provided field locator could be of different types
@@ -281,8 +350,46 @@ func (idx *Index) addData(k key.Key, data map[string]interface{}) error {
 	return nil
 }
 
+// removeKey removes all the entries for the document k from the index
+func (idx *Index) removeKey(k key.Key) {
+
+	// Remove the data from the ValueKeys map
+	for _, v := range idx.KeyValues[k] {
+		var keys []key.Key
+		for _, _k := range idx.ValueKeys[v] {
+			if _k != k {
+				keys = append(keys, _k)
+			}
+		}
+		if len(keys) == 0 {
+			delete(idx.ValueKeys, v)
+		} else {
+			idx.ValueKeys[v] = keys
+		}
+	}
+	delete(idx.KeyValues, k)
+
+	idx.NumValues = len(idx.ValueKeys)
+}
+
+// normalizeIndexValue converts all numeric values into float64. Different encodings decode numbers into different
+// types (e.g. JSON always gives float64, while MessagePack picks the smallest int type that fits), but the index should
+// treat 500 the same regardless of how it was stored.
+func normalizeIndexValue(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint())
+	case reflect.Float32:
+		return rv.Float()
+	}
+	return v
+}
+
 func (idx *Index) save() error {
-	clog.Debugf("Saving Index for %s collection on %s field", idx.CollectionName, idx.FieldLocator)
+	util.Debugf("Saving Index for %s collection on %s field", idx.CollectionName, idx.FieldLocator)
 
 	// Save the index file.. but first json encode it
 	idxJson, err := json.Marshal(idx)
@@ -290,7 +397,24 @@ func (idx *Index) save() error {
 		return err
 	}
 
-	idxFile, err := os.Create(idx.FilePath)
+	if idx.cl != nil && idx.cl.shouldEncryptIndexes() {
+		encryptionKey, _ := idx.cl.getEncryptionKeys()
+		idxJson, err = seal(encryptionKey, idxJson, []byte(idx.FieldLocator))
+		if err != nil {
+			return err
+		}
+	}
+
+	if idx.cl != nil {
+		err = idx.cl.writeFile(idx.FilePath, idxJson)
+		if err != nil {
+			return err
+		}
+		idx.cl.setCachedIndex(idx)
+		return nil
+	}
+
+	idxFile, err := util.Create(idx.cl.fs(), idx.FilePath)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,216 @@
+package collection
+
+import (
+	"github.com/teejays/gofiledb/util"
+	"sync/atomic"
+	"time"
+)
+
+/********************************************************************************
+* I N D E X  B A T C H I N G
+*********************************************************************************/
+
+// By default, every document write loads, changes and saves each index of the collection, which makes index IO the
+// bulk of the cost of a write. With IndexFlushOps or IndexFlushInterval set, the changed indexes are instead kept in
+// memory and saved once every IndexFlushOps writes, or every IndexFlushInterval, whichever comes first.
+//
+// Searches see the in-memory version of the indexes, so batching doesn't change what a query returns. What changes is
+// the recovery window: the WAL or index journal entries of the batched writes are only committed once the batch has
+// been flushed, so after a crash, Recover replays (or reindexes) the writes of the last unflushed batch.
+//
+// Index changes are also batched while a bulk load is in progress (see BeginBulkLoad), whatever the props say.
+
+const DEFAULT_INDEX_FLUSH_INTERVAL time.Duration = time.Second
+
+// indexBatch holds the indexes that have been changed by document writes but not saved yet. It is guarded by
+// indexWriteLock of the collection.
+type indexBatch struct {
+	indexes map[string]*Index // field locator -> changed index
+	numOps  int               // number of document writes since the last flush
+	commits []walCommit       // log entries to commit once the batch is flushed
+	stop    chan struct{}
+}
+
+// walCommit is an entry of a WAL (or index journal) that can only be committed once the indexes have been flushed
+type walCommit struct {
+	w   *wal
+	seq uint64
+}
+
+// isIndexBatched tells whether index changes are batched in memory, rather than saved by every write
+func (cl *Collection) isIndexBatched() bool {
+	return cl.IndexFlushOps > 0 || cl.IndexFlushInterval > 0 || atomic.LoadInt32(&cl.numBulkLoads) > 0
+}
+
+// BeginBulkLoad batches the index changes of all the writes to the collection until the returned func is called, which
+// saves them. This saves loading and saving every index for each write when a lot of documents are written at once.
+func (cl *Collection) BeginBulkLoad() func() error {
+	atomic.AddInt32(&cl.numBulkLoads, 1)
+	return func() error {
+		atomic.AddInt32(&cl.numBulkLoads, -1)
+		if cl.isIndexBatched() {
+			return cl.FlushIndexes()
+		}
+		return cl.closeIndexBatch()
+	}
+}
+
+// getIndexBatch returns the current batch, creating it (and starting the background flusher) if needed. It should be
+// called while holding indexWriteLock.
+func (cl *Collection) getIndexBatch() *indexBatch {
+	if cl.indexBatch != nil {
+		return cl.indexBatch
+	}
+
+	interval := cl.IndexFlushInterval
+	if interval <= 0 {
+		interval = DEFAULT_INDEX_FLUSH_INTERVAL
+	}
+	b := &indexBatch{
+		indexes: make(map[string]*Index),
+		stop:    make(chan struct{}),
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := cl.FlushIndexes(); err != nil {
+					util.Warnf("Error while flushing the indexes of collection %s in the background: %s", cl.Name, err)
+				}
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+
+	cl.indexBatch = b
+	return b
+}
+
+// loadIndexForWrite returns the index on fieldLocator for a document write to change. If the index has changes that
+// haven't been flushed yet, that is the in-memory version. It should be called while holding indexWriteLock.
+func (cl *Collection) loadIndexForWrite(fieldLocator string) (*Index, error) {
+	if cl.indexBatch != nil {
+		if idx, ok := cl.indexBatch.indexes[fieldLocator]; ok {
+			return idx, nil
+		}
+	}
+
+	idx, err := cl.loadIndex(fieldLocator)
+	if err != nil {
+		return nil, err
+	}
+	return &idx, nil
+}
+
+// saveIndexForWrite saves idx once a document write has changed it, or adds it to the current batch if index changes
+// are batched. It should be called while holding indexWriteLock.
+func (cl *Collection) saveIndexForWrite(idx *Index) error {
+	if !cl.isIndexBatched() {
+		return idx.save()
+	}
+
+	cl.getIndexBatch().indexes[idx.FieldLocator] = idx
+	cl.uncacheIndex(idx.FieldLocator)
+	return nil
+}
+
+// endIndexWrite counts a document write in the current batch, and flushes the batch once it has IndexFlushOps writes.
+// It should be called while holding indexWriteLock.
+func (cl *Collection) endIndexWrite() error {
+	if cl.indexBatch == nil {
+		return nil
+	}
+
+	cl.indexBatch.numOps++
+	if cl.IndexFlushOps > 0 && cl.indexBatch.numOps >= cl.IndexFlushOps {
+		return cl.flushIndexBatch()
+	}
+	return nil
+}
+
+// commitAfterIndexFlush commits the entry seq of w, which logs a document write, once the index changes of the write
+// are on disk. If they are still in the current batch, the commit waits for the batch to be flushed.
+func (cl *Collection) commitAfterIndexFlush(w *wal, seq uint64) error {
+	// The batch is checked even if index changes aren't batched anymore, since a bulk load may have just ended
+	cl.indexWriteLock.Lock()
+	defer cl.indexWriteLock.Unlock()
+
+	if cl.indexBatch != nil && len(cl.indexBatch.indexes) > 0 {
+		cl.indexBatch.commits = append(cl.indexBatch.commits, walCommit{w, seq})
+		return nil
+	}
+
+	return w.commit(seq)
+}
+
+// FlushIndexes saves all the index changes that are batched in memory, and commits the log entries of the writes that
+// made them. It is a no-op unless IndexFlushOps or IndexFlushInterval is set.
+func (cl *Collection) FlushIndexes() error {
+	cl.indexWriteLock.Lock()
+	defer cl.indexWriteLock.Unlock()
+	return cl.flushIndexBatch()
+}
+
+// flushIndexBatch does the work for FlushIndexes. It should be called while holding indexWriteLock.
+func (cl *Collection) flushIndexBatch() error {
+	b := cl.indexBatch
+	if b == nil {
+		return nil
+	}
+
+	// An index is only removed from the batch once it is saved, so that a failed flush can be retried
+	for fieldLocator, idx := range b.indexes {
+		err := idx.save()
+		if err != nil {
+			return err
+		}
+		delete(b.indexes, fieldLocator)
+	}
+
+	for _, c := range b.commits {
+		err := c.w.commit(c.seq)
+		if err != nil {
+			return err
+		}
+	}
+	b.commits = nil
+	b.numOps = 0
+
+	return nil
+}
+
+// closeIndexBatch flushes the current batch and stops the background flusher
+func (cl *Collection) closeIndexBatch() error {
+	cl.indexWriteLock.Lock()
+	defer cl.indexWriteLock.Unlock()
+
+	err := cl.flushIndexBatch()
+	if err != nil {
+		return err
+	}
+	if cl.indexBatch != nil {
+		close(cl.indexBatch.stop)
+		cl.indexBatch = nil
+	}
+	return nil
+}
+
+// getBatchedIndexCompact returns a compacted copy of the in-memory version of the index on fieldLocator, if it has
+// changes that haven't been flushed yet. Searches use it instead of the index file, which would be out of date.
+func (cl *Collection) getBatchedIndexCompact(fieldLocator string) (*compactIndex, bool) {
+	cl.indexWriteLock.Lock()
+	defer cl.indexWriteLock.Unlock()
+
+	if cl.indexBatch == nil {
+		return nil, false
+	}
+	idx, ok := cl.indexBatch.indexes[fieldLocator]
+	if !ok {
+		return nil, false
+	}
+	return idx.compact(), true
+}
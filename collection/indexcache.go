@@ -0,0 +1,83 @@
+package collection
+
+/********************************************************************************
+* I N D E X  C A C H E
+*********************************************************************************/
+
+// Searches read the indexes they need from the index cache of the collection rather than from disk, so that queries on
+// a collection that isn't changing don't need any index file IO. An index is added to the cache the first time it is
+// needed by a search, and replaced whenever it is saved.
+//
+// The indexes in the cache are shared by all the searches, so they must never be modified. Writers don't use the cache:
+// they load their own copy of the index from disk, change it, and the copy replaces the cached one once it is saved.
+//
+// As with the document cache, a search that loads an index from disk can race with a write that saves a newer version
+// of it. A generation number, bumped on every save, makes sure that the older version doesn't end up in the cache.
+
+// The cache starts with the Index that was last saved, since that is what the writer has at hand, and compacts it the
+// first time a search needs it. This keeps the cost of compacting out of the write path, and only pays it once for all
+// the searches between two writes.
+
+// cachedIndex is an entry of the index cache: the saved Index until a search has needed it, the compactIndex after
+type cachedIndex struct {
+	saved     *Index
+	compacted *compactIndex
+}
+
+// getCachedIndex returns the index on fieldLocator, from the cache if possible. The returned index must not be modified.
+func (cl *Collection) getCachedIndex(fieldLocator string) (*compactIndex, error) {
+	cl.indexCacheLock.RLock()
+	entry, ok := cl.indexCache[fieldLocator]
+	generation := cl.indexCacheGeneration
+	cl.indexCacheLock.RUnlock()
+
+	if ok && entry.compacted != nil {
+		return entry.compacted, nil
+	}
+
+	var compacted *compactIndex
+	if ok {
+		compacted = entry.saved.compact()
+	} else if batched, ok := cl.getBatchedIndexCompact(fieldLocator); ok {
+		// With batched index flushes, the latest version of the index may only be in memory
+		compacted = batched
+	} else {
+		loaded, err := cl.loadIndex(fieldLocator)
+		if err != nil {
+			return nil, err
+		}
+		compacted = loaded.compact()
+	}
+
+	cl.indexCacheLock.Lock()
+	defer cl.indexCacheLock.Unlock()
+	if generation == cl.indexCacheGeneration {
+		if cl.indexCache == nil {
+			cl.indexCache = make(map[string]*cachedIndex)
+		}
+		cl.indexCache[fieldLocator] = &cachedIndex{compacted: compacted}
+	}
+
+	return compacted, nil
+}
+
+// setCachedIndex replaces the cached version of idx, which has just been saved. idx must not be modified afterwards.
+func (cl *Collection) setCachedIndex(idx *Index) {
+	cl.indexCacheLock.Lock()
+	defer cl.indexCacheLock.Unlock()
+
+	cl.indexCacheGeneration++
+	if cl.indexCache == nil {
+		cl.indexCache = make(map[string]*cachedIndex)
+	}
+	cl.indexCache[idx.FieldLocator] = &cachedIndex{saved: idx}
+}
+
+// uncacheIndex removes the cached version of the index on fieldLocator, which has changes that haven't been saved yet
+func (cl *Collection) uncacheIndex(fieldLocator string) {
+	cl.indexCacheLock.Lock()
+	defer cl.indexCacheLock.Unlock()
+
+	cl.indexCacheGeneration++
+	delete(cl.indexCache, fieldLocator)
+}
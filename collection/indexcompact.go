@@ -0,0 +1,170 @@
+package collection
+
+import (
+	"cmp"
+	"github.com/teejays/gofiledb/key"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/********************************************************************************
+* C O M P A C T  I N D E X
+*********************************************************************************/
+
+// The Index struct is built to be changed by writes: every value has its own slice of keys, and every key has its own
+// slice of values, which repeats every value string. Searches only need the value -> keys direction, so the indexes in
+// the index cache are kept as a compactIndex instead: the keys of all the values are packed into one sorted array, and
+// the value strings are shared with the Index they were compacted from, rather than copied.
+
+// compactIndex is a read-only version of an Index, as kept in the index cache for searches
+type compactIndex struct {
+	IndexInfo
+	values map[string][]key.Key // field value -> sorted, distinct doc keys, all backed by the same array
+}
+
+// compact returns the compactIndex version of idx. idx can be changed afterwards without affecting it.
+func (idx *Index) compact() *compactIndex {
+	var numKeys int
+	for _, keys := range idx.ValueKeys {
+		numKeys += len(keys)
+	}
+
+	c := &compactIndex{
+		IndexInfo: idx.IndexInfo,
+		values:    make(map[string][]key.Key, len(idx.ValueKeys)),
+	}
+	all := make([]key.Key, 0, numKeys)
+	for v, keys := range idx.ValueKeys {
+		start := len(all)
+		all = append(all, keys...)
+		sorted := all[start:]
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		// A document with the same value more than once (e.g. in an array) only needs to be listed once
+		n := 0
+		for i, k := range sorted {
+			if i > 0 && k == sorted[n-1] {
+				continue
+			}
+			sorted[n] = k
+			n++
+		}
+		all = all[:start+n]
+		c.values[v] = all[start : start+n : start+n]
+	}
+
+	return c
+}
+
+// getKeys returns the keys of the documents that have the value v in the indexed field, in ascending order. The
+// returned slice must not be modified.
+func (c *compactIndex) getKeys(v string) []key.Key {
+	if c == nil {
+		return nil
+	}
+	return c.values[v]
+}
+
+// getKeysInRange returns the keys of the documents that have a value in the indexed field for which the value compares
+// to v as operator (one of the range QUERY_OP_ constants) says, e.g. greater than v for QUERY_OP_GREATER. The values are
+// compared as numbers if the indexed field is a number, and as strings otherwise.
+func (c *compactIndex) getKeysInRange(operator string, v string) []key.Key {
+	if c == nil {
+		return nil
+	}
+	isInRange, ok := c.getRangeFunc(operator, v)
+	if !ok {
+		return nil
+	}
+
+	var keys []key.Key
+	for value, valueKeys := range c.values {
+		if isInRange(value) {
+			keys = append(keys, valueKeys...)
+		}
+	}
+	return keys
+}
+
+// hasKey tells whether the document k has the value v in the indexed field
+func (c *compactIndex) hasKey(v string, k key.Key) bool {
+	if c == nil {
+		return false
+	}
+	keys := c.values[v]
+	i := sort.Search(len(keys), func(i int) bool { return keys[i] >= k })
+	return i < len(keys) && keys[i] == k
+}
+
+// hasKeyInRange tells whether the document k has a value in the indexed field that compares to v as operator says, see
+// getKeysInRange
+func (c *compactIndex) hasKeyInRange(operator string, v string, k key.Key) bool {
+	if c == nil {
+		return false
+	}
+	isInRange, ok := c.getRangeFunc(operator, v)
+	if !ok {
+		return false
+	}
+	for value := range c.values {
+		if isInRange(value) && c.hasKey(value, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// getRangeFunc returns a func that tells whether a value of the indexed field compares to v as operator says, and false
+// if no value can, i.e. if v is not a number but the indexed field is
+func (c *compactIndex) getRangeFunc(operator string, v string) (func(value string) bool, bool) {
+	isNumber := isNumberKind(c.FieldType)
+	n, err := strconv.ParseFloat(v, 64)
+	if isNumber && err != nil {
+		return nil, false
+	}
+
+	return func(value string) bool {
+		var order int
+		if isNumber {
+			valueN, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return false
+			}
+			order = cmp.Compare(valueN, n)
+		} else {
+			order = strings.Compare(value, v)
+		}
+		switch operator {
+		case QUERY_OP_LESS:
+			return order < 0
+		case QUERY_OP_LESS_EQUAL:
+			return order <= 0
+		case QUERY_OP_GREATER:
+			return order > 0
+		case QUERY_OP_GREATER_EQUAL:
+			return order >= 0
+		}
+		return false
+	}, true
+}
+
+func isNumberKind(kind string) bool {
+	return strings.HasPrefix(kind, "int") || strings.HasPrefix(kind, "uint") || strings.HasPrefix(kind, "float")
+}
+
+// internValues makes the value strings in KeyValues share their data with the matching keys of ValueKeys, so that each
+// value is only in memory once. Decoding an index from JSON gives each of them its own copy.
+func (idx *Index) internValues() {
+	interned := make(map[string]string, len(idx.ValueKeys))
+	for v := range idx.ValueKeys {
+		interned[v] = v
+	}
+	for _, values := range idx.KeyValues {
+		for i, v := range values {
+			if s, ok := interned[v]; ok {
+				values[i] = s
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package collection
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/********************************************************************************
+* I O  L I M I T E R
+*********************************************************************************/
+
+// An IOLimiter bounds the number of document and index files that are read or written at the same time, e.g. so that a
+// burst of parallel searches can't run out of file descriptors or thrash a spinning disk. It is shared by all the
+// collections of a client, see SetIOLimiter. Reading a document holds a slot from the time it is opened until it has
+// been read, and writing a file holds one until it is written and synced.
+//
+// Slots are never held while waiting for another one, so a limit of 1 can't deadlock.
+
+type IOLimiter struct {
+	slots         chan struct{} // replaced by SetMaxConcurrentIO, so only accessed while holding slotsLock
+	slotsLock     sync.RWMutex
+	numOps        int64 // all fields but slots are updated atomically
+	numWaited     int64
+	totalWaitTime int64
+	maxWaitTime   int64
+}
+
+// numWaitingForIO is the number of operations waiting for a slot of any IOLimiter, see NumWaitingForIO
+var numWaitingForIO int64
+
+// IOLimiterStats tells how busy an IOLimiter has been. Wait times only include the operations that had to wait for a
+// slot.
+type IOLimiterStats struct {
+	MaxConcurrentIO int
+	NumInProgress   int // number of operations holding a slot right now
+	NumOps          int64
+	NumWaited       int64 // number of operations that had to wait for a slot
+	TotalWaitTime   time.Duration
+	MaxWaitTime     time.Duration
+}
+
+// NewIOLimiter returns an IOLimiter that lets up to maxConcurrentIO operations happen at the same time
+func NewIOLimiter(maxConcurrentIO int) *IOLimiter {
+	if maxConcurrentIO < 1 {
+		maxConcurrentIO = 1
+	}
+	return &IOLimiter{slots: make(chan struct{}, maxConcurrentIO)}
+}
+
+// NumWaitingForIO returns the number of reads and writes of the process that are waiting for a slot of an IOLimiter
+func NumWaitingForIO() int64 {
+	return atomic.LoadInt64(&numWaitingForIO)
+}
+
+// acquire waits for a slot, and returns the func that releases it. A nil IOLimiter doesn't limit anything.
+func (l *IOLimiter) acquire() func() {
+	if l == nil {
+		return func() {}
+	}
+	atomic.AddInt64(&l.numOps, 1)
+
+	// the slot is released into the channel it was taken from, even if the limit has been changed since
+	l.slotsLock.RLock()
+	slots := l.slots
+	l.slotsLock.RUnlock()
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		start := time.Now()
+		atomic.AddInt64(&numWaitingForIO, 1)
+		slots <- struct{}{}
+		atomic.AddInt64(&numWaitingForIO, -1)
+		wait := int64(time.Since(start))
+
+		atomic.AddInt64(&l.numWaited, 1)
+		atomic.AddInt64(&l.totalWaitTime, wait)
+		for {
+			max := atomic.LoadInt64(&l.maxWaitTime)
+			if wait <= max || atomic.CompareAndSwapInt64(&l.maxWaitTime, max, wait) {
+				break
+			}
+		}
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { <-slots }) }
+}
+
+// SetMaxConcurrentIO changes the number of operations that can happen at the same time. Operations that are already
+// holding a slot keep it until they are done, so for a short while there can be more of them than the new limit.
+func (l *IOLimiter) SetMaxConcurrentIO(maxConcurrentIO int) {
+	if maxConcurrentIO < 1 {
+		maxConcurrentIO = 1
+	}
+	l.slotsLock.Lock()
+	defer l.slotsLock.Unlock()
+	if cap(l.slots) != maxConcurrentIO {
+		l.slots = make(chan struct{}, maxConcurrentIO)
+	}
+}
+
+// GetStats returns the stats of the limiter since it was created
+func (l *IOLimiter) GetStats() IOLimiterStats {
+	if l == nil {
+		return IOLimiterStats{}
+	}
+	l.slotsLock.RLock()
+	slots := l.slots
+	l.slotsLock.RUnlock()
+	return IOLimiterStats{
+		MaxConcurrentIO: cap(slots),
+		NumInProgress:   len(slots),
+		NumOps:          atomic.LoadInt64(&l.numOps),
+		NumWaited:       atomic.LoadInt64(&l.numWaited),
+		TotalWaitTime:   time.Duration(atomic.LoadInt64(&l.totalWaitTime)),
+		MaxWaitTime:     time.Duration(atomic.LoadInt64(&l.maxWaitTime)),
+	}
+}
+
+// SetIOLimiter makes the reads and writes of the collection share the slots of l. A nil l removes the limit.
+func (cl *Collection) SetIOLimiter(l *IOLimiter) {
+	cl.ioLimiterLock.Lock()
+	defer cl.ioLimiterLock.Unlock()
+	cl.ioLimiter = l
+}
+
+// acquireIO waits for an IO slot, if the collection has an IOLimiter, and returns the func that releases it
+func (cl *Collection) acquireIO() func() {
+	cl.ioLimiterLock.Lock()
+	l := cl.ioLimiter
+	cl.ioLimiterLock.Unlock()
+	return l.acquire()
+}
@@ -0,0 +1,163 @@
+package collection
+
+import (
+	"bytes"
+	"github.com/teejays/gofiledb/key"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+/********************************************************************************
+* S N A P S H O T  I S O L A T I O N
+*********************************************************************************/
+
+// A query reads several indexes and then several documents, and writes can happen in between. To make sure that a
+// query sees the collection as it was at a single point in time, it runs on a readSnapshot:
+//
+// - The snapshot is taken while no write is in progress, and all the indexes the query needs are taken right away,
+//   from the index cache (see getCachedIndex).
+// - Before a write changes a document, it saves the current content of the document file (its pre-image) in every
+//   snapshot that is in use, unless the snapshot already has one for that document.
+// - The query reads a document from its pre-image if there is one, and from the disk otherwise.
+//
+// This costs nothing when no query is running, and only keeps the documents that change during a query in memory.
+
+type readSnapshot struct {
+	indexes   map[string]*compactIndex // field locator -> index, as of when the snapshot was taken
+	preImages map[key.Key]docPreImage  // document files as of when the snapshot was taken, for the ones written since
+	sync.Mutex
+}
+
+type docPreImage struct {
+	isExist  bool // false if the document didn't exist when the snapshot was taken
+	fileName string
+	fileData []byte
+}
+
+// newReadSnapshot takes a snapshot of the collection, which includes the indexes on fieldLocators. It should be released
+// using releaseReadSnapshot once the query is done.
+func (cl *Collection) newReadSnapshot(fieldLocators []string) (*readSnapshot, error) {
+	s := &readSnapshot{
+		indexes:   make(map[string]*compactIndex),
+		preImages: make(map[key.Key]docPreImage),
+	}
+
+	// Block writes while we load the indexes, so they are consistent with each other and with the documents
+	cl.readSnapshotsLock.Lock()
+	defer cl.readSnapshotsLock.Unlock()
+
+	for _, fieldLocator := range fieldLocators {
+		if _, exists := s.indexes[fieldLocator]; exists {
+			continue
+		}
+		idx, err := cl.getCachedIndex(fieldLocator)
+		if err != nil {
+			return nil, err
+		}
+		s.indexes[fieldLocator] = idx
+	}
+
+	if cl.readSnapshots == nil {
+		cl.readSnapshots = make(map[*readSnapshot]bool)
+	}
+	cl.readSnapshots[s] = true
+
+	return s, nil
+}
+
+func (cl *Collection) releaseReadSnapshot(s *readSnapshot) {
+	cl.readSnapshotsLock.Lock()
+	delete(cl.readSnapshots, s)
+	cl.readSnapshotsLock.Unlock()
+}
+
+// preserveForReadSnapshots saves the current document file for k in all the snapshots in use. It should be called with
+// readSnapshotsLock held for reading, before the document is changed.
+func (cl *Collection) preserveForReadSnapshots(k key.Key) error {
+	if len(cl.readSnapshots) == 0 {
+		return nil
+	}
+
+	var p docPreImage
+	fileName, fileData, err := cl.readDocFile(k)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		p.isExist = true
+		p.fileName = fileName
+		p.fileData = fileData
+	}
+
+	for s := range cl.readSnapshots {
+		s.Lock()
+		if _, exists := s.preImages[k]; !exists {
+			s.preImages[k] = p
+		}
+		s.Unlock()
+	}
+
+	return nil
+}
+
+// getFileData returns the document file for k as of when the snapshot was taken. The returned bool is true if the data
+// is from a pre-image, rather than the current file on disk.
+func (s *readSnapshot) getFileData(cl *Collection, k key.Key) (docPreImage, bool, error) {
+	// Holding the lock while reading from the disk means that a write can't change the file before it has saved it in
+	// the snapshot
+	s.Lock()
+	defer s.Unlock()
+
+	if p, exists := s.preImages[k]; exists {
+		return p, true, nil
+	}
+
+	var p docPreImage
+	fileName, fileData, err := cl.readDocFile(k)
+	if err != nil {
+		return p, false, err
+	}
+	p.isExist = true
+	p.fileName = fileName
+	p.fileData = fileData
+
+	return p, false, nil
+}
+
+// getIntoStructFromSnapshot is like GetIntoStruct, but reads the document as of when the snapshot was taken
+func (cl *Collection) getIntoStructFromSnapshot(s *readSnapshot, k key.Key, dest interface{}) error {
+	if cl.getEncodingType() == ENCODING_NONE {
+		return ErrStructNotSupported
+	}
+
+	p, isPreImage, err := s.getFileData(cl, k)
+	if err != nil {
+		return err
+	}
+	if !p.isExist {
+		return os.ErrNotExist
+	}
+
+	err = cl.decodeFileData(p, k, dest)
+	// only quarantine if the corrupted data is what's on disk right now
+	if _, ok := err.(corruptionError); ok && isPreImage {
+		return ErrDocumentIsCorrupted
+	}
+	return cl.quarantineIfCorrupted(k, err)
+}
+
+func (cl *Collection) decodeFileData(p docPreImage, k key.Key, dest interface{}) error {
+	h, r, err := cl.openDocReader(ioutil.NopCloser(bytes.NewReader(p.fileData)), p.fileName, k, true)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	return decodeDoc(h, data, dest)
+}
@@ -0,0 +1,175 @@
+package collection
+
+import (
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"os"
+)
+
+/********************************************************************************
+* I N D E X  J O U R N A L
+*********************************************************************************/
+
+// A document is written first and the indexes are updated after, so a crash in between would leave indexes that don't
+// match the document. With EnableWAL, the whole op is replayed after a crash, which takes care of this. Otherwise, the
+// key of the document is logged in the index journal before the document is changed, and marked as done once the
+// indexes have been updated. After a crash, the indexes are brought in line with whatever version of the document
+// made it to disk, for every key that wasn't marked as done.
+//
+// The index journal uses the same format as the WAL, but its entries have no payload. It is only fsynced if the
+// Durability setting of the collection asks for fsyncs.
+
+const INDEX_JOURNAL_FILE_NAME string = "index_journal"
+
+const WAL_OP_REINDEX string = "reindex"
+
+func (cl *Collection) getIndexJournalPath() string {
+	return util.JoinPath(cl.DirPath, META_DIR_NAME, INDEX_JOURNAL_FILE_NAME)
+}
+
+func (cl *Collection) getIndexJournal() (*wal, error) {
+	cl.walLock.Lock()
+	defer cl.walLock.Unlock()
+
+	if cl.indexJournal != nil {
+		return cl.indexJournal, nil
+	}
+
+	j, err := cl.openWAL(cl.getIndexJournalPath())
+	if err != nil {
+		return nil, err
+	}
+	durability, _ := cl.GetDurability()
+	j.noSync = durability == DURABILITY_NONE
+
+	cl.indexJournal = j
+	return cl.indexJournal, nil
+}
+
+// getOpenLogs returns the WAL and the index journal, if they are open
+func (cl *Collection) getOpenLogs() []*wal {
+	cl.walLock.Lock()
+	defer cl.walLock.Unlock()
+
+	var logs []*wal
+	for _, w := range []*wal{cl.wal, cl.indexJournal} {
+		if w != nil {
+			logs = append(logs, w)
+		}
+	}
+	return logs
+}
+
+// closeIndexJournal closes the index journal file if it is open
+func (cl *Collection) closeIndexJournal() error {
+	cl.walLock.Lock()
+	j := cl.indexJournal
+	cl.indexJournal = nil
+	cl.walLock.Unlock()
+
+	if j == nil {
+		return nil
+	}
+	j.Lock()
+	defer j.Unlock()
+	return j.file.Close()
+}
+
+// withIndexJournal runs apply, which changes the document for k and updates the indexes, behind an index journal entry
+// for k. The journal is not needed if the op is in the WAL already, or if there are no indexes to update.
+func (cl *Collection) withIndexJournal(k key.Key, apply func() error) error {
+	cl.IndexStore.RLock()
+	numIndexes := len(cl.IndexStore.Store)
+	cl.IndexStore.RUnlock()
+
+	if cl.EnableWAL || !cl.canIndex() || numIndexes == 0 {
+		return apply()
+	}
+
+	j, err := cl.getIndexJournal()
+	if err != nil {
+		return err
+	}
+	seq, err := j.begin(WAL_OP_REINDEX, k, nil)
+	if err != nil {
+		return err
+	}
+
+	err = apply()
+	if err != nil {
+		// The document may have changed without the indexes being updated, so try to fix the indexes now. If that fails
+		// as well, the entry stays in the journal and the indexes are fixed when the collection is recovered.
+		rErr := cl.reindexDoc(k)
+		if rErr != nil {
+			util.Errorf("Could not update the indexes of collection %s for document %s: %s", cl.Name, k, rErr)
+			return err
+		}
+		cl.commitAfterIndexFlush(j, seq)
+		return err
+	}
+
+	return cl.commitAfterIndexFlush(j, seq)
+}
+
+// reindexDoc makes the indexes match the document for k as it is on disk, i.e. removes k from the indexes if the
+// document doesn't exist
+func (cl *Collection) reindexDoc(k key.Key) error {
+	err := cl.checkDocExists(k)
+	if os.IsNotExist(err) {
+		return cl.removeDocFromIndexes(k)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = cl.addDocToIndexes(k)
+	if err == ErrDocumentIsCorrupted { // it has been quarantined, which removes it from the indexes
+		return nil
+	}
+	return err
+}
+
+// ReplayIndexJournal updates the indexes for all the documents that were being changed when the process crashed, and
+// then truncates the journal. It returns the number of documents reindexed. It should be called before the collection
+// is used.
+func (cl *Collection) ReplayIndexJournal() (int, error) {
+	path := cl.getIndexJournalPath()
+
+	entries, err := cl.readWALEntries(path)
+	if err != nil {
+		return 0, err
+	}
+
+	// A key can be pending more than once, but it only needs to be reindexed once
+	var keys []key.Key
+	var seen map[key.Key]bool = make(map[key.Key]bool)
+	for _, e := range getPendingWALEntries(entries) {
+		if !seen[e.Key] {
+			seen[e.Key] = true
+			keys = append(keys, e.Key)
+		}
+	}
+
+	for _, k := range keys {
+		util.Infof("Reindexing document %s of collection %s, which was being changed when the process stopped", k, cl.Name)
+		err = cl.reindexDoc(k)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = cl.FlushIndexes()
+	if err != nil {
+		return 0, err
+	}
+	err = cl.closeIndexJournal()
+	if err != nil {
+		return 0, err
+	}
+	err = cl.fs().Truncate(path, 0)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	return len(keys), nil
+}
@@ -0,0 +1,41 @@
+package collection
+
+import (
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"sync"
+)
+
+/********************************************************************************
+* K E Y  L O C K S
+*********************************************************************************/
+
+// Writes to the same document are serialized, so that concurrent writes can't interleave the document, revision and
+// index updates for a key. Rather than having a mutex per key, a key is mapped to one of NUM_KEY_LOCK_STRIPES mutexes.
+// Writes to different keys can still end up waiting on each other if they share a stripe, but the number of mutexes
+// stays fixed however many documents the collection has.
+//
+// A key lock is taken by the exported methods that change a document, and held for the whole op (including the WAL,
+// the index journal and the audit log), so none of the methods that take it should call each other.
+
+const NUM_KEY_LOCK_STRIPES int = 64
+
+type keyLocks [NUM_KEY_LOCK_STRIPES]sync.Mutex
+
+// lockKey locks the stripe for k, and returns the func to unlock it. If the collection is being repartitioned, the files
+// of the document are moved to its new partition first, see StartRepartition. A failed move is only logged, since the
+// document can still be found in its old partition, and FinishRepartition tries it again.
+func (cl *Collection) lockKey(k key.Key) func() {
+	unlock := cl.lockKeyStripe(k)
+	if err := cl.migrateDoc(k); err != nil {
+		util.Warnf("Repartitioning collection %s: could not move document %s: %v", cl.Name, k.String(), err)
+	}
+	return unlock
+}
+
+// lockKeyStripe locks the stripe for k without moving the files of the document, and returns the func to unlock it
+func (cl *Collection) lockKeyStripe(k key.Key) func() {
+	i := int(uint64(k) % uint64(NUM_KEY_LOCK_STRIPES))
+	cl.keyLocks[i].Lock()
+	return cl.keyLocks[i].Unlock
+}
@@ -0,0 +1,439 @@
+package collection
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/********************************************************************************
+* P A R T I T I O N  M A N I F E S T S
+*********************************************************************************/
+
+// Listing a partition dir with millions of documents is slow, and scans (index builds, key rotation, preloading) and
+// counts do it over and over. With EnableManifests, every partition has a manifest in the meta dir instead: the
+// keys, file names and sizes of its documents. Scans and counts read the manifest, which is kept in memory once loaded.
+//
+// A manifest is a log of one line per change ("set <key> <size> <file name>" or "del <key>"), which is appended to on
+// every Set and Delete, and rewritten once most of its lines are outdated. A manifest that doesn't exist yet is built
+// from the partition dir the first time it is needed.
+//
+// The document is written before the manifest, so a crash in between leaves the manifest out of date. While manifests
+// are being written to, a dirty marker file exists in the manifests dir. It is removed when the collection is closed, so
+// if Recover finds it, the manifests are thrown away, to be rebuilt from the partition dirs.
+
+const MANIFEST_DIR_NAME string = "manifests"
+const MANIFEST_DIRTY_FILE_NAME string = "dirty"
+
+// MANIFEST_COMPACTION_MIN_LINES is the number of lines a manifest can have before it is rewritten, regardless of how
+// many of them are outdated
+const MANIFEST_COMPACTION_MIN_LINES int = 1024
+
+const (
+	manifestOpSet string = "set"
+	manifestOpDel string = "del"
+)
+
+type manifestEntry struct {
+	FileName string
+	Size     int64
+}
+
+// partitionManifest is the in-memory version of the manifest of a partition. It is guarded by manifestsLock of the
+// collection.
+type partitionManifest struct {
+	path     string
+	entries  map[key.Key]manifestEntry
+	file     util.File // opened for appending on the first change
+	numLines int
+}
+
+// usesManifests tells whether scans and counts go through the partition manifests. Segments have indexes of their own.
+func (cl *Collection) usesManifests() bool {
+	return cl.EnableManifests && !cl.isSegmented() && !cl.isRepartitioning()
+}
+
+func (cl *Collection) getManifestsDirPath() string {
+	return util.JoinPath(cl.DirPath, META_DIR_NAME, MANIFEST_DIR_NAME)
+}
+
+// getManifest returns the manifest of the partition dir named pDirName, loading or building it if needed. It should be
+// called while holding manifestsLock.
+func (cl *Collection) getManifest(pDirName string) (*partitionManifest, error) {
+	if m, ok := cl.manifests[pDirName]; ok {
+		return m, nil
+	}
+
+	err := util.CreateDirIfNotExist(cl.fs(), cl.getManifestsDirPath())
+	if err != nil {
+		return nil, err
+	}
+
+	path := util.JoinPath(cl.getManifestsDirPath(), pDirName)
+	m, err := cl.loadManifest(path)
+	if os.IsNotExist(err) {
+		m, err = cl.buildManifest(path, util.JoinPath(cl.getDataPath(), pDirName))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cl.manifests == nil {
+		cl.manifests = make(map[string]*partitionManifest)
+	}
+	cl.manifests[pDirName] = m
+	return m, nil
+}
+
+// loadManifest reads the manifest at path. Reading stops at the first incomplete line, which is what a crash in the
+// middle of an append leaves behind.
+func (cl *Collection) loadManifest(path string) (*partitionManifest, error) {
+	data, err := util.ReadFile(cl.fs(), path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &partitionManifest{path: path, entries: make(map[key.Key]manifestEntry)}
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			util.Warnf("Ignoring incomplete line at the end of the manifest %s", path)
+			break
+		}
+		line := string(data[:end])
+		data = data[end+1:]
+
+		err = m.applyLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid line in the manifest %s: %w", path, err)
+		}
+		m.numLines++
+	}
+
+	return m, nil
+}
+
+// applyLine applies a change read from the manifest file
+func (m *partitionManifest) applyLine(line string) error {
+	parts := strings.SplitN(line, " ", 4)
+	if len(parts) < 2 {
+		return fmt.Errorf("%q", line)
+	}
+	k, err := key.ParseKey(parts[1])
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case parts[0] == manifestOpSet && len(parts) == 4:
+		size, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return err
+		}
+		m.entries[k] = manifestEntry{FileName: parts[3], Size: size}
+	case parts[0] == manifestOpDel:
+		delete(m.entries, k)
+	default:
+		return fmt.Errorf("%q", line)
+	}
+	return nil
+}
+
+// buildManifest creates the manifest at path from the documents in the partition dir at pDirPath
+func (cl *Collection) buildManifest(path string, pDirPath string) (*partitionManifest, error) {
+	m := &partitionManifest{path: path, entries: make(map[key.Key]manifestEntry)}
+
+	err := cl.forEachDocInPartition(pDirPath, func(k key.Key, docPath string) error {
+		info, err := cl.fs().Stat(docPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		m.entries[k] = manifestEntry{FileName: info.Name(), Size: info.Size()}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) { // the partition dir is only created with its first document
+		return nil, err
+	}
+
+	return m, cl.rewriteManifest(m)
+}
+
+// rewriteManifest replaces the manifest file of m with one line per entry
+func (cl *Collection) rewriteManifest(m *partitionManifest) error {
+	if m.file != nil {
+		err := m.file.Close()
+		if err != nil {
+			return err
+		}
+		m.file = nil
+	}
+
+	buf := bytes.NewBuffer(nil)
+	for _, k := range m.getKeys() {
+		e := m.entries[k]
+		fmt.Fprintf(buf, "%s %s %d %s\n", manifestOpSet, k, e.Size, e.FileName)
+	}
+	m.numLines = len(m.entries)
+
+	return cl.writeFile(m.path, buf.Bytes())
+}
+
+// getKeys returns the keys in the manifest, in order
+func (m *partitionManifest) getKeys() []key.Key {
+	keys := make([]key.Key, 0, len(m.entries))
+	for k := range m.entries {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// appendLine logs a change at the end of the manifest file, and rewrites the file if most of it is outdated. It should
+// be called after the change has been made to the entries.
+func (cl *Collection) appendLine(m *partitionManifest, line string) error {
+	if m.numLines >= MANIFEST_COMPACTION_MIN_LINES && m.numLines > 2*len(m.entries) {
+		return cl.rewriteManifest(m)
+	}
+
+	if m.file == nil {
+		err := cl.markManifestsDirty()
+		if err != nil {
+			return err
+		}
+		m.file, err = cl.fs().OpenFile(m.path, os.O_WRONLY|os.O_APPEND, util.FILE_PERM)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(m.file, line+"\n")
+	if err != nil {
+		return err
+	}
+	m.numLines++
+	return cl.syncFile(m.file)
+}
+
+// markManifestsDirty creates the dirty marker, if it doesn't exist yet. It should be called while holding manifestsLock.
+func (cl *Collection) markManifestsDirty() error {
+	if cl.manifestsDirty {
+		return nil
+	}
+	path := util.JoinPath(cl.getManifestsDirPath(), MANIFEST_DIRTY_FILE_NAME)
+	err := cl.writeFile(path, nil)
+	if err != nil {
+		return err
+	}
+	cl.manifestsDirty = true
+	return nil
+}
+
+// refreshManifestEntry updates the manifest entry for k with whatever is on disk for it, after it has been written,
+// removed or moved into place
+func (cl *Collection) refreshManifestEntry(k key.Key) error {
+	if !cl.usesManifests() {
+		return nil
+	}
+
+	var e manifestEntry
+	var exists bool
+	for _, path := range []string{cl.getFilePath(k), cl.getAltFilePath(k)} {
+		info, err := cl.fs().Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		e = manifestEntry{FileName: info.Name(), Size: info.Size()}
+		exists = true
+		break
+	}
+
+	cl.manifestsLock.Lock()
+	defer cl.manifestsLock.Unlock()
+
+	m, err := cl.getManifest(k.GetPartitionDirName(cl.getNumPartitions()))
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		if _, ok := m.entries[k]; !ok {
+			return nil
+		}
+		delete(m.entries, k)
+		return cl.appendLine(m, fmt.Sprintf("%s %s", manifestOpDel, k))
+	}
+	if m.entries[k] == e {
+		return nil
+	}
+	m.entries[k] = e
+	return cl.appendLine(m, fmt.Sprintf("%s %s %d %s", manifestOpSet, k, e.Size, e.FileName))
+}
+
+// removeManifestEntry removes k from the manifest of the partition dir named pDirName, e.g. after its document has been
+// moved out of that dir
+func (cl *Collection) removeManifestEntry(pDirName string, k key.Key) error {
+	if !cl.usesManifests() {
+		return nil
+	}
+
+	cl.manifestsLock.Lock()
+	defer cl.manifestsLock.Unlock()
+
+	m, err := cl.getManifest(pDirName)
+	if err != nil {
+		return err
+	}
+	if _, ok := m.entries[k]; !ok {
+		return nil
+	}
+	delete(m.entries, k)
+	return cl.appendLine(m, fmt.Sprintf("%s %s", manifestOpDel, k))
+}
+
+// forEachDocInManifest is forEachDocInPartition, but using the manifest of the partition rather than listing its dir.
+// The keys are copied before fn is called, so fn can change the collection.
+func (cl *Collection) forEachDocInManifest(pDirPath string, fn func(k key.Key, docPath string) error) error {
+	cl.manifestsLock.Lock()
+	m, err := cl.getManifest(filepath.Base(pDirPath))
+	if err != nil {
+		cl.manifestsLock.Unlock()
+		return err
+	}
+	keys := m.getKeys()
+	var fileNames []string = make([]string, len(keys))
+	for i, k := range keys {
+		fileNames[i] = m.entries[k].FileName
+	}
+	cl.manifestsLock.Unlock()
+
+	for i, k := range keys {
+		err = fn(k, util.JoinPath(pDirPath, fileNames[i]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachDocInPartitionDir calls fn for every document in the partition dir at pDirPath, using its manifest if the
+// collection has them
+func (cl *Collection) forEachDocInPartitionDir(pDirPath string, fn func(k key.Key, docPath string) error) error {
+	if cl.usesManifests() {
+		return cl.forEachDocInManifest(pDirPath, fn)
+	}
+	return cl.forEachDocInPartition(pDirPath, fn)
+}
+
+// Count returns the number of documents in the collection. With EnableManifests, it doesn't list any partition
+// dirs, other than to build missing manifests.
+func (cl *Collection) Count() (int, error) {
+	if !cl.usesManifests() {
+		var n int
+		err := cl.forEachDoc(func(k key.Key, docPath string) error {
+			n++
+			return nil
+		})
+		if os.IsNotExist(err) { // no documents have been written yet
+			return 0, nil
+		}
+		return n, err
+	}
+
+	pDirPaths, err := cl.getPartitionDirPaths()
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	cl.manifestsLock.Lock()
+	defer cl.manifestsLock.Unlock()
+
+	var n int
+	for _, pDirPath := range pDirPaths {
+		m, err := cl.getManifest(filepath.Base(pDirPath))
+		if err != nil {
+			return 0, err
+		}
+		n += len(m.entries)
+	}
+
+	// Cold documents are not in any partition, so they are not in the manifests either
+	numCold, err := cl.countColdDocs()
+	if err != nil {
+		return 0, err
+	}
+	return n + numCold, nil
+}
+
+// closeManifests closes the manifest files, and removes the dirty marker since they are all up to date
+func (cl *Collection) closeManifests() error {
+	cl.manifestsLock.Lock()
+	defer cl.manifestsLock.Unlock()
+
+	for _, m := range cl.manifests {
+		if m.file == nil {
+			continue
+		}
+		err := m.file.Close()
+		if err != nil {
+			return err
+		}
+		m.file = nil
+	}
+	cl.manifests = nil
+
+	if !cl.manifestsDirty {
+		return nil
+	}
+	path := util.JoinPath(cl.getManifestsDirPath(), MANIFEST_DIRTY_FILE_NAME)
+	err := cl.fs().Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	cl.manifestsDirty = false
+	return cl.syncRenamed(path)
+}
+
+// removeDirtyManifests removes all the manifests if the collection wasn't closed cleanly, so that they are rebuilt from
+// the partition dirs. It returns whether they were removed.
+func (cl *Collection) removeDirtyManifests() (bool, error) {
+	_, err := cl.fs().Stat(util.JoinPath(cl.getManifestsDirPath(), MANIFEST_DIRTY_FILE_NAME))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, cl.removeManifests()
+}
+
+// removeManifests removes all the manifests, so that they are rebuilt from the partition dirs when next needed
+func (cl *Collection) removeManifests() error {
+	cl.manifestsLock.Lock()
+	defer cl.manifestsLock.Unlock()
+
+	for _, m := range cl.manifests {
+		if m.file != nil {
+			m.file.Close()
+		}
+	}
+	cl.manifests = nil
+	cl.manifestsDirty = false
+
+	return cl.fs().RemoveAll(cl.getManifestsDirPath())
+}
@@ -0,0 +1,96 @@
+package collection
+
+import (
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/********************************************************************************
+* N A M E S
+*********************************************************************************/
+
+// Collection names are normalized by NormalizeName: the white space around them is trimmed, they are put in Unicode
+// normalization form C (so that e.g. an "é" typed as one character or as an "e" and a combining accent is the same),
+// and they are lowercased using the Unicode case mappings, so that names only differing by case refer to the same
+// collection. New names (of collections and aliases) then need to follow NameRules, which a client can configure.
+// Whatever the rules are, a name can only have printable characters (no control or invisible formatting characters,
+// which would make different names look the same), can't have a path separator, and can't start with '.' or
+// TEMP_FILE_PREFIX, since it is used as the name of the dir of the collection.
+//
+// Names are only checked when they are given to a collection: the names of existing collections are kept as they are,
+// even if they don't follow the rules.
+
+const DEFAULT_NAME_MIN_LENGTH int = 2
+const DEFAULT_NAME_MAX_LENGTH int = 50
+
+var ErrInvalidCollectionName = fmt.Errorf("Invalid collection name")
+
+// DefaultNamePattern only allows letters and digits, as names are lowercased before being checked
+var DefaultNamePattern = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// NameRules are the rules that new collection names need to follow. The zero value has the default rules.
+type NameRules struct {
+	Pattern   *regexp.Regexp // names need to match it, defaults to DefaultNamePattern
+	MinLength int            // in characters, defaults to DEFAULT_NAME_MIN_LENGTH
+	MaxLength int            // in characters, defaults to DEFAULT_NAME_MAX_LENGTH
+}
+
+// NormalizeName returns the normalized form of the collection name name
+func NormalizeName(name string) string {
+	return strings.ToLower(norm.NFC.String(strings.TrimSpace(name)))
+}
+
+// Validate checks that name, which should be normalized, follows the rules. The errors it returns wrap
+// ErrInvalidCollectionName.
+func (r NameRules) Validate(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: it cannot be empty", ErrInvalidCollectionName)
+	}
+	if !utf8.ValidString(name) || strings.ContainsRune(name, utf8.RuneError) {
+		return fmt.Errorf("%w: it is not valid UTF-8", ErrInvalidCollectionName)
+	}
+	for _, c := range name {
+		if !unicode.IsGraphic(c) {
+			return fmt.Errorf("%w: it cannot have non-printable characters", ErrInvalidCollectionName)
+		}
+	}
+	if strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") || strings.HasPrefix(name, TEMP_FILE_PREFIX) {
+		return fmt.Errorf("%w: it cannot have a path separator, or start with '.' or %q", ErrInvalidCollectionName, TEMP_FILE_PREFIX)
+	}
+
+	minLength, maxLength := r.getLengthLimits()
+	length := utf8.RuneCountInString(name)
+	if length < minLength {
+		return fmt.Errorf("%w: it needs to be a minimum of %d chars", ErrInvalidCollectionName, minLength)
+	}
+	if length > maxLength {
+		return fmt.Errorf("%w: it can be a max of %d chars", ErrInvalidCollectionName, maxLength)
+	}
+
+	pattern := r.Pattern
+	if pattern == nil {
+		pattern = DefaultNamePattern
+	}
+	if !pattern.MatchString(name) {
+		if r.Pattern == nil {
+			return fmt.Errorf("%w: it cannot have any special characters", ErrInvalidCollectionName)
+		}
+		return fmt.Errorf("%w: it does not match the pattern %s", ErrInvalidCollectionName, pattern)
+	}
+	return nil
+}
+
+func (r NameRules) getLengthLimits() (int, int) {
+	minLength, maxLength := r.MinLength, r.MaxLength
+	if minLength <= 0 {
+		minLength = DEFAULT_NAME_MIN_LENGTH
+	}
+	if maxLength <= 0 {
+		maxLength = DEFAULT_NAME_MAX_LENGTH
+	}
+	return minLength, maxLength
+}
@@ -0,0 +1,37 @@
+package collection
+
+import (
+	"github.com/teejays/gofiledb/key"
+	"sync"
+)
+
+/********************************************************************************
+* C H A N G E  N O T I F I C A T I O N S
+*********************************************************************************/
+
+// ChangeHandler is called after every change to a document of the collection has been applied, with the op (one of the
+// AUDIT_OP_ constants) and the key of the document. It is called while the document is still locked, so it should not
+// do anything slow, or use the collection.
+type ChangeHandler func(op string, k key.Key)
+
+type changeNotifier struct {
+	handler ChangeHandler
+	sync.RWMutex
+}
+
+// SetChangeHandler sets the func that is told about the changes to the collection, see ChangeHandler
+func (cl *Collection) SetChangeHandler(fn ChangeHandler) {
+	cl.changes.Lock()
+	defer cl.changes.Unlock()
+	cl.changes.handler = fn
+}
+
+// notifyChange tells the change handler, if there is one, about op on the document for k
+func (cl *Collection) notifyChange(op string, k key.Key) {
+	cl.changes.RLock()
+	fn := cl.changes.handler
+	cl.changes.RUnlock()
+	if fn != nil {
+		fn(op, k)
+	}
+}
@@ -0,0 +1,131 @@
+package collection
+
+import (
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+)
+
+/********************************************************************************
+* P A T H S
+*********************************************************************************/
+
+// Every write needs the path of the document file, and its partition dir to exist. Rather than building the path from
+// scratch and checking for the dir every time, the partition dir paths are built once, and a dir is only checked for
+// (and created) the first time it is written to. If a known dir goes away anyway (e.g. it is removed by hand), the
+// write that fails because of it forgets the dir, and is retried once.
+
+// pathCache holds the paths for the current Name, DirPath and NumPartitions of a collection. It is guarded by pathsLock of
+// the collection.
+type pathCache struct {
+	name           string
+	dirPath        string
+	numPartitions  int
+	pDirPaths      []string // partition hash -> partition dir path
+	pDirExists     []bool   // partition hash -> whether the dir is known to exist
+	fileNamePrefix string
+}
+
+// getPathCache returns the path cache, rebuilding it if the collection has been renamed, moved or repartitioned since
+// it was built. It should be called while holding pathsLock.
+func (cl *Collection) getPathCache() *pathCache {
+	numPartitions := cl.getNumPartitions()
+	c := cl.paths
+	if c != nil && c.name == cl.Name && c.dirPath == cl.DirPath && c.numPartitions == numPartitions {
+		return c
+	}
+
+	c = &pathCache{
+		name:           cl.Name,
+		dirPath:        cl.DirPath,
+		numPartitions:  numPartitions,
+		pDirPaths:      make([]string, numPartitions),
+		pDirExists:     make([]bool, numPartitions),
+		fileNamePrefix: cl.Name + "_" + key.DOC_FILE_NAME_PREFIX,
+	}
+	dataPath := cl.getDataPath()
+	for i := range c.pDirPaths {
+		c.pDirPaths[i] = util.JoinPath(dataPath, key.Key(i).GetPartitionDirName(numPartitions))
+	}
+	cl.paths = c
+	return c
+}
+
+// getPartitionHash returns the partition of k as an index into the path cache, or -1 for keys that the cache doesn't
+// cover (negative keys, whose partition names are negative too)
+func (c *pathCache) getPartitionHash(k key.Key) int {
+	if k < 0 || c.numPartitions < 1 {
+		return -1
+	}
+	return int(k % key.Key(c.numPartitions))
+}
+
+// getPartitionDirPath returns the path of the partition dir of the document for k
+func (cl *Collection) getPartitionDirPath(k key.Key) string {
+	cl.pathsLock.Lock()
+	c := cl.getPathCache()
+	h := c.getPartitionHash(k)
+	cl.pathsLock.Unlock()
+	if h < 0 {
+		return util.JoinPath(cl.getDataPath(), k.GetPartitionDirName(c.numPartitions))
+	}
+	return c.pDirPaths[h]
+}
+
+// getDocFileName returns the name of the file for the document for k, with or without the gzip extension
+func (cl *Collection) getDocFileName(k key.Key, isGzipped bool) string {
+	cl.pathsLock.Lock()
+	prefix := cl.getPathCache().fileNamePrefix
+	cl.pathsLock.Unlock()
+
+	if isGzipped {
+		return prefix + k.String() + key.GZIP_FILE_EXTENSION
+	}
+	return prefix + k.String()
+}
+
+// ensurePartitionDir makes sure that the partition dir of the document for k exists, and returns its path
+func (cl *Collection) ensurePartitionDir(k key.Key) (string, error) {
+	cl.pathsLock.Lock()
+	c := cl.getPathCache()
+	h := c.getPartitionHash(k)
+	var dirPath string
+	if h >= 0 {
+		dirPath = c.pDirPaths[h]
+		if c.pDirExists[h] {
+			cl.pathsLock.Unlock()
+			return dirPath, nil
+		}
+	}
+	cl.pathsLock.Unlock()
+
+	if h < 0 {
+		dirPath = cl.getPartitionDirPath(k)
+	}
+	err := util.CreateDirIfNotExist(cl.fs(), dirPath)
+	if err != nil {
+		return dirPath, err
+	}
+	if _, err := cl.fs().Stat(dirPath); err != nil {
+		return dirPath, err
+	}
+
+	if h >= 0 {
+		cl.pathsLock.Lock()
+		if c := cl.getPathCache(); h < len(c.pDirPaths) && c.pDirPaths[h] == dirPath {
+			c.pDirExists[h] = true
+		}
+		cl.pathsLock.Unlock()
+	}
+	return dirPath, nil
+}
+
+// forgetPartitionDir marks the partition dir of the document for k as not known to exist, e.g. after a write to it
+// failed because it doesn't
+func (cl *Collection) forgetPartitionDir(k key.Key) {
+	cl.pathsLock.Lock()
+	defer cl.pathsLock.Unlock()
+	c := cl.getPathCache()
+	if h := c.getPartitionHash(k); h >= 0 {
+		c.pDirExists[h] = false
+	}
+}
@@ -0,0 +1,115 @@
+package collection
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync/atomic"
+)
+
+/********************************************************************************
+* P E R S I S T E N C E
+*********************************************************************************/
+
+// collectionGob is what gets saved to disk for a Collection as part of the client meta. The encryption keys are
+// deliberately left out: they should never be stored next to the data they protect. They need to be provided again
+// when the client is initialized.
+type collectionGob struct {
+	DirPath     string
+	IndexStore  map[string]IndexInfo
+	Props       CollectionProps
+	IsEncrypted bool
+	IsFrozen    bool
+	// the NumPartitions before a repartitioning that isn't finished, if any, see StartRepartition
+	PrevNumPartitions int
+}
+
+func (cl *Collection) GobEncode() ([]byte, error) {
+	cl.IndexStore.RLock()
+	var store map[string]IndexInfo = make(map[string]IndexInfo, len(cl.IndexStore.Store))
+	for fieldLocator, info := range cl.IndexStore.Store {
+		store[fieldLocator] = info
+	}
+	cl.IndexStore.RUnlock()
+
+	cl.settingsLock.RLock()
+	props := cl.CollectionProps
+	cl.settingsLock.RUnlock()
+	props.EncryptionKey = nil
+	props.PreviousEncryptionKey = nil
+
+	clGob := collectionGob{
+		DirPath:           cl.DirPath,
+		IndexStore:        store,
+		Props:             props,
+		IsEncrypted:       cl.isEncrypted() || cl.requiresEncryptionKey,
+		IsFrozen:          cl.IsFrozen(),
+		PrevNumPartitions: int(atomic.LoadInt32(&cl.prevNumPartitions)),
+	}
+
+	buff := bytes.NewBuffer(nil)
+	enc := gob.NewEncoder(buff)
+	err := enc.Encode(clGob)
+	if err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+func (cl *Collection) GobDecode(b []byte) error {
+	var clGob collectionGob
+
+	buff := bytes.NewBuffer(b)
+	dec := gob.NewDecoder(buff)
+	err := dec.Decode(&clGob)
+	if err != nil {
+		return err
+	}
+
+	cl.DirPath = clGob.DirPath
+	cl.CollectionProps = clGob.Props
+	cl.IndexStore.Store = clGob.IndexStore
+	if cl.IndexStore.Store == nil {
+		cl.IndexStore.Store = make(map[string]IndexInfo)
+	}
+	// IndexInfo keeps a pointer to its collection which is not saved
+	for fieldLocator, info := range cl.IndexStore.Store {
+		info.cl = cl
+		cl.IndexStore.Store[fieldLocator] = info
+	}
+	cl.requiresEncryptionKey = clGob.IsEncrypted
+	if clGob.IsFrozen {
+		cl.isFrozen = 1
+	}
+	cl.prevNumPartitions = int32(clGob.PrevNumPartitions)
+
+	return nil
+}
+
+// IsMissingEncryptionKey is true if the collection was loaded from disk and is encrypted, but no EncryptionKey has
+// been provided for it yet.
+func (cl *Collection) IsMissingEncryptionKey() bool {
+	return cl.requiresEncryptionKey && !cl.isEncrypted()
+}
+
+// SetEncryptionKeys provides the keys for a collection that has been loaded from disk, since keys are never saved.
+func (cl *Collection) SetEncryptionKeys(encryptionKey []byte, previousEncryptionKey []byte) error {
+	props := cl.CollectionProps
+	props.EncryptionKey = encryptionKey
+	props.PreviousEncryptionKey = previousEncryptionKey
+	err := props.Validate()
+	if err != nil {
+		return err
+	}
+
+	cl.settingsLock.Lock()
+	cl.EncryptionKey = encryptionKey
+	cl.PreviousEncryptionKey = previousEncryptionKey
+	cl.settingsLock.Unlock()
+	return nil
+}
+
+// SetReadOnly marks a collection as being used by a read-only client, which may share it with other processes. Reads of
+// a read-only collection never change its files, e.g. a corrupted document is reported but not quarantined.
+func (cl *Collection) SetReadOnly(isReadOnly bool) {
+	cl.isReadOnly = isReadOnly
+}
@@ -0,0 +1,99 @@
+package collection
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+/********************************************************************************
+* P O O L S
+*********************************************************************************/
+
+// Reading or writing a document needs a few buffers and, for gzipped documents, a gzip reader or writer, all of which
+// are fairly big allocations. Under a high read throughput these make up most of the garbage, so they are pooled and
+// reused across ops.
+//
+// Buffers that have grown beyond MAX_POOLED_BUFFER_SIZE are not put back in the pool, so that one big document doesn't
+// keep a big buffer around for good.
+
+const MAX_POOLED_BUFFER_SIZE int = 1024 * 1024
+
+var bufferPool sync.Pool = sync.Pool{
+	New: func() interface{} { return bytes.NewBuffer(nil) },
+}
+
+var bufioReaderPool sync.Pool = sync.Pool{
+	New: func() interface{} { return bufio.NewReader(nil) },
+}
+
+var gzipWriterPool sync.Pool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// gzip.NewReader needs a valid gzip header to create a reader, so the pool starts out empty
+var gzipReaderPool sync.Pool
+
+// getBuffer returns an empty buffer, which should be given back with putBuffer once its bytes are no longer used
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > MAX_POOLED_BUFFER_SIZE {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+func getBufioReader(r io.Reader) *bufio.Reader {
+	br := bufioReaderPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+func putBufioReader(br *bufio.Reader) {
+	br.Reset(nil)
+	bufioReaderPool.Put(br)
+}
+
+func getGzipWriter(w io.Writer) *gzip.Writer {
+	gz := gzipWriterPool.Get().(*gzip.Writer)
+	gz.Reset(w)
+	return gz
+}
+
+// putGzipWriter gives back gz, which should have been closed
+func putGzipWriter(gz *gzip.Writer) {
+	gz.Reset(nil)
+	gzipWriterPool.Put(gz)
+}
+
+func getGzipReader(r io.Reader) (*gzip.Reader, error) {
+	if gz, ok := gzipReaderPool.Get().(*gzip.Reader); ok {
+		err := gz.Reset(r)
+		if err != nil {
+			gzipReaderPool.Put(gz)
+			return nil, err
+		}
+		return gz, nil
+	}
+	return gzip.NewReader(r)
+}
+
+// putGzipReader closes gz and gives it back
+func putGzipReader(gz *gzip.Reader) error {
+	err := gz.Close()
+	gzipReaderPool.Put(gz)
+	return err
+}
+
+// closerFunc lets a func be used as an io.Closer
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
@@ -0,0 +1,358 @@
+package collection
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/********************************************************************************
+* Q U A R A N T I N E
+*********************************************************************************/
+
+// When a document can't be read back because its data is corrupted (e.g. it fails to decompress, fails the gzip
+// checksum or fails to decode), it is moved out of the data dir into the quarantine dir of the collection, along with a
+// report of what went wrong. This way a single bad file doesn't fail every Search that touches it. Quarantined
+// documents can be reviewed using ListQuarantined, and then either deleted or restored (e.g. after a manual fix).
+//
+// Decryption failures are not treated as corruption, since they are just as likely to be caused by a wrong key.
+
+const QUARANTINE_DIR_NAME string = "quarantine"
+const QUARANTINE_REPORT_FILE_EXTENSION string = ".report.json"
+
+var ErrDocumentIsCorrupted = fmt.Errorf("Document data is corrupted, and the document has been quarantined")
+var ErrQuarantinedDocumentIsNotExist = fmt.Errorf("Quarantined document does not exist")
+
+// QuarantinedDoc is the report entry for a quarantined document
+type QuarantinedDoc struct {
+	Key           key.Key
+	FileName      string // name of the document file, which is kept as it is in the quarantine dir
+	Reason        string
+	QuarantinedAt time.Time
+}
+
+// corruptionError wraps errors that are caused by the data of a document being unreadable, as opposed to e.g. the
+// document not existing or the disk failing
+type corruptionError struct {
+	err error
+}
+
+func (e corruptionError) Error() string {
+	return e.err.Error()
+}
+
+// isDecodable tells whether data is valid for the encoding type at all, irrespective of the type it is being decoded
+// into. This is used to tell apart corrupted data from a dest that doesn't match the data.
+func isDecodable(encodingType uint, data []byte) bool {
+	// gob can't decode into an interface{} unless the types are registered, so we can't tell for sure
+	if encodingType == ENCODING_GOB {
+		return true
+	}
+	var v interface{}
+	return decode(encodingType, data, &v) == nil
+}
+
+func (cl *Collection) getQuarantineDirPath() string {
+	return util.JoinPath(cl.DirPath, META_DIR_NAME, QUARANTINE_DIR_NAME)
+}
+
+// quarantineIfCorrupted quarantines the document for k if err was caused by its data being corrupted, and returns
+// ErrDocumentIsCorrupted. Any other err is returned as it is.
+func (cl *Collection) quarantineIfCorrupted(k key.Key, err error) error {
+	cErr, ok := err.(corruptionError)
+	if !ok {
+		return err
+	}
+
+	if cl.isReadOnly {
+		util.Warnf("Document %s of collection %s is corrupted: %s", k, cl.Name, cErr.err)
+		return ErrDocumentIsCorrupted
+	}
+
+	util.Warnf("Document %s of collection %s is corrupted, quarantining it: %s", k, cl.Name, cErr.err)
+	qErr := cl.quarantine(k, cErr.err.Error())
+	if qErr != nil {
+		util.Errorf("Could not quarantine document %s of collection %s: %s", k, cl.Name, qErr)
+	}
+
+	return ErrDocumentIsCorrupted
+}
+
+// quarantine moves the document for k into the quarantine dir, writes a report for it, and removes it from the indexes
+func (cl *Collection) quarantine(k key.Key, reason string) error {
+	if cl.isSegmented() {
+		return cl.quarantineSegmentDoc(k, reason)
+	}
+
+	path, err := cl.getExistingFilePath(k)
+	if os.IsNotExist(err) { // already quarantined by someone else
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	dirPath := cl.getQuarantineDirPath()
+	err = util.CreateDirIfNotExist(cl.fs(), dirPath)
+	if err != nil {
+		return err
+	}
+
+	// the blob may be shared, so the quarantined file gets a copy of its own
+	if cl.isContentAddressed() {
+		err = cl.materializeDocFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	fileName := filepath.Base(path)
+
+	// write the report first, so a quarantined file never ends up without one
+	err = cl.writeQuarantineReport(k, fileName, reason)
+	if err != nil {
+		return err
+	}
+	err = cl.fs().Rename(path, util.JoinPath(dirPath, fileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = cl.syncRenamed(path)
+	if err != nil {
+		return err
+	}
+	cl.uncache(k)
+	err = cl.refreshManifestEntry(k)
+	if err != nil {
+		return err
+	}
+
+	return cl.afterQuarantine(k)
+}
+
+// quarantineSegmentDoc is quarantine for collections with STORAGE_SEGMENTS. The document has no file of its own to move,
+// so a copy of its data is written to the quarantine dir, and it is then removed from its segment.
+func (cl *Collection) quarantineSegmentDoc(k key.Key, reason string) error {
+	fileData, err := cl.readSegmentDoc(k, false)
+	if os.IsNotExist(err) { // already quarantined by someone else
+		return nil
+	}
+	if _, ok := err.(corruptionError); err != nil && !ok {
+		return err
+	}
+	// if the record itself is broken, there is no data to keep, but the report is still written
+
+	dirPath := cl.getQuarantineDirPath()
+	err = util.CreateDirIfNotExist(cl.fs(), dirPath)
+	if err != nil {
+		return err
+	}
+
+	fileName := cl.getSegmentDocFileName(k)
+	err = cl.writeQuarantineReport(k, fileName, reason)
+	if err != nil {
+		return err
+	}
+	err = cl.writeFile(util.JoinPath(dirPath, fileName), fileData)
+	if err != nil {
+		return err
+	}
+	err = cl.removeDocFile(k)
+	if err != nil {
+		return err
+	}
+	cl.uncache(k)
+
+	return cl.afterQuarantine(k)
+}
+
+func (cl *Collection) writeQuarantineReport(k key.Key, fileName string, reason string) error {
+	report := QuarantinedDoc{
+		Key:           k,
+		FileName:      fileName,
+		Reason:        reason,
+		QuarantinedAt: time.Now(),
+	}
+	reportData, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	return cl.writeFile(util.JoinPath(cl.getQuarantineDirPath(), fileName+QUARANTINE_REPORT_FILE_EXTENSION), reportData)
+}
+
+// afterQuarantine removes the quarantined document for k from the indexes, and records the quarantine in the audit log
+func (cl *Collection) afterQuarantine(k key.Key) error {
+	if cl.canIndex() {
+		err := cl.removeDocFromIndexes(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := cl.recordChange(AUDIT_OP_QUARANTINE, k)
+	if err != nil {
+		return err
+	}
+	cl.notifyChange(AUDIT_OP_QUARANTINE, k)
+	return cl.audit(AUDIT_OP_QUARANTINE, k, nil)
+}
+
+// ListQuarantined returns the reports of all the quarantined documents of the collection, oldest first
+func (cl *Collection) ListQuarantined() ([]QuarantinedDoc, error) {
+	dirPath := cl.getQuarantineDirPath()
+
+	fileInfos, err := util.ReadDir(cl.fs(), dirPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []QuarantinedDoc
+	for _, fileInfo := range fileInfos {
+		fileName := fileInfo.Name()
+		if !strings.HasSuffix(fileName, QUARANTINE_REPORT_FILE_EXTENSION) {
+			continue
+		}
+		data, err := util.ReadFile(cl.fs(), util.JoinPath(dirPath, fileName))
+		if err != nil {
+			return nil, err
+		}
+		var doc QuarantinedDoc
+		err = json.Unmarshal(data, &doc)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+
+	sort.Slice(docs, func(i, j int) bool { return docs[i].QuarantinedAt.Before(docs[j].QuarantinedAt) })
+
+	return docs, nil
+}
+
+func (cl *Collection) getQuarantinedDoc(k key.Key) (QuarantinedDoc, error) {
+	docs, err := cl.ListQuarantined()
+	if err != nil {
+		return QuarantinedDoc{}, err
+	}
+	for _, doc := range docs {
+		if doc.Key == k {
+			return doc, nil
+		}
+	}
+	return QuarantinedDoc{}, ErrQuarantinedDocumentIsNotExist
+}
+
+// DeleteQuarantined permanently deletes the quarantined document for k, along with its report
+func (cl *Collection) DeleteQuarantined(k key.Key) error {
+	defer cl.lockKey(k)()
+
+	doc, err := cl.getQuarantinedDoc(k)
+	if err != nil {
+		return err
+	}
+
+	dirPath := cl.getQuarantineDirPath()
+	err = cl.fs().Remove(util.JoinPath(dirPath, doc.FileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return cl.fs().Remove(util.JoinPath(dirPath, doc.FileName+QUARANTINE_REPORT_FILE_EXTENSION))
+}
+
+// RestoreQuarantined moves the quarantined document for k back into the collection and adds it to the indexes. If the
+// document is still corrupted, it ends up back in the quarantine and ErrDocumentIsCorrupted is returned.
+func (cl *Collection) RestoreQuarantined(k key.Key) error {
+	defer cl.lockKey(k)()
+
+	doc, err := cl.getQuarantinedDoc(k)
+	if err != nil {
+		return err
+	}
+
+	// a new version of the document may have been written since it was quarantined, which we shouldn't overwrite
+	if err := cl.checkDocExists(k); err == nil {
+		return fmt.Errorf("cannot restore quarantined document %s: the document already exists in collection %s", k, cl.Name)
+	}
+
+	if cl.isSegmented() {
+		err = cl.restoreQuarantinedSegmentDoc(k, doc)
+	} else {
+		err = cl.restoreQuarantinedFile(k, doc)
+	}
+	if err != nil {
+		return err
+	}
+
+	if cl.canIndex() {
+		err = cl.addDocToIndexes(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = cl.recordChange(AUDIT_OP_SET, k)
+	if err != nil {
+		return err
+	}
+	cl.notifyChange(AUDIT_OP_SET, k) // to subscribers, the document is back as if it had been set
+	return nil
+}
+
+// restoreQuarantinedFile moves the quarantined file back into its partition dir
+func (cl *Collection) restoreQuarantinedFile(k key.Key, doc QuarantinedDoc) error {
+	dirPath := util.JoinPath(cl.getDataPath(), k.GetPartitionDirName(cl.getNumPartitions()))
+	err := util.CreateDirIfNotExist(cl.fs(), dirPath)
+	if err != nil {
+		return err
+	}
+
+	path := util.JoinPath(dirPath, doc.FileName)
+	qDirPath := cl.getQuarantineDirPath()
+	err = cl.fs().Rename(util.JoinPath(qDirPath, doc.FileName), path)
+	if err != nil {
+		return err
+	}
+	err = cl.syncRenamed(path)
+	if err != nil {
+		return err
+	}
+	cl.uncache(k)
+	err = cl.refreshManifestEntry(k)
+	if err != nil {
+		return err
+	}
+	return cl.fs().Remove(util.JoinPath(qDirPath, doc.FileName+QUARANTINE_REPORT_FILE_EXTENSION))
+}
+
+// restoreQuarantinedSegmentDoc appends the quarantined data to the segments of the collection, and removes it from the
+// quarantine dir
+func (cl *Collection) restoreQuarantinedSegmentDoc(k key.Key, doc QuarantinedDoc) error {
+	qDirPath := cl.getQuarantineDirPath()
+	fileData, err := util.ReadFile(cl.fs(), util.JoinPath(qDirPath, doc.FileName))
+	if err != nil {
+		return err
+	}
+	err = cl.storeDocFile(k, fileData)
+	if err != nil {
+		return err
+	}
+	cl.uncache(k)
+
+	err = cl.fs().Remove(util.JoinPath(qDirPath, doc.FileName))
+	if err != nil {
+		return err
+	}
+	return cl.fs().Remove(util.JoinPath(qDirPath, doc.FileName+QUARANTINE_REPORT_FILE_EXTENSION))
+}
@@ -0,0 +1,111 @@
+package collection
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"os"
+)
+
+/********************************************************************************
+* Q U O T A S
+*********************************************************************************/
+
+// If MaxDocs or MaxBytes is set, writes that would take the collection over either of them fail with ErrQuotaExceeded,
+// and leave the collection as it was. The bytes counted are the stored size of the documents, as in Stats.StoredBytes.
+// Checking a write uses the stats of the collection, so the first write gathers them (see GetStats). Writes to different
+// documents that run at the same time are each checked against the collection as it was before them, so together they
+// can go over the quota by a little.
+//
+// A capped collection (Capped is set) makes room for new documents instead: once a document has been written, the
+// documents that were written the longest ago are deleted until the collection is within MaxDocs and MaxBytes again,
+// which keeps a rolling window of the most recent documents. Only a document that is larger than MaxBytes on its own is
+// refused. Rewriting a document (including by SetGzipCompression or ChangeEncoding) counts as writing it. A collection
+// with an EvictionPolicy makes room in the same way, but picks the documents to evict by it, see EvictionPolicy.
+
+var ErrQuotaExceeded = fmt.Errorf("The write would take the collection over its MaxDocs or MaxBytes quota")
+
+// hasQuota tells whether MaxDocs or MaxBytes is set
+func (cl *Collection) hasQuota() bool {
+	cl.settingsLock.RLock()
+	defer cl.settingsLock.RUnlock()
+	return cl.MaxDocs > 0 || cl.MaxBytes > 0
+}
+
+// isCapped tells whether documents are evicted to keep the collection within its quota
+func (cl *Collection) isCapped() bool {
+	cl.settingsLock.RLock()
+	defer cl.settingsLock.RUnlock()
+	return cl.Capped || cl.EvictionPolicy != EVICTION_POLICY_NONE
+}
+
+// isOverQuota tells whether numDocs documents of storedBytes bytes in total are over the quota of the collection
+func (cl *Collection) isOverQuota(numDocs int, storedBytes int64) bool {
+	cl.settingsLock.RLock()
+	defer cl.settingsLock.RUnlock()
+	return (cl.MaxDocs > 0 && numDocs > cl.MaxDocs) || (cl.MaxBytes > 0 && storedBytes > cl.MaxBytes)
+}
+
+// checkQuota returns ErrQuotaExceeded if storing fileSize bytes as the document for k would take the collection over
+// its quota. For a capped collection, it only checks that the document fits on its own.
+func (cl *Collection) checkQuota(k key.Key, fileSize int64) error {
+	if !cl.hasQuota() {
+		return nil
+	}
+	if cl.isCapped() {
+		if cl.isOverQuota(1, fileSize) {
+			return ErrQuotaExceeded
+		}
+		return nil
+	}
+	s, err := cl.getStats()
+	if err != nil {
+		return err
+	}
+
+	cl.statsLock.Lock()
+	numDocs, storedBytes := len(s.docs), s.storedBytes
+	d, ok := s.docs[k]
+	cl.statsLock.Unlock()
+	if !ok {
+		numDocs++
+	}
+	storedBytes += fileSize - d.storedBytes
+
+	if cl.isOverQuota(numDocs, storedBytes) {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// evict deletes the documents that were written the longest ago (or the ones picked by the EvictionPolicy), other than
+// the one for k, until the collection is within its quota again. It is a no-op unless the collection is capped. It takes
+// the key locks of the documents it deletes, so it should be called once the key lock for k has been released.
+func (cl *Collection) evict(k key.Key) error {
+	if !cl.isCapped() {
+		return nil
+	}
+	policy := cl.getEvictionPolicy()
+	for {
+		s, err := cl.getStats()
+		if err != nil {
+			return err
+		}
+
+		cl.statsLock.Lock()
+		isOver := cl.isOverQuota(len(s.docs), s.storedBytes)
+		evictee, found := s.pickEvictee(policy, &k)
+		cl.statsLock.Unlock()
+		if !isOver || !found {
+			return nil
+		}
+
+		err = cl.deleteNow(evictee)
+		if os.IsNotExist(err) { // deleted by someone else meanwhile, or the stats are behind
+			cl.noteRemovedDoc(evictee)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("evicting document %d: %w", evictee, err)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package collection
+
+import (
+	"context"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"os"
+	"strings"
+	"time"
+)
+
+/********************************************************************************
+* C R A S H  R E C O V E R Y
+*********************************************************************************/
+
+// Files that are written to a temporary location and then renamed into place start with this prefix. If one of them
+// is found when recovering, the process crashed before the rename, and the original file is still intact.
+const TEMP_FILE_PREFIX string = "tmp_"
+
+// Recover looks for evidence of operations that were interrupted by a crash, and brings the collection back to a
+// consistent state. It returns the number of problems that were fixed, all of which are logged. It should be called
+// before the collection is used.
+func (cl *Collection) Recover() (int, error) {
+	var numFixed int
+
+	// 1. Temp files: remove them, since the op that created them never completed
+	n, err := cl.removeTempFiles(0)
+	if err != nil {
+		return numFixed, err
+	}
+	numFixed += n
+
+	// 2. WAL: apply all the ops that were logged but never committed
+	n, err = cl.ReplayWAL()
+	if err != nil {
+		return numFixed, err
+	}
+	if n > 0 {
+		util.Warnf("Recovery: replayed %d uncommitted ops from the WAL of collection %s", n, cl.Name)
+	}
+	numFixed += n
+
+	// 3. Index journal: update the indexes for the documents that were being changed
+	n, err = cl.ReplayIndexJournal()
+	if err != nil {
+		return numFixed, err
+	}
+	if n > 0 {
+		util.Warnf("Recovery: reindexed %d documents from the index journal of collection %s", n, cl.Name)
+	}
+	numFixed += n
+
+	// 4. Indexes: an index is saved right after a document is written, so an index that is older than a document (or is
+	// missing) may not know about that document. Rebuild it.
+	n, err = cl.rebuildStaleIndexes()
+	if err != nil {
+		return numFixed, err
+	}
+	numFixed += n
+
+	// 5. Manifests: if the collection wasn't closed cleanly, the manifests may be missing the last changes. Remove them,
+	// so they are rebuilt from the partition dirs.
+	removed, err := cl.removeDirtyManifests()
+	if err != nil {
+		return numFixed, err
+	}
+	if removed {
+		util.Warnf("Recovery: manifests of collection %s may be out of date, rebuilding them", cl.Name)
+		numFixed++
+	}
+
+	return numFixed, nil
+}
+
+// removeTempFiles removes the temp files in the meta dir, which is where writeFile creates them, and in the partition
+// dirs, in case an older version or another tool left any there. Only the files that haven't been changed for minAge are
+// removed, so that the ones of the writes in progress are left alone. It returns the number of files removed.
+func (cl *Collection) removeTempFiles(minAge time.Duration) (int, error) {
+	var numRemoved int
+
+	dirPaths := []string{util.JoinPath(cl.DirPath, META_DIR_NAME)}
+	pDirNames, err := cl.getDirNames(cl.getDataPath())
+	if err != nil {
+		return 0, err
+	}
+	for _, pDirName := range pDirNames {
+		pDirPath := util.JoinPath(cl.getDataPath(), pDirName)
+		if info, err := cl.fs().Stat(pDirPath); err == nil && info.IsDir() {
+			dirPaths = append(dirPaths, pDirPath)
+		}
+	}
+
+	for _, dirPath := range dirPaths {
+		names, err := cl.getDirNames(dirPath)
+		if err != nil {
+			return numRemoved, err
+		}
+
+		for _, name := range names {
+			// document file names start with the collection name, which could itself start with the prefix
+			if !strings.HasPrefix(name, TEMP_FILE_PREFIX) || strings.HasPrefix(name, cl.Name+"_") {
+				continue
+			}
+			path := util.JoinPath(dirPath, name)
+			info, err := cl.fs().Stat(path)
+			if os.IsNotExist(err) { // renamed into place since it was listed
+				continue
+			}
+			if err != nil {
+				return numRemoved, err
+			}
+			if info.IsDir() || time.Since(info.ModTime()) < minAge {
+				continue
+			}
+			util.Warnf("Removing temp file left behind by an interrupted operation: %s", path)
+			err = cl.fs().Remove(path)
+			if err != nil {
+				return numRemoved, err
+			}
+			numRemoved++
+		}
+	}
+
+	return numRemoved, nil
+}
+
+// getDirNames returns the names of everything in the dir at path, or nothing if it doesn't exist
+func (cl *Collection) getDirNames(path string) ([]string, error) {
+	dir, err := cl.fs().Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	return dir.Readdirnames(-1)
+}
+
+func (cl *Collection) rebuildStaleIndexes() (int, error) {
+	var numRebuilt int
+
+	cl.IndexStore.RLock()
+	var fieldLocators []string
+	for fieldLocator := range cl.IndexStore.Store {
+		fieldLocators = append(fieldLocators, fieldLocator)
+	}
+	cl.IndexStore.RUnlock()
+
+	if len(fieldLocators) == 0 {
+		return 0, nil
+	}
+
+	// Find when the last document was written
+	var lastDocModTime time.Time
+	err := cl.forEachDoc(func(k key.Key, docPath string) error {
+		info, err := cl.fs().Stat(docPath)
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(lastDocModTime) {
+			lastDocModTime = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, fieldLocator := range fieldLocators {
+		idx := cl.NewIndex(fieldLocator)
+
+		info, err := cl.fs().Stat(idx.FilePath)
+		if err != nil && !os.IsNotExist(err) {
+			return numRebuilt, err
+		}
+		if err == nil && !info.ModTime().Before(lastDocModTime) {
+			continue
+		}
+
+		util.Warnf("Recovery: index on %s of collection %s is missing or older than the data, rebuilding it", fieldLocator, cl.Name)
+		err = cl.rebuildIndex(fieldLocator)
+		if err != nil {
+			return numRebuilt, err
+		}
+
+		numRebuilt++
+	}
+
+	return numRebuilt, nil
+}
+
+// rebuildIndex builds the index on fieldLocator from scratch, and replaces the existing one with it
+func (cl *Collection) rebuildIndex(fieldLocator string) error {
+	// Otherwise, batched changes to the old index could overwrite the new one when they are flushed
+	err := cl.FlushIndexes()
+	if err != nil {
+		return err
+	}
+
+	idx := cl.NewIndex(fieldLocator)
+
+	err = idx.build(context.Background())
+	if err != nil {
+		return err
+	}
+	err = idx.save()
+	if err != nil {
+		return err
+	}
+
+	cl.IndexStore.Lock()
+	cl.IndexStore.Store[idx.FieldLocator] = idx.IndexInfo
+	cl.IndexStore.Unlock()
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package collection
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/********************************************************************************
+* R E N A M I N G
+*********************************************************************************/
+
+// The name of a collection is part of the name of every document file (and of its cold and revision files), and the
+// index files record the path they are saved at. Renaming a collection therefore renames its dir, and then all those
+// files, and rewrites its indexes. Manifests record file names as well, so they are thrown away, to be rebuilt.
+
+// Rename renames the collection to newName, and moves it to newDirPath. The collection should have been closed. If
+// Rename is interrupted, it can be called again with the same args to finish it.
+func (cl *Collection) Rename(newName, newDirPath string) error {
+	// wait for any writes that are still in progress
+	cl.readSnapshotsLock.Lock()
+	defer cl.readSnapshotsLock.Unlock()
+
+	oldName := cl.Name
+	if cl.DirPath != newDirPath {
+		_, err := cl.fs().Stat(cl.DirPath)
+		if err == nil {
+			if _, err := cl.fs().Stat(newDirPath); err == nil {
+				return fmt.Errorf("cannot move collection %s to %s, since it already exists", cl.Name, newDirPath)
+			}
+			err = cl.fs().Rename(cl.DirPath, newDirPath)
+		}
+		// if the dir isn't there anymore, it has been moved already
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	cl.Name = newName
+	cl.DirPath = newDirPath
+
+	if oldName != newName {
+		err := cl.renameDocFiles(oldName)
+		if err != nil {
+			return err
+		}
+	}
+	err := cl.removeManifests()
+	if err != nil {
+		return err
+	}
+
+	// loading an index sets its new path, and saving it writes that into the index file
+	cl.IndexStore.Lock()
+	var fieldLocators []string
+	for fieldLocator, info := range cl.IndexStore.Store {
+		info.CollectionName = cl.Name
+		info.FilePath = util.JoinPath(cl.GetDirPathForIndexes(), fieldLocator)
+		cl.IndexStore.Store[fieldLocator] = info
+		fieldLocators = append(fieldLocators, fieldLocator)
+	}
+	cl.IndexStore.Unlock()
+
+	for _, fieldLocator := range fieldLocators {
+		idx, err := cl.loadIndex(fieldLocator)
+		if err != nil {
+			return err
+		}
+		err = idx.save()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameDocFiles renames the files of the collection dir that are named after oldName, i.e. the document files and their
+// cold and revision files. The meta dir is left alone: the quarantine reports refer to the files in it by name.
+func (cl *Collection) renameDocFiles(oldName string) error {
+	oldPrefix := oldName + "_" + key.DOC_FILE_NAME_PREFIX
+	newPrefix := cl.Name + "_" + key.DOC_FILE_NAME_PREFIX
+	metaDirPath := util.JoinPath(cl.DirPath, META_DIR_NAME)
+
+	return util.Walk(cl.fs(), cl.DirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == metaDirPath {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// revision files have their number in front of the document file name
+		name := info.Name()
+		i := strings.Index(name, oldPrefix)
+		if i < 0 || (i > 0 && name[i-1] != '_') {
+			return nil
+		}
+		newPath := util.JoinPath(filepath.Dir(path), name[:i]+newPrefix+name[i+len(oldPrefix):])
+		return cl.fs().Rename(path, newPath)
+	})
+}
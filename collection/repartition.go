@@ -0,0 +1,478 @@
+package collection
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+/********************************************************************************
+* R E P A R T I T I O N I N G
+*********************************************************************************/
+
+// The partition of a document only decides which dir its file is in, so unlike Alter, changing the number of partitions
+// doesn't need to rewrite the documents, and the collection can be read and written all along. StartRepartition
+// switches the collection over to the new number of partitions right away, and remembers the old one. From then on:
+//   - writes go to the new partitions. Taking the key lock of a document (which every write does, see lockKey) first
+//     moves its files from their old partition dirs to their new ones: the document file, its cold file (see tiering)
+//     and its revisions, which are kept in partition dirs of their own.
+//   - reads look for a document in its new partition dir first, and then in its old one.
+//
+// FinishRepartition then goes through the partition dirs, moving every document that is still in its old one the same
+// way, and forgets the old number of partitions once it is done. The manifests are thrown away when the repartitioning
+// starts, and not used until it is finished, and the stats are dropped. Indexes, expiries and the audit trail only know
+// the documents by their keys, so they stay as they are.
+//
+// The old number of partitions is saved with the collection, so an interrupted repartitioning (e.g. by a crash) leaves
+// a collection that can still be used, and FinishRepartition can be called again to finish it. The partition dirs that
+// it has gone through are recorded in a progress file as it goes, so that it carries on from where it was. Scans that
+// run while the documents are being moved may miss a document, or see it twice, if it moves from a partition dir that
+// they haven't listed yet to one that they have, or the other way around.
+//
+// PlanRepartition lists the documents that a repartitioning would move, without moving anything.
+
+const REPARTITION_PROGRESS_FILE_NAME string = "repartition_progress"
+
+var ErrRepartitionInProgress = fmt.Errorf("The collection is already being repartitioned to a different number of partitions")
+
+// StartRepartition switches the collection over to numPartitions partitions, see FinishRepartition. The collection
+// should be saved before FinishRepartition is called, so that the old number of partitions isn't lost. It is a no-op if
+// the collection is already being repartitioned to numPartitions, and returns ErrRepartitionInProgress if it is being
+// repartitioned to another number. It is not supported for collections with STORAGE_SEGMENTS, which have no partition
+// dirs: see Alter.
+func (cl *Collection) StartRepartition(numPartitions int) error {
+	if cl.isSegmented() {
+		return ErrSegmentStorageNotSupported
+	}
+	if numPartitions < 1 {
+		return fmt.Errorf("the number of partitions must be > 0, got %d", numPartitions)
+	}
+
+	// Every write either finishes before the switch, or starts after it and moves the files of its document first
+	cl.lockAllKeys()
+	defer cl.unlockAllKeys()
+
+	if cl.isRepartitioning() {
+		if numPartitions != cl.getNumPartitions() {
+			return ErrRepartitionInProgress
+		}
+		return nil
+	}
+	oldNumPartitions := cl.getNumPartitions()
+	if numPartitions == oldNumPartitions {
+		return nil
+	}
+
+	err := cl.closeManifests()
+	if err != nil {
+		return err
+	}
+	err = cl.fs().RemoveAll(cl.getManifestsDirPath())
+	if err != nil {
+		return err
+	}
+	// left behind by a repartitioning that was finished, but not saved as such
+	err = cl.fs().Remove(util.JoinPath(cl.DirPath, META_DIR_NAME, REPARTITION_PROGRESS_FILE_NAME))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	cl.settingsLock.Lock()
+	cl.NumPartitions = numPartitions
+	atomic.StoreInt32(&cl.prevNumPartitions, int32(oldNumPartitions))
+	cl.settingsLock.Unlock()
+	cl.dropStats()
+	return nil
+}
+
+type (
+	// RepartitionProgress is how far a repartitioning has got, see GetRepartitionProgress
+	RepartitionProgress struct {
+		NumPartitions     int // the number of partitions that the collection is being repartitioned to
+		PrevNumPartitions int // the number of partitions that it had before
+		NumDirs           int // the number of partition dirs (of documents, cold documents and revisions) to go through
+		NumDirsDone       int // the number of those that have been gone through, including before a resume
+		NumMoved          int // the number of documents moved by FinishRepartition since it was last called
+	}
+
+	// RepartitionMove is a document that a repartitioning would move, see PlanRepartition
+	RepartitionMove struct {
+		Key  key.Key
+		From string // the name of the partition dir that the document is in
+		To   string // the name of the partition dir that it would be moved to
+	}
+)
+
+// FinishRepartition moves the documents that are still in their old partition dirs to their new ones, and ends the
+// repartitioning started by StartRepartition. If onProgress isn't nil, it is called with the progress of the
+// repartitioning every time a partition dir has been gone through. It returns the number of documents that it moved. It
+// is a no-op if the collection isn't being repartitioned. The collection should be saved afterwards. If some documents
+// could not be moved, it fails once it has gone through all the dirs, and the collection is still being repartitioned,
+// so that calling it again picks up from there.
+func (cl *Collection) FinishRepartition(onProgress func(RepartitionProgress)) (int, error) {
+	if !cl.isRepartitioning() {
+		return 0, nil
+	}
+
+	progressPath := util.JoinPath(cl.DirPath, META_DIR_NAME, REPARTITION_PROGRESS_FILE_NAME)
+	done, err := cl.readRepartitionProgress(progressPath)
+	if err != nil {
+		return 0, err
+	}
+	if len(done) > 0 {
+		util.Infof("Resuming repartitioning of collection %s: %d partition dirs already done", cl.Name, len(done))
+	}
+
+	// The cold files and revisions are moved along with their documents, so only the ones of documents that have been
+	// deleted since, or that a crash left behind, are found in their dirs
+	var pDirPaths []string
+	for _, dirPath := range []string{cl.getDataPath(), cl.getColdDirPath(), cl.getRevisionsDirPath()} {
+		paths, err := cl.getOldPartitionDirPaths(dirPath)
+		if err != nil {
+			return 0, err
+		}
+		pDirPaths = append(pDirPaths, paths...)
+	}
+	progress := RepartitionProgress{NumDirs: len(pDirPaths)}
+	cl.setRepartitionProgress(progress)
+
+	err = util.CreateDirIfNotExist(cl.fs(), filepath.Dir(progressPath))
+	if err != nil {
+		return 0, err
+	}
+	progressFile, err := cl.fs().OpenFile(progressPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, util.FILE_PERM)
+	if err != nil {
+		return 0, err
+	}
+	defer progressFile.Close()
+
+	// A dir that some documents could not be moved out of is not recorded as done, and the other dirs are still gone
+	// through, so that only those documents are left for the next time
+	var moveErr error
+	for _, pDirPath := range pDirPaths {
+		relPath := strings.TrimPrefix(pDirPath, cl.DirPath+string(os.PathSeparator))
+		if !done[relPath] {
+			n, err := cl.moveToNewPartition(pDirPath)
+			progress.NumMoved += n
+			if err != nil {
+				util.Warnf("Repartitioning collection %s: %s: %v", cl.Name, relPath, err)
+				if moveErr == nil {
+					moveErr = fmt.Errorf("%s: %w", relPath, err)
+				}
+				continue
+			}
+			// record that this dir is done, so we can skip it if we have to resume
+			_, err = fmt.Fprintln(progressFile, relPath)
+			if err != nil {
+				return progress.NumMoved, err
+			}
+		}
+		progress.NumDirsDone++
+		cl.setRepartitionProgress(progress)
+		if onProgress != nil {
+			onProgress(cl.getRepartitionProgress())
+		}
+	}
+	util.Infof("Repartitioning collection %s: moved %d documents", cl.Name, progress.NumMoved)
+	if moveErr != nil {
+		cl.setRepartitionProgress(progress)
+		return progress.NumMoved, moveErr
+	}
+
+	// All done
+	err = progressFile.Close()
+	if err != nil {
+		return progress.NumMoved, err
+	}
+	err = cl.fs().Remove(progressPath)
+	if err != nil {
+		return progress.NumMoved, err
+	}
+
+	cl.lockAllKeys()
+	defer cl.unlockAllKeys()
+	cl.settingsLock.Lock()
+	atomic.StoreInt32(&cl.prevNumPartitions, 0)
+	cl.settingsLock.Unlock()
+	cl.setRepartitionProgress(RepartitionProgress{})
+	cl.dropStats()
+	return progress.NumMoved, nil
+}
+
+// GetRepartitionProgress returns how far the repartitioning of the collection has got, and false if it isn't being
+// repartitioned. The dirs are only known once FinishRepartition has listed them.
+func (cl *Collection) GetRepartitionProgress() (RepartitionProgress, bool) {
+	if !cl.isRepartitioning() {
+		return RepartitionProgress{}, false
+	}
+	return cl.getRepartitionProgress(), true
+}
+
+func (cl *Collection) getRepartitionProgress() RepartitionProgress {
+	cl.repartitionLock.Lock()
+	p := cl.repartitionProgress
+	cl.repartitionLock.Unlock()
+
+	cl.settingsLock.RLock()
+	p.NumPartitions = cl.NumPartitions
+	p.PrevNumPartitions = int(atomic.LoadInt32(&cl.prevNumPartitions))
+	cl.settingsLock.RUnlock()
+	return p
+}
+
+func (cl *Collection) setRepartitionProgress(p RepartitionProgress) {
+	cl.repartitionLock.Lock()
+	cl.repartitionProgress = p
+	cl.repartitionLock.Unlock()
+}
+
+// PlanRepartition returns the documents that repartitioning the collection to numPartitions would move, without moving
+// anything. Their revisions would be moved along with them. If the collection is being repartitioned already, the
+// documents are listed from where they are now, in either their old or their new partition dirs.
+func (cl *Collection) PlanRepartition(numPartitions int) ([]RepartitionMove, error) {
+	if cl.isSegmented() {
+		return nil, ErrSegmentStorageNotSupported
+	}
+	if numPartitions < 1 {
+		return nil, fmt.Errorf("the number of partitions must be > 0, got %d", numPartitions)
+	}
+
+	var moves []RepartitionMove
+	for _, dirPath := range []string{cl.getDataPath(), cl.getColdDirPath()} {
+		pDirInfos, err := util.ReadDir(cl.fs(), dirPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, pDirInfo := range pDirInfos {
+			if !pDirInfo.IsDir() || !strings.HasPrefix(pDirInfo.Name(), key.DATA_PARTITION_PREFIX) {
+				continue
+			}
+			infos, err := util.ReadDir(cl.fs(), util.JoinPath(dirPath, pDirInfo.Name()))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, info := range infos {
+				k, ok := parsePartitionedFileName(info.Name())
+				if !ok {
+					continue
+				}
+				if to := k.GetPartitionDirName(numPartitions); to != pDirInfo.Name() {
+					moves = append(moves, RepartitionMove{Key: k, From: pDirInfo.Name(), To: to})
+				}
+			}
+		}
+	}
+	sort.Slice(moves, func(i, j int) bool { return moves[i].Key < moves[j].Key })
+	return moves, nil
+}
+
+// readRepartitionProgress returns the partition dirs (relative to the dir of the collection) that a repartitioning has
+// already gone through, as recorded at path
+func (cl *Collection) readRepartitionProgress(path string) (map[string]bool, error) {
+	var done map[string]bool = make(map[string]bool)
+
+	file, err := cl.fs().Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// the last line may be incomplete if we were interrupted while writing it, in which case it matches no dir
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		done[scanner.Text()] = true
+	}
+	return done, scanner.Err()
+}
+
+// IsRepartitioning tells whether StartRepartition has been called for the collection, and FinishRepartition hasn't
+// finished yet
+func (cl *Collection) IsRepartitioning() bool {
+	return cl.isRepartitioning()
+}
+
+func (cl *Collection) isRepartitioning() bool {
+	return atomic.LoadInt32(&cl.prevNumPartitions) > 0
+}
+
+// lockAllKeys takes the key locks of all the documents, in order
+func (cl *Collection) lockAllKeys() {
+	for i := range cl.keyLocks {
+		cl.keyLocks[i].Lock()
+	}
+}
+
+func (cl *Collection) unlockAllKeys() {
+	for i := range cl.keyLocks {
+		cl.keyLocks[i].Unlock()
+	}
+}
+
+// getOldPartitionDirPaths returns the paths of the partition dirs in dirPath that documents may have to be moved out
+// of, i.e. all of them, since a dir that the documents are moved into may have been one that they are moved out of too
+func (cl *Collection) getOldPartitionDirPaths(dirPath string) ([]string, error) {
+	pDirInfos, err := util.ReadDir(cl.fs(), dirPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var pDirPaths []string
+	for _, pDirInfo := range pDirInfos {
+		if pDirInfo.IsDir() && strings.HasPrefix(pDirInfo.Name(), key.DATA_PARTITION_PREFIX) {
+			pDirPaths = append(pDirPaths, util.JoinPath(dirPath, pDirInfo.Name()))
+		}
+	}
+	return pDirPaths, nil
+}
+
+// moveToNewPartition moves the files (or dirs) in the partition dir at pDirPath that aren't in their new partition dir
+// yet, one document at a time, and removes the dir if it is left empty. It returns the number of documents that it
+// moved. The documents that can't be moved are left where they are, and the first error is returned once the others
+// have been moved.
+func (cl *Collection) moveToNewPartition(pDirPath string) (int, error) {
+	pDirName := filepath.Base(pDirPath)
+	infos, err := util.ReadDir(cl.fs(), pDirPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var numMoved, numLeft int
+	var moveErr error // the first error from moving a document
+	for _, info := range infos {
+		k, ok := parsePartitionedFileName(info.Name())
+		if !ok { // e.g. a temp file, which the recovery pass takes care of
+			numLeft++
+			continue
+		}
+		if k.GetPartitionDirName(cl.getNumPartitions()) == pDirName {
+			numLeft++
+			continue
+		}
+		unlock := cl.lockKeyStripe(k)
+		err := cl.migrateDoc(k)
+		unlock()
+		if err != nil {
+			if moveErr == nil {
+				moveErr = fmt.Errorf("could not move document %s: %w", k.String(), err)
+			}
+			numLeft++
+			continue
+		}
+		numMoved++
+	}
+	if moveErr != nil {
+		return numMoved, moveErr
+	}
+
+	// a write may have just recreated the dir, in which case it isn't empty anymore
+	if numLeft == 0 && !cl.isInNewPartitions(pDirName) {
+		err = cl.fs().Remove(pDirPath)
+		if err != nil && !os.IsNotExist(err) {
+			util.Warnf("Repartitioning collection %s: could not remove %s: %v", cl.Name, pDirPath, err)
+		}
+	}
+	return numMoved, nil
+}
+
+// migrateDoc moves the files of the document for k from their old partition dirs to their new ones, if the collection
+// is being repartitioned. It should be called while holding the key lock for k, see lockKey.
+func (cl *Collection) migrateDoc(k key.Key) error {
+	prevNumPartitions := int(atomic.LoadInt32(&cl.prevNumPartitions))
+	if prevNumPartitions == 0 {
+		return nil
+	}
+	oldPDirName, newPDirName := k.GetPartitionDirName(prevNumPartitions), k.GetPartitionDirName(cl.getNumPartitions())
+	if oldPDirName == newPDirName {
+		return nil
+	}
+
+	docFileNames := []string{cl.getDocFileName(k, false), cl.getDocFileName(k, true)}
+	// The document file is moved last, so that its cold file or revisions are never left behind once it has moved
+	for _, move := range []struct {
+		dirPath string
+		names   []string
+	}{
+		{cl.getRevisionsDirPath(), []string{k.String()}},
+		{cl.getColdDirPath(), []string{docFileNames[0] + COLD_FILE_EXTENSION, docFileNames[1] + COLD_FILE_EXTENSION}},
+		{cl.getDataPath(), docFileNames},
+	} {
+		for _, name := range move.names {
+			oldPath := util.JoinPath(move.dirPath, oldPDirName, name)
+			if _, err := cl.fs().Stat(oldPath); os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			newPDirPath := util.JoinPath(move.dirPath, newPDirName)
+			err := util.CreateDirIfNotExist(cl.fs(), newPDirPath)
+			if err != nil {
+				return err
+			}
+			err = cl.fs().Rename(oldPath, util.JoinPath(newPDirPath, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// getOldPartitionPath returns the path of the file named name in the partition dir in dirPath that the document for k
+// was in before the collection started being repartitioned, or "" if it isn't being repartitioned
+func (cl *Collection) getOldPartitionPath(dirPath string, k key.Key, name string) string {
+	prevNumPartitions := int(atomic.LoadInt32(&cl.prevNumPartitions))
+	if prevNumPartitions == 0 {
+		return ""
+	}
+	return util.JoinPath(dirPath, k.GetPartitionDirName(prevNumPartitions), name)
+}
+
+// isInOldPartition tells whether pDirName is the partition dir that the document for k was in before the collection
+// started being repartitioned
+func (cl *Collection) isInOldPartition(k key.Key, pDirName string) bool {
+	prevNumPartitions := int(atomic.LoadInt32(&cl.prevNumPartitions))
+	return prevNumPartitions > 0 && k.GetPartitionDirName(prevNumPartitions) == pDirName
+}
+
+// isInNewPartitions tells whether pDirName is the name of one of the partition dirs for the current NumPartitions
+func (cl *Collection) isInNewPartitions(pDirName string) bool {
+	numPartitions := cl.getNumPartitions()
+	for i := 0; i < numPartitions; i++ {
+		if key.Key(i).GetPartitionDirName(numPartitions) == pDirName {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePartitionedFileName returns the key of the document that a file (or dir) in a partition dir is for: a document
+// file, a cold file, or a dir of revisions
+func parsePartitionedFileName(name string) (key.Key, bool) {
+	if !strings.Contains(name, key.DOC_FILE_NAME_PREFIX) {
+		k, err := key.ParseKey(name)
+		return k, err == nil
+	}
+	k, err := key.GetKeyFromFileName(strings.TrimSuffix(name, COLD_FILE_EXTENSION))
+	return k, err == nil
+}
@@ -0,0 +1,208 @@
+package collection
+
+import (
+	"context"
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"os"
+	"sync"
+	"time"
+)
+
+/********************************************************************************
+* S T A L E  W H I L E  R E V A L I D A T E
+*********************************************************************************/
+
+// With SoftTTL set, a document becomes stale once it was written longer than SoftTTL ago, going by the modification time
+// of its file. GetStaleWhileRevalidate returns a stale document as it is, and refreshes it in the background with the
+// Loader of the collection (see SetLoader), which gives the fresh data for a key, e.g. from the database that the
+// collection is a cache of. A document that doesn't exist is loaded right away instead.
+//
+// Only one refresh of a document runs at a time, however many stale reads it gets. The fresh data is only written back
+// if the document hasn't changed since the refresh started: if it has been written (or deleted) meanwhile, the newer
+// write wins, rather than being overwritten by data that may be older. The document keeps its expiration time, if it
+// has one. Refreshes are given a context that is canceled when the collection is closed, which waits for them.
+
+var ErrLoaderNotSet = fmt.Errorf("The collection does not have a loader, see SetLoader")
+
+// Loader returns the fresh data of the document for k
+type Loader func(ctx context.Context, k key.Key) ([]byte, error)
+
+type refresher struct {
+	loader     Loader
+	inProgress map[key.Key]bool
+	ctx        context.Context // canceled by Close, see stopRefreshes
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+	sync.Mutex
+}
+
+// SetLoader sets the func that GetStaleWhileRevalidate refreshes documents with
+func (cl *Collection) SetLoader(fn Loader) {
+	cl.refresher.Lock()
+	defer cl.refresher.Unlock()
+	cl.refresher.loader = fn
+}
+
+func (cl *Collection) getLoader() Loader {
+	cl.refresher.Lock()
+	defer cl.refresher.Unlock()
+	return cl.refresher.loader
+}
+
+func (cl *Collection) getSoftTTL() time.Duration {
+	cl.settingsLock.RLock()
+	defer cl.settingsLock.RUnlock()
+	return cl.SoftTTL
+}
+
+// GetStaleWhileRevalidate returns the data of the document for k, and whether it is stale, in which case it is refreshed
+// in the background. If there is no document for k, it is loaded, written and returned.
+func (cl *Collection) GetStaleWhileRevalidate(ctx context.Context, k key.Key) ([]byte, bool, error) {
+	if cl.isSegmented() {
+		return nil, false, ErrSegmentStorageNotSupported
+	}
+	loader := cl.getLoader()
+	if loader == nil {
+		return nil, false, ErrLoaderNotSet
+	}
+
+	data, err := cl.GetFileDataCtx(ctx, k)
+	if os.IsNotExist(err) {
+		data, err = loader(ctx, k)
+		if err != nil {
+			return nil, false, err
+		}
+		err = cl.SetCtx(ctx, k, data)
+		if err != nil {
+			return nil, false, err
+		}
+		return data, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	softTTL := cl.getSoftTTL()
+	if softTTL <= 0 {
+		return data, false, nil
+	}
+	writtenAt, err := cl.getWriteTime(k)
+	if os.IsNotExist(err) { // deleted since it was read
+		return data, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if time.Since(writtenAt) < softTTL {
+		return data, false, nil
+	}
+
+	cl.startRefresh(k, loader, writtenAt)
+	return data, true, nil
+}
+
+// getWriteTime returns when the document for k was last written
+func (cl *Collection) getWriteTime(k key.Key) (time.Time, error) {
+	path, err := cl.getExistingFilePath(k)
+	if err != nil {
+		return time.Time{}, err
+	}
+	info, err := cl.fs().Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// GetWriteTime returns when the document for k was last written, which is not known for STORAGE_SEGMENTS
+func (cl *Collection) GetWriteTime(k key.Key) (time.Time, error) {
+	if cl.isSegmented() {
+		return time.Time{}, ErrSegmentStorageNotSupported
+	}
+	return cl.getWriteTime(k)
+}
+
+// startRefresh refreshes the document for k, which was last written at writtenAt, in the background, unless it is being
+// refreshed already
+func (cl *Collection) startRefresh(k key.Key, loader Loader, writtenAt time.Time) {
+	r := &cl.refresher
+	r.Lock()
+	defer r.Unlock()
+	if r.inProgress[k] {
+		return
+	}
+	if r.inProgress == nil {
+		r.inProgress = make(map[key.Key]bool)
+	}
+	if r.ctx == nil {
+		r.ctx, r.cancel = context.WithCancel(context.Background())
+	}
+	r.inProgress[k] = true
+	r.wg.Add(1)
+
+	go func(ctx context.Context) {
+		defer r.wg.Done()
+		err := cl.refresh(ctx, k, loader, writtenAt)
+		if err != nil {
+			util.Warnf("Could not refresh document %d of collection %s: %s", k, cl.Name, err)
+		}
+		r.Lock()
+		delete(r.inProgress, k)
+		r.Unlock()
+	}(r.ctx)
+}
+
+// refresh loads the fresh data of the document for k, and writes it unless the document has changed since writtenAt
+func (cl *Collection) refresh(ctx context.Context, k key.Key, loader Loader, writtenAt time.Time) error {
+	data, err := loader(ctx, k)
+	if err != nil {
+		return err
+	}
+
+	cl.waitForWrites(k)
+	isWritten, err := cl.setIfUnchanged(ctx, k, data, writtenAt)
+	if err != nil || !isWritten {
+		return err
+	}
+	return cl.evict(k)
+}
+
+// setIfUnchanged writes data as the document for k, keeping its expiration time, if it was last written at writtenAt.
+// It tells whether it has written it.
+func (cl *Collection) setIfUnchanged(ctx context.Context, k key.Key, data []byte, writtenAt time.Time) (bool, error) {
+	defer cl.lockKey(k)()
+
+	currentWrittenAt, err := cl.getWriteTime(k)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !currentWrittenAt.Equal(writtenAt) {
+		return false, nil
+	}
+	expiresAt, err := cl.GetExpiry(k)
+	if err != nil {
+		return false, err
+	}
+	err = cl.setLocked(ctx, k, data, expiresAt)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// stopRefreshes cancels the refreshes in progress, and waits for them to stop
+func (cl *Collection) stopRefreshes() {
+	r := &cl.refresher
+	r.Lock()
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.ctx, r.cancel = nil, nil
+	r.Unlock()
+	r.wg.Wait()
+}
@@ -0,0 +1,301 @@
+package collection
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/********************************************************************************
+* R E V I S I O N S
+*********************************************************************************/
+
+// When NumRevisions is set, the previous version of a document is kept as a revision every time it is overwritten or
+// deleted. Revisions are stored as exact copies of the document file (i.e. with the header, and compressed/encrypted
+// the same way) under revisions/<partition>/<key>/, and are named <revision number>_<document file name>. Revision
+// numbers start at 1 and go up with every write.
+//
+// Revisions are pruned whenever a new one is saved: only the latest NumRevisions are kept, and if RevisionMaxAge is
+// set, the ones older than that are removed too. PruneRevisions applies the same policy to all the documents, which
+// is useful with RevisionMaxAge since documents that are not written to are otherwise never pruned.
+
+const REVISIONS_DIR_NAME string = "revisions"
+
+var ErrRevisionIsNotExist = fmt.Errorf("Revision does not exist")
+
+type Revision struct {
+	Number    int
+	CreatedAt time.Time
+	Size      int64 // size of the revision file on disk
+	path      string
+}
+
+func (cl *Collection) isRevisionsEnabled() bool {
+	return cl.NumRevisions > 0
+}
+
+func (cl *Collection) getRevisionsDirPath() string {
+	return util.JoinPath(cl.DirPath, REVISIONS_DIR_NAME)
+}
+
+func (cl *Collection) getRevisionsDirPathForKey(k key.Key) string {
+	dirPath := util.JoinPath(cl.getRevisionsDirPath(), k.GetPartitionDirName(cl.getNumPartitions()), k.String())
+	// the revisions may not have been moved yet, see StartRepartition
+	if oldDirPath := cl.getOldPartitionPath(cl.getRevisionsDirPath(), k, k.String()); oldDirPath != "" {
+		if _, err := cl.fs().Stat(dirPath); os.IsNotExist(err) {
+			if _, err := cl.fs().Stat(oldDirPath); err == nil {
+				return oldDirPath
+			}
+		}
+	}
+	return dirPath
+}
+
+// saveRevision copies the current document for k, if there is one, as its latest revision
+func (cl *Collection) saveRevision(k key.Key) error {
+	if !cl.isRevisionsEnabled() {
+		return nil
+	}
+
+	fileName, data, err := cl.readDocFile(k)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	revisions, err := cl.ListRevisions(k)
+	if err != nil {
+		return err
+	}
+	var number int = 1
+	if len(revisions) > 0 {
+		number = revisions[len(revisions)-1].Number + 1
+	}
+
+	dirPath := cl.getRevisionsDirPathForKey(k)
+	err = util.CreateDirIfNotExist(cl.fs(), dirPath)
+	if err != nil {
+		return err
+	}
+	revPath := util.JoinPath(dirPath, strconv.Itoa(number)+"_"+filepath.Base(fileName))
+	err = cl.writeFile(revPath, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = cl.pruneRevisions(k)
+	return err
+}
+
+// ListRevisions returns the revisions of the document for k, oldest first
+func (cl *Collection) ListRevisions(k key.Key) ([]Revision, error) {
+	dirPath := cl.getRevisionsDirPathForKey(k)
+
+	fileInfos, err := util.ReadDir(cl.fs(), dirPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []Revision
+	for _, fileInfo := range fileInfos {
+		parts := strings.SplitN(fileInfo.Name(), "_", 2)
+		number, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			continue // not a revision file
+		}
+		revisions = append(revisions, Revision{
+			Number:    number,
+			CreatedAt: fileInfo.ModTime(),
+			Size:      fileInfo.Size(),
+			path:      util.JoinPath(dirPath, fileInfo.Name()),
+		})
+	}
+
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i].Number < revisions[j].Number })
+
+	return revisions, nil
+}
+
+func (cl *Collection) getRevision(k key.Key, n int) (Revision, error) {
+	revisions, err := cl.ListRevisions(k)
+	if err != nil {
+		return Revision{}, err
+	}
+	for _, r := range revisions {
+		if r.Number == n {
+			return r, nil
+		}
+	}
+	return Revision{}, ErrRevisionIsNotExist
+}
+
+// GetRevision returns the data of revision n of the document for k, the same way GetFileData does for the document
+func (cl *Collection) GetRevision(k key.Key, n int) ([]byte, error) {
+	r, err := cl.getRevision(k, n)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := cl.fs().Open(r.path)
+	if err != nil {
+		return nil, err
+	}
+	_, dr, err := cl.openDocFile(file, k, true)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+
+	return ioutil.ReadAll(dr)
+}
+
+// RevertTo makes revision n the current version of the document for k. The version being replaced is saved as a new
+// revision, so a revert can be undone as well.
+func (cl *Collection) RevertTo(k key.Key, n int) error {
+	// The revisions to revert to should include the versions that are still queued
+	cl.waitForWrites(k)
+	err := cl.revertLocked(k, n)
+	if err != nil {
+		return err
+	}
+	return cl.evict(k)
+}
+
+// revertLocked does the work for RevertTo, while holding the key lock for k
+func (cl *Collection) revertLocked(k key.Key, n int) error {
+	defer cl.lockKey(k)()
+
+	r, err := cl.getRevision(k, n)
+	if err != nil {
+		return err
+	}
+
+	// the revision file is a complete document file, so it can be written back as it is
+	fileData, err := util.ReadFile(cl.fs(), r.path)
+	if err != nil {
+		return err
+	}
+
+	// read the data for the audit log now, since the revert can prune the revision
+	var data []byte
+	if cl.EnableAuditLog {
+		data, err = cl.GetRevision(k, n)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = cl.setFileData(k, fileData, AUDIT_OP_REVERT)
+	if err != nil {
+		return err
+	}
+
+	cl.notifyChange(AUDIT_OP_REVERT, k)
+	return cl.audit(AUDIT_OP_REVERT, k, data)
+}
+
+// PruneRevisions applies the pruning policy to the revisions of all the documents of the collection, including the ones
+// that have been deleted. It returns the number of revisions removed.
+func (cl *Collection) PruneRevisions() (int, error) {
+	var numPruned int
+	err := cl.forEachRevisionKey(func(k key.Key) error {
+		n, err := cl.pruneRevisions(k)
+		numPruned += n
+		return err
+	})
+	return numPruned, err
+}
+
+// pruneRevisions removes the revisions of the document for k that are beyond NumRevisions or older than RevisionMaxAge
+func (cl *Collection) pruneRevisions(k key.Key) (int, error) {
+	revisions, err := cl.ListRevisions(k)
+	if err != nil {
+		return 0, err
+	}
+
+	var numPruned int
+	for i, r := range revisions {
+		isExtra := len(revisions)-i > cl.NumRevisions
+		isExpired := cl.RevisionMaxAge > 0 && time.Since(r.CreatedAt) > cl.RevisionMaxAge
+		if !isExtra && !isExpired {
+			continue
+		}
+		err = cl.fs().Remove(r.path)
+		if err != nil && !os.IsNotExist(err) {
+			return numPruned, err
+		}
+		numPruned++
+	}
+
+	// don't leave empty dirs behind for documents that have no revisions left
+	if numPruned > 0 && numPruned == len(revisions) {
+		err = cl.fs().Remove(cl.getRevisionsDirPathForKey(k))
+		if err != nil && !os.IsNotExist(err) {
+			return numPruned, err
+		}
+	}
+
+	return numPruned, nil
+}
+
+// forEachRevision calls fn for every revision file of every document in the collection. It stops at the first error.
+func (cl *Collection) forEachRevision(fn func(k key.Key, revPath string) error) error {
+	return cl.forEachRevisionKey(func(k key.Key) error {
+		revisions, err := cl.ListRevisions(k)
+		if err != nil {
+			return err
+		}
+		for _, r := range revisions {
+			err = fn(k, r.path)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// forEachRevisionKey calls fn for the key of every document that has revisions. It stops at the first error.
+func (cl *Collection) forEachRevisionKey(fn func(k key.Key) error) error {
+	pDirInfos, err := util.ReadDir(cl.fs(), cl.getRevisionsDirPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, pDirInfo := range pDirInfos {
+		if !pDirInfo.IsDir() {
+			continue
+		}
+		keyDirInfos, err := util.ReadDir(cl.fs(), util.JoinPath(cl.getRevisionsDirPath(), pDirInfo.Name()))
+		if err != nil {
+			return err
+		}
+		for _, keyDirInfo := range keyDirInfos {
+			k, err := key.ParseKey(keyDirInfo.Name())
+			if err != nil {
+				continue
+			}
+			err = fn(k)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -1,14 +1,33 @@
 package collection
 
 import (
+	"context"
 	"fmt"
 	"github.com/teejays/gofiledb/key"
 	"sort"
 	"strings"
+	"time"
 )
 
 var ErrIndexNotImplemented error = fmt.Errorf("Searching is only supported on indexed fields. No index found on one of the fields")
 
+// The operators of the conditions of a query. Range conditions compare the values as numbers if the indexed field is a
+// number, and as strings otherwise.
+const (
+	QUERY_OP_EQUAL         string = ":"
+	QUERY_OP_LESS          string = "<"
+	QUERY_OP_LESS_EQUAL    string = "<="
+	QUERY_OP_GREATER       string = ">"
+	QUERY_OP_GREATER_EQUAL string = ">="
+)
+
+// QUERY_AND_SEPARATOR separates the conditions of a query, which all need to match. QUERY_ESCAPE escapes it, or itself,
+// in the value of a condition.
+const (
+	QUERY_AND_SEPARATOR string = "+"
+	QUERY_ESCAPE        string = `\`
+)
+
 /********************************************************************************
 * E N T I T Y
 *********************************************************************************/
@@ -22,12 +41,27 @@ type QueryConditionsPlan []QueryCondition
 
 type QueryCondition struct {
 	FieldLocator    string
+	Operator        string // one of the QUERY_OP_ constants
 	ConditionValues []string
 	QueryPosition   int
 	HasIndex        bool
 	IndexInfo       *IndexInfo
 }
 
+// Summary describes the plan in a line, with the conditions in the order they are evaluated in, e.g.
+// "Name:Acme [index, 12 values] + Age>=18 [no index]"
+func (p QueryPlan) Summary() string {
+	parts := make([]string, len(p.ConditionsPlan))
+	for i, condition := range p.ConditionsPlan {
+		how := "no index"
+		if condition.HasIndex && condition.IndexInfo != nil {
+			how = fmt.Sprintf("index, %d values", condition.IndexInfo.NumValues)
+		}
+		parts[i] = fmt.Sprintf("%s%s%s [%s]", condition.FieldLocator, condition.Operator, strings.Join(condition.ConditionValues, ","), how)
+	}
+	return strings.Join(parts, " + ")
+}
+
 func (qs QueryConditionsPlan) Len() int {
 	return len(qs)
 }
@@ -56,26 +90,64 @@ func (qs QueryConditionsPlan) Swap(i, j int) {
 * S E A R C H
 *********************************************************************************/
 
-// e.g query: UserId=1+Org.OrgId=1|261+Name=Talha
+// e.g query: UserId:1+Org.OrgId:261+Name:Talha, or Age>=18+Age<65 for a range. A '+' or '\' in a value is escaped with
+// a '\', e.g. Name:A\+B for the value A+B, see EscapeQueryValue.
 func (cl *Collection) Search(query string) ([]interface{}, error) {
+	return cl.SearchCtx(context.Background(), query)
+}
+
+// SearchCtx is Search, which gives up with ctx.Err() as soon as ctx is done, e.g. while it is still reading the matching
+// documents
+func (cl *Collection) SearchCtx(ctx context.Context, query string) ([]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	// Plan
 	plan, err := cl.getQueryPlan(query)
 	if err != nil {
 		return nil, err
 	}
+	reportQueryPlan(ctx, plan)
+
+	// Execute the plan on a snapshot, so writes that happen while the query runs are not visible to it
+	var fieldLocators []string
+	for _, condition := range plan.ConditionsPlan {
+		if condition.HasIndex {
+			fieldLocators = append(fieldLocators, condition.FieldLocator)
+		}
+	}
+	s, err := cl.newReadSnapshot(fieldLocators)
+	if err != nil {
+		return nil, err
+	}
+	defer cl.releaseReadSnapshot(s)
 
-	// Execute the plan
-	keys, err := cl.getKeysForQueryConditionPlan(plan.ConditionsPlan)
+	keys, err := cl.getKeysForQueryConditionPlan(plan.ConditionsPlan, s)
 	if err != nil {
 		return nil, err
 	}
 	// After this for loop, we should have a map of all the doc keys we want to return
 
+	// The documents that have expired are left out, even if they haven't been deleted yet
+	now := time.Now()
 	var results []interface{}
 	for k := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		isExpired, err := cl.isExpired(k, now)
+		if err != nil {
+			return nil, err
+		}
+		if isExpired {
+			continue
+		}
 		var doc map[string]interface{}
-		err := cl.GetIntoStruct(k, &doc)
+		err = cl.getIntoStructFromSnapshot(s, k, &doc)
+		if err == ErrDocumentIsCorrupted { // it has been quarantined, so it's no longer part of the collection
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -86,6 +158,58 @@ func (cl *Collection) Search(query string) ([]interface{}, error) {
 
 }
 
+// IsMatch tells whether the document k matches query (see Search). Like Search, it only looks at the indexes, but it
+// only checks them for k, so it doesn't go through the documents that match the query.
+func (cl *Collection) IsMatch(k key.Key, query string) (bool, error) {
+	return cl.IsMatchCtx(context.Background(), k, query)
+}
+
+// IsMatchCtx is IsMatch, which gives up with ctx.Err() if ctx is already done
+func (cl *Collection) IsMatchCtx(ctx context.Context, k key.Key, query string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	plan, err := cl.getQueryPlan(query)
+	if err != nil {
+		return false, err
+	}
+	var fieldLocators []string
+	for _, condition := range plan.ConditionsPlan {
+		if !condition.HasIndex {
+			return false, ErrIndexNotImplemented
+		}
+		fieldLocators = append(fieldLocators, condition.FieldLocator)
+	}
+	s, err := cl.newReadSnapshot(fieldLocators)
+	if err != nil {
+		return false, err
+	}
+	defer cl.releaseReadSnapshot(s)
+
+	for _, condition := range plan.ConditionsPlan {
+		idx := s.indexes[condition.FieldLocator]
+		for _, conditionValue := range condition.ConditionValues {
+			var isMatch bool
+			if condition.Operator == QUERY_OP_EQUAL {
+				isMatch = idx.hasKey(conditionValue, k)
+			} else {
+				isMatch = idx.hasKeyInRange(condition.Operator, conditionValue, k)
+			}
+			if !isMatch {
+				return false, nil
+			}
+		}
+	}
+
+	// Like Search, a document that has expired doesn't match, even if it hasn't been deleted yet
+	isExpired, err := cl.isExpired(k, time.Now())
+	if err != nil {
+		return false, err
+	}
+	return !isExpired, nil
+}
+
 /********************************************************************************
 * P L A N
 *********************************************************************************/
@@ -113,11 +237,9 @@ func (cl *Collection) getConditionsPlanForQuery(query string) (QueryConditionsPl
 
 	var err error
 	var conditionsPlan QueryConditionsPlan
-	const AND_SEPARATOR string = "+"
-	const KV_SEPARATOR string = ":"
 
 	// Split each query by the separator `+`, each part represents a separate conditional
-	qParts := strings.Split(query, AND_SEPARATOR)
+	qParts := splitQuery(query)
 
 	// for each of the condition's field locator, we'll get and cache the index info so we don't have to do it again
 	var indexInfoCache map[string]IndexInfo = make(map[string]IndexInfo)
@@ -127,15 +249,14 @@ func (cl *Collection) getConditionsPlanForQuery(query string) (QueryConditionsPl
 
 		// We need to split it by field locator and the condition value
 		// Understand this part of condition
-		_qP := strings.SplitN(qP, KV_SEPARATOR, 2)
-		if len(_qP) < 2 {
+		fieldLocator, operator, fieldCondition, isValid := splitQueryCondition(qP)
+		if !isValid {
 			return conditionsPlan, fmt.Errorf("Invalid Query around `%s`", qP)
 		}
-		fieldLocator := _qP[0]
-		fieldCondition := _qP[1]
 
 		var condition QueryCondition
 		condition.FieldLocator = fieldLocator
+		condition.Operator = operator
 		condition.ConditionValues = []string{fieldCondition}
 		condition.QueryPosition = i
 		condition.HasIndex = cl.isIndexExist(fieldLocator)
@@ -166,11 +287,57 @@ func (cl *Collection) getConditionsPlanForQuery(query string) (QueryConditionsPl
 
 }
 
+// EscapeQueryValue escapes the '+' and '\' in v, so that it can be the value of a condition of a query, e.g.
+// "Name:"+EscapeQueryValue(name)
+func EscapeQueryValue(v string) string {
+	return queryValueEscaper.Replace(v)
+}
+
+var queryValueEscaper = strings.NewReplacer(QUERY_ESCAPE, QUERY_ESCAPE+QUERY_ESCAPE, QUERY_AND_SEPARATOR, QUERY_ESCAPE+QUERY_AND_SEPARATOR)
+
+// splitQuery splits a query into its conditions, on the separators that aren't escaped, and unescapes them. A '\' that
+// doesn't escape a '+' or a '\' is kept as it is.
+func splitQuery(query string) []string {
+	var parts []string
+	var part strings.Builder
+	for i := 0; i < len(query); i++ {
+		switch {
+		case query[i] == QUERY_ESCAPE[0] && i+1 < len(query) && (query[i+1] == QUERY_ESCAPE[0] || query[i+1] == QUERY_AND_SEPARATOR[0]):
+			i++
+			part.WriteByte(query[i])
+		case query[i] == QUERY_AND_SEPARATOR[0]:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(query[i])
+		}
+	}
+	return append(parts, part.String())
+}
+
+// splitQueryCondition splits a condition of a query, e.g. Age:18 or Age>=18, into its field locator, operator and value.
+// It splits on the operator that comes first, so everything after it is the value, which may have ':', '<' or '>' in it
+// (e.g. Time>=12:30).
+func splitQueryCondition(qP string) (string, string, string, bool) {
+	i := strings.IndexAny(qP, QUERY_OP_EQUAL+"<>")
+	if i < 0 {
+		return "", "", "", false
+	}
+	if qP[i:i+1] == QUERY_OP_EQUAL {
+		return qP[:i], QUERY_OP_EQUAL, qP[i+1:], true
+	}
+	operator := qP[i : i+1]
+	if strings.HasPrefix(qP[i+1:], "=") {
+		operator += "="
+	}
+	return qP[:i], operator, qP[i+len(operator):], true
+}
+
 /********************************************************************************
 * E X E C U T E
 *********************************************************************************/
 
-func (cl *Collection) getKeysForQueryConditionPlan(cPlan QueryConditionsPlan) (map[key.Key]bool, error) {
+func (cl *Collection) getKeysForQueryConditionPlan(cPlan QueryConditionsPlan, s *readSnapshot) (map[key.Key]bool, error) {
 
 	var resultKeys map[key.Key]bool = make(map[key.Key]bool) // value type int is just arbitrary so we can store some temp info when find intersects later
 
@@ -180,15 +347,17 @@ func (cl *Collection) getKeysForQueryConditionPlan(cPlan QueryConditionsPlan) (m
 
 		// if index, open index
 		if condition.HasIndex {
-			idx, err := cl.loadIndex(condition.FieldLocator)
-			if err != nil {
-				return nil, err
-			}
+			idx := s.indexes[condition.FieldLocator]
 
 			for _, conditionValue := range condition.ConditionValues {
 
 				// for each condition, get the values (doc keys) that satisfy the condition
-				keys := idx.ValueKeys[conditionValue]
+				var keys []key.Key
+				if condition.Operator == QUERY_OP_EQUAL {
+					keys = idx.getKeys(conditionValue)
+				} else {
+					keys = idx.getKeysInRange(condition.Operator, conditionValue)
+				}
 				if step == 1 {
 					// first time we're getting the keys, just add them to results
 					for _, k := range keys {
@@ -0,0 +1,767 @@
+package collection
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/********************************************************************************
+* S E G M E N T S
+*********************************************************************************/
+
+// With STORAGE_SEGMENTS, documents are not stored one file per document. Instead, they are appended to segment files in
+// the segments dir of the collection, which saves inodes and block space when documents are small, and makes backups a
+// lot faster. The location of every document is kept in memory, and is rebuilt from the segments when the collection
+// is first used.
+//
+// Record layout: | magic (4 bytes) | flags (1 byte) | key (8 bytes) | data length (4 bytes) | crc32 of data (4 bytes) | data |
+//
+// The data of a record is exactly what the document file would contain with STORAGE_FILES (i.e. the doc header followed
+// by the document data), so documents are read the same way whichever storage engine they are in. A delete is recorded
+// as a tombstone record, with no data.
+//
+// Once a segment reaches SegmentMaxBytes, it is sealed: an offset index (the offset of the last record of every key in
+// the segment) is appended to it, followed by a trailer that points to the index, so that loading the segment doesn't
+// require reading all its records. A segment that was not sealed, e.g. because the process crashed, is scanned instead.
+// Segments are only ever appended to by the store that created them, so an existing segment is never changed once the
+// collection has been loaded again.
+//
+// Overwritten and deleted documents leave dead records behind. Whenever a segment is sealed, the segments in which at
+// least SEGMENT_COMPACTION_MIN_GARBAGE_RATIO of the bytes are dead are compacted: their live records are copied to the
+// current segment, and the old segment is removed. Compact can also be called to compact all the segments with dead
+// records.
+
+const (
+	STORAGE_FILES             uint = iota // one file per document, in the partition dirs
+	STORAGE_SEGMENTS                      // documents are packed into append-only segment files
+	STORAGE_CONTENT_ADDRESSED             // one pointer file per document, to a shared blob named after its content
+)
+
+const SEGMENTS_DIR_NAME string = "segments"
+const SEGMENT_FILE_PREFIX string = "segment_"
+const SEGMENT_FILE_EXTENSION string = ".seg"
+
+const DEFAULT_SEGMENT_MAX_BYTES int64 = 64 << 20
+const SEGMENT_COMPACTION_MIN_GARBAGE_RATIO float64 = 0.5
+
+const (
+	segmentRecordMagic        string = "GFSR"
+	segmentIndexMagic         string = "GFSI"
+	segmentRecordHeaderLen    int    = len(segmentRecordMagic) + 1 + 8 + 4 + 4
+	segmentIndexEntryLen      int    = 8 + 8 + 4 + 1 // key, offset, data length, flags
+	segmentTrailerLen         int    = 8 + 4 + len(segmentIndexMagic)
+	segmentRecordFlagDeletion byte   = 1 << 0
+)
+
+var ErrSegmentStorageIsNotEnabled = fmt.Errorf("The collection does not use STORAGE_SEGMENTS")
+var ErrSegmentStorageNotSupported = fmt.Errorf("The operation is not supported for collections with STORAGE_SEGMENTS, since their documents are not stored in files of their own")
+
+type segmentStore struct {
+	cl         *Collection
+	dirPath    string
+	segments   map[uint32]*segmentInfo
+	locs       map[key.Key]segmentLoc // the latest record of every existing document
+	tombstones map[key.Key]segmentLoc // the latest record of every deleted document, if it is still needed
+	nextID     uint32
+	active     *segmentInfo // the segment being appended to, nil until the first write
+	compacting bool
+	sync.RWMutex
+}
+
+type segmentInfo struct {
+	id        uint32
+	path      string
+	file      util.File // opened for reading, or for appending if it is the active segment
+	size      int64     // the size of the records, i.e. without the offset index
+	liveBytes int64     // the size of the records that are in locs or tombstones
+	entries   []segmentIndexEntry
+}
+
+type segmentLoc struct {
+	segmentID uint32
+	offset    int64
+	length    uint32
+}
+
+func (loc segmentLoc) recordLen() int64 {
+	return int64(segmentRecordHeaderLen) + int64(loc.length)
+}
+
+type segmentIndexEntry struct {
+	k          key.Key
+	offset     int64
+	length     uint32
+	isDeletion bool
+}
+
+func (cl *Collection) isSegmented() bool {
+	return cl.StorageEngine == STORAGE_SEGMENTS
+}
+
+func (cl *Collection) getSegmentsDirPath() string {
+	return util.JoinPath(cl.DirPath, SEGMENTS_DIR_NAME)
+}
+
+func (cl *Collection) getSegmentMaxBytes() int64 {
+	if cl.SegmentMaxBytes <= 0 {
+		return DEFAULT_SEGMENT_MAX_BYTES
+	}
+	return cl.SegmentMaxBytes
+}
+
+// getSegmentStore returns the segment store of the collection, loading it from the segments on first use
+func (cl *Collection) getSegmentStore() (*segmentStore, error) {
+	cl.segmentsLock.Lock()
+	defer cl.segmentsLock.Unlock()
+
+	if cl.segments == nil {
+		s, err := openSegmentStore(cl)
+		if err != nil {
+			return nil, err
+		}
+		cl.segments = s
+	}
+	return cl.segments, nil
+}
+
+// closeSegmentStore seals the active segment and closes all the segment files. The store is loaded again if the
+// collection is used after this.
+func (cl *Collection) closeSegmentStore() error {
+	cl.segmentsLock.Lock()
+	s := cl.segments
+	cl.segments = nil
+	cl.segmentsLock.Unlock()
+
+	if s == nil {
+		return nil
+	}
+	return s.close()
+}
+
+func getSegmentFileName(id uint32) string {
+	return fmt.Sprintf("%s%08d%s", SEGMENT_FILE_PREFIX, id, SEGMENT_FILE_EXTENSION)
+}
+
+func parseSegmentFileName(name string) (uint32, bool) {
+	if !strings.HasPrefix(name, SEGMENT_FILE_PREFIX) || !strings.HasSuffix(name, SEGMENT_FILE_EXTENSION) {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, SEGMENT_FILE_PREFIX), SEGMENT_FILE_EXTENSION), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(id), true
+}
+
+func openSegmentStore(cl *Collection) (*segmentStore, error) {
+	s := &segmentStore{
+		cl:         cl,
+		dirPath:    cl.getSegmentsDirPath(),
+		segments:   make(map[uint32]*segmentInfo),
+		locs:       make(map[key.Key]segmentLoc),
+		tombstones: make(map[key.Key]segmentLoc),
+		nextID:     1,
+	}
+
+	names, err := s.cl.getDirNames(s.dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	for _, name := range names {
+		if id, ok := parseSegmentFileName(name); ok {
+			ids = append(ids, id)
+		}
+	}
+	// later segments have the later versions of the documents
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		err = s.load(id)
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("error while loading segment %d of collection %s: %w", id, cl.Name, err)
+		}
+		s.nextID = id + 1
+	}
+
+	return s, nil
+}
+
+// load reads the offset index of the segment, or scans its records if it has no index, and adds its records to the store
+func (s *segmentStore) load(id uint32) error {
+	path := util.JoinPath(s.dirPath, getSegmentFileName(id))
+	file, err := s.cl.fs().Open(path)
+	if err != nil {
+		return err
+	}
+	info := &segmentInfo{id: id, path: path, file: file}
+	s.segments[id] = info
+
+	entries, size, err := readSegmentIndex(file)
+	if err != nil {
+		return err
+	}
+	if entries == nil {
+		entries, size, err = scanSegment(file)
+		if err != nil {
+			return err
+		}
+	}
+	info.size = size
+
+	for _, e := range entries {
+		s.apply(info, e)
+	}
+
+	return nil
+}
+
+// readSegmentIndex reads the offset index at the end of a sealed segment. If the segment is not sealed, nil entries are
+// returned.
+func readSegmentIndex(file util.File) ([]segmentIndexEntry, int64, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	fileSize := fileInfo.Size()
+	if fileSize < int64(segmentTrailerLen) {
+		return nil, 0, nil
+	}
+
+	trailer := make([]byte, segmentTrailerLen)
+	_, err = file.ReadAt(trailer, fileSize-int64(segmentTrailerLen))
+	if err != nil {
+		return nil, 0, err
+	}
+	if string(trailer[12:]) != segmentIndexMagic {
+		return nil, 0, nil
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(trailer[0:8]))
+	numEntries := int64(binary.LittleEndian.Uint32(trailer[8:12]))
+	if indexOffset < 0 || indexOffset+numEntries*int64(segmentIndexEntryLen)+int64(segmentTrailerLen) != fileSize {
+		return nil, 0, nil
+	}
+
+	b := make([]byte, numEntries*int64(segmentIndexEntryLen))
+	_, err = file.ReadAt(b, indexOffset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var entries []segmentIndexEntry = make([]segmentIndexEntry, 0, numEntries)
+	for i := int64(0); i < numEntries; i++ {
+		e := b[i*int64(segmentIndexEntryLen):]
+		entries = append(entries, segmentIndexEntry{
+			k:          key.Key(binary.LittleEndian.Uint64(e[0:8])),
+			offset:     int64(binary.LittleEndian.Uint64(e[8:16])),
+			length:     binary.LittleEndian.Uint32(e[16:20]),
+			isDeletion: e[20]&segmentRecordFlagDeletion != 0,
+		})
+	}
+
+	return entries, indexOffset, nil
+}
+
+// scanSegment reads all the records of a segment that has no offset index. It stops at the first record that is
+// incomplete (e.g. because a write to it was interrupted) or isn't a record at all, and returns the size of the
+// records before it. Records with a wrong checksum are included, so that reading them reports the corruption.
+func scanSegment(file util.File) ([]segmentIndexEntry, int64, error) {
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, 0, err
+	}
+	br := getBufioReader(file)
+	defer putBufioReader(br)
+
+	var entries []segmentIndexEntry = []segmentIndexEntry{}
+	var offset int64
+	header := make([]byte, segmentRecordHeaderLen)
+	for {
+		_, err = io.ReadFull(br, header)
+		if err == io.EOF {
+			return entries, offset, nil
+		}
+		if err == io.ErrUnexpectedEOF || (err == nil && string(header[:len(segmentRecordMagic)]) != segmentRecordMagic) {
+			util.Warnf("Segment %s has an incomplete or invalid record at offset %d, ignoring the rest of it", file.Name(), offset)
+			return entries, offset, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		e := parseSegmentRecordHeader(header)
+		e.offset = offset
+		_, err = br.Discard(int(e.length))
+		if err == io.EOF {
+			util.Warnf("Segment %s has an incomplete record at offset %d, ignoring the rest of it", file.Name(), offset)
+			return entries, offset, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		entries = append(entries, e)
+		offset += int64(segmentRecordHeaderLen) + int64(e.length)
+	}
+}
+
+func parseSegmentRecordHeader(header []byte) segmentIndexEntry {
+	b := header[len(segmentRecordMagic):]
+	return segmentIndexEntry{
+		isDeletion: b[0]&segmentRecordFlagDeletion != 0,
+		k:          key.Key(binary.LittleEndian.Uint64(b[1:9])),
+		length:     binary.LittleEndian.Uint32(b[9:13]),
+	}
+}
+
+// apply makes the record described by e, in the segment info, the latest one for its key
+func (s *segmentStore) apply(info *segmentInfo, e segmentIndexEntry) {
+	if old, ok := s.locs[e.k]; ok {
+		s.segments[old.segmentID].liveBytes -= old.recordLen()
+		delete(s.locs, e.k)
+	}
+	if old, ok := s.tombstones[e.k]; ok {
+		s.segments[old.segmentID].liveBytes -= old.recordLen()
+		delete(s.tombstones, e.k)
+	}
+
+	loc := segmentLoc{segmentID: info.id, offset: e.offset, length: e.length}
+	if e.isDeletion {
+		s.tombstones[e.k] = loc
+	} else {
+		s.locs[e.k] = loc
+	}
+	info.liveBytes += loc.recordLen()
+}
+
+// has tells whether there is a document for k
+func (s *segmentStore) has(k key.Key) bool {
+	s.RLock()
+	_, ok := s.locs[k]
+	s.RUnlock()
+	return ok
+}
+
+// get returns the data of the latest record for k. If verify is true, a corruptionError is returned if the data doesn't
+// match the checksum of the record. If there is no document for k, the returned error satisfies os.IsNotExist.
+func (s *segmentStore) get(k key.Key, verify bool) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	loc, ok := s.locs[k]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return s.readRecord(loc, k, verify)
+}
+
+func (s *segmentStore) readRecord(loc segmentLoc, k key.Key, verify bool) ([]byte, error) {
+	info := s.segments[loc.segmentID]
+
+	b := make([]byte, loc.recordLen())
+	_, err := info.file.ReadAt(b, loc.offset)
+	if err == io.EOF {
+		return nil, corruptionError{fmt.Errorf("record at offset %d of segment %s is incomplete", loc.offset, info.path)}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	header, data := b[:segmentRecordHeaderLen], b[segmentRecordHeaderLen:]
+	e := parseSegmentRecordHeader(header)
+	if string(header[:len(segmentRecordMagic)]) != segmentRecordMagic || e.k != k || e.length != loc.length {
+		return nil, corruptionError{fmt.Errorf("record at offset %d of segment %s is not the record for document %s", loc.offset, info.path, k)}
+	}
+	if verify && binary.LittleEndian.Uint32(header[len(header)-4:]) != crc32.ChecksumIEEE(data) {
+		return data, corruptionError{fmt.Errorf("checksum of the record at offset %d of segment %s does not match its data", loc.offset, info.path)}
+	}
+
+	return data, nil
+}
+
+// put appends a record with data as the document for k
+func (s *segmentStore) put(k key.Key, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.appendRecord(k, data, false)
+}
+
+// remove appends a tombstone record for k, if there is a document for k
+func (s *segmentStore) remove(k key.Key) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.locs[k]; !ok {
+		return nil
+	}
+	return s.appendRecord(k, nil, true)
+}
+
+// appendRecord appends a record to the active segment, creating it first if needed, and seals the active segment once
+// it is full. It should be called with the store locked.
+func (s *segmentStore) appendRecord(k key.Key, data []byte, isDeletion bool) error {
+	if s.active == nil {
+		err := s.createActive()
+		if err != nil {
+			return err
+		}
+	}
+	info := s.active
+
+	var flags byte
+	if isDeletion {
+		flags |= segmentRecordFlagDeletion
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	buf.WriteString(segmentRecordMagic)
+	buf.WriteByte(flags)
+	binary.Write(buf, binary.LittleEndian, uint64(k))
+	binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+	binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(data))
+	buf.Write(data)
+
+	_, err := info.file.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	err = s.cl.syncFile(info.file)
+	if err != nil {
+		return err
+	}
+
+	e := segmentIndexEntry{k: k, offset: info.size, length: uint32(len(data)), isDeletion: isDeletion}
+	info.size += int64(buf.Len())
+	info.entries = append(info.entries, e)
+	s.apply(info, e)
+
+	if info.size >= s.cl.getSegmentMaxBytes() {
+		err = s.sealActive()
+		if err != nil {
+			return err
+		}
+		if !s.compacting {
+			_, err = s.compact(SEGMENT_COMPACTION_MIN_GARBAGE_RATIO)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *segmentStore) createActive() error {
+	err := util.CreateDirIfNotExist(s.cl.fs(), s.dirPath)
+	if err != nil {
+		return err
+	}
+
+	id := s.nextID
+	path := util.JoinPath(s.dirPath, getSegmentFileName(id))
+	file, err := s.cl.fs().OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL|os.O_APPEND, util.FILE_PERM)
+	if err != nil {
+		return err
+	}
+	s.nextID++
+
+	info := &segmentInfo{id: id, path: path, file: file}
+	s.segments[id] = info
+	s.active = info
+	return nil
+}
+
+// sealActive appends the offset index and the trailer to the active segment, so nothing is appended to it anymore. It
+// should be called with the store locked.
+func (s *segmentStore) sealActive() error {
+	info := s.active
+	if info == nil {
+		return nil
+	}
+
+	// only the last record of every key is needed
+	var last map[key.Key]int = make(map[key.Key]int, len(info.entries))
+	for i, e := range info.entries {
+		last[e.k] = i
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	var numEntries uint32
+	for i, e := range info.entries {
+		if last[e.k] != i {
+			continue
+		}
+		var flags byte
+		if e.isDeletion {
+			flags |= segmentRecordFlagDeletion
+		}
+		binary.Write(buf, binary.LittleEndian, uint64(e.k))
+		binary.Write(buf, binary.LittleEndian, uint64(e.offset))
+		binary.Write(buf, binary.LittleEndian, e.length)
+		buf.WriteByte(flags)
+		numEntries++
+	}
+	binary.Write(buf, binary.LittleEndian, uint64(info.size))
+	binary.Write(buf, binary.LittleEndian, numEntries)
+	buf.WriteString(segmentIndexMagic)
+
+	_, err := info.file.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	err = s.cl.syncFile(info.file)
+	if err != nil {
+		return err
+	}
+
+	info.entries = nil
+	s.active = nil
+	return nil
+}
+
+// compact compacts the sealed segments in which at least minGarbageRatio of the bytes are in dead records, and returns
+// the number of segments compacted. It should be called with the store locked.
+func (s *segmentStore) compact(minGarbageRatio float64) (int, error) {
+	var ids []uint32
+	for id, info := range s.segments {
+		if info == s.active || info.size == 0 {
+			continue
+		}
+		garbageRatio := float64(info.size-info.liveBytes) / float64(info.size)
+		if garbageRatio > 0 && garbageRatio >= minGarbageRatio {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	s.compacting = true
+	defer func() { s.compacting = false }()
+
+	for i, id := range ids {
+		err := s.compactSegment(id)
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(ids), nil
+}
+
+// compactSegment copies the live records of the segment to the active segment, and removes the segment
+func (s *segmentStore) compactSegment(id uint32) error {
+	info := s.segments[id]
+	util.Debugf("Compacting segment %s: %d of %d bytes are live", info.path, info.liveBytes, info.size)
+
+	// a tombstone is only needed while an older segment may still have a record for its key
+	isOldest := true
+	for otherID := range s.segments {
+		if otherID < id {
+			isOldest = false
+		}
+	}
+
+	type record struct {
+		k   key.Key
+		loc segmentLoc
+	}
+	var records []record
+	for k, loc := range s.locs {
+		if loc.segmentID == id {
+			records = append(records, record{k, loc})
+		}
+	}
+	var tombstones []key.Key
+	for k, loc := range s.tombstones {
+		if loc.segmentID != id {
+			continue
+		}
+		if isOldest {
+			delete(s.tombstones, k)
+			info.liveBytes -= loc.recordLen()
+			continue
+		}
+		tombstones = append(tombstones, k)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].loc.offset < records[j].loc.offset })
+
+	for _, r := range records {
+		data, err := s.readRecord(r.loc, r.k, false)
+		if err != nil {
+			return err
+		}
+		err = s.appendRecord(r.k, data, false)
+		if err != nil {
+			return err
+		}
+	}
+	for _, k := range tombstones {
+		err := s.appendRecord(k, nil, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the copies need to be on disk before the originals are removed, whatever the Durability setting
+	if s.active != nil && (len(records) > 0 || len(tombstones) > 0) {
+		err := s.active.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := info.file.Close()
+	if err != nil {
+		return err
+	}
+	delete(s.segments, id)
+	err = s.cl.fs().Remove(info.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.cl.syncRenamed(info.path)
+}
+
+// forEach calls fn for every document in the store, in the order they were written. fn is called without the store
+// being locked.
+func (s *segmentStore) forEach(fn func(k key.Key, segmentPath string) error) error {
+	type doc struct {
+		k   key.Key
+		loc segmentLoc
+	}
+
+	s.RLock()
+	var docs []doc = make([]doc, 0, len(s.locs))
+	var paths map[uint32]string = make(map[uint32]string, len(s.segments))
+	for k, loc := range s.locs {
+		docs = append(docs, doc{k, loc})
+	}
+	for id, info := range s.segments {
+		paths[id] = info.path
+	}
+	s.RUnlock()
+
+	sort.Slice(docs, func(i, j int) bool {
+		if docs[i].loc.segmentID != docs[j].loc.segmentID {
+			return docs[i].loc.segmentID < docs[j].loc.segmentID
+		}
+		return docs[i].loc.offset < docs[j].loc.offset
+	})
+
+	for _, d := range docs {
+		err := fn(d.k, paths[d.loc.segmentID])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isActivePath tells whether path is the path of the active segment
+func (s *segmentStore) isActivePath(path string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.active != nil && s.active.path == path
+}
+
+func (s *segmentStore) close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	var err error
+	if !s.cl.isReadOnly {
+		err = s.sealActive()
+	}
+	for _, info := range s.segments {
+		if _err := info.file.Close(); _err != nil && err == nil {
+			err = _err
+		}
+	}
+	s.segments = nil
+	return err
+}
+
+/********************************************************************************
+* C O L L E C T I O N  <->  S E G M E N T S
+*********************************************************************************/
+
+// getSegmentDocFileName is the name the file of the document would have with STORAGE_FILES, which is used e.g. for its
+// revisions and for its quarantined copy
+func (cl *Collection) getSegmentDocFileName(k key.Key) string {
+	return k.GetFileName(cl.Name, cl.isGzipEnabled())
+}
+
+// readSegmentDoc returns the data of the document for k, i.e. what its file would contain with STORAGE_FILES
+func (cl *Collection) readSegmentDoc(k key.Key, verify bool) ([]byte, error) {
+	s, err := cl.getSegmentStore()
+	if err != nil {
+		return nil, err
+	}
+	return s.get(k, verify)
+}
+
+// openSegmentDoc is openDoc for collections with STORAGE_SEGMENTS
+func (cl *Collection) openSegmentDoc(k key.Key, decompress bool) (docHeader, *docReader, error) {
+	data, err := cl.readSegmentDoc(k, true)
+	if err != nil {
+		return docHeader{}, nil, err
+	}
+	return cl.openDocReader(ioutil.NopCloser(bytes.NewReader(data)), cl.getSegmentDocFileName(k), k, decompress)
+}
+
+// forEachSegmentDoc is forEachDoc for collections with STORAGE_SEGMENTS. The path given to fn is the path of the segment
+// the document is in.
+func (cl *Collection) forEachSegmentDoc(fn func(k key.Key, segmentPath string) error) error {
+	s, err := cl.getSegmentStore()
+	if err != nil {
+		return err
+	}
+	return s.forEach(fn)
+}
+
+// isActiveSegmentFile tells whether the file at relPath (relative to the collection dir) is the segment that is being
+// appended to
+func (cl *Collection) isActiveSegmentFile(relPath string) bool {
+	if !cl.isSegmented() || filepath.Dir(relPath) != SEGMENTS_DIR_NAME {
+		return false
+	}
+
+	cl.segmentsLock.Lock()
+	s := cl.segments
+	cl.segmentsLock.Unlock()
+
+	return s != nil && s.isActivePath(util.JoinPath(cl.getSegmentsDirPath(), filepath.Base(relPath)))
+}
+
+// Compact compacts all the segments of the collection that have dead records, i.e. records of documents that have since
+// been overwritten or deleted, and returns the number of segments compacted. The segment that is being appended to is
+// left as it is. Segments are also compacted automatically once they are mostly dead.
+func (cl *Collection) Compact() (int, error) {
+	if !cl.isSegmented() {
+		return 0, ErrSegmentStorageIsNotEnabled
+	}
+
+	// Compaction rewrites the active segment, which shouldn't happen while a snapshot is being taken
+	cl.readSnapshotsLock.RLock()
+	defer cl.readSnapshotsLock.RUnlock()
+
+	s, err := cl.getSegmentStore()
+	if err != nil {
+		return 0, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	return s.compact(0)
+}
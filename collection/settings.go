@@ -0,0 +1,277 @@
+package collection
+
+import (
+	"context"
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"os"
+	"strings"
+	"time"
+)
+
+/********************************************************************************
+* R U N T I M E  S E T T I N G S
+*********************************************************************************/
+
+// A few of the props of a collection can be changed while it is in use, without reopening it: the cache limits with
+// SetCacheLimits, the durability mode with SetDurability, the gzip compression with SetGzipCompression, the encoding
+// with ChangeEncoding, and the number of partitions with StartRepartition. Since other goroutines may be reading them at
+// the same time, those props are only read and written while holding settingsLock once the collection is in use.
+
+// SetCacheLimits changes CacheMaxEntries and CacheMaxBytes. The documents that are already cached are kept, as far as
+// the new limits allow. Setting both to 0 turns the cache off, and drops everything in it.
+func (cl *Collection) SetCacheLimits(maxEntries int, maxBytes int64) error {
+	if maxEntries < 0 || maxBytes < 0 {
+		return fmt.Errorf("cache limits cannot be negative")
+	}
+
+	cl.settingsLock.Lock()
+	cl.CacheMaxEntries = maxEntries
+	cl.CacheMaxBytes = maxBytes
+	cl.settingsLock.Unlock()
+
+	cl.cacheLock.Lock()
+	defer cl.cacheLock.Unlock()
+	if cl.cache == nil {
+		return nil
+	}
+	if maxEntries == 0 && maxBytes == 0 {
+		cl.cache = nil
+		return nil
+	}
+	cl.cache.setLimits(maxEntries, maxBytes)
+	return nil
+}
+
+// getNumPartitions returns NumPartitions, see StartRepartition
+func (cl *Collection) getNumPartitions() int {
+	cl.settingsLock.RLock()
+	defer cl.settingsLock.RUnlock()
+	return cl.NumPartitions
+}
+
+// GetCacheLimits returns CacheMaxEntries and CacheMaxBytes
+func (cl *Collection) GetCacheLimits() (int, int64) {
+	cl.settingsLock.RLock()
+	defer cl.settingsLock.RUnlock()
+	return cl.CacheMaxEntries, cl.CacheMaxBytes
+}
+
+// SetDurability changes Durability and FsyncInterval. Anything that is waiting to be fsynced under the old settings is
+// fsynced first.
+func (cl *Collection) SetDurability(durability uint, fsyncInterval time.Duration) error {
+	if durability > DURABILITY_FSYNC_INTERVAL {
+		return fmt.Errorf("invalid durability %d", durability)
+	}
+	if fsyncInterval < 0 {
+		return fmt.Errorf("fsync interval cannot be negative")
+	}
+
+	cl.settingsLock.Lock()
+	cl.Durability = durability
+	cl.FsyncInterval = fsyncInterval
+	cl.settingsLock.Unlock()
+
+	// The index journal is only fsynced if there is some durability
+	cl.walLock.Lock()
+	if j := cl.indexJournal; j != nil {
+		j.Lock()
+		j.noSync = durability == DURABILITY_NONE
+		j.Unlock()
+	}
+	cl.walLock.Unlock()
+
+	// The syncer has the old interval, or isn't needed anymore. The next write makes a new one if needed.
+	cl.syncerLock.Lock()
+	s := cl.syncer
+	cl.syncer = nil
+	cl.syncerLock.Unlock()
+	if s == nil {
+		return nil
+	}
+	return s.close()
+}
+
+// GetDurability returns Durability and FsyncInterval
+func (cl *Collection) GetDurability() (uint, time.Duration) {
+	cl.settingsLock.RLock()
+	defer cl.settingsLock.RUnlock()
+	return cl.Durability, cl.FsyncInterval
+}
+
+// SetGzipCompression changes EnableGzipCompression, and rewrites the documents that are stored the other way, returning
+// how many were rewritten. Documents can be read and written all along: each document is read the way its header says it
+// is stored, under either file name. If SetGzipCompression is interrupted, it can be called again to finish rewriting
+// the documents. Cold documents are left as they are, until they are read again.
+func (cl *Collection) SetGzipCompression(enabled bool) (int, error) {
+	cl.settingsLock.Lock()
+	cl.EnableGzipCompression = enabled
+	cl.settingsLock.Unlock()
+
+	var n int
+	err := cl.forEachDoc(func(k key.Key, docPath string) error {
+		if strings.HasSuffix(docPath, COLD_FILE_EXTENSION) {
+			return nil
+		}
+		// the file name says how a document file is stored, but all the documents of a segment have the same path
+		if !cl.isSegmented() && docPath == cl.getFilePath(k) {
+			return nil
+		}
+		rewritten, err := cl.recompressDoc(k)
+		if err != nil {
+			return err
+		}
+		if rewritten {
+			n++
+		}
+		return nil
+	})
+	if os.IsNotExist(err) { // no documents have been written yet
+		return 0, nil
+	}
+	return n, err
+}
+
+// recompressDoc rewrites the document for k with the current gzip setting, unless it is already stored that way. The
+// content of the document doesn't change, so neither the indexes nor the revisions are touched.
+func (cl *Collection) recompressDoc(k key.Key) (bool, error) {
+	defer cl.lockKey(k)()
+
+	h, data, err := cl.getDocData(context.Background(), k)
+	if os.IsNotExist(err) || err == ErrDocumentIsCorrupted { // deleted or quarantined since it was listed
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	newH := cl.newDocHeader()
+	if cl.isSegmented() && h.IsGzipped == newH.IsGzipped {
+		return false, nil
+	}
+	newH.EncodingType = h.EncodingType // the data is still in the encoding it was written with
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	err = cl.writeDoc(buf, newH, k, data)
+	if err != nil {
+		return false, err
+	}
+
+	cl.readSnapshotsLock.RLock()
+	defer cl.readSnapshotsLock.RUnlock()
+	err = cl.preserveForReadSnapshots(k)
+	if err != nil {
+		return false, err
+	}
+	err = cl.storeDocFile(k, buf.Bytes())
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// isGzipEnabled returns EnableGzipCompression
+func (cl *Collection) isGzipEnabled() bool {
+	cl.settingsLock.RLock()
+	defer cl.settingsLock.RUnlock()
+	return cl.EnableGzipCompression
+}
+
+// ChangeEncoding changes EncodingType, and re-encodes the documents that are stored with another encoding, returning how
+// many were re-encoded. Cold documents are moved back to their partition dir in the process. The indexes are rebuilt
+// afterwards, since the values decoded from the documents may differ. newDoc returns a new value (a pointer) of the type
+// that the documents decode into, which is needed to re-encode documents from or to ENCODING_GOB, see reencode. It can be
+// nil otherwise. Documents can be read and written all along, each being decoded the way its header says it is encoded.
+// If ChangeEncoding is interrupted, it can be called again to finish re-encoding the documents.
+func (cl *Collection) ChangeEncoding(encodingType uint, newDoc func() interface{}) (int, error) {
+	if encodingType == ENCODING_NONE || cl.getEncodingType() == ENCODING_NONE {
+		return 0, ErrReencodeNotSupported
+	}
+	if newDoc == nil && !canReencode(cl.getEncodingType(), encodingType) {
+		return 0, ErrReencodeNotSupported
+	}
+	fieldLocators := cl.GetIndexFieldLocators()
+	if len(fieldLocators) > 0 && !canIndex(encodingType) {
+		return 0, ErrIndexNotSupported
+	}
+
+	cl.settingsLock.Lock()
+	cl.EncodingType = encodingType
+	cl.settingsLock.Unlock()
+
+	var n int
+	err := cl.forEachDoc(func(k key.Key, docPath string) error {
+		reencoded, err := cl.reencodeDoc(k, encodingType, newDoc)
+		if err != nil {
+			return fmt.Errorf("re-encoding document %d: %w", k, err)
+		}
+		if reencoded {
+			n++
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) { // no documents have been written yet
+		return n, err
+	}
+
+	// Writes wait until the indexes have been rebuilt, so that none are missing from them
+	cl.readSnapshotsLock.Lock()
+	defer cl.readSnapshotsLock.Unlock()
+	for _, fieldLocator := range fieldLocators {
+		err = cl.rebuildIndex(fieldLocator)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// reencodeDoc rewrites the document for k with encodingType, unless it is already encoded that way
+func (cl *Collection) reencodeDoc(k key.Key, encodingType uint, newDoc func() interface{}) (bool, error) {
+	defer cl.lockKey(k)()
+
+	h, data, err := cl.getDocData(context.Background(), k)
+	if os.IsNotExist(err) || err == ErrDocumentIsCorrupted { // deleted or quarantined since it was listed
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if h.EncodingType == encodingType {
+		return false, nil
+	}
+
+	data, err = reencode(data, h.EncodingType, encodingType, newDoc)
+	if err != nil {
+		return false, err
+	}
+	newH := cl.newDocHeader()
+	newH.EncodingType = encodingType // in case the setting has been changed again meanwhile
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	err = cl.writeDoc(buf, newH, k, data)
+	if err != nil {
+		return false, err
+	}
+
+	cl.readSnapshotsLock.RLock()
+	defer cl.readSnapshotsLock.RUnlock()
+	err = cl.preserveForReadSnapshots(k)
+	if err != nil {
+		return false, err
+	}
+	err = cl.storeDocFile(k, buf.Bytes())
+	if err != nil {
+		return false, err
+	}
+	cl.uncache(k)
+	return true, nil
+}
+
+// getEncodingType returns EncodingType
+func (cl *Collection) getEncodingType() uint {
+	cl.settingsLock.RLock()
+	defer cl.settingsLock.RUnlock()
+	return cl.EncodingType
+}
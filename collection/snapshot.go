@@ -0,0 +1,183 @@
+package collection
+
+import (
+	"encoding/gob"
+	"github.com/teejays/gofiledb/util"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/********************************************************************************
+* S N A P S H O T S
+*********************************************************************************/
+
+// A snapshot is a copy of the collection dir, along with the collection info (props and index info) as of the same
+// point in time. Files are hard linked into the snapshot where possible, which is safe because documents and indexes
+// are always replaced (see writeFile) and never modified in place. Files that are appended to are copied instead.
+//
+// The WAL and the index journal are left out: they only contain ops that had not been applied when the snapshot was
+// taken, and replaying them on restore would bring in changes made after the snapshot. The audit log is left out as
+// well, since restoring a snapshot shouldn't rewrite the audit trail, and so is the WAL history (see RetainWAL), since the
+// ops in it are only meant to be replayed onto the snapshots taken before them.
+
+const SNAPSHOT_COLLECTION_FILE_NAME string = "collection.gob"
+
+// Snapshot writes a consistent copy of the collection to dirPath, which should not exist yet. Writes to the collection
+// are blocked while the snapshot is being taken.
+func (cl *Collection) Snapshot(dirPath string) error {
+	cl.readSnapshotsLock.Lock()
+	defer cl.readSnapshotsLock.Unlock()
+
+	// Batched index changes would be missing from the snapshot otherwise
+	err := cl.FlushIndexes()
+	if err != nil {
+		return err
+	}
+
+	err = linkDir(cl.fs(), cl.DirPath, dirPath, cl.getSnapshotFileMode)
+	if err != nil {
+		return err
+	}
+
+	// GobEncode leaves out the encryption keys
+	file, err := cl.fs().OpenFile(util.JoinPath(dirPath, SNAPSHOT_COLLECTION_FILE_NAME), os.O_WRONLY|os.O_CREATE|os.O_EXCL, util.FILE_PERM)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(file).Encode(cl)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// RestoreSnapshot recreates the collection dir from the snapshot at snapshotDirPath at dirPath, and returns the
+// collection as it was when the snapshot was taken. The returned collection expects its dir to be at its DirPath, so the
+// dir at dirPath should be moved there before it is used. The snapshot itself is left as it is, so it can be restored
+// again. If the collection is encrypted, its keys need to be provided using SetEncryptionKeys.
+func RestoreSnapshot(snapshotDirPath string, dirPath string) (*Collection, error) {
+	return RestoreSnapshotFS(util.OSFS{}, snapshotDirPath, dirPath)
+}
+
+// RestoreSnapshotFS is RestoreSnapshot for a snapshot in fsys. The dir is recreated in fsys as well, and the returned
+// collection uses it.
+func RestoreSnapshotFS(fsys util.FS, snapshotDirPath string, dirPath string) (*Collection, error) {
+	file, err := fsys.Open(util.JoinPath(snapshotDirPath, SNAPSHOT_COLLECTION_FILE_NAME))
+	if err != nil {
+		return nil, err
+	}
+	var cl *Collection = new(Collection)
+	err = gob.NewDecoder(file).Decode(cl)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	cl.SetFS(fsys)
+
+	err = linkDir(fsys, snapshotDirPath, dirPath, func(relPath string) snapshotFileMode {
+		if relPath == SNAPSHOT_COLLECTION_FILE_NAME {
+			return snapshotFileSkip
+		}
+		return cl.getSnapshotFileMode(relPath)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cl, nil
+}
+
+type snapshotFileMode int
+
+const (
+	snapshotFileLink snapshotFileMode = iota
+	snapshotFileCopy
+	snapshotFileSkip
+)
+
+// getSnapshotFileMode decides how the file at relPath (relative to the collection dir) goes into a snapshot, or back into
+// the collection from a snapshot
+func (cl *Collection) getSnapshotFileMode(relPath string) snapshotFileMode {
+	base := filepath.Base(relPath)
+	switch {
+	case relPath == util.JoinPath(META_DIR_NAME, WAL_FILE_NAME), relPath == util.JoinPath(META_DIR_NAME, INDEX_JOURNAL_FILE_NAME):
+		return snapshotFileSkip
+	case strings.HasPrefix(base, TEMP_FILE_PREFIX):
+		return snapshotFileSkip
+	case strings.HasPrefix(relPath, util.JoinPath(META_DIR_NAME, AUDIT_DIR_NAME)+string(os.PathSeparator)):
+		return snapshotFileSkip
+	case strings.HasPrefix(relPath, util.JoinPath(META_DIR_NAME, WAL_HISTORY_DIR_NAME)+string(os.PathSeparator)):
+		return snapshotFileSkip
+	case strings.HasPrefix(relPath, util.JoinPath(META_DIR_NAME, CHANGE_FEED_DIR_NAME)+string(os.PathSeparator)):
+		return snapshotFileSkip // appended to, and carries on across restores so that sequence numbers never go back
+	case strings.HasPrefix(relPath, util.JoinPath(META_DIR_NAME, MANIFEST_DIR_NAME)+string(os.PathSeparator)):
+		return snapshotFileSkip // appended to, and rebuilt from the partition dirs when missing
+	case relPath == util.JoinPath(META_DIR_NAME, KEY_ROTATION_PROGRESS_FILE_NAME):
+		return snapshotFileCopy // appended to
+	case relPath == util.JoinPath(META_DIR_NAME, REPARTITION_PROGRESS_FILE_NAME):
+		return snapshotFileCopy // appended to
+	case cl.isActiveSegmentFile(relPath):
+		return snapshotFileCopy // appended to
+	}
+	return snapshotFileLink
+}
+
+// linkDir recreates the dir tree at src at dst, hard linking (or copying, if linking is not supported) the files as
+// per getMode.
+func linkDir(fsys util.FS, src string, dst string, getMode func(relPath string) snapshotFileMode) error {
+	return util.Walk(fsys, src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dst, relPath)
+
+		if info.IsDir() {
+			return fsys.MkdirAll(dstPath, util.DIR_PERM)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		switch getMode(relPath) {
+		case snapshotFileSkip:
+			return nil
+		case snapshotFileLink:
+			err = fsys.Link(path, dstPath)
+			if err == nil {
+				return nil
+			}
+			util.Debugf("Could not hard link %s, copying it instead: %s", path, err)
+		}
+
+		return copyFile(fsys, path, dstPath)
+	})
+}
+
+func copyFile(fsys util.FS, src string, dst string) error {
+	in, err := fsys.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := fsys.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, util.FILE_PERM)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
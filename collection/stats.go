@@ -0,0 +1,267 @@
+package collection
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+/********************************************************************************
+* S T A T S
+*********************************************************************************/
+
+// The stats of a collection are gathered by going through all its documents once, the first time they are asked for, and
+// are then kept up to date by every write and delete. This keeps the size of every document in memory. Operations that
+// rewrite the documents in bulk (e.g. Alter) drop the stats, to be gathered again when they are next asked for. The
+// documents are also kept in the order they were written in, oldest first, for capped collections (see evict). When
+// the stats are gathered, that order comes from the modification times of the files. The order they were used in, and
+// how often, is kept for the collections in cache mode, see EvictionPolicy.
+
+type (
+	// Stats describes the documents and the indexes of a collection, see GetStats
+	Stats struct {
+		NumDocuments    int
+		RawBytes        int64          // the size of the data of the documents, as GetFileData returns it
+		StoredBytes     int64          // the size of the files of the documents, i.e. after compression and encryption
+		PartitionCounts map[string]int // partition dir name -> number of documents in that partition
+		Indexes         []IndexStats
+		LastWriteTime   time.Time // zero if the collection has never been written to
+	}
+
+	IndexStats struct {
+		FieldLocator string
+		NumValues    int
+		Bytes        int64 // the size of the index file
+	}
+
+	// docStats are the stats that are kept for each document
+	docStats struct {
+		rawBytes    int64
+		storedBytes int64
+		elem        *list.Element // of collectionStats.order
+		usageElem   *list.Element // of collectionStats.usage
+		numUses     int64         // reads and writes, see noteUse
+	}
+
+	// collectionStats are the stats of all the documents of a collection, see getStats
+	collectionStats struct {
+		docs            map[key.Key]docStats
+		order           *list.List // of key.Key, the least recently written first
+		usage           *list.List // of key.Key, the least recently used first
+		rawBytes        int64
+		storedBytes     int64
+		partitionCounts map[string]int
+		lastWriteTime   time.Time
+	}
+)
+
+// GetStats returns the stats of the collection. The first call goes through all the documents, and blocks writes while
+// doing so. Later calls are cheap.
+func (cl *Collection) GetStats() (Stats, error) {
+	s, err := cl.getStats()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	cl.statsLock.Lock()
+	stats := Stats{
+		NumDocuments:    len(s.docs),
+		RawBytes:        s.rawBytes,
+		StoredBytes:     s.storedBytes,
+		PartitionCounts: make(map[string]int, len(s.partitionCounts)),
+		LastWriteTime:   s.lastWriteTime,
+	}
+	for name, n := range s.partitionCounts {
+		stats.PartitionCounts[name] = n
+	}
+	cl.statsLock.Unlock()
+
+	cl.IndexStore.RLock()
+	for fieldLocator, info := range cl.IndexStore.Store {
+		stats.Indexes = append(stats.Indexes, IndexStats{FieldLocator: fieldLocator, NumValues: info.NumValues})
+	}
+	cl.IndexStore.RUnlock()
+	for i := range stats.Indexes {
+		info, err := cl.fs().Stat(util.JoinPath(cl.GetDirPathForIndexes(), stats.Indexes[i].FieldLocator))
+		if err != nil && !os.IsNotExist(err) {
+			return Stats{}, err
+		}
+		if err == nil {
+			stats.Indexes[i].Bytes = info.Size()
+		}
+	}
+
+	return stats, nil
+}
+
+// getStats returns the stats of the collection, gathering them first if needed
+func (cl *Collection) getStats() (*collectionStats, error) {
+	cl.statsLock.Lock()
+	s := cl.stats
+	cl.statsLock.Unlock()
+	if s != nil {
+		return s, nil
+	}
+
+	// Writes update the stats while holding readSnapshotsLock for reading, so none are missed while gathering them
+	cl.readSnapshotsLock.Lock()
+	defer cl.readSnapshotsLock.Unlock()
+	cl.statsLock.Lock()
+	s = cl.stats
+	cl.statsLock.Unlock()
+	if s != nil { // gathered by someone else meanwhile
+		return s, nil
+	}
+
+	type statsEntry struct {
+		k       key.Key
+		d       docStats
+		modTime time.Time
+	}
+	var entries []statsEntry
+	s = &collectionStats{docs: make(map[key.Key]docStats), order: list.New(), usage: list.New(), partitionCounts: make(map[string]int)}
+	err := cl.forEachDoc(func(k key.Key, docPath string) error {
+		fileName, fileData, err := cl.readDocFile(k)
+		if os.IsNotExist(err) { // deleted since it was listed
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		info, err := cl.fs().Stat(docPath)
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(s.lastWriteTime) {
+			s.lastWriteTime = info.ModTime()
+		}
+		d, err := cl.newDocStats(k, fileName, fileData)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, statsEntry{k: k, d: d, modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) { // no documents have been written yet
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	for _, e := range entries {
+		s.put(cl, e.k, e.d)
+	}
+	if cl.getEvictionPolicy() != EVICTION_POLICY_NONE {
+		err = cl.applyAccessLog(s)
+		if err != nil { // the documents are then evicted as if they had only been written
+			util.Warnf("Could not read the access log of collection %s, ignoring it: %s", cl.Name, err)
+		}
+	}
+
+	cl.statsLock.Lock()
+	cl.stats = s
+	cl.statsLock.Unlock()
+	return s, nil
+}
+
+// noteStoredDoc updates the stats, if they have been gathered, for fileData having been stored as the document for k
+func (cl *Collection) noteStoredDoc(k key.Key, fileName string, fileData []byte) {
+	cl.statsLock.Lock()
+	defer cl.statsLock.Unlock()
+	if cl.stats == nil {
+		return
+	}
+	cl.stats.lastWriteTime = time.Now()
+	d, err := cl.newDocStats(k, fileName, fileData)
+	if err != nil {
+		// the write itself has been done, so the stats are gathered again rather than failing it
+		util.Warnf("Could not update the stats of collection %s for document %s, dropping them: %s", cl.Name, k, err)
+		cl.stats = nil
+		return
+	}
+	cl.stats.put(cl, k, d)
+}
+
+// noteRemovedDoc updates the stats, if they have been gathered, for the document for k having been removed
+func (cl *Collection) noteRemovedDoc(k key.Key) {
+	cl.statsLock.Lock()
+	defer cl.statsLock.Unlock()
+	if cl.stats == nil {
+		return
+	}
+	cl.stats.lastWriteTime = time.Now()
+	cl.stats.remove(cl, k)
+}
+
+// dropStats drops the stats, which are gathered again when they are next asked for
+func (cl *Collection) dropStats() {
+	cl.statsLock.Lock()
+	cl.stats = nil
+	cl.statsLock.Unlock()
+}
+
+// newDocStats returns the stats of the document for k, stored as fileData
+func (cl *Collection) newDocStats(k key.Key, fileName string, fileData []byte) (docStats, error) {
+	rawBytes, err := cl.getRawSize(k, fileName, fileData)
+	if err != nil {
+		return docStats{}, err
+	}
+	return docStats{rawBytes: rawBytes, storedBytes: int64(len(fileData))}, nil
+}
+
+// put adds (or replaces) the stats d of the document for k, as the most recently written (and used) document
+func (s *collectionStats) put(cl *Collection, k key.Key, d docStats) {
+	d.numUses = s.docs[k].numUses + 1
+	s.remove(cl, k)
+	d.elem = s.order.PushBack(k)
+	d.usageElem = s.usage.PushBack(k)
+	s.docs[k] = d
+	s.rawBytes += d.rawBytes
+	s.storedBytes += d.storedBytes
+	s.partitionCounts[k.GetPartitionDirName(cl.getNumPartitions())]++
+}
+
+// remove removes the document for k from the stats, if it is in them
+func (s *collectionStats) remove(cl *Collection, k key.Key) {
+	d, ok := s.docs[k]
+	if !ok {
+		return
+	}
+	delete(s.docs, k)
+	s.order.Remove(d.elem)
+	s.usage.Remove(d.usageElem)
+	s.rawBytes -= d.rawBytes
+	s.storedBytes -= d.storedBytes
+	pName := k.GetPartitionDirName(cl.getNumPartitions())
+	s.partitionCounts[pName]--
+	if s.partitionCounts[pName] == 0 {
+		delete(s.partitionCounts, pName)
+	}
+}
+
+// getRawSize returns the size of the data of the document for k from fileData, the content of its file, without
+// decompressing it: the size of gzipped data is in the gzip footer
+func (cl *Collection) getRawSize(k key.Key, fileName string, fileData []byte) (int64, error) {
+	h, r, err := cl.openDocReader(ioutil.NopCloser(bytes.NewReader(fileData)), fileName, k, false)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	if !h.IsGzipped {
+		return io.Copy(ioutil.Discard, r)
+	}
+	gzData, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	if len(gzData) < 4 {
+		return 0, corruptionError{ErrGzipIsIncomplete}
+	}
+	return int64(binary.LittleEndian.Uint32(gzData[len(gzData)-4:])), nil
+}
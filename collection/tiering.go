@@ -0,0 +1,414 @@
+package collection
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/********************************************************************************
+* H O T / C O L D  T I E R I N G
+*********************************************************************************/
+
+// With ColdAfter set, MoveColdDocuments moves the documents that haven't been read for that long out of the partition
+// dirs, into the cold dir of the collection, gzip compressed as a whole. This keeps the partition dirs small, and the
+// rarely used data cheap to keep. A document is "read" when it is fetched with GetFile, GetFileData, GetIntoStruct,
+// GetIntoWriter or GetRawIntoWriter, or written. Read times are only tracked in memory, so after a restart, the mod time
+// of the document file is all there is to go on.
+//
+// Fetching a cold document moves it back to its partition dir. Everything else (searches, scans, index builds, Verify)
+// reads cold documents where they are, without warming them up. Writes to a cold document replace it in the partition
+// dir, and deletes remove it from both places.
+
+const COLD_DIR_NAME string = "cold"
+const COLD_FILE_EXTENSION string = ".cold"
+
+var ErrColdTieringNotEnabled = fmt.Errorf("Documents can only be moved to the cold dir if ColdAfter is set for the collection")
+
+const (
+	coldStateUnknown int32 = iota
+	coldStateNone          // there is no cold dir, so no document can be cold
+	coldStateSome          // there is a cold dir, so documents may be cold
+)
+
+func (cl *Collection) getColdDirPath() string {
+	return util.JoinPath(cl.DirPath, COLD_DIR_NAME)
+}
+
+// mayHaveColdDocs tells whether any document of the collection may be cold. It only looks for the cold dir once, so that
+// collections that have never used tiering don't pay for it on every read and write.
+func (cl *Collection) mayHaveColdDocs() bool {
+	state := atomic.LoadInt32(&cl.coldState)
+	if state == coldStateUnknown {
+		state = coldStateNone
+		if _, err := cl.fs().Stat(cl.getColdDirPath()); err == nil {
+			state = coldStateSome
+		}
+		atomic.CompareAndSwapInt32(&cl.coldState, coldStateUnknown, state)
+		state = atomic.LoadInt32(&cl.coldState)
+	}
+	return state == coldStateSome
+}
+
+// getExistingColdFilePath returns the path of the cold file of the document for k. If the document isn't cold, the
+// returned error satisfies os.IsNotExist.
+func (cl *Collection) getExistingColdFilePath(k key.Key) (string, error) {
+	pDirPath := util.JoinPath(cl.getColdDirPath(), k.GetPartitionDirName(cl.getNumPartitions()))
+	var err error
+	isGzipEnabled := cl.isGzipEnabled()
+	for _, isGzipped := range []bool{isGzipEnabled, !isGzipEnabled} {
+		name := cl.getDocFileName(k, isGzipped) + COLD_FILE_EXTENSION
+		// the cold file may not have been moved yet, see StartRepartition
+		paths := []string{util.JoinPath(pDirPath, name)}
+		if oldPath := cl.getOldPartitionPath(cl.getColdDirPath(), k, name); oldPath != "" {
+			paths = append(paths, oldPath, paths[0])
+		}
+		for _, path := range paths {
+			if _, err = cl.fs().Stat(path); err == nil {
+				return path, nil
+			}
+			if !os.IsNotExist(err) {
+				return "", err
+			}
+		}
+	}
+	return "", err
+}
+
+// noteRead records that the document for k is being read (see noteUse), and moves it back from the cold dir if it is
+// there. The latter is a no-op unless ColdAfter is set. If the document has expired, it returns an error that satisfies
+// os.IsNotExist instead, see checkNotExpired.
+func (cl *Collection) noteRead(k key.Key) error {
+	err := cl.checkNotExpired(k)
+	if err != nil {
+		return err
+	}
+	err = cl.noteUse(k)
+	if err != nil {
+		return err
+	}
+	if cl.ColdAfter <= 0 || cl.isSegmented() {
+		return nil
+	}
+
+	cl.readTimesLock.Lock()
+	if cl.readTimes == nil {
+		cl.readTimes = make(map[key.Key]time.Time)
+	}
+	cl.readTimes[k] = time.Now()
+	cl.readTimesLock.Unlock()
+
+	if !cl.mayHaveColdDocs() {
+		return nil
+	}
+	_, err = cl.getExistingFilePath(k)
+	if os.IsNotExist(err) {
+		return cl.restoreColdDoc(k)
+	}
+	return err
+}
+
+// MoveColdDocuments moves the documents that haven't been read for ColdAfter into the cold dir. It returns the number of
+// documents moved.
+func (cl *Collection) MoveColdDocuments() (int, error) {
+	if cl.ColdAfter <= 0 {
+		return 0, ErrColdTieringNotEnabled
+	}
+	if cl.isSegmented() {
+		return 0, ErrSegmentStorageNotSupported
+	}
+
+	pDirPaths, err := cl.getPartitionDirPaths()
+	if os.IsNotExist(err) { // no documents have been written yet
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	coldBefore := time.Now().Add(-cl.ColdAfter)
+	var numMoved int
+	for _, pDirPath := range pDirPaths {
+		err = cl.forEachDocInPartitionDir(pDirPath, func(k key.Key, docPath string) error {
+			isMoved, err := cl.moveToCold(k, coldBefore)
+			if isMoved {
+				numMoved++
+			}
+			return err
+		})
+		if err != nil {
+			return numMoved, err
+		}
+	}
+
+	return numMoved, nil
+}
+
+// moveToCold moves the document for k into the cold dir, if it hasn't been read or written since coldBefore
+func (cl *Collection) moveToCold(k key.Key, coldBefore time.Time) (bool, error) {
+	defer cl.lockKey(k)()
+
+	cl.readTimesLock.Lock()
+	readTime := cl.readTimes[k]
+	cl.readTimesLock.Unlock()
+	if readTime.After(coldBefore) {
+		return false, nil
+	}
+
+	path, err := cl.getExistingFilePath(k)
+	if os.IsNotExist(err) { // deleted since it was listed
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	info, err := cl.fs().Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().After(coldBefore) {
+		return false, nil
+	}
+
+	fileData, err := util.ReadFile(cl.fs(), path)
+	if err != nil {
+		return false, err
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	gz := getGzipWriter(buf)
+	_, err = gz.Write(fileData)
+	if err == nil {
+		err = gz.Close()
+	}
+	putGzipWriter(gz)
+	if err != nil {
+		return false, err
+	}
+
+	cl.coldLock.Lock()
+	defer cl.coldLock.Unlock()
+
+	// The cold file is written before the document file is removed, so that readers always find one of the two
+	coldPDirPath := util.JoinPath(cl.getColdDirPath(), k.GetPartitionDirName(cl.getNumPartitions()))
+	err = util.CreateDirIfNotExist(cl.fs(), coldPDirPath)
+	if err != nil {
+		return false, err
+	}
+	atomic.StoreInt32(&cl.coldState, coldStateSome)
+	err = cl.writeFile(util.JoinPath(coldPDirPath, filepath.Base(path)+COLD_FILE_EXTENSION), buf.Bytes())
+	if err != nil {
+		return false, err
+	}
+	err = cl.fs().Remove(path)
+	if err != nil {
+		return false, err
+	}
+	err = cl.syncRenamed(path)
+	if err != nil {
+		return false, err
+	}
+
+	cl.readTimesLock.Lock()
+	delete(cl.readTimes, k)
+	cl.readTimesLock.Unlock()
+
+	return true, cl.refreshManifestEntry(k)
+}
+
+// restoreColdDoc moves the document for k from the cold dir back to its partition dir. It is a no-op if the document
+// isn't cold. A document that has been written to its partition dir in the meantime is left as it is.
+func (cl *Collection) restoreColdDoc(k key.Key) error {
+	cl.coldLock.Lock()
+	defer cl.coldLock.Unlock()
+
+	coldPath, err := cl.getExistingColdFilePath(k)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fileName, fileData, err := cl.readColdFile(coldPath)
+	if err != nil {
+		return err
+	}
+
+	dirPath, err := cl.ensurePartitionDir(k)
+	if err != nil {
+		return err
+	}
+	err = cl.writeNewFile(util.JoinPath(dirPath, fileName), fileData)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	err = cl.fs().Remove(coldPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = cl.syncRenamed(coldPath)
+	if err != nil {
+		return err
+	}
+
+	return cl.refreshManifestEntry(k)
+}
+
+// restoreAllColdDocs moves all the cold documents back to their partition dirs
+func (cl *Collection) restoreAllColdDocs() error {
+	if !cl.mayHaveColdDocs() {
+		return nil
+	}
+	return cl.forEachColdDoc(func(k key.Key, coldPath string) error {
+		return cl.restoreColdDoc(k)
+	})
+}
+
+// removeColdDocFile removes the cold file of the document for k, if there is one. It should be called after the
+// document has been written to its partition dir, and before it is removed from there, so that a concurrent
+// restoreColdDoc can't bring back an older version of it.
+func (cl *Collection) removeColdDocFile(k key.Key) error {
+	if !cl.mayHaveColdDocs() {
+		return nil
+	}
+
+	cl.coldLock.Lock()
+	defer cl.coldLock.Unlock()
+
+	coldPath, err := cl.getExistingColdFilePath(k)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = cl.fs().Remove(coldPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return cl.syncRenamed(coldPath)
+}
+
+// readColdFile returns the name the document file at coldPath has in its partition dir, and its content
+func (cl *Collection) readColdFile(coldPath string) (string, []byte, error) {
+	rc, fileName, err := cl.openColdFile(coldPath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rc.Close()
+
+	fileData, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return "", nil, newGzipCorruptionError(err)
+	}
+	return fileName, fileData, nil
+}
+
+// openColdFile opens the cold file at coldPath. The returned reader gives the content of the document file, and the
+// returned name is the one the file has in its partition dir.
+func (cl *Collection) openColdFile(coldPath string) (io.ReadCloser, string, error) {
+	file, err := cl.fs().Open(coldPath)
+	if err != nil {
+		return nil, "", err
+	}
+	gz, err := getGzipReader(file)
+	if err != nil {
+		file.Close()
+		return nil, "", newGzipCorruptionError(err)
+	}
+
+	rc := struct {
+		io.Reader
+		io.Closer
+	}{gz, closerFunc(func() error {
+		putGzipReader(gz)
+		return file.Close()
+	})}
+	return rc, strings.TrimSuffix(filepath.Base(coldPath), COLD_FILE_EXTENSION), nil
+}
+
+// openColdDoc is like openDoc, for a cold document. It reads the document from the cold dir, without moving it back.
+func (cl *Collection) openColdDoc(k key.Key, decompress bool) (docHeader, *docReader, error) {
+	coldPath, err := cl.getExistingColdFilePath(k)
+	if err != nil {
+		return docHeader{}, nil, err
+	}
+	rc, fileName, err := cl.openColdFile(coldPath)
+	if err != nil {
+		return docHeader{}, nil, err
+	}
+	return cl.openDocReader(rc, fileName, k, decompress)
+}
+
+// readColdDocFile is like readDocFile, for a cold document. The returned name is the path the document file would have
+// in its partition dir.
+func (cl *Collection) readColdDocFile(k key.Key) (string, []byte, error) {
+	coldPath, err := cl.getExistingColdFilePath(k)
+	if err != nil {
+		return "", nil, err
+	}
+	fileName, fileData, err := cl.readColdFile(coldPath)
+	if err != nil {
+		return "", nil, err
+	}
+	return util.JoinPath(cl.getPartitionDirPath(k), fileName), fileData, nil
+}
+
+// forEachColdDoc calls fn for every cold document of the collection, with the path of its cold file. It stops at the
+// first error.
+func (cl *Collection) forEachColdDoc(fn func(k key.Key, coldPath string) error) error {
+	pDirInfos, err := util.ReadDir(cl.fs(), cl.getColdDirPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, pDirInfo := range pDirInfos {
+		if !pDirInfo.IsDir() {
+			continue
+		}
+		pDirPath := util.JoinPath(cl.getColdDirPath(), pDirInfo.Name())
+		coldNames, err := cl.getDirNames(pDirPath)
+		if err != nil {
+			return err
+		}
+		for _, coldName := range coldNames {
+			if !strings.HasSuffix(coldName, COLD_FILE_EXTENSION) {
+				continue
+			}
+			k, err := key.GetKeyFromFileName(strings.TrimSuffix(coldName, COLD_FILE_EXTENSION))
+			if err != nil {
+				return err
+			}
+			err = fn(k, util.JoinPath(pDirPath, coldName))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// countColdDocs returns the number of cold documents of the collection
+func (cl *Collection) countColdDocs() (int, error) {
+	if !cl.mayHaveColdDocs() {
+		return 0, nil
+	}
+	var n int
+	err := cl.forEachColdDoc(func(k key.Key, coldPath string) error {
+		n++
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,129 @@
+package collection
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/teejays/gofiledb/util"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/********************************************************************************
+* U S E R  M E T A
+*********************************************************************************/
+
+// Applications can keep their own metadata about a collection (e.g. a schema version, a sync cursor or an owner) with
+// the collection itself, using SetMeta and GetMeta. Each entry is gob encoded into its own file in USER_META_DIR_NAME in
+// the meta dir, so it goes wherever the collection goes: it is renamed, snapshotted, cloned and altered along with it.
+// The entries are not encrypted, even if the collection is.
+
+const USER_META_DIR_NAME string = "user"
+
+var ErrMetaIsNotExist = fmt.Errorf("Collection meta not found")
+var ErrInvalidMetaName = fmt.Errorf("Collection meta names can only have letters, digits, '_', '-' and '.', and can't start with '.'")
+
+var metaNameRgx = regexp.MustCompile(`^[a-zA-Z0-9_\-][a-zA-Z0-9_\-.]*$`)
+
+func (cl *Collection) getUserMetaDirPath() string {
+	return util.JoinPath(cl.DirPath, META_DIR_NAME, USER_META_DIR_NAME)
+}
+
+func validateMetaName(name string) error {
+	if !metaNameRgx.MatchString(name) || strings.HasPrefix(name, TEMP_FILE_PREFIX) {
+		return ErrInvalidMetaName
+	}
+	return nil
+}
+
+// SetMeta saves v as the meta entry name of the collection, replacing it if it exists. v is gob encoded, so it should
+// be decoded into a value of the same type by GetMeta.
+func (cl *Collection) SetMeta(name string, v interface{}) error {
+	err := validateMetaName(name)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return err
+	}
+
+	err = util.CreateDirIfNotExist(cl.fs(), cl.getUserMetaDirPath())
+	if err != nil {
+		return err
+	}
+	return cl.writeFile(util.JoinPath(cl.getUserMetaDirPath(), name), buf.Bytes())
+}
+
+// GetMeta decodes the meta entry name of the collection into v, which should be a pointer. It returns ErrMetaIsNotExist
+// if there is no such entry.
+func (cl *Collection) GetMeta(name string, v interface{}) error {
+	err := validateMetaName(name)
+	if err != nil {
+		return err
+	}
+
+	data, err := util.ReadFile(cl.fs(), util.JoinPath(cl.getUserMetaDirPath(), name))
+	if os.IsNotExist(err) {
+		return ErrMetaIsNotExist
+	}
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// DeleteMeta removes the meta entry name of the collection. It returns ErrMetaIsNotExist if there is no such entry.
+func (cl *Collection) DeleteMeta(name string) error {
+	err := validateMetaName(name)
+	if err != nil {
+		return err
+	}
+
+	err = cl.fs().Remove(util.JoinPath(cl.getUserMetaDirPath(), name))
+	if os.IsNotExist(err) {
+		return ErrMetaIsNotExist
+	}
+	return err
+}
+
+// ListMeta returns the names of the meta entries of the collection, sorted
+func (cl *Collection) ListMeta() ([]string, error) {
+	names, err := cl.getDirNames(cl.getUserMetaDirPath())
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// CopyMetaTo copies all the meta entries of the collection to dst, replacing the entries of dst with the same names
+func (cl *Collection) CopyMetaTo(dst *Collection) error {
+	names, err := cl.ListMeta()
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	err = util.CreateDirIfNotExist(dst.fs(), dst.getUserMetaDirPath())
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		data, err := util.ReadFile(cl.fs(), util.JoinPath(cl.getUserMetaDirPath(), name))
+		if err != nil {
+			return err
+		}
+		err = dst.writeFile(util.JoinPath(dst.getUserMetaDirPath(), name), data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
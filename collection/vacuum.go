@@ -0,0 +1,188 @@
+package collection
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"os"
+	"strings"
+	"time"
+)
+
+/********************************************************************************
+* V A C U U M
+*********************************************************************************/
+
+// Vacuum removes what the collection has no use for anymore from its dirs, which reclaims the space it takes up and
+// keeps the scans from going through it:
+//   - the empty partition dirs of documents, cold documents and revisions, e.g. once their documents have been deleted
+//   - the temp files left behind by interrupted operations, see Recover
+//   - the index files of indexes that the collection doesn't have anymore
+//   - the files in the partition dirs of the documents that aren't documents of the collection, e.g. because their
+//     names don't parse to keys. They are reported, since they may have been put there by someone by mistake.
+//
+// Unlike Recover, it can be run while the collection is in use. The temp files and index files that have been changed
+// in the last VACUUM_MIN_AGE are left alone, since they may be those of operations in progress.
+
+const VACUUM_MIN_AGE time.Duration = time.Hour
+
+var ErrVacuumWhileRepartitioning = fmt.Errorf("The collection cannot be vacuumed while it is being repartitioned")
+
+type VacuumReport struct {
+	NumEmptyDirsRemoved  int
+	NumTempFilesRemoved  int
+	NumIndexFilesRemoved int
+	InvalidFilesRemoved  []string // the paths of the files removed from the partition dirs that weren't documents
+}
+
+// Vacuum removes the files and dirs that the collection doesn't use anymore, see VacuumReport. It is not supported while
+// the collection is being repartitioned, since its documents are moving between partition dirs then.
+func (cl *Collection) Vacuum() (VacuumReport, error) {
+	var report VacuumReport
+	if cl.isRepartitioning() {
+		return report, ErrVacuumWhileRepartitioning
+	}
+
+	var err error
+	report.NumTempFilesRemoved, err = cl.removeTempFiles(VACUUM_MIN_AGE)
+	if err != nil {
+		return report, err
+	}
+
+	report.NumIndexFilesRemoved, err = cl.removeOrphanedIndexFiles()
+	if err != nil {
+		return report, err
+	}
+
+	if !cl.isSegmented() {
+		report.InvalidFilesRemoved, err = cl.removeInvalidDocFiles()
+		if err != nil {
+			return report, err
+		}
+	}
+
+	report.NumEmptyDirsRemoved, err = cl.removeEmptyPartitionDirs()
+	if err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+// removeOrphanedIndexFiles removes the files in the indexes dir that aren't the file of one of the indexes of the
+// collection, and haven't been changed in the last VACUUM_MIN_AGE (an index that is being added is saved before it is
+// added). It returns the number of files removed.
+func (cl *Collection) removeOrphanedIndexFiles() (int, error) {
+	dirPath := cl.GetDirPathForIndexes()
+	infos, err := util.ReadDir(cl.fs(), dirPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var numRemoved int
+	for _, info := range infos {
+		if info.IsDir() || cl.isIndexExist(info.Name()) || time.Since(info.ModTime()) < VACUUM_MIN_AGE {
+			continue
+		}
+		path := util.JoinPath(dirPath, info.Name())
+		util.Warnf("Vacuum %s: removing the file of an index that doesn't exist: %s", cl.Name, path)
+		err = cl.fs().Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return numRemoved, err
+		}
+		numRemoved++
+	}
+	return numRemoved, nil
+}
+
+// removeInvalidDocFiles removes the files in the partition dirs of the documents whose names aren't those of documents
+// of the collection, and returns their paths. The temp files are left to removeTempFiles.
+func (cl *Collection) removeInvalidDocFiles() ([]string, error) {
+	dataPath := cl.getDataPath()
+	pDirInfos, err := util.ReadDir(cl.fs(), dataPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, pDirInfo := range pDirInfos {
+		if !pDirInfo.IsDir() || !strings.HasPrefix(pDirInfo.Name(), key.DATA_PARTITION_PREFIX) {
+			continue // see VERIFY_PROBLEM_NOT_A_PARTITION_DIR
+		}
+		pDirPath := util.JoinPath(dataPath, pDirInfo.Name())
+		names, err := cl.getDirNames(pDirPath)
+		if err != nil {
+			return removed, err
+		}
+
+		for _, name := range names {
+			if strings.HasPrefix(name, cl.Name+"_") {
+				if _, err := key.GetKeyFromFileName(name); err == nil {
+					continue
+				}
+			} else if strings.HasPrefix(name, TEMP_FILE_PREFIX) {
+				continue
+			}
+			path := util.JoinPath(pDirPath, name)
+			util.Warnf("Vacuum %s: removing a file that isn't a document of the collection: %s", cl.Name, path)
+			err = cl.fs().RemoveAll(path)
+			if err != nil {
+				return removed, err
+			}
+			removed = append(removed, path)
+		}
+	}
+	return removed, nil
+}
+
+// removeEmptyPartitionDirs removes the partition dirs of the documents, cold documents and revisions that are empty. The
+// writes are held off meanwhile, so that none of them writes to a dir that is being removed. It returns the number of
+// dirs removed.
+func (cl *Collection) removeEmptyPartitionDirs() (int, error) {
+	cl.lockAllKeys()
+	defer cl.unlockAllKeys()
+
+	var numRemoved int
+	for _, dirPath := range []string{cl.getDataPath(), cl.getColdDirPath(), cl.getRevisionsDirPath()} {
+		pDirInfos, err := util.ReadDir(cl.fs(), dirPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return numRemoved, err
+		}
+
+		for _, pDirInfo := range pDirInfos {
+			if !pDirInfo.IsDir() || !strings.HasPrefix(pDirInfo.Name(), key.DATA_PARTITION_PREFIX) {
+				continue
+			}
+			pDirPath := util.JoinPath(dirPath, pDirInfo.Name())
+			names, err := cl.getDirNames(pDirPath)
+			if err != nil {
+				return numRemoved, err
+			}
+			if len(names) > 0 {
+				continue
+			}
+			err = cl.fs().Remove(pDirPath)
+			if err != nil && !os.IsNotExist(err) {
+				return numRemoved, err
+			}
+			numRemoved++
+		}
+	}
+
+	// the path cache may know some of the dirs as existing
+	if numRemoved > 0 {
+		cl.pathsLock.Lock()
+		cl.paths = nil
+		cl.pathsLock.Unlock()
+	}
+	return numRemoved, nil
+}
@@ -0,0 +1,448 @@
+package collection
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/********************************************************************************
+* V E R I F Y
+*********************************************************************************/
+
+// Verify does an fsck-style check of the collection on disk, and optionally repairs the problems it can. Problems that
+// can't be repaired safely (e.g. files we don't recognize) are only reported, and are left for the user to look at.
+
+const (
+	VERIFY_PROBLEM_NOT_A_PARTITION_DIR  string = "not_a_partition_dir"  // a file in the data dir, where only partition dirs should be
+	VERIFY_PROBLEM_INVALID_FILE_NAME    string = "invalid_file_name"    // a file in a partition dir that doesn't parse to a key
+	VERIFY_PROBLEM_WRONG_PARTITION      string = "wrong_partition"      // a document in a partition dir that doesn't match its key's hash
+	VERIFY_PROBLEM_CORRUPTED_DOCUMENT   string = "corrupted_document"   // a document that can't be decompressed or decoded
+	VERIFY_PROBLEM_INCOMPLETE_DOCUMENT  string = "incomplete_document"  // a gzipped document that ends early, e.g. because of a torn write
+	VERIFY_PROBLEM_UNREADABLE_DOCUMENT  string = "unreadable_document"  // a document that can't be read for any other reason, e.g. a wrong key
+	VERIFY_PROBLEM_UNREADABLE_INDEX     string = "unreadable_index"     // an index file that is missing or can't be loaded
+	VERIFY_PROBLEM_DANGLING_INDEX_KEY   string = "dangling_index_key"   // an index that references a document that doesn't exist
+	VERIFY_PROBLEM_INDEX_COUNT_MISMATCH string = "index_count_mismatch" // the meta count of an index doesn't match the index
+	VERIFY_PROBLEM_STALE_MANIFEST       string = "stale_manifest"       // the partition manifests don't list the documents that exist
+)
+
+type VerifyReport struct {
+	CollectionName string
+	NumDocuments   int // number of documents that were found and verified as readable
+	NumIndexes     int
+	Problems       []VerifyProblem
+}
+
+type VerifyProblem struct {
+	Type        string
+	Path        string  // the file with the problem
+	Key         key.Key // the document key, if known
+	Description string
+	IsRepaired  bool
+}
+
+// NumRepaired returns the number of problems that were repaired
+func (r VerifyReport) NumRepaired() int {
+	var n int
+	for _, p := range r.Problems {
+		if p.IsRepaired {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *VerifyReport) addProblem(p VerifyProblem) {
+	util.Warnf("Verify %s: %s at %s: %s (repaired: %t)", r.CollectionName, p.Type, p.Path, p.Description, p.IsRepaired)
+	r.Problems = append(r.Problems, p)
+}
+
+// Verify checks that every file in the data dir of the collection is a readable document in the right partition, and
+// that the indexes only reference existing documents and agree with their meta counts. If repair is true, misplaced
+// documents are moved to the right partition, corrupted documents are quarantined, and indexes are fixed.
+func (cl *Collection) Verify(repair bool) (VerifyReport, error) {
+	var report VerifyReport = VerifyReport{CollectionName: cl.Name}
+
+	existingKeys, err := cl.verifyDocs(repair, &report)
+	if err != nil {
+		return report, err
+	}
+
+	err = cl.verifyIndexes(existingKeys, repair, &report)
+	if err != nil {
+		return report, err
+	}
+
+	err = cl.verifyManifests(existingKeys, repair, &report)
+	if err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+// verifyDocs checks all the document files, and returns the keys of the documents that exist after the check
+func (cl *Collection) verifyDocs(repair bool, report *VerifyReport) (map[key.Key]bool, error) {
+	if cl.isSegmented() {
+		return cl.verifySegmentDocs(repair, report)
+	}
+
+	var existingKeys map[key.Key]bool = make(map[key.Key]bool)
+	var movedPaths map[string]bool = make(map[string]bool) // documents moved into a partition we may not have visited yet
+
+	dataPath := cl.getDataPath()
+	pDirInfos, err := util.ReadDir(cl.fs(), dataPath)
+	if os.IsNotExist(err) {
+		return existingKeys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pDirInfo := range pDirInfos {
+		pDirPath := util.JoinPath(dataPath, pDirInfo.Name())
+		if !pDirInfo.IsDir() || !strings.HasPrefix(pDirInfo.Name(), key.DATA_PARTITION_PREFIX) {
+			report.addProblem(VerifyProblem{
+				Type:        VERIFY_PROBLEM_NOT_A_PARTITION_DIR,
+				Path:        pDirPath,
+				Description: "unexpected entry in the data dir",
+			})
+			continue
+		}
+
+		docInfos, err := util.ReadDir(cl.fs(), pDirPath)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, docInfo := range docInfos {
+			docName := docInfo.Name()
+			docPath := util.JoinPath(pDirPath, docName)
+			if movedPaths[docPath] {
+				continue
+			}
+
+			k, err := key.GetKeyFromFileName(docName)
+			if err != nil || !strings.HasPrefix(docName, cl.Name+"_") {
+				report.addProblem(VerifyProblem{
+					Type:        VERIFY_PROBLEM_INVALID_FILE_NAME,
+					Path:        docPath,
+					Description: "file name is not a document file name of this collection",
+				})
+				continue
+			}
+
+			// Is it in the right partition?
+			// a document that hasn't been moved yet by a repartitioning is where it should be for now
+			if expected := k.GetPartitionDirName(cl.getNumPartitions()); expected != pDirInfo.Name() && !cl.isInOldPartition(k, pDirInfo.Name()) {
+				p := VerifyProblem{
+					Type:        VERIFY_PROBLEM_WRONG_PARTITION,
+					Path:        docPath,
+					Key:         k,
+					Description: "document should be in " + expected,
+				}
+				if repair {
+					docPath, p.IsRepaired, err = cl.moveToPartition(k, docPath, expected)
+					if err != nil {
+						return nil, err
+					}
+					movedPaths[docPath] = p.IsRepaired
+				}
+				report.addProblem(p)
+				if !p.IsRepaired {
+					existingKeys[k] = true // moving it is all that's needed for the indexes to be right
+					continue
+				}
+			}
+
+			// Can it be read back?
+			err = cl.verifyReadableDoc(k, docPath, cl.verifyDocFile(k, docPath), repair, report, existingKeys)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Cold documents are only checked when they are moved back, but they still exist as far as the indexes are concerned
+	err = cl.forEachColdDoc(func(k key.Key, coldPath string) error {
+		existingKeys[k] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return existingKeys, nil
+}
+
+// verifySegmentDocs is verifyDocs for collections with STORAGE_SEGMENTS. Segments don't have partitions or file names
+// that can be wrong, so it is only the documents themselves that are checked.
+func (cl *Collection) verifySegmentDocs(repair bool, report *VerifyReport) (map[key.Key]bool, error) {
+	var existingKeys map[key.Key]bool = make(map[key.Key]bool)
+
+	err := cl.forEachSegmentDoc(func(k key.Key, segmentPath string) error {
+		h, r, err := cl.openSegmentDoc(k, true)
+		if os.IsNotExist(err) { // deleted since it was listed
+			return nil
+		}
+		if err == nil {
+			err = cl.verifyDocReader(h, r)
+		}
+		return cl.verifyReadableDoc(k, segmentPath, err, repair, report, existingKeys)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return existingKeys, nil
+}
+
+// verifyReadableDoc records the result of reading back the document for k, i.e. err, in report. If the document is
+// corrupted and repair is true, it is quarantined. The document is added to existingKeys, unless it has been
+// quarantined.
+func (cl *Collection) verifyReadableDoc(k key.Key, docPath string, err error, repair bool, report *VerifyReport, existingKeys map[key.Key]bool) error {
+	if cErr, ok := err.(corruptionError); ok {
+		p := VerifyProblem{
+			Type:        VERIFY_PROBLEM_CORRUPTED_DOCUMENT,
+			Path:        docPath,
+			Key:         k,
+			Description: err.Error(),
+		}
+		if cErr.err == ErrGzipIsIncomplete {
+			p.Type = VERIFY_PROBLEM_INCOMPLETE_DOCUMENT
+		}
+		if repair {
+			err = cl.quarantine(k, err.Error())
+			if err != nil {
+				return err
+			}
+			p.IsRepaired = true
+		} else {
+			existingKeys[k] = true
+		}
+		report.addProblem(p)
+		return nil
+	}
+	if err != nil {
+		report.addProblem(VerifyProblem{
+			Type:        VERIFY_PROBLEM_UNREADABLE_DOCUMENT,
+			Path:        docPath,
+			Key:         k,
+			Description: err.Error(),
+		})
+		existingKeys[k] = true // it's still there, so the indexes may rightly point to it
+		return nil
+	}
+
+	existingKeys[k] = true
+	report.NumDocuments++
+	return nil
+}
+
+// verifyManifests checks that the partition manifests list exactly existingKeys. Stale manifests are repaired by
+// removing them, so they are rebuilt from the partition dirs.
+func (cl *Collection) verifyManifests(existingKeys map[key.Key]bool, repair bool, report *VerifyReport) error {
+	if !cl.usesManifests() {
+		return nil
+	}
+
+	var numMissing, numExtra int
+	var listedKeys map[key.Key]bool = make(map[key.Key]bool)
+	err := cl.forEachDoc(func(k key.Key, docPath string) error {
+		listedKeys[k] = true
+		if !existingKeys[k] {
+			numExtra++
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for k := range existingKeys {
+		if !listedKeys[k] {
+			numMissing++
+		}
+	}
+	if numMissing == 0 && numExtra == 0 {
+		return nil
+	}
+
+	p := VerifyProblem{
+		Type:        VERIFY_PROBLEM_STALE_MANIFEST,
+		Path:        cl.getManifestsDirPath(),
+		Description: fmt.Sprintf("%d documents are missing from the manifests, and %d listed ones don't exist", numMissing, numExtra),
+	}
+	if repair {
+		err = cl.removeManifests()
+		if err != nil {
+			return err
+		}
+		p.IsRepaired = true
+	}
+	report.addProblem(p)
+	return nil
+}
+
+// moveToPartition moves the document at docPath into the partition dir it belongs to, unless a document for k already
+// exists there. It returns the new path, and whether the document was moved.
+func (cl *Collection) moveToPartition(k key.Key, docPath string, pDirName string) (string, bool, error) {
+	pDirPath := util.JoinPath(cl.getDataPath(), pDirName)
+	err := util.CreateDirIfNotExist(cl.fs(), pDirPath)
+	if err != nil {
+		return docPath, false, err
+	}
+
+	// we can't tell which of the two is the right one, so leave it to the user
+	if _, err := cl.getExistingFilePath(k); err == nil {
+		return docPath, false, nil
+	}
+
+	newPath := util.JoinPath(pDirPath, filepath.Base(docPath))
+	err = cl.fs().Rename(docPath, newPath)
+	if err != nil {
+		return docPath, false, err
+	}
+	err = cl.syncRenamed(newPath)
+	if err != nil {
+		return newPath, true, err
+	}
+	err = cl.removeManifestEntry(filepath.Base(filepath.Dir(docPath)), k)
+	if err != nil {
+		return newPath, true, err
+	}
+	err = cl.refreshManifestEntry(k)
+	if err != nil {
+		return newPath, true, err
+	}
+
+	return newPath, true, nil
+}
+
+// verifyDocFile reads the whole document at docPath, which makes sure that e.g. the gzip stream is complete, and then
+// decodes it. Errors caused by the data being corrupted are returned as corruptionError.
+func (cl *Collection) verifyDocFile(k key.Key, docPath string) error {
+	if cl.isContentAddressed() {
+		var err error
+		docPath, err = cl.resolveDocPath(docPath)
+		if err == ErrDocumentIsCorrupted {
+			return corruptionError{fmt.Errorf("the blob that the document points to is missing")}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	file, err := cl.fs().Open(docPath)
+	if err != nil {
+		return err
+	}
+
+	h, r, err := cl.openDocFile(file, k, true)
+	if err != nil {
+		return err
+	}
+	return cl.verifyDocReader(h, r)
+}
+
+// verifyDocReader is like verifyDocFile, but for a document that has already been opened. r is closed once read.
+func (cl *Collection) verifyDocReader(h docHeader, r *docReader) error {
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if h.EncodingType != ENCODING_NONE && !isDecodable(h.EncodingType, data) {
+		return corruptionError{fmt.Errorf("document data can not be decoded using encoding type %d", h.EncodingType)}
+	}
+
+	return nil
+}
+
+// verifyIndexes checks that the indexes only reference existingKeys, and that their meta counts are right
+func (cl *Collection) verifyIndexes(existingKeys map[key.Key]bool, repair bool, report *VerifyReport) error {
+	err := cl.FlushIndexes()
+	if err != nil {
+		return err
+	}
+
+	cl.IndexStore.RLock()
+	var fieldLocators []string
+	for fieldLocator := range cl.IndexStore.Store {
+		fieldLocators = append(fieldLocators, fieldLocator)
+	}
+	cl.IndexStore.RUnlock()
+
+	for _, fieldLocator := range fieldLocators {
+		report.NumIndexes++
+		idxPath := util.JoinPath(cl.GetDirPathForIndexes(), fieldLocator)
+
+		idx, err := cl.loadIndex(fieldLocator)
+		if err != nil {
+			p := VerifyProblem{
+				Type:        VERIFY_PROBLEM_UNREADABLE_INDEX,
+				Path:        idxPath,
+				Description: err.Error(),
+			}
+			if repair && err != ErrDecryptionFailed && err != ErrEncryptionKeyMissing {
+				err = cl.rebuildIndex(fieldLocator)
+				if err != nil {
+					return err
+				}
+				p.IsRepaired = true
+			}
+			report.addProblem(p)
+			continue
+		}
+
+		var isChanged bool
+		for k := range idx.KeyValues {
+			if existingKeys[k] {
+				continue
+			}
+			report.addProblem(VerifyProblem{
+				Type:        VERIFY_PROBLEM_DANGLING_INDEX_KEY,
+				Path:        idxPath,
+				Key:         k,
+				Description: "index " + fieldLocator + " references a document that does not exist",
+				IsRepaired:  repair,
+			})
+			if repair {
+				idx.removeKey(k)
+				isChanged = true
+			}
+		}
+
+		// removeKey keeps NumValues right, so compare it with what the store has
+		numValues := len(idx.ValueKeys)
+		cl.IndexStore.RLock()
+		storedNumValues := cl.IndexStore.Store[fieldLocator].NumValues
+		cl.IndexStore.RUnlock()
+		if storedNumValues != numValues || idx.NumValues != numValues {
+			report.addProblem(VerifyProblem{
+				Type:        VERIFY_PROBLEM_INDEX_COUNT_MISMATCH,
+				Path:        idxPath,
+				Description: "index " + fieldLocator + " has a NumValues that does not match its values",
+				IsRepaired:  repair,
+			})
+			idx.NumValues = numValues
+			isChanged = true
+		}
+
+		if repair && isChanged {
+			err = idx.save()
+			if err != nil {
+				return err
+			}
+			cl.IndexStore.Lock()
+			cl.IndexStore.Store[idx.FieldLocator] = idx.IndexInfo
+			cl.IndexStore.Unlock()
+		}
+	}
+
+	return nil
+}
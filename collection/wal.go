@@ -0,0 +1,406 @@
+package collection
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/********************************************************************************
+* W R I T E  A H E A D  L O G
+*********************************************************************************/
+
+// When EnableWAL is set, every Set/Delete is first logged in the WAL of the collection (and the log is fsynced),
+// then applied to the document file and the indexes, recorded in the change feed, and finally marked as committed in
+// the WAL. If we crash in the middle of applying an op, the op is replayed the next time the collection is added to the
+// client, which makes the document + index + change feed updates crash-consistent.
+//
+// For Set, the logged payload is the exact content of the document file (i.e. header + compressed/encrypted data) so
+// replaying just means writing the payload to the file again. This also means that no plaintext of an encrypted
+// collection ends up in the WAL.
+//
+// Each record in the log is stored as: | body length (4 bytes) | crc32 of body (4 bytes) | JSON encoded walEntry |
+//
+// With RetainWAL, the log is moved into the WAL history of the collection rather than truncated, see RestoreToTime.
+
+const WAL_FILE_NAME string = "wal"
+
+// The WAL is truncated once it grows beyond this size and there are no ops in flight
+const WAL_MAX_SIZE int64 = 4 * 1024 * 1024
+
+const (
+	WAL_OP_SET    string = "set"
+	WAL_OP_DELETE string = "delete"
+	WAL_OP_COMMIT string = "commit"
+	WAL_OP_ABORT  string = "abort"
+)
+
+const walRecordHeaderLen int = 8
+
+var ErrWALChecksumMismatch = fmt.Errorf("WAL entry payload does not match its checksum")
+
+type walEntry struct {
+	Seq      uint64
+	Op       string
+	Key      key.Key
+	Checksum uint32    `json:",omitempty"` // crc32 of the Payload
+	Payload  []byte    `json:",omitempty"`
+	Time     time.Time // when the entry was written, zero for the entries written before it was recorded
+}
+
+type wal struct {
+	file     util.File
+	noSync   bool   // if true, begin does not fsync the log
+	seq      uint64 // seq of the last entry written
+	size     int64
+	inFlight int                // number of ops that have begun but not committed yet
+	rotate   func(w *wal) error // if set, called instead of truncating the log once it is over WAL_MAX_SIZE
+	archive  func() error       // if set, called before the log is truncated or rotated, see SetWALArchiver
+	sync.Mutex
+}
+
+func (cl *Collection) getWALPath() string {
+	return util.JoinPath(cl.DirPath, META_DIR_NAME, WAL_FILE_NAME)
+}
+
+func (cl *Collection) getWAL() (*wal, error) {
+	cl.walLock.Lock()
+	defer cl.walLock.Unlock()
+
+	if cl.wal != nil {
+		return cl.wal, nil
+	}
+
+	w, err := cl.openWAL(cl.getWALPath())
+	if err != nil {
+		return nil, err
+	}
+	if cl.RetainWAL {
+		w.rotate = cl.rotateWAL
+	}
+	w.archive = cl.archiveWAL
+
+	cl.wal = w
+	return cl.wal, nil
+}
+
+// openWAL opens the log at path for appending, creating it if needed
+func (cl *Collection) openWAL(path string) (*wal, error) {
+	file, err := cl.fs().OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, util.FILE_PERM)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	w := &wal{file: file, size: info.Size()}
+
+	// If the log hasn't been truncated (e.g. it wasn't replayed), continue the sequence from where it left off
+	if w.size > 0 {
+		entries, err := cl.readWALEntries(path)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Seq > w.seq {
+				w.seq = e.Seq
+			}
+		}
+	}
+
+	return w, nil
+}
+
+// closeWAL closes the WAL file if it is open
+func (cl *Collection) closeWAL() error {
+	cl.walLock.Lock()
+	w := cl.wal
+	cl.wal = nil
+	cl.walLock.Unlock()
+
+	if w == nil {
+		return nil
+	}
+	w.Lock()
+	defer w.Unlock()
+	return w.file.Close()
+}
+
+// begin logs an op, and makes sure the log is on disk before returning. It returns the seq of the op, which should be
+// passed to commit once the op has been applied.
+func (w *wal) begin(op string, k key.Key, payload []byte) (uint64, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.seq++
+	e := walEntry{
+		Seq:      w.seq,
+		Op:       op,
+		Key:      k,
+		Checksum: crc32.ChecksumIEEE(payload),
+		Payload:  payload,
+		Time:     time.Now(),
+	}
+	err := w.append(e)
+	if err != nil {
+		return 0, err
+	}
+	if !w.noSync {
+		err = w.file.Sync()
+		if err != nil {
+			return 0, err
+		}
+	}
+	w.inFlight++
+
+	return e.Seq, nil
+}
+
+// commit marks the op with seq as applied. The commit record is not fsynced: if it is lost, the op is simply replayed,
+// which is harmless since replaying is idempotent.
+func (w *wal) commit(seq uint64) error {
+	return w.end(seq, WAL_OP_COMMIT)
+}
+
+// abort marks the op with seq as failed, so that it is not replayed. The error while applying the op has already been
+// returned to the caller.
+func (w *wal) abort(seq uint64) error {
+	return w.end(seq, WAL_OP_ABORT)
+}
+
+func (w *wal) end(seq uint64, op string) error {
+	w.Lock()
+	defer w.Unlock()
+
+	err := w.append(walEntry{Seq: seq, Op: op, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	w.inFlight--
+
+	// Nothing in the log is needed anymore if there are no ops in flight
+	if w.inFlight == 0 && w.size > WAL_MAX_SIZE {
+		if w.archive != nil {
+			err = w.archive()
+			if err != nil {
+				return err
+			}
+		}
+		if w.rotate != nil {
+			return w.rotate(w)
+		}
+		err = w.file.Truncate(0)
+		if err != nil {
+			return err
+		}
+		w.size = 0
+	}
+
+	return nil
+}
+
+// append writes e at the end of the log. It should be called while holding the lock.
+func (w *wal) append(e walEntry) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, walRecordHeaderLen, walRecordHeaderLen+len(body))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(body))
+	record = append(record, body...)
+
+	n, err := w.file.Write(record)
+	w.size += int64(n)
+	return err
+}
+
+// sync fsyncs the log
+func (w *wal) sync() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.file.Sync()
+}
+
+// readWALEntries reads all the entries from the WAL at path. Reading stops at the first incomplete or corrupted record,
+// which is what a crash in the middle of an append leaves behind.
+func (cl *Collection) readWALEntries(path string) ([]walEntry, error) {
+	file, err := cl.fs().Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []walEntry
+	r := bufio.NewReader(file)
+	header := make([]byte, walRecordHeaderLen)
+	remaining := info.Size() // the number of bytes of the file that haven't been read yet
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			util.Warnf("Ignoring incomplete record at the end of the WAL %s", path)
+			break
+		}
+		remaining -= int64(walRecordHeaderLen)
+
+		// A length that is longer than the rest of the file can only be that of a torn or corrupted record, so it is
+		// not allocated
+		bodyLen := int64(binary.BigEndian.Uint32(header[0:4]))
+		if bodyLen > remaining {
+			util.Warnf("Ignoring incomplete record at the end of the WAL %s", path)
+			break
+		}
+		remaining -= bodyLen
+
+		body := make([]byte, bodyLen)
+		_, err = io.ReadFull(r, body)
+		if err != nil {
+			util.Warnf("Ignoring incomplete record at the end of the WAL %s", path)
+			break
+		}
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:8]) {
+			util.Warnf("Ignoring corrupted record at the end of the WAL %s", path)
+			break
+		}
+
+		var e walEntry
+		err = json.Unmarshal(body, &e)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// ReplayWAL re-applies all the ops in the WAL that were not committed, e.g. because of a crash, and then truncates the
+// WAL. It returns the number of ops that were replayed. It should be called before the collection is used.
+func (cl *Collection) ReplayWAL() (int, error) {
+	path := cl.getWALPath()
+
+	entries, err := cl.readWALEntries(path)
+	if err != nil {
+		return 0, err
+	}
+
+	pending := getPendingWALEntries(entries)
+	for _, e := range pending {
+		util.Infof("Replaying uncommitted WAL op %d for collection %s: %s %s", e.Seq, cl.Name, e.Op, e.Key)
+
+		var changeOp string
+		switch e.Op {
+		case WAL_OP_SET:
+			if crc32.ChecksumIEEE(e.Payload) != e.Checksum {
+				return 0, ErrWALChecksumMismatch
+			}
+			err = cl.applySet(e.Key, e.Payload)
+			changeOp = AUDIT_OP_SET
+		case WAL_OP_DELETE:
+			err = cl.applyDelete(e.Key)
+			changeOp = AUDIT_OP_DELETE
+		default:
+			err = fmt.Errorf("unknown WAL op %s", e.Op)
+		}
+		if err != nil {
+			return 0, err
+		}
+		err = cl.replayChange(changeOp, e.Key)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Everything has been applied, so the log is no longer needed, unless it is retained
+	err = cl.FlushIndexes()
+	if err != nil {
+		return 0, err
+	}
+	if cl.RetainWAL {
+		err = cl.retainReplayedWAL(pending)
+		if err != nil {
+			return 0, err
+		}
+		return len(pending), nil
+	}
+	err = cl.closeWAL()
+	if err != nil {
+		return 0, err
+	}
+	err = cl.archiveWAL()
+	if err != nil {
+		return 0, err
+	}
+	err = cl.fs().Truncate(path, 0)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	return len(pending), nil
+}
+
+// replayChange records op on the document for k in the change feed and the audit log, and tells the change handler about
+// it, once the op has been replayed. An op is only committed once its change has been recorded, so a change that was
+// recorded just before a crash is recorded again, but none is lost.
+func (cl *Collection) replayChange(op string, k key.Key) error {
+	err := cl.recordChange(op, k)
+	if err != nil {
+		return err
+	}
+	cl.notifyChange(op, k)
+
+	var data []byte
+	if cl.EnableAuditLog && op == AUDIT_OP_SET {
+		_, data, err = cl.getDocData(context.Background(), k)
+		if err != nil {
+			return err
+		}
+	}
+	return cl.audit(op, k, data)
+}
+
+// getPendingWALEntries returns the entries for all the ops that have begun but have not been committed or aborted, in
+// the order they were logged
+func getPendingWALEntries(entries []walEntry) []walEntry {
+	var pending map[uint64]walEntry = make(map[uint64]walEntry)
+	for _, e := range entries {
+		if e.Op == WAL_OP_COMMIT || e.Op == WAL_OP_ABORT {
+			delete(pending, e.Seq)
+			continue
+		}
+		pending[e.Seq] = e
+	}
+
+	var results []walEntry
+	for _, e := range pending {
+		results = append(results, e)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Seq < results[j].Seq })
+
+	return results
+}
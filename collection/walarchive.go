@@ -0,0 +1,63 @@
+package collection
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+/********************************************************************************
+* W A L  A R C H I V I N G
+*********************************************************************************/
+
+// A WALArchiver, set with SetWALArchiver, is given every segment of the WAL before it is recycled: truncated once it is
+// over WAL_MAX_SIZE or once it has been replayed, or moved into the WAL history with RetainWAL. The segments hold all the
+// ops logged in the WAL, as records in the WAL format, so shipping them off the box, e.g. to replay them onto a copy of
+// the collection, doesn't need replication to be set up.
+//
+// The WAL is only recycled once the archiver has returned without an error. Otherwise, the write that would have
+// recycled it fails with the error, even though it has been applied, and the WAL is archived again the next time, along
+// with the ops logged in the meantime. Segments are named after the time they are archived at, zero padded so that they
+// sort in that order.
+
+// WALArchiver copies the segment of the WAL read from r somewhere else, e.g. into an archive dir
+type WALArchiver func(segmentName string, r io.Reader) error
+
+// SetWALArchiver sets the func that the segments of the WAL are given to before they are recycled. A nil fn stops the
+// archiving.
+func (cl *Collection) SetWALArchiver(fn WALArchiver) {
+	cl.walArchiverLock.Lock()
+	defer cl.walArchiverLock.Unlock()
+	cl.walArchiver = fn
+}
+
+// archiveWAL gives the WAL to the archiver, if there is one and the WAL isn't empty. It should be called while holding
+// the lock of the WAL, if it is open.
+func (cl *Collection) archiveWAL() error {
+	cl.walArchiverLock.Lock()
+	fn := cl.walArchiver
+	cl.walArchiverLock.Unlock()
+	if fn == nil {
+		return nil
+	}
+
+	file, err := cl.fs().Open(cl.getWALPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+
+	err = fn(fmt.Sprintf("%020d", time.Now().UnixNano()), file)
+	if err != nil {
+		return fmt.Errorf("archiving the WAL of collection %s: %w", cl.Name, err)
+	}
+	return nil
+}
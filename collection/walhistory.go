@@ -0,0 +1,269 @@
+package collection
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb/util"
+	"hash/crc32"
+	"os"
+	"strconv"
+	"time"
+)
+
+/********************************************************************************
+* W A L  H I S T O R Y
+*********************************************************************************/
+
+// With RetainWAL, the WAL is not truncated once it has been applied: it is moved into the WAL history, in the meta dir,
+// as a file named after the time it was moved at (see rotateWAL), and a new WAL is started. Along with the snapshots of
+// the collection, the history makes point-in-time recovery possible: restoring a snapshot and replaying the ops that were
+// committed since it was taken brings back the collection as it was at any time after it (see RestoreToTime in the
+// client). ReadWALHistory reads those ops, and ReplayWALHistory replays them.
+//
+// The files of the history are never changed once they have been moved there. The history is only needed from the
+// oldest snapshot on, and older files are removed with PruneWALHistory. It is not part of the snapshots, so restoring
+// one starts the history over.
+
+const WAL_HISTORY_DIR_NAME string = "wal_history"
+
+// WALHistory is the ops read from the WAL history by ReadWALHistory, in the order they were committed in
+type WALHistory struct {
+	entries []walEntry
+}
+
+// Len returns the number of ops in h
+func (h WALHistory) Len() int {
+	return len(h.entries)
+}
+
+func (cl *Collection) getWALHistoryDirPath() string {
+	return util.JoinPath(cl.DirPath, META_DIR_NAME, WAL_HISTORY_DIR_NAME)
+}
+
+// rotateWAL moves the log of w, which is the WAL, into the WAL history, and starts a new one. It should be called while
+// holding the lock of w, with no ops in flight.
+func (cl *Collection) rotateWAL(w *wal) error {
+	err := w.file.Sync()
+	if err != nil {
+		return err
+	}
+	err = w.file.Close()
+	if err != nil {
+		return err
+	}
+	err = cl.moveWALToHistory()
+	if err != nil {
+		return err
+	}
+
+	file, err := cl.fs().OpenFile(cl.getWALPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, util.FILE_PERM)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.size = 0
+	return nil
+}
+
+// moveWALToHistory moves the WAL file, which should be closed, into the WAL history
+func (cl *Collection) moveWALToHistory() error {
+	dirPath := cl.getWALHistoryDirPath()
+	err := util.CreateDirIfNotExist(cl.fs(), dirPath)
+	if err != nil {
+		return err
+	}
+	// zero padded, so that the files sort in the order they were moved in
+	path := util.JoinPath(dirPath, fmt.Sprintf("%020d", time.Now().UnixNano()))
+	err = cl.fs().Rename(cl.getWALPath(), path)
+	if err != nil {
+		return err
+	}
+	return util.SyncFile(cl.fs(), dirPath)
+}
+
+// retainReplayedWAL marks the ops that ReplayWAL has replayed as committed, and moves the WAL into the WAL history
+func (cl *Collection) retainReplayedWAL(replayed []walEntry) error {
+	if len(replayed) > 0 {
+		w, err := cl.getWAL()
+		if err != nil {
+			return err
+		}
+		w.Lock()
+		for _, e := range replayed {
+			err = w.append(walEntry{Seq: e.Seq, Op: WAL_OP_COMMIT, Time: time.Now()})
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = w.file.Sync()
+		}
+		w.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := cl.closeWAL()
+	if err != nil {
+		return err
+	}
+	info, err := cl.fs().Stat(cl.getWALPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+	err = cl.archiveWAL()
+	if err != nil {
+		return err
+	}
+	return cl.moveWALToHistory()
+}
+
+// getWALHistoryFiles returns the names of the files of the WAL history, oldest first, along with the times they were
+// moved there at
+func (cl *Collection) getWALHistoryFiles() ([]string, []time.Time, error) {
+	fileInfos, err := util.ReadDir(cl.fs(), cl.getWALHistoryDirPath())
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var names []string
+	var movedAt []time.Time
+	for _, fileInfo := range fileInfos {
+		nanos, err := strconv.ParseInt(fileInfo.Name(), 10, 64)
+		if err != nil { // e.g. a temp file
+			continue
+		}
+		names = append(names, fileInfo.Name())
+		movedAt = append(movedAt, time.Unix(0, nanos))
+	}
+	return names, movedAt, nil
+}
+
+// ReadWALHistory reads the ops of the WAL history, and of the current WAL, that were committed at or after since and
+// began at or before until. The ops that were aborted, or that are still in flight, are left out. Since an op is only
+// applied between the time it begins and the time it is committed, these are the ops to replay onto a copy of the
+// collection taken at since, to bring it to the state it had at until. The payloads of the ops are held in memory.
+func (cl *Collection) ReadWALHistory(since time.Time, until time.Time) (WALHistory, error) {
+	var h WALHistory
+	if !cl.RetainWAL {
+		return h, nil
+	}
+
+	// Keep the WAL from being moved into the history while it is read
+	cl.walLock.Lock()
+	w := cl.wal
+	cl.walLock.Unlock()
+	if w != nil {
+		w.Lock()
+		defer w.Unlock()
+	}
+
+	names, movedAt, err := cl.getWALHistoryFiles()
+	if err != nil {
+		return h, err
+	}
+	var paths []string
+	for i, name := range names {
+		if movedAt[i].Before(since) { // every op in it was committed before since
+			continue
+		}
+		paths = append(paths, util.JoinPath(cl.getWALHistoryDirPath(), name))
+	}
+	paths = append(paths, cl.getWALPath())
+
+	for _, path := range paths {
+		entries, err := cl.readWALEntries(path)
+		if err != nil {
+			return h, err
+		}
+		begun := make(map[uint64]walEntry)
+		for _, e := range entries {
+			switch e.Op {
+			case WAL_OP_SET, WAL_OP_DELETE:
+				begun[e.Seq] = e
+			case WAL_OP_COMMIT:
+				b, ok := begun[e.Seq]
+				if ok && !e.Time.Before(since) && !b.Time.After(until) {
+					h.entries = append(h.entries, b)
+				}
+				delete(begun, e.Seq)
+			case WAL_OP_ABORT:
+				delete(begun, e.Seq)
+			}
+		}
+	}
+	return h, nil
+}
+
+// ReplayWALHistory applies the ops of h to the collection, in order, and returns the number of ops applied. The ops are
+// logged in the WAL like any other, if it is enabled.
+func (cl *Collection) ReplayWALHistory(h WALHistory) (int, error) {
+	for i, e := range h.entries {
+		err := cl.replayWALHistoryOp(e)
+		if err != nil {
+			return i, fmt.Errorf("replaying the %s of document %d: %w", e.Op, e.Key, err)
+		}
+	}
+	return len(h.entries), cl.FlushIndexes()
+}
+
+func (cl *Collection) replayWALHistoryOp(e walEntry) error {
+	defer cl.lockKey(e.Key)()
+
+	apply := func() error { return cl.applyDelete(e.Key) }
+	if e.Op == WAL_OP_SET {
+		if crc32.ChecksumIEEE(e.Payload) != e.Checksum {
+			return ErrWALChecksumMismatch
+		}
+		apply = func() error { return cl.applySet(e.Key, e.Payload) }
+	}
+	if !cl.EnableWAL {
+		return apply()
+	}
+
+	w, err := cl.getWAL()
+	if err != nil {
+		return err
+	}
+	seq, err := w.begin(e.Op, e.Key, e.Payload)
+	if err != nil {
+		return err
+	}
+	err = apply()
+	if err != nil {
+		w.abort(seq)
+		return err
+	}
+	return cl.commitAfterIndexFlush(w, seq)
+}
+
+// PruneWALHistory removes the files of the WAL history that only have ops committed before before, and returns the
+// number of files removed
+func (cl *Collection) PruneWALHistory(before time.Time) (int, error) {
+	names, movedAt, err := cl.getWALHistoryFiles()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for i, name := range names {
+		if !movedAt[i].Before(before) {
+			break
+		}
+		err = cl.fs().Remove(util.JoinPath(cl.getWALHistoryDirPath(), name))
+		if err != nil && !os.IsNotExist(err) {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
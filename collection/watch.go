@@ -0,0 +1,509 @@
+package collection
+
+import (
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/********************************************************************************
+* E X T E R N A L  C H A N G E S
+*********************************************************************************/
+
+// The files of the documents can be changed by other processes than the one that has the collection open, e.g. a
+// script that copies documents into the partition dirs, which leaves the indexes, the cache and the stats out of date:
+// Search misses the new documents, and still finds the removed ones. SyncExternalChanges finds those changes by
+// comparing the size and the modification time of the file of every document with the ones it saw the last time. For
+// every document that has been added, modified or removed by someone else, it updates the index entries (see
+// reindexDoc), drops it from the cache, refreshes its manifest entry, and tells the change handler about it. The stats
+// are dropped, to be gathered again. The collection notes its own writes as they are made, along with a checksum of the
+// file, so they aren't taken for external ones, other than the files it rewrites in bulk (e.g. moving documents to the
+// cold dir), which may be reported once.
+//
+// WatchExternalChanges watches the partition dirs with fsnotify in the background instead, until
+// StopWatchingExternalChanges or Close, and syncs the documents that it has been notified about every interval. Those
+// are compared by checksum as well, so that a change that keeps both the size and the modification time of a file is
+// found too. If the files can't be watched (e.g. the collection isn't on the local file system, or the OS is out of
+// watches), or notifications may have been missed, it falls back to SyncExternalChanges, every interval. Changes made
+// before the watcher starts are not detected: Verify with repair fixes those.
+
+var ErrWatchNotSupported = fmt.Errorf("External changes can not be detected for collections with STORAGE_SEGMENTS")
+
+type (
+	// ExternalChange is a change to a document made by another process, see SyncExternalChanges
+	ExternalChange struct {
+		Op  string // AUDIT_OP_SET if the document has been added or modified, AUDIT_OP_DELETE if it has been removed
+		Key key.Key
+	}
+
+	// ExternalChangeHandler is called by the watcher with the external changes found by every run, if there are any
+	ExternalChangeHandler func(changes []ExternalChange)
+
+	// externalWatcher has the state of the files of the documents as last seen, see SyncExternalChanges
+	externalWatcher struct {
+		files    map[key.Key]docFileState // nil until the files are first listed
+		stop     chan struct{}            // closed to stop the watcher, nil if there is none
+		done     chan struct{}
+		syncLock sync.Mutex // held by SyncExternalChanges, so that only one runs at a time
+		sync.Mutex
+	}
+
+	docFileState struct {
+		size        int64
+		modTime     time.Time
+		checksum    uint32 // crc32 of the file, only known if hasChecksum
+		hasChecksum bool
+	}
+
+	// docNotifier passes on the fsnotify events for the files of the documents of a collection, see newDocNotifier
+	docNotifier struct {
+		cl      *Collection
+		watcher *fsnotify.Watcher
+		keys    map[key.Key]bool // the documents that there have been events for since the last sync
+		// isMissing is set if events may have been missed, e.g. if the OS dropped some, in which case all the files need
+		// to be checked
+		isMissing bool
+	}
+)
+
+// WatchExternalChanges has the collection watch the files of its documents in the background, sync the ones that have
+// changed every interval (or all of them, if it can't be notified, see SyncExternalChanges), and call fn (if not nil)
+// with the changes it finds. Errors are logged. It replaces the previous watcher, if there is one.
+func (cl *Collection) WatchExternalChanges(interval time.Duration, fn ExternalChangeHandler) error {
+	if cl.isSegmented() {
+		return ErrWatchNotSupported
+	}
+	if interval <= 0 {
+		return fmt.Errorf("the interval of the watcher must be > 0")
+	}
+
+	// Start watching before taking note of the files, so that no change falls in between
+	n, err := cl.newDocNotifier()
+	if err != nil {
+		util.Warnf("Could not watch the files of collection %s, checking all of them every %s instead: %s", cl.Name, interval, err)
+	}
+
+	// Take note of the files now, so that changes made from now on are detected by the first run
+	_, err = cl.SyncExternalChanges()
+	if err != nil {
+		if n != nil {
+			n.close()
+		}
+		return err
+	}
+
+	cl.StopWatchingExternalChanges()
+	stop, done := make(chan struct{}), make(chan struct{})
+	cl.watcher.Lock()
+	cl.watcher.stop, cl.watcher.done = stop, done
+	cl.watcher.Unlock()
+	go cl.runWatcher(interval, fn, n, stop, done)
+	return nil
+}
+
+// StopWatchingExternalChanges stops the watcher started by WatchExternalChanges, if there is one, and waits for its
+// current run to be done
+func (cl *Collection) StopWatchingExternalChanges() {
+	cl.watcher.Lock()
+	stop, done := cl.watcher.stop, cl.watcher.done
+	cl.watcher.stop, cl.watcher.done = nil, nil
+	cl.watcher.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// runWatcher syncs the files that n has been notified about every interval, or all of them if n is nil, until stop is
+// closed
+func (cl *Collection) runWatcher(interval time.Duration, fn ExternalChangeHandler, n *docNotifier, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	// Without notifications, every file is checked every interval
+	var events chan fsnotify.Event
+	var errors chan error
+	if n != nil {
+		defer n.close()
+		events, errors = n.watcher.Events, n.watcher.Errors
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-events:
+			n.handleEvent(event)
+		case err := <-errors:
+			util.Warnf("Missed some changes to the files of collection %s, checking all of them: %s", cl.Name, err)
+			n.isMissing = true
+		case <-ticker.C:
+			var changes []ExternalChange
+			var err error
+			if n == nil || n.isMissing {
+				if n != nil {
+					n.keys, n.isMissing = make(map[key.Key]bool), false
+				}
+				changes, err = cl.SyncExternalChanges()
+			} else if len(n.keys) > 0 {
+				keys := n.keys
+				n.keys = make(map[key.Key]bool)
+				changes, err = cl.syncNotifiedChanges(keys)
+			}
+			if err != nil {
+				util.Errorf("Could not sync the external changes to collection %s: %s", cl.Name, err)
+			}
+			if len(changes) > 0 && fn != nil {
+				fn(changes)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// newDocNotifier starts watching the dir of the collection, its data and cold dirs, and their partition dirs. It is
+// only supported for collections on the local file system.
+func (cl *Collection) newDocNotifier() (*docNotifier, error) {
+	if _, ok := cl.fs().(util.OSFS); !ok {
+		return nil, fmt.Errorf("file system notifications are only supported on the local file system")
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	n := &docNotifier{cl: cl, watcher: watcher, keys: make(map[key.Key]bool)}
+
+	// The data and cold dirs are watched as they are created, if they aren't there yet
+	err = watcher.Add(cl.DirPath)
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	for _, dirPath := range []string{cl.getDataPath(), cl.getColdDirPath()} {
+		err = n.addDir(dirPath, false)
+		if err != nil && !os.IsNotExist(err) {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (n *docNotifier) close() {
+	err := n.watcher.Close()
+	if err != nil {
+		util.Warnf("Could not stop watching the files of collection %s: %s", n.cl.Name, err)
+	}
+}
+
+// addDir starts watching the data or cold dir at dirPath, and the partition dirs in it. If isNew, the files that are
+// already in its partition dirs are noted as changed, since they may have been added before the dirs were watched.
+func (n *docNotifier) addDir(dirPath string, isNew bool) error {
+	err := n.watcher.Add(dirPath)
+	if err != nil {
+		return err
+	}
+	infos, err := util.ReadDir(n.cl.fs(), dirPath)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.IsDir() && strings.HasPrefix(info.Name(), key.DATA_PARTITION_PREFIX) {
+			err = n.addPartitionDir(util.JoinPath(dirPath, info.Name()), isNew)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addPartitionDir starts watching the partition dir at pDirPath. If isNew, the files already in it are noted as
+// changed.
+func (n *docNotifier) addPartitionDir(pDirPath string, isNew bool) error {
+	err := n.watcher.Add(pDirPath)
+	if err != nil || !isNew {
+		return err
+	}
+	infos, err := util.ReadDir(n.cl.fs(), pDirPath)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if k, ok := parsePartitionedFileName(info.Name()); ok {
+			n.keys[k] = true
+		}
+	}
+	return nil
+}
+
+// handleEvent takes note of the document that event is about, or starts watching the dir that it has created
+func (n *docNotifier) handleEvent(event fsnotify.Event) {
+	if event.Op == fsnotify.Chmod {
+		return
+	}
+	dirPath, name := filepath.Dir(event.Name), filepath.Base(event.Name)
+	cl := n.cl
+	dataPath, coldPath := filepath.Clean(cl.getDataPath()), filepath.Clean(cl.getColdDirPath())
+
+	var err error
+	switch {
+	case dirPath == filepath.Clean(cl.DirPath):
+		// the data or cold dir, which isn't there until something is written to it
+		if event.Has(fsnotify.Create) && (name == DATA_DIR_NAME || name == COLD_DIR_NAME) {
+			err = n.addDir(event.Name, true)
+		}
+	case dirPath == dataPath || dirPath == coldPath:
+		if !strings.HasPrefix(name, key.DATA_PARTITION_PREFIX) {
+			return
+		}
+		if event.Has(fsnotify.Create) {
+			err = n.addPartitionDir(event.Name, true)
+		} else if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+			// the files that were in it are gone without an event, if the dir was moved away
+			n.isMissing = true
+		}
+	case filepath.Dir(dirPath) == dataPath || filepath.Dir(dirPath) == coldPath:
+		if k, ok := parsePartitionedFileName(name); ok {
+			n.keys[k] = true
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		util.Warnf("Could not watch %s of collection %s, checking all the files instead: %s", event.Name, cl.Name, err)
+		n.isMissing = true
+	}
+}
+
+// SyncExternalChanges updates the collection for the changes made to the files of its documents by other processes
+// since it was last called, and returns them, ordered by key. The first call only takes note of the files.
+func (cl *Collection) SyncExternalChanges() ([]ExternalChange, error) {
+	if cl.isSegmented() {
+		return nil, ErrWatchNotSupported
+	}
+
+	cl.watcher.syncLock.Lock()
+	defer cl.watcher.syncLock.Unlock()
+
+	files, err := cl.getDocFileStates()
+	if err != nil {
+		return nil, err
+	}
+
+	cl.watcher.Lock()
+	if cl.watcher.files == nil {
+		cl.watcher.files = files
+		cl.watcher.Unlock()
+		return nil, nil
+	}
+	var keys []key.Key
+	for k, state := range files {
+		if prev, ok := cl.watcher.files[k]; !ok || !prev.equal(state) {
+			keys = append(keys, k)
+		}
+	}
+	for k := range cl.watcher.files {
+		if _, ok := files[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	cl.watcher.Unlock()
+	return cl.syncExternalChanges(keys, false)
+}
+
+// syncNotifiedChanges is SyncExternalChanges for the documents in keys, which the watcher has been notified about, see
+// runWatcher
+func (cl *Collection) syncNotifiedChanges(keys map[key.Key]bool) ([]ExternalChange, error) {
+	cl.watcher.syncLock.Lock()
+	defer cl.watcher.syncLock.Unlock()
+
+	var sorted []key.Key
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	return cl.syncExternalChanges(sorted, true)
+}
+
+// syncExternalChanges updates the collection for the documents for keys, which may have been changed by another
+// process, in order of key. It should be called while holding the sync lock of the watcher.
+func (cl *Collection) syncExternalChanges(keys []key.Key, isNotified bool) ([]ExternalChange, error) {
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	var changes []ExternalChange
+	defer func() {
+		if len(changes) > 0 {
+			cl.dropStats()
+		}
+	}()
+	for _, k := range keys {
+		change, ok, err := cl.syncExternalChange(k, isNotified)
+		if err != nil {
+			return changes, fmt.Errorf("document %s: %w", k, err)
+		}
+		if ok {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+// syncExternalChange updates the collection for the document for k having been changed by another process. It returns
+// false if the change turns out to have been made by the collection itself, since the files were listed. If isNotified,
+// there has been a notification for the file, so it has been written even if it has kept its size and modification
+// time, unless its checksum is the one that the collection noted for its own write.
+func (cl *Collection) syncExternalChange(k key.Key, isNotified bool) (ExternalChange, bool, error) {
+	endWrite, err := cl.beginWrite()
+	if err != nil {
+		return ExternalChange{}, false, err
+	}
+	defer endWrite()
+	unlock := cl.lockKey(k)
+	defer unlock()
+
+	state, exists, err := cl.getDocFileState(k)
+	if err != nil {
+		return ExternalChange{}, false, err
+	}
+	cl.watcher.Lock()
+	prev, isKnown := cl.watcher.files[k]
+	cl.watcher.Unlock()
+	if exists == isKnown && (!exists || state.equal(prev) && (prev.hasChecksum || !isNotified)) {
+		return ExternalChange{}, false, nil
+	}
+
+	cl.uncache(k)
+	err = cl.reindexDoc(k)
+	if err != nil {
+		return ExternalChange{}, false, err
+	}
+	err = cl.refreshManifestEntry(k)
+	if err != nil {
+		return ExternalChange{}, false, err
+	}
+
+	change := ExternalChange{Op: AUDIT_OP_SET, Key: k}
+	cl.watcher.Lock()
+	if exists {
+		cl.watcher.files[k] = state
+	} else {
+		change.Op = AUDIT_OP_DELETE
+		delete(cl.watcher.files, k)
+	}
+	cl.watcher.Unlock()
+	cl.notifyChange(change.Op, k)
+	return change, true, nil
+}
+
+// noteOwnDocChange takes note of the file of the document for k as the collection has just written (or removed) it, so
+// that the change isn't taken for an external one. It should be called while holding the key lock for k.
+func (cl *Collection) noteOwnDocChange(k key.Key) {
+	cl.watcher.Lock()
+	isWatched := cl.watcher.files != nil
+	cl.watcher.Unlock()
+	if !isWatched {
+		return
+	}
+
+	state, exists, err := cl.getDocFileState(k)
+	cl.watcher.Lock()
+	defer cl.watcher.Unlock()
+	switch {
+	case err != nil:
+		// the next sync reads the file again, and at worst reindexes the document for nothing
+		util.Warnf("Could not read document %s of collection %s: %s", k, cl.Name, err)
+	case exists:
+		cl.watcher.files[k] = state
+	default:
+		delete(cl.watcher.files, k)
+	}
+}
+
+// getDocFileStates returns the state of the file of every document of the collection, listing the partition dirs even
+// if the collection has manifests, since they don't know about the external changes
+func (cl *Collection) getDocFileStates() (map[key.Key]docFileState, error) {
+	files := make(map[key.Key]docFileState)
+	addFile := func(k key.Key, docPath string) error {
+		info, err := cl.fs().Stat(docPath)
+		if os.IsNotExist(err) { // removed since it was listed
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		files[k] = docFileState{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	}
+
+	pDirPaths, err := cl.getPartitionDirPaths()
+	if os.IsNotExist(err) { // nothing has been written yet
+		return files, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, pDirPath := range pDirPaths {
+		err = cl.forEachDocInPartition(pDirPath, addFile)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cl.mayHaveColdDocs() {
+		err = cl.forEachColdDoc(addFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// getDocFileState returns the state of the file of the document for k, including its checksum, and whether it exists
+func (cl *Collection) getDocFileState(k key.Key) (docFileState, bool, error) {
+	path, err := cl.getExistingFilePath(k)
+	if os.IsNotExist(err) && cl.mayHaveColdDocs() {
+		path, err = cl.getExistingColdFilePath(k)
+	}
+	if os.IsNotExist(err) {
+		return docFileState{}, false, nil
+	}
+	if err != nil {
+		return docFileState{}, false, err
+	}
+
+	file, err := cl.fs().Open(path)
+	if os.IsNotExist(err) {
+		return docFileState{}, false, nil
+	}
+	if err != nil {
+		return docFileState{}, false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return docFileState{}, false, err
+	}
+	hash := crc32.NewIEEE()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return docFileState{}, false, err
+	}
+	return docFileState{size: info.Size(), modTime: info.ModTime(), checksum: hash.Sum32(), hasChecksum: true}, true, nil
+}
+
+// equal tells whether s and other are the same, comparing the checksums only if both are known
+func (s docFileState) equal(other docFileState) bool {
+	if s.hasChecksum && other.hasChecksum && s.checksum != other.checksum {
+		return false
+	}
+	return s.size == other.size && s.modTime.Equal(other.modTime)
+}
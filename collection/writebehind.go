@@ -0,0 +1,195 @@
+package collection
+
+import (
+	"context"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/********************************************************************************
+* W R I T E  B E H I N D
+*********************************************************************************/
+
+// With WriteBehindQueueSize set, Set and Delete return as soon as the write is queued, and a background writer applies
+// the queued writes in order. If the queue is full, Set and Delete block until there is room in it. Writes that fail
+// in the background are reported to the handler set with SetWriteErrorHandler, or logged if there is none.
+//
+// Reading a document waits for the queued writes to it, so readers always see their own writes. Searches and scans
+// only see a write once it has been applied. Flush and Close wait for the queue to be empty, so a write that was queued
+// before them is not lost, but anything still in the queue when the process crashes is.
+
+// WriteErrorHandler is called with the key and the error of a queued write that failed in the background
+type WriteErrorHandler func(k key.Key, err error)
+
+type writeBehindOp struct {
+	k         key.Key
+	data      []byte
+	expiresAt time.Time // see setWithExpiry
+	isDelete  bool
+}
+
+// numQueuedWrites is the number of writes queued for the background writers of all the collections, see
+// NumQueuedWrites
+var numQueuedWrites int64
+
+// writeBehind holds the queue of the background writer, and the number of queued writes for each key
+type writeBehind struct {
+	queue      chan writeBehindOp
+	pending    map[key.Key]int
+	numPending int
+	done       *sync.Cond // broadcast whenever a queued write has been applied
+	stopped    chan struct{}
+	sync.Mutex
+}
+
+func (cl *Collection) isWriteBehind() bool {
+	return cl.WriteBehindQueueSize > 0
+}
+
+// SetWriteErrorHandler sets the func that is called when a queued write fails in the background
+func (cl *Collection) SetWriteErrorHandler(fn WriteErrorHandler) {
+	cl.writeBehindLock.Lock()
+	defer cl.writeBehindLock.Unlock()
+	cl.writeErrorHandler = fn
+}
+
+// getWriteBehind returns the background writer, starting it if needed
+func (cl *Collection) getWriteBehind() *writeBehind {
+	cl.writeBehindLock.Lock()
+	defer cl.writeBehindLock.Unlock()
+
+	if cl.writeBehind != nil {
+		return cl.writeBehind
+	}
+
+	wb := &writeBehind{
+		queue:   make(chan writeBehindOp, cl.WriteBehindQueueSize),
+		pending: make(map[key.Key]int),
+		stopped: make(chan struct{}),
+	}
+	wb.done = sync.NewCond(&wb.Mutex)
+
+	go func() {
+		defer close(wb.stopped)
+		for op := range wb.queue {
+			var err error
+			if op.isDelete {
+				err = cl.deleteNow(op.k)
+			} else {
+				err = cl.setNow(context.Background(), op.k, op.data, op.expiresAt)
+			}
+			if err != nil {
+				cl.handleWriteError(op.k, err)
+			}
+
+			wb.Lock()
+			wb.pending[op.k]--
+			if wb.pending[op.k] == 0 {
+				delete(wb.pending, op.k)
+			}
+			wb.numPending--
+			wb.done.Broadcast()
+			wb.Unlock()
+			atomic.AddInt64(&numQueuedWrites, -1)
+		}
+	}()
+
+	cl.writeBehind = wb
+	return wb
+}
+
+func (cl *Collection) handleWriteError(k key.Key, err error) {
+	cl.writeBehindLock.Lock()
+	fn := cl.writeErrorHandler
+	cl.writeBehindLock.Unlock()
+
+	if fn == nil {
+		util.Errorf("Queued write to document %s of collection %s failed: %s", k, cl.Name, err)
+		return
+	}
+	fn(k, err)
+}
+
+// enqueueWrite adds op to the queue of the background writer, waiting for room in the queue if it is full, unless ctx is
+// done first
+func (cl *Collection) enqueueWrite(ctx context.Context, op writeBehindOp) error {
+	wb := cl.getWriteBehind()
+
+	wb.Lock()
+	wb.pending[op.k]++
+	wb.numPending++
+	wb.Unlock()
+	atomic.AddInt64(&numQueuedWrites, 1)
+
+	select {
+	case wb.queue <- op:
+		return nil
+	case <-ctx.Done():
+	}
+	atomic.AddInt64(&numQueuedWrites, -1)
+
+	wb.Lock()
+	wb.pending[op.k]--
+	if wb.pending[op.k] == 0 {
+		delete(wb.pending, op.k)
+	}
+	wb.numPending--
+	wb.done.Broadcast()
+	wb.Unlock()
+	return ctx.Err()
+}
+
+// waitForWrites waits until the queued writes to the document for k have been applied
+func (cl *Collection) waitForWrites(k key.Key) {
+	cl.writeBehindLock.Lock()
+	wb := cl.writeBehind
+	cl.writeBehindLock.Unlock()
+	if wb == nil {
+		return
+	}
+
+	wb.Lock()
+	defer wb.Unlock()
+	for wb.pending[k] > 0 {
+		wb.done.Wait()
+	}
+}
+
+// waitForAllWrites waits until the queue of the background writer is empty
+func (cl *Collection) waitForAllWrites() {
+	cl.writeBehindLock.Lock()
+	wb := cl.writeBehind
+	cl.writeBehindLock.Unlock()
+	if wb == nil {
+		return
+	}
+
+	wb.Lock()
+	defer wb.Unlock()
+	for wb.numPending > 0 {
+		wb.done.Wait()
+	}
+}
+
+// closeWriteBehind applies everything that is queued, and stops the background writer
+func (cl *Collection) closeWriteBehind() {
+	cl.writeBehindLock.Lock()
+	wb := cl.writeBehind
+	cl.writeBehind = nil
+	cl.writeBehindLock.Unlock()
+	if wb == nil {
+		return
+	}
+
+	close(wb.queue)
+	<-wb.stopped
+}
+
+// NumQueuedWrites returns the number of writes that are queued for the background writers of all the collections of the
+// process, and haven't been applied yet
+func NumQueuedWrites() int64 {
+	return atomic.LoadInt64(&numQueuedWrites)
+}
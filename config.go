@@ -0,0 +1,132 @@
+package gofiledb
+
+import (
+	"fmt"
+	"github.com/teejays/clog"
+	"github.com/teejays/gofiledb/collection"
+	"time"
+)
+
+/********************************************************************************
+* C O N F I G
+*********************************************************************************/
+
+// Some of the settings of a client can be changed while it is running, without closing it: see ApplyConfig. Only the
+// fields of a Config that are set are changed, and the rest are left as they are:
+//
+//	logLevel := 4 // only warnings and errors
+//	maxEntries := 10000
+//	err := client.ApplyConfig(Config{
+//		LogLevel:    &logLevel,
+//		Collections: map[string]CollectionConfig{"Orders": {CacheMaxEntries: &maxEntries}},
+//	})
+
+var ErrIOLimitIsNotEnabled = fmt.Errorf("The client was initialized without MaxConcurrentIO, so its IO limit can't be changed")
+
+// Config is a set of changes to the settings of a client, see ApplyConfig
+type Config struct {
+	// LogLevel is the level below which log messages are dropped. Like WithLogLevel, it is global to the process.
+	LogLevel *int
+	// MaxConcurrentIO is the number of files that can be read or written at the same time. The client needs to have been
+	// initialized with ClientInitOptions.MaxConcurrentIO.
+	MaxConcurrentIO *int
+	// Collections has the changes to the settings of the collections, by collection name
+	Collections map[string]CollectionConfig
+}
+
+// CollectionConfig is a set of changes to the settings of a collection, see Config
+type CollectionConfig struct {
+	// CacheMaxEntries and CacheMaxBytes are the limits of the document cache. Setting both to 0 turns it off.
+	CacheMaxEntries *int
+	CacheMaxBytes   *int64
+	// Durability is one of the DURABILITY_ constants. Writes that are waiting to be synced under the old setting are
+	// synced first.
+	Durability    *uint
+	FsyncInterval *time.Duration
+}
+
+// ApplyConfig changes the settings of the client to the ones in cfg, and saves the collection settings so that they are
+// kept when the client is initialized again. Everything in cfg is validated before anything is changed.
+func (c *Client) ApplyConfig(cfg Config) error {
+	if cfg.MaxConcurrentIO != nil && c.ioLimiter == nil {
+		return ErrIOLimitIsNotEnabled
+	}
+
+	collections := make(map[*collection.Collection]CollectionConfig, len(cfg.Collections))
+	for name, clCfg := range cfg.Collections {
+		cl, err := c.getWritableCollectionByName(name)
+		if err != nil {
+			return err
+		}
+		err = clCfg.validate()
+		if err != nil {
+			return fmt.Errorf("invalid config for collection %s: %w", name, err)
+		}
+		collections[cl] = clCfg
+	}
+
+	if cfg.LogLevel != nil {
+		clog.LogLevel = *cfg.LogLevel
+	}
+	if cfg.MaxConcurrentIO != nil {
+		c.ioLimiter.SetMaxConcurrentIO(*cfg.MaxConcurrentIO)
+	}
+	if len(collections) == 0 {
+		return nil
+	}
+
+	for cl, clCfg := range collections {
+		err := clCfg.apply(cl)
+		if err != nil {
+			return err
+		}
+	}
+	return c.save()
+}
+
+func (cfg CollectionConfig) validate() error {
+	if cfg.CacheMaxEntries != nil && *cfg.CacheMaxEntries < 0 {
+		return fmt.Errorf("CacheMaxEntries can not be negative")
+	}
+	if cfg.CacheMaxBytes != nil && *cfg.CacheMaxBytes < 0 {
+		return fmt.Errorf("CacheMaxBytes can not be negative")
+	}
+	if cfg.Durability != nil && *cfg.Durability > DURABILITY_FSYNC_INTERVAL {
+		return fmt.Errorf("Durability should be one of the DURABILITY_ constants")
+	}
+	if cfg.FsyncInterval != nil && *cfg.FsyncInterval < 0 {
+		return fmt.Errorf("FsyncInterval can not be negative")
+	}
+	return nil
+}
+
+// apply changes the settings of cl, keeping the ones that aren't set in cfg
+func (cfg CollectionConfig) apply(cl *collection.Collection) error {
+	if cfg.CacheMaxEntries != nil || cfg.CacheMaxBytes != nil {
+		maxEntries, maxBytes := cl.GetCacheLimits()
+		if cfg.CacheMaxEntries != nil {
+			maxEntries = *cfg.CacheMaxEntries
+		}
+		if cfg.CacheMaxBytes != nil {
+			maxBytes = *cfg.CacheMaxBytes
+		}
+		err := cl.SetCacheLimits(maxEntries, maxBytes)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Durability != nil || cfg.FsyncInterval != nil {
+		durability, fsyncInterval := cl.GetDurability()
+		if cfg.Durability != nil {
+			durability = *cfg.Durability
+		}
+		if cfg.FsyncInterval != nil {
+			fsyncInterval = *cfg.FsyncInterval
+		}
+		err := cl.SetDurability(durability, fsyncInterval)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
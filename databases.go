@@ -0,0 +1,218 @@
+package gofiledb
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/util"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+/********************************************************************************
+* D A T A B A S E S
+*********************************************************************************/
+
+// A document root can hold any number of named databases besides the collections of the client itself, e.g. one for
+// each tenant of an application: client.DB("tenant_42") returns a client for the database, with its own collections
+// and meta, kept under databases/tenant_42 in the document root. A database is created the first time it is used.
+//
+// A database client shares the document root lock, the file system, the IO limiter and the other settings of the client
+// it was opened from, and is closed along with it. Middleware (see Use) and subscriptions (see Subscribe) are per
+// database. The encryption keys of the collections of a database are provided in ClientInitOptions.EncryptionKeys as
+// "<database>/<collection>".
+
+const DATABASES_DIR_NAME string = "databases"
+
+var ErrDatabaseNameIsInvalid = fmt.Errorf("Database names can only have letters, digits, '_' and '-'")
+var ErrDatabasesCannotBeNested = fmt.Errorf("Databases can only be opened from the main GoFileDb client, not from another database")
+
+var databaseNameRegexp = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+type databaseStore struct {
+	Store map[string]*Client
+	sync.Mutex
+}
+
+// DB returns the client for the database name, creating the database if it doesn't exist yet. Names are case
+// insensitive, like collection names.
+func (c *Client) DB(name string) (*Client, error) {
+	if c.databases == nil {
+		return nil, ErrDatabasesCannotBeNested
+	}
+	name, err := sanitizeDatabaseName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	c.databases.Lock()
+	defer c.databases.Unlock()
+
+	if db, ok := c.databases.Store[name]; ok {
+		return db, nil
+	}
+	db, err := c.openDatabase(name)
+	if err != nil {
+		return nil, err
+	}
+	if c.databases.Store == nil {
+		c.databases.Store = make(map[string]*Client)
+	}
+	c.databases.Store[name] = db
+	return db, nil
+}
+
+// RemoveDB removes the database name, with all its collections
+func (c *Client) RemoveDB(name string) error {
+	if c.isReadOnly() {
+		return ErrClientIsReadOnly
+	}
+	if c.databases == nil {
+		return ErrDatabasesCannotBeNested
+	}
+	name, err := sanitizeDatabaseName(name)
+	if err != nil {
+		return err
+	}
+
+	c.databases.Lock()
+	defer c.databases.Unlock()
+
+	if db, ok := c.databases.Store[name]; ok {
+		err = db.Close()
+		if err != nil {
+			return err
+		}
+		delete(c.databases.Store, name)
+	}
+	return c.fs().RemoveAll(c.getDatabaseDirPath(name))
+}
+
+func sanitizeDatabaseName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !databaseNameRegexp.MatchString(name) {
+		return "", ErrDatabaseNameIsInvalid
+	}
+	return name, nil
+}
+
+func (c *Client) getDatabaseDirPath(name string) string {
+	return util.JoinPath(c.documentRoot, DATABASES_DIR_NAME, name)
+}
+
+// openDatabase loads the database name, or creates it if it doesn't exist and the client isn't read-only
+func (c *Client) openDatabase(name string) (*Client, error) {
+	db := &Client{
+		ClientParams:         ClientParams{documentRoot: c.getDatabaseDirPath(name)},
+		lock:                 &documentRootLock{isShared: c.isReadOnly()}, // the lock of c covers the database
+		auditActor:           c.auditActor,
+		writeErrorHandler:    c.writeErrorHandler,
+		ioLimiter:            c.ioLimiter,
+		walArchiver:          c.walArchiver,
+		defaultNumPartitions: c.defaultNumPartitions,
+		healthMinFreeBytes:   c.healthMinFreeBytes,
+		nameRules:            c.nameRules,
+		fsys:                 c.fsys,
+		hooks:                new(hookStore),
+		subscriptions:        new(subscriptionStore),
+		snapshotSchedules:    new(snapshotScheduleStore),
+		webhooks:             new(webhookStore),
+		metrics:              new(metricsStore),
+		tracer:               c.tracer,
+	}
+	p := c.getDatabaseInitOptions(name)
+	db.encryptionKeys, db.previousEncryptionKeys = p.EncryptionKeys, p.PreviousEncryptionKeys
+
+	if !c.isReadOnly() {
+		for _, dirPath := range []string{db.documentRoot, util.JoinPath(db.documentRoot, util.DATA_DIR_NAME), util.JoinPath(db.documentRoot, util.META_DIR_NAME)} {
+			err := util.CreateDirIfNotExist(db.fs(), dirPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	documentRoot := db.documentRoot
+	layoutVersion, err := db.checkLayoutVersion()
+	if err != nil {
+		return nil, err
+	}
+	err = db.getMeta("globalClient.gob", db)
+	if os.IsNotExist(err) && c.isReadOnly() {
+		return nil, fmt.Errorf("database %s does not exist, and can't be created by a read-only client", name)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if !db.isInitialized {
+		db.collections = &collectionStore{Store: make(map[string]*collection.Collection)}
+		db.isInitialized = true
+		err = db.save()
+		if err != nil {
+			return nil, err
+		}
+		return db, db.setLayoutVersion(LAYOUT_VERSION)
+	}
+
+	util.Debugf("Loading existing GoFileDb database %s", name)
+	if db.documentRoot != documentRoot {
+		return nil, fmt.Errorf("The existing GoFileDb database %s has its documentRoot set to %s. This is an unexpected error.", name, db.documentRoot)
+	}
+	err = setEncryptionKeysFromOptions(p, *db)
+	if err != nil {
+		return nil, err
+	}
+	for _, cl := range db.collections.Store {
+		db.setupCollection(cl)
+		if c.isReadOnly() {
+			cl.SetReadOnly(true)
+		}
+	}
+	if c.isReadOnly() {
+		return db, db.migrateLayout(layoutVersion)
+	}
+
+	// A previous process may have crashed in the middle of something, so make sure that everything is consistent
+	err = db.recover()
+	if err != nil {
+		return nil, err
+	}
+	return db, db.migrateLayout(layoutVersion)
+}
+
+// getDatabaseInitOptions returns the options for the database name, i.e. the encryption keys of its collections
+func (c *Client) getDatabaseInitOptions(name string) ClientInitOptions {
+	p := ClientInitOptions{EncryptionKeys: make(map[string][]byte), PreviousEncryptionKeys: make(map[string][]byte)}
+	prefix := name + "/"
+	for fullName, k := range c.encryptionKeys {
+		fullName = collection.NormalizeName(fullName)
+		if strings.HasPrefix(fullName, prefix) {
+			p.EncryptionKeys[fullName[len(prefix):]] = k
+		}
+	}
+	for fullName, k := range c.previousEncryptionKeys {
+		fullName = collection.NormalizeName(fullName)
+		if strings.HasPrefix(fullName, prefix) {
+			p.PreviousEncryptionKeys[fullName[len(prefix):]] = k
+		}
+	}
+	return p
+}
+
+// closeDatabases closes the clients of all the databases that have been opened
+func (c *Client) closeDatabases() {
+	if c.databases == nil {
+		return
+	}
+	c.databases.Lock()
+	defer c.databases.Unlock()
+	for name, db := range c.databases.Store {
+		err := db.Close()
+		if err != nil {
+			util.Warnf("Error while closing database %s: %s", name, err)
+		}
+	}
+	c.databases.Store = nil
+}
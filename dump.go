@@ -0,0 +1,229 @@
+package gofiledb
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/key"
+	"io"
+	"sort"
+	"time"
+)
+
+/********************************************************************************
+* D U M P
+*********************************************************************************/
+
+// Dump writes all the collections of the client to w in a format that doesn't depend on how they are laid out on disk, so
+// that Load can bring them back in a warehouse written by another version of gofiledb, or on another operating system.
+// A dump is a stream of JSON objects, one per line, each with a "type":
+//
+//	header      {"type":"header","format":"gofiledb-dump","version":1,"created_at":...}
+//	collection  {"type":"collection","name":...,"props":{...},"indexes":[...]}, the props without the encryption keys
+//	doc         {"type":"doc","collection":...,"key":...,"encoding":...,"data":...}, data as base64, as GetFileData returns it
+//	end         {"type":"end","num_collections":...,"num_docs":...}
+//
+// The documents of a collection follow its collection record. The end record is written last, so a dump that was cut
+// short is detected. Readers should ignore the fields they don't know, so that fields can be added without a new version.
+//
+// The dump is consistent: the writes are paused while it is written, as with Backup. Revisions, audit logs, change
+// feeds, expiries, aliases and databases are not part of a dump.
+
+const DUMP_FORMAT_NAME string = "gofiledb-dump"
+const DUMP_FORMAT_VERSION int = 1
+
+const (
+	dumpRecordHeader     string = "header"
+	dumpRecordCollection string = "collection"
+	dumpRecordDoc        string = "doc"
+	dumpRecordEnd        string = "end"
+)
+
+var ErrInvalidDump = fmt.Errorf("The data is not a valid dump")
+var ErrDumpVersionNotSupported = fmt.Errorf("The dump was written in a version of the format that is not supported")
+var ErrDumpIsIncomplete = fmt.Errorf("The dump ends before its end record, it may have been cut short")
+
+// dumpRecord is a line of a dump. Only the fields of its type are set.
+type dumpRecord struct {
+	Type string `json:"type"`
+
+	// header
+	Format    string     `json:"format,omitempty"`
+	Version   int        `json:"version,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+
+	// collection
+	Name    string                      `json:"name,omitempty"`
+	Props   *collection.CollectionProps `json:"props,omitempty"`
+	Indexes []string                    `json:"indexes,omitempty"`
+
+	// doc
+	Collection string  `json:"collection,omitempty"`
+	Key        key.Key `json:"key,omitempty"`
+	Encoding   uint    `json:"encoding,omitempty"`
+	Data       []byte  `json:"data,omitempty"`
+
+	// end
+	NumCollections int `json:"num_collections,omitempty"`
+	NumDocs        int `json:"num_docs,omitempty"`
+}
+
+// Dump writes a dump of all the collections of the client to w
+func (c *Client) Dump(w io.Writer) error {
+	// The collections are loaded first, since none can be once the writes are paused
+	c.collections.RLock()
+	names := c.collections.getNames()
+	c.collections.RUnlock()
+	for _, name := range names {
+		_, err := c.getCollectionByName(name)
+		if err != nil && err != ErrCollectionIsNotExist {
+			return err
+		}
+	}
+
+	resume, err := c.pauseWrites()
+	if err != nil {
+		return err
+	}
+	defer resume()
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	now := time.Now()
+	err = enc.Encode(dumpRecord{Type: dumpRecordHeader, Format: DUMP_FORMAT_NAME, Version: DUMP_FORMAT_VERSION, CreatedAt: &now})
+	if err != nil {
+		return err
+	}
+
+	end := dumpRecord{Type: dumpRecordEnd}
+	for _, name := range c.collections.getNames() {
+		cl, isLoaded := c.collections.Store[name]
+		if !isLoaded { // removed since it was loaded
+			continue
+		}
+
+		props := cl.CollectionProps
+		props.EncryptionKey, props.PreviousEncryptionKey = nil, nil
+		indexes := cl.GetIndexFieldLocators()
+		sort.Strings(indexes)
+		err = enc.Encode(dumpRecord{Type: dumpRecordCollection, Name: cl.Name, Props: &props, Indexes: indexes})
+		if err != nil {
+			return err
+		}
+		end.NumCollections++
+
+		err = cl.ForEachDocData(func(k key.Key, encodingType uint, data []byte) error {
+			end.NumDocs++
+			return enc.Encode(dumpRecord{Type: dumpRecordDoc, Collection: cl.Name, Key: k, Encoding: encodingType, Data: data})
+		})
+		if err != nil {
+			return fmt.Errorf("dumping collection %s: %w", cl.Name, err)
+		}
+	}
+
+	err = enc.Encode(end)
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Load adds the collections in the dump read from r (see Dump) to the client, with their documents and indexes. It fails
+// with ErrCollectionIsExist if the client has a collection with the name of one in the dump. Encrypted collections are
+// encrypted with the keys given to the client for them, if any. If Load fails, the collections loaded so far are kept.
+func (c *Client) Load(r io.Reader) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	var header dumpRecord
+	err := dec.Decode(&header)
+	if err == io.EOF {
+		return ErrDumpIsIncomplete
+	}
+	if err != nil || header.Type != dumpRecordHeader || header.Format != DUMP_FORMAT_NAME {
+		return ErrInvalidDump
+	}
+	if header.Version > DUMP_FORMAT_VERSION {
+		return ErrDumpVersionNotSupported
+	}
+
+	// The indexes of a collection are added once all its documents are loaded, which is faster than keeping them up to
+	// date along the way
+	var cl *collection.Collection
+	var indexes []string
+	addIndexes := func() error {
+		for _, fieldLocator := range indexes {
+			err := c.AddIndex(cl.Name, fieldLocator)
+			if err != nil {
+				return fmt.Errorf("loading collection %s: %w", cl.Name, err)
+			}
+		}
+		cl, indexes = nil, nil
+		return nil
+	}
+
+	var numCollections, numDocs int
+	for {
+		var rec dumpRecord
+		err = dec.Decode(&rec)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrDumpIsIncomplete
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidDump, err)
+		}
+
+		switch rec.Type {
+		case dumpRecordCollection:
+			if rec.Props == nil {
+				return ErrInvalidDump
+			}
+			if cl != nil {
+				err = addIndexes()
+				if err != nil {
+					return err
+				}
+			}
+			_, err = c.getCollectionByName(rec.Name)
+			if err == nil {
+				return ErrCollectionIsExist
+			}
+			if err != ErrCollectionIsNotExist {
+				return err
+			}
+			err = c.addCollectionWithProps(collection.NormalizeName(rec.Name), *rec.Props)
+			if err != nil {
+				return fmt.Errorf("loading collection %s: %w", rec.Name, err)
+			}
+			cl, err = c.getWritableCollectionByName(rec.Name)
+			if err != nil {
+				return err
+			}
+			indexes = rec.Indexes
+			numCollections++
+
+		case dumpRecordDoc:
+			if cl == nil || collection.NormalizeName(rec.Collection) != cl.Name {
+				return ErrInvalidDump
+			}
+			err = cl.SetEncoded(rec.Key, rec.Data, rec.Encoding)
+			if err != nil {
+				return fmt.Errorf("loading document %d of collection %s: %w", rec.Key, cl.Name, err)
+			}
+			numDocs++
+
+		case dumpRecordEnd:
+			if rec.NumCollections != numCollections || rec.NumDocs != numDocs {
+				return ErrDumpIsIncomplete
+			}
+			if cl != nil {
+				return addIndexes()
+			}
+			return nil
+
+		default:
+			// records of types added after this version of the format, which are safe to skip
+		}
+	}
+}
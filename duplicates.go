@@ -0,0 +1,133 @@
+package gofiledb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/key"
+	"io"
+	"sort"
+)
+
+/********************************************************************************
+* D U P L I C A T E S
+*********************************************************************************/
+
+// FindDuplicates goes through the documents of the collections, and reports the ones that have the same data, e.g. to
+// see how much would be saved by STORAGE_CONTENT_ADDRESSED, or to find redundant entries in a cache. Documents are
+// compared by the SHA-256 of their data, as Get returns it (the same hash as the PayloadHash of the audit trail), so
+// documents that are encoded differently (e.g. JSON objects with their fields in another order, or documents of
+// collections with different encodings) are not duplicates. Documents that have expired are left out, even if they
+// haven't been reaped yet, and the documents are read without being added to the cache. Documents that are written while
+// it runs may or may not be compared as they were before.
+
+type DuplicatesOptions struct {
+	Collections []string // the collections to look in, all of them if empty
+	// if true, documents of different collections are compared too, and otherwise only those of the same collection
+	AcrossCollections bool
+}
+
+type DuplicatesReport struct {
+	NumDocs           int   // the number of documents that were compared
+	NumDuplicateDocs  int   // the number of documents that are a duplicate of one that comes before them in their set
+	NumDuplicateBytes int64 // the number of bytes of data of those documents
+	Sets              []DuplicateSet
+}
+
+// DuplicateSet is a set of documents that have the same data
+type DuplicateSet struct {
+	Hash string // the hex encoded SHA-256 of the data
+	Size int64  // the number of bytes of the data of each document
+	Docs []DuplicateDoc
+}
+
+type DuplicateDoc struct {
+	Collection string // the normalized name of the collection
+	Key        Key
+}
+
+// FindDuplicates returns the sets of documents that have the same data in the collections of opts. The sets that waste
+// the most bytes come first (see DuplicateSet.Wasted), and the documents of a set are ordered by collection and key.
+func (c *Client) FindDuplicates(opts DuplicatesOptions) (DuplicatesReport, error) {
+	var report DuplicatesReport
+
+	names := opts.Collections
+	if len(names) == 0 {
+		c.collections.RLock()
+		names = c.collections.getNames()
+		c.collections.RUnlock()
+	}
+
+	type docGroup struct {
+		collection string // the collection of the documents, or "" if AcrossCollections
+		hash       string
+	}
+	groups := make(map[docGroup]*DuplicateSet)
+	seen := make(map[*collection.Collection]bool) // a collection may be listed by its name and by an alias
+	for _, name := range names {
+		cl, err := c.getCollectionByName(name)
+		if err != nil {
+			return report, err
+		}
+		if seen[cl] {
+			continue
+		}
+		seen[cl] = true
+
+		err = cl.ForEachDocReader(func(k key.Key, r io.Reader) error {
+			hash := sha256.New()
+			size, err := io.Copy(hash, r)
+			if err != nil {
+				return err
+			}
+			g := docGroup{hash: hex.EncodeToString(hash.Sum(nil))}
+			if !opts.AcrossCollections {
+				g.collection = cl.Name
+			}
+			set := groups[g]
+			if set == nil {
+				set = &DuplicateSet{Hash: g.hash, Size: size}
+				groups[g] = set
+			}
+			set.Docs = append(set.Docs, DuplicateDoc{Collection: cl.Name, Key: Key(k)})
+			report.NumDocs++
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+
+	for _, set := range groups {
+		if len(set.Docs) < 2 {
+			continue
+		}
+		sort.Slice(set.Docs, func(i, j int) bool {
+			a, b := set.Docs[i], set.Docs[j]
+			if a.Collection != b.Collection {
+				return a.Collection < b.Collection
+			}
+			return a.Key < b.Key
+		})
+		report.NumDuplicateDocs += len(set.Docs) - 1
+		report.NumDuplicateBytes += set.Wasted()
+		report.Sets = append(report.Sets, *set)
+	}
+	sort.Slice(report.Sets, func(i, j int) bool {
+		a, b := report.Sets[i], report.Sets[j]
+		if a.Wasted() != b.Wasted() {
+			return a.Wasted() > b.Wasted()
+		}
+		if a.Hash != b.Hash {
+			return a.Hash < b.Hash
+		}
+		return a.Docs[0].Collection < b.Docs[0].Collection
+	})
+
+	return report, nil
+}
+
+// Wasted returns the number of bytes of data of the documents of the set that are a duplicate of another one
+func (s DuplicateSet) Wasted() int64 {
+	return int64(len(s.Docs)-1) * s.Size
+}
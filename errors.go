@@ -0,0 +1,106 @@
+package gofiledb
+
+import (
+	"errors"
+	"fmt"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/key"
+	"io/fs"
+	"path/filepath"
+)
+
+/********************************************************************************
+* E R R O R S
+*********************************************************************************/
+
+// The errors of Set, Get, Delete and Search (including their Struct and Ctx variants) are *Error values, which tell the
+// collection and document the operation was on, and wrap the error that caused it. Callers can branch on the kind of
+// failure with errors.Is, and get to the details with errors.As:
+//
+//	err := client.GetStruct("Orders", key, &order)
+//	if errors.Is(err, ErrDocNotExist) {
+//		...
+//	}
+//	var dbErr *Error
+//	if errors.As(err, &dbErr) {
+//		log.Printf("%s failed on %s: %s", dbErr.Op, dbErr.Collection, dbErr.Err)
+//	}
+//
+// errors.Is also works with the error that caused it, e.g. fs.ErrNotExist, context.Canceled or ErrDocumentIsCorrupted.
+
+var ErrDocNotExist = fmt.Errorf("Document does not exist")
+var ErrCorrupt = fmt.Errorf("Data is corrupted")
+
+// ErrCollectionNotExist and ErrIndexExists are ErrCollectionIsNotExist and ErrIndexIsExist, named like the other kinds
+// of an Error
+var ErrCollectionNotExist = ErrCollectionIsNotExist
+var ErrIndexExists = collection.ErrIndexIsExist
+
+// Error is an error of an operation on a collection
+type Error struct {
+	Op         string // one of the OP_ constants
+	Collection string
+	Key        Key // not set for searches
+	// Kind is ErrDocNotExist, ErrCollectionNotExist, ErrIndexExists, ErrDecode or ErrCorrupt, or nil if the error is of
+	// none of those kinds
+	Kind error
+	Err  error // the error that caused it
+}
+
+func (e *Error) Error() string {
+	if e.Op == OP_SEARCH {
+		return fmt.Sprintf("%s %s: %s", e.Op, e.Collection, e.Err)
+	}
+	return fmt.Sprintf("%s %s/%d: %s", e.Op, e.Collection, e.Key, e.Err)
+}
+
+// Unwrap returns the Kind and the error that caused e, so that errors.Is and errors.As see both of them
+func (e *Error) Unwrap() []error {
+	if e.Kind == nil || e.Kind == e.Err {
+		return []error{e.Err}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// newError wraps err, which is from op, as an *Error. Errors that already are one are returned as they are.
+func newError(op *Op, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	e := &Error{Op: op.Type, Collection: op.Collection, Err: err, Kind: getErrorKind(err)}
+	if op.Type != OP_SEARCH {
+		e.Key = op.Key
+	}
+	return e
+}
+
+func getErrorKind(err error) error {
+	switch {
+	case errors.Is(err, ErrCollectionIsNotExist):
+		return ErrCollectionNotExist
+	case errors.Is(err, collection.ErrIndexIsExist):
+		return ErrIndexExists
+	case errors.Is(err, ErrDecode):
+		return ErrDecode
+	case errors.Is(err, ErrDocumentIsCorrupted), errors.Is(err, ErrGzipIsIncomplete), errors.Is(err, collection.ErrWALChecksumMismatch):
+		return ErrCorrupt
+	case errors.Is(err, fs.ErrNotExist) && isDocLookupError(err):
+		return ErrDocNotExist
+	}
+	return nil
+}
+
+// isDocLookupError tells whether err, which is a not exist error, is from looking up a document, rather than from some
+// other file of the collection missing (e.g. its meta or an index file). A missing document is reported either as
+// fs.ErrNotExist itself or as an *fs.PathError for the file of the document.
+func isDocLookupError(err error) bool {
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) {
+		return true
+	}
+	_, keyErr := key.GetKeyFromFileName(filepath.Base(pathErr.Path))
+	return keyErr == nil
+}
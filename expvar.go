@@ -0,0 +1,74 @@
+package gofiledb
+
+import (
+	"expvar"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/util"
+	"sync/atomic"
+)
+
+/********************************************************************************
+* E X P V A R
+*********************************************************************************/
+
+// A few counters of the process are published with the expvar package, under the EXPVAR_PREFIX, so that they show up
+// on /debug/vars (or wherever the expvars are already served) without anything to set up. Unlike the metrics of
+// MetricsHandler, they are totals for all the clients of the process (including the databases, see DB):
+//   - gofiledb.docs_written, gofiledb.docs_read, gofiledb.docs_deleted and gofiledb.searches count the operations that
+//     went through the Middleware of the clients and succeeded, and gofiledb.op_errors the ones that failed
+//   - gofiledb.open_files is the number of files that are open right now, if they are in the local file system
+//   - gofiledb.queued_writes is the number of writes queued for write-behind, see CollectionProps.WriteBehindQueueSize
+//   - gofiledb.queued_change_events is the number of changes waiting to be received by the subscribers and webhooks
+//   - gofiledb.io_waiting is the number of reads and writes waiting for their turn, see ClientInitOptions.MaxConcurrentIO
+//
+// GetExpvars returns the same values.
+
+const EXPVAR_PREFIX string = "gofiledb."
+
+var (
+	expvarDocsWritten = expvar.NewInt(EXPVAR_PREFIX + "docs_written")
+	expvarDocsRead    = expvar.NewInt(EXPVAR_PREFIX + "docs_read")
+	expvarDocsDeleted = expvar.NewInt(EXPVAR_PREFIX + "docs_deleted")
+	expvarSearches    = expvar.NewInt(EXPVAR_PREFIX + "searches")
+	expvarOpErrors    = expvar.NewInt(EXPVAR_PREFIX + "op_errors")
+)
+
+func init() {
+	expvar.Publish(EXPVAR_PREFIX+"open_files", expvar.Func(func() interface{} { return util.NumOpenFiles() }))
+	expvar.Publish(EXPVAR_PREFIX+"queued_writes", expvar.Func(func() interface{} { return collection.NumQueuedWrites() }))
+	expvar.Publish(EXPVAR_PREFIX+"queued_change_events", expvar.Func(func() interface{} { return atomic.LoadInt64(&numQueuedChangeEvents) }))
+	expvar.Publish(EXPVAR_PREFIX+"io_waiting", expvar.Func(func() interface{} { return collection.NumWaitingForIO() }))
+}
+
+// GetExpvars returns the values that are published with expvar, by their name without the EXPVAR_PREFIX
+func GetExpvars() map[string]int64 {
+	return map[string]int64{
+		"docs_written":         expvarDocsWritten.Value(),
+		"docs_read":            expvarDocsRead.Value(),
+		"docs_deleted":         expvarDocsDeleted.Value(),
+		"searches":             expvarSearches.Value(),
+		"op_errors":            expvarOpErrors.Value(),
+		"open_files":           util.NumOpenFiles(),
+		"queued_writes":        collection.NumQueuedWrites(),
+		"queued_change_events": atomic.LoadInt64(&numQueuedChangeEvents),
+		"io_waiting":           collection.NumWaitingForIO(),
+	}
+}
+
+// countExpvarOp adds op to the expvar counters, as having failed if err isn't nil
+func countExpvarOp(op *Op, err error) {
+	if err != nil {
+		expvarOpErrors.Add(1)
+		return
+	}
+	switch op.Type {
+	case OP_SET:
+		expvarDocsWritten.Add(1)
+	case OP_GET:
+		expvarDocsRead.Add(1)
+	case OP_DELETE:
+		expvarDocsDeleted.Add(1)
+	case OP_SEARCH:
+		expvarSearches.Add(1)
+	}
+}
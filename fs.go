@@ -0,0 +1,27 @@
+package gofiledb
+
+import (
+	"github.com/teejays/gofiledb/util"
+)
+
+/********************************************************************************
+* F I L E  S Y S T E M
+*********************************************************************************/
+
+// FS is the file system that a client keeps its data in, see ClientInitOptions.FS. These are aliases rather than new
+// types, so that an FS implementation only has to deal with the File of the util package.
+type FS = util.FS
+
+// File is an open file of an FS
+type File = util.File
+
+// OSFS is the local file system, which is used by default
+type OSFS = util.OSFS
+
+// fs returns the file system that the client keeps its data in
+func (c *Client) fs() util.FS {
+	if c.fsys == nil {
+		return util.OSFS{}
+	}
+	return c.fsys
+}
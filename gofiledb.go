@@ -3,32 +3,216 @@
 package gofiledb
 
 import (
+	"errors"
 	"fmt"
 	"github.com/teejays/clog"
 	"github.com/teejays/gofiledb/collection"
 	"github.com/teejays/gofiledb/util"
+	"go.opentelemetry.io/otel/trace"
+	"io/fs"
 	"os"
+	"time"
 )
 
 type ClientInitOptions struct {
 	DocumentRoot          string
 	OverwritePreviousData bool // if true, gofiledb will remove all the existing data in the document root
+	// Encryption keys are never saved to disk, so the keys for existing encrypted collections need to be provided
+	// (collection name -> key) every time the client is initialized.
+	EncryptionKeys         map[string][]byte
+	PreviousEncryptionKeys map[string][]byte // only needed if a key rotation was interrupted
+	// If true, the client can only read an existing document root, and can share it with other read-only clients (e.g.
+	// in other processes). Otherwise, the client needs to be the only one using the document root.
+	ReadOnly bool
+	// AuditActor is who changes are attributed to in the audit logs of the collections with EnableAuditLog set. If empty,
+	// the OS user and host name of the process are used.
+	AuditActor string
+	// WriteErrorHandler is called when a write to a collection with WriteBehindQueueSize set fails in the background,
+	// after Set or Delete has returned. If nil, such errors are logged.
+	WriteErrorHandler func(collectionName string, k Key, err error)
+	// If > 0, at most this many document and index files are read or written at the same time, across all the
+	// collections. Other reads and writes wait for their turn, see GetIOStats.
+	MaxConcurrentIO int
+	// DefaultNumPartitions is the NumPartitions of the collections that are added without one. If 0, they have a single
+	// partition.
+	DefaultNumPartitions int
+	// FS is the file system that the client keeps its data in. If nil, it is the local file system. It isn't saved with
+	// the client, so the same FS needs to be provided every time the client is initialized. In-memory clients don't use
+	// it.
+	FS FS
+	// If true, the client keeps all its data in memory, and loses it when it is closed. DocumentRoot is then not needed,
+	// and not used. It is meant for tests, which can then run without creating anything on disk.
+	InMemory bool
+	// HealthMinFreeBytes is the free disk space below which Health reports the client as unhealthy. If 0,
+	// DEFAULT_HEALTH_MIN_FREE_BYTES is used.
+	HealthMinFreeBytes uint64
+	// CollectionNameRules are the rules that the names of new collections and aliases need to follow. By default, names
+	// can only have letters and digits, and be 2 to 50 characters long. Names are lowercased before they are checked.
+	CollectionNameRules CollectionNameRules
+	// If > 0, the warehouse is kept within this many bytes, by evicting documents from the collections marked Evictable
+	// once it is over, see EnforceByteBudget. It is checked every ByteBudgetCheckInterval, which defaults to
+	// DEFAULT_BYTE_BUDGET_CHECK_INTERVAL.
+	ByteBudget              int64
+	ByteBudgetCheckInterval time.Duration
+	// ByteBudgetHandler is called for every collection that documents are evicted from to stay within the ByteBudget
+	ByteBudgetHandler func(e ByteBudgetEviction)
+	// WALArchiver is given the segments of the WAL of the collections with EnableWAL before they are recycled, e.g. to
+	// ship them off the box. See NewWALArchiveDir to keep them in a dir.
+	WALArchiver WALArchiver
+	// TracerProvider provides the OpenTelemetry tracer that starts a span for every Set, Get, Delete, Search and
+	// AddIndex, see TRACER_NAME. If nil, nothing is traced.
+	TracerProvider trace.TracerProvider
+	// Logger is what the log messages are written to, and LogLevel is the level of clog below which they are dropped.
+	// Both are global to the process, and are only changed once the client has been initialized. If nil, they are left
+	// as they are.
+	Logger   Logger
+	LogLevel *int
 }
 
+// Logger is what the log messages of gofiledb are written to, see ClientInitOptions.Logger
+type Logger util.Logger
+
+// CollectionNameRules are the rules for the names of new collections, see ClientInitOptions.CollectionNameRules. The zero
+// value has the default rules.
+type CollectionNameRules collection.NameRules
+
 type CollectionProps collection.CollectionProps
 
+type QuarantinedDoc collection.QuarantinedDoc
+
+type Revision collection.Revision
+
+type VerifyReport collection.VerifyReport
+
+type VacuumReport collection.VacuumReport
+
+type AuditEntry collection.AuditEntry
+
+type Change collection.Change
+
+// Sequence is the sequence number of a change in the change feed of a collection, see Changes
+type Sequence = collection.Sequence
+
+type IOStats collection.IOLimiterStats
+
+type CollectionStats collection.Stats
+
+type ExportFormat uint
+
+type ExportRecord collection.ExportRecord
+
+type ImportFormat uint
+
+type ImportResult collection.ImportResult
+
+type ReapStats collection.ReapStats
+
+type CacheStats collection.CacheStats
+
+type ExternalChange collection.ExternalChange
+
+type RepartitionProgress collection.RepartitionProgress
+
+type RepartitionMove collection.RepartitionMove
+
+const (
+	ENCODING_NONE    uint = collection.ENCODING_NONE
+	ENCODING_JSON    uint = collection.ENCODING_JSON
+	ENCODING_GOB     uint = collection.ENCODING_GOB
+	ENCODING_MSGPACK uint = collection.ENCODING_MSGPACK
+	ENCODING_CBOR    uint = collection.ENCODING_CBOR
+	ENCODING_BSON    uint = collection.ENCODING_BSON
+)
+
+const (
+	DURABILITY_NONE           uint = collection.DURABILITY_NONE
+	DURABILITY_FSYNC_ON_WRITE uint = collection.DURABILITY_FSYNC_ON_WRITE
+	DURABILITY_FSYNC_INTERVAL uint = collection.DURABILITY_FSYNC_INTERVAL
+)
+
+const (
+	STORAGE_FILES             uint = collection.STORAGE_FILES
+	STORAGE_SEGMENTS          uint = collection.STORAGE_SEGMENTS
+	STORAGE_CONTENT_ADDRESSED uint = collection.STORAGE_CONTENT_ADDRESSED
+)
+
 const (
-	ENCODING_NONE uint = collection.ENCODING_NONE
-	ENCODING_JSON uint = collection.ENCODING_JSON
-	ENCODING_GOB  uint = collection.ENCODING_GOB
+	EVICTION_POLICY_NONE uint = collection.EVICTION_POLICY_NONE
+	EVICTION_POLICY_LRU  uint = collection.EVICTION_POLICY_LRU
+	EVICTION_POLICY_LFU  uint = collection.EVICTION_POLICY_LFU
+)
+
+const (
+	VERIFY_PROBLEM_NOT_A_PARTITION_DIR  string = collection.VERIFY_PROBLEM_NOT_A_PARTITION_DIR
+	VERIFY_PROBLEM_INVALID_FILE_NAME    string = collection.VERIFY_PROBLEM_INVALID_FILE_NAME
+	VERIFY_PROBLEM_WRONG_PARTITION      string = collection.VERIFY_PROBLEM_WRONG_PARTITION
+	VERIFY_PROBLEM_CORRUPTED_DOCUMENT   string = collection.VERIFY_PROBLEM_CORRUPTED_DOCUMENT
+	VERIFY_PROBLEM_INCOMPLETE_DOCUMENT  string = collection.VERIFY_PROBLEM_INCOMPLETE_DOCUMENT
+	VERIFY_PROBLEM_UNREADABLE_DOCUMENT  string = collection.VERIFY_PROBLEM_UNREADABLE_DOCUMENT
+	VERIFY_PROBLEM_UNREADABLE_INDEX     string = collection.VERIFY_PROBLEM_UNREADABLE_INDEX
+	VERIFY_PROBLEM_DANGLING_INDEX_KEY   string = collection.VERIFY_PROBLEM_DANGLING_INDEX_KEY
+	VERIFY_PROBLEM_INDEX_COUNT_MISMATCH string = collection.VERIFY_PROBLEM_INDEX_COUNT_MISMATCH
+	VERIFY_PROBLEM_STALE_MANIFEST       string = collection.VERIFY_PROBLEM_STALE_MANIFEST
+)
+
+const (
+	EXPORT_FORMAT_JSONL ExportFormat = ExportFormat(collection.EXPORT_FORMAT_JSONL)
+	EXPORT_FORMAT_TAR   ExportFormat = ExportFormat(collection.EXPORT_FORMAT_TAR)
+)
+
+const (
+	IMPORT_FORMAT_JSONL        ImportFormat = ImportFormat(collection.IMPORT_FORMAT_JSONL)
+	IMPORT_FORMAT_CSV          ImportFormat = ImportFormat(collection.IMPORT_FORMAT_CSV)
+	IMPORT_FORMAT_EXPORT_JSONL ImportFormat = ImportFormat(collection.IMPORT_FORMAT_EXPORT_JSONL)
+)
+
+const (
+	AUDIT_OP_SET        string = collection.AUDIT_OP_SET
+	AUDIT_OP_DELETE     string = collection.AUDIT_OP_DELETE
+	AUDIT_OP_REVERT     string = collection.AUDIT_OP_REVERT
+	AUDIT_OP_QUARANTINE string = collection.AUDIT_OP_QUARANTINE
 )
 
 var ErrCollectionIsNotExist = collection.ErrCollectionIsNotExist
 var ErrCollectionIsExist = collection.ErrCollectionIsExist
 var ErrIndexNotImplemented = collection.ErrIndexNotImplemented
+var ErrStructNotSupported = collection.ErrStructNotSupported
+var ErrIndexNotSupported = collection.ErrIndexNotSupported
+var ErrEncryptionKeyMissing = collection.ErrEncryptionKeyMissing
+var ErrDecryptionFailed = collection.ErrDecryptionFailed
+var ErrRevisionIsNotExist = collection.ErrRevisionIsNotExist
+var ErrDocumentIsCorrupted = collection.ErrDocumentIsCorrupted
+var ErrQuarantinedDocumentIsNotExist = collection.ErrQuarantinedDocumentIsNotExist
+var ErrGzipIsIncomplete = collection.ErrGzipIsIncomplete
+var ErrCacheIsNotEnabled = collection.ErrCacheIsNotEnabled
+var ErrSegmentStorageIsNotEnabled = collection.ErrSegmentStorageIsNotEnabled
+var ErrContentAddressingIsNotEnabled = collection.ErrContentAddressingIsNotEnabled
+var ErrSegmentStorageNotSupported = collection.ErrSegmentStorageNotSupported
+var ErrColdTieringNotEnabled = collection.ErrColdTieringNotEnabled
+var ErrDecode = collection.ErrDecode
+var ErrReencodeNotSupported = collection.ErrReencodeNotSupported
+var ErrQuotaExceeded = collection.ErrQuotaExceeded
+var ErrCollectionIsFrozen = collection.ErrCollectionIsFrozen
+var ErrInvalidCollectionName = collection.ErrInvalidCollectionName
+var ErrWatchNotSupported = collection.ErrWatchNotSupported
+var ErrInvalidTTL = collection.ErrInvalidTTL
+var ErrLoaderNotSet = collection.ErrLoaderNotSet
+var ErrChangeFeedNotEnabled = collection.ErrChangeFeedNotEnabled
+var ErrMetaIsNotExist = collection.ErrMetaIsNotExist
+var ErrInvalidMetaName = collection.ErrInvalidMetaName
+var ErrInvalidExportFormat = collection.ErrInvalidExportFormat
+var ErrInvalidImportFormat = collection.ErrInvalidImportFormat
+var ErrImportKeyIsMissing = collection.ErrImportKeyIsMissing
+var ErrImportDocIsNotObject = collection.ErrImportDocIsNotObject
+
+// Initialize setsup the package for use by an appliction. This should be called before the client can be used. The
+// options are applied in order, see Option.
+func Initialize(opts ...Option) (err error) {
+	var p ClientInitOptions
+	for _, opt := range opts {
+		opt.apply(&p)
+	}
 
-// Initialize setsup the package for use by an appliction. This should be called before the client can be used.
-func Initialize(p ClientInitOptions) error {
 	// Although rare, it is still possible that two almost simultaneous calls are made to the Initialize function,
 	// which could end up initializing the client twice and might overwrite the param values. Hence, we use a lock
 	// to avoid that situation.
@@ -39,12 +223,47 @@ func Initialize(p ClientInitOptions) error {
 		return ErrClientAlreadyInitialized
 	}
 
-	var cParams ClientParams = NewClientParams(p.DocumentRoot)
+	client, err := openClient(p)
+	if err != nil {
+		return err
+	}
+	globalClient = *client
+	(&globalClient).startByteBudget()
+	p.applyLogSettings()
+	return nil
+}
+
+// applyLogSettings sets the Logger and LogLevel of p, if they are set
+func (p ClientInitOptions) applyLogSettings() {
+	if p.Logger != nil {
+		util.SetLogger(p.Logger)
+	}
+	if p.LogLevel != nil {
+		clog.LogLevel = *p.LogLevel
+	}
+}
 
+// openClient opens the client at p.DocumentRoot, creating it if there is none, without making it the global client
+func openClient(p ClientInitOptions) (_ *Client, err error) {
 	// Ensure that the params provided make sense
-	err := cParams.validate()
+	var fsys util.FS = util.OSFS{}
+	if p.InMemory {
+		if p.ReadOnly {
+			return nil, ErrInMemoryIsReadOnly
+		}
+		fsys, err = newMemoryFS()
+		if err != nil {
+			return nil, err
+		}
+		p.DocumentRoot = MEMORY_DOCUMENT_ROOT
+	} else if p.FS != nil {
+		fsys = p.FS
+	}
+
+	var cParams ClientParams = NewClientParams(p.DocumentRoot)
+	err = cParams.validate(fsys)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Sanitize the params so they'r emore standard
@@ -52,70 +271,203 @@ func Initialize(p ClientInitOptions) error {
 
 	var client Client
 	client.ClientParams = cParams
+	client.hooks = new(hookStore)
+	client.subscriptions = new(subscriptionStore)
+	client.snapshotSchedules = new(snapshotScheduleStore)
+	client.webhooks = new(webhookStore)
+	client.metrics = new(metricsStore)
+	client.databases = new(databaseStore)
+	client.encryptionKeys = p.EncryptionKeys
+	client.previousEncryptionKeys = p.PreviousEncryptionKeys
+	if p.FS != nil || p.InMemory {
+		client.fsys = fsys
+	}
+
+	// Make sure that no other client, e.g. in another process, is writing to the document root
+	lock, err := lockDocumentRoot(fsys, cParams.documentRoot, p.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			lock.unlock()
+		}
+	}()
 
 	// If overwrite previousdata flag is passed, we should delete existing data at document root
 	if p.OverwritePreviousData {
+		if p.ReadOnly {
+			return nil, ErrClientIsReadOnly
+		}
 		err = client.Destroy()
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
+	client.lock = lock
+	client.isInMemory = p.InMemory
+	client.auditActor = p.AuditActor
+	client.writeErrorHandler = p.WriteErrorHandler
+	client.walArchiver = p.WALArchiver
+	client.defaultNumPartitions = p.DefaultNumPartitions
+	client.healthMinFreeBytes = p.HealthMinFreeBytes
+	client.nameRules = collection.NameRules(p.CollectionNameRules)
+	client.budget = newByteBudget(p)
+	if p.TracerProvider != nil {
+		client.tracer = p.TracerProvider.Tracer(TRACER_NAME)
+	}
+	if p.MaxConcurrentIO > 0 {
+		client.ioLimiter = collection.NewIOLimiter(p.MaxConcurrentIO)
+	}
+
+	if p.ReadOnly {
+		return initializeReadOnly(p, client)
+	}
 
 	// Create the neccesary folders
-	err = util.CreateDirIfNotExist(client.ClientParams.documentRoot)
+	err = util.CreateDirIfNotExist(client.fs(), client.ClientParams.documentRoot)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = util.CreateDirIfNotExist(util.JoinPath(client.ClientParams.documentRoot, util.DATA_DIR_NAME))
+	err = util.CreateDirIfNotExist(client.fs(), util.JoinPath(client.ClientParams.documentRoot, util.DATA_DIR_NAME))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = util.CreateDirIfNotExist(util.JoinPath(client.ClientParams.documentRoot, util.META_DIR_NAME))
+	err = util.CreateDirIfNotExist(client.fs(), util.JoinPath(client.ClientParams.documentRoot, util.META_DIR_NAME))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Check if we already have a client that is intitilzed at this Document Root
+	layoutVersion, err := client.checkLayoutVersion()
+	if err != nil {
+		return nil, err
+	}
 	err = client.getMeta("globalClient.gob", &client)
 	if err != nil && !os.IsNotExist(err) {
-		return err
+		return nil, err
 	}
 
 	// By this point, either the existing client has been loaded to client var, or not.
 	// If client.isInitialized == true, then the existing client has been loaded.
 	if client.isInitialized {
-		clog.Warnf("Existing GoFileDb client found at %s. Loading it.", p.DocumentRoot)
+		util.Warnf("Existing GoFileDb client found at %s. Loading it.", p.DocumentRoot)
 		// Ensure that the loaded params match the new params provided
 		// For now, the only param that matters is document root.
-		if client.documentRoot != p.DocumentRoot {
-			return fmt.Errorf("An existing GoFileDb client has been found at the location %s. However, that client's documentRoot is set to %s. This is an unexpected error.", p.DocumentRoot, client.documentRoot)
+		if client.documentRoot != cParams.documentRoot {
+			return nil, fmt.Errorf("An existing GoFileDb client has been found at the location %s. However, that client's documentRoot is set to %s. This is an unexpected error.", p.DocumentRoot, client.documentRoot)
 		}
 		if client.collections == nil {
-			return fmt.Errorf("An existing GoFileDb client has been found at the location %s. However, that client does not have an initialized collection data. This is an unexpected error.", p.DocumentRoot)
+			return nil, fmt.Errorf("An existing GoFileDb client has been found at the location %s. However, that client does not have an initialized collection data. This is an unexpected error.", p.DocumentRoot)
+		}
+
+		err = setEncryptionKeysFromOptions(p, client)
+		if err != nil {
+			return nil, err
+		}
+		for _, cl := range client.collections.Store {
+			client.setupCollection(cl)
 		}
 
-		return nil
+		// A previous process may have crashed in the middle of something, so make sure that everything is consistent
+		err = client.recover()
+		if err != nil {
+			return nil, err
+		}
+		err = client.migrateLayout(layoutVersion)
+		if err != nil {
+			return nil, err
+		}
+		return &client, nil
 	}
 
 	// Code here corresponds to the case when we're creating a new Client
 	// Initialize the CollectionStore
-	collections := new(collectionStore)                        // collections is a pointer to collectionStore
-	collections.Store = make(map[string]collection.Collection) // default case
+	collections := new(collectionStore)                         // collections is a pointer to collectionStore
+	collections.Store = make(map[string]*collection.Collection) // default case
 
 	client.collections = collections
 
 	client.isInitialized = true
 
-	globalClient = client
+	err = client.save()
+	if err != nil {
+		return nil, err
+	}
 
-	err = (&globalClient).save()
+	err = client.setLayoutVersion(LAYOUT_VERSION)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return &client, nil
+}
+
+// initializeReadOnly loads the existing client at the document root for reading only. Unlike a normal client, it does
+// not create anything and does not run the crash recovery pass, since both would write to the document root.
+func initializeReadOnly(p ClientInitOptions, client Client) (*Client, error) {
+	documentRoot := client.documentRoot
+	layoutVersion, err := client.checkLayoutVersion()
+	if err != nil {
+		return nil, err
+	}
+	err = client.getMeta("globalClient.gob", &client)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no existing GoFileDb client found at %s, which is needed for a read-only client", p.DocumentRoot)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if client.documentRoot != documentRoot {
+		return nil, fmt.Errorf("An existing GoFileDb client has been found at the location %s. However, that client's documentRoot is set to %s. This is an unexpected error.", p.DocumentRoot, client.documentRoot)
+	}
+
+	err = setEncryptionKeysFromOptions(p, client)
+	if err != nil {
+		return nil, err
+	}
+	for _, cl := range client.collections.Store {
+		client.setupCollection(cl)
+		cl.SetReadOnly(true)
 	}
 
+	return &client, client.migrateLayout(layoutVersion)
+}
+
+// setEncryptionKeysFromOptions provides the encryption keys to the collections of a client loaded from disk, since keys
+// are not saved with the client
+func setEncryptionKeysFromOptions(p ClientInitOptions, client Client) error {
+	for name, cl := range client.collections.Store {
+		encryptionKey, previousEncryptionKey := getEncryptionKeysFromOptions(p, name)
+		if len(encryptionKey) == 0 && len(previousEncryptionKey) == 0 {
+			continue
+		}
+		err := cl.SetEncryptionKeys(encryptionKey, previousEncryptionKey)
+		if err != nil {
+			return fmt.Errorf("invalid encryption keys provided for collection %s: %w", name, err)
+		}
+	}
 	return nil
 }
 
+// getEncryptionKeysFromOptions returns the keys provided for the collection, matching the collection name the same
+// way collection names are sanitized
+func getEncryptionKeysFromOptions(p ClientInitOptions, collectionName string) ([]byte, []byte) {
+	var encryptionKey, previousEncryptionKey []byte
+	for name, k := range p.EncryptionKeys {
+		if collection.NormalizeName(name) == collectionName {
+			encryptionKey = k
+		}
+	}
+	for name, k := range p.PreviousEncryptionKeys {
+		if collection.NormalizeName(name) == collectionName {
+			previousEncryptionKey = k
+		}
+	}
+	return encryptionKey, previousEncryptionKey
+}
+
+// IsNotExist tells whether err is caused by a document or file not existing. Unlike os.IsNotExist, it sees through
+// wrapped errors, such as an *Error.
 func IsNotExist(err error) bool {
-	return os.IsNotExist(err)
+	return errors.Is(err, fs.ErrNotExist)
 }
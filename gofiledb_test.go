@@ -3,13 +3,62 @@
 package gofiledb
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"github.com/teejays/clog"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/key"
 	"github.com/teejays/gofiledb/util"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"io/ioutil"
 	"log"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
 	"os/user"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 const REMOVE_COLLECTION = false
@@ -73,6 +122,468 @@ var mockCollections map[string]CollectionProps = map[string]CollectionProps{
 		EnableGzipCompression: true,
 		NumPartitions:         3,
 	},
+	"Blob": CollectionProps{
+		Name:                  "Blob",
+		EncodingType:          ENCODING_NONE,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+	},
+	"OrgMsgpack": CollectionProps{
+		Name:                  "OrgMsgpack",
+		EncodingType:          ENCODING_MSGPACK,
+		EnableGzipCompression: false,
+		NumPartitions:         2,
+		Durability:            DURABILITY_FSYNC_ON_WRITE,
+	},
+	"OrgCbor": CollectionProps{
+		Name:                  "OrgCbor",
+		EncodingType:          ENCODING_CBOR,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+		Durability:            DURABILITY_FSYNC_INTERVAL,
+		FsyncInterval:         10 * time.Millisecond,
+	},
+	"OrgBson": CollectionProps{
+		Name:                  "OrgBson",
+		EncodingType:          ENCODING_BSON,
+		EnableGzipCompression: false,
+		NumPartitions:         2,
+	},
+	"OrgMixed": CollectionProps{
+		Name:                  "OrgMixed",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: false,
+		NumPartitions:         2,
+	},
+	"OrgSecret": CollectionProps{
+		Name:                  "OrgSecret",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: false,
+		NumPartitions:         2,
+		EncryptionKey:         []byte("0123456789abcdef0123456789abcdef"),
+		EncryptIndexes:        true,
+	},
+	"OrgWal": CollectionProps{
+		Name:                  "OrgWal",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+		EnableWAL:             true,
+	},
+	"OrgGob": CollectionProps{
+		Name:                  "OrgGob",
+		EncodingType:          ENCODING_GOB,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+	},
+	"OrgCorrupt": CollectionProps{
+		Name:                  "OrgCorrupt",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+	},
+	"OrgVerify": CollectionProps{
+		Name:                  "OrgVerify",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+	},
+	"OrgIsolation": CollectionProps{
+		Name:                  "OrgIsolation",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: false,
+		NumPartitions:         2,
+	},
+	"OrgSnapshot": CollectionProps{
+		Name:                  "OrgSnapshot",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+	},
+	"OrgJournal": CollectionProps{
+		Name:                  "OrgJournal",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: false,
+		NumPartitions:         2,
+	},
+	"OrgAudit": CollectionProps{
+		Name:                  "OrgAudit",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+		NumRevisions:          1,
+		EnableAuditLog:        true,
+	},
+	"OrgRevisions": CollectionProps{
+		Name:                  "OrgRevisions",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+		NumRevisions:          2,
+	},
+	"OrgIndexBuild": CollectionProps{
+		Name:                  "OrgIndexBuild",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         5,
+	},
+	"OrgCache": CollectionProps{
+		Name:                  "OrgCache",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+		CacheMaxEntries:       1,
+	},
+	"OrgPreload": CollectionProps{
+		Name:                  "OrgPreload",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: false,
+		NumPartitions:         2,
+		CacheMaxEntries:       10,
+	},
+	"OrgIndexCache": CollectionProps{
+		Name:                  "OrgIndexCache",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+	},
+	"OrgConcurrent": CollectionProps{
+		Name:                  "OrgConcurrent",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+		NumRevisions:          2,
+	},
+	"OrgSegments": CollectionProps{
+		Name:                  "OrgSegments",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+		StorageEngine:         STORAGE_SEGMENTS,
+		SegmentMaxBytes:       512,
+	},
+	"OrgIndexBatch": CollectionProps{
+		Name:                  "OrgIndexBatch",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+		IndexFlushOps:         5,
+		IndexFlushInterval:    time.Hour, // long enough to never kick in during the test
+	},
+	"OrgManifest": CollectionProps{
+		Name:                  "OrgManifest",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+		EnableManifests:       true,
+	},
+	"OrgWriteBehind": CollectionProps{
+		Name:                  "OrgWriteBehind",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+		WriteBehindQueueSize:  4,
+	},
+	"OrgStreamDecode": CollectionProps{
+		Name:          "OrgStreamDecode",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+	},
+	"OrgPartitionDirs": CollectionProps{
+		Name:          "OrgPartitionDirs",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+	},
+	"OrgTiering": CollectionProps{
+		Name:                  "OrgTiering",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+		ColdAfter:             100 * time.Millisecond,
+	},
+	"OrgDefaultPartitions": CollectionProps{
+		Name:         "OrgDefaultPartitions",
+		EncodingType: ENCODING_JSON,
+	},
+	"OrgContext": CollectionProps{
+		Name:          "OrgContext",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+	},
+	"OrgHooks": CollectionProps{
+		Name:          "OrgHooks",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+	},
+	"OrgSubscribe": CollectionProps{
+		Name:          "OrgSubscribe",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+	},
+	"OrgConfig": CollectionProps{
+		Name:          "OrgConfig",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+	},
+	"OrgLayout": CollectionProps{
+		Name:                  "OrgLayout",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+	},
+	"OrgRename": CollectionProps{
+		Name:                  "OrgRename",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+		NumRevisions:          2,
+	},
+	"OrgClone": CollectionProps{
+		Name:                  "OrgClone",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+	},
+	"OrgAlter": CollectionProps{
+		Name:                  "OrgAlter",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+		NumRevisions:          1,
+	},
+	"OrgRecompress": CollectionProps{
+		Name:                  "OrgRecompress",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+	},
+	"OrgEncoding": CollectionProps{
+		Name:                  "OrgEncoding",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+	},
+	"OrgStats": CollectionProps{
+		Name:                  "OrgStats",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+	},
+	"OrgQuota": CollectionProps{
+		Name:          "OrgQuota",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+		MaxDocs:       2,
+		MaxBytes:      512,
+	},
+	"OrgCapped": CollectionProps{
+		Name:          "OrgCapped",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+		MaxDocs:       3,
+		MaxBytes:      4096,
+		Capped:        true,
+	},
+	"OrgLRU": CollectionProps{
+		Name:           "OrgLRU",
+		EncodingType:   ENCODING_JSON,
+		NumPartitions:  2,
+		MaxDocs:        3,
+		EvictionPolicy: EVICTION_POLICY_LRU,
+	},
+	"OrgLFU": CollectionProps{
+		Name:           "OrgLFU",
+		EncodingType:   ENCODING_JSON,
+		NumPartitions:  2,
+		MaxDocs:        3,
+		EvictionPolicy: EVICTION_POLICY_LFU,
+	},
+	"OrgMeta": CollectionProps{
+		Name:          "OrgMeta",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 1,
+	},
+	"OrgExport": CollectionProps{
+		Name:                  "OrgExport",
+		EncodingType:          ENCODING_MSGPACK,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+	},
+	"OrgImport": CollectionProps{
+		Name:          "OrgImport",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+	},
+	"OrgRollover1": CollectionProps{
+		Name:          "OrgRollover1",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 1,
+	},
+	"OrgRollover2": CollectionProps{
+		Name:          "OrgRollover2",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 1,
+	},
+	"OrgFrozen": CollectionProps{
+		Name:          "OrgFrozen",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+		EnableWAL:     true,
+	},
+	"OrgLazy": CollectionProps{
+		Name:          "OrgLazy",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+		EnableWAL:     true,
+	},
+	"OrgExpiring": CollectionProps{
+		Name:          "OrgExpiring",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+		ReapInterval:  20 * time.Millisecond,
+	},
+	"OrgExpiringUnreaped": CollectionProps{
+		Name:          "OrgExpiringUnreaped",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+	},
+	"OrgCached": CollectionProps{
+		Name:          "OrgCached",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+		SoftTTL:       50 * time.Millisecond,
+	},
+	"OrgPITR": CollectionProps{
+		Name:          "OrgPITR",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+		EnableWAL:     true,
+		RetainWAL:     true,
+	},
+	"OrgChangeFeed": CollectionProps{
+		Name:             "OrgChangeFeed",
+		EncodingType:     ENCODING_JSON,
+		NumPartitions:    2,
+		EnableChangeFeed: true,
+	},
+	"OrgReplicated": CollectionProps{
+		Name:             "OrgReplicated",
+		EncodingType:     ENCODING_JSON,
+		NumPartitions:    2,
+		EnableChangeFeed: true,
+	},
+	"OrgObjectStore": CollectionProps{
+		Name:             "OrgObjectStore",
+		EncodingType:     ENCODING_JSON,
+		NumPartitions:    2,
+		EnableChangeFeed: true,
+	},
+	"OrgContentAddressed": CollectionProps{
+		Name:          "OrgContentAddressed",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+		StorageEngine: STORAGE_CONTENT_ADDRESSED,
+	},
+	"OrgScheduledSnapshots": CollectionProps{
+		Name:          "OrgScheduledSnapshots",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+	},
+	"OrgWALArchive": CollectionProps{
+		Name:          "OrgWALArchive",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+		EnableWAL:     true,
+	},
+	"OrgMerge": CollectionProps{
+		Name:          "OrgMerge",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+	},
+	"OrgGRPC": CollectionProps{
+		Name:          "OrgGRPC",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+	},
+	"OrgSQL": CollectionProps{
+		Name:          "OrgSQL",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+	},
+	"OrgGraphQL": CollectionProps{
+		Name:          "OrgGraphQL",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+	},
+	"OrgWatch": CollectionProps{
+		Name:          "OrgWatch",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+	},
+	"OrgWebhook": CollectionProps{
+		Name:          "OrgWebhook",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+	},
+	"OrgMetrics": CollectionProps{
+		Name:            "OrgMetrics",
+		EncodingType:    ENCODING_JSON,
+		NumPartitions:   2,
+		CacheMaxEntries: 10,
+	},
+	"OrgExpvar": CollectionProps{
+		Name:          "OrgExpvar",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+	},
+	"OrgFS": CollectionProps{
+		Name:                  "OrgFS",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+	},
+	"OrgRepartition": CollectionProps{
+		Name:            "OrgRepartition",
+		EncodingType:    ENCODING_JSON,
+		NumPartitions:   2,
+		NumRevisions:    2,
+		EnableManifests: true,
+	},
+	"OrgVacuum": CollectionProps{
+		Name:          "OrgVacuum",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 3,
+	},
+	"OrgDuplicates": CollectionProps{
+		Name:            "OrgDuplicates",
+		EncodingType:    ENCODING_JSON,
+		NumPartitions:   2,
+		CacheMaxEntries: 10,
+	},
+	"OrgDuplicatesOther": CollectionProps{
+		Name:                  "OrgDuplicatesOther",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         1,
+	},
+	"OrgWALChangeFeed": CollectionProps{
+		Name:             "OrgWALChangeFeed",
+		EncodingType:     ENCODING_JSON,
+		NumPartitions:    2,
+		EnableWAL:        true,
+		EnableChangeFeed: true,
+	},
+	"OrgRepartitionFaultyFS": CollectionProps{
+		Name:          "OrgRepartitionFaultyFS",
+		EncodingType:  ENCODING_JSON,
+		NumPartitions: 2,
+	},
+	"OrgFaultyFS": CollectionProps{
+		Name:                  "OrgFaultyFS",
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         2,
+	},
 }
 
 var mockUsers map[string]User = map[string]User{
@@ -144,6 +655,11 @@ func TestGetClientPreInit(t *testing.T) {
 		}
 	}()
 
+	c, err := GetClientE()
+	if c != nil || err != ErrClientNotInitialized {
+		t.Errorf("Expected GetClientE to return ErrClientNotInitialized but got: %v, %v", c, err)
+	}
+
 	_ = GetClient()
 
 }
@@ -389,10 +905,10 @@ func TestSearch(t *testing.T) {
 	}
 
 	resp, err = c.Search(collectionName, "Org.OrgId:1+Age:26+Name:Tom")
-	if err != nil && err != ErrIndexNotImplemented {
+	if err != nil && !errors.Is(err, ErrIndexNotImplemented) {
 		t.Error(err)
 	}
-	if err != ErrIndexNotImplemented {
+	if !errors.Is(err, ErrIndexNotImplemented) {
 		t.Error(fmt.Errorf("Expected ErrIndexNotImplemented got: %v, %s", resp, err))
 	}
 
@@ -468,96 +984,8768 @@ func TestGzipCollection(t *testing.T) {
 
 }
 
-func TestRemoveCollection(t *testing.T) {
-	if !REMOVE_COLLECTION {
-		log.Println("REMOVE_COLLECTION flag set to false. Leaving collection data as it is.")
-		return
-	}
+func TestGobCollection(t *testing.T) {
+	collectionName := "OrgGob"
+	collectionProps := mockCollections[collectionName]
+
 	client := GetClient()
-	err := client.RemoveCollection(mockCollections["User"].Name)
+	err := client.AddCollection(collectionProps)
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = client.RemoveCollection(mockCollections["Org"].Name)
+	err = assertOrgsRoundTrip(collectionName)
 	if err != nil {
 		t.Error(err)
 	}
+
+	// Gob data cannot be decoded into a map, so it cannot be indexed
+	err = client.AddIndex(collectionName, "Employees")
+	if err != ErrIndexNotSupported {
+		t.Errorf("Expected ErrIndexNotSupported error but got: %v", err)
+	}
 }
 
-func TestDestroy(t *testing.T) {
-	if !DESTROY {
-		log.Println("DESTROY flag set to false. Not destorying the db.")
-		return
+func TestMsgpackCollection(t *testing.T) {
+	err := assertEncodedCollection("OrgMsgpack")
+	if err != nil {
+		t.Error(err)
 	}
-	client := GetClient()
-	err := client.Destroy()
+}
+
+func TestCborCollection(t *testing.T) {
+	err := assertEncodedCollection("OrgCbor")
 	if err != nil {
 		t.Error(err)
 	}
 }
 
-/********************************************************************************
-* H E L P E R S
-*********************************************************************************/
+func TestBsonCollection(t *testing.T) {
+	collectionName := "OrgBson"
 
-// func assertUserDataByKey(key Key, expectedData interface{}) error {
-// 	client := GetClient()
+	client := GetClient()
+	err := client.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Error(err)
+	}
 
-// 	var data User
-// 	err := client.GetStruct(userCollectionName, key, &data)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	if data != expectedData {
-// 		return fmt.Errorf("Fectched data did not match expected data: \n Fetched: %v \n Expected: %v", data, expectedData)
-// 	}
+	err = assertOrgsRoundTrip(collectionName)
+	if err != nil {
+		t.Error(err)
+	}
+}
 
-// 	return nil
-// }
+func TestRawCollection(t *testing.T) {
+	collectionName := "Blob"
+	collectionProps := mockCollections[collectionName]
+	data := []byte("some raw bytes that are not a struct")
 
-func fetchAndAssertData(collectionName string, key Key, newData interface{}, expectedData interface{}, keyFieldName string) error {
 	client := GetClient()
+	err := client.AddCollection(collectionProps)
+	if err != nil {
+		t.Error(err)
+	}
 
-	err := client.GetStruct(collectionName, key, &newData)
+	err = client.Set(collectionName, Key(1), data)
 	if err != nil {
-		return err
+		t.Error(err)
 	}
-	clog.Debugf("Fetched with Key: %d \n%+v", key, newData)
-	clog.Debugf("Expected with Key: %d \n%+v", key, expectedData)
 
-	err = assertEquality(expectedData, newData, keyFieldName)
+	fetched, err := client.Get(collectionName, Key(1))
 	if err != nil {
-		return fmt.Errorf("Fectched data did not match expected data: \n Fetched: %v \n Expected: %v \n Error: %s", newData, expectedData, err)
+		t.Error(err)
+	}
+	if !bytes.Equal(fetched, data) {
+		t.Errorf("Fetched data did not match expected data: \n Fetched: %s \n Expected: %s", fetched, data)
 	}
 
-	return nil
-}
+	buff := bytes.NewBuffer(nil)
+	err = client.GetIntoWriter(collectionName, Key(1), buff)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(buff.Bytes(), data) {
+		t.Errorf("Data written to writer did not match expected data: \n Fetched: %s \n Expected: %s", buff.Bytes(), data)
+	}
 
-func assertSearchResponse(resp SearchResponse, expectedLength int, expectedResult interface{}, keyFieldName string) error {
-	if resp.NumDocuments != expectedLength {
-		return fmt.Errorf("number of results returned %d do not match the expected number %d", resp.NumDocuments, expectedLength)
+	// Raw bytes should be gzip compressed, and decompress to the original data
+	buff.Reset()
+	isGzipped, err := client.GetRawIntoWriter(collectionName, Key(1), buff)
+	if err != nil {
+		t.Error(err)
+	}
+	if !isGzipped {
+		t.Error("Expected the raw data to be gzip compressed")
+	}
+	gz, err := gzip.NewReader(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Errorf("Decompressed raw data did not match expected data: \n Fetched: %s \n Expected: %s", decompressed, data)
 	}
 
-	var seen map[Key]bool = make(map[Key]bool)
+	// Copying into a file takes the direct path from the document file, and should give the same bytes
+	file, err := ioutil.TempFile("", "gofiledb_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	_, err = client.GetRawIntoWriter(collectionName, Key(1), file)
+	if err != nil {
+		t.Error(err)
+	}
+	copied, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err = gzip.NewReader(bytes.NewReader(copied))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err = ioutil.ReadAll(gz)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Errorf("Raw data copied into a file did not match expected data: \n Fetched: %s \n Expected: %s", decompressed, data)
+	}
 
-	switch reflect.TypeOf(expectedResult).Kind() {
-	case reflect.Slice:
-		expectedResultV := reflect.ValueOf(expectedResult)
+	// Struct operations and indexing should be rejected
+	err = client.SetStruct(collectionName, Key(2), mockOrgs[0])
+	if !errors.Is(err, ErrStructNotSupported) {
+		t.Errorf("Expected ErrStructNotSupported error but got: %v", err)
+	}
+	var org Org
+	err = client.GetStruct(collectionName, Key(1), &org)
+	if !errors.Is(err, ErrStructNotSupported) {
+		t.Errorf("Expected ErrStructNotSupported error but got: %v", err)
+	}
+	err = client.AddIndex(collectionName, "OrgId")
+	if err != ErrIndexNotSupported {
+		t.Errorf("Expected ErrIndexNotSupported error but got: %v", err)
+	}
+}
 
-		for i := 0; i < expectedResultV.Len(); i++ {
-			dv := expectedResultV.Index(i)
-			dkv := dv.FieldByName(keyFieldName)
-			var dk Key = Key(dkv.Int())
+func TestEncryptedCollection(t *testing.T) {
+	collectionName := "OrgSecret"
 
-			if seen[dk] == true {
-				return fmt.Errorf("Same document can not be used twice in the expected results: %v", dv.Interface())
-			}
-			seen[dk] = false
-			for _, _r := range resp.Result {
-				r, ok := _r.(map[string]interface{})
-				if !ok {
-					return fmt.Errorf("Could not assert a result item as a map. It should be a map...")
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The data on disk should not be readable
+	client := GetClient()
+	file, err := client.GetFile(collectionName, Key(mockOrgs[0].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	raw, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Error(err)
+	}
+	if bytes.Contains(raw, []byte(mockOrgs[0].Name)) {
+		t.Errorf("Expected the document to be encrypted on disk, but found plaintext: %s", raw)
+	}
+}
+
+var rotatedEncryptionKey []byte = []byte("fedcba9876543210")
+
+func TestRotateEncryptionKey(t *testing.T) {
+	collectionName := "OrgSecret"
+	newKey := rotatedEncryptionKey
+
+	client := GetClient()
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The progress of an interrupted rotation to another key lists every document, but it shouldn't make this rotation
+	// skip any of them
+	progress := "key 00112233445566778899aabbccddeeff\n"
+	for _, data := range mockOrgs {
+		progress += key.Key(data.OrgId).String() + "\n"
+	}
+	progressPath := util.JoinPath(cl.DirPath, collection.META_DIR_NAME, collection.KEY_ROTATION_PROGRESS_FILE_NAME)
+	err = ioutil.WriteFile(progressPath, []byte(progress), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.RotateEncryptionKey(collectionName, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything should be readable using only the new key
+	if len(cl.PreviousEncryptionKey) > 0 {
+		t.Error("Expected the PreviousEncryptionKey to be cleared after the rotation")
+	}
+
+	for _, data := range mockOrgs {
+		var fetched Org
+		err = client.GetStruct(collectionName, Key(data.OrgId), &fetched)
+		if err != nil {
+			t.Error(err)
+		}
+		if fetched != data {
+			t.Errorf("Fetched data did not match expected data: \n Fetched: %v \n Expected: %v", fetched, data)
+		}
+	}
+
+	resp, err := client.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Error(err)
+	}
+	err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWALCollection(t *testing.T) {
+	collectionName := "OrgWal"
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Delete a document, and make sure that it is gone from the data and the index
+	client := GetClient()
+	err = client.Delete(collectionName, Key(mockOrgs[1].OrgId))
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = client.Get(collectionName, Key(mockOrgs[1].OrgId))
+	if !IsNotExist(err) {
+		t.Errorf("Expected a not exist error for a deleted document but got: %v", err)
+	}
+	resp, err := client.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Error(err)
+	}
+	err = assertSearchResult(resp, 0, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Deleting again should fail since the document doesn't exist
+	err = client.Delete(collectionName, Key(mockOrgs[1].OrgId))
+	if !IsNotExist(err) {
+		t.Errorf("Expected a not exist error when deleting a deleted document but got: %v", err)
+	}
+
+	// All ops have been committed, so there should be nothing to replay
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := cl.ReplayWAL()
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 0 {
+		t.Errorf("Expected no ops to be replayed but %d were", n)
+	}
+
+	// A torn record whose length runs past the end of the file is ignored, without reading or allocating that much
+	walPath := util.JoinPath(cl.DirPath, collection.META_DIR_NAME, collection.WAL_FILE_NAME)
+	file, err := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte{0xff, 0xff, 0xff, 0xf0, 0, 0, 0, 0, '{'})
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = cl.ReplayWAL()
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 0 {
+		t.Errorf("Expected no ops to be replayed from a torn record but %d were", n)
+	}
+}
+
+// TestMixedFormatCollection: Makes sure that documents are read correctly after the encoding and gzip settings of a collection change
+func TestMixedFormatCollection(t *testing.T) {
+	collectionName := "OrgMixed"
+	collectionProps := mockCollections[collectionName]
+
+	client := GetClient()
+	err := client.AddCollection(collectionProps)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.SetStruct(collectionName, Key(mockOrgs[0].OrgId), mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Change the settings of the collection directly, since there is no API to do so
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl.EncodingType = ENCODING_GOB
+	cl.EnableGzipCompression = true
+
+	err = client.SetStruct(collectionName, Key(mockOrgs[1].OrgId), mockOrgs[1])
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, data := range mockOrgs {
+		var fetched Org
+		err = client.GetStruct(collectionName, Key(data.OrgId), &fetched)
+		if err != nil {
+			t.Error(err)
+		}
+		if fetched != data {
+			t.Errorf("Fetched data did not match expected data: \n Fetched: %v \n Expected: %v", fetched, data)
+		}
+	}
+}
+
+// TestReloadClient: Makes sure that an existing client, along with its collections, is loaded when the package is
+// initialized again at the same documentRoot (e.g. after a restart)
+func TestQuarantineCorruptedDocument(t *testing.T) {
+	collectionName := "OrgCorrupt"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the document of the second org by cutting off the end of its gzip stream
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := Key(mockOrgs[1].OrgId)
+	path := util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME, key.Key(k).GetPartitionDirName(cl.NumPartitions), key.Key(k).GetFileName(cl.Name, true))
+	original, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, original[:len(original)-10], 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Search should skip the corrupted document instead of failing
+	resp, err := client.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 0, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	docs, err := client.ListQuarantined(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0].Key != key.Key(k) {
+		t.Fatalf("expected document %d to be quarantined, got: %v", k, docs)
+	}
+	if docs[0].Reason != ErrGzipIsIncomplete.Error() {
+		t.Errorf("expected the document to be reported as incomplete, got: %s", docs[0].Reason)
+	}
+
+	// The document is no longer part of the collection
+	_, err = client.Get(collectionName, k)
+	if !errors.Is(err, ErrDocNotExist) {
+		t.Errorf("expected a not exist error for a quarantined document, got: %v", err)
+	}
+
+	// Fix the file, and restore it
+	err = ioutil.WriteFile(util.JoinPath(cl.DirPath, collection.META_DIR_NAME, collection.QUARANTINE_DIR_NAME, docs[0].FileName), original, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.RestoreQuarantined(collectionName, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Corrupt it again, and this time delete it
+	err = ioutil.WriteFile(path, original[:len(original)-10], 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetched Org
+	err = client.GetStruct(collectionName, k, &fetched)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrDocumentIsCorrupted, got: %v", err)
+	}
+	err = client.DeleteQuarantined(collectionName, k)
+	if err != nil {
+		t.Error(err)
+	}
+	docs, err = client.ListQuarantined(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 0 {
+		t.Errorf("expected no quarantined documents, got: %v", docs)
+	}
+}
+
+func TestStreamingDecode(t *testing.T) {
+	collectionName := "OrgStreamDecode"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Documents are decoded while they are read, so write legacy (header-less) files with the JSON we want to test
+	k := Key(mockOrgs[1].OrgId)
+	path := util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME, key.Key(k).GetPartitionDirName(cl.NumPartitions), key.Key(k).GetFileName(cl.Name, false))
+
+	// A document that doesn't fit the struct is an error, but it isn't corrupted
+	err = ioutil.WriteFile(path, []byte(`{"OrgId": 2, "Name": ["Company", "B"]}`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetched Org
+	err = client.GetStruct(collectionName, k, &fetched)
+	if err == nil || err == ErrDocumentIsCorrupted {
+		t.Errorf("expected a decoding error, got: %v", err)
+	}
+
+	// Anything after the JSON value makes the document invalid, as it would with json.Unmarshal
+	err = ioutil.WriteFile(path, []byte(`{"OrgId": 2, "Name": "Company B", "Employees": 500} {}`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.GetStruct(collectionName, k, &fetched)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrDocumentIsCorrupted for a document with trailing data, got: %v", err)
+	}
+	err = client.DeleteQuarantined(collectionName, k)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Trailing whitespace is fine
+	err = ioutil.WriteFile(path, []byte(`{"OrgId": 2, "Name": "Company B", "Employees": 500}`+"\n\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrg(collectionName, mockOrgs[1])
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyCollection(t *testing.T) {
+	collectionName := "OrgVerify"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := client.Verify(collectionName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.NumDocuments != len(mockOrgs) || len(report.Problems) != 0 {
+		t.Fatalf("expected %d documents and no problems, got: %+v", len(mockOrgs), report)
+	}
+
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getDocPath := func(k Key, partition string) string {
+		return util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME, partition, key.Key(k).GetFileName(cl.Name, true))
+	}
+
+	// Move the first doc to the wrong partition, truncate the second one (as a torn write would), and add a file that
+	// doesn't belong
+	k1, k2 := Key(mockOrgs[0].OrgId), Key(mockOrgs[1].OrgId)
+	wrongPartition := key.Key(k2).GetPartitionDirName(cl.NumPartitions)
+	err = os.Rename(getDocPath(k1, key.Key(k1).GetPartitionDirName(cl.NumPartitions)), getDocPath(k1, wrongPartition))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(getDocPath(k2, wrongPartition))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(getDocPath(k2, wrongPartition), data[:len(data)-10], 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	junkPath := util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME, wrongPartition, "junk")
+	err = ioutil.WriteFile(junkPath, []byte("junk"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(junkPath)
+
+	expectedProblems := []string{VERIFY_PROBLEM_WRONG_PARTITION, VERIFY_PROBLEM_INCOMPLETE_DOCUMENT, VERIFY_PROBLEM_INVALID_FILE_NAME}
+	for _, repair := range []bool{false, true} {
+		report, err = client.Verify(collectionName, repair)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = assertVerifyProblems(report, expectedProblems)
+		if err != nil {
+			t.Errorf("repair %t: %s", repair, err)
+		}
+	}
+	if report.NumRepaired() != 2 {
+		t.Errorf("expected 2 problems to be repaired, got %d", report.NumRepaired())
+	}
+
+	// Only the problem that can't be repaired should be left
+	report, err = client.Verify(collectionName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertVerifyProblems(report, []string{VERIFY_PROBLEM_INVALID_FILE_NAME})
+	if err != nil {
+		t.Error(err)
+	}
+
+	var fetched Org
+	err = client.GetStruct(collectionName, k1, &fetched)
+	if err != nil {
+		t.Error(err)
+	}
+	resp, err := client.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 0, nil)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// TestSearchIsolation: a search running alongside writes should only return documents that match the query
+func TestSearchIsolation(t *testing.T) {
+	collectionName := "OrgIsolation"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	org := mockOrgs[1]
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 200; i++ {
+			org.Employees = 500 + (i%2)*100
+			err := client.SetStruct(collectionName, Key(org.OrgId), org)
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		default:
+		}
+
+		resp, err := client.Search(collectionName, "Employees:500")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, _r := range resp.Result {
+			r := _r.(map[string]interface{})
+			if r["Employees"] != float64(500) {
+				t.Fatalf("search for Employees:500 returned a document with Employees %v", r["Employees"])
+			}
+		}
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	collectionName := "OrgSnapshot"
+	snapshotName := "before-change"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Snapshot(collectionName, snapshotName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Snapshot(collectionName, snapshotName)
+	if err != ErrSnapshotIsExist {
+		t.Errorf("expected ErrSnapshotIsExist, got: %v", err)
+	}
+
+	// Changes made after the snapshot should be undone by restoring it, every time it is restored
+	for i := 0; i < 2; i++ {
+		changed := mockOrgs[0]
+		changed.Employees = 500
+		err = client.SetStruct(collectionName, Key(changed.OrgId), changed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.Delete(collectionName, Key(mockOrgs[1].OrgId))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Search(collectionName, "Employees:500")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = assertSearchResult(resp, 1, []string{changed.Name})
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = client.RestoreSnapshot(snapshotName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = assertSnapshotRestored(collectionName)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// A removed collection can be brought back
+	err = client.RemoveCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.RestoreSnapshot(snapshotName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSnapshotRestored(collectionName)
+	if err != nil {
+		t.Error(err)
+	}
+
+	snapshots, err := client.ListSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 || snapshots[0].Name != snapshotName || snapshots[0].CollectionName != strings.ToLower(collectionName) {
+		t.Errorf("unexpected snapshots: %v", snapshots)
+	}
+
+	err = client.DeleteSnapshot(snapshotName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.RestoreSnapshot(snapshotName)
+	if err != ErrSnapshotIsNotExist {
+		t.Errorf("expected ErrSnapshotIsNotExist, got: %v", err)
+	}
+}
+
+func TestIndexJournal(t *testing.T) {
+	collectionName := "OrgJournal"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := key.Key(mockOrgs[0].OrgId)
+	docPath := util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME, k.GetPartitionDirName(cl.NumPartitions), k.GetFileName(cl.Name, false))
+	idxPath := util.JoinPath(cl.GetDirPathForIndexes(), "Employees")
+
+	// Get the file for a newer version of the document, and then go back to the current one
+	changed := mockOrgs[0]
+	changed.Employees = 777
+	err = client.SetStruct(collectionName, Key(changed.OrgId), changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changedFileData, err := ioutil.ReadFile(docPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SetStruct(collectionName, Key(mockOrgs[0].OrgId), mockOrgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash after the newer version was written, but before the index was updated. The index is made newer
+	// than the document, so that only the journal can tell that the index is out of date.
+	err = ioutil.WriteFile(docPath, changedFileData, util.FILE_PERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	err = os.Chtimes(idxPath, future, future)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = appendJournalEntry(util.JoinPath(cl.DirPath, collection.META_DIR_NAME, collection.INDEX_JOURNAL_FILE_NAME), 1000, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = GetClient()
+
+	resp, err := client.Search(collectionName, "Employees:777")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{changed.Name})
+	if err != nil {
+		t.Error(err)
+	}
+	resp, err = client.Search(collectionName, fmt.Sprintf("Employees:%d", mockOrgs[0].Employees))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 0, nil)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	collectionName := "OrgAudit"
+	client := GetClient()
+
+	err := client.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := Key(mockOrgs[0].OrgId)
+	changed := mockOrgs[0]
+	changed.Employees = 500
+	for _, org := range []Org{mockOrgs[0], changed} {
+		err = client.SetStruct(collectionName, k, org)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = client.RevertTo(collectionName, k, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Delete(collectionName, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := client.GetAuditTrail(collectionName, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedOps := []string{AUDIT_OP_SET, AUDIT_OP_SET, AUDIT_OP_REVERT, AUDIT_OP_DELETE}
+	if len(entries) != len(expectedOps) {
+		t.Fatalf("expected %d audit entries, got: %+v", len(expectedOps), entries)
+	}
+
+	usr, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(mockOrgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	originalHash := hex.EncodeToString(sum[:])
+
+	for i, e := range entries {
+		if e.Op != expectedOps[i] || e.Key != key.Key(k) {
+			t.Errorf("entry %d: expected op %s on %d, got: %+v", i, expectedOps[i], k, e)
+		}
+		if e.Actor != usr.Username+"@"+host {
+			t.Errorf("entry %d: unexpected actor %s", i, e.Actor)
+		}
+		if i > 0 && e.Time.Before(entries[i-1].Time) {
+			t.Errorf("entry %d is older than the one before it", i)
+		}
+	}
+	if entries[0].PayloadHash != originalHash || entries[2].PayloadHash != originalHash {
+		t.Errorf("expected the set and the revert to have the hash of the original data %s, got: %+v", originalHash, entries)
+	}
+	if entries[1].PayloadHash == originalHash || entries[3].PayloadHash != "" {
+		t.Errorf("unexpected hashes: %+v", entries)
+	}
+
+	entries, err = client.GetAuditTrail(collectionName, Key(mockOrgs[1].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no audit entries for a document that was never written, got: %+v", entries)
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	collectionName := "OrgRevisions"
+	client := GetClient()
+
+	err := client.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.AddIndex(collectionName, "Employees")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write 4 versions of the same org, only the last 2 previous ones should be kept
+	org := mockOrgs[0]
+	k := Key(org.OrgId)
+	var versions []Org
+	for i := 1; i <= 4; i++ {
+		org.Employees = i * 1000
+		versions = append(versions, org)
+		err = client.SetStruct(collectionName, k, org)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = assertRevisions(collectionName, k, []int{2, 3}, []Org{versions[1], versions[2]})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Revert to the second version, which should keep the fourth one as a revision
+	err = client.RevertTo(collectionName, k, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetched Org
+	err = client.GetStruct(collectionName, k, &fetched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched != versions[1] {
+		t.Errorf("Fetched data did not match expected data: \n Fetched: %v \n Expected: %v", fetched, versions[1])
+	}
+	err = assertRevisions(collectionName, k, []int{3, 4}, []Org{versions[2], versions[3]})
+	if err != nil {
+		t.Error(err)
+	}
+	resp, err := client.Search(collectionName, "Employees:2000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{org.Name})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// A delete can be undone too
+	err = client.Delete(collectionName, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.RevertTo(collectionName, k, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.GetStruct(collectionName, k, &fetched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched != versions[1] {
+		t.Errorf("Fetched data did not match expected data: \n Fetched: %v \n Expected: %v", fetched, versions[1])
+	}
+
+	_, err = client.GetRevision(collectionName, k, 1)
+	if err != ErrRevisionIsNotExist {
+		t.Errorf("expected ErrRevisionIsNotExist for a pruned revision, got: %v", err)
+	}
+}
+
+func TestAddIndexManyPartitions(t *testing.T) {
+	collectionName := "OrgIndexBuild"
+	client := GetClient()
+
+	err := client.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Spread the documents over all the partitions, with every Employees value in more than one of them
+	const numDocs int = 40
+	const numValues int = 4
+	for i := 1; i <= numDocs; i++ {
+		org := Org{OrgId: i, Name: fmt.Sprintf("Company %d", i), Employees: 100 * (i % numValues)}
+		err = client.SetStruct(collectionName, Key(org.OrgId), org)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = client.AddIndex(collectionName, "Employees")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for v := 0; v < numValues; v++ {
+		var names []string
+		for i := 1; i <= numDocs; i++ {
+			if i%numValues == v {
+				names = append(names, fmt.Sprintf("Company %d", i))
+			}
+		}
+		resp, err := client.Search(collectionName, fmt.Sprintf("Employees:%d", 100*v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = assertSearchResult(resp, len(names), names)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	report, err := client.Verify(collectionName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertVerifyProblems(report, nil)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDocumentCache(t *testing.T) {
+	collectionName := "OrgCache"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := key.Key(mockOrgs[0].OrgId)
+	docPath := util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME, k.GetPartitionDirName(cl.NumPartitions), k.GetFileName(cl.Name, true))
+
+	// Keep the file of the current version, and then write a newer one
+	oldFileData, err := ioutil.ReadFile(docPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := mockOrgs[0]
+	changed.Employees = 777
+	err = client.SetStruct(collectionName, Key(changed.OrgId), changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the newer version has been read, it should be served from the cache even if the file changes behind our back
+	err = assertOrg(collectionName, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(docPath, oldFileData, util.FILE_PERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrg(collectionName, changed)
+	if err != nil {
+		t.Error(err)
+	}
+	var buf bytes.Buffer
+	err = client.GetIntoWriter(collectionName, Key(changed.OrgId), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "777") {
+		t.Errorf("expected GetIntoWriter to give the cached data, got: %s", buf.String())
+	}
+
+	// The cache holds one document, so reading another one evicts the first, which is then read from disk again
+	err = assertOrg(collectionName, mockOrgs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrg(collectionName, mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Writes and deletes remove the document from the cache
+	err = client.SetStruct(collectionName, Key(changed.OrgId), changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrg(collectionName, changed)
+	if err != nil {
+		t.Error(err)
+	}
+	err = client.Delete(collectionName, Key(changed.OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Get(collectionName, Key(changed.OrgId))
+	if !IsNotExist(err) {
+		t.Errorf("expected a not exist error after the delete, got: %v", err)
+	}
+}
+
+func TestPreload(t *testing.T) {
+	collectionName := "OrgPreload"
+	client := GetClient()
+
+	err := client.Preload("Org")
+	if err != ErrCacheIsNotEnabled {
+		t.Errorf("expected ErrCacheIsNotEnabled for a collection without a cache, got: %v", err)
+	}
+
+	err = assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var docPaths []string
+	for _, org := range mockOrgs {
+		k := key.Key(org.OrgId)
+		docPaths = append(docPaths, util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME, k.GetPartitionDirName(cl.NumPartitions), k.GetFileName(cl.Name, false)))
+	}
+	// make the first org the most recently written one. The second one is made older, rather than the first one newer, so
+	// that the index isn't older than the documents and isn't rebuilt (which reads all the documents) on reload.
+	past := time.Now().Add(-time.Hour)
+	err = os.Chtimes(docPaths[1], past, past)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Preloaded documents should be served from the cache, even once their files are gone
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = GetClient().Preload(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = withFilesMoved(docPaths, func() error {
+		for _, org := range mockOrgs {
+			err := assertOrg(collectionName, org)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Only the most recent document should be preloaded
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = GetClient().PreloadRecent(collectionName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = withFilesMoved(docPaths, func() error {
+		err := assertOrg(collectionName, mockOrgs[0])
+		if err != nil {
+			return err
+		}
+		_, err = GetClient().Get(collectionName, Key(mockOrgs[1].OrgId))
+		if !IsNotExist(err) {
+			return fmt.Errorf("expected a not exist error for the document that wasn't preloaded, got: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIndexCache(t *testing.T) {
+	collectionName := "OrgIndexCache"
+	client := GetClient()
+
+	// This searches on Employees once, which loads the index into the cache
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxPaths := []string{util.JoinPath(cl.GetDirPathForIndexes(), "Employees")}
+
+	// Searches shouldn't need the index file anymore
+	err = withFilesMoved(idxPaths, func() error {
+		resp, err := client.Search(collectionName, "Employees:100")
+		if err != nil {
+			return err
+		}
+		return assertSearchResult(resp, 1, []string{mockOrgs[0].Name})
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// A write replaces the cached index, so searches see it without reading the index file
+	changed := mockOrgs[0]
+	changed.Employees = 777
+	err = client.SetStruct(collectionName, Key(changed.OrgId), changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = withFilesMoved(idxPaths, func() error {
+		resp, err := client.Search(collectionName, "Employees:777")
+		if err != nil {
+			return err
+		}
+		err = assertSearchResult(resp, 1, []string{changed.Name})
+		if err != nil {
+			return err
+		}
+		resp, err = client.Search(collectionName, "Employees:100")
+		if err != nil {
+			return err
+		}
+		return assertSearchResult(resp, 0, nil)
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	collectionName := "OrgConcurrent"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write both documents from many goroutines at once, so that writes to the same key and to different keys overlap
+	const numWrites int = 20
+	var wg sync.WaitGroup
+	var errs chan error = make(chan error, numWrites)
+	for i := 0; i < numWrites; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			org := mockOrgs[i%len(mockOrgs)]
+			org.Employees = 1000 + i
+			errs <- client.SetStruct(collectionName, Key(org.OrgId), org)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Whichever write ended up last, the index should match it
+	for _, org := range mockOrgs {
+		var stored Org
+		err = client.GetStruct(collectionName, Key(org.OrgId), &stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Search(collectionName, fmt.Sprintf("Employees:%d", stored.Employees))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = assertSearchResult(resp, 1, []string{org.Name})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	report, err := client.Verify(collectionName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertVerifyProblems(report, nil)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSegmentCollection(t *testing.T) {
+	collectionName := "OrgSegments"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Documents should be in the segments, rather than in files of their own
+	dataFiles, err := ioutil.ReadDir(util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dataFiles) != 0 {
+		t.Errorf("expected no partition dirs in the data dir, found %d", len(dataFiles))
+	}
+	_, err = client.GetFile(collectionName, Key(mockOrgs[0].OrgId))
+	if err != ErrSegmentStorageNotSupported {
+		t.Errorf("expected ErrSegmentStorageNotSupported from GetFile, got: %v", err)
+	}
+
+	// Overwrite the documents enough times for segments to fill up, so they are sealed and compacted along the way
+	var latest []Org = make([]Org, len(mockOrgs))
+	for i := 0; i < 50; i++ {
+		org := mockOrgs[i%len(mockOrgs)]
+		org.Employees = 1000 + i
+		err = client.SetStruct(collectionName, Key(org.OrgId), org)
+		if err != nil {
+			t.Fatal(err)
+		}
+		latest[i%len(mockOrgs)] = org
+	}
+	segmentFiles, err := ioutil.ReadDir(util.JoinPath(cl.DirPath, collection.SEGMENTS_DIR_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every segment holds a few writes, but only the latest versions are live, so the old segments are compacted away
+	if len(segmentFiles) > 2 {
+		t.Errorf("expected the old segments to have been compacted, found %d segments", len(segmentFiles))
+	}
+	for _, org := range latest {
+		err = assertOrg(collectionName, org)
+		if err != nil {
+			t.Error(err)
+		}
+		resp, err := client.Search(collectionName, fmt.Sprintf("Employees:%d", org.Employees))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = assertSearchResult(resp, 1, []string{org.Name})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	err = client.Delete(collectionName, Key(latest[0].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Get(collectionName, Key(latest[0].OrgId))
+	if !IsNotExist(err) {
+		t.Errorf("expected a not exist error after the delete, got: %v", err)
+	}
+
+	_, err = client.Compact(collectionName)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = client.Compact("Org")
+	if err != ErrSegmentStorageIsNotEnabled {
+		t.Errorf("expected ErrSegmentStorageIsNotEnabled, got: %v", err)
+	}
+
+	report, err := client.Verify(collectionName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertVerifyProblems(report, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if report.NumDocuments != len(mockOrgs)-1 {
+		t.Errorf("expected Verify to find %d documents, found %d", len(mockOrgs)-1, report.NumDocuments)
+	}
+
+	// The documents are found in the segments again after a restart, and the deleted one stays deleted
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = GetClient()
+	err = assertOrg(collectionName, latest[1])
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = client.Get(collectionName, Key(latest[0].OrgId))
+	if !IsNotExist(err) {
+		t.Errorf("expected a not exist error after reloading, got: %v", err)
+	}
+}
+
+func TestIndexBatching(t *testing.T) {
+	collectionName := "OrgIndexBatch"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxPath := util.JoinPath(cl.GetDirPathForIndexes(), "Employees")
+	idxData, err := ioutil.ReadFile(idxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A couple of writes stay in memory: the index file doesn't change, but searches see them
+	for i := 0; i < 2; i++ {
+		org := mockOrgs[i]
+		org.Employees = 2000 + i
+		err = client.SetStruct(collectionName, Key(org.OrgId), org)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	newIdxData, err := ioutil.ReadFile(idxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(idxData, newIdxData) {
+		t.Errorf("expected the index file to be unchanged before the batch is flushed")
+	}
+	resp, err := client.Search(collectionName, "Employees:2001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Flush saves the batch
+	err = client.Flush(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxData, err = ioutil.ReadFile(idxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(idxData, newIdxData) {
+		t.Errorf("expected the index file to be updated by Flush")
+	}
+
+	// So does reaching IndexFlushOps writes
+	for i := 0; i < 5; i++ {
+		org := mockOrgs[i%len(mockOrgs)]
+		org.Employees = 3000 + i
+		err = client.SetStruct(collectionName, Key(org.OrgId), org)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	newIdxData, err = ioutil.ReadFile(idxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(idxData, newIdxData) {
+		t.Errorf("expected the index file to be updated after %d writes", 5)
+	}
+
+	// Batched changes are saved when the client is closed, so they are still there after a restart
+	err = client.Delete(collectionName, Key(mockOrgs[0].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = GetClient()
+	resp, err = client.Search(collectionName, "Employees:3003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+	if err != nil {
+		t.Error(err)
+	}
+	resp, err = client.Search(collectionName, "Employees:3004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 0, nil)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPartitionManifests(t *testing.T) {
+	collectionName := "OrgManifest"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := client.Count(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(mockOrgs) {
+		t.Errorf("expected a count of %d, got %d", len(mockOrgs), n)
+	}
+
+	// Scans and counts use the manifests, so a document file that was added behind the back of the collection isn't seen
+	k := Key(100)
+	path := util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME, key.Key(k).GetPartitionDirName(cl.NumPartitions), key.Key(k).GetFileName(cl.Name, true))
+	original, err := ioutil.ReadFile(util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME, key.Key(mockOrgs[0].OrgId).GetPartitionDirName(cl.NumPartitions), key.Key(mockOrgs[0].OrgId).GetFileName(cl.Name, true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, original, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = client.Count(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(mockOrgs) {
+		t.Errorf("expected the count to come from the manifests and be %d, got %d", len(mockOrgs), n)
+	}
+
+	// Verify lists the dirs, so it notices, and rebuilds the manifests
+	report, err := client.Verify(collectionName, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertVerifyProblems(report, []string{VERIFY_PROBLEM_STALE_MANIFEST})
+	if err != nil {
+		t.Error(err)
+	}
+	n, err = client.Count(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(mockOrgs)+1 {
+		t.Errorf("expected a count of %d after the manifests were rebuilt, got %d", len(mockOrgs)+1, n)
+	}
+
+	// Sets and Deletes update the manifests
+	err = client.Delete(collectionName, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SetStruct(collectionName, Key(200), mockOrgs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SetStruct(collectionName, Key(201), mockOrgs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = client.Count(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(mockOrgs)+2 {
+		t.Errorf("expected a count of %d, got %d", len(mockOrgs)+2, n)
+	}
+	resp, err := client.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 3, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The manifests are loaded from disk after a restart
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = GetClient()
+	_, err = os.Stat(util.JoinPath(cl.DirPath, collection.META_DIR_NAME, collection.MANIFEST_DIR_NAME, collection.MANIFEST_DIRTY_FILE_NAME))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the dirty marker to be removed when the collection is closed, got: %v", err)
+	}
+	n, err = client.Count(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(mockOrgs)+2 {
+		t.Errorf("expected a count of %d after reloading, got %d", len(mockOrgs)+2, n)
+	}
+	report, err = client.Verify(collectionName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertVerifyProblems(report, nil)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteBehind(t *testing.T) {
+	collectionName := "OrgWriteBehind"
+	client := GetClient()
+
+	// Reads wait for the queued writes to the document, so this works as it does without write-behind
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var latest Org = mockOrgs[0]
+	for i := 0; i < 20; i++ {
+		latest.Employees = 4000 + i
+		err = client.SetStruct(collectionName, Key(latest.OrgId), latest)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = assertOrg(collectionName, latest)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Searches only see the writes once they are applied, which Flush waits for
+	err = client.Flush(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Search(collectionName, fmt.Sprintf("Employees:%d", latest.Employees))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{latest.Name})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Deleting a document that doesn't exist still fails right away
+	err = client.Delete(collectionName, Key(12345))
+	if !IsNotExist(err) {
+		t.Errorf("expected a not exist error, got: %v", err)
+	}
+
+	// Writes that fail in the background are reported to the handler. Replacing the partition dir with a file makes
+	// writes to it fail.
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failedKeys []key.Key
+	var failedKeysLock sync.Mutex
+	cl.SetWriteErrorHandler(func(k key.Key, err error) {
+		failedKeysLock.Lock()
+		failedKeys = append(failedKeys, k)
+		failedKeysLock.Unlock()
+	})
+	defer cl.SetWriteErrorHandler(nil)
+
+	pDirPath := util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME, key.Key(latest.OrgId).GetPartitionDirName(cl.NumPartitions))
+	err = withFilesMoved([]string{pDirPath}, func() error {
+		err := ioutil.WriteFile(pDirPath, nil, 0666)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(pDirPath)
+
+		err = client.SetStruct(collectionName, Key(latest.OrgId), mockOrgs[0])
+		if err != nil {
+			return fmt.Errorf("expected the write to be queued without an error, got: %s", err)
+		}
+		return client.Flush(collectionName)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failedKeysLock.Lock()
+	if len(failedKeys) != 1 || failedKeys[0] != key.Key(latest.OrgId) {
+		t.Errorf("expected the write to %d to be reported as failed, got: %v", latest.OrgId, failedKeys)
+	}
+	failedKeysLock.Unlock()
+
+	// The document is as it was before the failed write
+	err = assertOrg(collectionName, latest)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPartitionDirRemoved(t *testing.T) {
+	collectionName := "OrgPartitionDirs"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes skip the check for the partition dir once it is known to exist, so removing it behind the collection's back
+	// should only cost the next write a retry
+	org := mockOrgs[0]
+	pDirPath := util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME, key.Key(org.OrgId).GetPartitionDirName(cl.NumPartitions))
+	err = os.RemoveAll(pDirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	org.Employees = 5000
+	err = client.SetStruct(collectionName, Key(org.OrgId), org)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrg(collectionName, org)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestColdTiering(t *testing.T) {
+	collectionName := "OrgTiering"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getDocPath := func(k key.Key) string {
+		return util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME, k.GetPartitionDirName(cl.NumPartitions), k.GetFileName(cl.Name, cl.EnableGzipCompression))
+	}
+
+	// Nothing has gone unread for ColdAfter yet
+	n, err := client.MoveColdDocuments(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("expected no documents to be moved, got %d", n)
+	}
+
+	time.Sleep(2 * cl.ColdAfter)
+	n, err = client.MoveColdDocuments(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(mockOrgs) {
+		t.Errorf("expected %d documents to be moved, got %d", len(mockOrgs), n)
+	}
+	for _, org := range mockOrgs {
+		if _, err := os.Stat(getDocPath(key.Key(org.OrgId))); !os.IsNotExist(err) {
+			t.Errorf("expected the file of document %d to be gone from its partition dir, got: %v", org.OrgId, err)
+		}
+	}
+
+	// Cold documents are still counted, searched and verified
+	count, err := client.Count(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(mockOrgs) {
+		t.Errorf("expected a count of %d, got %d", len(mockOrgs), count)
+	}
+	resp, err := client.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+	if err != nil {
+		t.Error(err)
+	}
+	report, err := client.Verify(collectionName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertVerifyProblems(report, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The cold files have the whole document file in them, header included, so there are no headers to add
+	n, err = cl.AddMissingHeaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("expected no headers to be added to cold documents, got %d", n)
+	}
+
+	// Fetching a cold document moves it back
+	err = assertOrg(collectionName, mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(getDocPath(key.Key(mockOrgs[0].OrgId))); err != nil {
+		t.Errorf("expected the file of document %d to be back in its partition dir, got: %v", mockOrgs[0].OrgId, err)
+	}
+
+	// Deleting a cold document removes it for good
+	err = client.Delete(collectionName, Key(mockOrgs[1].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, err := cl.IsDocExist(key.Key(mockOrgs[1].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Errorf("expected document %d to be deleted", mockOrgs[1].OrgId)
+	}
+	count, err = client.Count(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(mockOrgs)-1 {
+		t.Errorf("expected a count of %d, got %d", len(mockOrgs)-1, count)
+	}
+}
+
+func TestIOLimits(t *testing.T) {
+	err := GetClient().Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalClient = Client{}
+	err = Initialize(ClientInitOptions{
+		DocumentRoot:    documentRoot,
+		EncryptionKeys:  map[string][]byte{"OrgSecret": rotatedEncryptionKey},
+		MaxConcurrentIO: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := reloadClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	client := GetClient()
+
+	// With a single slot, parallel reads and writes take turns rather than failing or deadlocking
+	var wg sync.WaitGroup
+	var errs []error = make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			org := mockOrgs[i%len(mockOrgs)]
+			if i%2 == 0 {
+				errs[i] = client.SetStruct("Org", Key(org.OrgId), org)
+				return
+			}
+			resp, err := client.Search("Org", "Employees:500")
+			if err == nil {
+				err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	stats := client.GetIOStats()
+	if stats.MaxConcurrentIO != 1 || stats.NumOps == 0 || stats.NumInProgress != 0 {
+		t.Errorf("unexpected IO stats: %+v", stats)
+	}
+	// The limit can be changed while the client is running
+	maxConcurrentIO := 3
+	err = client.ApplyConfig(Config{MaxConcurrentIO: &maxConcurrentIO})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrg("Org", mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+	if stats := client.GetIOStats(); stats.MaxConcurrentIO != maxConcurrentIO {
+		t.Errorf("expected MaxConcurrentIO to be %d after applying the config, got %d", maxConcurrentIO, stats.MaxConcurrentIO)
+	}
+}
+
+// recordingLogger is a Logger that keeps the messages written to it
+type recordingLogger struct {
+	sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) record(format string, args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) { l.record(format, args...) }
+func (l *recordingLogger) Infof(format string, args ...interface{})  { l.record(format, args...) }
+func (l *recordingLogger) Warnf(format string, args ...interface{})  { l.record(format, args...) }
+func (l *recordingLogger) Errorf(format string, args ...interface{}) { l.record(format, args...) }
+
+func TestInitializeOptions(t *testing.T) {
+	err := GetClient().Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalClient = Client{}
+
+	// The log settings are left alone if Initialize fails
+	logger := new(recordingLogger)
+	logLevel := clog.LogLevel
+	err = Initialize(WithDocumentRoot(" "), WithLogLevel(logLevel+1), WithLogger(logger))
+	if err == nil {
+		t.Fatal("expected Initialize to fail without a document root")
+	}
+	if clog.LogLevel != logLevel {
+		t.Errorf("expected the log level to stay %d, got %d", logLevel, clog.LogLevel)
+	}
+	util.Debugf("logged before the logger is set")
+	logger.Lock()
+	numMessages := len(logger.messages)
+	logger.Unlock()
+	if numMessages != 0 {
+		t.Errorf("expected no messages to be written to the logger before Initialize succeeded, got %d", numMessages)
+	}
+
+	// A ClientInitOptions can be mixed with other options, which are applied in order
+	err = Initialize(
+		ClientInitOptions{DocumentRoot: documentRoot, DefaultNumPartitions: 2},
+		WithEncryptionKey("OrgSecret", rotatedEncryptionKey),
+		WithDefaultPartitions(3),
+		WithLogger(logger),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		util.SetLogger(nil)
+		err := reloadClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	collectionName := "OrgDefaultPartitions"
+	err = assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := GetClient().getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl.NumPartitions != 3 {
+		t.Errorf("expected the collection to have the default of 3 partitions, got %d", cl.NumPartitions)
+	}
+
+	// Encrypted collections can still be read, since their key was given
+	resp, err := GetClient().Search("OrgSecret", "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The messages logged since then have been written to the logger
+	logger.Lock()
+	numMessages = len(logger.messages)
+	logger.Unlock()
+	if numMessages == 0 {
+		t.Error("expected messages to be written to the logger")
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	collectionName := "OrgContext"
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := GetClient()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = client.SearchCtx(ctx, collectionName, "Employees:500")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected SearchCtx to fail with context.Canceled, got %v", err)
+	}
+	_, err = client.GetCtx(ctx, collectionName, Key(mockOrgs[0].OrgId))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected GetCtx to fail with context.Canceled, got %v", err)
+	}
+	var org Org
+	err = client.GetStructCtx(ctx, collectionName, Key(mockOrgs[0].OrgId), &org)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected GetStructCtx to fail with context.Canceled, got %v", err)
+	}
+	var buf bytes.Buffer
+	err = client.GetIntoWriterCtx(ctx, collectionName, Key(mockOrgs[0].OrgId), &buf)
+	if err != context.Canceled {
+		t.Errorf("expected GetIntoWriterCtx to fail with context.Canceled, got %v", err)
+	}
+
+	// A cancelled write leaves the document as it was
+	changed := mockOrgs[0]
+	changed.Name = "Cancelled"
+	err = client.SetStructCtx(ctx, collectionName, Key(changed.OrgId), changed)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected SetStructCtx to fail with context.Canceled, got %v", err)
+	}
+	err = assertOrg(collectionName, mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+
+	// A cancelled index build doesn't add the index
+	err = client.AddIndexCtx(ctx, collectionName, "OrgId")
+	if err != context.Canceled {
+		t.Errorf("expected AddIndexCtx to fail with context.Canceled, got %v", err)
+	}
+	_, err = client.Search(collectionName, "OrgId:1")
+	if !errors.Is(err, ErrIndexNotImplemented) {
+		t.Errorf("expected searching on OrgId to fail with ErrIndexNotImplemented, got %v", err)
+	}
+
+	// Contexts that are not done don't change anything
+	resp, err := client.SearchCtx(context.Background(), collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInMemory(t *testing.T) {
+	err := GetClient().Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalClient = Client{}
+	defer func() {
+		globalClient = Client{}
+		err := Initialize(ClientInitOptions{
+			DocumentRoot:   documentRoot,
+			EncryptionKeys: map[string][]byte{"OrgSecret": rotatedEncryptionKey},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	err = Initialize(WithInMemory(), WithReadOnly())
+	if err != ErrInMemoryIsReadOnly {
+		t.Errorf("expected a read-only in-memory client to fail with ErrInMemoryIsReadOnly, got %v", err)
+	}
+
+	err = Initialize(WithInMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := GetClient()
+	if !client.IsInMemory() {
+		t.Error("expected the client to be in-memory")
+	}
+	if _, ok := client.fs().(*util.MemFS); !ok {
+		t.Errorf("expected the in-memory client to keep its data in a util.MemFS, got %T", client.fs())
+	}
+	if _, err := os.Stat(client.getDocumentRoot()); !os.IsNotExist(err) {
+		t.Errorf("expected the in-memory client to create nothing on the local file system, got %v", err)
+	}
+
+	// The in-memory client starts out empty, and works like any other client, e.g. the collections of the client at the
+	// document root can be added to it afresh
+	exists, err := client.IsCollectionExist("OrgContext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Error("expected the in-memory client to have no collections")
+	}
+	err = assertEncodedCollection("OrgContext")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing it removes all its data
+	err = client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.fs().Stat(client.getDocumentRoot()); !os.IsNotExist(err) {
+		t.Errorf("expected the data of the in-memory client to be removed when it is closed, got %v", err)
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	fsys := util.NewMemFS()
+	err := fsys.MkdirAll("/a/b", util.DIR_PERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files can be written, appended to, linked and renamed, like on the local file system
+	file, err := util.Create(fsys, "/a/b/doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	file, err = fsys.OpenFile("/a/b/doc", os.O_WRONLY|os.O_APPEND, util.FILE_PERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte(" world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	err = fsys.Link("/a/b/doc", "/a/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fsys.Rename("/a/b", "/a/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/a/c/doc", "/a/link"} {
+		data, err := util.ReadFile(fsys, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "hello world" {
+			t.Errorf("expected %s to have %q, got %q", path, "hello world", data)
+		}
+	}
+
+	// Errors work with os.IsNotExist and os.IsExist
+	if _, err := fsys.Stat("/a/b/doc"); !os.IsNotExist(err) {
+		t.Errorf("expected the renamed dir to be gone, got %v", err)
+	}
+	if _, err := fsys.OpenFile("/a/link", os.O_RDWR|os.O_CREATE|os.O_EXCL, util.FILE_PERM); !os.IsExist(err) {
+		t.Errorf("expected O_EXCL to fail for an existing file, got %v", err)
+	}
+	if err := fsys.Remove("/a"); err == nil {
+		t.Error("expected removing a dir that isn't empty to fail")
+	}
+
+	infos, err := util.ReadDir(fsys, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	if !reflect.DeepEqual(names, []string{"c", "link"}) {
+		t.Errorf("expected the dir to have [c link], got %v", names)
+	}
+
+	err = fsys.RemoveAll("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat("/a/link"); !os.IsNotExist(err) {
+		t.Errorf("expected RemoveAll to remove everything under the dir, got %v", err)
+	}
+}
+
+var errInjected = fmt.Errorf("injected error")
+
+// faultyFS is the local file system, but fails to create files while failWrites is set, to write to the change feeds
+// while failChangeFeeds is set, and to move files from one dir to another while failMoves is set. While logSyncs is set,
+// it logs the fsyncs and the renames, in order, see getSyncLog.
+type faultyFS struct {
+	util.OSFS
+	failWrites      int32
+	failChangeFeeds int32
+	failMoves       int32
+	logSyncs        int32
+	syncLog         []string // "sync <path>" or "rename <new path>"
+	syncLogLock     sync.Mutex
+	vanishing       atomic.Value // the name of a file that is removed right before it is opened, as if by another write
+}
+
+// syncLoggingFile is a file of a faultyFS that logs its fsyncs
+type syncLoggingFile struct {
+	util.File
+	fsys *faultyFS
+}
+
+func (f *syncLoggingFile) Sync() error {
+	f.fsys.logSync("sync", f.Name())
+	return f.File.Sync()
+}
+
+func (fsys *faultyFS) Open(name string) (util.File, error) {
+	if vanishing, _ := fsys.vanishing.Load().(string); vanishing != "" && filepath.Base(name) == vanishing {
+		fsys.OSFS.Remove(name)
+	}
+	f, err := fsys.OSFS.Open(name)
+	if err != nil || atomic.LoadInt32(&fsys.logSyncs) == 0 {
+		return f, err
+	}
+	return &syncLoggingFile{File: f, fsys: fsys}, nil
+}
+
+func (fsys *faultyFS) OpenFile(name string, flag int, perm os.FileMode) (util.File, error) {
+	if atomic.LoadInt32(&fsys.failWrites) == 1 && flag&os.O_CREATE != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errInjected}
+	}
+	if atomic.LoadInt32(&fsys.failChangeFeeds) == 1 && filepath.Base(name) == collection.CHANGE_FEED_FILE_NAME {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errInjected}
+	}
+	f, err := fsys.OSFS.OpenFile(name, flag, perm)
+	if err != nil || atomic.LoadInt32(&fsys.logSyncs) == 0 {
+		return f, err
+	}
+	return &syncLoggingFile{File: f, fsys: fsys}, nil
+}
+
+func (fsys *faultyFS) Rename(oldpath, newpath string) error {
+	if atomic.LoadInt32(&fsys.failMoves) == 1 && filepath.Dir(oldpath) != filepath.Dir(newpath) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errInjected}
+	}
+	err := fsys.OSFS.Rename(oldpath, newpath)
+	if err == nil {
+		fsys.logSync("rename", newpath)
+	}
+	return err
+}
+
+func (fsys *faultyFS) logSync(op string, path string) {
+	if atomic.LoadInt32(&fsys.logSyncs) == 0 {
+		return
+	}
+	fsys.syncLogLock.Lock()
+	fsys.syncLog = append(fsys.syncLog, op+" "+filepath.Clean(path))
+	fsys.syncLogLock.Unlock()
+}
+
+// getSyncLog returns the fsyncs and renames logged since the last call
+func (fsys *faultyFS) getSyncLog() []string {
+	fsys.syncLogLock.Lock()
+	defer fsys.syncLogLock.Unlock()
+	log := fsys.syncLog
+	fsys.syncLog = nil
+	return log
+}
+
+func TestFaultyFS(t *testing.T) {
+	err := GetClient().Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalClient = Client{}
+
+	fsys := &faultyFS{}
+	err = Initialize(
+		WithDocumentRoot(documentRoot),
+		WithEncryptionKey("OrgSecret", rotatedEncryptionKey),
+		WithFS(fsys),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := reloadClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	collectionName := "OrgFaultyFS"
+	err = assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed write is reported, and leaves the document as it was
+	atomic.StoreInt32(&fsys.failWrites, 1)
+	changed := mockOrgs[0]
+	changed.Name = "Unwritten"
+	err = GetClient().SetStruct(collectionName, Key(changed.OrgId), changed)
+	if pathErr := new(os.PathError); !errors.As(err, &pathErr) || pathErr.Err != errInjected {
+		t.Errorf("expected the write to fail with the injected error, got %v", err)
+	}
+	atomic.StoreInt32(&fsys.failWrites, 0)
+
+	err = assertOrg(collectionName, mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+	report, err := GetClient().Verify(collectionName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertVerifyProblems(report, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// A document that is deleted while the encryption key is rotated is skipped, rather than stopping the rotation
+	secretProps := mockCollections["OrgSecret"]
+	secretProps.Name = "OrgSecretFaultyFS"
+	err = GetClient().AddCollection(secretProps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer GetClient().RemoveCollection(secretProps.Name)
+	for _, org := range mockOrgs {
+		err = GetClient().SetStruct(secretProps.Name, Key(org.OrgId), org)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fsys.vanishing.Store(fmt.Sprintf("orgsecretfaultyfs_doc_%d", mockOrgs[0].OrgId))
+	err = GetClient().RotateEncryptionKey(secretProps.Name, rotatedEncryptionKey)
+	fsys.vanishing.Store("")
+	if err != nil {
+		t.Errorf("expected the rotation to skip the deleted document, got %v", err)
+	}
+	_, err = GetClient().Get(secretProps.Name, Key(mockOrgs[0].OrgId))
+	if !IsNotExist(err) {
+		t.Errorf("expected the deleted document to not exist, got: %v", err)
+	}
+	err = assertOrg(secretProps.Name, mockOrgs[1])
+	if err != nil {
+		t.Error(err)
+	}
+
+	// A repartitioning that can't move some documents is left unfinished, without the partition dirs of those documents
+	// being recorded as done, and running it again finishes it
+	collectionName = "OrgRepartitionFaultyFS"
+	err = assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := Org{OrgId: 3, Name: "Company C", Employees: 300} // from partition 1 to partition 0
+	err = GetClient().SetStruct(collectionName, Key(moved.OrgId), moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&fsys.failMoves, 1)
+	_, err = GetClient().RepartitionCollection(collectionName, 3, RepartitionOptions{})
+	atomic.StoreInt32(&fsys.failMoves, 0)
+	if !errors.Is(err, errInjected) {
+		t.Errorf("expected the repartitioning to fail with the injected error, got %v", err)
+	}
+	if _, ok, _ := GetClient().GetRepartitionProgress(collectionName); !ok {
+		t.Error("expected the collection to still be repartitioning")
+	}
+	cl, err := GetClient().getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal, err := os.ReadFile(util.JoinPath(cl.DirPath, collection.META_DIR_NAME, collection.REPARTITION_PROGRESS_FILE_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, relPath := range strings.Fields(string(journal)) {
+		if strings.HasPrefix(relPath, collection.DATA_DIR_NAME) { // both partition dirs have a document to move
+			t.Errorf("expected %s not to be recorded as done, since its documents could not be moved", relPath)
+		}
+	}
+	for _, org := range append(mockOrgs[:2:2], moved) {
+		err = assertOrg(collectionName, org)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	repartitionReport, err := GetClient().RepartitionCollection(collectionName, 3, RepartitionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repartitionReport.NumMoved != 2 {
+		t.Errorf("expected the 2 documents that could not be moved before to be moved, got %d", repartitionReport.NumMoved)
+	}
+	if _, ok, _ := GetClient().GetRepartitionProgress(collectionName); ok {
+		t.Error("expected the repartitioning to be finished")
+	}
+	for _, org := range append(mockOrgs[:2:2], moved) {
+		err = assertOrg(collectionName, org)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	report, err = GetClient().Verify(collectionName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertVerifyProblems(report, nil)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWALChangeFeedFailure(t *testing.T) {
+	err := GetClient().Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalClient = Client{}
+
+	fsys := &faultyFS{}
+	initialize := func() error {
+		return Initialize(WithDocumentRoot(documentRoot), WithEncryptionKey("OrgSecret", rotatedEncryptionKey), WithFS(fsys))
+	}
+	err = initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := reloadClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	collectionName := "OrgWALChangeFeed"
+	err = assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastSeq, err := GetClient().GetLastChangeSeq(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A write whose change can't be recorded has still happened, and is committed in the WAL, but returns the error
+	atomic.StoreInt32(&fsys.failChangeFeeds, 1)
+	unrecorded := mockOrgs[0]
+	unrecorded.Name = "Unrecorded"
+	err = GetClient().SetStruct(collectionName, Key(unrecorded.OrgId), unrecorded)
+	atomic.StoreInt32(&fsys.failChangeFeeds, 0)
+	if err == nil {
+		t.Fatal("expected the write to return an error, since its change could not be recorded")
+	}
+	err = assertOrg(collectionName, unrecorded)
+	if err != nil {
+		t.Error(err)
+	}
+	seq, err := GetClient().GetLastChangeSeq(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != lastSeq {
+		t.Fatalf("expected no change to be recorded, got the sequence number %d rather than %d", seq, lastSeq)
+	}
+
+	// A later write to the same document isn't undone when the collection is loaded again, i.e. the WAL has nothing left
+	// to replay
+	changed := mockOrgs[0]
+	changed.Name = "Changed"
+	err = GetClient().SetStruct(collectionName, Key(changed.OrgId), changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = GetClient().Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalClient = Client{}
+	err = initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrg(collectionName, changed)
+	if err != nil {
+		t.Error(err)
+	}
+	it, err := GetClient().Changes(collectionName, lastSeq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	var changes []Change
+	for it.Next() {
+		changes = append(changes, it.Change())
+	}
+	if err = it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Op != AUDIT_OP_SET || changes[0].Key != key.Key(changed.OrgId) {
+		t.Errorf("expected only the later write to be recorded in the change feed, got %+v", changes)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	collectionName := "OrgHooks"
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := GetClient()
+	defer func() {
+		err := reloadClient() // to get rid of the middleware
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// The outer middleware records what it sees, the inner one rejects changes to org 2
+	var seen []string
+	var seenLock sync.Mutex
+	errRejected := fmt.Errorf("org 2 is read-only")
+	client.Use(
+		func(next Handler) Handler {
+			return func(ctx context.Context, op *Op) error {
+				err := next(ctx, op)
+				seenLock.Lock()
+				seen = append(seen, fmt.Sprintf("%s %s %d %v", op.Type, op.Collection, op.Key, err == nil))
+				seenLock.Unlock()
+				return err
+			}
+		},
+		func(next Handler) Handler {
+			return func(ctx context.Context, op *Op) error {
+				if (op.Type == OP_SET || op.Type == OP_DELETE) && op.Key == 2 {
+					return errRejected
+				}
+				return next(ctx, op)
+			}
+		},
+	)
+
+	err = client.SetStruct(collectionName, Key(mockOrgs[1].OrgId), mockOrgs[0])
+	if !errors.Is(err, errRejected) {
+		t.Errorf("expected the middleware to reject the write, got %v", err)
+	}
+	err = client.Delete(collectionName, Key(mockOrgs[1].OrgId))
+	if !errors.Is(err, errRejected) {
+		t.Errorf("expected the middleware to reject the delete, got %v", err)
+	}
+	err = assertOrg(collectionName, mockOrgs[1])
+	if err != nil {
+		t.Error(err)
+	}
+	resp, err := client.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+	if err != nil {
+		t.Error(err)
+	}
+
+	expected := []string{
+		"set OrgHooks 2 false",
+		"delete OrgHooks 2 false",
+		"get OrgHooks 2 true",
+		"search OrgHooks 0 true",
+	}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("expected the middleware to see %v, got %v", expected, seen)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	collectionName := "OrgSubscribe"
+	client := GetClient()
+
+	// Subscribing works before the collection exists, and a subscriber that is never read from doesn't hold up writes
+	events, cancel := client.Subscribe(collectionName)
+	_, cancelIdle := client.Subscribe(collectionName)
+	defer cancelIdle()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Delete(collectionName, Key(mockOrgs[0].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := strings.ToLower(collectionName)
+	expected := []ChangeEvent{
+		{Collection: name, Key: Key(mockOrgs[0].OrgId), Op: AUDIT_OP_SET},
+		{Collection: name, Key: Key(mockOrgs[1].OrgId), Op: AUDIT_OP_SET},
+		{Collection: name, Key: Key(mockOrgs[0].OrgId), Op: AUDIT_OP_DELETE},
+	}
+	for _, want := range expected {
+		select {
+		case e := <-events:
+			if e.Time.IsZero() {
+				t.Errorf("expected the event to have a time: %+v", e)
+			}
+			e.Time = time.Time{}
+			if e != want {
+				t.Errorf("expected event %+v, got %+v", want, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for event %+v", want)
+		}
+	}
+
+	// Cancelling closes the channel
+	cancel()
+	for range events {
+	}
+}
+
+func TestDatabases(t *testing.T) {
+	client := GetClient()
+
+	_, err := client.DB("tenant 42")
+	if err != ErrDatabaseNameIsInvalid {
+		t.Errorf("expected an invalid database name to fail with ErrDatabaseNameIsInvalid, got %v", err)
+	}
+
+	db, err := client.DB("Tenant_42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DB("nested")
+	if err != ErrDatabasesCannotBeNested {
+		t.Errorf("expected opening a database from a database to fail with ErrDatabasesCannotBeNested, got %v", err)
+	}
+
+	// A database can have a collection with the same name as one of the main client, without affecting it
+	collectionName := "OrgHooks"
+	err = db.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := mockOrgs[0]
+	changed.Name = "Tenant 42"
+	err = db.SetStruct(collectionName, Key(changed.OrgId), changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrg(collectionName, mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+	dbDirPath := util.JoinPath(client.getDocumentRoot(), DATABASES_DIR_NAME, "tenant_42")
+	if _, err := os.Stat(util.JoinPath(dbDirPath, util.DATA_DIR_NAME, strings.ToLower(collectionName))); err != nil {
+		t.Errorf("expected the collection to be in the database dir: %v", err)
+	}
+
+	// The database is still there once the client is reloaded
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = GetClient()
+	db, err = client.DB("tenant_42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetched Org
+	err = db.GetStruct(collectionName, Key(changed.OrgId), &fetched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched != changed {
+		t.Errorf("expected %v from the database after reloading, got %v", changed, fetched)
+	}
+
+	err = client.RemoveDB("tenant_42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dbDirPath); !os.IsNotExist(err) {
+		t.Errorf("expected the database dir to be removed, got %v", err)
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	collectionName := "OrgConfig"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Preload(collectionName)
+	if err != ErrCacheIsNotEnabled {
+		t.Fatalf("expected ErrCacheIsNotEnabled before the cache is turned on, got: %v", err)
+	}
+
+	// Nothing is changed if any part of the config is invalid
+	maxEntries := 1
+	negative := time.Duration(-1)
+	err = client.ApplyConfig(Config{Collections: map[string]CollectionConfig{
+		collectionName: {CacheMaxEntries: &maxEntries, FsyncInterval: &negative},
+	}})
+	if err == nil {
+		t.Fatal("expected a negative FsyncInterval to be rejected")
+	}
+	err = client.Preload(collectionName)
+	if err != ErrCacheIsNotEnabled {
+		t.Errorf("expected the cache to still be off after an invalid config, got: %v", err)
+	}
+	maxConcurrentIO := 4
+	err = client.ApplyConfig(Config{MaxConcurrentIO: &maxConcurrentIO})
+	if err != ErrIOLimitIsNotEnabled {
+		t.Errorf("expected ErrIOLimitIsNotEnabled for a client without MaxConcurrentIO, got: %v", err)
+	}
+
+	durability := DURABILITY_FSYNC_INTERVAL
+	interval := 10 * time.Millisecond
+	err = client.ApplyConfig(Config{Collections: map[string]CollectionConfig{
+		collectionName: {CacheMaxEntries: &maxEntries, Durability: &durability, FsyncInterval: &interval},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Preload(collectionName)
+	if err != nil {
+		t.Errorf("expected the cache to be on after applying the config: %v", err)
+	}
+	err = assertOrgsRoundTrip(collectionName)
+	if err != nil {
+		t.Error(err)
+	}
+	err = client.Flush(collectionName)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The settings are kept when the client is reloaded
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = GetClient()
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotEntries, _ := cl.GetCacheLimits(); gotEntries != maxEntries {
+		t.Errorf("expected CacheMaxEntries %d after reloading, got %d", maxEntries, gotEntries)
+	}
+	if gotDurability, gotInterval := cl.GetDurability(); gotDurability != durability || gotInterval != interval {
+		t.Errorf("expected durability %d every %s after reloading, got %d every %s", durability, interval, gotDurability, gotInterval)
+	}
+
+	// Turning the cache off again
+	off := 0
+	err = client.ApplyConfig(Config{Collections: map[string]CollectionConfig{collectionName: {CacheMaxEntries: &off}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Preload(collectionName)
+	if err != ErrCacheIsNotEnabled {
+		t.Errorf("expected ErrCacheIsNotEnabled once the cache is turned off, got: %v", err)
+	}
+	err = assertOrg(collectionName, mockOrgs[1])
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	client := GetClient()
+
+	_, err := client.Get("Org", Key(404))
+	if !errors.Is(err, ErrDocNotExist) || !IsNotExist(err) {
+		t.Errorf("expected ErrDocNotExist for a document that doesn't exist, got: %v", err)
+	}
+	var dbErr *Error
+	if !errors.As(err, &dbErr) {
+		t.Fatalf("expected an *Error, got %T", err)
+	}
+	if dbErr.Op != OP_GET || dbErr.Collection != "Org" || dbErr.Key != Key(404) || dbErr.Kind != ErrDocNotExist {
+		t.Errorf("unexpected error details: %+v", dbErr)
+	}
+
+	_, err = client.Get("NoSuchCollection", Key(1))
+	if !errors.Is(err, ErrCollectionNotExist) {
+		t.Errorf("expected ErrCollectionNotExist, got: %v", err)
+	}
+
+	// A document that doesn't fit the value it is decoded into is not corrupted
+	var wrong []int
+	err = client.GetStruct("Org", Key(mockOrgs[0].OrgId), &wrong)
+	if !errors.Is(err, ErrDecode) || errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrDecode when decoding into the wrong type, got: %v", err)
+	}
+	err = assertOrg("Org", mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Only a missing document is ErrDocNotExist, and not e.g. a missing meta or index file of the collection
+	cl, err := client.getCollectionByName("Org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	missingIndexErr := fmt.Errorf("error while loading the index: %w", &fs.PathError{
+		Op: "open", Path: util.JoinPath(cl.GetDirPathForIndexes(), "Employees"), Err: fs.ErrNotExist,
+	})
+	if kind := getErrorKind(missingIndexErr); kind != nil || !IsNotExist(missingIndexErr) {
+		t.Errorf("expected a missing index file to be of no kind, got %v", kind)
+	}
+	missingDocErr := &fs.PathError{
+		Op: "open", Path: util.JoinPath(cl.DirPath, key.Key(404).GetFileName(cl.Name, false)), Err: fs.ErrNotExist,
+	}
+	if kind := getErrorKind(missingDocErr); kind != ErrDocNotExist {
+		t.Errorf("expected a missing document file to be ErrDocNotExist, got %v", kind)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	client := GetClient()
+
+	report := client.Health()
+	if !report.Healthy {
+		t.Errorf("expected the client to be healthy, got: %+v", report)
+	}
+	checks := make(map[string]HealthCheck, len(report.Checks))
+	for _, check := range report.Checks {
+		checks[check.Name] = check
+	}
+	for _, name := range []string{HEALTH_CHECK_WRITABLE, HEALTH_CHECK_DISK_SPACE, HEALTH_CHECK_META, HEALTH_CHECK_COLLECTION_PREFIX + "org"} {
+		if _, ok := checks[name]; !ok {
+			t.Errorf("expected a %s check, got: %+v", name, report.Checks)
+		}
+	}
+
+	// Not enough free disk space makes the client unhealthy
+	client.healthMinFreeBytes = math.MaxUint64
+	defer func() { client.healthMinFreeBytes = 0 }()
+	report = client.Health()
+	if report.Healthy {
+		t.Error("expected the client to be unhealthy with not enough free disk space")
+	}
+	for _, check := range report.Checks {
+		if check.Healthy == (check.Name == HEALTH_CHECK_DISK_SPACE) {
+			t.Errorf("expected only the %s check to fail, got: %+v", HEALTH_CHECK_DISK_SPACE, check)
+		}
+	}
+}
+
+func TestLayoutMigration(t *testing.T) {
+	collectionName := "OrgLayout"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := client.checkLayoutVersion()
+	if err != nil || version != LAYOUT_VERSION {
+		t.Errorf("expected the layout to be version %d, got %d (%v)", LAYOUT_VERSION, version, err)
+	}
+
+	// Take the headers off the document files, and the layout version out of the meta, as if the document root was
+	// written before either existed
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataPath := util.JoinPath(cl.DirPath, util.DATA_DIR_NAME)
+	forEachDocFile := func(fn func(path string, data []byte) error) error {
+		return filepath.Walk(dataPath, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return fn(path, data)
+		})
+	}
+	err = forEachDocFile(func(path string, data []byte) error {
+		return ioutil.WriteFile(path, data[collection.DOC_HEADER_LEN:], util.FILE_PERM)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	layoutPath := util.JoinPath(client.getDocumentRoot(), util.META_DIR_NAME, LAYOUT_META_NAME)
+	for _, path := range []string{layoutPath, layoutPath + META_PREVIOUS_FILE_EXTENSION} {
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+	}
+
+	// Loading the client migrates the layout
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = GetClient()
+	var numDocs int
+	err = forEachDocFile(func(path string, data []byte) error {
+		numDocs++
+		if !bytes.HasPrefix(data, []byte(collection.DOC_HEADER_MAGIC)) {
+			return fmt.Errorf("expected %s to have a header after the migration", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if numDocs != len(mockOrgs) {
+		t.Errorf("expected %d document files, found %d", len(mockOrgs), numDocs)
+	}
+	version, err = client.checkLayoutVersion()
+	if err != nil || version != LAYOUT_VERSION {
+		t.Errorf("expected the layout to be version %d after the migration, got %d (%v)", LAYOUT_VERSION, version, err)
+	}
+	err = assertOrg(collectionName, mockOrgs[1])
+	if err != nil {
+		t.Error(err)
+	}
+
+	// A layout newer than this version knows about is not loaded
+	params := client.ClientParams
+	err = client.setLayoutVersion(LAYOUT_VERSION + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reloadClient()
+	if err != ErrLayoutIsNewer {
+		t.Errorf("expected ErrLayoutIsNewer for a newer layout, got: %v", err)
+	}
+	err = (&Client{ClientParams: params}).setLayoutVersion(LAYOUT_VERSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Initialize(ClientInitOptions{
+		DocumentRoot:   documentRoot,
+		EncryptionKeys: map[string][]byte{"OrgSecret": rotatedEncryptionKey},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyLayoutMigration(t *testing.T) {
+	collectionName := "OrgLegacy"
+	root, err := ioutil.TempDir("", "gofiledb_legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	var orgs []Org
+	for i := 1; i <= 6; i++ {
+		orgs = append(orgs, Org{OrgId: i, Name: fmt.Sprintf("Company %d", i), Employees: 100 * i})
+	}
+	c, err := openClient(ClientInitOptions{DocumentRoot: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.AddCollection(CollectionProps{Name: collectionName, EncodingType: ENCODING_JSON, NumPartitions: 3, EnableGzipCompression: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, org := range orgs {
+		err = c.SetStruct(collectionName, Key(org.OrgId), org)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = c.AddIndex(collectionName, "Employees")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	warehousePath, clDirPath := c.getDocumentRoot(), cl.DirPath
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite the warehouse the way it was laid out before layout versions: a client meta with only the params, the
+	// index files in the indexes dir of the collection, and document files without a header
+	metaDirPath := util.JoinPath(warehousePath, util.META_DIR_NAME)
+	err = os.RemoveAll(metaDirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(metaDirPath, util.DIR_PERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta bytes.Buffer
+	err = gob.NewEncoder(&meta).Encode(NewClientParams(warehousePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(util.JoinPath(metaDirPath, "globalClient.gob"), meta.Bytes(), util.FILE_PERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(util.JoinPath(clDirPath, util.META_DIR_NAME, collection.INDEX_DIR_NAME), util.JoinPath(clDirPath, collection.INDEX_DIR_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileInfos, err := ioutil.ReadDir(clDirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fileInfo := range fileInfos {
+		if fileInfo.Name() != util.DATA_DIR_NAME && fileInfo.Name() != collection.INDEX_DIR_NAME {
+			err = os.RemoveAll(util.JoinPath(clDirPath, fileInfo.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err = filepath.Walk(util.JoinPath(clDirPath, util.DATA_DIR_NAME), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(path, data[collection.DOC_HEADER_LEN:], util.FILE_PERM)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Loading the client registers the collection again, with the props worked out from its files
+	c, err = openClient(ClientInitOptions{DocumentRoot: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	version, err := c.checkLayoutVersion()
+	if err != nil || version != LAYOUT_VERSION {
+		t.Errorf("expected the layout to be version %d after the migration, got %d (%v)", LAYOUT_VERSION, version, err)
+	}
+	cl, err = c.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl.NumPartitions != 3 || !cl.EnableGzipCompression || cl.EncodingType != ENCODING_JSON {
+		t.Errorf("expected the props of the collection to be worked out from its files, got %+v", cl.CollectionProps)
+	}
+	if _, err := os.Stat(util.JoinPath(clDirPath, collection.INDEX_DIR_NAME)); !os.IsNotExist(err) {
+		t.Errorf("expected the index files to be moved out of the indexes dir, got: %v", err)
+	}
+	for _, org := range orgs {
+		err = assertOrgIn(c, collectionName, org)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	resp, err := c.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{orgs[4].Name})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRenameCollection(t *testing.T) {
+	collectionName := "OrgRename"
+	newName := "OrgRenamed"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := mockOrgs[0]
+	changed.Employees = 150
+	err = client.SetStruct(collectionName, Key(changed.OrgId), changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.RenameCollection(collectionName, "Org")
+	if err != ErrCollectionIsExist {
+		t.Errorf("expected renaming to the name of another collection to fail with ErrCollectionIsExist, got: %v", err)
+	}
+	err = client.RenameCollection(collectionName, newName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Get(collectionName, Key(changed.OrgId))
+	if !errors.Is(err, ErrCollectionNotExist) {
+		t.Errorf("expected the old name to be gone, got: %v", err)
+	}
+
+	assertRenamed := func(name string) error {
+		err := assertOrg(name, changed)
+		if err != nil {
+			return err
+		}
+		resp, err := GetClient().Search(name, "Employees:500")
+		if err != nil {
+			return err
+		}
+		err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+		if err != nil {
+			return err
+		}
+		revisions, err := GetClient().ListRevisions(name, Key(changed.OrgId))
+		if err != nil {
+			return err
+		}
+		if len(revisions) != 1 {
+			return fmt.Errorf("expected 1 revision, got %d", len(revisions))
+		}
+
+		// all the document files are named after the collection
+		cl, err := GetClient().getCollectionByName(name)
+		if err != nil {
+			return err
+		}
+		if cl.DirPath != GetClient().getDirPathForCollection(strings.ToLower(name)) {
+			return fmt.Errorf("expected the collection to be at %s, got %s", GetClient().getDirPathForCollection(strings.ToLower(name)), cl.DirPath)
+		}
+		return filepath.Walk(util.JoinPath(cl.DirPath, util.DATA_DIR_NAME), func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			if !strings.HasPrefix(info.Name(), strings.ToLower(name)+"_") {
+				return fmt.Errorf("expected %s to be named after collection %s", path, name)
+			}
+			return nil
+		})
+	}
+	err = assertRenamed(newName)
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(client.getDirPathForCollection(strings.ToLower(collectionName))); !os.IsNotExist(err) {
+		t.Errorf("expected the old collection dir to be gone, got: %v", err)
+	}
+
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertRenamed(newName)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// A rename that was interrupted right after it was recorded is finished by the recovery pass
+	err = GetClient().setMeta(RENAME_META_NAME, renameInfo{OldName: strings.ToLower(newName), NewName: strings.ToLower(collectionName)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertRenamed(collectionName)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCloneCollection(t *testing.T) {
+	collectionName := "OrgClone"
+	cloneName := "OrgCloned"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.CloneCollection(collectionName, "Org", CloneOptions{})
+	if err != ErrCollectionIsExist {
+		t.Errorf("expected cloning to the name of another collection to fail with ErrCollectionIsExist, got: %v", err)
+	}
+	err = client.CloneCollection("NoSuchCollection", cloneName, CloneOptions{})
+	if err != ErrCollectionIsNotExist {
+		t.Errorf("expected ErrCollectionIsNotExist, got: %v", err)
+	}
+
+	noGzip := false
+	err = client.CloneCollection(collectionName, cloneName, CloneOptions{NumPartitions: 3, EnableGzipCompression: &noGzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertCloned := func() error {
+		for _, org := range mockOrgs {
+			err := assertOrg(cloneName, org)
+			if err != nil {
+				return err
+			}
+		}
+		resp, err := GetClient().Search(cloneName, "Employees:500")
+		if err != nil {
+			return err
+		}
+		err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+		if err != nil {
+			return err
+		}
+
+		cl, err := GetClient().getCollectionByName(cloneName)
+		if err != nil {
+			return err
+		}
+		if cl.NumPartitions != 3 || cl.EnableGzipCompression {
+			return fmt.Errorf("expected the clone to have 3 partitions and no gzip compression, got %d partitions and gzip %t", cl.NumPartitions, cl.EnableGzipCompression)
+		}
+		return filepath.Walk(util.JoinPath(cl.DirPath, util.DATA_DIR_NAME), func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			if strings.HasSuffix(path, ".gz") {
+				return fmt.Errorf("expected %s not to be gzip compressed", path)
+			}
+			return nil
+		})
+	}
+	err = assertCloned()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The clone is independent of the source
+	changed := mockOrgs[0]
+	changed.Employees = 150
+	err = client.SetStruct(cloneName, Key(changed.OrgId), changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrg(collectionName, mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+	err = client.SetStruct(cloneName, Key(mockOrgs[0].OrgId), mockOrgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertCloned()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = GetClient().RemoveCollection(cloneName)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAlterCollection(t *testing.T) {
+	collectionName := "OrgAlter"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	props := mockCollections[collectionName]
+	props.Name = "OrgAltered"
+	err = client.AlterCollection(collectionName, props)
+	if err != ErrAlterCannotRename {
+		t.Errorf("expected ErrAlterCannotRename, got: %v", err)
+	}
+
+	props = mockCollections[collectionName]
+	props.EncodingType = ENCODING_MSGPACK
+	props.EnableGzipCompression = false
+	props.NumPartitions = 3
+	err = client.AlterCollection(collectionName, props)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertAltered := func() error {
+		for _, org := range mockOrgs {
+			err := assertOrg(collectionName, org)
+			if err != nil {
+				return err
+			}
+		}
+		resp, err := GetClient().Search(collectionName, "Employees:500")
+		if err != nil {
+			return err
+		}
+		err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+		if err != nil {
+			return err
+		}
+
+		cl, err := GetClient().getCollectionByName(collectionName)
+		if err != nil {
+			return err
+		}
+		if cl.EncodingType != ENCODING_MSGPACK || cl.EnableGzipCompression || cl.NumPartitions != 3 {
+			return fmt.Errorf("expected the collection to be altered, got props %+v", cl.CollectionProps)
+		}
+		for _, suffix := range []string{collection.ALTER_NEW_DIR_SUFFIX, collection.ALTER_OLD_DIR_SUFFIX} {
+			if _, err := os.Stat(cl.DirPath + suffix); !os.IsNotExist(err) {
+				return fmt.Errorf("expected %s to be gone, got: %v", cl.DirPath+suffix, err)
+			}
+		}
+		var numDocs int
+		err = filepath.Walk(util.JoinPath(cl.DirPath, util.DATA_DIR_NAME), func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			if strings.HasSuffix(path, ".gz") {
+				return fmt.Errorf("expected %s not to be gzip compressed", path)
+			}
+			numDocs++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if numDocs != len(mockOrgs) {
+			return fmt.Errorf("expected %d document files, got %d", len(mockOrgs), numDocs)
+		}
+		return nil
+	}
+	err = assertAltered()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Gob can't be decoded without knowing the type of the documents, so they can't be re-encoded to it
+	gobProps := props
+	gobProps.EncodingType = ENCODING_GOB
+	err = client.AlterCollection(collectionName, gobProps)
+	if !errors.Is(err, ErrReencodeNotSupported) {
+		t.Errorf("expected ErrReencodeNotSupported, got: %v", err)
+	}
+	err = assertAltered()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertAltered()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// An alteration that was interrupted before the dirs were swapped is abandoned by the recovery pass...
+	cl, err := GetClient().getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(cl.DirPath+collection.ALTER_NEW_DIR_SUFFIX, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = GetClient().setMeta(ALTER_META_NAME, newAlterInfo(collection.CollectionProps(mockCollections[collectionName]).Sanitize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertAltered()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// ...and one that was interrupted while they were being swapped is finished
+	err = os.MkdirAll(cl.DirPath+collection.ALTER_OLD_DIR_SUFFIX, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cachedProps := props
+	cachedProps.CacheMaxEntries = 10
+	err = GetClient().setMeta(ALTER_META_NAME, newAlterInfo(collection.CollectionProps(cachedProps).Sanitize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertAltered()
+	if err != nil {
+		t.Error(err)
+	}
+	cl, err = GetClient().getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl.CacheMaxEntries != 10 {
+		t.Errorf("expected the recorded props to be applied, got CacheMaxEntries %d", cl.CacheMaxEntries)
+	}
+}
+
+func TestSetGzipCompression(t *testing.T) {
+	collectionName := "OrgRecompress"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertCompression := func(enabled bool) error {
+		for _, org := range mockOrgs {
+			err := assertOrg(collectionName, org)
+			if err != nil {
+				return err
+			}
+			isGzipped, err := GetClient().GetRawIntoWriter(collectionName, Key(org.OrgId), ioutil.Discard)
+			if err != nil {
+				return err
+			}
+			if isGzipped != enabled {
+				return fmt.Errorf("expected document %d to be gzipped: %t, got %t", org.OrgId, enabled, isGzipped)
+			}
+		}
+		resp, err := GetClient().Search(collectionName, "Employees:500")
+		if err != nil {
+			return err
+		}
+		err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+		if err != nil {
+			return err
+		}
+
+		cl, err := GetClient().getCollectionByName(collectionName)
+		if err != nil {
+			return err
+		}
+		if cl.EnableGzipCompression != enabled {
+			return fmt.Errorf("expected EnableGzipCompression to be %t", enabled)
+		}
+		return filepath.Walk(util.JoinPath(cl.DirPath, util.DATA_DIR_NAME), func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			if strings.HasSuffix(path, ".gz") != enabled {
+				return fmt.Errorf("expected %s to be named after the gzip setting", path)
+			}
+			return nil
+		})
+	}
+
+	// Documents can be written while they are being rewritten
+	done := make(chan error)
+	go func() {
+		var err error
+		for i := 0; i < 20 && err == nil; i++ {
+			err = GetClient().SetStruct(collectionName, Key(mockOrgs[1].OrgId), mockOrgs[1])
+		}
+		done <- err
+	}()
+	_, err = client.SetGzipCompression(collectionName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	err = assertCompression(false)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Nothing is left to rewrite
+	n, err := client.SetGzipCompression(collectionName, false)
+	if err != nil || n != 0 {
+		t.Errorf("expected no documents to be rewritten, got %d (%v)", n, err)
+	}
+
+	n, err = client.SetGzipCompression(collectionName, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(mockOrgs) {
+		t.Errorf("expected %d documents to be rewritten, got %d", len(mockOrgs), n)
+	}
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertCompression(true)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChangeEncoding(t *testing.T) {
+	collectionName := "OrgEncoding"
+	client := GetClient()
+
+	err := client.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrgsRoundTrip(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEncoding := func(encodingType uint) error {
+		for _, org := range mockOrgs {
+			err := assertOrg(collectionName, org)
+			if err != nil {
+				return err
+			}
+		}
+		cl, err := GetClient().getCollectionByName(collectionName)
+		if err != nil {
+			return err
+		}
+		if cl.EncodingType != encodingType {
+			return fmt.Errorf("expected encoding type %d, got %d", encodingType, cl.EncodingType)
+		}
+		return nil
+	}
+
+	// Gob can only be decoded into the type it was encoded from
+	_, err = client.ChangeEncoding(collectionName, ENCODING_GOB, nil)
+	if !errors.Is(err, ErrReencodeNotSupported) {
+		t.Errorf("expected ErrReencodeNotSupported, got: %v", err)
+	}
+	n, err := client.ChangeEncoding(collectionName, ENCODING_GOB, Org{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(mockOrgs) {
+		t.Errorf("expected %d documents to be re-encoded, got %d", len(mockOrgs), n)
+	}
+	err = assertEncoding(ENCODING_GOB)
+	if err != nil {
+		t.Error(err)
+	}
+	n, err = client.ChangeEncoding(collectionName, ENCODING_JSON, &Org{})
+	if err != nil || n != len(mockOrgs) {
+		t.Fatalf("expected %d documents to be re-encoded, got %d (%v)", len(mockOrgs), n, err)
+	}
+	err = assertEncoding(ENCODING_JSON)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Indexes are rebuilt, and so need an encoding that can be indexed
+	err = client.AddIndex(collectionName, "Employees")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.ChangeEncoding(collectionName, ENCODING_GOB, Org{})
+	if err != ErrIndexNotSupported {
+		t.Errorf("expected ErrIndexNotSupported, got: %v", err)
+	}
+	n, err = client.ChangeEncoding(collectionName, ENCODING_MSGPACK, nil)
+	if err != nil || n != len(mockOrgs) {
+		t.Fatalf("expected %d documents to be re-encoded, got %d (%v)", len(mockOrgs), n, err)
+	}
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertEncoding(ENCODING_MSGPACK)
+	if err != nil {
+		t.Error(err)
+	}
+	resp, err := GetClient().Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectionStats(t *testing.T) {
+	collectionName := "OrgStats"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The stats should match what is on disk
+	assertStats := func(orgs []Org) (CollectionStats, error) {
+		stats, err := GetClient().CollectionStats(collectionName)
+		if err != nil {
+			return stats, err
+		}
+		if stats.NumDocuments != len(orgs) {
+			return stats, fmt.Errorf("expected %d documents, got %d", len(orgs), stats.NumDocuments)
+		}
+		var rawBytes int64
+		for _, org := range orgs {
+			data, err := json.Marshal(org)
+			if err != nil {
+				return stats, err
+			}
+			rawBytes += int64(len(data))
+		}
+		if stats.RawBytes != rawBytes {
+			return stats, fmt.Errorf("expected %d raw bytes, got %d", rawBytes, stats.RawBytes)
+		}
+
+		cl, err := GetClient().getCollectionByName(collectionName)
+		if err != nil {
+			return stats, err
+		}
+		var storedBytes int64
+		partitionCounts := make(map[string]int)
+		err = filepath.Walk(util.JoinPath(cl.DirPath, util.DATA_DIR_NAME), func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			storedBytes += info.Size()
+			partitionCounts[filepath.Base(filepath.Dir(path))]++
+			return nil
+		})
+		if err != nil {
+			return stats, err
+		}
+		if stats.StoredBytes != storedBytes {
+			return stats, fmt.Errorf("expected %d stored bytes, got %d", storedBytes, stats.StoredBytes)
+		}
+		if !reflect.DeepEqual(stats.PartitionCounts, partitionCounts) {
+			return stats, fmt.Errorf("expected partition counts %v, got %v", partitionCounts, stats.PartitionCounts)
+		}
+
+		if len(stats.Indexes) != 1 || stats.Indexes[0].FieldLocator != "Employees" || stats.Indexes[0].NumValues == 0 || stats.Indexes[0].Bytes == 0 {
+			return stats, fmt.Errorf("expected stats for the index on Employees, got %+v", stats.Indexes)
+		}
+		if stats.LastWriteTime.IsZero() {
+			return stats, fmt.Errorf("expected a last write time")
+		}
+		return stats, nil
+	}
+	before, err := assertStats(mockOrgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes and deletes keep the stats up to date
+	changed := mockOrgs[0]
+	changed.Name = changed.Name + " Incorporated"
+	err = client.SetStruct(collectionName, Key(changed.OrgId), changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := assertStats([]Org{changed, mockOrgs[1]})
+	if err != nil {
+		t.Error(err)
+	}
+	if stats.LastWriteTime.Before(before.LastWriteTime) {
+		t.Errorf("expected the last write time to move on from %s, got %s", before.LastWriteTime, stats.LastWriteTime)
+	}
+	err = client.Delete(collectionName, Key(changed.OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = assertStats(mockOrgs[1:])
+	if err != nil {
+		t.Error(err)
+	}
+
+	// They are gathered again from disk by a new client
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = assertStats(mockOrgs[1:])
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectionQuota(t *testing.T) {
+	collectionName := "OrgQuota"
+	client := GetClient()
+
+	// Quotas can't be negative
+	p := mockCollections[collectionName]
+	p.MaxDocs = -1
+	err := client.AddCollection(p)
+	if err == nil {
+		t.Errorf("expected an error when adding a collection with a negative MaxDocs")
+	}
+
+	err = client.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrgsRoundTrip(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Documents can still be overwritten once the collection is full
+	changed := mockOrgs[0]
+	changed.Employees = 150
+	err = client.SetStruct(collectionName, Key(changed.OrgId), changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// but no more documents can be added
+	extra := Org{OrgId: 3, Name: "Company C", Employees: 50}
+	err = client.SetStruct(collectionName, Key(extra.OrgId), extra)
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded when going over MaxDocs, got: %v", err)
+	}
+	_, err = client.Get(collectionName, Key(extra.OrgId))
+	if !IsNotExist(err) {
+		t.Errorf("expected the document over the quota not to have been written, got: %v", err)
+	}
+
+	// and documents can't grow past MaxBytes
+	tooBig := changed
+	tooBig.Name = strings.Repeat("A", 1000)
+	err = client.SetStruct(collectionName, Key(tooBig.OrgId), tooBig)
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded when going over MaxBytes, got: %v", err)
+	}
+	err = assertOrg(collectionName, changed)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Deleting a document makes room for another one
+	err = client.Delete(collectionName, Key(mockOrgs[1].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SetStruct(collectionName, Key(extra.OrgId), extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The quota still holds for a new client
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = GetClient().SetStruct(collectionName, Key(mockOrgs[1].OrgId), mockOrgs[1])
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded after reloading the client, got: %v", err)
+	}
+}
+
+func TestCappedCollection(t *testing.T) {
+	collectionName := "OrgCapped"
+	client := GetClient()
+
+	// A capped collection needs a cap
+	p := mockCollections[collectionName]
+	p.MaxDocs, p.MaxBytes = 0, 0
+	err := client.AddCollection(p)
+	if err == nil {
+		t.Errorf("expected an error when adding a capped collection without MaxDocs or MaxBytes")
+	}
+
+	err = client.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The oldest documents make room for the new ones
+	setOrg := func(id int) error {
+		// the order of the documents is taken from the modification times of their files by a new client
+		time.Sleep(10 * time.Millisecond)
+		return GetClient().SetStruct(collectionName, Key(id), Org{OrgId: id, Name: fmt.Sprintf("Company %d", id), Employees: id * 100})
+	}
+	assertOrgIds := func(expectedIds []int) error {
+		for id := 1; id <= 10; id++ {
+			var expected bool
+			for _, expectedId := range expectedIds {
+				expected = expected || id == expectedId
+			}
+			_, err := GetClient().Get(collectionName, Key(id))
+			if expected && err != nil {
+				return fmt.Errorf("expected document %d to be there, got: %v", id, err)
+			}
+			if !expected && !IsNotExist(err) {
+				return fmt.Errorf("expected document %d to have been evicted, got: %v", id, err)
+			}
+		}
+		stats, err := GetClient().CollectionStats(collectionName)
+		if err != nil {
+			return err
+		}
+		if stats.NumDocuments != len(expectedIds) {
+			return fmt.Errorf("expected %d documents in the stats, got %d", len(expectedIds), stats.NumDocuments)
+		}
+		return nil
+	}
+	for id := 1; id <= 5; id++ {
+		err = setOrg(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = assertOrgIds([]int{3, 4, 5})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Rewriting a document makes it the most recent one
+	err = setOrg(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setOrg(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrgIds([]int{3, 5, 6})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Only a document that doesn't fit on its own is refused
+	tooBig := Org{OrgId: 7, Name: strings.Repeat("A", 5000)}
+	err = client.SetStruct(collectionName, Key(tooBig.OrgId), tooBig)
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded for a document larger than MaxBytes, got: %v", err)
+	}
+	err = assertOrgIds([]int{3, 5, 6})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// A new client evicts in the same order
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setOrg(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrgIds([]int{3, 6, 7})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCacheModeCollection(t *testing.T) {
+	client := GetClient()
+
+	// Cache mode needs a limit, and can't be combined with Capped
+	p := mockCollections["OrgLRU"]
+	p.MaxDocs = 0
+	err := client.AddCollection(p)
+	if err == nil {
+		t.Errorf("expected an error when adding a collection with an EvictionPolicy but no MaxDocs or MaxBytes")
+	}
+	p = mockCollections["OrgLRU"]
+	p.Capped = true
+	err = client.AddCollection(p)
+	if err == nil {
+		t.Errorf("expected an error when adding a collection with both Capped and an EvictionPolicy")
+	}
+
+	// Reads count as uses, so the checks are made in the order the uses are expected in
+	setOrg := func(collectionName string, id int) error {
+		return GetClient().SetStruct(collectionName, Key(id), Org{OrgId: id, Name: fmt.Sprintf("Company %d", id), Employees: id * 100})
+	}
+	getOrgs := func(collectionName string, ids ...int) error {
+		for _, id := range ids {
+			_, err := GetClient().Get(collectionName, Key(id))
+			if err != nil {
+				return fmt.Errorf("expected document %d to be there, got: %v", id, err)
+			}
+		}
+		return nil
+	}
+	assertEvicted := func(collectionName string, id int) error {
+		_, err := GetClient().Get(collectionName, Key(id))
+		if !IsNotExist(err) {
+			return fmt.Errorf("expected document %d to have been evicted, got: %v", id, err)
+		}
+		return nil
+	}
+
+	// LRU evicts the document that was used the longest ago, rather than the oldest one
+	collectionName := "OrgLRU"
+	err = client.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := 1; id <= 3; id++ {
+		err = setOrg(collectionName, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = getOrgs(collectionName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setOrg(collectionName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertEvicted(collectionName, 2)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The uses are taken from the access log by a new client
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setOrg(collectionName, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertEvicted(collectionName, 3)
+	if err != nil {
+		t.Error(err)
+	}
+	err = getOrgs(collectionName, 1, 4, 5)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// LFU evicts the document that was used the least often, and the least recently used one among those
+	collectionName = "OrgLFU"
+	err = GetClient().AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := 1; id <= 3; id++ {
+		err = setOrg(collectionName, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = getOrgs(collectionName, 1, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setOrg(collectionName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertEvicted(collectionName, 3)
+	if err != nil {
+		t.Error(err)
+	}
+	err = setOrg(collectionName, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertEvicted(collectionName, 4)
+	if err != nil {
+		t.Error(err)
+	}
+	err = getOrgs(collectionName, 1, 2, 5)
+	if err != nil {
+		t.Error(err)
+	}
+	stats, err := GetClient().CollectionStats(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumDocuments != 3 {
+		t.Errorf("expected 3 documents in the stats, got %d", stats.NumDocuments)
+	}
+}
+
+type mockSyncCursor struct {
+	Cursor   string
+	SyncedAt time.Time
+}
+
+func TestCollectionMeta(t *testing.T) {
+	collectionName := "OrgMeta"
+	cloneName := "OrgMetaCloned"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var version int
+	err = client.GetCollectionMeta(collectionName, "schema", &version)
+	if !errors.Is(err, ErrMetaIsNotExist) {
+		t.Errorf("expected ErrMetaIsNotExist before any meta is set, got: %v", err)
+	}
+	err = client.SetCollectionMeta(collectionName, "../schema", 1)
+	if !errors.Is(err, ErrInvalidMetaName) {
+		t.Errorf("expected ErrInvalidMetaName for a name with a path separator, got: %v", err)
+	}
+
+	cursor := mockSyncCursor{Cursor: "abc123", SyncedAt: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	err = client.SetCollectionMeta(collectionName, "schema", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SetCollectionMeta(collectionName, "schema", 2) // replaces the first one
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SetCollectionMeta(collectionName, "sync.cursor", cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertMeta := func(collectionName string) error {
+		names, err := GetClient().ListCollectionMeta(collectionName)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(names, []string{"schema", "sync.cursor"}) {
+			return fmt.Errorf("expected the meta entries schema and sync.cursor, got %v", names)
+		}
+		var version int
+		err = GetClient().GetCollectionMeta(collectionName, "schema", &version)
+		if err != nil {
+			return err
+		}
+		if version != 2 {
+			return fmt.Errorf("expected schema version 2, got %d", version)
+		}
+		var fetched mockSyncCursor
+		err = GetClient().GetCollectionMeta(collectionName, "sync.cursor", &fetched)
+		if err != nil {
+			return err
+		}
+		if fetched.Cursor != cursor.Cursor || !fetched.SyncedAt.Equal(cursor.SyncedAt) {
+			return fmt.Errorf("expected sync cursor %+v, got %+v", cursor, fetched)
+		}
+		return nil
+	}
+	err = assertMeta(collectionName)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The meta goes along with the collection
+	err = client.CloneCollection(collectionName, cloneName, CloneOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertMeta(cloneName)
+	if err != nil {
+		t.Error(err)
+	}
+	err = client.RemoveCollection(cloneName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	props := mockCollections[collectionName]
+	props.NumPartitions = 2
+	err = client.AlterCollection(collectionName, props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertMeta(collectionName)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertMeta(collectionName)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Deleting
+	err = GetClient().DeleteCollectionMeta(collectionName, "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = GetClient().GetCollectionMeta(collectionName, "schema", &version)
+	if !errors.Is(err, ErrMetaIsNotExist) {
+		t.Errorf("expected ErrMetaIsNotExist for a deleted meta entry, got: %v", err)
+	}
+	err = GetClient().DeleteCollectionMeta(collectionName, "schema")
+	if !errors.Is(err, ErrMetaIsNotExist) {
+		t.Errorf("expected ErrMetaIsNotExist when deleting a deleted meta entry, got: %v", err)
+	}
+}
+
+func TestExportCollection(t *testing.T) {
+	collectionName := "OrgExport"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.ExportCollection(collectionName, ioutil.Discard, ExportFormat(10))
+	if err != ErrInvalidExportFormat {
+		t.Errorf("expected ErrInvalidExportFormat, got: %v", err)
+	}
+
+	// JSONL: documents that can be expressed as JSON are
+	var buf bytes.Buffer
+	err = client.ExportCollection(collectionName, &buf, EXPORT_FORMAT_JSONL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(mockOrgs) {
+		t.Fatalf("expected %d lines in the export, got %d: %s", len(mockOrgs), len(lines), buf.String())
+	}
+	exported := make(map[Key]Org)
+	for _, line := range lines {
+		var r ExportRecord
+		err = json.Unmarshal([]byte(line), &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var org Org
+		err = json.Unmarshal(r.Doc, &org)
+		if err != nil {
+			t.Fatalf("expected the document to be exported as JSON, got %s: %s", line, err)
+		}
+		exported[Key(r.Key)] = org
+	}
+	for _, org := range mockOrgs {
+		if exported[Key(org.OrgId)] != org {
+			t.Errorf("expected %+v to be exported, got %+v", org, exported[Key(org.OrgId)])
+		}
+	}
+
+	// and the others are exported as their data
+	buf.Reset()
+	err = client.ExportCollection("Blob", &buf, EXPORT_FORMAT_JSONL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := client.CollectionStats("Blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(&buf)
+	var numExported int
+	for dec.More() {
+		var r ExportRecord
+		err = dec.Decode(&r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := client.Get("Blob", Key(r.Key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Doc != nil || !bytes.Equal(r.Data, data) {
+			t.Errorf("expected document %d to be exported as its data", r.Key)
+		}
+		numExported++
+	}
+	if numExported != stats.NumDocuments {
+		t.Errorf("expected %d documents to be exported, got %d", stats.NumDocuments, numExported)
+	}
+
+	// Tar
+	buf.Reset()
+	err = client.ExportCollection(collectionName, &buf, EXPORT_FORMAT_TAR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&buf)
+	numExported = 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(hdr.Name, strings.ToLower(collectionName)+"/"), ".msgpack"))
+		if err != nil {
+			t.Fatalf("unexpected file in the export: %s", hdr.Name)
+		}
+		expected, err := client.Get(collectionName, Key(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("expected %s to have the data of document %d", hdr.Name, id)
+		}
+		numExported++
+	}
+	if numExported != len(mockOrgs) {
+		t.Errorf("expected %d files in the export, got %d", len(mockOrgs), numExported)
+	}
+}
+
+func TestImportCollection(t *testing.T) {
+	collectionName := "OrgImport"
+	client := GetClient()
+
+	err := client.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.AddIndex(collectionName, "Employees")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.ImportCollection(collectionName, strings.NewReader(""), ImportOptions{Format: ImportFormat(10)})
+	if err != ErrInvalidImportFormat {
+		t.Errorf("expected ErrInvalidImportFormat, got: %v", err)
+	}
+
+	assertImportResult := func(result ImportResult, numImported int, errorLines []int) error {
+		if result.NumImported != numImported {
+			return fmt.Errorf("expected %d documents to be imported, got %d", numImported, result.NumImported)
+		}
+		var lines []int
+		for _, e := range result.Errors {
+			lines = append(lines, e.Line)
+		}
+		if !reflect.DeepEqual(lines, errorLines) {
+			return fmt.Errorf("expected errors for lines %v, got %v", errorLines, result.Errors)
+		}
+		return nil
+	}
+
+	// JSONL, with the keys taken from a field. Bad lines are reported, and don't stop the import.
+	var jsonl bytes.Buffer
+	for _, org := range mockOrgs {
+		json.NewEncoder(&jsonl).Encode(org)
+	}
+	jsonl.WriteString("{\"OrgId\": 3, \"Name\": \n")
+	jsonl.WriteString("{\"Name\": \"Company without id\"}\n")
+	jsonl.WriteString("\n")
+	jsonl.WriteString("[1, 2]\n")
+	result, err := client.ImportCollection(collectionName, &jsonl, ImportOptions{Format: IMPORT_FORMAT_JSONL, KeyField: "OrgId"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertImportResult(result, 2, []int{3, 4, 6})
+	if err != nil {
+		t.Error(err)
+	}
+	for _, org := range mockOrgs {
+		err = assertOrg(collectionName, org)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	resp, err := client.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// CSV, with generated keys following on from the existing ones
+	csvData := "Name,Employees\nCompany C,50\nCompany D,60,extra\n\"Company, E\",70\n"
+	result, err = client.ImportCollection(collectionName, strings.NewReader(csvData), ImportOptions{Format: IMPORT_FORMAT_CSV})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertImportResult(result, 2, []int{3})
+	if err != nil {
+		t.Error(err)
+	}
+	for _, org := range []Org{{OrgId: 3, Name: "Company C", Employees: 50}, {OrgId: 4, Name: "Company, E", Employees: 70}} {
+		var fetched Org
+		err = client.GetStruct(collectionName, Key(org.OrgId), &fetched)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fetched.OrgId = org.OrgId
+		if fetched != org {
+			t.Errorf("expected %+v to be imported, got %+v", org, fetched)
+		}
+	}
+	resp, err = client.Search(collectionName, "Employees:70")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{"Company, E"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Documents that don't decode into DocType are not imported
+	jsonl.Reset()
+	jsonl.WriteString("{\"OrgId\": 5, \"Name\": \"Company F\", \"Employees\": \"many\"}\n")
+	result, err = client.ImportCollection(collectionName, &jsonl, ImportOptions{Format: IMPORT_FORMAT_JSONL, KeyField: "OrgId", DocType: Org{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertImportResult(result, 0, []int{1})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// What is exported can be imported, keys included, into a collection with another encoding
+	jsonl.Reset()
+	err = client.ExportCollection("OrgExport", &jsonl, EXPORT_FORMAT_JSONL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := mockOrgs[0]
+	changed.Employees = 150
+	err = client.SetStruct(collectionName, Key(changed.OrgId), changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = client.ImportCollection(collectionName, &jsonl, ImportOptions{Format: IMPORT_FORMAT_EXPORT_JSONL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertImportResult(result, len(mockOrgs), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	err = assertOrg(collectionName, mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectionAliases(t *testing.T) {
+	client := GetClient()
+
+	for i, collectionName := range []string{"OrgRollover1", "OrgRollover2"} {
+		err := client.AddCollection(mockCollections[collectionName])
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.SetStruct(collectionName, Key(mockOrgs[i].OrgId), mockOrgs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := client.AddAlias("OrgCurrent", "NoSuchCollection")
+	if err != ErrCollectionIsNotExist {
+		t.Errorf("expected ErrCollectionIsNotExist for an alias of a collection that doesn't exist, got: %v", err)
+	}
+	err = client.AddAlias("Org", "OrgRollover1")
+	if err != ErrCollectionIsExist {
+		t.Errorf("expected ErrCollectionIsExist for an alias with the name of a collection, got: %v", err)
+	}
+
+	// An alias can be used in place of the name of the collection
+	err = client.AddAlias("OrgCurrent", "OrgRollover1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrg("OrgCurrent", mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+	p := mockCollections["OrgRollover1"]
+	p.Name = "OrgCurrent"
+	err = client.AddCollection(p)
+	if err != ErrAliasIsExist {
+		t.Errorf("expected ErrAliasIsExist for a collection with the name of an alias, got: %v", err)
+	}
+
+	// and swapped over to another collection
+	err = client.AddAlias("OrgCurrent", "OrgRollover2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrg("OrgCurrent", mockOrgs[1])
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = client.Get("OrgCurrent", Key(mockOrgs[0].OrgId))
+	if !IsNotExist(err) {
+		t.Errorf("expected the alias not to point to the first collection anymore, got: %v", err)
+	}
+	changed := mockOrgs[1]
+	changed.Employees = 550
+	err = client.SetStruct("OrgCurrent", Key(changed.OrgId), changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrg("OrgRollover2", changed)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// An alias of an alias points to the collection
+	err = client.AddAlias("OrgLatest", "OrgCurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedAliases := map[string]string{"orgcurrent": "orgrollover2", "orglatest": "orgrollover2"}
+	if aliases := client.GetAliases(); !reflect.DeepEqual(aliases, expectedAliases) {
+		t.Errorf("expected aliases %v, got %v", expectedAliases, aliases)
+	}
+
+	// A collection can't be removed while it has aliases
+	for _, name := range []string{"OrgRollover2", "OrgCurrent"} {
+		err = client.RemoveCollection(name)
+		if err != ErrCollectionHasAliases {
+			t.Errorf("expected ErrCollectionHasAliases when removing %s, got: %v", name, err)
+		}
+	}
+
+	// Aliases follow a renamed collection, and are saved with the client
+	err = client.RenameCollection("OrgRollover2", "OrgRolloverRenamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = GetClient()
+	expectedAliases = map[string]string{"orgcurrent": "orgrolloverrenamed", "orglatest": "orgrolloverrenamed"}
+	if aliases := client.GetAliases(); !reflect.DeepEqual(aliases, expectedAliases) {
+		t.Errorf("expected aliases %v, got %v", expectedAliases, aliases)
+	}
+	err = assertOrg("OrgLatest", changed)
+	if err != nil {
+		t.Error(err)
+	}
+	err = client.RenameCollection("OrgRolloverRenamed", "OrgRollover2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, alias := range []string{"OrgCurrent", "OrgLatest"} {
+		err = client.RemoveAlias(alias)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = client.RemoveAlias("OrgLatest")
+	if err != ErrAliasIsNotExist {
+		t.Errorf("expected ErrAliasIsNotExist when removing an alias twice, got: %v", err)
+	}
+	_, err = client.Get("OrgCurrent", Key(changed.OrgId))
+	if !errors.Is(err, ErrCollectionIsNotExist) {
+		t.Errorf("expected ErrCollectionIsNotExist for a removed alias, got: %v", err)
+	}
+	if aliases := client.GetAliases(); len(aliases) != 0 {
+		t.Errorf("expected no aliases, got %v", aliases)
+	}
+}
+
+func TestFreezeCollection(t *testing.T) {
+	collectionName := "OrgFrozen"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.FreezeCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	isFrozen, err := client.IsCollectionFrozen(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isFrozen {
+		t.Errorf("expected the collection to be frozen")
+	}
+
+	// Changes are rejected, while the collection can still be read
+	changed := mockOrgs[1]
+	changed.Employees = 600
+	err = client.SetStruct(collectionName, Key(changed.OrgId), changed)
+	if !errors.Is(err, ErrCollectionIsFrozen) {
+		t.Errorf("expected ErrCollectionIsFrozen when writing to a frozen collection, got: %v", err)
+	}
+	err = client.Delete(collectionName, Key(changed.OrgId))
+	if !errors.Is(err, ErrCollectionIsFrozen) {
+		t.Errorf("expected ErrCollectionIsFrozen when deleting from a frozen collection, got: %v", err)
+	}
+	err = client.AddIndex(collectionName, "OrgId")
+	if !errors.Is(err, ErrCollectionIsFrozen) {
+		t.Errorf("expected ErrCollectionIsFrozen when indexing a frozen collection, got: %v", err)
+	}
+	err = client.RemoveCollection(collectionName)
+	if !errors.Is(err, ErrCollectionIsFrozen) {
+		t.Errorf("expected ErrCollectionIsFrozen when removing a frozen collection, got: %v", err)
+	}
+	err = assertOrg(collectionName, mockOrgs[1])
+	if err != nil {
+		t.Error(err)
+	}
+	resp, err := client.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The other collections remain writable
+	err = client.SetStruct("OrgMeta", Key(changed.OrgId), changed)
+	if err != nil {
+		t.Errorf("expected other collections to remain writable, got: %v", err)
+	}
+	err = client.SetStruct("OrgMeta", Key(changed.OrgId), mockOrgs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The collection stays frozen across restarts
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = GetClient()
+	err = client.SetStruct(collectionName, Key(changed.OrgId), changed)
+	if !errors.Is(err, ErrCollectionIsFrozen) {
+		t.Errorf("expected ErrCollectionIsFrozen after a reload, got: %v", err)
+	}
+
+	err = client.UnfreezeCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SetStruct(collectionName, Key(changed.OrgId), changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrg(collectionName, changed)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = client.IsCollectionFrozen("OrgUnknown")
+	if !errors.Is(err, ErrCollectionIsNotExist) {
+		t.Errorf("expected ErrCollectionIsNotExist for an unknown collection, got: %v", err)
+	}
+}
+
+func TestCollectionNames(t *testing.T) {
+	client := GetClient()
+
+	// Names are checked against the default rules
+	invalidNames := []string{
+		"",
+		"o",
+		"Org_Names",
+		"Org Names",
+		"../OrgNames",
+		"tmp_orgnames",
+		"Org\u200bNames",
+		"Org\xffNames",
+		strings.Repeat("o", collection.DEFAULT_NAME_MAX_LENGTH+1),
+	}
+	for _, name := range invalidNames {
+		err := client.AddCollection(CollectionProps{Name: name, EncodingType: ENCODING_JSON})
+		if !errors.Is(err, ErrInvalidCollectionName) {
+			t.Errorf("expected ErrInvalidCollectionName when adding a collection named %q, got: %v", name, err)
+		}
+	}
+	err := client.RenameCollection("OrgFrozen", "Org-Frozen")
+	if !errors.Is(err, ErrInvalidCollectionName) {
+		t.Errorf("expected ErrInvalidCollectionName when renaming to an invalid name, got: %v", err)
+	}
+	err = client.AddAlias("Org.Frozen", "OrgFrozen")
+	if !errors.Is(err, ErrInvalidCollectionName) {
+		t.Errorf("expected ErrInvalidCollectionName for an invalid alias, got: %v", err)
+	}
+
+	// Clients can have their own rules
+	err = client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalClient = Client{}
+	defer func() {
+		globalClient = Client{}
+		err := Initialize(ClientInitOptions{
+			DocumentRoot:   documentRoot,
+			EncryptionKeys: map[string][]byte{"OrgSecret": rotatedEncryptionKey},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	err = Initialize(WithInMemory(), WithCollectionNameRules(CollectionNameRules{
+		Pattern:   regexp.MustCompile(`^[\p{L}\p{N}_-]+$`),
+		MaxLength: 12,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = GetClient()
+
+	// Lengths are counted in characters, and names are lowercased using the Unicode case mappings
+	err = client.AddCollection(CollectionProps{Name: " Événements_Ü ", EncodingType: ENCODING_JSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, err := client.IsCollectionExist("événements_ü")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Error("expected the collection to be found under its lowercased name")
+	}
+	err = client.SetStruct("ÉVÉNEMENTS_Ü", Key(mockOrgs[0].OrgId), mockOrgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrg("événements_ü", mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+
+	// A name with a decomposed "é" (an "e" and a combining accent) is the one with the composed "é"
+	err = client.AddCollection(CollectionProps{Name: "Cafe\u0301", EncodingType: ENCODING_JSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, cancel := client.Subscribe(" Cafe\u0301")
+	defer cancel()
+	exists, err = client.IsCollectionExist("caf\u00e9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Error("expected the collection to be found under its composed name")
+	}
+	err = client.SetStruct("CAF\u00c9", Key(mockOrgs[0].OrgId), mockOrgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrg("cafe\u0301", mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+	select {
+	case e := <-events:
+		if e.Collection != "caf\u00e9" || e.Key != Key(mockOrgs[0].OrgId) {
+			t.Errorf("expected the event of the write to caf\u00e9, got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected a subscription under the decomposed name to get the events of the collection")
+	}
+	err = client.AddAlias("cafes", "Cafe\u0301 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrg("cafes", mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+	err = client.RemoveAlias("cafes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptionKey, _ := getEncryptionKeysFromOptions(ClientInitOptions{EncryptionKeys: map[string][]byte{" Cafe\u0301": []byte("key")}}, "caf\u00e9")
+	if string(encryptionKey) != "key" {
+		t.Error("expected the encryption key given under the decomposed name to be found for the collection")
+	}
+
+	for _, name := range []string{"org names", "événements_2024", "org/names", "org\u200dnames"} {
+		err = client.AddCollection(CollectionProps{Name: name, EncodingType: ENCODING_JSON})
+		if !errors.Is(err, ErrInvalidCollectionName) {
+			t.Errorf("expected ErrInvalidCollectionName when adding a collection named %q, got: %v", name, err)
+		}
+	}
+}
+
+func TestLazyLoading(t *testing.T) {
+	collectionName := "OrgLazy"
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	isLoaded := func(name string) bool {
+		c := GetClient()
+		c.collections.RLock()
+		defer c.collections.RUnlock()
+		_, isLoaded := c.collections.Store[strings.ToLower(name)]
+		return isLoaded
+	}
+
+	// Collections are only loaded once they are used
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := GetClient()
+	if isLoaded(collectionName) {
+		t.Error("expected the collection not to be loaded before it is used")
+	}
+
+	// Saving the client keeps the collections that haven't been loaded
+	err = client.SetCollectionMeta("OrgMeta", "schema", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.AddAlias("OrgLazyAlias", collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = GetClient()
+
+	// A collection is loaded once, however many callers use it first
+	var wg sync.WaitGroup
+	cls := make([]*collection.Collection, 10)
+	for i := range cls {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := collectionName
+			if i%2 == 1 {
+				name = "OrgLazyAlias"
+			}
+			cl, err := client.getCollectionByName(name)
+			if err != nil {
+				t.Error(err)
+			}
+			cls[i] = cl
+		}(i)
+	}
+	wg.Wait()
+	for _, cl := range cls {
+		if cl == nil || cl != cls[0] {
+			t.Fatal("expected all the callers to get the same collection")
+		}
+	}
+	if !isLoaded(collectionName) {
+		t.Error("expected the collection to be loaded once it has been used")
+	}
+
+	// Loaded collections work as before, including their indexes
+	resp, err := client.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+	if err != nil {
+		t.Error(err)
+	}
+	err = assertOrg(collectionName, mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveAlias("OrgLazyAlias")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDocumentExpiration(t *testing.T) {
+	collectionName := "OrgExpiring"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.SetStructWithTTL(collectionName, Key(mockOrgs[1].OrgId), mockOrgs[1], 0)
+	if !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("expected ErrInvalidTTL for a TTL of 0, got: %v", err)
+	}
+
+	// The expiration time is saved, and survives a reload
+	err = client.SetStructWithTTL(collectionName, Key(mockOrgs[1].OrgId), mockOrgs[1], time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt, err := client.GetExpiry(collectionName, Key(mockOrgs[1].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiresAt.Before(time.Now().Add(59 * time.Minute)) {
+		t.Errorf("expected the document to expire in an hour, got: %s", expiresAt)
+	}
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = GetClient()
+	reloadedExpiresAt, err := client.GetExpiry(collectionName, Key(mockOrgs[1].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloadedExpiresAt.Equal(expiresAt) {
+		t.Errorf("expected the expiration time %s to survive a reload, got: %s", expiresAt, reloadedExpiresAt)
+	}
+
+	// Writing the document without a TTL makes it not expire
+	err = client.SetStruct(collectionName, Key(mockOrgs[1].OrgId), mockOrgs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt, err = client.GetExpiry(collectionName, Key(mockOrgs[1].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiresAt.IsZero() {
+		t.Errorf("expected the document to not expire once written without a TTL, got: %s", expiresAt)
+	}
+
+	// The background reaper deletes the document once it has expired, along with its index entries
+	err = client.SetStructWithTTL(collectionName, Key(mockOrgs[1].OrgId), mockOrgs[1], 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		stats, err := client.GetReapStats(collectionName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.NumReaped > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = client.Get(collectionName, Key(mockOrgs[1].OrgId))
+	if !IsNotExist(err) {
+		t.Fatalf("expected the expired document to be deleted by the reaper, got: %v", err)
+	}
+	resp, err := client.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 0, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	expiresAt, err = client.GetExpiry(collectionName, Key(mockOrgs[1].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiresAt.IsZero() {
+		t.Errorf("expected the expiration time of a reaped document to be cleared, got: %s", expiresAt)
+	}
+
+	// The documents without a TTL are left alone
+	err = assertOrg(collectionName, mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+	n, err := client.ReapExpired(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("expected no documents left to reap, got: %d", n)
+	}
+
+	stats, err := client.GetReapStats(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumReaped != 1 || stats.NumErrors != 0 || stats.LastRunAt.IsZero() {
+		t.Errorf("unexpected reap stats: %+v", stats)
+	}
+}
+
+func TestByteBudget(t *testing.T) {
+	dirPath, err := os.MkdirTemp("", "gofiledb_budget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	err = GetClient().Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalClient = Client{}
+	defer func() {
+		GetClient().Close()
+		globalClient = Client{}
+		err := Initialize(ClientInitOptions{
+			DocumentRoot:   documentRoot,
+			EncryptionKeys: map[string][]byte{"OrgSecret": rotatedEncryptionKey},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Fill an evictable collection and one that isn't with documents of about 1KB each
+	err = Initialize(WithDocumentRoot(dirPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetClient().EnforceByteBudget()
+	if !errors.Is(err, ErrByteBudgetNotSet) {
+		t.Errorf("expected ErrByteBudgetNotSet for a client without a ByteBudget, got: %v", err)
+	}
+	for _, p := range []CollectionProps{
+		{Name: "OrgEvictable", EncodingType: ENCODING_JSON, Evictable: true, EvictionPolicy: EVICTION_POLICY_LRU},
+		{Name: "OrgKept", EncodingType: ENCODING_JSON},
+	} {
+		err = GetClient().AddCollection(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for id := 1; id <= 10; id++ {
+			err = GetClient().SetStruct(p.Name, Key(id), Org{OrgId: id, Name: strings.Repeat("A", 1000)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	_, err = GetClient().Get("OrgEvictable", Key(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetClient().Get("OrgEvictable", Key(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := GetClient().getWarehouseSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = GetClient().Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalClient = Client{}
+
+	// Going over the budget evicts the least recently used documents of the evictable collection, in the background
+	var events []ByteBudgetEviction
+	var eventsLock sync.Mutex
+	budget := size - 4500
+	err = Initialize(ClientInitOptions{
+		DocumentRoot:            dirPath,
+		ByteBudget:              budget,
+		ByteBudgetCheckInterval: 20 * time.Millisecond,
+		ByteBudgetHandler: func(e ByteBudgetEviction) {
+			eventsLock.Lock()
+			events = append(events, e)
+			eventsLock.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := GetClient()
+	_, err = client.Get("OrgEvictable", Key(1)) // loads the collection
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats ByteBudgetStats
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		stats, err = client.GetByteBudgetStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.NumEvicted > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats.NumEvicted == 0 || stats.NumOverBudget == 0 || stats.NumEvictedBytes == 0 {
+		t.Fatalf("expected documents to have been evicted, got stats: %+v", stats)
+	}
+	if stats.ByteBudget != budget || stats.UsedBytes > budget {
+		t.Errorf("expected the warehouse to be within its budget of %d bytes, got stats: %+v", budget, stats)
+	}
+
+	_, err = client.Get("OrgEvictable", Key(3))
+	if !IsNotExist(err) {
+		t.Errorf("expected the least recently used document to have been evicted, got: %v", err)
+	}
+	for _, id := range []int{1, 2, 10} {
+		_, err = client.Get("OrgEvictable", Key(id))
+		if err != nil {
+			t.Errorf("expected document %d to have been kept, got: %v", id, err)
+		}
+	}
+	for id := 1; id <= 10; id++ {
+		_, err = client.Get("OrgKept", Key(id))
+		if err != nil {
+			t.Errorf("expected the documents of a collection that isn't evictable to be kept, got: %v", err)
+		}
+	}
+
+	// Within the budget, nothing is evicted. This also waits for the background check to be done.
+	n, err := client.EnforceByteBudget()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("expected nothing to be evicted within the budget, got: %d", n)
+	}
+
+	eventsLock.Lock()
+	if len(events) != 1 || events[0].Collection != "orgevictable" || int64(events[0].NumEvicted) != stats.NumEvicted {
+		t.Errorf("expected one eviction event for the evictable collection, got: %+v", events)
+	}
+	eventsLock.Unlock()
+}
+
+func TestTouch(t *testing.T) {
+	collectionName := "OrgExpiring"
+	client := GetClient()
+
+	err := client.Touch(collectionName, Key(12345), time.Hour)
+	if !IsNotExist(err) {
+		t.Errorf("expected a not exist error when touching a document that doesn't exist, got: %v", err)
+	}
+	err = client.Touch(collectionName, Key(mockOrgs[0].OrgId), 0)
+	if !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("expected ErrInvalidTTL for a TTL of 0, got: %v", err)
+	}
+
+	// Touching a document gives it a TTL, and leaves its data as it is
+	err = client.Touch(collectionName, Key(mockOrgs[0].OrgId), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt, err := client.GetExpiry(collectionName, Key(mockOrgs[0].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiresAt.Before(time.Now().Add(59 * time.Minute)) {
+		t.Errorf("expected the document to expire in an hour, got: %s", expiresAt)
+	}
+	err = assertOrg(collectionName, mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+
+	// A document that keeps being touched outlives its original TTL
+	err = client.SetStructWithTTL(collectionName, Key(mockOrgs[1].OrgId), mockOrgs[1], 150*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		err = client.Touch(collectionName, Key(mockOrgs[1].OrgId), 150*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = assertOrg(collectionName, mockOrgs[1])
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Once it isn't touched anymore, it expires
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err = client.Get(collectionName, Key(mockOrgs[1].OrgId))
+		if IsNotExist(err) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !IsNotExist(err) {
+		t.Errorf("expected the document to expire once it isn't touched anymore, got: %v", err)
+	}
+
+	// Writing the document again clears its TTL
+	err = client.SetStruct(collectionName, Key(mockOrgs[0].OrgId), mockOrgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpiredDocumentFiltering(t *testing.T) {
+	collectionName := "OrgExpiringUnreaped"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SetStructWithTTL(collectionName, Key(mockOrgs[1].OrgId), mockOrgs[1], 30*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Without a reaper, the expired document is still on disk, but can't be read or found anymore
+	time.Sleep(50 * time.Millisecond)
+	_, err = client.Get(collectionName, Key(mockOrgs[1].OrgId))
+	if !IsNotExist(err) {
+		t.Errorf("expected a not exist error when getting an expired document, got: %v", err)
+	}
+	var org Org
+	err = client.GetStruct(collectionName, Key(mockOrgs[1].OrgId), &org)
+	if !IsNotExist(err) {
+		t.Errorf("expected a not exist error when getting an expired document as a struct, got: %v", err)
+	}
+	resp, err = client.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 0, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	err = assertOrg(collectionName, mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Once it is reaped, the document can be written again
+	n, err := client.ReapExpired(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected the expired document to be reaped, got: %d", n)
+	}
+	err = client.SetStruct(collectionName, Key(mockOrgs[1].OrgId), mockOrgs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrg(collectionName, mockOrgs[1])
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	collectionName := "OrgCached"
+	client := GetClient()
+	ctx := context.Background()
+	k := Key(1)
+
+	err := client.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = client.GetStaleWhileRevalidate(ctx, collectionName, k)
+	if !errors.Is(err, ErrLoaderNotSet) {
+		t.Errorf("expected ErrLoaderNotSet without a loader, got: %v", err)
+	}
+
+	// Every load gives a new number of employees. While isBlocked is set, loads wait for release.
+	var numLoads, isBlocked int32
+	release := make(chan struct{})
+	err = client.RegisterLoader(collectionName, func(ctx context.Context, k Key) ([]byte, error) {
+		n := atomic.AddInt32(&numLoads, 1)
+		if atomic.LoadInt32(&isBlocked) == 1 {
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		return json.Marshal(Org{OrgId: int(k), Name: "Cached", Employees: 1000 + int(n)})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEmployees := func(data []byte, expected int) error {
+		var org Org
+		err := json.Unmarshal(data, &org)
+		if err != nil {
+			return err
+		}
+		if org.Employees != expected {
+			return fmt.Errorf("expected %d employees, got %d", expected, org.Employees)
+		}
+		return nil
+	}
+	waitForEmployees := func(expected int) error {
+		var data []byte
+		var err error
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			data, err = client.Get(collectionName, k)
+			if err == nil && assertEmployees(data, expected) == nil {
+				return nil
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			return err
+		}
+		return assertEmployees(data, expected)
+	}
+
+	// A missing document is loaded right away, and is then fresh until its SoftTTL
+	data, isStale, err := client.GetStaleWhileRevalidate(ctx, collectionName, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isStale {
+		t.Errorf("expected a loaded document not to be stale")
+	}
+	err = assertEmployees(data, 1001)
+	if err != nil {
+		t.Error(err)
+	}
+	data, isStale, err = client.GetStaleWhileRevalidate(ctx, collectionName, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isStale || atomic.LoadInt32(&numLoads) != 1 {
+		t.Errorf("expected a fresh document to be returned without loading it, stale: %t, loads: %d", isStale, numLoads)
+	}
+
+	// Past its SoftTTL, the stale document is returned right away, and refreshed once in the background
+	time.Sleep(60 * time.Millisecond)
+	atomic.StoreInt32(&isBlocked, 1)
+	for i := 0; i < 3; i++ {
+		data, isStale, err = client.GetStaleWhileRevalidate(ctx, collectionName, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isStale {
+			t.Errorf("expected the document to be stale")
+		}
+		err = assertEmployees(data, 1001)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	release <- struct{}{}
+	err = waitForEmployees(1002)
+	if err != nil {
+		t.Error(err)
+	}
+	if n := atomic.LoadInt32(&numLoads); n != 2 {
+		t.Errorf("expected the document to be refreshed once, got %d loads", n)
+	}
+
+	// A write made while a refresh is in progress wins over the refreshed data
+	time.Sleep(60 * time.Millisecond)
+	_, isStale, err = client.GetStaleWhileRevalidate(ctx, collectionName, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isStale {
+		t.Errorf("expected the document to be stale")
+	}
+	err = client.SetStruct(collectionName, k, Org{OrgId: int(k), Name: "Cached", Employees: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release <- struct{}{}
+	err = reloadClient() // waits for the refresh
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = GetClient()
+	data, err = client.Get(collectionName, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertEmployees(data, 5)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dirPath, err := os.MkdirTemp("", "gofiledb_backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	err = GetClient().Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalClient = Client{}
+	defer func() {
+		GetClient().Close()
+		globalClient = Client{}
+		err := Initialize(ClientInitOptions{
+			DocumentRoot:   documentRoot,
+			EncryptionKeys: map[string][]byte{"OrgSecret": rotatedEncryptionKey},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	warehousePath := util.JoinPath(dirPath, "warehouse")
+	err = os.Mkdir(warehousePath, util.DIR_PERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Initialize(WithDocumentRoot(warehousePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := GetClient()
+	collectionName := "OrgBackup"
+	err = client.AddCollection(CollectionProps{Name: collectionName, EncodingType: ENCODING_JSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.AddIndex(collectionName, "Employees")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, org := range mockOrgs {
+		err = client.SetStruct(collectionName, Key(org.OrgId), org)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := client.DB("tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddCollection(CollectionProps{Name: collectionName, EncodingType: ENCODING_JSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetStruct(collectionName, Key(mockOrgs[0].OrgId), mockOrgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Snapshot(collectionName, "before_backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes go on during the backup
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for id := 100; ; id++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			err := client.SetStruct(collectionName, Key(id), Org{OrgId: id, Name: "Company X", Employees: id})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	var buf bytes.Buffer
+	err = client.Backup(&buf)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SetStruct(collectionName, Key(99), Org{OrgId: 99, Name: "Company Y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	warehouseDirPath := client.getDocumentRoot()
+	err = client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalClient = Client{}
+	backupReport, err := VerifyBackup(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !backupReport.IsRestorable() || backupReport.NumCollections != 2 {
+		t.Errorf("expected the backup of the warehouse and its database to be restorable, got %+v", backupReport)
+	}
+
+	// Restore the backup in place of the warehouse, which leaves out the snapshots and the writes made since
+	err = os.RemoveAll(warehouseDirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := extractTarGz(&buf, warehousePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if strings.Contains(name, "/"+SNAPSHOTS_DIR_NAME+"/") || strings.Contains(name, collection.TEMP_FILE_PREFIX) {
+			t.Errorf("expected %s to be left out of the backup", name)
+		}
+	}
+	err = Initialize(WithDocumentRoot(warehousePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = GetClient()
+	_, err = client.Get(collectionName, Key(99))
+	if !IsNotExist(err) {
+		t.Errorf("expected a document written after the backup not to be in it, got: %v", err)
+	}
+	for _, org := range mockOrgs {
+		err = assertOrg(collectionName, org)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	resp, err := client.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+	if err != nil {
+		t.Error(err)
+	}
+	report, err := client.Verify(collectionName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) > 0 {
+		t.Errorf("expected the backup of collection %s to be consistent, got problems: %+v", collectionName, report.Problems)
+	}
+	db, err = client.DB("tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var org Org
+	err = db.GetStruct(collectionName, Key(mockOrgs[0].OrgId), &org)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if org != mockOrgs[0] {
+		t.Errorf("expected the database to be in the backup with %+v, got %+v", mockOrgs[0], org)
+	}
+	snapshots, err := client.ListSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 0 {
+		t.Errorf("expected no snapshots in the backup, got %d", len(snapshots))
+	}
+
+	// The backup of a single collection can be restored like a snapshot
+	buf.Reset()
+	err = client.BackupCollection(collectionName, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collectionBackupPath := util.JoinPath(dirPath, "collection")
+	_, err = extractTarGz(&buf, collectionBackupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := collection.RestoreSnapshot(collectionBackupPath, util.JoinPath(dirPath, "restored_collection"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl.Name != strings.ToLower(collectionName) {
+		t.Errorf("expected the backup to be of collection %s, got %s", collectionName, cl.Name)
+	}
+	err = client.BackupCollection("OrgNotExist", &buf)
+	if err != collection.ErrCollectionIsNotExist {
+		t.Errorf("expected ErrCollectionIsNotExist for a collection that doesn't exist, got: %v", err)
+	}
+}
+
+func TestRestoreToTime(t *testing.T) {
+	collectionName := "OrgPITR"
+	snapshotName := "pitr-base"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Snapshot(collectionName, snapshotName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := mockOrgs[0]
+	changed.Employees = 150
+	err = client.SetStruct(collectionName, Key(changed.OrgId), changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The WAL is moved into the WAL history when the collection is loaded again
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = GetClient()
+	time.Sleep(5 * time.Millisecond)
+	restoreAt := time.Now()
+	time.Sleep(5 * time.Millisecond)
+
+	// The mistakes to undo
+	err = client.Delete(collectionName, Key(mockOrgs[1].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SetStruct(collectionName, Key(3), Org{OrgId: 3, Name: "Company C", Employees: 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.RestoreToTime(collectionName, restoreAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, org := range []Org{changed, mockOrgs[1]} {
+		err = assertOrg(collectionName, org)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	_, err = client.Get(collectionName, Key(3))
+	if !IsNotExist(err) {
+		t.Errorf("expected a document written after the time restored to not to exist, got: %v", err)
+	}
+	resp, err := client.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The ops replayed by the restore are in the new WAL history, so the collection can be restored again
+	time.Sleep(5 * time.Millisecond)
+	restoreAt = time.Now()
+	time.Sleep(5 * time.Millisecond)
+	err = client.Delete(collectionName, Key(changed.OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.RestoreToTime(collectionName, restoreAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrg(collectionName, changed)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RestoreToTime(collectionName, time.Now().Add(-time.Hour))
+	if err != ErrNoSnapshotBeforeTime {
+		t.Errorf("expected ErrNoSnapshotBeforeTime for a time before the first snapshot, got: %v", err)
+	}
+	err = client.RestoreToTime("Org", time.Now())
+	if err != ErrWALNotRetained {
+		t.Errorf("expected ErrWALNotRetained for a collection without RetainWAL, got: %v", err)
+	}
+
+	err = client.DeleteSnapshot(snapshotName)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChangeFeed(t *testing.T) {
+	collectionName := "OrgChangeFeed"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	since, err := client.GetLastChangeSeq(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if since == 0 {
+		t.Fatal("expected the documents set by assertEncodedCollection to be in the change feed")
+	}
+
+	err = client.Delete(collectionName, Key(mockOrgs[0].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SetStruct(collectionName, Key(mockOrgs[0].OrgId), mockOrgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertChanges(collectionName, since, []Change{
+		{Seq: since + 1, Op: AUDIT_OP_DELETE, Key: key.Key(mockOrgs[0].OrgId)},
+		{Seq: since + 2, Op: AUDIT_OP_SET, Key: key.Key(mockOrgs[0].OrgId)},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The feed, and its sequence numbers, carry on after a restart
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = GetClient()
+	err = client.Delete(collectionName, Key(mockOrgs[1].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertChanges(collectionName, since+1, []Change{
+		{Seq: since + 2, Op: AUDIT_OP_SET, Key: key.Key(mockOrgs[0].OrgId)},
+		{Seq: since + 3, Op: AUDIT_OP_DELETE, Key: key.Key(mockOrgs[1].OrgId)},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	last, err := client.GetLastChangeSeq(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != since+3 {
+		t.Errorf("expected the last change to have sequence number %d, got %d", since+3, last)
+	}
+	err = assertChanges(collectionName, last, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = client.Changes("Org", 0)
+	if err != ErrChangeFeedNotEnabled {
+		t.Errorf("expected ErrChangeFeedNotEnabled for a collection without EnableChangeFeed, got: %v", err)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	collectionName := "OrgReplicated"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.ServeReplication(l, ReplicationOptions{})
+	if err != ErrReplicationIsNotAuthenticated {
+		t.Fatalf("expected ErrReplicationIsNotAuthenticated without a way to authenticate the followers, got: %v", err)
+	}
+	opts := ReplicationOptions{Secret: []byte("replication secret")}
+	served := make(chan error, 1)
+	go func() { served <- client.ServeReplication(l, opts) }()
+	addr := l.Addr().String()
+
+	follower, err := client.DB("replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	follow := func() (context.CancelFunc, chan error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- follower.Follow(ctx, addr, collectionName, opts) }()
+		return cancel, done
+	}
+
+	// The full sync creates the collection on the follower
+	cancel, done := follow()
+	for _, org := range mockOrgs {
+		org := org
+		err = awaitReplicated(follower, collectionName, Key(org.OrgId), &org)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Changes are applied as they are made
+	err = client.Delete(collectionName, Key(mockOrgs[0].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := Org{OrgId: 3, Name: "Company C", Employees: 300}
+	err = client.SetStruct(collectionName, Key(added.OrgId), added)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = awaitReplicated(follower, collectionName, Key(mockOrgs[0].OrgId), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	err = awaitReplicated(follower, collectionName, Key(added.OrgId), &added)
+	if err != nil {
+		t.Error(err)
+	}
+	cancel()
+	err = <-done
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled once following is cancelled, got: %v", err)
+	}
+
+	// Following again carries on from the last change applied, without a full sync, which would delete the stray document
+	stray := Org{OrgId: 99, Name: "Stray", Employees: 1}
+	err = follower.SetStruct(collectionName, Key(stray.OrgId), stray)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missed := Org{OrgId: 4, Name: "Company D", Employees: 400}
+	err = client.SetStruct(collectionName, Key(missed.OrgId), missed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel, done = follow()
+	err = awaitReplicated(follower, collectionName, Key(missed.OrgId), &missed)
+	if err != nil {
+		t.Error(err)
+	}
+	err = assertOrgIn(follower, collectionName, stray)
+	if err != nil {
+		t.Errorf("expected the follower to resume without a full sync: %v", err)
+	}
+	cancel()
+	<-done
+
+	err = follower.Follow(context.Background(), addr, "Org", opts)
+	if err != ErrChangeFeedNotEnabled {
+		t.Errorf("expected ErrChangeFeedNotEnabled for a collection without EnableChangeFeed, got: %v", err)
+	}
+	err = follower.Follow(context.Background(), addr, collectionName, ReplicationOptions{Secret: []byte("wrong")})
+	if err != ErrReplicationIsUnauthorized {
+		t.Errorf("expected ErrReplicationIsUnauthorized for a follower with the wrong secret, got: %v", err)
+	}
+
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-served
+	if err != nil {
+		t.Errorf("expected ServeReplication to return nil once the listener is closed, got: %v", err)
+	}
+	err = client.RemoveDB("replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With mTLS, only the followers with a client certificate that the leader trusts are served
+	serverTLS, clientTLS, err := newTestTLSConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverTLS.ClientAuth = tls.RequireAndVerifyClientCert
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { served <- client.ServeReplication(l, ReplicationOptions{TLSConfig: serverTLS}) }()
+	addr = l.Addr().String()
+	follower, err = client.DB("replica_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = ReplicationOptions{TLSConfig: clientTLS}
+	cancel, done = follow()
+	err = awaitReplicated(follower, collectionName, Key(added.OrgId), &added)
+	if err != nil {
+		t.Error(err)
+	}
+	cancel()
+	<-done
+	noCert := clientTLS.Clone()
+	noCert.Certificates = nil
+	ctx, cancelNoCert := context.WithTimeout(context.Background(), 5*time.Second)
+	err = follower.followOnce(ctx, addr, "Org", ReplicationOptions{TLSConfig: noCert})
+	cancelNoCert()
+	if err == nil || errors.Is(err, ErrChangeFeedNotEnabled) {
+		t.Errorf("expected a follower without a client certificate to be refused, got: %v", err)
+	}
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-served
+	if err != nil {
+		t.Errorf("expected ServeReplication with TLS to return nil once the listener is closed, got: %v", err)
+	}
+	err = client.RemoveDB("replica_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestObjectStoreSync(t *testing.T) {
+	collectionName := "OrgObjectStore"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := newMockS3Bucket("backups")
+	srv := httptest.NewServer(bucket)
+	defer srv.Close()
+	cfg := ObjectStoreConfig{
+		Store: NewS3ObjectStore(S3Options{
+			Endpoint:        srv.URL,
+			Region:          "us-east-1",
+			Bucket:          "backups",
+			AccessKeyID:     "AKIDEXAMPLE",
+			SecretAccessKey: "secret",
+		}),
+		Prefix:      "gofiledb/",
+		Collections: []string{collectionName},
+	}
+	docName := func(k int) string {
+		return fmt.Sprintf("gofiledb/orgobjectstore/docs/%d", k)
+	}
+
+	// The first sync uploads every document
+	err = cfg.Store.PutObject(context.Background(), docName(99), []byte("stale"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SyncToObjectStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, org := range mockOrgs {
+		if !bucket.has(docName(org.OrgId)) {
+			t.Errorf("expected document %d to be uploaded by the first sync", org.OrgId)
+		}
+	}
+	if bucket.has(docName(99)) {
+		t.Error("expected a document that the collection doesn't have to be removed from the store")
+	}
+
+	// Later syncs only upload the changes
+	err = client.Delete(collectionName, Key(mockOrgs[0].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := Org{OrgId: 3, Name: "Company C", Employees: 300}
+	err = client.SetStruct(collectionName, Key(added.OrgId), added)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numPuts := bucket.getNumPuts()
+	err = client.SyncToObjectStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bucket.getNumPuts() - numPuts; n != 3 { // the props, the added document and the cursor
+		t.Errorf("expected a sync of one added document to upload 3 objects, got %d", n)
+	}
+	if bucket.has(docName(mockOrgs[0].OrgId)) || !bucket.has(docName(added.OrgId)) {
+		t.Error("expected the deleted document to be removed from the store and the added one to be uploaded")
+	}
+
+	db, err := client.DB("objectstore_restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RestoreFromObjectStore(ObjectStoreConfig{Store: cfg.Store, Prefix: cfg.Prefix})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, org := range []Org{mockOrgs[1], added} {
+		err = assertOrgIn(db, collectionName, org)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	_, err = db.Get(collectionName, Key(mockOrgs[0].OrgId))
+	if !IsNotExist(err) {
+		t.Errorf("expected a document deleted before the sync to not be restored, got: %v", err)
+	}
+
+	// The restored collection is recorded as synced, so syncing it again only uploads the props and the cursor
+	numPuts = bucket.getNumPuts()
+	err = db.SyncToObjectStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bucket.getNumPuts() - numPuts; n != 2 {
+		t.Errorf("expected a sync right after a restore to upload 2 objects, got %d", n)
+	}
+	err = client.RemoveDB("objectstore_restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Encrypted documents are uploaded as they are stored, and restored byte for byte
+	secretName := "OrgObjectStoreSecret"
+	props := mockCollections["OrgSecret"]
+	props.Name = secretName
+	err = client.AddCollection(props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.RemoveCollection(secretName)
+	err = client.SetStruct(secretName, Key(mockOrgs[0].OrgId), mockOrgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretCfg := ObjectStoreConfig{Store: cfg.Store, Prefix: cfg.Prefix, Collections: []string{secretName}}
+	err = client.SyncToObjectStore(secretCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := cfg.Store.GetObject(context.Background(), fmt.Sprintf("gofiledb/orgobjectstoresecret/docs/%d", mockOrgs[0].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte(mockOrgs[0].Name)) {
+		t.Error("expected an encrypted document to be uploaded encrypted")
+	}
+	changed := mockOrgs[0]
+	changed.Name = "Changed"
+	err = client.SetStruct(secretName, Key(changed.OrgId), changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.RestoreFromObjectStore(secretCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertOrg(secretName, mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = cfg.Store.GetObject(context.Background(), docName(12345))
+	if err != ErrObjectIsNotExist {
+		t.Errorf("expected ErrObjectIsNotExist for an object that doesn't exist, got: %v", err)
+	}
+}
+
+func TestContentAddressedStorage(t *testing.T) {
+	collectionName := "OrgContentAddressed"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	countBlobs := func() int {
+		var n int
+		err := util.Walk(util.OSFS{}, util.JoinPath(cl.DirPath, collection.BLOBS_DIR_NAME), func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				n++
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := countBlobs(); n != len(mockOrgs) {
+		t.Errorf("expected a blob for each of the %d documents, got %d", len(mockOrgs), n)
+	}
+
+	// Documents with the same content share a blob, and their files only point to it
+	twin := mockOrgs[1]
+	err = client.SetStruct(collectionName, Key(10), twin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countBlobs(); n != len(mockOrgs) {
+		t.Errorf("expected a document with the same content as another to share its blob, got %d blobs", n)
+	}
+	path := util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME, key.Key(10).GetPartitionDirName(cl.NumPartitions), key.Key(10).GetFileName(cl.Name, false))
+	pointer, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(pointer), collection.BLOB_POINTER_PREFIX) {
+		t.Errorf("expected the file of the document to point to its blob, got %q", pointer)
+	}
+
+	var fetched Org
+	err = client.GetStruct(collectionName, Key(10), &fetched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched != twin {
+		t.Errorf("expected %v, got %v", twin, fetched)
+	}
+	resp, err := client.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 2, []string{twin.Name, twin.Name})
+	if err != nil {
+		t.Error(err)
+	}
+	report, err := client.Verify(collectionName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) > 0 {
+		t.Errorf("expected no problems with the documents, got %v", report.Problems)
+	}
+
+	// A blob is only pruned once no document points to it
+	err = client.Delete(collectionName, Key(mockOrgs[1].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Delete(collectionName, Key(mockOrgs[0].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := client.PruneBlobs(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 blob to be pruned, got %d", n)
+	}
+	err = client.GetStruct(collectionName, Key(10), &fetched)
+	if err != nil {
+		t.Errorf("expected a document to be readable after the blob it shares has been pruned for another: %v", err)
+	}
+
+	_, err = client.PruneBlobs("Org")
+	if err != ErrContentAddressingIsNotEnabled {
+		t.Errorf("expected ErrContentAddressingIsNotEnabled for a collection without STORAGE_CONTENT_ADDRESSED, got: %v", err)
+	}
+}
+
+func TestDumpLoad(t *testing.T) {
+	collectionName := "OrgDump"
+	client := GetClient()
+
+	src, err := client.DB("dump_src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = src.AddCollection(CollectionProps{
+		Name:                  collectionName,
+		EncodingType:          ENCODING_JSON,
+		EnableGzipCompression: true,
+		NumPartitions:         3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, org := range mockOrgs {
+		err = src.SetStruct(collectionName, Key(org.OrgId), org)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = src.AddIndex(collectionName, "Employees")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = src.Dump(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := buf.Bytes()
+
+	// The collection comes back with its props, documents and indexes
+	dst, err := client.DB("dump_dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dst.Load(bytes.NewReader(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := dst.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl.NumPartitions != 3 || !cl.EnableGzipCompression {
+		t.Errorf("expected the props of the collection to be loaded, got %+v", cl.CollectionProps)
+	}
+	for _, org := range mockOrgs {
+		err = assertOrgIn(dst, collectionName, org)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	resp, err := dst.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = dst.Load(bytes.NewReader(dump))
+	if err != ErrCollectionIsExist {
+		t.Errorf("expected loading a collection that exists to fail with ErrCollectionIsExist, got: %v", err)
+	}
+
+	// A dump that has been cut short, or that isn't one, is detected
+	truncated, err := client.DB("dump_truncated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = truncated.Load(bytes.NewReader(dump[:bytes.LastIndexByte(dump[:len(dump)-1], '\n')+1]))
+	if err != ErrDumpIsIncomplete {
+		t.Errorf("expected a dump without its end record to fail with ErrDumpIsIncomplete, got: %v", err)
+	}
+	err = truncated.Load(strings.NewReader(`{"type":"header","format":"gofiledb-dump","version":99}`))
+	if err != ErrDumpVersionNotSupported {
+		t.Errorf("expected a dump of a later version to fail with ErrDumpVersionNotSupported, got: %v", err)
+	}
+	err = truncated.Load(strings.NewReader("not a dump"))
+	if err != ErrInvalidDump {
+		t.Errorf("expected ErrInvalidDump for data that is not a dump, got: %v", err)
+	}
+
+	for _, name := range []string{"dump_src", "dump_dst", "dump_truncated"} {
+		err = client.RemoveDB(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestScheduledSnapshots(t *testing.T) {
+	collectionName := "OrgScheduledSnapshots"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.ScheduleSnapshots(SnapshotSchedule{CollectionName: collectionName})
+	if err != ErrInvalidSnapshotSchedule {
+		t.Errorf("expected a schedule without an Interval to fail with ErrInvalidSnapshotSchedule, got: %v", err)
+	}
+
+	// A snapshot taken by hand is never pruned by the schedule
+	err = client.Snapshot(collectionName, "scheduled-by-hand")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	taken := make(chan string, 100)
+	hooks := []SnapshotHook{func(info SnapshotInfo, dirPath string) error {
+		if _, err := os.Stat(util.JoinPath(dirPath, SNAPSHOT_INFO_FILE_NAME)); err != nil {
+			t.Errorf("expected the hook to get the dir of the snapshot: %v", err)
+		}
+		taken <- info.Name
+		return nil
+	}}
+	if _, err := exec.LookPath("sh"); err == nil {
+		hooks = append(hooks, CommandHook("sh", "-c", `test -d "$GOFILEDB_SNAPSHOT_PATH" && test "$GOFILEDB_SNAPSHOT_COLLECTION" = orgscheduledsnapshots`))
+		hooks = append(hooks, func(info SnapshotInfo, dirPath string) error {
+			err := CommandHook("sh", "-c", "exit 3")(info, dirPath)
+			if err == nil {
+				t.Errorf("expected a hook running a command that fails to fail")
+			}
+			return nil
+		})
+	}
+	err = client.ScheduleSnapshots(SnapshotSchedule{
+		CollectionName: collectionName,
+		Interval:       10 * time.Millisecond,
+		Keep:           2,
+		AfterSnapshot:  hooks,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case <-taken:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected a scheduled snapshot to be taken, got %d", i)
+		}
+	}
+	err = client.UnscheduleSnapshots(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.UnscheduleSnapshots(collectionName)
+	if err != ErrSnapshotScheduleIsNotExist {
+		t.Errorf("expected ErrSnapshotScheduleIsNotExist once the schedule has stopped, got: %v", err)
+	}
+
+	snapshots, err := client.ListSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range snapshots {
+		if info.CollectionName == strings.ToLower(collectionName) {
+			names = append(names, info.Name)
+		}
+	}
+	if len(names) != 3 || names[0] != "scheduled-by-hand" || !strings.HasPrefix(names[2], SCHEDULED_SNAPSHOT_PREFIX) {
+		t.Errorf("expected the snapshot taken by hand and the 2 latest scheduled ones, got %v", names)
+	}
+	for _, name := range names {
+		err = client.DeleteSnapshot(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWALArchiving(t *testing.T) {
+	collectionName := "OrgWALArchive"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archiveDirPath, err := ioutil.TempDir("", "gofiledb_wal_archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(archiveDirPath)
+	archive := NewWALArchiveDir(archiveDirPath)
+	var failArchiving bool
+	cl.SetWALArchiver(func(segmentName string, r io.Reader) error {
+		if failArchiving {
+			return fmt.Errorf("archive is unavailable")
+		}
+		return archive(cl.Name, segmentName, r)
+	})
+	defer cl.SetWALArchiver(nil)
+
+	walPath := util.JoinPath(cl.DirPath, collection.META_DIR_NAME, collection.WAL_FILE_NAME)
+	getWALSize := func() int64 {
+		info, err := os.Stat(walPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	big := []byte(fmt.Sprintf(`{"OrgId":10,"Name":"%s","Employees":10}`, strings.Repeat("x", 512*1024)))
+
+	// The WAL is not recycled while it can't be archived: the write that takes it over WAL_MAX_SIZE fails
+	failArchiving = true
+	for getWALSize() <= collection.WAL_MAX_SIZE {
+		err = client.Set(collectionName, Key(10), big)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		t.Errorf("expected the write that would recycle the WAL to fail while the archiver fails")
+	}
+	if size := getWALSize(); size <= collection.WAL_MAX_SIZE {
+		t.Errorf("expected the WAL to be kept while the archiver fails, got a size of %d", size)
+	}
+
+	// Once it can, the whole WAL is archived before it is truncated
+	failArchiving = false
+	sizeBefore := getWALSize()
+	err = client.Set(collectionName, Key(10), big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := getWALSize(); size != 0 {
+		t.Errorf("expected the WAL to be truncated once it has been archived, got a size of %d", size)
+	}
+	fileInfos, err := ioutil.ReadDir(util.JoinPath(archiveDirPath, cl.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fileInfos) != 1 {
+		t.Fatalf("expected 1 segment in the archive dir, got %d", len(fileInfos))
+	}
+	if fileInfos[0].Size() <= sizeBefore {
+		t.Errorf("expected the segment to have all the records of the WAL (more than %d bytes), got %d bytes", sizeBefore, fileInfos[0].Size())
+	}
+
+	err = assertOrg(collectionName, Org{OrgId: 10, Name: strings.Repeat("x", 512*1024), Employees: 10})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrateWarehouse(t *testing.T) {
+	collectionName := "OrgMigrated"
+	srcRoot, err := ioutil.TempDir("", "gofiledb_migrate_src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcRoot)
+	dstRoot, err := ioutil.TempDir("", "gofiledb_migrate_dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstRoot)
+
+	src, err := openClient(ClientInitOptions{DocumentRoot: srcRoot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = src.AddCollection(CollectionProps{Name: collectionName, EncodingType: ENCODING_JSON, NumPartitions: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, org := range mockOrgs {
+		err = src.SetStruct(collectionName, Key(org.OrgId), org)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = src.AddIndex(collectionName, "Employees")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = src.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The collection gets the props given for the destination, with the same documents and indexes
+	opts := MigrateOptions{Props: func(props CollectionProps) CollectionProps {
+		props.NumPartitions = 5
+		props.EnableGzipCompression = true
+		return props
+	}}
+	report, err := MigrateWarehouse(srcRoot, util.JoinPath(dstRoot, "warehouse"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.NumCollections != 1 || report.NumDocs != len(mockOrgs) {
+		t.Errorf("expected 1 collection and %d documents to be migrated, got %+v", len(mockOrgs), report)
+	}
+
+	dst, err := openClient(ClientInitOptions{DocumentRoot: util.JoinPath(dstRoot, "warehouse")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := dst.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl.NumPartitions != 5 || !cl.EnableGzipCompression {
+		t.Errorf("expected the props given for the destination, got %+v", cl.CollectionProps)
+	}
+	for _, org := range mockOrgs {
+		err = assertOrgIn(dst, collectionName, org)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	resp, err := dst.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+	if err != nil {
+		t.Error(err)
+	}
+	err = dst.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = MigrateWarehouse(srcRoot, util.JoinPath(dstRoot, "warehouse"), MigrateOptions{})
+	if !errors.Is(err, ErrCollectionIsExist) {
+		t.Errorf("expected migrating a collection that the destination has to fail with ErrCollectionIsExist, got: %v", err)
+	}
+}
+
+func TestMergeFrom(t *testing.T) {
+	collectionName := "OrgMerge"
+	newCollectionName := "OrgMergeNew"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRoot, err := ioutil.TempDir("", "gofiledb_merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(otherRoot)
+
+	// The other warehouse has the same document 2, a newer document 1, a document 20 of its own, and a collection of its own
+	other, err := openClient(ClientInitOptions{DocumentRoot: otherRoot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := mockOrgs[0]
+	changed.Name = "Company A, merged"
+	added := Org{OrgId: 20, Name: "Company T", Employees: 20}
+	for _, name := range []string{collectionName, newCollectionName} {
+		err = other.AddCollection(CollectionProps{Name: name, EncodingType: ENCODING_JSON, NumPartitions: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, org := range []Org{changed, mockOrgs[1], added} {
+		err = other.SetStruct(collectionName, Key(org.OrgId), org)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = other.SetStruct(newCollectionName, Key(added.OrgId), added)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.AddIndex(newCollectionName, "Employees")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := client.MergeFrom(otherRoot, KeepNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := MergeReport{NumCollectionsAdded: 1, NumDocsAdded: 2, NumConflicts: 1, NumDocsReplaced: 1}
+	if report != expected {
+		t.Errorf("expected %+v, got %+v", expected, report)
+	}
+	for _, org := range []Org{changed, mockOrgs[1], added} {
+		err = assertOrg(collectionName, org)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	resp, err := client.Search(newCollectionName, "Employees:20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{added.Name})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Once ours is newer, it is kept, and a custom resolver sees both versions
+	err = client.SetStruct(collectionName, Key(changed.OrgId), mockOrgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = client.MergeFrom(otherRoot, KeepNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.NumConflicts != 1 || report.NumDocsReplaced != 0 {
+		t.Errorf("expected the newer document of the client to be kept, got %+v", report)
+	}
+	err = assertOrg(collectionName, mockOrgs[0])
+	if err != nil {
+		t.Error(err)
+	}
+	errResolver := fmt.Errorf("unresolved")
+	_, err = client.MergeFrom(otherRoot, func(c Conflict) ([]byte, error) {
+		if c.Key != Key(changed.OrgId) || !strings.Contains(string(c.Theirs), changed.Name) || !strings.Contains(string(c.Ours), mockOrgs[0].Name) {
+			t.Errorf("expected the conflict to have both versions of document %d, got %+v", changed.OrgId, c)
+		}
+		return nil, errResolver
+	})
+	if !errors.Is(err, errResolver) {
+		t.Errorf("expected the error of the resolver, got: %v", err)
+	}
+
+	err = client.RemoveCollection(newCollectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyBackup(t *testing.T) {
+	collectionName := "OrgVerifyBackup"
+	dirPath, err := ioutil.TempDir("", "gofiledb_verify_backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	client, err := openClient(ClientInitOptions{DocumentRoot: dirPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.AddCollection(CollectionProps{Name: collectionName, EncodingType: ENCODING_JSON, NumPartitions: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, org := range mockOrgs {
+		err = client.SetStruct(collectionName, Key(org.OrgId), org)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = client.AddIndex(collectionName, "Employees")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = client.Backup(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := VerifyBackup(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.IsRestorable() {
+		t.Errorf("expected the backup to be restorable, got problems: %+v", report.Problems)
+	}
+	if report.NumCollections != 1 || report.NumDocuments != len(mockOrgs) || report.NumIndexes != 1 || report.CreatedAt.IsZero() {
+		t.Errorf("expected the backup to have 1 collection with %d documents and 1 index, got %+v", len(mockOrgs), report)
+	}
+
+	// A document changed in the archive no longer matches the manifest, and one left out leaves the index dangling
+	rewrite := func(fn func(hdr *tar.Header, data []byte) []byte) []byte {
+		gzr, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(gzr)
+		var out bytes.Buffer
+		gzw := gzip.NewWriter(&out)
+		tw := tar.NewWriter(gzw)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(hdr.Name, "/"+collection.DATA_DIR_NAME+"/") && hdr.Typeflag == tar.TypeReg {
+				data = fn(hdr, data)
+				if data == nil {
+					continue
+				}
+				hdr.Size = int64(len(data))
+			}
+			err = tw.WriteHeader(hdr)
+			if err == nil {
+				_, err = tw.Write(data)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = tw.Close(); err == nil {
+			err = gzw.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out.Bytes()
+	}
+	assertProblems := func(data []byte, problemType string) {
+		report, err := VerifyBackup(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found bool
+		for _, p := range report.Problems {
+			found = found || p.Type == problemType
+		}
+		if !found {
+			t.Errorf("expected a %s problem, got: %+v", problemType, report.Problems)
+		}
+	}
+	var isChanged bool
+	assertProblems(rewrite(func(hdr *tar.Header, data []byte) []byte {
+		if !isChanged {
+			data[len(data)-1]++
+			isChanged = true
+		}
+		return data
+	}), BACKUP_PROBLEM_CHECKSUM_MISMATCH)
+	var isRemoved bool
+	assertProblems(rewrite(func(hdr *tar.Header, data []byte) []byte {
+		if !isRemoved {
+			isRemoved = true
+			return nil
+		}
+		return data
+	}), BACKUP_PROBLEM_DANGLING_INDEX_KEY)
+
+	// A backup that is cut short is not restorable
+	report, err = VerifyBackup(bytes.NewReader(buf.Bytes()[:buf.Len()/2]))
+	if err == nil && report.IsRestorable() {
+		t.Error("expected a truncated backup not to be restorable")
+	}
+	_, err = VerifyBackup(strings.NewReader("not a backup"))
+	if !errors.Is(err, ErrInvalidBackup) {
+		t.Errorf("expected %v, got: %v", ErrInvalidBackup, err)
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	collectionName := "OrgGRPC"
+	client := GetClient()
+
+	err := client.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- client.ServeGRPC(l)
+	}()
+	remote, err := NewGRPCClient(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	ctx := context.Background()
+
+	for _, org := range mockOrgs {
+		data, err := json.Marshal(org)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = remote.Set(ctx, collectionName, Key(org.OrgId), data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, org := range mockOrgs {
+		err = assertOrg(collectionName, org)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	data, err := remote.Get(ctx, collectionName, Key(mockOrgs[0].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var org Org
+	err = json.Unmarshal(data, &org)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if org != mockOrgs[0] {
+		t.Errorf("expected %+v, got %+v", mockOrgs[0], org)
+	}
+
+	err = remote.AddIndex(ctx, collectionName, "Employees")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = remote.AddIndex(ctx, collectionName, "Employees")
+	if !errors.Is(err, ErrIndexExists) {
+		t.Errorf("expected %v, got: %v", ErrIndexExists, err)
+	}
+	docs, err := remote.Search(ctx, collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || !strings.Contains(string(docs[0]), mockOrgs[1].Name) {
+		t.Errorf("expected the search to find %s, got %s", mockOrgs[1].Name, docs)
+	}
+	names, err := remote.ListCollections(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if i := sort.SearchStrings(names, collection.NormalizeName(collectionName)); i == len(names) || names[i] != collection.NormalizeName(collectionName) {
+		t.Errorf("expected collection %s to be listed, got %v", collectionName, names)
+	}
+
+	// The errors keep their kind across the wire
+	err = remote.Delete(ctx, collectionName, Key(mockOrgs[0].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = remote.Get(ctx, collectionName, Key(mockOrgs[0].OrgId))
+	var grpcErr *GRPCError
+	if !errors.Is(err, ErrDocNotExist) || !IsNotExist(err) || !errors.As(err, &grpcErr) || grpcErr.Code != codes.NotFound {
+		t.Errorf("expected %v with gRPC status %s, got: %v", ErrDocNotExist, codes.NotFound, err)
+	}
+	_, err = remote.Get(ctx, "OrgGRPCMissing", Key(1))
+	if !errors.Is(err, ErrCollectionNotExist) {
+		t.Errorf("expected %v, got: %v", ErrCollectionNotExist, err)
+	}
+
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-served
+	if err != nil {
+		t.Errorf("expected ServeGRPC to return nil once the listener is closed, got: %v", err)
+	}
+
+	// With TLS, and an interceptor of the caller's that runs along with the client's own
+	serverTLS, clientTLS, err := newTestTLSConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		served <- client.ServeGRPC(l, grpc.Creds(credentials.NewTLS(serverTLS)))
+	}()
+	var numCalls int32
+	remote, err = NewGRPCClient(l.Addr().String(),
+		grpc.WithTransportCredentials(credentials.NewTLS(clientTLS)),
+		grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			atomic.AddInt32(&numCalls, 1)
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	data, err = remote.Get(ctx, collectionName, Key(mockOrgs[1].OrgId))
+	if err != nil || !strings.Contains(string(data), mockOrgs[1].Name) {
+		t.Errorf("expected %s over TLS, got %s, %v", mockOrgs[1].Name, data, err)
+	}
+	_, err = remote.Get(ctx, collectionName, Key(mockOrgs[0].OrgId))
+	if !errors.Is(err, ErrDocNotExist) {
+		t.Errorf("expected %v over TLS, got: %v", ErrDocNotExist, err)
+	}
+	if n := atomic.LoadInt32(&numCalls); n != 2 {
+		t.Errorf("expected the interceptor to see the 2 calls, got %d", n)
+	}
+	insecureRemote, err := NewGRPCClient(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer insecureRemote.Close()
+	_, err = insecureRemote.Get(ctx, collectionName, Key(mockOrgs[1].OrgId))
+	if err == nil {
+		t.Error("expected a client without TLS to not get through to the server with TLS")
+	}
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-served
+	if err != nil {
+		t.Errorf("expected ServeGRPC with TLS to return nil once the listener is closed, got: %v", err)
+	}
+}
+
+func TestSQLDriver(t *testing.T) {
+	collectionName := "OrgSQL"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.AddIndex(collectionName, "Name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Range conditions are run on the index, comparing numbers as numbers
+	resp, err := client.Search(collectionName, "Employees>99+Employees<=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{mockOrgs[0].Name})
+	if err != nil {
+		t.Error(err)
+	}
+
+	db := OpenDB(client)
+	defer db.Close()
+	queryOrgs := func(query string, args ...interface{}) []Org {
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			t.Fatalf("%s: %s", query, err)
+		}
+		defer rows.Close()
+		var orgs []Org
+		for rows.Next() {
+			var org Org
+			err = rows.Scan(&org.OrgId, &org.Name, &org.Employees)
+			if err != nil {
+				t.Fatal(err)
+			}
+			orgs = append(orgs, org)
+		}
+		if err = rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(orgs, func(i, j int) bool { return orgs[i].OrgId < orgs[j].OrgId })
+		return orgs
+	}
+	for _, tc := range []struct {
+		query    string
+		args     []interface{}
+		expected []Org
+	}{
+		{"SELECT OrgId, Name, Employees FROM OrgSQL WHERE Employees > ?", []interface{}{100}, mockOrgs[1:2]},
+		{"select OrgId, Name, Employees from OrgSQL where Employees >= 100 and Employees < 500", nil, mockOrgs[0:1]},
+		{"SELECT OrgId, Name, Employees FROM OrgSQL WHERE Employees = 500.0", nil, mockOrgs[1:2]},
+		{"SELECT OrgId, \"Name\", Employees FROM OrgSQL WHERE Name = 'Company A';", nil, mockOrgs[0:1]},
+		{"SELECT OrgId, Name, Employees FROM OrgSQL WHERE Name = ? AND Employees = ?", []interface{}{"Company A", 500}, nil},
+		{"SELECT OrgId, Name, Employees FROM OrgSQL", nil, mockOrgs[0:2]},
+		{"SELECT OrgId, Name, Employees FROM OrgSQL LIMIT 1", nil, nil},
+	} {
+		orgs := queryOrgs(tc.query, tc.args...)
+		if strings.HasSuffix(tc.query, "LIMIT 1") {
+			if len(orgs) != 1 {
+				t.Errorf("%s: expected 1 row, got %+v", tc.query, orgs)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(orgs, tc.expected) {
+			t.Errorf("%s: expected %+v, got %+v", tc.query, tc.expected, orgs)
+		}
+	}
+
+	rows, err := db.Query("SELECT * FROM OrgSQL LIMIT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"Employees", "Name", "OrgId"}; !reflect.DeepEqual(columns, expected) {
+		t.Errorf("expected the columns %v, got %v", expected, columns)
+	}
+
+	// Only SELECT is supported
+	_, err = db.Exec("DELETE FROM OrgSQL WHERE OrgId = 1")
+	if !errors.Is(err, ErrSQLNotSupported) {
+		t.Errorf("expected %v, got: %v", ErrSQLNotSupported, err)
+	}
+	_, err = db.Query("SELECT Name FROM OrgSQL ORDER BY Name")
+	if !errors.Is(err, ErrSQLNotSupported) {
+		t.Errorf("expected %v, got: %v", ErrSQLNotSupported, err)
+	}
+
+	// The driver opens the warehouse read-only from its document root
+	dirPath, err := ioutil.TempDir("", "gofiledb_sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirPath)
+	other, err := openClient(ClientInitOptions{DocumentRoot: dirPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.AddCollection(CollectionProps{Name: collectionName, EncodingType: ENCODING_JSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.SetStruct(collectionName, Key(mockOrgs[1].OrgId), mockOrgs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roDB, err := sql.Open(SQL_DRIVER_NAME, dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	err = roDB.QueryRow("SELECT Name FROM OrgSQL").Scan(&name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != mockOrgs[1].Name {
+		t.Errorf("expected %s, got %s", mockOrgs[1].Name, name)
+	}
+	err = roDB.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The value of a range condition may have a ':' in it
+	shift := Org{OrgId: 3, Name: "12:30 Shift", Employees: 30}
+	err = client.SetStruct(collectionName, Key(shift.OrgId), shift)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.Search(collectionName, "Name>=12:30+Name<12:31")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{shift.Name})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// A '+' or a '\\' in a value is escaped in the query, so string literals can have them
+	lab := Org{OrgId: 4, Name: `R+D \ Lab`, Employees: 40}
+	err = client.SetStruct(collectionName, Key(lab.OrgId), lab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.Search(collectionName, "Name:"+collection.EscapeQueryValue(lab.Name)+"+Employees:40")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertSearchResult(resp, 1, []string{lab.Name})
+	if err != nil {
+		t.Error(err)
+	}
+	orgs := queryOrgs("SELECT OrgId, Name, Employees FROM OrgSQL WHERE Name = 'R+D \\ Lab'")
+	if !reflect.DeepEqual(orgs, []Org{lab}) {
+		t.Errorf("expected %+v, got %+v", lab, orgs)
+	}
+}
+
+func TestGraphQL(t *testing.T) {
+	collectionName := "OrgGraphQL"
+	client := GetClient()
+
+	err := assertEncodedCollection(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := GraphQLOptions{Types: map[string]interface{}{collectionName: Org{}}, MaxLimit: 5}
+
+	schema, err := client.GraphQLSchema(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"orggraphql(key: Int, where: OrggraphqlFilter, limit: Int): [Org!]!",
+		"type Org {\n  OrgId: Int\n  Name: String\n  Employees: Int\n}",
+		"Employees_gte: Float", // as decoded from JSON
+	} {
+		if !strings.Contains(schema, expected) {
+			t.Errorf("expected the schema to have %q, got:\n%s", expected, schema)
+		}
+	}
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		query     string
+		variables map[string]interface{}
+		expected  string
+	}{
+		{`{ orggraphql(key: 1) { Name } }`, nil, `{"orggraphql":[{"Name":"Company A"}]}`},
+		{`{ orggraphql(key: 3) { Name } }`, nil, `{"orggraphql":[]}`},
+		{`{ big: orggraphql(where: {Employees_gt: 100}) { Employees, OrgId } }`, nil, `{"big":[{"Employees":500,"OrgId":2}]}`},
+		{`{ orggraphql(where: {Employees: 100}) { __typename Name } }`, nil, `{"orggraphql":[{"__typename":"Org","Name":"Company A"}]}`},
+		{`query Orgs($min: Int = 0, $max: Int) { orggraphql(where: {Employees_gte: $min, Employees_lte: $max}) { OrgId } }`, map[string]interface{}{"max": 499.0}, `{"orggraphql":[{"OrgId":1}]}`},
+		{`{ orggraphql(key: 2, where: {Employees_lt: 500}) { Name } }`, nil, `{"orggraphql":[]}`},
+		{`{ orggraphql(key: 2, where: {Employees_gte: 100}, limit: 1) { Name } }`, nil, `{"orggraphql":[{"Name":"Company B"}]}`},
+		{`{ orggraphql(key: 1, where: {Employees: 100}) { Name } }`, nil, `{"orggraphql":[{"Name":"Company A"}]}`},
+		{`{ orggraphql(limit: 0) { Name } }`, nil, `{"orggraphql":[]}`},
+	} {
+		resp := client.ExecuteGraphQL(ctx, opts, GraphQLRequest{Query: tc.query, Variables: tc.variables})
+		if len(resp.Errors) > 0 {
+			t.Errorf("%s: %v", tc.query, resp.Errors)
+			continue
+		}
+		data, err := json.Marshal(resp.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.query, tc.expected, data)
+		}
+	}
+
+	for _, query := range []string{
+		`{ orggraphql { Address } }`,                          // not a field of Org
+		`{ orggraphql(where: {Name: "Company A"}) { Name } }`, // not indexed
+		`mutation { orggraphql { Name } }`,
+		`{ orggraphql { ...OrgFields } }`,
+		`{ nocollection { Name } }`,
+		`{ orggraphql(key: 1) { Name }`,
+	} {
+		resp := client.ExecuteGraphQL(ctx, opts, GraphQLRequest{Query: query})
+		if len(resp.Errors) == 0 {
+			t.Errorf("%s: expected an error", query)
+		}
+	}
+
+	// Nesting is limited, rather than running out of stack
+	for _, query := range []string{
+		`{ orggraphql(key: ` + strings.Repeat("[", 100000) + "1" + strings.Repeat("]", 100000) + `) { Name } }`,
+		`query($k: ` + strings.Repeat("[", 100000) + "Int" + strings.Repeat("]", 100000) + `) { orggraphql { Name } }`,
+		strings.Repeat("{ orggraphql ", 100000) + strings.Repeat("}", 100000),
+	} {
+		resp := client.ExecuteGraphQL(ctx, opts, GraphQLRequest{Query: query})
+		if len(resp.Errors) == 0 || !strings.Contains(resp.Errors[0].Message, "nested deeper") {
+			t.Errorf("expected an error for a document nested deeper than %d levels, got %+v", GRAPHQL_MAX_DEPTH, resp.Errors)
+		}
+	}
+
+	// Without its Go type, any field of the documents can be selected
+	resp := client.ExecuteGraphQL(ctx, GraphQLOptions{}, GraphQLRequest{Query: `{ orggraphql(key: 2) { Name, Address } }`})
+	data, _ := json.Marshal(resp)
+	if string(data) != `{"data":{"orggraphql":[{"Name":"Company B","Address":null}]}}` {
+		t.Errorf("expected the untyped document, got %s", data)
+	}
+
+	server := httptest.NewServer(client.GraphQLHandler(opts))
+	defer server.Close()
+	body, _ := json.Marshal(GraphQLRequest{Query: `query($k: Int) { orggraphql(key: $k) { Name } }`, Variables: map[string]interface{}{"k": 2}})
+	httpResp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpResp.Body.Close()
+	var result struct {
+		Data struct {
+			Orgs []Org `json:"orggraphql"`
+		}
+		Errors []GraphQLError
+	}
+	err = json.NewDecoder(httpResp.Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Errors) > 0 || len(result.Data.Orgs) != 1 || result.Data.Orgs[0].Name != mockOrgs[1].Name {
+		t.Errorf("expected %s over HTTP, got %+v", mockOrgs[1].Name, result)
+	}
+
+	httpResp, err = http.Get(server.URL + "?query=" + url.QueryEscape(`{ orggraphql { OrgId } }`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpResp.Body.Close()
+	result.Data.Orgs = nil
+	err = json.NewDecoder(httpResp.Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Data.Orgs) != 2 {
+		t.Errorf("expected the 2 orgs with GET, got %+v", result)
+	}
+
+	// Requests larger than MaxRequestBytes are not read
+	small := httptest.NewServer(client.GraphQLHandler(GraphQLOptions{MaxRequestBytes: 64}))
+	defer small.Close()
+	body, _ = json.Marshal(GraphQLRequest{Query: "{ orggraphql { Name } }" + strings.Repeat(" ", 64)})
+	httpResp, err = http.Post(small.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected a POST larger than MaxRequestBytes to get status %d, got %d", http.StatusRequestEntityTooLarge, httpResp.StatusCode)
+	}
+	httpResp, err = http.Get(small.URL + "?query=" + url.QueryEscape("{ orggraphql { Name } }"+strings.Repeat(" ", 64)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusRequestURITooLong {
+		t.Errorf("expected a GET larger than MaxRequestBytes to get status %d, got %d", http.StatusRequestURITooLong, httpResp.StatusCode)
+	}
+}
+
+func TestExternalChanges(t *testing.T) {
+	collectionName := "OrgWatch"
+	client := GetClient()
+
+	err := client.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, org := range mockOrgs {
+		err = client.SetStruct(collectionName, Key(org.OrgId), org)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = client.AddIndex(collectionName, "Employees")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getDocPath := func(k key.Key) string {
+		return util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME, k.GetPartitionDirName(cl.NumPartitions), k.GetFileName(cl.Name, false))
+	}
+	assertChanges := func(changes []ExternalChange, expected []ExternalChange) {
+		t.Helper()
+		if !reflect.DeepEqual(changes, expected) {
+			t.Errorf("expected the external changes %v, got %v", expected, changes)
+		}
+	}
+
+	// The first sync only takes note of the files
+	changes, err := client.SyncExternalChanges(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertChanges(changes, nil)
+
+	// The writes of the client are not external changes
+	changed := mockOrgs[0]
+	changed.Employees = 7777
+	err = client.SetStruct(collectionName, Key(changed.OrgId), changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changedFileData, err := ioutil.ReadFile(getDocPath(key.Key(changed.OrgId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SetStruct(collectionName, Key(mockOrgs[0].OrgId), mockOrgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err = client.SyncExternalChanges(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertChanges(changes, nil)
+
+	events, cancel := client.Subscribe(collectionName)
+	defer cancel()
+
+	// Modify the first org, remove the second one and add a third one behind the back of the client
+	err = ioutil.WriteFile(getDocPath(key.Key(mockOrgs[0].OrgId)), changedFileData, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(getDocPath(key.Key(mockOrgs[1].OrgId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(getDocPath(3), changedFileData, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err = client.SyncExternalChanges(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertChanges(changes, []ExternalChange{
+		{Op: AUDIT_OP_SET, Key: key.Key(mockOrgs[0].OrgId)},
+		{Op: AUDIT_OP_DELETE, Key: key.Key(mockOrgs[1].OrgId)},
+		{Op: AUDIT_OP_SET, Key: 3},
+	})
+
+	resp, err := client.Search(collectionName, "Employees:7777")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Result) != 2 {
+		t.Errorf("expected the 2 externally written orgs to be found, got %v", resp.Result)
+	}
+	resp, err = client.Search(collectionName, "Employees:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Result) != 0 {
+		t.Errorf("expected the externally removed org not to be found, got %v", resp.Result)
+	}
+	stats, err := client.CollectionStats(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumDocuments != 2 {
+		t.Errorf("expected the stats to have 2 documents, got %d", stats.NumDocuments)
+	}
+
+	// The subscribers are told about the external changes
+	for _, k := range []Key{1, 2, 3} {
+		select {
+		case event := <-events:
+			if event.Key != k {
+				t.Errorf("expected an event for document %d, got %+v", k, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected an event for document %d", k)
+		}
+	}
+
+	// The watcher syncs in the background
+	watched := make(chan []ExternalChange, 1)
+	err = client.WatchExternalChanges(collectionName, 10*time.Millisecond, func(changes []ExternalChange) { watched <- changes })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.StopWatchingExternalChanges(collectionName)
+	err = os.Remove(getDocPath(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case changes = <-watched:
+		assertChanges(changes, []ExternalChange{{Op: AUDIT_OP_DELETE, Key: 3}})
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the watcher to find the removed document")
+	}
+
+	// The watcher is notified of a change that keeps both the size and the modification time of the file
+	path := getDocPath(key.Key(mockOrgs[0].OrgId))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameSizeData := bytes.Replace(changedFileData, []byte("7777"), []byte("7778"), 1)
+	if len(sameSizeData) != len(changedFileData) || bytes.Equal(sameSizeData, changedFileData) {
+		t.Fatalf("expected the file data to change but keep its size: %s", sameSizeData)
+	}
+	err = ioutil.WriteFile(path, sameSizeData, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(path, info.ModTime(), info.ModTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case changes = <-watched:
+		assertChanges(changes, []ExternalChange{{Op: AUDIT_OP_SET, Key: key.Key(mockOrgs[0].OrgId)}})
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the watcher to find the document modified in place")
+	}
+	resp, err = client.Search(collectionName, "Employees:7778")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Result) != 1 {
+		t.Errorf("expected the org modified in place to be found, got %v", resp.Result)
+	}
+	err = client.StopWatchingExternalChanges(collectionName)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.WatchExternalChanges(collectionName, 0, nil)
+	if err == nil {
+		t.Error("expected an error for an interval of 0")
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	collectionName := "OrgWebhook"
+	client := GetClient()
+
+	err := client.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("webhook secret")
+
+	// The receiver fails the first attempt, so that it is retried
+	var lock sync.Mutex
+	var numRequests int
+	var payloads []WebhookPayload
+	received := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if !VerifyWebhookSignature(secret, body, r.Header.Get(WEBHOOK_SIGNATURE_HEADER)) {
+			t.Errorf("invalid signature %q", r.Header.Get(WEBHOOK_SIGNATURE_HEADER))
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		numRequests++
+		if numRequests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload WebhookPayload
+		err := json.Unmarshal(body, &payload)
+		if err != nil {
+			t.Error(err)
+		}
+		if payload.ID != r.Header.Get(WEBHOOK_DELIVERY_HEADER) {
+			t.Errorf("expected the delivery header to be the ID of the payload %s, got %s", payload.ID, r.Header.Get(WEBHOOK_DELIVERY_HEADER))
+		}
+		payloads = append(payloads, payload)
+		received <- struct{}{}
+	}))
+	defer server.Close()
+
+	id, err := client.AddWebhook(Webhook{
+		CollectionName: collectionName,
+		URL:            server.URL,
+		Ops:            []string{AUDIT_OP_SET},
+		Secret:         secret,
+		IncludeData:    true,
+		RetryDelay:     10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.ListWebhooks()[id]; !ok {
+		t.Errorf("expected webhook %s to be listed", id)
+	}
+
+	err = client.SetStruct(collectionName, Key(mockOrgs[0].OrgId), mockOrgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Delete(collectionName, Key(mockOrgs[0].OrgId)) // not sent
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SetStruct(collectionName, Key(mockOrgs[1].OrgId), mockOrgs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the webhook to receive 2 payloads")
+		}
+	}
+
+	lock.Lock()
+	if numRequests != 3 {
+		t.Errorf("expected 3 requests, with 1 retry, got %d", numRequests)
+	}
+	if len(payloads) != 2 || payloads[0].Key != Key(mockOrgs[0].OrgId) || payloads[1].Key != Key(mockOrgs[1].OrgId) {
+		t.Errorf("expected the payloads of the 2 sets, in order, got %+v", payloads)
+	}
+	for _, payload := range payloads {
+		if payload.Op != AUDIT_OP_SET || payload.Collection != strings.ToLower(collectionName) {
+			t.Errorf("unexpected payload %+v", payload)
+		}
+	}
+	if len(payloads) == 2 && string(payloads[1].Data) != `{"Employees":500,"Name":"Company B","OrgId":2}` {
+		t.Errorf("expected the payload to have the data of the second org, got %s", payloads[1].Data)
+	}
+	lock.Unlock()
+
+	// The payloads that can't be sent end up in the dead-letter log
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	failingID, err := client.AddWebhook(Webhook{CollectionName: collectionName, URL: failing.URL, MaxAttempts: 2, RetryDelay: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Delete(collectionName, Key(mockOrgs[1].OrgId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var letter *WebhookDeadLetter
+	for start := time.Now(); letter == nil && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		letters, err := client.GetWebhookDeadLetters()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range letters {
+			if letters[i].WebhookID == failingID {
+				letter = &letters[i]
+			}
+		}
+	}
+	if letter == nil {
+		t.Fatal("expected the payload to be added to the dead-letter log")
+	}
+	if letter.Attempts != 2 || letter.Payload.Op != AUDIT_OP_DELETE || letter.Payload.Key != Key(mockOrgs[1].OrgId) || letter.Error == "" {
+		t.Errorf("unexpected dead letter %+v", letter)
+	}
+
+	for _, webhookID := range []string{id, failingID} {
+		err = client.RemoveWebhook(webhookID)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	err = client.RemoveWebhook(id)
+	if err != ErrWebhookIsNotExist {
+		t.Errorf("expected ErrWebhookIsNotExist, got %v", err)
+	}
+	_, err = client.AddWebhook(Webhook{CollectionName: collectionName, URL: "ftp://example.com"})
+	if !errors.Is(err, ErrInvalidWebhook) {
+		t.Errorf("expected ErrInvalidWebhook, got %v", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	collectionName := "OrgMetrics"
+	client := GetClient()
+
+	err := client.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.AddIndex(collectionName, "Name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"Acme", "Globex"} {
+		err = client.SetStruct(collectionName, Key(i+1), Org{OrgId: i + 1, Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var org Org
+	err = client.GetStruct(collectionName, Key(1), &org)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.GetStruct(collectionName, Key(1), &org)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.GetStruct(collectionName, Key(3), &org)
+	if !errors.Is(err, ErrDocNotExist) {
+		t.Fatalf("expected ErrDocNotExist, got %v", err)
+	}
+
+	server := httptest.NewServer(client.MetricsHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("expected a text/plain response, got %s", resp.Header.Get("Content-Type"))
+	}
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(string(body), "\n") {
+		lines[line] = true
+	}
+	for _, line := range []string{
+		"# TYPE gofiledb_operations_total counter",
+		`gofiledb_operations_total{collection="orgmetrics",op="set"} 2`,
+		`gofiledb_operations_total{collection="orgmetrics",op="get"} 3`,
+		`gofiledb_operation_errors_total{collection="orgmetrics",op="get",kind="doc_not_exist"} 1`,
+		"# TYPE gofiledb_operation_duration_seconds histogram",
+		`gofiledb_operation_duration_seconds_bucket{collection="orgmetrics",op="set",le="+Inf"} 2`,
+		`gofiledb_operation_duration_seconds_count{collection="orgmetrics",op="set"} 2`,
+		`gofiledb_collection_documents{collection="orgmetrics"} 2`,
+		`gofiledb_index_values{collection="orgmetrics",field="Name"} 2`,
+		`gofiledb_cache_hits_total{collection="orgmetrics"} 2`, // the documents are cached as they are set
+		"# TYPE gofiledb_io_in_progress gauge",
+	} {
+		if !lines[line] {
+			t.Errorf("expected the metrics to have the line %s, got:\n%s", line, body)
+		}
+	}
+}
+
+func TestExpvars(t *testing.T) {
+	collectionName := "OrgExpvar"
+	client := GetClient()
+
+	err := client.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := GetExpvars()
+
+	err = client.SetStruct(collectionName, Key(1), Org{OrgId: 1, Name: "Acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var org Org
+	err = client.GetStruct(collectionName, Key(1), &org)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.GetStruct(collectionName, Key(2), &org)
+	if !errors.Is(err, ErrDocNotExist) {
+		t.Fatalf("expected ErrDocNotExist, got %v", err)
+	}
+	err = client.Delete(collectionName, Key(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := GetExpvars()
+	for name, diff := range map[string]int64{"docs_written": 1, "docs_read": 1, "docs_deleted": 1, "op_errors": 1, "searches": 0} {
+		if after[name]-before[name] != diff {
+			t.Errorf("expected %s to go up by %d, it went from %d to %d", name, diff, before[name], after[name])
+		}
+	}
+	if after["open_files"] < 0 || after["queued_writes"] < 0 || after["queued_change_events"] < 0 || after["io_waiting"] < 0 {
+		t.Errorf("expected the gauges to be >= 0, got %v", after)
+	}
+
+	// The same values are published with expvar
+	v := expvar.Get(EXPVAR_PREFIX + "docs_written")
+	if v == nil {
+		t.Fatalf("expected %sdocs_written to be published", EXPVAR_PREFIX)
+	}
+	if v.String() != strconv.FormatInt(after["docs_written"], 10) {
+		t.Errorf("expected %sdocs_written to be %d, got %s", EXPVAR_PREFIX, after["docs_written"], v)
+	}
+	if expvar.Get(EXPVAR_PREFIX+"open_files") == nil {
+		t.Errorf("expected %sopen_files to be published", EXPVAR_PREFIX)
+	}
+}
+
+func TestCollectionFS(t *testing.T) {
+	collectionName := "OrgFS"
+	client := GetClient()
+
+	err := client.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := client.CollectionFS(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An empty collection has an empty root dir
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no files, got %d", len(entries))
+	}
+
+	docs := map[Key][]byte{
+		1:  []byte(`{"OrgId":1,"Name":"Acme"}`),
+		2:  []byte(`{"OrgId":2,"Name":"Globex"}`),
+		10: []byte(`{"OrgId":10,"Name":"Initech"}`),
+	}
+	for k, data := range docs {
+		err = client.Set(collectionName, k, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = fstest.TestFS(fsys, "1", "2", "10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The documents are stored gzipped, but read as they were set
+	for k, data := range docs {
+		got, err := fs.ReadFile(fsys, strconv.Itoa(int(k)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("expected file %d to be %s, got %s", k, data, got)
+		}
+	}
+	for _, name := range []string{"3", "01", "a", "1/2"} {
+		_, err = fs.Stat(fsys, name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected file %s to not exist, got %v", name, err)
+		}
+	}
+
+	// The documents can be served as they are
+	server := httptest.NewServer(http.FileServer(http.FS(fsys)))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, docs[2]) {
+		t.Errorf("expected document 2 to be served, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer provider.Shutdown(context.Background())
+	client, err := openClient(ClientInitOptions{InMemory: true, TracerProvider: provider})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Middleware see the span of the operation in their ctx
+	var middlewareSpans []trace.SpanContext
+	client.Use(func(next Handler) Handler {
+		return func(ctx context.Context, op *Op) error {
+			middlewareSpans = append(middlewareSpans, trace.SpanContextFromContext(ctx))
+			return next(ctx, op)
+		}
+	})
+
+	err = client.AddCollection(CollectionProps{Name: "OrgTrace", EncodingType: ENCODING_JSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentCtx, parent := provider.Tracer("test").Start(context.Background(), "request")
+	err = client.AddIndexCtx(parentCtx, "OrgTrace", "Name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(`{"OrgId":1,"Name":"Acme"}`)
+	err = client.SetCtx(parentCtx, "OrgTrace", Key(1), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetCtx(parentCtx, "OrgTrace", Key(2))
+	if !errors.Is(err, ErrDocNotExist) {
+		t.Fatalf("expected ErrDocNotExist, got %v", err)
+	}
+	_, err = client.SearchCtx(parentCtx, "OrgTrace", "Name:Acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+
+	// The spans of the operations are exported, as ended children of the span of the request
+	spans := recorder.Ended()
+	if len(spans) != 5 {
+		t.Fatalf("expected 5 spans, got %d", len(spans))
+	}
+	for i, expected := range []struct {
+		name  string
+		attrs []attribute.KeyValue
+		isErr bool
+	}{
+		{TRACE_SPAN_ADD_INDEX, []attribute.KeyValue{TRACE_ATTR_COLLECTION.String("orgtrace"), TRACE_ATTR_FIELD.String("Name")}, false},
+		{"gofiledb.set", []attribute.KeyValue{TRACE_ATTR_SYSTEM.String("gofiledb"), TRACE_ATTR_KEY.Int64(1), TRACE_ATTR_BYTES.Int(len(data))}, false},
+		{"gofiledb.get", []attribute.KeyValue{TRACE_ATTR_OPERATION.String(OP_GET), TRACE_ATTR_KEY.Int64(2)}, true},
+		{"gofiledb.search", []attribute.KeyValue{TRACE_ATTR_QUERY.String("Name:Acme"), TRACE_ATTR_PLAN.String("Name:Acme [index, 1 values]"), TRACE_ATTR_NUM_RESULTS.Int(1)}, false},
+	} {
+		span := spans[i]
+		if span.Name() != expected.name {
+			t.Errorf("expected span %d to be %s, got %s", i, expected.name, span.Name())
+			continue
+		}
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() || span.SpanKind() != trace.SpanKindClient {
+			t.Errorf("expected span %s to be a client span, child of the span of the request", span.Name())
+		}
+		if (span.Status().Code == otelcodes.Error) != expected.isErr || (len(span.Events()) > 0) != expected.isErr {
+			t.Errorf("expected span %s to have an error: %v, got %+v", span.Name(), expected.isErr, span.Status())
+		}
+		attrs := attribute.NewSet(span.Attributes()...)
+		for _, attr := range expected.attrs {
+			if v, ok := attrs.Value(attr.Key); !ok || v != attr.Value {
+				t.Errorf("expected span %s to have %s = %v, got %v", span.Name(), attr.Key, attr.Value.Emit(), v.Emit())
+			}
+		}
+	}
+	if spans[4].Name() != "request" {
+		t.Errorf("expected the span of the request to be the last one, got %s", spans[4].Name())
+	}
+	if len(middlewareSpans) != 3 || middlewareSpans[0].SpanID() != spans[1].SpanContext().SpanID() {
+		t.Errorf("expected the middleware to see the spans of the operations, got %v", middlewareSpans)
+	}
+}
+
+func TestRepartitionCollection(t *testing.T) {
+	collectionName := "OrgRepartition"
+	client := GetClient()
+
+	err := client.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.AddIndex(collectionName, "Name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		err = client.SetStruct(collectionName, Key(i), Org{OrgId: i, Name: fmt.Sprintf("Org %d", i%3)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// so that document 4 has a revision
+	err = client.SetStruct(collectionName, Key(4), Org{OrgId: 4, Name: "Org 1", Employees: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A collection is repartitioned by one call at a time
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := lockRepartition(util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.RepartitionCollection(collectionName, 5, RepartitionOptions{})
+	unlock()
+	if err != ErrIsRepartitioning {
+		t.Fatalf("expected ErrIsRepartitioning, got %v", err)
+	}
+	// but other collections don't wait for each other
+	unlock, err = lockRepartition(util.JoinPath(cl.DirPath, "..", "other", collection.DATA_DIR_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	assertRepartitioned := func(numPartitions int) {
+		t.Helper()
+		cl, err := client.getCollectionByName(collectionName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cl.NumPartitions != numPartitions {
+			t.Fatalf("expected %d partitions, got %d", numPartitions, cl.NumPartitions)
+		}
+		for i := 1; i <= 10; i++ {
+			path := util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME, key.Key(i).GetPartitionDirName(numPartitions), key.Key(i).GetFileName(cl.Name, false))
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("expected document %d to be in its new partition: %s", i, err)
+			}
+		}
+		infos, err := ioutil.ReadDir(util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != numPartitions {
+			t.Errorf("expected %d partition dirs, got %d", numPartitions, len(infos))
+		}
+
+		var org Org
+		err = client.GetStruct(collectionName, Key(7), &org)
+		if err != nil || org.OrgId != 7 {
+			t.Errorf("expected to get org 7, got %v: %v", org, err)
+		}
+		resp, err := client.Search(collectionName, "Name:Org 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.NumDocuments != 4 { // 1, 4, 7 and 10
+			t.Errorf("expected 4 documents to be found, got %d", resp.NumDocuments)
+		}
+		revisions, err := client.ListRevisions(collectionName, Key(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(revisions) != 1 {
+			t.Errorf("expected document 4 to still have its revision, got %d", len(revisions))
+		}
+		stats, err := client.CollectionStats(collectionName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.NumDocuments != 10 {
+			t.Errorf("expected 10 documents, got %d", stats.NumDocuments)
+		}
+		report, err := client.Verify(collectionName, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) > 0 {
+			t.Errorf("expected no problems, got %+v", report.Problems)
+		}
+	}
+
+	// A dry run only reports what would be moved: documents 1 and 10 are in the same partition either way
+	report, err := client.RepartitionCollection(collectionName, 5, RepartitionOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.PlannedMoves) != 8 {
+		t.Fatalf("expected 8 documents to be moved, got %+v", report.PlannedMoves)
+	}
+	if m := report.PlannedMoves[0]; m.Key != 2 || m.From != "partition_0" || m.To != "partition_2" {
+		t.Errorf("unexpected move %+v", m)
+	}
+	if cl.NumPartitions != 2 {
+		t.Fatalf("expected the collection not to be repartitioned by a dry run")
+	}
+
+	var progress []RepartitionProgress
+	report, err = client.RepartitionCollection(collectionName, 5, RepartitionOptions{
+		OnProgress: func(p RepartitionProgress) {
+			if _, isRepartitioning, _ := client.GetRepartitionProgress(collectionName); !isRepartitioning {
+				t.Errorf("expected the collection to be being repartitioned")
+			}
+			progress = append(progress, p)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.NumMoved != 8 {
+		t.Errorf("expected 8 documents to be moved, got %d", report.NumMoved)
+	}
+	if len(progress) == 0 {
+		t.Fatalf("expected the progress to be reported")
+	}
+	last := progress[len(progress)-1]
+	if last.NumPartitions != 5 || last.PrevNumPartitions != 2 || last.NumDirsDone != last.NumDirs || last.NumMoved != 8 {
+		t.Errorf("unexpected progress %+v", last)
+	}
+	if _, isRepartitioning, _ := client.GetRepartitionProgress(collectionName); isRepartitioning {
+		t.Errorf("expected the repartitioning to be done")
+	}
+	assertRepartitioned(5)
+
+	// The documents can still be written, into their new partitions
+	err = client.SetStruct(collectionName, Key(11), Org{OrgId: 11, Name: "Org 2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Delete(collectionName, Key(11))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The collection can be used while its documents haven't all been moved yet, e.g. if a repartitioning has been
+	// interrupted, and it is saved as being repartitioned
+	err = cl.StartRepartition(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cl.StartRepartition(4)
+	if err != collection.ErrRepartitionInProgress {
+		t.Fatalf("expected ErrRepartitionInProgress, got %v", err)
+	}
+	b, err := cl.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded collection.Collection
+	err = decoded.GobDecode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.IsRepartitioning() {
+		t.Errorf("expected the repartitioning to be saved with the collection")
+	}
+
+	// and it carries on from where it was: documents 3 and 8 have been moved out of partition_3 already, which has been
+	// recorded as done
+	for _, k := range []int{3, 8} {
+		err = client.SetStruct(collectionName, Key(k), Org{OrgId: k, Name: fmt.Sprintf("Org %d", k%3)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Remove(util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME, "partition_3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	progressPath := util.JoinPath(cl.DirPath, collection.META_DIR_NAME, collection.REPARTITION_PROGRESS_FILE_NAME)
+	err = ioutil.WriteFile(progressPath, []byte(util.JoinPath(collection.DATA_DIR_NAME, "partition_3")+"\ndata/parti"), util.FILE_PERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 10; i++ {
+		var org Org
+		err = client.GetStruct(collectionName, Key(i), &org)
+		if err != nil || org.OrgId != i {
+			t.Errorf("expected to get org %d from its old partition, got %v: %v", i, org, err)
+		}
+	}
+	// a document that is deleted before it is moved stays deleted
+	err = client.Delete(collectionName, Key(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.GetStruct(collectionName, Key(2), &Org{}); err == nil {
+		t.Errorf("expected org 2 to be deleted")
+	}
+	err = client.SetStruct(collectionName, Key(2), Org{OrgId: 2, Name: "Org 2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads and writes go on while the rest of the documents are moved
+	stop := make(chan struct{})
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(isWriter bool) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				k := n%10 + 1
+				var org Org
+				if err := client.GetStruct(collectionName, Key(k), &org); err != nil || org.OrgId != k {
+					errs <- fmt.Errorf("getting org %d while repartitioning: %v: %v", k, org, err)
+					return
+				}
+				if isWriter && k != 4 { // document 4 keeps just the one revision
+					if err := client.SetStruct(collectionName, Key(k), org); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(g == 0)
+	}
+	_, err = client.RepartitionCollection(collectionName, 3, RepartitionOptions{})
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl.IsRepartitioning() {
+		t.Errorf("expected the repartitioning to be finished")
+	}
+	if _, err := os.Stat(progressPath); !os.IsNotExist(err) {
+		t.Errorf("expected the progress file to be removed, got %v", err)
+	}
+	assertRepartitioned(3)
+}
+
+func TestVacuum(t *testing.T) {
+	collectionName := "OrgVacuum"
+	client := GetClient()
+
+	err := client.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.AddIndex(collectionName, "Name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		err = client.SetStruct(collectionName, Key(i), Org{OrgId: i, Name: "Org"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// leaves partition_0 empty
+	err = client.Delete(collectionName, Key(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl, err := client.getCollectionByName(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaDirPath := util.JoinPath(cl.DirPath, collection.META_DIR_NAME)
+	invalidPath := util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME, "partition_1", "notes.txt")
+	old := time.Now().Add(-2 * collection.VACUUM_MIN_AGE)
+	files := map[string]bool{ // path -> whether it should be removed
+		invalidPath: true,
+		util.JoinPath(metaDirPath, collection.TEMP_FILE_PREFIX+"old"): true,
+		util.JoinPath(metaDirPath, collection.TEMP_FILE_PREFIX+"new"): false, // may be in use
+		util.JoinPath(cl.GetDirPathForIndexes(), "Employees"):         true,
+		util.JoinPath(cl.GetDirPathForIndexes(), "Address"):           false, // may be being added
+	}
+	for path, isRemoved := range files {
+		err = ioutil.WriteFile(path, []byte("{}"), util.FILE_PERM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isRemoved && path != invalidPath {
+			err = os.Chtimes(path, old, old)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	report, err := client.Vacuum(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.NumEmptyDirsRemoved != 1 || report.NumTempFilesRemoved != 1 || report.NumIndexFilesRemoved != 1 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if len(report.InvalidFilesRemoved) != 1 || report.InvalidFilesRemoved[0] != invalidPath {
+		t.Errorf("expected %s to be reported as removed, got %v", invalidPath, report.InvalidFilesRemoved)
+	}
+	for path, isRemoved := range files {
+		if _, err := os.Stat(path); os.IsNotExist(err) != isRemoved {
+			t.Errorf("expected %s to be removed: %t, got %v", path, isRemoved, err)
+		}
+	}
+
+	// The documents and indexes are left as they are, and the removed partition dir is created again when needed
+	err = client.SetStruct(collectionName, Key(3), Org{OrgId: 3, Name: "Org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Search(collectionName, "Name:Org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.NumDocuments != 3 {
+		t.Errorf("expected 3 documents to be found, got %d", resp.NumDocuments)
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	client := GetClient()
+
+	for _, name := range []string{"OrgDuplicates", "OrgDuplicatesOther"} {
+		err := client.AddCollection(mockCollections[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 1, 3 and 5 are the same, and so are 2 and 4, and document 1 of the other collection. Document 6 is the same as
+	// document 2 of the other collection.
+	for i := 1; i <= 5; i++ {
+		err := client.SetStruct("OrgDuplicates", Key(i), Org{OrgId: 1 + (i+1)%2, Name: "Org"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := client.SetStruct("OrgDuplicates", Key(6), Org{OrgId: 6, Name: "Org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SetStruct("OrgDuplicatesOther", Key(1), Org{OrgId: 2, Name: "Org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SetStruct("OrgDuplicatesOther", Key(2), Org{OrgId: 6, Name: "Org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Document 7 would be the same as 1, but it has expired, even though it hasn't been reaped
+	err = client.SetStructWithTTL("OrgDuplicates", Key(7), Org{OrgId: 1, Name: "Org"}, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	err = client.AddAlias("OrgDuplicatesAlias", "OrgDuplicates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheStats, err := client.GetCacheStats("OrgDuplicates")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The collection that is listed by its alias too is only gone through once
+	report, err := client.FindDuplicates(DuplicatesOptions{Collections: []string{"OrgDuplicates", "OrgDuplicatesOther", "OrgDuplicatesAlias"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.NumDocs != 8 || report.NumDuplicateDocs != 3 || len(report.Sets) != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	// The documents are not read through the cache
+	newCacheStats, err := client.GetCacheStats("OrgDuplicates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newCacheStats != cacheStats {
+		t.Errorf("expected the cache to be left alone, got %+v rather than %+v", newCacheStats, cacheStats)
+	}
+	set := report.Sets[0]
+	if len(set.Docs) != 3 || set.Docs[0].Key != 1 || set.Docs[1].Key != 3 || set.Docs[2].Key != 5 {
+		t.Errorf("expected documents 1, 3 and 5 to come first, got %+v", set)
+	}
+	if report.NumDuplicateBytes != 2*set.Size+report.Sets[1].Size {
+		t.Errorf("unexpected number of duplicate bytes %d", report.NumDuplicateBytes)
+	}
+
+	// Across collections, the data is compared whatever the compression
+	report, err = client.FindDuplicates(DuplicatesOptions{Collections: []string{"OrgDuplicates", "OrgDuplicatesOther"}, AcrossCollections: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.NumDuplicateDocs != 5 || len(report.Sets) != 3 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for _, set := range report.Sets {
+		if len(set.Docs) == 2 && (set.Docs[0] != DuplicateDoc{Collection: "orgduplicates", Key: 6} || set.Docs[1] != DuplicateDoc{Collection: "orgduplicatesother", Key: 2}) {
+			t.Errorf("expected document 6 to be a duplicate of document 2 of the other collection, got %+v", set)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	client := GetClient()
+
+	// One collection for each Durability setting, and one with a WAL
+	for _, collectionName := range []string{"Org", "OrgMsgpack", "OrgCbor", "OrgWal"} {
+		err := client.SetStruct(collectionName, Key(mockOrgs[0].OrgId), mockOrgs[0])
+		if err != nil {
+			t.Error(err)
+		}
+		err = client.Flush(collectionName)
+		if err != nil {
+			t.Errorf("flushing %s: %s", collectionName, err)
+		}
+	}
+
+	err := client.Flush("NoSuchCollection")
+	if err != ErrCollectionIsNotExist {
+		t.Errorf("expected ErrCollectionIsNotExist, got: %v", err)
+	}
+
+	err = client.Sync()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDurability(t *testing.T) {
+	err := GetClient().Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalClient = Client{}
+
+	fsys := &faultyFS{}
+	err = Initialize(
+		WithDocumentRoot(documentRoot),
+		WithEncryptionKey("OrgSecret", rotatedEncryptionKey),
+		WithFS(fsys),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := reloadClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	client := GetClient()
+
+	// indexOf returns the index of entry in log, or -1
+	indexOf := func(log []string, entry string) int {
+		for i, e := range log {
+			if e == entry {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for _, durability := range []uint{DURABILITY_NONE, DURABILITY_FSYNC_ON_WRITE, DURABILITY_FSYNC_INTERVAL} {
+		collectionName := fmt.Sprintf("OrgDurability%d", durability)
+		err = client.AddCollection(CollectionProps{
+			Name:          collectionName,
+			EncodingType:  ENCODING_JSON,
+			Durability:    durability,
+			FsyncInterval: 10 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cl, err := client.getCollectionByName(collectionName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k := key.Key(mockOrgs[0].OrgId)
+		path := filepath.Clean(util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME, k.GetPartitionDirName(cl.NumPartitions), k.GetFileName(cl.Name, false)))
+		metaDirPath := filepath.Clean(util.JoinPath(cl.DirPath, collection.META_DIR_NAME))
+
+		atomic.StoreInt32(&fsys.logSyncs, 1)
+		err = client.SetStruct(collectionName, Key(k), mockOrgs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		log := fsys.getSyncLog()
+		renamed := indexOf(log, "rename "+path)
+		if renamed < 0 {
+			t.Fatalf("expected the document of %s to be renamed into place, got %v", collectionName, log)
+		}
+
+		switch durability {
+		case DURABILITY_NONE:
+			// Nothing is fsynced, even later on
+			time.Sleep(50 * time.Millisecond)
+			log = append(log, fsys.getSyncLog()...)
+			for _, entry := range log {
+				if strings.HasPrefix(entry, "sync ") {
+					t.Errorf("expected nothing to be fsynced for %s, got %v", collectionName, log)
+					break
+				}
+			}
+
+		case DURABILITY_FSYNC_ON_WRITE:
+			// The temp file and its dir are fsynced before the rename, and the dir of the document after it
+			var tmpSynced int = -1
+			for i, entry := range log[:renamed] {
+				if strings.HasPrefix(entry, "sync "+util.JoinPath(metaDirPath, collection.TEMP_FILE_PREFIX)) {
+					tmpSynced = i
+				}
+			}
+			if tmpSynced < 0 || indexOf(log[tmpSynced:renamed], "sync "+metaDirPath) < 0 {
+				t.Errorf("expected the temp file and the meta dir of %s to be fsynced before the rename, got %v", collectionName, log)
+			}
+			if indexOf(log[renamed:], "sync "+filepath.Dir(path)) < 0 {
+				t.Errorf("expected the dir of the document of %s to be fsynced after the rename, got %v", collectionName, log)
+			}
+
+		case DURABILITY_FSYNC_INTERVAL:
+			// The document and its dir are fsynced in the background, after the rename
+			deadline := time.Now().Add(5 * time.Second)
+			for indexOf(log, "sync "+filepath.Dir(path)) < 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+				log = append(log, fsys.getSyncLog()...)
+			}
+			synced, dirSynced := indexOf(log, "sync "+path), indexOf(log, "sync "+filepath.Dir(path))
+			if synced < renamed || dirSynced < synced {
+				t.Errorf("expected the document of %s and then its dir to be fsynced after the rename, got %v", collectionName, log)
+			}
+		}
+		atomic.StoreInt32(&fsys.logSyncs, 0)
+	}
+}
+
+func TestStartupCleanup(t *testing.T) {
+	collectionName := "OrgSnapshot"
+	snapshotName := "startup"
+	client := GetClient()
+
+	err := client.Snapshot(collectionName, snapshotName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotDirPath := util.JoinPath(client.getSnapshotsDirPath(), snapshotName, SNAPSHOT_COLLECTION_DIR_NAME)
+	changed := mockOrgs[0]
+	changed.Employees = 500
+
+	// Leave behind temp files, as a crashed process would
+	cl, err := client.getCollectionByName("Org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempPaths := []string{
+		util.JoinPath(client.getDocumentRoot(), util.META_DIR_NAME, collection.TEMP_FILE_PREFIX+"globalClient.gob123"),
+		util.JoinPath(client.getSnapshotsDirPath(), collection.TEMP_FILE_PREFIX+"half-done"),
+		util.JoinPath(cl.DirPath, collection.META_DIR_NAME, collection.TEMP_FILE_PREFIX+"456"),
+		util.JoinPath(cl.DirPath, collection.DATA_DIR_NAME, key.Key(1).GetPartitionDirName(cl.NumPartitions), collection.TEMP_FILE_PREFIX+"789"),
+	}
+	for _, path := range tempPaths {
+		err = ioutil.WriteFile(path, []byte("partial"), util.FILE_PERM)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A restore that crashed after it was committed should be finished, and one that crashed before should be undone
+	for _, isCommitted := range []bool{true, false} {
+		err = client.SetStruct(collectionName, Key(changed.OrgId), changed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cl, err := client.getCollectionByName(collectionName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newDirPath, oldDirPath, commitPath := getRestorePaths(cl.DirPath)
+		restored, err := collection.RestoreSnapshot(snapshotDirPath, newDirPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isCommitted {
+			err = GetClient().writeRestoreCommit(commitPath, restored)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = os.Rename(cl.DirPath, oldDirPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = reloadClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client = GetClient()
+
+		if isCommitted {
+			err = assertSnapshotRestored(collectionName)
+		} else {
+			err = fetchAndAssertData(collectionName, Key(changed.OrgId), Org{}, changed, "OrgId")
+		}
+		if err != nil {
+			t.Errorf("committed %t: %s", isCommitted, err)
+		}
+		tempPaths = append(tempPaths, newDirPath, oldDirPath, commitPath)
+	}
+
+	// Collections are recovered when they are first used
+	_, err = client.Count("Org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range tempPaths {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to have been removed, got: %v", path, err)
+		}
+	}
+
+	err = client.DeleteSnapshot(snapshotName)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientMetaRecovery(t *testing.T) {
+	client := GetClient()
+	metaPath := util.JoinPath(client.getDocumentRoot(), util.META_DIR_NAME, "globalClient.gob")
+
+	// Saving again makes the previous generation match the current meta
+	err := client.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a torn write of the meta
+	err = ioutil.WriteFile(metaPath, []byte("not a gob"), util.FILE_PERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = reloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client = GetClient()
+	for _, props := range mockCollections {
+		exists, err := client.IsCollectionExist(props.Name)
+		if err != nil {
+			t.Error(err)
+		}
+		if !exists {
+			t.Errorf("Expected collection %s to exist after loading the previous client meta", props.Name)
+		}
+	}
+
+	// The meta should be readable again once the client is saved
+	err = client.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded Client
+	err = GetClient().decodeMetaFile(metaPath, &loaded)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientLocking(t *testing.T) {
+	client := GetClient()
+	root := client.getDocumentRoot()
+
+	// The document root is locked by the client, so no other client can use it
+	for _, isShared := range []bool{false, true} {
+		lock, err := lockDocumentRoot(util.OSFS{}, root, isShared)
+		if err != ErrDocumentRootIsLocked {
+			t.Errorf("expected ErrDocumentRootIsLocked (shared: %t), got: %v", isShared, err)
+			lock.unlock()
+		}
+	}
+
+	// Reopen the document root as read-only
+	err := client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalClient = Client{}
+	err = Initialize(ClientInitOptions{
+		DocumentRoot:   documentRoot,
+		EncryptionKeys: map[string][]byte{"OrgSecret": rotatedEncryptionKey},
+		ReadOnly:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = GetClient()
+
+	// Other read-only clients can share the document root, but a normal client can't
+	lock, err := lockDocumentRoot(util.OSFS{}, root, true)
+	if err != nil {
+		t.Error(err)
+	}
+	lock.unlock()
+	lock, err = lockDocumentRoot(util.OSFS{}, root, false)
+	if err != ErrDocumentRootIsLocked {
+		t.Errorf("expected ErrDocumentRootIsLocked, got: %v", err)
+		lock.unlock()
+	}
+
+	err = fetchAndAssertData("Org", Key(mockOrgs[0].OrgId), Org{}, mockOrgs[0], "OrgId")
+	if err != nil {
+		t.Error(err)
+	}
+	resp, err := client.Search("Org", "Employees:500")
+	if err != nil {
+		t.Error(err)
+	}
+	err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.SetStruct("Org", Key(mockOrgs[0].OrgId), mockOrgs[0])
+	if !errors.Is(err, ErrClientIsReadOnly) {
+		t.Errorf("expected ErrClientIsReadOnly from SetStruct, got: %v", err)
+	}
+	err = client.Delete("Org", Key(mockOrgs[0].OrgId))
+	if !errors.Is(err, ErrClientIsReadOnly) {
+		t.Errorf("expected ErrClientIsReadOnly from Delete, got: %v", err)
+	}
+	err = client.AddCollection(CollectionProps{Name: "OrgReadOnly", EncodingType: ENCODING_JSON})
+	if err != ErrClientIsReadOnly {
+		t.Errorf("expected ErrClientIsReadOnly from AddCollection, got: %v", err)
+	}
+	_, err = client.Verify("Org", true)
+	if err != ErrClientIsReadOnly {
+		t.Errorf("expected ErrClientIsReadOnly from Verify, got: %v", err)
+	}
+}
+
+func TestReloadClient(t *testing.T) {
+	client := GetClient()
+
+	// Simulate a restart
+	err := client.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	globalClient = Client{}
+
+	err = Initialize(ClientInitOptions{
+		DocumentRoot:   documentRoot,
+		EncryptionKeys: map[string][]byte{"OrgSecret": rotatedEncryptionKey},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client = GetClient()
+	for _, props := range mockCollections {
+		exists, err := client.IsCollectionExist(props.Name)
+		if err != nil {
+			t.Error(err)
+		}
+		if !exists {
+			t.Errorf("Expected collection %s to exist after reloading the client", props.Name)
+		}
+	}
+
+	// Indexes should have been loaded as well, including the encrypted ones
+	for _, collectionName := range []string{"Org", "OrgSecret"} {
+		resp, err := client.Search(collectionName, "Employees:500")
+		if err != nil {
+			t.Error(err)
+		}
+		err = assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestRemoveCollection(t *testing.T) {
+	if !REMOVE_COLLECTION {
+		log.Println("REMOVE_COLLECTION flag set to false. Leaving collection data as it is.")
+		return
+	}
+	client := GetClient()
+	err := client.RemoveCollection(mockCollections["User"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["Org"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["OrgGob"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["Blob"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["OrgMixed"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["OrgConcurrent"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["OrgIndexBuild"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["OrgCache"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["OrgPreload"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["OrgIndexCache"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["OrgSecret"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["OrgWal"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["OrgMsgpack"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["OrgCbor"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["OrgBson"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["OrgCorrupt"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["OrgVerify"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["OrgIsolation"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["OrgSnapshot"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["OrgJournal"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["OrgAudit"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.RemoveCollection(mockCollections["OrgRevisions"].Name)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	if !DESTROY {
+		log.Println("DESTROY flag set to false. Not destorying the db.")
+		return
+	}
+	client := GetClient()
+	err := client.Destroy()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+/********************************************************************************
+* H E L P E R S
+*********************************************************************************/
+
+// func assertUserDataByKey(key Key, expectedData interface{}) error {
+// 	client := GetClient()
+
+// 	var data User
+// 	err := client.GetStruct(userCollectionName, key, &data)
+// 	if err != nil {
+// 		return err
+// 	}
+// 	if data != expectedData {
+// 		return fmt.Errorf("Fectched data did not match expected data: \n Fetched: %v \n Expected: %v", data, expectedData)
+// 	}
+
+// 	return nil
+// }
+
+func fetchAndAssertData(collectionName string, key Key, newData interface{}, expectedData interface{}, keyFieldName string) error {
+	client := GetClient()
+
+	err := client.GetStruct(collectionName, key, &newData)
+	if err != nil {
+		return err
+	}
+	clog.Debugf("Fetched with Key: %d \n%+v", key, newData)
+	clog.Debugf("Expected with Key: %d \n%+v", key, expectedData)
+
+	err = assertEquality(expectedData, newData, keyFieldName)
+	if err != nil {
+		return fmt.Errorf("Fectched data did not match expected data: \n Fetched: %v \n Expected: %v \n Error: %s", newData, expectedData, err)
+	}
+
+	return nil
+}
+
+// assertOrgsRoundTrip saves all the mockOrgs in the collection, and ensures that they are fetched back unchanged
+func assertOrgsRoundTrip(collectionName string) error {
+	client := GetClient()
+
+	for _, data := range mockOrgs {
+		err := client.SetStruct(collectionName, Key(data.OrgId), data)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, data := range mockOrgs {
+		var fetched Org
+		err := client.GetStruct(collectionName, Key(data.OrgId), &fetched)
+		if err != nil {
+			return err
+		}
+		if fetched != data {
+			return fmt.Errorf("Fetched data did not match expected data: \n Fetched: %v \n Expected: %v", fetched, data)
+		}
+	}
+
+	return nil
+}
+
+// assertOrg ensures that the document for expected in the collection matches it
+func assertOrg(collectionName string, expected Org) error {
+	var fetched Org
+	err := GetClient().GetStruct(collectionName, Key(expected.OrgId), &fetched)
+	if err != nil {
+		return err
+	}
+	if fetched != expected {
+		return fmt.Errorf("Fetched data did not match expected data: \n Fetched: %v \n Expected: %v", fetched, expected)
+	}
+	return nil
+}
+
+// withFilesMoved moves the files at paths out of the document root while fn runs, and then moves them back
+func withFilesMoved(paths []string, fn func() error) error {
+	dirPath, err := ioutil.TempDir("", "gofiledb_test")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dirPath)
+
+	for i, path := range paths {
+		err = os.Rename(path, util.JoinPath(dirPath, strconv.Itoa(i)))
+		if err != nil {
+			return err
+		}
+		defer os.Rename(util.JoinPath(dirPath, strconv.Itoa(i)), path)
+	}
+
+	return fn()
+}
+
+// assertEncodedCollection creates the collection, saves and fetches all the mockOrgs, and ensures that they can be searched
+// using an index. It is used to test the encodings that support indexing.
+func assertEncodedCollection(collectionName string) error {
+	client := GetClient()
+	err := client.AddCollection(mockCollections[collectionName])
+	if err != nil {
+		return err
+	}
+
+	err = assertOrgsRoundTrip(collectionName)
+	if err != nil {
+		return err
+	}
+
+	err = client.AddIndex(collectionName, "Employees")
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Search(collectionName, "Employees:500")
+	if err != nil {
+		return err
+	}
+
+	return assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+}
+
+func assertSearchResponse(resp SearchResponse, expectedLength int, expectedResult interface{}, keyFieldName string) error {
+	if resp.NumDocuments != expectedLength {
+		return fmt.Errorf("number of results returned %d do not match the expected number %d", resp.NumDocuments, expectedLength)
+	}
+
+	var seen map[Key]bool = make(map[Key]bool)
+
+	switch reflect.TypeOf(expectedResult).Kind() {
+	case reflect.Slice:
+		expectedResultV := reflect.ValueOf(expectedResult)
+
+		for i := 0; i < expectedResultV.Len(); i++ {
+			dv := expectedResultV.Index(i)
+			dkv := dv.FieldByName(keyFieldName)
+			var dk Key = Key(dkv.Int())
+
+			if seen[dk] == true {
+				return fmt.Errorf("Same document can not be used twice in the expected results: %v", dv.Interface())
+			}
+			seen[dk] = false
+			for _, _r := range resp.Result {
+				r, ok := _r.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("Could not assert a result item as a map. It should be a map...")
 				}
 
 				__rk, ok := r[keyFieldName].(float64)
@@ -618,6 +9806,290 @@ func assertEquality(expectedData interface{}, data interface{}, keyFieldName str
 	return nil
 }
 
+// reloadClient closes the client and initializes it again, as if the process had restarted
+// assertChanges checks that the changes to the collection after since are the expected ones, ignoring their times
+func assertChanges(collectionName string, since Sequence, expected []Change) error {
+	it, err := GetClient().Changes(collectionName, since)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	var changes []Change
+	for it.Next() {
+		c := it.Change()
+		if c.Time.IsZero() {
+			return fmt.Errorf("change %d has no time", c.Seq)
+		}
+		c.Time = time.Time{}
+		changes = append(changes, c)
+	}
+	if it.Err() != nil {
+		return it.Err()
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		return fmt.Errorf("expected changes %v after %d, got %v", expected, since, changes)
+	}
+	return nil
+}
+
+// awaitReplicated waits for the document for k of the collection of db to become expected, or to not exist if it is nil
+// newTestTLSConfigs returns the TLS configs of a server and of a client that trust each other, with a self-signed
+// certificate for 127.0.0.1 that both of them use
+func newTestTLSConfigs() (*tls.Config, *tls.Config, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gofiledb test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	tlsCert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv, Leaf: cert}
+	server := &tls.Config{Certificates: []tls.Certificate{tlsCert}, ClientCAs: pool}
+	client := &tls.Config{Certificates: []tls.Certificate{tlsCert}, RootCAs: pool}
+	return server, client, nil
+}
+
+func awaitReplicated(db *Client, collectionName string, k Key, expected *Org) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var err error
+		if expected == nil {
+			_, err = db.Get(collectionName, k)
+			if IsNotExist(err) {
+				return nil
+			}
+			if err == nil {
+				err = fmt.Errorf("document %d still exists", k)
+			}
+		} else {
+			err = assertOrgIn(db, collectionName, *expected)
+			if err == nil {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("document %d was not replicated: %v", k, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// assertOrgIn checks that org is in the collection of db
+func assertOrgIn(db *Client, collectionName string, org Org) error {
+	var fetched Org
+	err := db.GetStruct(collectionName, Key(org.OrgId), &fetched)
+	if err != nil {
+		return err
+	}
+	if fetched != org {
+		return fmt.Errorf("expected %v, got %v", org, fetched)
+	}
+	return nil
+}
+
+// mockS3Bucket is an in memory bucket served with the S3 API, as much of it as S3ObjectStore uses. It lists two objects
+// at a time, so that listing takes more than one request.
+type mockS3Bucket struct {
+	name    string
+	objects map[string][]byte
+	numPuts int
+	sync.Mutex
+}
+
+func newMockS3Bucket(name string) *mockS3Bucket {
+	return &mockS3Bucket{name: name, objects: make(map[string][]byte)}
+}
+
+func (b *mockS3Bucket) has(name string) bool {
+	b.Lock()
+	defer b.Unlock()
+	_, ok := b.objects[name]
+	return ok
+}
+
+func (b *mockS3Bucket) getNumPuts() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.numPuts
+}
+
+func (b *mockS3Bucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || r.Header.Get("X-Amz-Date") == "" {
+		http.Error(w, "unsigned request", http.StatusForbidden)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+b.name), "/")
+
+	b.Lock()
+	defer b.Unlock()
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		prefix, after := r.URL.Query().Get("prefix"), r.URL.Query().Get("continuation-token")
+		var names []string
+		for n := range b.objects {
+			if strings.HasPrefix(n, prefix) && n > after {
+				names = append(names, n)
+			}
+		}
+		sort.Strings(names)
+		fmt.Fprint(w, "<ListBucketResult>")
+		for i, n := range names {
+			if i == 2 {
+				fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>", names[i-1])
+				break
+			}
+			fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", n)
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+	case r.Method == http.MethodGet:
+		data, ok := b.objects[name]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b.objects[name] = data
+		b.numPuts++
+	case r.Method == http.MethodDelete:
+		delete(b.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+func reloadClient() error {
+	err := GetClient().Close()
+	if err != nil {
+		return err
+	}
+	globalClient = Client{}
+	return Initialize(ClientInitOptions{
+		DocumentRoot:   documentRoot,
+		EncryptionKeys: map[string][]byte{"OrgSecret": rotatedEncryptionKey},
+	})
+}
+
+// appendJournalEntry adds an entry for k to the WAL-formatted log at path, which is never marked as done
+func appendJournalEntry(path string, seq uint64, k key.Key) error {
+	body, err := json.Marshal(map[string]interface{}{"Seq": seq, "Op": collection.WAL_OP_REINDEX, "Key": k})
+	if err != nil {
+		return err
+	}
+	record := make([]byte, 8)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(body))
+	record = append(record, body...)
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, util.FILE_PERM)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(record)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// assertSnapshotRestored checks that the collection has the mock orgs, as it did when TestSnapshots took the snapshot
+func assertSnapshotRestored(collectionName string) error {
+	client := GetClient()
+
+	for _, data := range mockOrgs {
+		var fetched Org
+		err := client.GetStruct(collectionName, Key(data.OrgId), &fetched)
+		if err != nil {
+			return err
+		}
+		if fetched != data {
+			return fmt.Errorf("Fetched data did not match expected data: \n Fetched: %v \n Expected: %v", fetched, data)
+		}
+	}
+
+	resp, err := client.Search(collectionName, "Employees:500")
+	if err != nil {
+		return err
+	}
+	return assertSearchResult(resp, 1, []string{mockOrgs[1].Name})
+}
+
+func assertRevisions(collectionName string, k Key, expectedNumbers []int, expectedOrgs []Org) error {
+	client := GetClient()
+
+	revisions, err := client.ListRevisions(collectionName, k)
+	if err != nil {
+		return err
+	}
+	if len(revisions) != len(expectedNumbers) {
+		return fmt.Errorf("expected %d revisions, got %d: %v", len(expectedNumbers), len(revisions), revisions)
+	}
+
+	for i, r := range revisions {
+		if r.Number != expectedNumbers[i] {
+			return fmt.Errorf("expected revision %d, got %d", expectedNumbers[i], r.Number)
+		}
+		data, err := client.GetRevision(collectionName, k, r.Number)
+		if err != nil {
+			return err
+		}
+		var fetched Org
+		err = json.Unmarshal(data, &fetched)
+		if err != nil {
+			return err
+		}
+		if fetched != expectedOrgs[i] {
+			return fmt.Errorf("revision %d did not match expected data: \n Fetched: %v \n Expected: %v", r.Number, fetched, expectedOrgs[i])
+		}
+	}
+
+	return nil
+}
+
+func assertVerifyProblems(report VerifyReport, expectedTypes []string) error {
+	if len(report.Problems) != len(expectedTypes) {
+		return fmt.Errorf("expected %d problems, got %d: %+v", len(expectedTypes), len(report.Problems), report.Problems)
+	}
+	for _, t := range expectedTypes {
+		var exists bool
+		for _, p := range report.Problems {
+			if p.Type == t {
+				exists = true
+			}
+		}
+		if !exists {
+			return fmt.Errorf("expected a problem of type %s but did not find it in the report: %+v", t, report.Problems)
+		}
+	}
+	return nil
+}
+
 func assertSearchResult(resp SearchResponse, expectedLength int, names []string) error {
 	if resp.NumDocuments != expectedLength {
 		return fmt.Errorf("number of results returned %d do not match the expected number %d", resp.NumDocuments, expectedLength)
@@ -643,3 +10115,39 @@ func assertSearchResult(resp SearchResponse, expectedLength int, names []string)
 
 	return nil
 }
+
+// extractTarGz extracts the tar.gz archive r into dirPath, and returns the names of the entries
+func extractTarGz(r io.Reader, dirPath string) ([]string, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return names, err
+		}
+		names = append(names, hdr.Name)
+		path := filepath.Join(dirPath, filepath.FromSlash(hdr.Name))
+		if hdr.Typeflag == tar.TypeDir {
+			err = os.MkdirAll(path, util.DIR_PERM)
+		} else {
+			err = os.MkdirAll(filepath.Dir(path), util.DIR_PERM)
+			if err == nil {
+				var data []byte
+				data, err = ioutil.ReadAll(tr)
+				if err == nil {
+					err = os.WriteFile(path, data, util.FILE_PERM)
+				}
+			}
+		}
+		if err != nil {
+			return names, err
+		}
+	}
+}
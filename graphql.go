@@ -0,0 +1,1074 @@
+package gofiledb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/key"
+)
+
+/********************************************************************************
+* G R A P H Q L
+*********************************************************************************/
+
+// A GraphQL endpoint serves queries over the collections of a client, e.g. for an admin UI. Every collection is a
+// field of the Query type, named after the collection, which returns its documents:
+//
+//	{
+//		orgs(where: {Employees_gte: 100, Country: "NZ"}, limit: 10) {
+//			Name
+//			Address { City }
+//		}
+//		first: orgs(key: 1) { Name }
+//	}
+//
+// The where argument has a field for every index of the collection: the field locator with '_' in place of the dots for
+// equality, and followed by _lt, _lte, _gt or _gte for a range. Its conditions are run as a Search, see the range
+// conditions of Search. With key, the document with that key is returned, if it exists. Without either, every document
+// of the collection is read. Up to limit documents are returned, and never more than MaxLimit.
+//
+// The schema (see GraphQLSchema) is derived from the collections of the client and their indexes, and from the Go types
+// of their documents given in GraphQLOptions.Types: the fields of a document type are those of the JSON encoding of its
+// Go type. The documents of the collections without a Go type can be queried anyway, any field that they have being
+// returned as it is, objects as JSON. Only queries are supported, read-only, without fragments, directives or
+// introspection. Selections, values and types can't be nested deeper than GRAPHQL_MAX_DEPTH, and GraphQLHandler doesn't
+// read requests larger than MaxRequestBytes.
+
+const GRAPHQL_DEFAULT_MAX_LIMIT int = 1000
+const GRAPHQL_DEFAULT_MAX_REQUEST_BYTES int64 = 1 << 20
+const GRAPHQL_MAX_DEPTH int = 64
+
+var ErrGraphQLNotSupported = fmt.Errorf("The GraphQL document is not supported, only queries without fragments or directives are")
+
+type GraphQLOptions struct {
+	// Types are the Go types of the documents of the collections (collection name -> a value of the type, e.g. Org{}), from
+	// which their GraphQL types are derived
+	Types           map[string]interface{}
+	MaxLimit        int   // defaults to GRAPHQL_DEFAULT_MAX_LIMIT
+	MaxRequestBytes int64 // the largest body of a POST, or query string of a GET, defaults to GRAPHQL_DEFAULT_MAX_REQUEST_BYTES
+}
+
+// GraphQLRequest is the body of a GraphQL request, as sent by GraphQL clients
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+type GraphQLResponse struct {
+	Data   interface{}    `json:"data"`
+	Errors []GraphQLError `json:"errors,omitempty"`
+}
+
+type GraphQLError struct {
+	Message string `json:"message"`
+}
+
+// GraphQLHandler returns an http.Handler that serves GraphQL requests, POSTed as JSON or sent with GET with the query in
+// the URL, with the schema derived from the collections of the client and opts
+func (c *Client) GraphQLHandler(opts GraphQLOptions) http.Handler {
+	maxRequestBytes := opts.MaxRequestBytes
+	if maxRequestBytes <= 0 {
+		maxRequestBytes = GRAPHQL_DEFAULT_MAX_REQUEST_BYTES
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req GraphQLRequest
+		switch r.Method {
+		case http.MethodGet:
+			if int64(len(r.URL.RawQuery)) > maxRequestBytes {
+				http.Error(w, "GraphQL request is too large", http.StatusRequestURITooLong)
+				return
+			}
+			req.Query = r.URL.Query().Get("query")
+			req.OperationName = r.URL.Query().Get("operationName")
+			if vars := r.URL.Query().Get("variables"); vars != "" {
+				err := json.Unmarshal([]byte(vars), &req.Variables)
+				if err != nil {
+					http.Error(w, "Invalid variables: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		case http.MethodPost:
+			err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes)).Decode(&req)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "GraphQL request is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Invalid GraphQL request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		resp := c.ExecuteGraphQL(r.Context(), opts, req)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// ExecuteGraphQL runs the GraphQL query of req, see GraphQLHandler
+func (c *Client) ExecuteGraphQL(ctx context.Context, opts GraphQLOptions, req GraphQLRequest) GraphQLResponse {
+	data, err := c.executeGraphQL(ctx, opts, req)
+	if err != nil {
+		return GraphQLResponse{Errors: []GraphQLError{{Message: err.Error()}}}
+	}
+	return GraphQLResponse{Data: data}
+}
+
+// GraphQLSchema returns the schema that GraphQLHandler serves with opts, in the GraphQL schema definition language
+func (c *Client) GraphQLSchema(opts GraphQLOptions) (string, error) {
+	schema, err := c.getGraphQLSchema(opts)
+	if err != nil {
+		return "", err
+	}
+	return schema.String(), nil
+}
+
+/********************************************************************************
+* G R A P H Q L  S C H E M A
+*********************************************************************************/
+
+// graphQLSchema is the schema derived from the collections of a client
+type graphQLSchema struct {
+	fields []*graphQLCollection // the fields of the Query type, by name
+	types  map[string]*graphQLType
+}
+
+// graphQLCollection is the field of the Query type for a collection
+type graphQLCollection struct {
+	fieldName      string
+	collectionName string
+	docType        *graphQLType
+	isTyped        bool                     // whether docType is derived from a Go type, rather than from the indexes
+	filters        map[string]graphQLFilter // field of the where argument -> its condition
+}
+
+type graphQLFilter struct {
+	fieldLocator string
+	operator     string // one of the QUERY_OP_ constants
+	typeName     string
+}
+
+// graphQLType is an object type
+type graphQLType struct {
+	name   string
+	fields []graphQLTypeField
+}
+
+type graphQLTypeField struct {
+	name     string
+	typeName string       // e.g. [String]
+	object   *graphQLType // the object type of the field, or of its elements, if any
+}
+
+func (t *graphQLType) getField(name string) (graphQLTypeField, bool) {
+	for _, f := range t.fields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return graphQLTypeField{}, false
+}
+
+func (c *Client) getGraphQLSchema(opts GraphQLOptions) (*graphQLSchema, error) {
+	docTypes := make(map[string]interface{}, len(opts.Types))
+	for name, docType := range opts.Types {
+		docTypes[collection.NormalizeName(name)] = docType
+	}
+
+	c.collections.RLock()
+	names := c.collections.getNames()
+	c.collections.RUnlock()
+	sort.Strings(names)
+
+	schema := &graphQLSchema{types: make(map[string]*graphQLType)}
+	for _, name := range names {
+		cl, err := c.getCollectionByName(name)
+		if err == ErrCollectionIsNotExist { // removed meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		f := &graphQLCollection{fieldName: getGraphQLName(name), collectionName: name, filters: make(map[string]graphQLFilter)}
+		fieldLocators := cl.GetIndexFieldLocators()
+		sort.Strings(fieldLocators)
+		for _, fieldLocator := range fieldLocators {
+			cl.IndexStore.RLock()
+			typeName := getGraphQLScalarName(cl.IndexStore.Store[fieldLocator].FieldType)
+			cl.IndexStore.RUnlock()
+			base := getGraphQLName(strings.ReplaceAll(fieldLocator, ".", "_"))
+			for suffix, operator := range map[string]string{
+				"":     collection.QUERY_OP_EQUAL,
+				"_lt":  collection.QUERY_OP_LESS,
+				"_lte": collection.QUERY_OP_LESS_EQUAL,
+				"_gt":  collection.QUERY_OP_GREATER,
+				"_gte": collection.QUERY_OP_GREATER_EQUAL,
+			} {
+				f.filters[base+suffix] = graphQLFilter{fieldLocator: fieldLocator, operator: operator, typeName: typeName}
+			}
+		}
+
+		if docType, ok := docTypes[name]; ok && docType != nil {
+			f.docType = schema.addGoType(reflect.TypeOf(docType))
+			f.isTyped = f.docType != nil
+		}
+		schema.fields = append(schema.fields, f)
+	}
+
+	// The types of the other collections only have the indexed fields, which are known to be there, with their types.
+	// They are named after the collection, once the names of the Go types are taken.
+	for _, f := range schema.fields {
+		if f.isTyped {
+			continue
+		}
+		t := &graphQLType{name: getGraphQLTypeName(f.collectionName) + "Document"}
+		for schema.types[t.name] != nil {
+			t.name += "_"
+		}
+		for filterName, filter := range f.filters {
+			if filter.operator == collection.QUERY_OP_EQUAL && !strings.Contains(filter.fieldLocator, ".") {
+				t.fields = append(t.fields, graphQLTypeField{name: filterName, typeName: filter.typeName})
+			}
+		}
+		sort.Slice(t.fields, func(i, j int) bool { return t.fields[i].name < t.fields[j].name })
+		schema.types[t.name] = t
+		f.docType = t
+	}
+	return schema, nil
+}
+
+// addGoType adds the object type for the struct type t to the schema, along with those of its fields, and returns it. It
+// returns nil if t isn't a struct.
+func (s *graphQLSchema) addGoType(t reflect.Type) *graphQLType {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	name := getGraphQLTypeName(t.Name())
+	if t.Name() == "" {
+		name = "Object"
+	}
+	if existing, ok := s.types[name]; ok {
+		return existing
+	}
+	gt := &graphQLType{name: name}
+	s.types[name] = gt // before the fields, for recursive types
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		fieldName := sf.Name
+		if tag := sf.Tag.Get("json"); tag != "" {
+			tagName, _, _ := strings.Cut(tag, ",")
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				fieldName = tagName
+			}
+		}
+		typeName, object := s.getGoTypeName(sf.Type)
+		gt.fields = append(gt.fields, graphQLTypeField{name: fieldName, typeName: typeName, object: object})
+	}
+	return gt
+}
+
+// getGoTypeName returns the GraphQL type of a field of the Go type t, and its object type if it has one
+func (s *graphQLSchema) getGoTypeName(t reflect.Type) (string, *graphQLType) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if object := s.addGoType(t); object != nil && t.String() != "time.Time" {
+			return object.name, object
+		}
+		return "String", nil
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 { // []byte, which is encoded as base64
+			return "String", nil
+		}
+		typeName, object := s.getGoTypeName(t.Elem())
+		return "[" + typeName + "]", object
+	case reflect.Map, reflect.Interface:
+		return "JSON", nil
+	}
+	return getGraphQLScalarName(t.Kind().String()), nil
+}
+
+// getGraphQLScalarName returns the GraphQL scalar for the reflect.Kind kind
+func getGraphQLScalarName(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"):
+		return "Int"
+	case strings.HasPrefix(kind, "float"):
+		return "Float"
+	case kind == "bool":
+		return "Boolean"
+	case kind == "string":
+		return "String"
+	}
+	return "JSON"
+}
+
+// getGraphQLName returns name with the characters that GraphQL names can't have replaced with '_'
+func getGraphQLName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if r == '_' || r < unicode.MaxASCII && (unicode.IsLetter(r) || i > 0 && unicode.IsDigit(r)) {
+			b.WriteRune(r)
+			continue
+		}
+		b.WriteRune('_')
+	}
+	return b.String()
+}
+
+func getGraphQLTypeName(name string) string {
+	name = getGraphQLName(name)
+	if name == "" {
+		return name
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+func (s *graphQLSchema) getField(name string) *graphQLCollection {
+	for _, f := range s.fields {
+		if f.fieldName == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// String returns the schema in the GraphQL schema definition language
+func (s *graphQLSchema) String() string {
+	var b strings.Builder
+	b.WriteString("scalar JSON\n\ntype Query {\n")
+	for _, f := range s.fields {
+		var where string
+		if len(f.filters) > 0 {
+			where = " where: " + getGraphQLTypeName(f.fieldName) + "Filter,"
+		}
+		fmt.Fprintf(&b, "  %s(key: Int,%s limit: Int): [%s!]!\n", f.fieldName, where, f.docType.name)
+	}
+	b.WriteString("}\n")
+
+	var typeNames []string
+	for name := range s.types {
+		typeNames = append(typeNames, name)
+	}
+	sort.Strings(typeNames)
+	for _, name := range typeNames {
+		var fields []string
+		for _, f := range s.types[name].fields {
+			fields = append(fields, f.name+": "+f.typeName)
+		}
+		writeGraphQLDefinition(&b, "type "+name, fields)
+	}
+
+	for _, f := range s.fields {
+		if len(f.filters) == 0 {
+			continue
+		}
+		var fields []string
+		for name, filter := range f.filters {
+			fields = append(fields, name+": "+filter.typeName)
+		}
+		sort.Strings(fields)
+		writeGraphQLDefinition(&b, "input "+getGraphQLTypeName(f.fieldName)+"Filter", fields)
+	}
+	return b.String()
+}
+
+// writeGraphQLDefinition writes the definition of a type with fields to b, without braces if it has no fields
+func writeGraphQLDefinition(b *strings.Builder, definition string, fields []string) {
+	b.WriteString("\n" + definition)
+	if len(fields) == 0 {
+		b.WriteString("\n")
+		return
+	}
+	b.WriteString(" {\n")
+	for _, field := range fields {
+		b.WriteString("  " + field + "\n")
+	}
+	b.WriteString("}\n")
+}
+
+/********************************************************************************
+* G R A P H Q L  E X E C U T I O N
+*********************************************************************************/
+
+// graphQLObject is an object of a response, which keeps its fields in the order they were selected in
+type graphQLObject []graphQLObjectField
+
+type graphQLObjectField struct {
+	name  string
+	value interface{}
+}
+
+func (o graphQLObject) MarshalJSON() ([]byte, error) {
+	b := []byte{'{'}
+	for i, f := range o {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		name, err := json.Marshal(f.name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		b = append(append(append(b, name...), ':'), value...)
+	}
+	return append(b, '}'), nil
+}
+
+func (c *Client) executeGraphQL(ctx context.Context, opts GraphQLOptions, req GraphQLRequest) (interface{}, error) {
+	op, err := parseGraphQL(req.Query, req.OperationName)
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]interface{}, len(op.variables))
+	for name, defaultValue := range op.variables {
+		vars[name] = defaultValue
+		if v, ok := req.Variables[name]; ok {
+			vars[name] = v
+		}
+	}
+
+	schema, err := c.getGraphQLSchema(opts)
+	if err != nil {
+		return nil, err
+	}
+	maxLimit := opts.MaxLimit
+	if maxLimit <= 0 {
+		maxLimit = GRAPHQL_DEFAULT_MAX_LIMIT
+	}
+
+	var data graphQLObject
+	for _, sel := range op.selections {
+		if sel.name == "__typename" {
+			data = append(data, graphQLObjectField{sel.responseName(), "Query"})
+			continue
+		}
+		f := schema.getField(sel.name)
+		if f == nil {
+			return nil, fmt.Errorf("Cannot query field %s on type Query", sel.name)
+		}
+		docs, err := c.resolveGraphQLCollection(ctx, f, sel, vars, maxLimit)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", sel.responseName(), err)
+		}
+		values := make([]interface{}, len(docs))
+		for i, doc := range docs {
+			values[i], err = selectGraphQLFields(doc, sel.selections, f.docType, f.isTyped)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", sel.responseName(), err)
+			}
+		}
+		data = append(data, graphQLObjectField{sel.responseName(), values})
+	}
+	return data, nil
+}
+
+// resolveGraphQLCollection returns the documents of the collection of f that the arguments of sel select
+func (c *Client) resolveGraphQLCollection(ctx context.Context, f *graphQLCollection, sel graphQLSelection, vars map[string]interface{}, maxLimit int) ([]map[string]interface{}, error) {
+	limit := maxLimit
+	var conditions []sqlCondition
+	var hasKey bool
+	var k Key
+	for name, arg := range sel.args {
+		v, err := arg.resolve(vars)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
+		switch name {
+		case "limit":
+			n, ok := getGraphQLInt(v)
+			if !ok || n < 0 {
+				return nil, fmt.Errorf("limit must be an Int >= 0")
+			}
+			if n < limit {
+				limit = n
+			}
+		case "key":
+			n, ok := getGraphQLInt(v)
+			if !ok {
+				return nil, fmt.Errorf("key must be an Int")
+			}
+			hasKey, k = true, Key(n)
+		case "where":
+			where, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("where must be an object")
+			}
+			filterNames := make([]string, 0, len(where))
+			for filterName := range where {
+				filterNames = append(filterNames, filterName)
+			}
+			sort.Strings(filterNames)
+			for _, filterName := range filterNames {
+				filter, ok := f.filters[filterName]
+				if !ok {
+					return nil, fmt.Errorf("there is no index for the filter %s", filterName)
+				}
+				value, err := getGraphQLFilterValue(where[filterName])
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", filterName, err)
+				}
+				conditions = append(conditions, sqlCondition{field: filter.fieldLocator, operator: filter.operator, value: value})
+			}
+		default:
+			return nil, fmt.Errorf("unknown argument %s", name)
+		}
+	}
+
+	q := sqlSelect{table: f.collectionName, conditions: conditions, limit: limit}
+	if !hasKey {
+		rows, err := c.runSQLSelect(ctx, q, nil)
+		if err != nil {
+			return nil, err
+		}
+		return rows.(*sqlRows).docs, nil
+	}
+
+	var doc map[string]interface{}
+	err := c.GetStructCtx(ctx, f.collectionName, k, &doc)
+	if IsNotExist(err) || limit == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The conditions still apply to the document with the key, and are checked against the indexes for it alone
+	if len(conditions) > 0 {
+		query, err := getSQLSearchQuery(conditions, nil)
+		if err != nil {
+			return nil, err
+		}
+		cl, err := c.getCollectionByName(f.collectionName)
+		if err != nil {
+			return nil, err
+		}
+		isMatch, err := cl.IsMatchCtx(ctx, key.Key(k), query)
+		if err != nil {
+			return nil, err
+		}
+		if !isMatch {
+			return nil, nil
+		}
+	}
+	return []map[string]interface{}{doc}, nil
+}
+
+// getGraphQLFilterValue returns the value of a filter as the value of a condition of a Search
+func getGraphQLFilterValue(v interface{}) (sqlValue, error) {
+	switch v := v.(type) {
+	case string:
+		return sqlValue{literal: v}, nil
+	case bool:
+		return sqlValue{literal: strconv.FormatBool(v)}, nil
+	case int64:
+		return sqlValue{literal: strconv.FormatInt(v, 10), isNumber: true}, nil
+	case float64:
+		return sqlValue{literal: strconv.FormatFloat(v, 'f', -1, 64), isNumber: true}, nil
+	}
+	return sqlValue{}, fmt.Errorf("the value %v is not supported in a filter", v)
+}
+
+func getGraphQLInt(v interface{}) (int, bool) {
+	switch v := v.(type) {
+	case int64:
+		return int(v), true
+	case float64: // from JSON variables
+		if v == float64(int(v)) {
+			return int(v), true
+		}
+	}
+	return 0, false
+}
+
+// selectGraphQLFields returns the fields of v selected by selections, v being of the object type t, or of a list of
+// it. If isTyped, only the fields of t can be selected.
+func selectGraphQLFields(v interface{}, selections []graphQLSelection, t *graphQLType, isTyped bool) (interface{}, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, elem := range v {
+			var err error
+			values[i], err = selectGraphQLFields(elem, selections, t, isTyped)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	case map[string]interface{}:
+		if len(selections) == 0 {
+			if isTyped {
+				return nil, fmt.Errorf("a field of type %s must have a selection of subfields", t.name)
+			}
+			return v, nil // as JSON
+		}
+		var obj graphQLObject
+		for _, sel := range selections {
+			if sel.name == "__typename" {
+				typeName := "JSON"
+				if t != nil {
+					typeName = t.name
+				}
+				obj = append(obj, graphQLObjectField{sel.responseName(), typeName})
+				continue
+			}
+			var fieldType *graphQLType
+			if isTyped {
+				f, ok := t.getField(sel.name)
+				if !ok {
+					return nil, fmt.Errorf("Cannot query field %s on type %s", sel.name, t.name)
+				}
+				fieldType = f.object
+			}
+			value, err := selectGraphQLFields(v[sel.name], sel.selections, fieldType, isTyped)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, graphQLObjectField{sel.responseName(), value})
+		}
+		return obj, nil
+	}
+	if len(selections) > 0 {
+		return nil, fmt.Errorf("a scalar field can't have a selection of subfields")
+	}
+	return v, nil
+}
+
+/********************************************************************************
+* G R A P H Q L  P A R S E R
+*********************************************************************************/
+
+// graphQLOperation is the operation of a GraphQL document that is run
+type graphQLOperation struct {
+	variables  map[string]interface{} // name -> default value
+	selections []graphQLSelection
+}
+
+type graphQLSelection struct {
+	alias      string
+	name       string
+	args       map[string]graphQLValue
+	selections []graphQLSelection
+}
+
+func (s graphQLSelection) responseName() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+// graphQLValue is a value in a GraphQL document: a variable, a constant, or a list or object of values
+type graphQLValue struct {
+	variable string
+	constant interface{}
+	list     []graphQLValue
+	object   map[string]graphQLValue
+	isList   bool
+}
+
+// resolve returns the value with the variables in it replaced with their values in vars
+func (v graphQLValue) resolve(vars map[string]interface{}) (interface{}, error) {
+	switch {
+	case v.variable != "":
+		value, ok := vars[v.variable]
+		if !ok {
+			return nil, fmt.Errorf("variable $%s is not defined", v.variable)
+		}
+		return value, nil
+	case v.isList:
+		values := make([]interface{}, len(v.list))
+		for i, elem := range v.list {
+			var err error
+			values[i], err = elem.resolve(vars)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	case v.object != nil:
+		values := make(map[string]interface{}, len(v.object))
+		for name, field := range v.object {
+			var err error
+			values[name], err = field.resolve(vars)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return v.constant, nil
+}
+
+type graphQLToken struct {
+	kind rune // 'n' for names, 'i' for ints, 'f' for floats, 's' for strings, or the punctuator
+	text string
+}
+
+type graphQLParser struct {
+	tokens []graphQLToken
+	pos    int
+	depth  int // of the selection sets, values and types being parsed, see enter
+}
+
+// parseGraphQL parses the GraphQL document query, and returns its operation named operationName, or its only one
+func parseGraphQL(query string, operationName string) (graphQLOperation, error) {
+	tokens, err := tokenizeGraphQL(query)
+	if err != nil {
+		return graphQLOperation{}, err
+	}
+	p := &graphQLParser{tokens: tokens}
+
+	var ops []graphQLOperation
+	var names []string
+	for p.pos < len(p.tokens) {
+		op := graphQLOperation{variables: make(map[string]interface{})}
+		var name string
+		if p.peek().kind == 'n' {
+			switch p.next().text {
+			case "query":
+			case "fragment":
+				return op, fmt.Errorf("%w: fragments are not supported", ErrGraphQLNotSupported)
+			default:
+				return op, fmt.Errorf("%w: only queries are supported", ErrGraphQLNotSupported)
+			}
+			if p.peek().kind == 'n' {
+				name = p.next().text
+			}
+			if p.accept('(') {
+				for !p.accept(')') {
+					if !p.accept('$') || p.peek().kind != 'n' {
+						return op, p.errorf("expected a variable")
+					}
+					varName := p.next().text
+					if !p.accept(':') {
+						return op, p.errorf("expected the type of $%s", varName)
+					}
+					err = p.skipType()
+					if err != nil {
+						return op, err
+					}
+					op.variables[varName] = nil
+					if p.accept('=') {
+						v, err := p.value(true)
+						if err != nil {
+							return op, err
+						}
+						op.variables[varName], _ = v.resolve(nil)
+					}
+				}
+			}
+		}
+		op.selections, err = p.selectionSet()
+		if err != nil {
+			return op, err
+		}
+		ops = append(ops, op)
+		names = append(names, name)
+	}
+
+	for i, op := range ops {
+		if names[i] == operationName || operationName == "" && len(ops) == 1 {
+			return op, nil
+		}
+	}
+	if operationName == "" {
+		return graphQLOperation{}, fmt.Errorf("the document has %d operations, operationName must tell which one to run", len(ops))
+	}
+	return graphQLOperation{}, fmt.Errorf("there is no operation named %s", operationName)
+}
+
+func (p *graphQLParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Syntax Error: %s", fmt.Sprintf(format, args...))
+}
+
+// enter is called as a selection set, value or type starts, with leave deferred, and returns an error if they are then
+// nested deeper than GRAPHQL_MAX_DEPTH, before the recursion can run out of stack
+func (p *graphQLParser) enter() error {
+	p.depth++
+	if p.depth > GRAPHQL_MAX_DEPTH {
+		return p.errorf("the document is nested deeper than %d levels", GRAPHQL_MAX_DEPTH)
+	}
+	return nil
+}
+
+func (p *graphQLParser) leave() {
+	p.depth--
+}
+
+func (p *graphQLParser) peek() graphQLToken {
+	if p.pos >= len(p.tokens) {
+		return graphQLToken{}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *graphQLParser) next() graphQLToken {
+	t := p.peek()
+	if p.pos < len(p.tokens) {
+		p.pos++
+	}
+	return t
+}
+
+// accept moves past the next token if it is the punctuator r
+func (p *graphQLParser) accept(r rune) bool {
+	if p.peek().kind == r {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// skipType moves past a type, e.g. [Int!]!, since the types of the variables are not checked
+func (p *graphQLParser) skipType() error {
+	err := p.enter()
+	defer p.leave()
+	if err != nil {
+		return err
+	}
+	if p.accept('[') {
+		err := p.skipType()
+		if err != nil {
+			return err
+		}
+		if !p.accept(']') {
+			return p.errorf("expected ]")
+		}
+	} else if p.next().kind != 'n' {
+		return p.errorf("expected a type")
+	}
+	p.accept('!')
+	return nil
+}
+
+func (p *graphQLParser) selectionSet() ([]graphQLSelection, error) {
+	err := p.enter()
+	defer p.leave()
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept('{') {
+		return nil, p.errorf("expected {")
+	}
+	var selections []graphQLSelection
+	for !p.accept('}') {
+		switch p.peek().kind {
+		case '.':
+			return nil, fmt.Errorf("%w: fragments are not supported", ErrGraphQLNotSupported)
+		case 'n':
+		default:
+			return nil, p.errorf("expected a field")
+		}
+		sel := graphQLSelection{name: p.next().text}
+		if p.accept(':') {
+			if p.peek().kind != 'n' {
+				return nil, p.errorf("expected a field after the alias %s", sel.name)
+			}
+			sel.alias, sel.name = sel.name, p.next().text
+		}
+		if p.accept('(') {
+			sel.args = make(map[string]graphQLValue)
+			for !p.accept(')') {
+				if p.peek().kind != 'n' {
+					return nil, p.errorf("expected an argument")
+				}
+				name := p.next().text
+				if !p.accept(':') {
+					return nil, p.errorf("expected the value of %s", name)
+				}
+				v, err := p.value(false)
+				if err != nil {
+					return nil, err
+				}
+				sel.args[name] = v
+			}
+		}
+		if p.peek().kind == '@' {
+			return nil, fmt.Errorf("%w: directives are not supported", ErrGraphQLNotSupported)
+		}
+		if p.peek().kind == '{' {
+			sel.selections, err = p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+		}
+		selections = append(selections, sel)
+	}
+	return selections, nil
+}
+
+// value parses a value, which can't have variables in it if isConst
+func (p *graphQLParser) value(isConst bool) (graphQLValue, error) {
+	err := p.enter()
+	defer p.leave()
+	if err != nil {
+		return graphQLValue{}, err
+	}
+	t := p.next()
+	switch t.kind {
+	case '$':
+		if isConst || p.peek().kind != 'n' {
+			return graphQLValue{}, p.errorf("unexpected $")
+		}
+		return graphQLValue{variable: p.next().text}, nil
+	case 'i':
+		n, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return graphQLValue{}, p.errorf("invalid Int %s", t.text)
+		}
+		return graphQLValue{constant: n}, nil
+	case 'f':
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return graphQLValue{}, p.errorf("invalid Float %s", t.text)
+		}
+		return graphQLValue{constant: f}, nil
+	case 's':
+		return graphQLValue{constant: t.text}, nil
+	case 'n':
+		switch t.text {
+		case "true", "false":
+			return graphQLValue{constant: t.text == "true"}, nil
+		case "null":
+			return graphQLValue{}, nil
+		}
+		return graphQLValue{constant: t.text}, nil // an enum value
+	case '[':
+		v := graphQLValue{isList: true}
+		for !p.accept(']') {
+			elem, err := p.value(isConst)
+			if err != nil {
+				return v, err
+			}
+			v.list = append(v.list, elem)
+		}
+		return v, nil
+	case '{':
+		v := graphQLValue{object: make(map[string]graphQLValue)}
+		for !p.accept('}') {
+			if p.peek().kind != 'n' {
+				return v, p.errorf("expected a field")
+			}
+			name := p.next().text
+			if !p.accept(':') {
+				return v, p.errorf("expected the value of %s", name)
+			}
+			field, err := p.value(isConst)
+			if err != nil {
+				return v, err
+			}
+			v.object[name] = field
+		}
+		return v, nil
+	}
+	return graphQLValue{}, p.errorf("expected a value")
+}
+
+// tokenizeGraphQL splits query into names, numbers, strings and punctuators, leaving out the white space, commas and
+// comments
+func tokenizeGraphQL(query string) ([]graphQLToken, error) {
+	var tokens []graphQLToken
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r) || r == ',' || r == '\uFEFF':
+			i++
+
+		case r == '#':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+
+		case r == '.':
+			if i+2 >= len(runes) || runes[i+1] != '.' || runes[i+2] != '.' {
+				return nil, fmt.Errorf("Syntax Error: unexpected .")
+			}
+			tokens = append(tokens, graphQLToken{kind: '.', text: "..."})
+			i += 3
+
+		case strings.ContainsRune("!$():=@[]{}|&", r):
+			tokens = append(tokens, graphQLToken{kind: r, text: string(r)})
+			i++
+
+		case r == '_' || r < unicode.MaxASCII && unicode.IsLetter(r):
+			j := i
+			for j < len(runes) && (runes[j] == '_' || runes[j] < unicode.MaxASCII && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]))) {
+				j++
+			}
+			tokens = append(tokens, graphQLToken{kind: 'n', text: string(runes[i:j])})
+			i = j
+
+		case r == '-' || unicode.IsDigit(r):
+			j, kind := i+1, 'i'
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || strings.ContainsRune(".eE+-", runes[j])) {
+				if !unicode.IsDigit(runes[j]) {
+					kind = 'f'
+				}
+				j++
+			}
+			tokens = append(tokens, graphQLToken{kind: kind, text: string(runes[i:j])})
+			i = j
+
+		case r == '"':
+			// The string is decoded as a JSON string, which has the same escapes
+			j := i + 1
+			for j < len(runes) && runes[j] != '"' && runes[j] != '\n' {
+				if runes[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(runes) || runes[j] != '"' {
+				return nil, fmt.Errorf("Syntax Error: unterminated string")
+			}
+			var s string
+			err := json.Unmarshal([]byte(string(runes[i:j+1])), &s)
+			if err != nil {
+				return nil, fmt.Errorf("Syntax Error: invalid string %s", string(runes[i:j+1]))
+			}
+			tokens = append(tokens, graphQLToken{kind: 's', text: s})
+			i = j + 1
+
+		default:
+			return nil, fmt.Errorf("Syntax Error: unexpected %c", r)
+		}
+	}
+	return tokens, nil
+}
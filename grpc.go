@@ -0,0 +1,284 @@
+package gofiledb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/teejays/gofiledb/grpcpb"
+	"github.com/teejays/gofiledb/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io/fs"
+	"net"
+)
+
+/********************************************************************************
+* G R P C
+*********************************************************************************/
+
+//go:generate protoc --go_out=grpcpb --go_opt=paths=source_relative --go-grpc_out=grpcpb --go-grpc_opt=paths=source_relative gofiledb.proto
+
+// ServeGRPC serves the Warehouse service of gofiledb.proto, so that other services, in any language, and remote processes
+// can use the warehouse without mounting its dir. GRPCClient is its client for Go programs:
+//
+//	go client.ServeGRPC(l)
+//	...
+//	remote, err := NewGRPCClient("10.0.0.1:7070")
+//	data, err := remote.Get(ctx, "Orders", 42)
+//
+// The server and the client are generated from gofiledb.proto into the grpcpb package, with protoc-gen-go and
+// protoc-gen-go-grpc (see go generate), and use grpc-go without compression. TLS and authentication are set up with the
+// grpc.ServerOption and grpc.DialOption given to ServeGRPC and NewGRPCClient, e.g. grpc.Creds and interceptors. Without
+// them, the service is served and called without TLS, and should only be reachable from the network it is meant for,
+// since there is no authentication. Errors are sent as gRPC status codes, with the Kind of the error (see Error) in the
+// gofiledb-error-kind trailer, so that GRPCClient can return errors that errors.Is sees as ErrDocNotExist,
+// ErrCollectionNotExist, etc.
+
+const GRPC_MAX_MESSAGE_SIZE int = 16 << 20
+
+// the trailer with the kind of the error of a call
+const grpcErrorKindKey string = "gofiledb-error-kind"
+
+// the values of the gofiledb-error-kind trailer
+var grpcErrorKinds = map[string]error{
+	"doc_not_exist":        ErrDocNotExist,
+	"collection_not_exist": ErrCollectionNotExist,
+	"index_exists":         ErrIndexExists,
+	"decode":               ErrDecode,
+	"corrupt":              ErrCorrupt,
+	"read_only":            ErrClientIsReadOnly,
+}
+
+// GRPCError is the error of a call that the server answered with a gRPC status other than OK
+type GRPCError struct {
+	Code    codes.Code
+	Message string
+	Kind    error // ErrDocNotExist, ErrCollectionNotExist, ErrIndexExists, ErrDecode, ErrCorrupt, ErrClientIsReadOnly or nil
+}
+
+func (e *GRPCError) Error() string {
+	return fmt.Sprintf("gRPC status %s: %s", e.Code, e.Message)
+}
+
+// Unwrap returns the Kind of e, along with fs.ErrNotExist for ErrDocNotExist so that IsNotExist sees it
+func (e *GRPCError) Unwrap() []error {
+	switch e.Kind {
+	case nil:
+		return nil
+	case ErrDocNotExist:
+		return []error{e.Kind, fs.ErrNotExist}
+	}
+	return []error{e.Kind}
+}
+
+/********************************************************************************
+* G R P C  S E R V E R
+*********************************************************************************/
+
+// grpcWarehouse serves the Warehouse service for a client, see ServeGRPC
+type grpcWarehouse struct {
+	grpcpb.UnimplementedWarehouseServer
+	c *Client
+}
+
+// ServeGRPC serves the Warehouse service to the connections accepted from l, until l is closed. The connections are then
+// closed as well, and it returns nil. opts are passed to grpc.NewServer, after the defaults of the message sizes, e.g.
+// grpc.Creds for TLS.
+func (c *Client) ServeGRPC(l net.Listener, opts ...grpc.ServerOption) error {
+	opts = append([]grpc.ServerOption{grpc.MaxRecvMsgSize(GRPC_MAX_MESSAGE_SIZE), grpc.MaxSendMsgSize(GRPC_MAX_MESSAGE_SIZE)}, opts...)
+	srv := grpc.NewServer(opts...)
+	grpcpb.RegisterWarehouseServer(srv, &grpcWarehouse{c: c})
+	err := srv.Serve(l)
+	srv.Stop()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (w *grpcWarehouse) Get(ctx context.Context, req *grpcpb.GetRequest) (*grpcpb.GetResponse, error) {
+	data, err := w.c.GetCtx(ctx, req.GetCollection(), Key(req.GetKey()))
+	if err != nil {
+		return nil, getGRPCStatusError(ctx, err)
+	}
+	return &grpcpb.GetResponse{Data: data}, nil
+}
+
+func (w *grpcWarehouse) Set(ctx context.Context, req *grpcpb.SetRequest) (*grpcpb.SetResponse, error) {
+	err := w.c.SetCtx(ctx, req.GetCollection(), Key(req.GetKey()), req.GetData())
+	if err != nil {
+		return nil, getGRPCStatusError(ctx, err)
+	}
+	return &grpcpb.SetResponse{}, nil
+}
+
+func (w *grpcWarehouse) Delete(ctx context.Context, req *grpcpb.DeleteRequest) (*grpcpb.DeleteResponse, error) {
+	err := w.c.DeleteCtx(ctx, req.GetCollection(), Key(req.GetKey()))
+	if err != nil {
+		return nil, getGRPCStatusError(ctx, err)
+	}
+	return &grpcpb.DeleteResponse{}, nil
+}
+
+// Search answers with the documents that match the query, each encoded as JSON
+func (w *grpcWarehouse) Search(ctx context.Context, req *grpcpb.SearchRequest) (*grpcpb.SearchResponse, error) {
+	result, err := w.c.SearchCtx(ctx, req.GetCollection(), req.GetQuery())
+	if err != nil {
+		return nil, getGRPCStatusError(ctx, err)
+	}
+	resp := &grpcpb.SearchResponse{}
+	for _, doc := range result.Result {
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return nil, getGRPCStatusError(ctx, err)
+		}
+		resp.Documents = append(resp.Documents, data)
+	}
+	return resp, nil
+}
+
+func (w *grpcWarehouse) AddIndex(ctx context.Context, req *grpcpb.AddIndexRequest) (*grpcpb.AddIndexResponse, error) {
+	err := w.c.AddIndexCtx(ctx, req.GetCollection(), req.GetFieldLocator())
+	if err != nil {
+		return nil, getGRPCStatusError(ctx, err)
+	}
+	return &grpcpb.AddIndexResponse{}, nil
+}
+
+func (w *grpcWarehouse) ListCollections(ctx context.Context, req *grpcpb.ListCollectionsRequest) (*grpcpb.ListCollectionsResponse, error) {
+	w.c.collections.RLock()
+	defer w.c.collections.RUnlock()
+	return &grpcpb.ListCollectionsResponse{Names: w.c.collections.getNames()}, nil
+}
+
+// getGRPCStatusError returns the status error that the call of ctx answers with for err, and sets the
+// gofiledb-error-kind trailer of the call to the kind of err
+func getGRPCStatusError(ctx context.Context, err error) error {
+	for name, kind := range grpcErrorKinds {
+		if errors.Is(err, kind) {
+			trailerErr := grpc.SetTrailer(ctx, metadata.Pairs(grpcErrorKindKey, name))
+			if trailerErr != nil {
+				util.Warnf("Could not set the error kind of a gRPC call: %s", trailerErr)
+			}
+		}
+	}
+	return status.Error(getGRPCCode(err), err.Error())
+}
+
+// getGRPCCode returns the gRPC status code for err
+func getGRPCCode(err error) codes.Code {
+	switch {
+	case err == nil:
+		return codes.OK
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	case errors.Is(err, ErrCollectionIsNotExist), IsNotExist(err):
+		return codes.NotFound
+	case errors.Is(err, ErrIndexExists):
+		return codes.AlreadyExists
+	case errors.Is(err, ErrClientIsReadOnly):
+		return codes.FailedPrecondition
+	case errors.Is(err, ErrDecode):
+		return codes.InvalidArgument
+	case errors.Is(err, ErrCorrupt), getErrorKind(err) == ErrCorrupt:
+		return codes.DataLoss
+	}
+	return codes.Unknown
+}
+
+/********************************************************************************
+* G R P C  C L I E N T
+*********************************************************************************/
+
+// GRPCClient calls the Warehouse service of a client served with ServeGRPC. It is safe for concurrent use, and its calls
+// share a single HTTP/2 connection.
+type GRPCClient struct {
+	conn      *grpc.ClientConn
+	warehouse grpcpb.WarehouseClient
+}
+
+// NewGRPCClient returns a GRPCClient for the service at addr, e.g. "10.0.0.1:7070". It connects on the first call. opts
+// are passed to grpc.NewClient, and need to include the transport credentials, e.g. grpc.WithTransportCredentials with
+// credentials.NewTLS. Without any opts, the connection doesn't use TLS.
+func NewGRPCClient(addr string, opts ...grpc.DialOption) (*GRPCClient, error) {
+	if len(opts) == 0 {
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	opts = append([]grpc.DialOption{
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(GRPC_MAX_MESSAGE_SIZE), grpc.MaxCallSendMsgSize(GRPC_MAX_MESSAGE_SIZE)),
+		grpc.WithChainUnaryInterceptor(interceptGRPCError), // chained, so that an interceptor in opts doesn't replace it
+	}, opts...)
+	conn, err := grpc.NewClient(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &GRPCClient{conn: conn, warehouse: grpcpb.NewWarehouseClient(conn)}, nil
+}
+
+// Close closes the connection to the service
+func (g *GRPCClient) Close() error {
+	return g.conn.Close()
+}
+
+func (g *GRPCClient) Get(ctx context.Context, collectionName string, k Key) ([]byte, error) {
+	resp, err := g.warehouse.Get(ctx, &grpcpb.GetRequest{Collection: collectionName, Key: int64(k)})
+	return resp.GetData(), err
+}
+
+func (g *GRPCClient) Set(ctx context.Context, collectionName string, k Key, data []byte) error {
+	_, err := g.warehouse.Set(ctx, &grpcpb.SetRequest{Collection: collectionName, Key: int64(k), Data: data})
+	return err
+}
+
+func (g *GRPCClient) Delete(ctx context.Context, collectionName string, k Key) error {
+	_, err := g.warehouse.Delete(ctx, &grpcpb.DeleteRequest{Collection: collectionName, Key: int64(k)})
+	return err
+}
+
+// Search returns the documents that match query, each encoded as JSON
+func (g *GRPCClient) Search(ctx context.Context, collectionName string, query string) ([]json.RawMessage, error) {
+	resp, err := g.warehouse.Search(ctx, &grpcpb.SearchRequest{Collection: collectionName, Query: query})
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]json.RawMessage, len(resp.GetDocuments()))
+	for i, doc := range resp.GetDocuments() {
+		docs[i] = doc
+	}
+	return docs, nil
+}
+
+func (g *GRPCClient) AddIndex(ctx context.Context, collectionName string, fieldLocator string) error {
+	_, err := g.warehouse.AddIndex(ctx, &grpcpb.AddIndexRequest{Collection: collectionName, FieldLocator: fieldLocator})
+	return err
+}
+
+func (g *GRPCClient) ListCollections(ctx context.Context) ([]string, error) {
+	resp, err := g.warehouse.ListCollections(ctx, &grpcpb.ListCollectionsRequest{})
+	return resp.GetNames(), err
+}
+
+// interceptGRPCError turns the status error of a call into a *GRPCError, with the kind from the gofiledb-error-kind
+// trailer
+func interceptGRPCError(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	var trailer metadata.MD
+	err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Trailer(&trailer))...)
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	var kind error
+	if values := trailer.Get(grpcErrorKindKey); len(values) > 0 {
+		kind = grpcErrorKinds[values[0]]
+	}
+	return &GRPCError{Code: st.Code(), Message: st.Message(), Kind: kind}
+}
@@ -0,0 +1,155 @@
+package gofiledb
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/util"
+	"io"
+	"syscall"
+	"time"
+)
+
+/********************************************************************************
+* H E A L T H
+*********************************************************************************/
+
+// Health runs a few quick checks on a client, and reports whether it is in a state to serve requests. It is meant to be
+// called from the health check endpoint of an application, e.g.:
+//
+//	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+//		report := client.Health()
+//		if !report.Healthy {
+//			w.WriteHeader(http.StatusServiceUnavailable)
+//		}
+//		json.NewEncoder(w).Encode(report)
+//	})
+//
+// None of the checks change any data, and they take about as long as a Count of every collection.
+
+const (
+	HEALTH_CHECK_WRITABLE          string = "writable"
+	HEALTH_CHECK_DISK_SPACE        string = "disk_space"
+	HEALTH_CHECK_META              string = "meta"
+	HEALTH_CHECK_COLLECTION_PREFIX string = "collection:" // followed by the name of the collection
+)
+
+const DEFAULT_HEALTH_MIN_FREE_BYTES uint64 = 100 << 20
+
+// HealthReport is the result of Health
+type HealthReport struct {
+	Healthy   bool // true if all the checks passed
+	CheckedAt time.Time
+	Checks    []HealthCheck
+}
+
+// HealthCheck is the result of one of the checks of Health
+type HealthCheck struct {
+	Name     string // one of the HEALTH_CHECK_ constants
+	Healthy  bool
+	Detail   string // e.g. the free disk space, or the number of documents in a collection
+	Error    string // why the check failed
+	Duration time.Duration
+}
+
+// Health checks that the document root is writable, that there is enough free disk space in it (see
+// ClientInitOptions.HealthMinFreeBytes), that the client meta can be read, and that every collection can be counted.
+func (c *Client) Health() HealthReport {
+	report := HealthReport{Healthy: true, CheckedAt: time.Now()}
+	add := func(name string, fn func() (string, error)) {
+		start := time.Now()
+		detail, err := fn()
+		check := HealthCheck{Name: name, Healthy: err == nil, Detail: detail, Duration: time.Since(start)}
+		if err != nil {
+			check.Error = err.Error()
+			report.Healthy = false
+		}
+		report.Checks = append(report.Checks, check)
+	}
+
+	add(HEALTH_CHECK_WRITABLE, c.checkWritable)
+	add(HEALTH_CHECK_DISK_SPACE, c.checkDiskSpace)
+	add(HEALTH_CHECK_META, c.checkMeta)
+
+	c.collections.RLock()
+	names := c.collections.getNames()
+	c.collections.RUnlock()
+
+	for _, name := range names {
+		name := name
+		add(HEALTH_CHECK_COLLECTION_PREFIX+name, func() (string, error) {
+			n, err := c.Count(name)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%d documents", n), nil
+		})
+	}
+
+	return report
+}
+
+// checkWritable writes, syncs and removes a temp file in the meta dir. Read-only clients only check that the dir can be
+// listed.
+func (c *Client) checkWritable() (string, error) {
+	dirPath := util.JoinPath(c.getDocumentRoot(), util.META_DIR_NAME)
+	if c.isReadOnly() {
+		_, err := util.ReadDir(c.fs(), dirPath)
+		if err != nil {
+			return "", err
+		}
+		return "read-only client, the document root is readable", nil
+	}
+
+	file, err := util.TempFile(c.fs(), dirPath, collection.TEMP_FILE_PREFIX+"health")
+	if err != nil {
+		return "", err
+	}
+	defer c.fs().Remove(file.Name())
+	_, err = io.WriteString(file, "ok")
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+// checkDiskSpace checks the free space of the file system of the document root. It can only be checked for the local
+// file system.
+func (c *Client) checkDiskSpace() (string, error) {
+	if _, ok := c.fs().(OSFS); !ok {
+		return "not checked, the client does not use the local file system", nil
+	}
+
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(c.getDocumentRoot(), &stat)
+	if err != nil {
+		return "", err
+	}
+	free := stat.Bavail * uint64(stat.Bsize)
+
+	minFree := c.healthMinFreeBytes
+	if minFree == 0 {
+		minFree = DEFAULT_HEALTH_MIN_FREE_BYTES
+	}
+	detail := fmt.Sprintf("%d bytes free", free)
+	if free < minFree {
+		return detail, fmt.Errorf("only %d bytes free, below the minimum of %d", free, minFree)
+	}
+	return detail, nil
+}
+
+// checkMeta reads the client meta from disk, without using what is read
+func (c *Client) checkMeta() (string, error) {
+	var client Client
+	err := c.getMeta("globalClient.gob", &client)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d collections", len(client.collections.getNames())), nil
+}
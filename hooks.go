@@ -0,0 +1,93 @@
+package gofiledb
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/********************************************************************************
+* H O O K S
+*********************************************************************************/
+
+// Middleware can be added to a client with Use, to run code before and after its Set, Get, Delete and Search operations
+// (including their Struct and Ctx variants), e.g. for auditing, validation, metrics, or to encrypt data on its way in
+// and decrypt it on its way out. A Middleware gets the Handler that does the rest of the work (which may be another
+// Middleware), and returns the Handler to use instead:
+//
+//	client.Use(func(next Handler) Handler {
+//		return func(ctx context.Context, op *Op) error {
+//			start := time.Now()
+//			err := next(ctx, op)
+//			log.Printf("%s %s/%d took %s", op.Type, op.Collection, op.Key, time.Since(start))
+//			return err
+//		}
+//	})
+//
+// A Handler can change the Op before passing it on, e.g. the Data of a Set, and after it has been carried out, e.g. the
+// Data of a Get. It can also not pass it on at all, and return an error instead.
+
+const (
+	OP_SET    string = "set"
+	OP_GET    string = "get"
+	OP_DELETE string = "delete"
+	OP_SEARCH string = "search"
+)
+
+// Op describes an operation on a collection, as seen by Middleware
+type Op struct {
+	Type       string // one of the OP_ constants
+	Collection string
+	Key        Key    // not set for searches
+	Query      string // only set for searches
+	// For a Set, the data to write. For a Get, the data that was read, once the Op has been carried out. Not set for
+	// the Struct variants, which use Value instead.
+	Data []byte
+	// For SetStruct, the value to write. For GetStruct, the value that the document is decoded into.
+	Value  interface{}
+	Result []interface{} // for a Search, the documents found, once the Op has been carried out
+	TTL    time.Duration // for the WithTTL variants of Set, the time after which the document expires
+}
+
+// Handler carries out an Op
+type Handler func(ctx context.Context, op *Op) error
+
+// Middleware wraps the Handler of the operations of a client, see Use
+type Middleware func(next Handler) Handler
+
+type hookStore struct {
+	middlewares []Middleware
+	sync.RWMutex
+}
+
+// Use adds mw to the Middleware that the operations of the client go through. The Middleware added first is the
+// outermost one, i.e. it sees an Op first on its way in, and last on its way out.
+func (c *Client) Use(mw ...Middleware) {
+	if c.hooks == nil {
+		return
+	}
+	c.hooks.Lock()
+	defer c.hooks.Unlock()
+	c.hooks.middlewares = append(c.hooks.middlewares, mw...)
+}
+
+// runOp carries out op with fn, through all the Middleware of the client. Its error is an *Error, see newError.
+func (c *Client) runOp(ctx context.Context, op *Op, fn Handler) error {
+	start := time.Now()
+	ctx, span := c.startOpSpan(ctx, op)
+	h := fn
+	if c.hooks != nil {
+		c.hooks.RLock()
+		middlewares := c.hooks.middlewares
+		c.hooks.RUnlock()
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			h = middlewares[i](h)
+		}
+	}
+
+	err := newError(op, h(ctx, op))
+	c.metrics.observe(op, err, time.Since(start))
+	countExpvarOp(op, err)
+	endOpSpan(span, op, err)
+	return err
+}
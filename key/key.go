@@ -9,6 +9,7 @@ import (
 const (
 	DATA_PARTITION_PREFIX string = "partition_"
 	DOC_FILE_NAME_PREFIX  string = "doc_"
+	GZIP_FILE_EXTENSION   string = ".gz"
 )
 
 /********************************************************************************
@@ -33,21 +34,25 @@ func (k Key) GetPartitionHash(numPartitions int) string {
 func (k Key) GetFileName(collectionName string, enableGzip bool) string {
 	fileName := collectionName + "_" + DOC_FILE_NAME_PREFIX + k.String()
 	if enableGzip {
-		fileName += ".gz"
+		fileName += GZIP_FILE_EXTENSION
 	}
 	return fileName
 }
 
+// ParseKey is the reverse of Key.String()
+func ParseKey(s string) (Key, error) {
+	keyInt, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return Key(keyInt), nil
+}
+
 func GetKeyFromFileName(fileName string) (Key, error) {
 	var k Key
 	parts := strings.Split(fileName, DOC_FILE_NAME_PREFIX)
 	if len(parts) != 2 {
 		return k, fmt.Errorf("Screw you Talha. Check how you get Key from filenames.")
 	}
-	keyInt, err := strconv.ParseInt(parts[1], 10, 64)
-	if err != nil {
-		return k, err
-	}
-	k = Key(keyInt)
-	return k, nil
+	return ParseKey(strings.TrimSuffix(parts[1], GZIP_FILE_EXTENSION))
 }
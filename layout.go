@@ -0,0 +1,351 @@
+package gofiledb
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/********************************************************************************
+* L A Y O U T  V E R S I O N S
+*********************************************************************************/
+
+// The way a warehouse is laid out on disk changes from time to time. The version of the layout of a document root is
+// recorded in its meta (LAYOUT_META_NAME), and when a client (or a database) is initialized on a document root with an
+// older layout, the migrations up to LAYOUT_VERSION are run on it, in order. A document root with a newer layout than
+// this version of GoFileDb knows is not loaded at all, rather than being misread.
+//
+// Versions:
+//	0: the client meta only has the params in it, so the collections are only known from their dirs under the data dir.
+//	   The index files of a collection may be in its indexes dir, rather than in meta/indexes.
+//	1: warehouses written before the layout version was recorded. Document files written before document headers were
+//	   introduced don't have one.
+//	2: every document file has a header.
+//	3: the collections are encoded separately in the client meta, so that they can be loaded lazily.
+//
+// Read-only clients don't run migrations, since they can't write. Older layouts can still be read.
+
+const LAYOUT_VERSION int = 3
+const LAYOUT_META_NAME string = "layout.gob"
+
+var ErrLayoutIsNewer = fmt.Errorf("The document root has been written by a newer version of GoFileDb, with a layout that this version can't read")
+
+type layoutInfo struct {
+	Version int
+}
+
+type layoutMigration struct {
+	toVersion   int
+	description string
+	run         func(c *Client) error
+}
+
+var layoutMigrations = []layoutMigration{
+	{toVersion: 1, description: "register the collections that are only known from their dirs", run: (*Client).registerLegacyCollections},
+	{toVersion: 2, description: "add a header to the document files that don't have one", run: (*Client).addMissingDocHeaders},
+	{toVersion: 3, description: "encode the collections separately in the client meta", run: (*Client).save},
+}
+
+// checkLayoutVersion returns the layout version of the document root, or ErrLayoutIsNewer if it is newer than
+// LAYOUT_VERSION
+func (c *Client) checkLayoutVersion() (int, error) {
+	var info layoutInfo
+	err := c.getMeta(LAYOUT_META_NAME, &info)
+	if os.IsNotExist(err) { // written before layout versions were recorded, or not written at all yet
+		if c.isParamsOnlyMeta() {
+			return 0, nil
+		}
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if info.Version > LAYOUT_VERSION {
+		util.Errorf("The layout of %s is version %d, but this version of GoFileDb only knows up to version %d", c.documentRoot, info.Version, LAYOUT_VERSION)
+		return info.Version, ErrLayoutIsNewer
+	}
+	return info.Version, nil
+}
+
+// isParamsOnlyMeta tells whether the client meta only has the params in it, as it had before layout version 1
+func (c *Client) isParamsOnlyMeta() bool {
+	var params ClientParams
+	return c.getMeta("globalClient.gob", &params) == nil
+}
+
+func (c *Client) setLayoutVersion(version int) error {
+	return c.setMeta(LAYOUT_META_NAME, layoutInfo{Version: version})
+}
+
+// migrateLayout runs the migrations from version, the current layout version of the document root, up to LAYOUT_VERSION.
+// The version is saved after each migration, so an interrupted one is run again the next time. Migrations are written
+// so that running them again is harmless.
+func (c *Client) migrateLayout(version int) error {
+	if version >= LAYOUT_VERSION {
+		return nil
+	}
+	if c.isReadOnly() {
+		util.Warnf("The layout of %s is version %d, and will be migrated to version %d once it is opened by a client that isn't read-only", c.documentRoot, version, LAYOUT_VERSION)
+		return nil
+	}
+
+	for _, m := range layoutMigrations {
+		if m.toVersion <= version {
+			continue
+		}
+		util.Warnf("Migrating the layout of %s to version %d: %s", c.documentRoot, m.toVersion, m.description)
+		err := m.run(c)
+		if err != nil {
+			return fmt.Errorf("could not migrate the layout of %s to version %d (%s): %w", c.documentRoot, m.toVersion, m.description, err)
+		}
+		err = c.setLayoutVersion(m.toVersion)
+		if err != nil {
+			return err
+		}
+		version = m.toVersion
+	}
+	return nil
+}
+
+/*** Migrations ***/
+
+func (c *Client) addMissingDocHeaders() error {
+	c.collections.RLock()
+	names := c.collections.getNames()
+	c.collections.RUnlock()
+
+	for _, name := range names {
+		cl, err := c.getCollectionByName(name)
+		if err != nil {
+			return err
+		}
+		n, err := cl.AddMissingHeaders()
+		if err != nil {
+			return fmt.Errorf("collection %s: %w", cl.Name, err)
+		}
+		if n > 0 {
+			util.Infof("Added a header to %d documents of collection %s", n, cl.Name)
+		}
+	}
+	return nil
+}
+
+// registerLegacyCollections registers the collections that have a dir under the data dir, but are not in the client
+// meta. Their props are not saved anywhere, so they are worked out from their files: the partitions from the partition
+// dirs the documents are in, gzip compression from the file names, the encoding from the content of a document (JSON,
+// or ENCODING_NONE if it isn't valid JSON) and the indexes from the index files.
+func (c *Client) registerLegacyCollections() error {
+	dataDirPath := util.JoinPath(c.documentRoot, util.DATA_DIR_NAME)
+	fileInfos, err := util.ReadDir(c.fs(), dataDirPath)
+	if err != nil {
+		return err
+	}
+
+	var n int
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		if !fileInfo.IsDir() || name != collection.NormalizeName(name) || strings.Contains(name, collection.TEMP_FILE_PREFIX) {
+			continue
+		}
+		c.collections.RLock()
+		isRegistered := c.collections.has(name)
+		c.collections.RUnlock()
+		if isRegistered {
+			continue
+		}
+
+		cl, err := c.getLegacyCollection(name)
+		if err != nil {
+			return fmt.Errorf("collection %s: %w", name, err)
+		}
+		c.setupCollection(cl)
+		c.collections.Lock()
+		c.collections.Store[name] = cl
+		c.collections.Unlock()
+		n++
+	}
+	if n > 0 {
+		util.Infof("Registered %d collections of %s from their dirs", n, c.documentRoot)
+	}
+
+	return c.save()
+}
+
+// getLegacyCollection returns the collection name, with the props worked out from its files, see
+// registerLegacyCollections. Its index files are moved to meta/indexes if they are in its indexes dir.
+func (c *Client) getLegacyCollection(name string) (*collection.Collection, error) {
+	cl := new(collection.Collection)
+	cl.DirPath = c.getDirPathForCollection(name)
+	cl.CollectionProps = collection.CollectionProps{Name: name, EncodingType: collection.ENCODING_JSON}
+
+	// Go through the documents, keeping the keys that are in each partition dir
+	dataPath := util.JoinPath(cl.DirPath, util.DATA_DIR_NAME)
+	pDirInfos, err := util.ReadDir(c.fs(), dataPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var partitionKeys map[int][]key.Key = make(map[int][]key.Key)
+	var maxPartition int
+	var hasDocs bool
+	for _, pDirInfo := range pDirInfos {
+		partition, err := strconv.Atoi(strings.TrimPrefix(pDirInfo.Name(), key.DATA_PARTITION_PREFIX))
+		if !pDirInfo.IsDir() || !strings.HasPrefix(pDirInfo.Name(), key.DATA_PARTITION_PREFIX) || err != nil {
+			continue
+		}
+		if partition < 0 {
+			partition = -partition
+		}
+		if partition > maxPartition {
+			maxPartition = partition
+		}
+
+		pDirPath := util.JoinPath(dataPath, pDirInfo.Name())
+		docInfos, err := util.ReadDir(c.fs(), pDirPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, docInfo := range docInfos {
+			k, err := key.GetKeyFromFileName(docInfo.Name())
+			if docInfo.IsDir() || strings.HasPrefix(docInfo.Name(), collection.TEMP_FILE_PREFIX) || err != nil {
+				continue
+			}
+			partitionKeys[partition] = append(partitionKeys[partition], k)
+			if hasDocs {
+				continue
+			}
+			hasDocs = true
+			cl.EnableGzipCompression = strings.HasSuffix(docInfo.Name(), key.GZIP_FILE_EXTENSION)
+			isJSON, err := c.isLegacyJSONDoc(util.JoinPath(pDirPath, docInfo.Name()), cl.EnableGzipCompression)
+			if err != nil {
+				return nil, err
+			}
+			if !isJSON {
+				cl.EncodingType = collection.ENCODING_NONE
+			}
+		}
+	}
+	cl.NumPartitions, err = getLegacyNumPartitions(partitionKeys, maxPartition)
+	if err != nil {
+		return nil, err
+	}
+
+	cl.CollectionProps = cl.CollectionProps.Sanitize()
+	err = cl.CollectionProps.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	// The indexes
+	err = util.CreateDirIfNotExist(c.fs(), cl.GetDirPathForIndexes())
+	if err != nil {
+		return nil, err
+	}
+	err = c.moveLegacyIndexFiles(cl)
+	if err != nil {
+		return nil, err
+	}
+	cl.IndexStore.Store = make(map[string]collection.IndexInfo)
+	idxInfos, err := util.ReadDir(c.fs(), cl.GetDirPathForIndexes())
+	if err != nil {
+		return nil, err
+	}
+	for _, idxInfo := range idxInfos {
+		if idxInfo.IsDir() || strings.HasPrefix(idxInfo.Name(), collection.TEMP_FILE_PREFIX) {
+			continue
+		}
+		path := util.JoinPath(cl.GetDirPathForIndexes(), idxInfo.Name())
+		data, err := util.ReadFile(c.fs(), path)
+		if err != nil {
+			return nil, err
+		}
+		var info collection.IndexInfo
+		err = json.Unmarshal(data, &info)
+		if err != nil {
+			return nil, fmt.Errorf("index file %s: %w", path, err)
+		}
+		info.CollectionName = name
+		info.FieldLocator = idxInfo.Name()
+		info.FilePath = path
+		cl.IndexStore.Store[info.FieldLocator] = info
+	}
+
+	return cl, nil
+}
+
+// moveLegacyIndexFiles moves the index files of cl from its indexes dir, if it has one, to meta/indexes
+func (c *Client) moveLegacyIndexFiles(cl *collection.Collection) error {
+	legacyDirPath := util.JoinPath(cl.DirPath, collection.INDEX_DIR_NAME)
+	fileInfos, err := util.ReadDir(c.fs(), legacyDirPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() || strings.HasPrefix(fileInfo.Name(), collection.TEMP_FILE_PREFIX) {
+			continue
+		}
+		err = c.fs().Rename(util.JoinPath(legacyDirPath, fileInfo.Name()), util.JoinPath(cl.GetDirPathForIndexes(), fileInfo.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return c.fs().RemoveAll(legacyDirPath)
+}
+
+// isLegacyJSONDoc tells whether the header-less document file at path has JSON in it
+func (c *Client) isLegacyJSONDoc(path string, isGzipped bool) (bool, error) {
+	file, err := c.fs().Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if isGzipped {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return false, nil
+		}
+		defer gz.Close()
+		r = gz
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return false, nil
+	}
+	return json.Valid(data), nil
+}
+
+// getLegacyNumPartitions returns the smallest number of partitions that puts every key of partitionKeys in the partition
+// it is in. Partitions past maxPartition that have no documents can't be told apart from no partition at all, but
+// since no document is in them, leaving them out doesn't lose any.
+func getLegacyNumPartitions(partitionKeys map[int][]key.Key, maxPartition int) (int, error) {
+	const maxNumPartitions int = 1 << 16
+	for numPartitions := maxPartition + 1; numPartitions <= maxNumPartitions; numPartitions++ {
+		isMatch := true
+		for partition, keys := range partitionKeys {
+			for _, k := range keys {
+				if int(k)%numPartitions != partition && int(k)%numPartitions != -partition {
+					isMatch = false
+					break
+				}
+			}
+			if !isMatch {
+				break
+			}
+		}
+		if isMatch {
+			return numPartitions, nil
+		}
+	}
+	return 0, fmt.Errorf("could not find a number of partitions that matches the partition dirs of the documents")
+}
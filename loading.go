@@ -0,0 +1,147 @@
+package gofiledb
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/util"
+	"sort"
+)
+
+/********************************************************************************
+* L A Z Y  L O A D I N G
+*********************************************************************************/
+
+// Collections are loaded lazily. The client meta keeps each collection encoded on its own (clientGob.CollectionGobs), and
+// a client that is initialized only decodes the names of its collections. A collection is decoded, set up with the
+// settings of the client (including its encryption keys) and recovered (see Collection.Recover) the first time it is
+// used, so the time a client takes to start and the memory it uses grow with the collections that are used, rather than
+// with all the ones it has. Since collections are only recovered once they are loaded, problems with a collection, such
+// as invalid encryption keys, are reported when it is first used rather than by Initialize.
+//
+// The metas saved before layout version 3 have all the collections decoded (clientGob.Collections), so they are loaded
+// by Initialize, until the layout is migrated.
+
+// has tells whether there is a collection named name, whether it has been loaded or not. It should be called while
+// holding the lock of s.
+func (s *collectionStore) has(name string) bool {
+	_, isLoaded := s.Store[name]
+	_, isUnloaded := s.Unloaded[name]
+	return isLoaded || isUnloaded
+}
+
+// getNames returns the names of all the collections, sorted. It should be called while holding the lock of s.
+func (s *collectionStore) getNames() []string {
+	names := make([]string, 0, len(s.Store)+len(s.Unloaded))
+	for name := range s.Store {
+		names = append(names, name)
+	}
+	for name := range s.Unloaded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setLoaded registers cl as the loaded collection name. It should be called while holding the lock of s.
+func (s *collectionStore) setLoaded(name string, cl *collection.Collection) {
+	if s.Store == nil {
+		s.Store = make(map[string]*collection.Collection)
+	}
+	s.Store[name] = cl
+	delete(s.Unloaded, name)
+}
+
+// loadCollection loads and recovers the collection name, which hasn't been used yet. If it can't be recovered, it is left
+// unloaded, so that it is tried again the next time it is used.
+func (c *Client) loadCollection(name string) (*collection.Collection, error) {
+	c.collections.Lock()
+	if cl, hasKey := c.collections.Store[name]; hasKey { // loaded meanwhile
+		c.collections.Unlock()
+		return cl, nil
+	}
+	cl, err := c.decodeCollection(name)
+	var isFixed bool
+	if err == nil {
+		isFixed, err = c.recoverCollection(cl)
+	}
+	if err == nil {
+		c.collections.setLoaded(name, cl)
+	}
+	c.collections.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	util.Debugf("Loaded collection %s", name)
+
+	if isFixed { // index info may have changed
+		err = c.save()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cl, nil
+}
+
+// getCollectionLocked returns the collection name, which can't be an alias, and whether it exists. If it hasn't been used
+// yet, it is loaded without being recovered: this is meant for the recovery pass of the client, which recovers the
+// collections that are loaded once it has finished the client operations that were interrupted. It should be called
+// while holding the lock of c.collections.
+func (c *Client) getCollectionLocked(name string) (*collection.Collection, bool, error) {
+	if cl, hasKey := c.collections.Store[name]; hasKey {
+		return cl, true, nil
+	}
+	if _, hasKey := c.collections.Unloaded[name]; !hasKey {
+		return nil, false, nil
+	}
+	cl, err := c.decodeCollection(name)
+	if err != nil {
+		return nil, true, err
+	}
+	c.collections.setLoaded(name, cl)
+	return cl, true, nil
+}
+
+// decodeCollection decodes the collection name, which hasn't been loaded yet, and sets it up for use. It should be
+// called while holding the lock of c.collections.
+func (c *Client) decodeCollection(name string) (*collection.Collection, error) {
+	cl := new(collection.Collection)
+	err := cl.GobDecode(c.collections.Unloaded[name])
+	if err != nil {
+		return nil, fmt.Errorf("could not load collection %s: %w", name, err)
+	}
+
+	p := ClientInitOptions{EncryptionKeys: c.encryptionKeys, PreviousEncryptionKeys: c.previousEncryptionKeys}
+	encryptionKey, previousEncryptionKey := getEncryptionKeysFromOptions(p, name)
+	if len(encryptionKey) > 0 || len(previousEncryptionKey) > 0 {
+		err = cl.SetEncryptionKeys(encryptionKey, previousEncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption keys provided for collection %s: %w", name, err)
+		}
+	}
+	c.setupCollection(cl)
+	if c.isReadOnly() {
+		cl.SetReadOnly(true)
+	}
+	return cl, nil
+}
+
+// recoverCollection fixes what a previous process may have left inconsistent in cl, e.g. by crashing in the middle of a
+// write, and tells whether anything was fixed. Read-only clients leave collections as they are.
+func (c *Client) recoverCollection(cl *collection.Collection) (bool, error) {
+	if c.isReadOnly() {
+		return false, nil
+	}
+	if cl.IsMissingEncryptionKey() {
+		util.Warnf("Collection %s is encrypted, but no encryption key was provided in ClientInitOptions. Skipping recovery for it.", cl.Name)
+		return false, nil
+	}
+
+	n, err := cl.Recover()
+	if err != nil {
+		return false, fmt.Errorf("error while recovering collection %s: %w", cl.Name, err)
+	}
+	if n > 0 {
+		util.Warnf("Recovery: fixed %d problems in collection %s", n, cl.Name)
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,124 @@
+package gofiledb
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/util"
+	"os"
+	"syscall"
+)
+
+/********************************************************************************
+* L O C K I N G
+*********************************************************************************/
+
+// Only one process can write to a document root at a time, otherwise they would overwrite each other's meta and
+// indexes. A client takes an advisory lock (flock) on the document root when it is initialized: an exclusive one for
+// a normal client, or a shared one for a read-only client. Any number of read-only clients can use a document root at
+// the same time, but not while a normal client is using it.
+//
+// The lock is taken on a file next to the warehouse dir rather than in it, so that the lock is not lost when the
+// warehouse dir is removed (e.g. with OverwritePreviousData).
+
+const LOCK_FILE_EXTENSION string = ".lock"
+
+var ErrDocumentRootIsLocked = fmt.Errorf("The document root is already in use by another GoFileDb client, possibly in another process")
+var ErrClientIsReadOnly = fmt.Errorf("Attempted to make changes using a read-only GoFileDb client")
+
+type documentRootLock struct {
+	file     util.File
+	isShared bool
+}
+
+// fdFile is a File of an OS file, such as the ones of OSFS, which can be locked with flock
+type fdFile interface {
+	Fd() uintptr
+}
+
+// lockDocumentRoot takes the lock for the warehouse dir at documentRoot in fsys, without waiting for it. It returns
+// ErrDocumentRootIsLocked if the lock is held by another client. The lock is an OS file lock, so it is only taken if
+// fsys has OS files, and other file systems are in charge of that themselves.
+func lockDocumentRoot(fsys util.FS, documentRoot string, isShared bool) (*documentRootLock, error) {
+	path := documentRoot + LOCK_FILE_EXTENSION
+	file, err := fsys.OpenFile(path, os.O_RDONLY|os.O_CREATE, util.FILE_PERM)
+	if err != nil {
+		return nil, err
+	}
+	osFile, ok := file.(fdFile)
+	if !ok {
+		return &documentRootLock{file: file, isShared: isShared}, nil
+	}
+
+	how := syscall.LOCK_EX
+	if isShared {
+		how = syscall.LOCK_SH
+	}
+	err = syscall.Flock(int(osFile.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		util.Errorf("Could not lock %s: it is locked by another GoFileDb client", path)
+		return nil, ErrDocumentRootIsLocked
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &documentRootLock{file: file, isShared: isShared}, nil
+}
+
+// unlock releases the lock. Closing the file releases it, and so does the process exiting.
+func (l *documentRootLock) unlock() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func (c *Client) isReadOnly() bool {
+	return c.lock != nil && c.lock.isShared
+}
+
+// getWritableCollectionByName is getCollectionByName for operations that change the collection. It returns
+// ErrCollectionIsFrozen if the collection is frozen, see FreezeCollection.
+func (c *Client) getWritableCollectionByName(collectionName string) (*collection.Collection, error) {
+	if c.isReadOnly() {
+		return nil, ErrClientIsReadOnly
+	}
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return nil, err
+	}
+	if cl.IsFrozen() {
+		return nil, ErrCollectionIsFrozen
+	}
+	return cl, nil
+}
+
+// Close closes all the collections of the client and releases its lock on the document root, so that another client
+// (e.g. in another process) can use it. The client cannot be used after it has been closed.
+func (c *Client) Close() error {
+	c.stopSnapshotSchedules()
+	c.stopWebhooks()
+	c.stopByteBudget()
+	c.closeDatabases()
+	if c.collections != nil {
+		c.collections.RLock()
+		for _, cl := range c.collections.Store {
+			err := cl.Close()
+			if err != nil {
+				util.Warnf("Error while closing collection %s: %s", cl.Name, err)
+			}
+		}
+		c.collections.RUnlock()
+	}
+
+	err := c.lock.unlock()
+	c.isInitialized = false
+	if err != nil {
+		return err
+	}
+	return c.removeMemoryData()
+}
@@ -0,0 +1,42 @@
+package gofiledb
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb/util"
+)
+
+/********************************************************************************
+* I N  M E M O R Y
+*********************************************************************************/
+
+// An in-memory client (see ClientInitOptions.InMemory) is meant for tests of applications that use gofiledb: it works
+// exactly like a normal client, but keeps its document root in a util.MemFS rather than on disk, and drops all of it
+// when the client is closed. Nothing is ever created on the local file system.
+
+// MEMORY_DOCUMENT_ROOT is the document root of in-memory clients, in their own util.MemFS
+const MEMORY_DOCUMENT_ROOT string = "/gofiledb"
+
+var ErrInMemoryIsReadOnly = fmt.Errorf("An in-memory GoFileDb client cannot be read-only, since it always starts out empty")
+
+// newMemoryFS creates the file system that an in-memory client keeps its data in, with the document root in it
+func newMemoryFS() (util.FS, error) {
+	fsys := util.NewMemFS()
+	err := fsys.MkdirAll(MEMORY_DOCUMENT_ROOT, util.DIR_PERM)
+	if err != nil {
+		return nil, err
+	}
+	return fsys, nil
+}
+
+// removeMemoryData drops all the data of an in-memory client, once it has been closed
+func (c *Client) removeMemoryData() error {
+	if !c.isInMemory {
+		return nil
+	}
+	return c.fs().RemoveAll(c.getDocumentRoot())
+}
+
+// IsInMemory tells whether the client keeps its data in memory only, see ClientInitOptions.InMemory
+func (c *Client) IsInMemory() bool {
+	return c.isInMemory
+}
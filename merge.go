@@ -0,0 +1,172 @@
+package gofiledb
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/teejays/gofiledb/key"
+	"sort"
+	"time"
+)
+
+/********************************************************************************
+* M E R G I N G
+*********************************************************************************/
+
+// MergeFrom imports the collections of another warehouse into the client. The collections that the client doesn't have
+// are added with their props, and the documents that only the other warehouse has are added to the collections of the
+// client. When a document is in both warehouses with different data, a ConflictResolver decides what the client keeps:
+// KeepOurs, KeepTheirs, KeepNewest, or a func of the application's own, e.g. one that merges the fields of both. The
+// indexes of the other warehouse that a collection of the client doesn't have are added to it.
+//
+// The other warehouse is opened read-only, with the encryption keys of the client. Documents that are only in the client
+// are left alone, and so are revisions, audit logs, change feeds, expiries, aliases and databases.
+
+// Conflict is a document that is in both warehouses with different data, see MergeFrom
+type Conflict struct {
+	Collection string
+	Key        Key
+	// Ours and Theirs are the data of the document in the client and in the other warehouse, both in the encoding of the
+	// collection of the client
+	Ours   []byte
+	Theirs []byte
+	// OursWrittenAt and TheirsWrittenAt are when the document was last written in each warehouse, zero if it is not known,
+	// e.g. with STORAGE_SEGMENTS
+	OursWrittenAt   time.Time
+	TheirsWrittenAt time.Time
+}
+
+// ConflictResolver returns the data that the client keeps for a Conflict, in the encoding of the collection of the
+// client. An error stops the merge.
+type ConflictResolver func(c Conflict) ([]byte, error)
+
+type MergeReport struct {
+	NumCollectionsAdded int
+	NumDocsAdded        int
+	NumConflicts        int
+	NumDocsReplaced     int // the conflicts resolved with other data than ours
+}
+
+// KeepOurs resolves a Conflict by keeping the document of the client
+func KeepOurs(c Conflict) ([]byte, error) {
+	return c.Ours, nil
+}
+
+// KeepTheirs resolves a Conflict by taking the document of the other warehouse
+func KeepTheirs(c Conflict) ([]byte, error) {
+	return c.Theirs, nil
+}
+
+// KeepNewest resolves a Conflict by keeping the document that was written last, or the one of the client if that is not
+// known
+func KeepNewest(c Conflict) ([]byte, error) {
+	if c.TheirsWrittenAt.After(c.OursWrittenAt) && !c.OursWrittenAt.IsZero() {
+		return c.Theirs, nil
+	}
+	return c.Ours, nil
+}
+
+// MergeFrom imports the collections of the warehouse at otherRoot, resolving the conflicts with resolver
+func (c *Client) MergeFrom(otherRoot string, resolver ConflictResolver) (MergeReport, error) {
+	var report MergeReport
+	if c.isReadOnly() {
+		return report, ErrClientIsReadOnly
+	}
+
+	other, err := openClient(ClientInitOptions{
+		DocumentRoot:           otherRoot,
+		ReadOnly:               true,
+		EncryptionKeys:         c.encryptionKeys,
+		PreviousEncryptionKeys: c.previousEncryptionKeys,
+	})
+	if err != nil {
+		return report, fmt.Errorf("opening the other warehouse: %w", err)
+	}
+	defer other.Close()
+
+	other.collections.RLock()
+	names := other.collections.getNames()
+	other.collections.RUnlock()
+	for _, name := range names {
+		err = c.mergeCollection(other, name, resolver, &report)
+		if err != nil {
+			return report, fmt.Errorf("merging collection %s: %w", name, err)
+		}
+	}
+	return report, nil
+}
+
+// mergeCollection imports the collection collectionName of other into the client
+func (c *Client) mergeCollection(other *Client, collectionName string, resolver ConflictResolver, report *MergeReport) error {
+	otherCl, err := other.getCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+	_, err = c.getCollectionByName(collectionName)
+	if err == ErrCollectionIsNotExist {
+		err = c.addCollectionWithProps(collectionName, otherCl.CollectionProps)
+		if err != nil {
+			return err
+		}
+		report.NumCollectionsAdded++
+	}
+	if err != nil {
+		return err
+	}
+	cl, err := c.getWritableCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+
+	err = otherCl.ForEachDocData(func(k key.Key, encodingType uint, data []byte) error {
+		theirs, err := cl.Reencode(data, encodingType)
+		if err != nil {
+			return fmt.Errorf("re-encoding document %d: %w", k, err)
+		}
+		ours, err := cl.GetFileData(k)
+		if IsNotExist(err) {
+			report.NumDocsAdded++
+			return cl.Set(k, theirs)
+		}
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(ours, theirs) {
+			return nil
+		}
+
+		report.NumConflicts++
+		conflict := Conflict{Collection: cl.Name, Key: Key(k), Ours: ours, Theirs: theirs}
+		conflict.OursWrittenAt, _ = cl.GetWriteTime(k)
+		conflict.TheirsWrittenAt, _ = otherCl.GetWriteTime(k)
+		kept, err := resolver(conflict)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(kept, ours) {
+			return nil
+		}
+		report.NumDocsReplaced++
+		return cl.Set(k, kept)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The documents are all in place, so the indexes are only built once
+	fieldLocators := otherCl.GetIndexFieldLocators()
+	sort.Strings(fieldLocators)
+	indexed := make(map[string]bool)
+	for _, fieldLocator := range cl.GetIndexFieldLocators() {
+		indexed[fieldLocator] = true
+	}
+	for _, fieldLocator := range fieldLocators {
+		if indexed[fieldLocator] {
+			continue
+		}
+		err = c.AddIndex(collectionName, fieldLocator)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,391 @@
+package gofiledb
+
+import (
+	"errors"
+	"fmt"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/util"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/********************************************************************************
+* M E T R I C S
+*********************************************************************************/
+
+// MetricsHandler serves the metrics of a client in the Prometheus text format, e.g. on /metrics:
+//
+//	http.Handle("/metrics", client.MetricsHandler())
+//
+// The metrics are:
+//   - the counts, errors (by kind, see Error) and latencies of the operations that go through the Middleware of the
+//     client, i.e. Set, Get, Delete and Search, by collection
+//   - the number of documents and their size, raw and on disk, of every collection, along with the number of values and
+//     the size of each of its indexes, see CollectionStats
+//   - the hits and misses of the caches, see GetCacheStats
+//   - the reads and writes that waited because of ClientInitOptions.MaxConcurrentIO, see GetIOStats
+//   - the status of the background jobs: the reapers of the expired documents, the scheduled snapshots and the webhooks
+//
+// Only the collections that have been loaded are described, so that a scrape doesn't load them all. The stats of a
+// collection are gathered by going through all its documents the first time they are asked for, so the first scrape
+// can be slow, but they are kept up to date from then on. Operations are counted from the time the client is
+// initialized. The metrics of the databases of the client (see DB) are served by their own handler.
+
+const METRICS_NAMESPACE string = "gofiledb"
+
+// METRICS_LATENCY_BUCKETS are the upper bounds, in seconds, of the buckets of the histograms of the latencies
+var METRICS_LATENCY_BUCKETS = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metricsStore struct {
+	ops map[opMetricsKey]*opMetrics
+	sync.Mutex
+}
+
+type opMetricsKey struct {
+	collection string
+	op         string
+}
+
+type opMetrics struct {
+	numOps       int64
+	numErrors    map[string]int64 // error kind -> count
+	buckets      []int64          // counts of the latencies up to each of METRICS_LATENCY_BUCKETS, not cumulative
+	totalSeconds float64
+}
+
+// observe records that op took d, and failed with err if it isn't nil
+func (m *metricsStore) observe(op *Op, err error, d time.Duration) {
+	if m == nil {
+		return
+	}
+	k := opMetricsKey{collection: collection.NormalizeName(op.Collection), op: op.Type}
+	seconds := d.Seconds()
+
+	m.Lock()
+	defer m.Unlock()
+	if m.ops == nil {
+		m.ops = make(map[opMetricsKey]*opMetrics)
+	}
+	om := m.ops[k]
+	if om == nil {
+		om = &opMetrics{numErrors: make(map[string]int64), buckets: make([]int64, len(METRICS_LATENCY_BUCKETS))}
+		m.ops[k] = om
+	}
+	om.numOps++
+	om.totalSeconds += seconds
+	for i, upperBound := range METRICS_LATENCY_BUCKETS {
+		if seconds <= upperBound {
+			om.buckets[i]++
+			break
+		}
+	}
+	if err != nil {
+		om.numErrors[getMetricsErrorKind(err)]++
+	}
+}
+
+// getMetricsErrorKind returns the name of the kind of err, as in the gofiledb-error-kind trailer of the gRPC service, or
+// "other"
+func getMetricsErrorKind(err error) string {
+	var e *Error
+	if errors.As(err, &e) && e.Kind != nil {
+		for name, kind := range grpcErrorKinds {
+			if kind == e.Kind {
+				return name
+			}
+		}
+	}
+	return "other"
+}
+
+// MetricsHandler returns an http.Handler that serves the metrics of the client in the Prometheus text format
+func (c *Client) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		err := c.WriteMetrics(w)
+		if err != nil {
+			// The headers have been sent already, so the scrape fails with the body cut short
+			fmt.Fprintf(w, "# error: %s\n", err)
+		}
+	})
+}
+
+// WriteMetrics writes the metrics of the client to w, in the Prometheus text format, see MetricsHandler
+func (c *Client) WriteMetrics(w io.Writer) error {
+	mw := &metricsWriter{w: w}
+	c.writeOpMetrics(mw)
+	c.writeCollectionMetrics(mw)
+	c.writeJobMetrics(mw)
+	return mw.err
+}
+
+func (c *Client) writeOpMetrics(mw *metricsWriter) {
+	if c.metrics == nil {
+		return
+	}
+	c.metrics.Lock()
+	defer c.metrics.Unlock()
+	var keys []opMetricsKey
+	for k := range c.metrics.ops {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].collection < keys[j].collection || keys[i].collection == keys[j].collection && keys[i].op < keys[j].op
+	})
+
+	mw.family("operations_total", "counter", "Operations on the documents of the collection")
+	for _, k := range keys {
+		mw.sample("operations_total", float64(c.metrics.ops[k].numOps), "collection", k.collection, "op", k.op)
+	}
+
+	mw.family("operation_errors_total", "counter", "Operations on the documents of the collection that failed, by kind of error")
+	for _, k := range keys {
+		om := c.metrics.ops[k]
+		var kinds []string
+		for kind := range om.numErrors {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			mw.sample("operation_errors_total", float64(om.numErrors[kind]), "collection", k.collection, "op", k.op, "kind", kind)
+		}
+	}
+
+	mw.family("operation_duration_seconds", "histogram", "Latencies of the operations on the documents of the collection")
+	for _, k := range keys {
+		om := c.metrics.ops[k]
+		var cumulative int64
+		for i, upperBound := range METRICS_LATENCY_BUCKETS {
+			cumulative += om.buckets[i]
+			mw.sample("operation_duration_seconds_bucket", float64(cumulative), "collection", k.collection, "op", k.op, "le", formatMetricsValue(upperBound))
+		}
+		mw.sample("operation_duration_seconds_bucket", float64(om.numOps), "collection", k.collection, "op", k.op, "le", "+Inf")
+		mw.sample("operation_duration_seconds_sum", om.totalSeconds, "collection", k.collection, "op", k.op)
+		mw.sample("operation_duration_seconds_count", float64(om.numOps), "collection", k.collection, "op", k.op)
+	}
+}
+
+// writeCollectionMetrics writes the stats of the collections that have been loaded
+func (c *Client) writeCollectionMetrics(mw *metricsWriter) {
+	var cls []*collection.Collection
+	if c.collections != nil {
+		c.collections.RLock()
+		for _, cl := range c.collections.Store {
+			cls = append(cls, cl)
+		}
+		c.collections.RUnlock()
+	}
+	sort.Slice(cls, func(i, j int) bool { return cls[i].Name < cls[j].Name })
+
+	// A collection whose stats can't be gathered is left out, rather than failing the scrape
+	var stats []collection.Stats
+	var statsCls []*collection.Collection
+	for _, cl := range cls {
+		s, err := cl.GetStats()
+		if err != nil {
+			util.Warnf("Could not get the stats of collection %s for the metrics: %s", cl.Name, err)
+			continue
+		}
+		stats = append(stats, s)
+		statsCls = append(statsCls, cl)
+	}
+
+	mw.family("collection_documents", "gauge", "Documents in the collection")
+	for i, cl := range statsCls {
+		mw.sample("collection_documents", float64(stats[i].NumDocuments), "collection", cl.Name)
+	}
+	mw.family("collection_raw_bytes", "gauge", "Size of the data of the documents of the collection")
+	for i, cl := range statsCls {
+		mw.sample("collection_raw_bytes", float64(stats[i].RawBytes), "collection", cl.Name)
+	}
+	mw.family("collection_stored_bytes", "gauge", "Size of the files of the documents of the collection on disk")
+	for i, cl := range statsCls {
+		mw.sample("collection_stored_bytes", float64(stats[i].StoredBytes), "collection", cl.Name)
+	}
+	mw.family("collection_last_write_timestamp_seconds", "gauge", "When the collection was last written to")
+	for i, cl := range statsCls {
+		if !stats[i].LastWriteTime.IsZero() {
+			mw.sample("collection_last_write_timestamp_seconds", getMetricsTimestamp(stats[i].LastWriteTime), "collection", cl.Name)
+		}
+	}
+	mw.family("index_values", "gauge", "Distinct values in the index")
+	for i, cl := range statsCls {
+		for _, idx := range stats[i].Indexes {
+			mw.sample("index_values", float64(idx.NumValues), "collection", cl.Name, "field", idx.FieldLocator)
+		}
+	}
+	mw.family("index_bytes", "gauge", "Size of the file of the index")
+	for i, cl := range statsCls {
+		for _, idx := range stats[i].Indexes {
+			mw.sample("index_bytes", float64(idx.Bytes), "collection", cl.Name, "field", idx.FieldLocator)
+		}
+	}
+
+	cacheStats := make(map[string]collection.CacheStats)
+	for _, cl := range cls {
+		s, err := cl.GetCacheStats()
+		if err == nil {
+			cacheStats[cl.Name] = s
+		}
+	}
+	for _, m := range []struct {
+		name, metricType, help string
+		value                  func(s collection.CacheStats) float64
+	}{
+		{"cache_hits_total", "counter", "Reads of documents that were in the cache", func(s collection.CacheStats) float64 { return float64(s.NumHits) }},
+		{"cache_misses_total", "counter", "Reads of documents that were not in the cache", func(s collection.CacheStats) float64 { return float64(s.NumMisses) }},
+		{"cache_entries", "gauge", "Documents in the cache", func(s collection.CacheStats) float64 { return float64(s.NumEntries) }},
+		{"cache_bytes", "gauge", "Size of the data of the documents in the cache", func(s collection.CacheStats) float64 { return float64(s.NumBytes) }},
+	} {
+		mw.family(m.name, m.metricType, m.help)
+		for _, cl := range cls {
+			if s, ok := cacheStats[cl.Name]; ok {
+				mw.sample(m.name, m.value(s), "collection", cl.Name)
+			}
+		}
+	}
+
+	mw.family("reaped_documents_total", "counter", "Expired documents deleted by ReapExpired")
+	for _, cl := range cls {
+		mw.sample("reaped_documents_total", float64(cl.GetReapStats().NumReaped), "collection", cl.Name)
+	}
+	mw.family("reap_errors_total", "counter", "Expired documents that could not be deleted by ReapExpired")
+	for _, cl := range cls {
+		mw.sample("reap_errors_total", float64(cl.GetReapStats().NumErrors), "collection", cl.Name)
+	}
+	mw.family("reap_last_run_timestamp_seconds", "gauge", "When ReapExpired last ran")
+	for _, cl := range cls {
+		if s := cl.GetReapStats(); !s.LastRunAt.IsZero() {
+			mw.sample("reap_last_run_timestamp_seconds", getMetricsTimestamp(s.LastRunAt), "collection", cl.Name)
+		}
+	}
+}
+
+// writeJobMetrics writes the metrics of the I/O limiter, the scheduled snapshots and the webhooks
+func (c *Client) writeJobMetrics(mw *metricsWriter) {
+	ioStats := c.GetIOStats()
+	mw.family("io_in_progress", "gauge", "Reads and writes holding a slot of MaxConcurrentIO")
+	mw.sample("io_in_progress", float64(ioStats.NumInProgress))
+	mw.family("io_operations_total", "counter", "Reads and writes that went through the I/O limiter")
+	mw.sample("io_operations_total", float64(ioStats.NumOps))
+	mw.family("io_waited_total", "counter", "Reads and writes that had to wait for a slot of MaxConcurrentIO")
+	mw.sample("io_waited_total", float64(ioStats.NumWaited))
+	mw.family("io_wait_seconds_total", "counter", "Time spent waiting for a slot of MaxConcurrentIO")
+	mw.sample("io_wait_seconds_total", ioStats.TotalWaitTime.Seconds())
+
+	var schedulers []*snapshotScheduler
+	if c.snapshotSchedules != nil {
+		c.snapshotSchedules.Lock()
+		for _, sch := range c.snapshotSchedules.Store {
+			schedulers = append(schedulers, sch)
+		}
+		c.snapshotSchedules.Unlock()
+	}
+	sort.Slice(schedulers, func(i, j int) bool {
+		return schedulers[i].schedule.CollectionName < schedulers[j].schedule.CollectionName
+	})
+	mw.family("scheduled_snapshot_last_success_timestamp_seconds", "gauge", "When the last scheduled snapshot of the collection was taken")
+	for _, sch := range schedulers {
+		sch.statusLock.Lock()
+		lastSnapshotAt := sch.lastSnapshotAt
+		sch.statusLock.Unlock()
+		if !lastSnapshotAt.IsZero() {
+			mw.sample("scheduled_snapshot_last_success_timestamp_seconds", getMetricsTimestamp(lastSnapshotAt), "collection", sch.schedule.CollectionName)
+		}
+	}
+	mw.family("scheduled_snapshot_failures_total", "counter", "Scheduled snapshots of the collection that failed")
+	for _, sch := range schedulers {
+		sch.statusLock.Lock()
+		numFailures := sch.numFailures
+		sch.statusLock.Unlock()
+		mw.sample("scheduled_snapshot_failures_total", float64(numFailures), "collection", sch.schedule.CollectionName)
+	}
+
+	var runners []*webhookRunner
+	if c.webhooks != nil {
+		c.webhooks.Lock()
+		for _, r := range c.webhooks.Store {
+			runners = append(runners, r)
+		}
+		c.webhooks.Unlock()
+	}
+	sort.Slice(runners, func(i, j int) bool { return runners[i].id < runners[j].id })
+	mw.family("webhook_pending_payloads", "gauge", "Changes waiting to be sent to the webhook")
+	for _, r := range runners {
+		r.sub.Lock()
+		numPending := len(r.sub.queue)
+		r.sub.Unlock()
+		mw.sample("webhook_pending_payloads", float64(numPending), "webhook", r.id, "collection", r.hook.CollectionName)
+	}
+	mw.family("webhook_sent_total", "counter", "Payloads acknowledged by the webhook")
+	for _, r := range runners {
+		mw.sample("webhook_sent_total", float64(atomic.LoadInt64(&r.numSent)), "webhook", r.id, "collection", r.hook.CollectionName)
+	}
+	mw.family("webhook_dead_letters_total", "counter", "Payloads that could not be sent to the webhook")
+	for _, r := range runners {
+		mw.sample("webhook_dead_letters_total", float64(atomic.LoadInt64(&r.numDeadLetters)), "webhook", r.id, "collection", r.hook.CollectionName)
+	}
+}
+
+// metricsWriter writes metrics in the Prometheus text format, keeping the first error
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+// family writes the HELP and TYPE lines of the metric name, which is prefixed with METRICS_NAMESPACE
+func (mw *metricsWriter) family(name string, metricType string, help string) {
+	mw.printf("# HELP %s_%s %s.\n# TYPE %s_%s %s\n", METRICS_NAMESPACE, name, help, METRICS_NAMESPACE, name, metricType)
+}
+
+// sample writes a sample of the metric name with value, and labels given as name, value pairs
+func (mw *metricsWriter) sample(name string, value float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(METRICS_NAMESPACE + "_" + name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i == 0 {
+			b.WriteByte('{')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i] + `="` + escapeMetricsLabelValue(labels[i+1]) + `"`)
+	}
+	if len(labels) > 0 {
+		b.WriteByte('}')
+	}
+	mw.printf("%s %s\n", b.String(), formatMetricsValue(value))
+}
+
+func (mw *metricsWriter) printf(format string, args ...interface{}) {
+	if mw.err != nil {
+		return
+	}
+	_, mw.err = fmt.Fprintf(mw.w, format, args...)
+}
+
+func escapeMetricsLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatMetricsValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func getMetricsTimestamp(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
@@ -0,0 +1,144 @@
+package gofiledb
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"sort"
+)
+
+/********************************************************************************
+* M I G R A T I O N
+*********************************************************************************/
+
+// MigrateWarehouse copies the collections of the warehouse at one document root into the one at another, e.g. to move
+// the data to a bigger disk. The source is opened read-only, so it can still be read by other read-only clients while it
+// is copied, and it may be of an older layout version. The destination is created if needed, with the current layout
+// version, and the collections can be given other props there with MigrateOptions.Props, e.g. another compression or
+// number of partitions.
+//
+// Every document is read back once it has been written to the destination, and the SHA-256 of its data is checked
+// against the one read from the source, unless it has been re-encoded. The documents of the source are checked against
+// their own checksums as they are read. Indexes are rebuilt in the destination once all the documents of a collection
+// have been copied. Revisions, audit logs, change feeds, expiries, aliases and databases are not copied.
+
+var ErrMigrationChecksumMismatch = fmt.Errorf("The data of a document read back from the destination does not match the data of the source")
+
+type MigrateOptions struct {
+	Collections []string // the collections to migrate, all of them if empty
+	// EncryptionKeys are the keys of the encrypted collections (collection name -> key), which are used in both warehouses
+	EncryptionKeys map[string][]byte
+	// Props, if set, returns the props of a collection in the destination from its props in the source
+	Props func(props CollectionProps) CollectionProps
+	// FS is the file system that both warehouses are in. If nil, it is the local file system.
+	FS FS
+}
+
+type MigrateReport struct {
+	NumCollections int
+	NumDocs        int
+}
+
+// MigrateWarehouse copies the collections at srcRoot into the warehouse at dstRoot, none of which can be there already
+func MigrateWarehouse(srcRoot, dstRoot string, opts MigrateOptions) (MigrateReport, error) {
+	var report MigrateReport
+
+	fsys := opts.FS
+	if fsys == nil {
+		fsys = util.OSFS{}
+	}
+	src, err := openClient(ClientInitOptions{DocumentRoot: srcRoot, ReadOnly: true, EncryptionKeys: opts.EncryptionKeys, FS: opts.FS})
+	if err != nil {
+		return report, fmt.Errorf("opening the source warehouse: %w", err)
+	}
+	defer src.Close()
+
+	err = fsys.MkdirAll(dstRoot, util.DIR_PERM)
+	if err != nil {
+		return report, err
+	}
+	dst, err := openClient(ClientInitOptions{DocumentRoot: dstRoot, EncryptionKeys: opts.EncryptionKeys, FS: opts.FS})
+	if err != nil {
+		return report, fmt.Errorf("opening the destination warehouse: %w", err)
+	}
+	defer dst.Close()
+
+	names := opts.Collections
+	if len(names) == 0 {
+		src.collections.RLock()
+		names = src.collections.getNames()
+		src.collections.RUnlock()
+	}
+	for _, name := range names {
+		n, err := migrateCollection(src, dst, collection.NormalizeName(name), opts)
+		if err != nil {
+			return report, fmt.Errorf("migrating collection %s: %w", name, err)
+		}
+		report.NumCollections++
+		report.NumDocs += n
+	}
+	return report, nil
+}
+
+// migrateCollection copies the collection from src to dst, and returns the number of documents copied
+func migrateCollection(src, dst *Client, collectionName string, opts MigrateOptions) (int, error) {
+	srcCl, err := src.getCollectionByName(collectionName)
+	if err != nil {
+		return 0, err
+	}
+	_, err = dst.getCollectionByName(collectionName)
+	if err == nil {
+		return 0, ErrCollectionIsExist
+	}
+	if err != ErrCollectionIsNotExist {
+		return 0, err
+	}
+
+	props := CollectionProps(srcCl.CollectionProps)
+	if opts.Props != nil {
+		props = opts.Props(props)
+	}
+	props.Name = collectionName
+	err = dst.AddCollection(props)
+	if err != nil {
+		return 0, err
+	}
+	dstCl, err := dst.getCollectionByName(collectionName)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	err = srcCl.ForEachDocData(func(k key.Key, encodingType uint, data []byte) error {
+		err := dstCl.SetEncoded(k, data, encodingType)
+		if err != nil {
+			return err
+		}
+		written, err := dstCl.GetFileData(k)
+		if err != nil {
+			return fmt.Errorf("reading back document %d: %w", k, err)
+		}
+		if encodingType == dstCl.EncodingType {
+			if sha256.Sum256(written) != sha256.Sum256(data) {
+				return fmt.Errorf("document %d: %w", k, ErrMigrationChecksumMismatch)
+			}
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+
+	fieldLocators := srcCl.GetIndexFieldLocators()
+	sort.Strings(fieldLocators)
+	for _, fieldLocator := range fieldLocators {
+		err = dst.AddIndex(collectionName, fieldLocator)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
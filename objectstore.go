@@ -0,0 +1,363 @@
+package gofiledb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/key"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/********************************************************************************
+* O B J E C T  S T O R E  S Y N C
+*********************************************************************************/
+
+// SyncToObjectStore mirrors collections to an object store, e.g. an S3 bucket (see NewS3ObjectStore), so that a client
+// running in a container whose disk doesn't outlive it can get its data back with RestoreFromObjectStore once it starts
+// again. Each collection is kept under <Prefix><collection name>/ as:
+//
+//	props     the props of the collection, as JSON, without the encryption keys
+//	docs/<k>  the file of the document for k as it is stored, see Collection.GetStoredFileData
+//	cursor    the sequence number and time of the last change in the bucket, as JSON
+//
+// The first sync of a collection uploads all of its documents, and removes the ones in the store that the collection
+// doesn't have. After that, for collections with EnableChangeFeed, only the documents changed since the last sync are
+// uploaded or removed, as read from the change feed (see Changes). The change at the cursor is checked against the feed
+// first, so a feed that has been pruned past it, or that has started over, e.g. in a new container, leads to a full sync
+// again. Collections without a change feed are synced in full every time.
+//
+// Documents are uploaded still compressed and encrypted if they are, so the store never sees the plaintext of an
+// encrypted collection. Since the encryption keys are left out, RestoreFromObjectStore needs them to be provided to the
+// client, as for any encrypted collection.
+//
+// A sync is a single pass: it is up to the application to sync as often as it needs to, e.g. on a ticker and once more
+// before it shuts down. Syncs to the same store should not run at the same time.
+
+const OBJECT_STORE_PROPS_NAME string = "props"
+const OBJECT_STORE_DOCS_DIR_NAME string = "docs"
+const OBJECT_STORE_CURSOR_NAME string = "cursor"
+
+var ErrObjectIsNotExist = fmt.Errorf("Object not found")
+
+// ObjectStore is where SyncToObjectStore keeps the collections. Objects are named with '/' separated paths.
+type ObjectStore interface {
+	PutObject(ctx context.Context, name string, data []byte) error
+	GetObject(ctx context.Context, name string) ([]byte, error) // returns ErrObjectIsNotExist if there is no such object
+	DeleteObject(ctx context.Context, name string) error
+	ListObjects(ctx context.Context, prefix string) ([]string, error) // returns the names of the objects that start with prefix
+}
+
+type ObjectStoreConfig struct {
+	Store       ObjectStore
+	Prefix      string          // put before the names of all the objects, e.g. "gofiledb/"
+	Collections []string        // the collections to sync, all of them if empty
+	Context     context.Context // the requests to the store give up once it is done, defaults to context.Background()
+}
+
+// objectStoreCursor records the last change synced to the store
+type objectStoreCursor struct {
+	Seq  Sequence
+	Time time.Time
+}
+
+func (cfg ObjectStoreConfig) getContext() context.Context {
+	if cfg.Context == nil {
+		return context.Background()
+	}
+	return cfg.Context
+}
+
+func (cfg ObjectStoreConfig) getCollectionPrefix(collectionName string) string {
+	return cfg.Prefix + collectionName + "/"
+}
+
+func (cfg ObjectStoreConfig) getDocName(collectionName string, k key.Key) string {
+	return cfg.getCollectionPrefix(collectionName) + OBJECT_STORE_DOCS_DIR_NAME + "/" + k.String()
+}
+
+// SyncToObjectStore uploads the changes to the collections since they were last synced to cfg.Store
+func (c *Client) SyncToObjectStore(cfg ObjectStoreConfig) error {
+	names := cfg.Collections
+	if len(names) == 0 {
+		c.collections.RLock()
+		names = c.collections.getNames()
+		c.collections.RUnlock()
+	}
+
+	for _, name := range names {
+		cl, err := c.getCollectionByName(name)
+		if err != nil {
+			return err
+		}
+		err = c.syncCollectionToObjectStore(cfg, cl)
+		if err != nil {
+			return fmt.Errorf("syncing collection %s: %w", cl.Name, err)
+		}
+	}
+	return nil
+}
+
+func (c *Client) syncCollectionToObjectStore(cfg ObjectStoreConfig, cl *collection.Collection) error {
+	ctx := cfg.getContext()
+	prefix := cfg.getCollectionPrefix(cl.Name)
+
+	props := cl.CollectionProps
+	props.EncryptionKey, props.PreviousEncryptionKey = nil, nil
+	data, err := json.Marshal(props)
+	if err != nil {
+		return err
+	}
+	err = cfg.Store.PutObject(ctx, prefix+OBJECT_STORE_PROPS_NAME, data)
+	if err != nil {
+		return err
+	}
+
+	var cursor objectStoreCursor
+	data, err = cfg.Store.GetObject(ctx, prefix+OBJECT_STORE_CURSOR_NAME)
+	if err == nil {
+		err = json.Unmarshal(data, &cursor)
+	}
+	if err != nil && err != ErrObjectIsNotExist {
+		return err
+	}
+
+	isSynced, err := isObjectStoreCursorValid(cl, cursor)
+	if err != nil {
+		return err
+	}
+	if isSynced {
+		cursor, err = syncChangesToObjectStore(cfg, cl, cursor)
+	} else {
+		cursor, err = syncAllToObjectStore(cfg, cl)
+	}
+	if err != nil {
+		return err
+	}
+	if cursor.Seq == 0 {
+		return nil
+	}
+
+	data, err = json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+	return cfg.Store.PutObject(ctx, prefix+OBJECT_STORE_CURSOR_NAME, data)
+}
+
+// isObjectStoreCursorValid tells whether the change at cursor is in the change feed of cl, so that the changes after it
+// are all that is left to sync
+func isObjectStoreCursorValid(cl *collection.Collection, cursor objectStoreCursor) (bool, error) {
+	if !cl.EnableChangeFeed || cursor.Seq == 0 {
+		return false, nil
+	}
+	it, err := cl.Changes(cursor.Seq - 1)
+	if err != nil {
+		return false, err
+	}
+	defer it.Close()
+	if !it.Next() {
+		return false, it.Err()
+	}
+	change := it.Change()
+	return change.Seq == cursor.Seq && change.Time.Equal(cursor.Time), nil
+}
+
+// syncChangesToObjectStore uploads or removes the documents changed after cursor, and returns the cursor of the last
+// change synced
+func syncChangesToObjectStore(cfg ObjectStoreConfig, cl *collection.Collection, cursor objectStoreCursor) (objectStoreCursor, error) {
+	it, err := cl.Changes(cursor.Seq)
+	if err != nil {
+		return cursor, err
+	}
+	changed := make(map[key.Key]bool)
+	last := cursor
+	for it.Next() {
+		change := it.Change()
+		changed[change.Key] = true
+		last = objectStoreCursor{Seq: change.Seq, Time: change.Time}
+	}
+	it.Close()
+	if it.Err() != nil {
+		return cursor, it.Err()
+	}
+
+	// Each document is synced as it is now, once, however many times it has changed
+	for k := range changed {
+		err = syncDocToObjectStore(cfg, cl, k)
+		if err != nil {
+			return cursor, err
+		}
+	}
+	return last, nil
+}
+
+// syncAllToObjectStore uploads all the documents of cl, removes the ones in the store that it doesn't have, and returns
+// the cursor of the last change made before they were read
+func syncAllToObjectStore(cfg ObjectStoreConfig, cl *collection.Collection) (objectStoreCursor, error) {
+	cursor, err := getLastChangeCursor(cl)
+	if err != nil {
+		return cursor, err
+	}
+
+	ctx := cfg.getContext()
+	docsPrefix := cfg.getCollectionPrefix(cl.Name) + OBJECT_STORE_DOCS_DIR_NAME + "/"
+	names, err := cfg.Store.ListObjects(ctx, docsPrefix)
+	if err != nil {
+		return cursor, err
+	}
+	stale := make(map[string]bool)
+	for _, name := range names {
+		stale[name] = true
+	}
+
+	err = cl.ForEachKey(func(k key.Key) error {
+		delete(stale, cfg.getDocName(cl.Name, k))
+		return syncDocToObjectStore(cfg, cl, k)
+	})
+	if err != nil {
+		return cursor, err
+	}
+	for name := range stale {
+		err = cfg.Store.DeleteObject(ctx, name)
+		if err != nil && err != ErrObjectIsNotExist {
+			return cursor, err
+		}
+	}
+	return cursor, nil
+}
+
+// getLastChangeCursor returns the cursor of the last change in the change feed of cl, which is zero if there is none
+func getLastChangeCursor(cl *collection.Collection) (objectStoreCursor, error) {
+	var cursor objectStoreCursor
+	if !cl.EnableChangeFeed {
+		return cursor, nil
+	}
+	seq, err := cl.GetLastChangeSeq()
+	if err != nil || seq == 0 {
+		return cursor, err
+	}
+	it, err := cl.Changes(seq - 1)
+	if err != nil {
+		return cursor, err
+	}
+	defer it.Close()
+	if it.Next() {
+		cursor = objectStoreCursor{Seq: it.Change().Seq, Time: it.Change().Time}
+	}
+	return cursor, it.Err()
+}
+
+// syncDocToObjectStore uploads the document for k, or removes it from the store if it no longer exists
+func syncDocToObjectStore(cfg ObjectStoreConfig, cl *collection.Collection, k key.Key) error {
+	ctx := cfg.getContext()
+	name := cfg.getDocName(cl.Name, k)
+	data, err := cl.GetStoredFileData(k)
+	if IsNotExist(err) {
+		err = cfg.Store.DeleteObject(ctx, name)
+		if err == ErrObjectIsNotExist {
+			return nil
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return cfg.Store.PutObject(ctx, name, data)
+}
+
+// RestoreFromObjectStore brings back the collections from cfg.Store as they were when they were last synced, see
+// SyncToObjectStore. The collections that don't exist are added with the props in the store, and the documents of the
+// ones that do are replaced, including the deletion of the ones that are not in the store. The collections are then
+// recorded as synced, so the next sync only uploads the changes made after the restore.
+func (c *Client) RestoreFromObjectStore(cfg ObjectStoreConfig) error {
+	ctx := cfg.getContext()
+	names := cfg.Collections
+	if len(names) == 0 {
+		objectNames, err := cfg.Store.ListObjects(ctx, cfg.Prefix)
+		if err != nil {
+			return err
+		}
+		for _, name := range objectNames {
+			name = strings.TrimPrefix(name, cfg.Prefix)
+			if strings.Count(name, "/") == 1 && strings.HasSuffix(name, "/"+OBJECT_STORE_PROPS_NAME) {
+				names = append(names, strings.TrimSuffix(name, "/"+OBJECT_STORE_PROPS_NAME))
+			}
+		}
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		err := c.restoreCollectionFromObjectStore(cfg, collection.NormalizeName(name))
+		if err != nil {
+			return fmt.Errorf("restoring collection %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (c *Client) restoreCollectionFromObjectStore(cfg ObjectStoreConfig, collectionName string) error {
+	ctx := cfg.getContext()
+	prefix := cfg.getCollectionPrefix(collectionName)
+
+	data, err := cfg.Store.GetObject(ctx, prefix+OBJECT_STORE_PROPS_NAME)
+	if err != nil {
+		return err
+	}
+	var props collection.CollectionProps
+	err = json.Unmarshal(data, &props)
+	if err != nil {
+		return err
+	}
+	err = c.addCollectionWithProps(collectionName, props)
+	if err != nil {
+		return err
+	}
+	cl, err := c.getWritableCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+
+	docsPrefix := prefix + OBJECT_STORE_DOCS_DIR_NAME + "/"
+	names, err := cfg.Store.ListObjects(ctx, docsPrefix)
+	if err != nil {
+		return err
+	}
+	restored := make(map[Key]bool)
+	for _, name := range names {
+		n, err := strconv.ParseInt(strings.TrimPrefix(name, docsPrefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		data, err := cfg.Store.GetObject(ctx, name)
+		if err == ErrObjectIsNotExist { // removed since it was listed
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = cl.SetStoredFileData(key.Key(n), data)
+		if err != nil {
+			return err
+		}
+		restored[Key(n)] = true
+	}
+	err = c.deleteUnsynced(collectionName, restored)
+	if err != nil {
+		return err
+	}
+
+	// The store now matches the collection as of its last change
+	cursor, err := getLastChangeCursor(cl)
+	if err != nil || cursor.Seq == 0 {
+		return err
+	}
+	data, err = json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+	return cfg.Store.PutObject(ctx, prefix+OBJECT_STORE_CURSOR_NAME, data)
+}
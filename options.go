@@ -0,0 +1,142 @@
+package gofiledb
+
+import (
+	"go.opentelemetry.io/otel/trace"
+)
+
+/********************************************************************************
+* O P T I O N S
+*********************************************************************************/
+
+// An Option configures the client that Initialize creates, e.g. Initialize(WithDocumentRoot(path), WithReadOnly()).
+// ClientInitOptions is an Option as well, which sets all of its fields at once, so it can still be given to Initialize
+// as it is, and followed by other options that change some of them.
+type Option interface {
+	apply(p *ClientInitOptions)
+}
+
+type optionFunc func(p *ClientInitOptions)
+
+func (fn optionFunc) apply(p *ClientInitOptions) {
+	fn(p)
+}
+
+func (o ClientInitOptions) apply(p *ClientInitOptions) {
+	*p = o
+}
+
+// WithDocumentRoot sets the dir in which the client keeps all its data. It is required.
+func WithDocumentRoot(documentRoot string) Option {
+	return optionFunc(func(p *ClientInitOptions) { p.DocumentRoot = documentRoot })
+}
+
+// WithOverwrite makes Initialize remove all the existing data in the document root
+func WithOverwrite() Option {
+	return optionFunc(func(p *ClientInitOptions) { p.OverwritePreviousData = true })
+}
+
+// WithReadOnly makes the client read-only, see ClientInitOptions.ReadOnly
+func WithReadOnly() Option {
+	return optionFunc(func(p *ClientInitOptions) { p.ReadOnly = true })
+}
+
+// WithEncryptionKey provides the key of the encrypted collection collectionName, since keys are never saved to disk
+func WithEncryptionKey(collectionName string, encryptionKey []byte) Option {
+	return optionFunc(func(p *ClientInitOptions) {
+		if p.EncryptionKeys == nil {
+			p.EncryptionKeys = make(map[string][]byte)
+		}
+		p.EncryptionKeys[collectionName] = encryptionKey
+	})
+}
+
+// WithPreviousEncryptionKey provides the old key of collectionName, which is only needed if a key rotation was
+// interrupted
+func WithPreviousEncryptionKey(collectionName string, encryptionKey []byte) Option {
+	return optionFunc(func(p *ClientInitOptions) {
+		if p.PreviousEncryptionKeys == nil {
+			p.PreviousEncryptionKeys = make(map[string][]byte)
+		}
+		p.PreviousEncryptionKeys[collectionName] = encryptionKey
+	})
+}
+
+// WithAuditActor sets who changes are attributed to in the audit logs, see ClientInitOptions.AuditActor
+func WithAuditActor(auditActor string) Option {
+	return optionFunc(func(p *ClientInitOptions) { p.AuditActor = auditActor })
+}
+
+// WithWriteErrorHandler sets the func that is called when a queued write fails, see ClientInitOptions.WriteErrorHandler
+func WithWriteErrorHandler(fn func(collectionName string, k Key, err error)) Option {
+	return optionFunc(func(p *ClientInitOptions) { p.WriteErrorHandler = fn })
+}
+
+// WithMaxConcurrentIO limits the number of files that are read or written at the same time, see
+// ClientInitOptions.MaxConcurrentIO
+func WithMaxConcurrentIO(maxConcurrentIO int) Option {
+	return optionFunc(func(p *ClientInitOptions) { p.MaxConcurrentIO = maxConcurrentIO })
+}
+
+// WithDefaultPartitions sets the NumPartitions of the collections that are added without one
+func WithDefaultPartitions(numPartitions int) Option {
+	return optionFunc(func(p *ClientInitOptions) { p.DefaultNumPartitions = numPartitions })
+}
+
+// WithFS makes the client keep its data in fsys rather than in the local file system, see ClientInitOptions.FS
+func WithFS(fsys FS) Option {
+	return optionFunc(func(p *ClientInitOptions) { p.FS = fsys })
+}
+
+// WithInMemory makes the client keep all its data in memory, see ClientInitOptions.InMemory
+func WithInMemory() Option {
+	return optionFunc(func(p *ClientInitOptions) { p.InMemory = true })
+}
+
+// WithLogLevel sets the level below which log messages are dropped. The level is global to the process, since it is the
+// one of the clog package, and is only set once Initialize has succeeded.
+func WithLogLevel(logLevel int) Option {
+	return optionFunc(func(p *ClientInitOptions) { p.LogLevel = &logLevel })
+}
+
+// WithLogger has the log messages written to l rather than to clog, see ClientInitOptions.Logger
+func WithLogger(l Logger) Option {
+	return optionFunc(func(p *ClientInitOptions) { p.Logger = l })
+}
+
+// WithHealthMinFreeBytes sets the free disk space below which Health reports the client as unhealthy
+func WithHealthMinFreeBytes(minFreeBytes uint64) Option {
+	return optionFunc(func(p *ClientInitOptions) { p.HealthMinFreeBytes = minFreeBytes })
+}
+
+// WithCollectionNameRules sets the rules that the names of new collections need to follow, see
+// ClientInitOptions.CollectionNameRules
+func WithCollectionNameRules(rules CollectionNameRules) Option {
+	return optionFunc(func(p *ClientInitOptions) { p.CollectionNameRules = rules })
+}
+
+// WithByteBudget sets the size that the warehouse is kept within by evicting documents, see ClientInitOptions.ByteBudget
+func WithByteBudget(maxBytes int64) Option {
+	return optionFunc(func(p *ClientInitOptions) { p.ByteBudget = maxBytes })
+}
+
+// WithByteBudgetHandler sets the func that is told about the documents evicted to stay within the ByteBudget, see
+// ClientInitOptions.ByteBudgetHandler
+func WithByteBudgetHandler(fn func(e ByteBudgetEviction)) Option {
+	return optionFunc(func(p *ClientInitOptions) { p.ByteBudgetHandler = fn })
+}
+
+// WithWALArchiver sets the func that the segments of the WAL are given to before they are recycled, see
+// ClientInitOptions.WALArchiver
+func WithWALArchiver(fn WALArchiver) Option {
+	return optionFunc(func(p *ClientInitOptions) { p.WALArchiver = fn })
+}
+
+// WithWALArchiveDir keeps a copy of the segments of the WAL in dirPath, see NewWALArchiveDir
+func WithWALArchiveDir(dirPath string) Option {
+	return optionFunc(func(p *ClientInitOptions) { p.WALArchiver = NewWALArchiveDir(dirPath) })
+}
+
+// WithTracerProvider has the operations of the client traced with a tracer of tp, see ClientInitOptions.TracerProvider
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return optionFunc(func(p *ClientInitOptions) { p.TracerProvider = tp })
+}
@@ -0,0 +1,100 @@
+package gofiledb
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/util"
+	"time"
+)
+
+/********************************************************************************
+* P O I N T - I N - T I M E  R E C O V E R Y
+*********************************************************************************/
+
+// A collection with RetainWAL keeps its WAL once it has been applied, in its WAL history (see ReadWALHistory). Together
+// with the snapshots of the collection, which serve as base backups, this lets RestoreToTime bring the collection back to
+// the way it was at any time since the oldest snapshot taken with RetainWAL set, e.g. to just before a document was
+// deleted by mistake: the latest snapshot taken before that time is restored, and the ops committed since it was taken
+// that began by that time are replayed onto it.
+//
+// The WAL history is only kept from the oldest such snapshot of the collection on: it is pruned whenever a snapshot of
+// the collection is taken or deleted. Restoring a snapshot, including by RestoreToTime, starts the history over, so
+// the collection can't be restored to a time before the restore afterwards, other than by restoring a snapshot.
+
+var ErrWALNotRetained = fmt.Errorf("The collection does not retain its WAL, see RetainWAL")
+var ErrNoSnapshotBeforeTime = fmt.Errorf("No snapshot of the collection was taken with RetainWAL set before that time")
+
+// RestoreToTime restores the collection as it was at t
+func (c *Client) RestoreToTime(collectionName string, t time.Time) error {
+	if c.isReadOnly() {
+		return ErrClientIsReadOnly
+	}
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+	if !cl.RetainWAL {
+		return ErrWALNotRetained
+	}
+
+	snapshots, err := c.ListSnapshots()
+	if err != nil {
+		return err
+	}
+	var base *SnapshotInfo
+	for i, s := range snapshots {
+		if s.CollectionName == cl.Name && s.IsWALRetained && !s.CreatedAt.After(t) {
+			base = &snapshots[i] // oldest first, so the last one is the latest
+		}
+	}
+	if base == nil {
+		return ErrNoSnapshotBeforeTime
+	}
+
+	// The history has to be read before the snapshot is restored, which starts it over
+	h, err := cl.ReadWALHistory(base.StartedAt, t)
+	if err != nil {
+		return err
+	}
+	err = c.RestoreSnapshot(base.Name)
+	if err != nil {
+		return err
+	}
+	cl, err = c.getCollectionByName(base.CollectionName)
+	if err != nil {
+		return err
+	}
+	n, err := cl.ReplayWALHistory(h)
+	if err != nil {
+		return fmt.Errorf("restored snapshot %s of collection %s, but could not replay the WAL history onto it: %w", base.Name, cl.Name, err)
+	}
+	util.Infof("Restored collection %s to %s: restored snapshot %s, and replayed %d ops from the WAL history", cl.Name, t, base.Name, n)
+	return nil
+}
+
+// pruneWALHistory removes the WAL history of cl that is older than all the snapshots of cl that it can be replayed onto
+func (c *Client) pruneWALHistory(cl *collection.Collection) error {
+	if !cl.RetainWAL {
+		return nil
+	}
+	snapshots, err := c.ListSnapshots()
+	if err != nil {
+		return err
+	}
+
+	before := time.Now()
+	for _, s := range snapshots {
+		if s.CollectionName == cl.Name && s.IsWALRetained && s.StartedAt.Before(before) {
+			before = s.StartedAt
+		}
+	}
+	n, err := cl.PruneWALHistory(before)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		util.Debugf("Pruned %d files of the WAL history of collection %s", n, cl.Name)
+	}
+	return nil
+}
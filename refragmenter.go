@@ -2,11 +2,11 @@ package gofiledb
 
 import (
 	"fmt"
-	"github.com/teejays/clog"
 	"github.com/teejays/gofiledb/key"
 	"github.com/teejays/gofiledb/util"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 )
@@ -40,32 +40,66 @@ func (a *BoolAtomic) CompareAndSet(v bool) bool {
 	return success
 }
 
-// Let's make a call that we can refragament only one collection at a time.
-var isRepartitioning BoolAtomic
+// repartitionLocks holds the data dirs that are being repartitioned, so that a collection is only repartitioned by one
+// call at a time, while other collections can be repartitioned (or otherwise maintained) at the same time
+var repartitionLocks = struct {
+	sync.Mutex
+	dirPaths map[string]bool
+}{dirPaths: make(map[string]bool)}
+
+// lockRepartition marks the data dir at dirPath as being repartitioned, and returns the func to unmark it, or
+// ErrIsRepartitioning if it is being repartitioned already
+func lockRepartition(dirPath string) (func(), error) {
+	dirPath = filepath.Clean(dirPath)
+	repartitionLocks.Lock()
+	defer repartitionLocks.Unlock()
+	if repartitionLocks.dirPaths[dirPath] {
+		return nil, ErrIsRepartitioning
+	}
+	repartitionLocks.dirPaths[dirPath] = true
+	return func() {
+		repartitionLocks.Lock()
+		delete(repartitionLocks.dirPaths, dirPath)
+		repartitionLocks.Unlock()
+	}, nil
+}
 
 type RepartitionParams struct {
 	DataDirectory    string // the location of the folder which stores the partition folders
 	NumPartitionsNew int    // the number of partitions that we want
+	FS               FS     // the file system that DataDirectory is in, if nil the local file system
 }
 
-var ErrIsRepartitioning = fmt.Errorf("The system is already busy repartitioning a collection. Please try again in a while.")
+var ErrIsRepartitioning = fmt.Errorf("The collection is already being repartitioned. Please try again in a while.")
 
+// Repartition moves the document files in params.DataDirectory into params.NumPartitionsNew partition dirs. It doesn't
+// change the NumPartitions of the collection that the dir belongs to, which can't find its documents afterwards unless
+// it is changed to match.
+//
+// Deprecated: use Client.RepartitionCollection, which updates the collection as well.
 func Repartition(params RepartitionParams) error {
 
-	if !((&isRepartitioning).CompareAndSet(true)) {
-		return ErrIsRepartitioning
-	}
-
 	if strings.TrimSpace(params.DataDirectory) == "" {
 		return fmt.Errorf("invalid data directory provided: %s", params.DataDirectory)
 	}
 
+	unlock, err := lockRepartition(params.DataDirectory)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	if params.NumPartitionsNew < 1 {
 		log.Panicf("invalid num-partitions provided: %d", params.NumPartitionsNew)
 	}
 
+	var fsys util.FS = util.OSFS{}
+	if params.FS != nil {
+		fsys = params.FS
+	}
+
 	// get all the current partition folders so we can read into them and start moving files
-	partitionFolders, err := getSubfiles(params.DataDirectory)
+	partitionFolders, err := getSubfiles(fsys, params.DataDirectory)
 	if err != nil {
 		return err
 	}
@@ -75,28 +109,28 @@ func Repartition(params RepartitionParams) error {
 
 		path := util.JoinPath(params.DataDirectory, partition)
 		// Ensure that we're looking into a folder, and not a file.
-		info, err := os.Stat(path)
+		info, err := fsys.Stat(path)
 		if err != nil {
 			return err
 		}
 		if !info.IsDir() {
-			clog.Warnf("Repartition: found a non-directory file `%s` at %s. Expected to find only partition folders", partition, params.DataDirectory)
+			util.Warnf("Repartition: found a non-directory file `%s` at %s. Expected to find only partition folders", partition, params.DataDirectory)
 			continue
 		}
 
 		// From the folder, get all the files
-		files, err := getSubfiles(path)
+		files, err := getSubfiles(fsys, path)
 		if err != nil {
 			return err
 		}
 		for _, f := range files {
 			// Ensure that we're looking at a file, and not a dir.
-			info, err := os.Stat(util.JoinPath(path, f))
+			info, err := fsys.Stat(util.JoinPath(path, f))
 			if err != nil {
 				return err
 			}
 			if info.IsDir() {
-				clog.Warnf("Repartition: found a directory `%s` at %s. Expected to find only documents files", f, path)
+				util.Warnf("Repartition: found a directory `%s` at %s. Expected to find only documents files", f, path)
 				continue
 			}
 
@@ -112,9 +146,9 @@ func Repartition(params RepartitionParams) error {
 			newPath := util.JoinPath(params.DataDirectory, newPartitionDir)
 
 			// if the dir doesn't exist, create one
-			if _, err := os.Stat(newPath); os.IsNotExist(err) {
+			if _, err := fsys.Stat(newPath); os.IsNotExist(err) {
 				fmt.Printf("Creating dir at %s...\n", newPath)
-				os.Mkdir(newPath, os.ModePerm)
+				fsys.MkdirAll(newPath, os.ModePerm)
 			}
 
 			// only move/rename if the path/name is different
@@ -122,7 +156,7 @@ func Repartition(params RepartitionParams) error {
 			newName := util.JoinPath(newPath, f)
 			if oldName != newName {
 				fmt.Printf("Moving file from %s to %s...\n", oldPath, newPath)
-				err := os.Rename(oldName, newName)
+				err := fsys.Rename(oldName, newName)
 				if err != nil {
 					return err
 				}
@@ -130,14 +164,12 @@ func Repartition(params RepartitionParams) error {
 		}
 	}
 
-	(&isRepartitioning).CompareAndSet(false)
-
 	return nil
 }
 
 // getSubfiles returns all the names of the files/directories at a given path
-func getSubfiles(path string) ([]string, error) {
-	file, err := os.Open(path)
+func getSubfiles(fsys util.FS, path string) ([]string, error) {
+	file, err := fsys.Open(path)
 	if err != nil {
 		return nil, err
 	}
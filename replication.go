@@ -0,0 +1,475 @@
+package gofiledb
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/key"
+	"github.com/teejays/gofiledb/util"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/********************************************************************************
+* R E P L I C A T I O N
+*********************************************************************************/
+
+// Replication keeps a warm standby of a collection on another machine. The leader serves the change feeds of its
+// collections (see Changes) with ServeReplication, and a follower keeps its copy of a collection in step with Follow: it
+// connects to the leader, and applies the changes to its own collection as they are made, with Set and Delete.
+//
+// A follower that has never followed the collection starts with a full sync, in which the leader sends every document,
+// and then the changes made since the sync started. The follower saves the sequence number of the last change it has
+// applied in the meta of its collection, so it carries on from there once it reconnects, even after a restart. If the
+// leader no longer has the changes since then, e.g. because they have been pruned, it does a full sync again, and the
+// documents that the follower has but the leader doesn't are deleted once it is done.
+//
+// For every change, the leader sends the document as it is when the change is sent, rather than as it was when the
+// change was made, so applying a change twice does no harm. The TTLs of documents are not replicated, and neither are the
+// snapshot restores on the leader, which are not in the change feed. The collection of the follower should not be
+// written to other than by Follow.
+//
+// Documents are sent decrypted, since each side encrypts its collection with its own key, so the leader only serves the
+// followers that authenticate (see ReplicationOptions), and the connections should use TLS unless the network between
+// them is trusted.
+
+const REPLICATION_CURSOR_META_NAME string = "replication_cursor"
+const REPLICATION_POLL_INTERVAL time.Duration = time.Second
+const REPLICATION_RETRY_INTERVAL time.Duration = time.Second
+const REPLICATION_REQUEST_TIMEOUT time.Duration = 10 * time.Second // for a follower to connect and send its request
+
+var ErrReplicationIsNotAuthenticated = fmt.Errorf("Replication needs a Secret, or a TLSConfig that requires and verifies client certificates, to authenticate the followers")
+var ErrReplicationIsUnauthorized = fmt.Errorf("The follower could not be authenticated by the leader")
+
+// ReplicationOptions secures the connections between a leader and its followers. The leader needs a Secret, or a TLSConfig
+// with ClientAuth set to tls.RequireAndVerifyClientCert (i.e. mTLS), or both, to authenticate the followers with.
+type ReplicationOptions struct {
+	// TLSConfig is used for the connections if set: as the server config by ServeReplication, and as the client config
+	// by Follow. Without it, the documents and Secret are sent in the clear.
+	TLSConfig *tls.Config
+	// Secret is what the followers have to send to be served, if set. Followers need the same one as the leader.
+	Secret []byte
+}
+
+// isAuthenticated tells whether the leader can authenticate the followers with opts
+func (opts ReplicationOptions) isAuthenticated() bool {
+	return len(opts.Secret) > 0 || (opts.TLSConfig != nil && opts.TLSConfig.ClientAuth == tls.RequireAndVerifyClientCert)
+}
+
+type replicationMsgType uint8
+
+const (
+	replicationMsgProps    replicationMsgType = iota + 1 // the props of the collection of the leader
+	replicationMsgFullSync                               // a full sync starts, every document follows
+	replicationMsgSet
+	replicationMsgDelete
+	replicationMsgSynced // the full sync is done, and the changes from Seq on follow
+	replicationMsgError
+)
+
+// replicationRequest is sent by a follower when it connects to the leader
+type replicationRequest struct {
+	Collection string
+	Cursor     Sequence // the sequence number of the last change the follower has applied, or 0 if none
+	Secret     []byte   // see ReplicationOptions
+}
+
+// replicationMsg is sent by the leader to a follower
+type replicationMsg struct {
+	Type  replicationMsgType
+	Seq   Sequence // for replicationMsgSet and replicationMsgDelete sent for a change, and replicationMsgSynced
+	Key   Key
+	Data  []byte
+	Props collection.CollectionProps
+	Err   string
+}
+
+// ServeReplication serves the change feeds of the collections of the client to the followers that connect to l (see
+// Follow) and authenticate with opts, until l is closed. The connections to the followers are then closed as well, and
+// it returns nil. It returns ErrReplicationIsNotAuthenticated right away if opts can't authenticate the followers.
+func (c *Client) ServeReplication(l net.Listener, opts ReplicationOptions) error {
+	if !opts.isAuthenticated() {
+		return ErrReplicationIsNotAuthenticated
+	}
+	if opts.TLSConfig != nil {
+		l = tls.NewListener(l, opts.TLSConfig)
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	conns := make(map[net.Conn]bool)
+	defer func() {
+		lock.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		lock.Unlock()
+		wg.Wait()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		lock.Lock()
+		conns[conn] = true
+		lock.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.serveFollower(conn, opts)
+			lock.Lock()
+			delete(conns, conn)
+			lock.Unlock()
+		}()
+	}
+}
+
+// serveFollower streams the changes to the collection requested by the follower at the other end of conn, until it
+// disconnects
+func (c *Client) serveFollower(conn net.Conn, opts ReplicationOptions) {
+	defer conn.Close()
+
+	// With TLS, the handshake (which checks the client certificate with mTLS) is done on this first read
+	var req replicationRequest
+	conn.SetReadDeadline(time.Now().Add(REPLICATION_REQUEST_TIMEOUT))
+	err := gob.NewDecoder(conn).Decode(&req)
+	if err != nil {
+		util.Warnf("Replication: could not read the request of follower %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	if len(opts.Secret) > 0 && subtle.ConstantTimeCompare(req.Secret, opts.Secret) != 1 {
+		util.Warnf("Replication: follower %s sent the wrong secret", conn.RemoteAddr())
+		gob.NewEncoder(conn).Encode(replicationMsg{Type: replicationMsgError, Err: ErrReplicationIsUnauthorized.Error()})
+		return
+	}
+
+	// Followers send nothing after their request, so the connection can only be read from again once it is closed
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+
+	enc := gob.NewEncoder(conn)
+	err = c.streamChanges(enc, req, gone)
+	if err != nil {
+		select {
+		case <-gone:
+			return
+		default:
+		}
+		util.Warnf("Replication: stopped serving collection %s to follower %s: %s", req.Collection, conn.RemoteAddr(), err)
+		enc.Encode(replicationMsg{Type: replicationMsgError, Err: err.Error()})
+	}
+}
+
+// streamChanges sends the changes to the collection requested in req to enc, with a full sync first if needed, until gone
+// is closed
+func (c *Client) streamChanges(enc *gob.Encoder, req replicationRequest, gone <-chan struct{}) error {
+	cl, err := c.getCollectionByName(req.Collection)
+	if err != nil {
+		return err
+	}
+	if !cl.EnableChangeFeed {
+		return ErrChangeFeedNotEnabled
+	}
+
+	// Encryption is set up on each side of its own
+	props := cl.CollectionProps
+	props.EncryptionKey, props.PreviousEncryptionKey, props.EncryptIndexes = nil, nil, false
+	err = enc.Encode(replicationMsg{Type: replicationMsgProps, Props: props})
+	if err != nil {
+		return err
+	}
+
+	// Subscribed to before reading the feed, so that no change is missed while waiting for the next one
+	events, unsubscribe := c.Subscribe(req.Collection)
+	defer unsubscribe()
+
+	since := req.Cursor
+	isSynced, err := isReplicationCursorValid(cl, since)
+	if err != nil {
+		return err
+	}
+	if !isSynced {
+		since, err = sendFullSync(cl, enc)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		// The collection may have been replaced since, e.g. by a snapshot restore
+		cl, err = c.getCollectionByName(req.Collection)
+		if err != nil {
+			return err
+		}
+		since, err = sendChanges(cl, enc, since)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-gone:
+			return nil
+		case <-events:
+		case <-time.After(REPLICATION_POLL_INTERVAL):
+		}
+		// The changes behind the events that have piled up are all sent on the next pass
+	drain:
+		for {
+			select {
+			case <-events:
+			default:
+				break drain
+			}
+		}
+	}
+}
+
+// isReplicationCursorValid tells whether the changes to cl after the change with sequence number cursor are all still
+// in its change feed, so that a follower that has applied the changes up to that one can carry on from there
+func isReplicationCursorValid(cl *collection.Collection, cursor Sequence) (bool, error) {
+	if cursor == 0 {
+		return false, nil
+	}
+	lastSeq, err := cl.GetLastChangeSeq()
+	if err != nil {
+		return false, err
+	}
+	if cursor > lastSeq { // the follower is ahead, e.g. the leader has been restored from a backup
+		return false, nil
+	}
+	if cursor == lastSeq {
+		return true, nil
+	}
+
+	it, err := cl.Changes(cursor)
+	if err != nil {
+		return false, err
+	}
+	defer it.Close()
+	if !it.Next() { // pruned
+		return false, it.Err()
+	}
+	return it.Change().Seq == cursor+1, nil
+}
+
+// sendFullSync sends every document of cl to enc, and returns the sequence number of the last change made before they
+// were read, which the changes are to be sent after
+func sendFullSync(cl *collection.Collection, enc *gob.Encoder) (Sequence, error) {
+	seq, err := cl.GetLastChangeSeq()
+	if err != nil {
+		return 0, err
+	}
+	err = enc.Encode(replicationMsg{Type: replicationMsgFullSync})
+	if err != nil {
+		return 0, err
+	}
+
+	err = cl.ForEachKey(func(k key.Key) error {
+		data, err := cl.GetFileData(k)
+		if IsNotExist(err) || errors.Is(err, ErrDocumentIsCorrupted) { // deleted or quarantined since, which is a change
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return enc.Encode(replicationMsg{Type: replicationMsgSet, Key: Key(k), Data: data})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return seq, enc.Encode(replicationMsg{Type: replicationMsgSynced, Seq: seq})
+}
+
+// sendChanges sends the changes to cl after the one with sequence number since to enc, and returns the sequence number
+// of the last one sent
+func sendChanges(cl *collection.Collection, enc *gob.Encoder, since Sequence) (Sequence, error) {
+	it, err := cl.Changes(since)
+	if err != nil {
+		return since, err
+	}
+	defer it.Close()
+
+	for it.Next() {
+		change := it.Change()
+		msg := replicationMsg{Type: replicationMsgDelete, Seq: change.Seq, Key: Key(change.Key)}
+		if change.Op != AUDIT_OP_DELETE && change.Op != AUDIT_OP_QUARANTINE {
+			data, err := cl.GetFileData(change.Key)
+			switch {
+			case err == nil:
+				msg.Type, msg.Data = replicationMsgSet, data
+			case IsNotExist(err), errors.Is(err, ErrDocumentIsCorrupted): // deleted or quarantined since
+			default:
+				return since, err
+			}
+		}
+
+		err = enc.Encode(msg)
+		if err != nil {
+			return since, err
+		}
+		since = change.Seq
+	}
+	return since, it.Err()
+}
+
+// Follow keeps the collection of the client in step with the collection of the same name of the leader at addr (see
+// ServeReplication), connecting with opts, and creates it with the props of the leader's if it doesn't exist. It
+// reconnects to the leader whenever the connection drops, and only returns once ctx is done, with ctx.Err(), or if the
+// leader can't serve the collection, e.g. with ErrCollectionIsNotExist, ErrChangeFeedNotEnabled or
+// ErrReplicationIsUnauthorized.
+func (c *Client) Follow(ctx context.Context, addr string, collectionName string, opts ReplicationOptions) error {
+	for {
+		err := c.followOnce(ctx, addr, collectionName, opts)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == ErrCollectionIsNotExist || err == ErrChangeFeedNotEnabled || err == ErrReplicationIsUnauthorized {
+			return err
+		}
+		util.Warnf("Replication: following collection %s at %s: %s, reconnecting in %s", collectionName, addr, err, REPLICATION_RETRY_INTERVAL)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(REPLICATION_RETRY_INTERVAL):
+		}
+	}
+}
+
+// followOnce connects to the leader at addr, and applies the changes to the collection that it sends, until the
+// connection drops or ctx is done
+func (c *Client) followOnce(ctx context.Context, addr string, collectionName string, opts ReplicationOptions) error {
+	var conn net.Conn
+	var err error
+	if opts.TLSConfig != nil {
+		d := tls.Dialer{Config: opts.TLSConfig}
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	cursor, err := c.getReplicationCursor(collectionName)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(conn).Encode(replicationRequest{Collection: collectionName, Cursor: cursor, Secret: opts.Secret})
+	if err != nil {
+		return err
+	}
+
+	dec := gob.NewDecoder(bufio.NewReader(conn))
+	var synced map[Key]bool // the documents sent so far by a full sync in progress
+	for {
+		var msg replicationMsg
+		err = dec.Decode(&msg)
+		if err != nil {
+			return err
+		}
+
+		switch msg.Type {
+		case replicationMsgProps:
+			err = c.addCollectionWithProps(collectionName, msg.Props)
+		case replicationMsgFullSync:
+			synced = make(map[Key]bool)
+		case replicationMsgSet:
+			err = c.Set(collectionName, msg.Key, msg.Data)
+			if synced != nil {
+				synced[msg.Key] = true
+			}
+		case replicationMsgDelete:
+			err = c.Delete(collectionName, msg.Key)
+			if IsNotExist(err) {
+				err = nil
+			}
+		case replicationMsgSynced:
+			err = c.deleteUnsynced(collectionName, synced)
+			synced = nil
+		case replicationMsgError:
+			return getReplicationError(msg.Err)
+		default:
+			return fmt.Errorf("unknown replication message type %d", msg.Type)
+		}
+		if err != nil {
+			return err
+		}
+
+		if msg.Seq > 0 {
+			err = c.SetCollectionMeta(collectionName, REPLICATION_CURSOR_META_NAME, msg.Seq)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// getReplicationCursor returns the sequence number of the last change of the leader applied to the collection, or 0 if
+// there is none, e.g. if the collection doesn't exist yet
+func (c *Client) getReplicationCursor(collectionName string) (Sequence, error) {
+	var cursor Sequence
+	err := c.GetCollectionMeta(collectionName, REPLICATION_CURSOR_META_NAME, &cursor)
+	if err == ErrCollectionIsNotExist || err == ErrMetaIsNotExist {
+		return 0, nil
+	}
+	return cursor, err
+}
+
+// deleteUnsynced deletes the documents of the collection that are not in synced, i.e. that the leader doesn't have
+func (c *Client) deleteUnsynced(collectionName string, synced map[Key]bool) error {
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+	var unsynced []Key
+	err = cl.ForEachKey(func(k key.Key) error {
+		if !synced[Key(k)] {
+			unsynced = append(unsynced, Key(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range unsynced {
+		err = c.Delete(collectionName, k)
+		if err != nil && !IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// getReplicationError returns the error that the leader has sent, as one of the errors of the package if it is one
+func getReplicationError(msg string) error {
+	for _, err := range []error{ErrCollectionIsNotExist, ErrChangeFeedNotEnabled, ErrReplicationIsUnauthorized} {
+		if msg == err.Error() {
+			return err
+		}
+	}
+	return fmt.Errorf("the leader stopped with: %s", msg)
+}
@@ -0,0 +1,213 @@
+package gofiledb
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+/********************************************************************************
+* S 3
+*********************************************************************************/
+
+// S3ObjectStore is an ObjectStore backed by a bucket of S3, or of any storage with an S3 compatible API, e.g. MinIO. Its
+// requests are signed with AWS Signature Version 4, and address the bucket in the path rather than in the host name, so
+// the endpoint can be any host.
+
+// S3Options tell NewS3ObjectStore where the bucket is, and how to sign the requests to it
+type S3Options struct {
+	Endpoint        string // e.g. https://s3.us-east-1.amazonaws.com
+	Region          string // e.g. us-east-1
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	HTTPClient      *http.Client // defaults to http.DefaultClient
+}
+
+type S3ObjectStore struct {
+	opts S3Options
+}
+
+// NewS3ObjectStore returns an ObjectStore for the bucket described by opts
+func NewS3ObjectStore(opts S3Options) *S3ObjectStore {
+	opts.Endpoint = strings.TrimSuffix(opts.Endpoint, "/")
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	return &S3ObjectStore{opts: opts}
+}
+
+func (s *S3ObjectStore) PutObject(ctx context.Context, name string, data []byte) error {
+	_, err := s.do(ctx, http.MethodPut, name, nil, data)
+	return err
+}
+
+func (s *S3ObjectStore) GetObject(ctx context.Context, name string) ([]byte, error) {
+	return s.do(ctx, http.MethodGet, name, nil, nil)
+}
+
+func (s *S3ObjectStore) DeleteObject(ctx context.Context, name string) error {
+	_, err := s.do(ctx, http.MethodDelete, name, nil, nil)
+	return err
+}
+
+// s3ListResult is the part of the response to ListObjectsV2 that ListObjects uses
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3ObjectStore) ListObjects(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		body, err := s.do(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.Unmarshal(body, &result)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the objects listed by S3: %w", err)
+		}
+		for _, c := range result.Contents {
+			names = append(names, c.Key)
+		}
+		if !result.IsTruncated {
+			return names, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// do sends a signed request for the object name (or for the bucket if name is empty) and returns the body of the
+// response. A 404 response to a request for an object is ErrObjectIsNotExist.
+func (s *S3ObjectStore) do(ctx context.Context, method string, name string, query url.Values, payload []byte) ([]byte, error) {
+	path := "/" + s.opts.Bucket
+	if name != "" {
+		path += "/" + name
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.opts.Endpoint+escapeS3Path(path)+encodeS3Query(query), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, path, query, payload, time.Now().UTC())
+
+	resp, err := s.opts.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound && name != "" {
+		return nil, ErrObjectIsNotExist
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("S3 responded to %s %s with %s: %s", method, path, resp.Status, bytes.TrimSpace(body))
+	}
+	return body, nil
+}
+
+// sign adds the headers of AWS Signature Version 4 to req, which is for path and query
+func (s *S3ObjectStore) sign(req *http.Request, path string, query url.Values, payload []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		escapeS3Path(path),
+		strings.TrimPrefix(encodeS3Query(query), "?"),
+		"host:" + req.URL.Host + "\n" + "x-amz-content-sha256:" + payloadHash + "\n" + "x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.opts.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := []byte("AWS4" + s.opts.SecretAccessKey)
+	for _, part := range []string{date, s.opts.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.opts.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// escapeS3Path escapes path as S3 expects it in the canonical request, which leaves only the unreserved characters and
+// the slashes as they are
+func escapeS3Path(path string) string {
+	var b strings.Builder
+	for _, c := range []byte(path) {
+		if c == '/' || isS3Unreserved(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// encodeS3Query returns query sorted and escaped as S3 expects it in the canonical request, with a leading '?' unless
+// it is empty
+func encodeS3Query(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		vs := append([]string(nil), query[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			pairs = append(pairs, escapeS3QueryPart(k)+"="+escapeS3QueryPart(v))
+		}
+	}
+	return "?" + strings.Join(pairs, "&")
+}
+
+func escapeS3QueryPart(s string) string {
+	return strings.ReplaceAll(escapeS3Path(s), "/", "%2F")
+}
+
+func isS3Unreserved(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~'
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,412 @@
+package gofiledb
+
+import (
+	"encoding/gob"
+	"fmt"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/util"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+/********************************************************************************
+* S N A P S H O T S
+*********************************************************************************/
+
+// Snapshots are saved under <documentRoot>/snapshots/<snapshot name>/, each with the snapshot of the collection dir and
+// an info file. Snapshot names are unique across all the collections of the client.
+
+const SNAPSHOTS_DIR_NAME string = "snapshots"
+const SNAPSHOT_INFO_FILE_NAME string = "snapshot.gob"
+const SNAPSHOT_COLLECTION_DIR_NAME string = "collection"
+
+var ErrSnapshotIsExist = fmt.Errorf("Snapshot with this name already exists")
+var ErrSnapshotIsNotExist = fmt.Errorf("Snapshot not found")
+
+type SnapshotInfo struct {
+	Name           string
+	CollectionName string
+	CreatedAt      time.Time
+	StartedAt      time.Time // when taking the snapshot started, zero for the snapshots taken before it was recorded
+	IsWALRetained  bool      // whether the collection had RetainWAL set, so that it can be restored to a later time
+}
+
+func (c *Client) getSnapshotsDirPath() string {
+	return util.JoinPath(c.documentRoot, SNAPSHOTS_DIR_NAME)
+}
+
+func validateSnapshotName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("Snapshot name cannot be empty")
+	}
+	// the name is used as a dir name, so keep it simple
+	if regexp.MustCompile("[^a-zA-Z0-9_-]+").MatchString(name) {
+		return fmt.Errorf("Snapshot name can only have letters, numbers, '_' and '-'")
+	}
+	if strings.HasPrefix(name, collection.TEMP_FILE_PREFIX) {
+		return fmt.Errorf("Snapshot name cannot start with %s", collection.TEMP_FILE_PREFIX)
+	}
+	return nil
+}
+
+// Snapshot captures a consistent copy of the collection under the given name, which can later be restored using
+// RestoreSnapshot. Files are hard linked where possible, so a snapshot takes little extra space until the collection
+// changes. Writes to the collection are blocked while the snapshot is being taken.
+func (c *Client) Snapshot(collectionName string, name string) error {
+	if c.isReadOnly() {
+		return ErrClientIsReadOnly
+	}
+
+	err := validateSnapshotName(name)
+	if err != nil {
+		return err
+	}
+
+	cl, err := c.getCollectionByName(collectionName)
+	if err != nil {
+		return err
+	}
+
+	dirPath := util.JoinPath(c.getSnapshotsDirPath(), name)
+	if _, err := c.fs().Stat(dirPath); err == nil {
+		return ErrSnapshotIsExist
+	}
+
+	// Build the snapshot in a temp dir and then move it into place, so an interrupted snapshot is never listed
+	tmpDirPath := util.JoinPath(c.getSnapshotsDirPath(), collection.TEMP_FILE_PREFIX+name)
+	err = c.fs().RemoveAll(tmpDirPath)
+	if err != nil {
+		return err
+	}
+	err = util.CreateDirIfNotExist(c.fs(), tmpDirPath)
+	if err != nil {
+		return err
+	}
+
+	startedAt := time.Now()
+	err = cl.Snapshot(util.JoinPath(tmpDirPath, SNAPSHOT_COLLECTION_DIR_NAME))
+	if err != nil {
+		c.fs().RemoveAll(tmpDirPath)
+		return err
+	}
+
+	info := SnapshotInfo{
+		Name:           name,
+		CollectionName: cl.Name,
+		CreatedAt:      time.Now(),
+		StartedAt:      startedAt,
+		IsWALRetained:  cl.RetainWAL,
+	}
+	err = c.writeSnapshotInfo(util.JoinPath(tmpDirPath, SNAPSHOT_INFO_FILE_NAME), info)
+	if err != nil {
+		c.fs().RemoveAll(tmpDirPath)
+		return err
+	}
+
+	err = c.fs().Rename(tmpDirPath, dirPath)
+	if err != nil {
+		return err
+	}
+	return c.pruneWALHistory(cl)
+}
+
+// RestoreSnapshot replaces the collection the snapshot was taken of with the snapshot. If the collection has been
+// removed since, it is added back. The snapshot is kept, so it can be restored again.
+func (c *Client) RestoreSnapshot(name string) error {
+	if c.isReadOnly() {
+		return ErrClientIsReadOnly
+	}
+
+	info, err := c.getSnapshotInfo(name)
+	if err != nil {
+		return err
+	}
+	snapshotDirPath := util.JoinPath(c.getSnapshotsDirPath(), name, SNAPSHOT_COLLECTION_DIR_NAME)
+
+	// Restore into a temp dir first, so the current collection is left intact if something goes wrong
+	dirPath := c.getDirPathForCollection(info.CollectionName)
+	newDirPath, oldDirPath, commitPath := getRestorePaths(dirPath)
+	for _, path := range []string{newDirPath, oldDirPath, commitPath} {
+		err = c.fs().RemoveAll(path)
+		if err != nil {
+			return err
+		}
+	}
+	cl, err := collection.RestoreSnapshotFS(c.fs(), snapshotDirPath, newDirPath)
+	if err != nil {
+		c.fs().RemoveAll(newDirPath)
+		return err
+	}
+	if cl.DirPath != dirPath {
+		c.fs().RemoveAll(newDirPath)
+		return fmt.Errorf("snapshot %s is of a collection at %s, and can not be restored to %s", name, cl.DirPath, dirPath)
+	}
+
+	// Once the commit file is written, the restore is finished by the next Initialize if we crash before it is done
+	err = c.writeRestoreCommit(commitPath, cl)
+	if err != nil {
+		c.fs().RemoveAll(newDirPath)
+		c.fs().Remove(commitPath)
+		return err
+	}
+
+	return c.finishRestore(cl)
+}
+
+// getRestorePaths returns the paths used while restoring a snapshot of the collection at dirPath: the dir the snapshot
+// is restored into, the dir the current collection is moved to, and the commit file
+func getRestorePaths(dirPath string) (string, string, string) {
+	return dirPath + "." + collection.TEMP_FILE_PREFIX + "restore",
+		dirPath + "." + collection.TEMP_FILE_PREFIX + "old",
+		dirPath + "." + collection.TEMP_FILE_PREFIX + "restore_commit"
+}
+
+// finishRestore swaps in the dir that a snapshot has been restored into, and registers cl (the restored collection) in
+// place of the current one. It can be called again if it is interrupted.
+func (c *Client) finishRestore(cl *collection.Collection) error {
+	newDirPath, oldDirPath, commitPath := getRestorePaths(cl.DirPath)
+
+	// Keys are never saved, so carry them over from the collection being replaced
+	c.collections.Lock()
+	existing, hasKey, err := c.getCollectionLocked(cl.Name)
+	c.collections.Unlock()
+	if err != nil {
+		return err
+	}
+	if hasKey {
+		err = existing.Close()
+		if err != nil {
+			util.Warnf("Error while closing collection %s: %s", existing.Name, err)
+		}
+		if cl.IsMissingEncryptionKey() && len(existing.EncryptionKey) > 0 {
+			err = cl.SetEncryptionKeys(existing.EncryptionKey, existing.PreviousEncryptionKey)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if cl.IsMissingEncryptionKey() {
+		util.Warnf("Restored collection %s is encrypted, but no encryption key is available for it.", cl.Name)
+	}
+
+	// Swap the dirs, unless that has been done already
+	if _, err := c.fs().Stat(newDirPath); err == nil {
+		// The audit trail and the change feed are not part of the snapshot, and carry on from the collection being replaced
+		for _, name := range []string{collection.AUDIT_DIR_NAME, collection.CHANGE_FEED_DIR_NAME} {
+			relPath := util.JoinPath(collection.META_DIR_NAME, name)
+			err = c.fs().Rename(util.JoinPath(cl.DirPath, relPath), util.JoinPath(newDirPath, relPath))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		err = c.fs().Rename(cl.DirPath, oldDirPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		err = c.fs().Rename(newDirPath, cl.DirPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.setupCollection(cl)
+	c.collections.Lock()
+	c.collections.setLoaded(cl.Name, cl)
+	c.collections.Unlock()
+
+	err = c.save()
+	if err != nil {
+		return err
+	}
+
+	err = c.fs().RemoveAll(oldDirPath)
+	if err != nil {
+		return err
+	}
+	return c.fs().Remove(commitPath)
+}
+
+// writeRestoreCommit saves the restored collection cl at path, and makes sure it is on disk
+func (c *Client) writeRestoreCommit(path string, cl *collection.Collection) error {
+	file, err := c.fs().OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, util.FILE_PERM)
+	if err != nil {
+		return err
+	}
+	// GobEncode leaves out the encryption keys
+	err = gob.NewEncoder(file).Encode(cl)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return util.SyncFile(c.fs(), filepath.Dir(path))
+}
+
+// recoverRestores finishes the snapshot restores that were committed but interrupted, e.g. by a crash, and undoes the
+// ones that weren't committed. It returns the number of restores recovered.
+func (c *Client) recoverRestores() (int, error) {
+	dataDirPath := util.JoinPath(c.documentRoot, util.DATA_DIR_NAME)
+	fileInfos, err := util.ReadDir(c.fs(), dataDirPath)
+	if err != nil {
+		return 0, err
+	}
+
+	// Find the collections with a restore in progress, from the files that a restore leaves behind
+	var dirPaths []string
+	var seen map[string]bool = make(map[string]bool)
+	for _, fileInfo := range fileInfos {
+		for _, suffix := range []string{"restore", "old", "restore_commit"} {
+			suffix = "." + collection.TEMP_FILE_PREFIX + suffix
+			if !strings.HasSuffix(fileInfo.Name(), suffix) {
+				continue
+			}
+			dirPath := util.JoinPath(dataDirPath, strings.TrimSuffix(fileInfo.Name(), suffix))
+			if !seen[dirPath] {
+				seen[dirPath] = true
+				dirPaths = append(dirPaths, dirPath)
+			}
+		}
+	}
+
+	var n int
+	for _, dirPath := range dirPaths {
+		newDirPath, oldDirPath, commitPath := getRestorePaths(dirPath)
+
+		var cl *collection.Collection = new(collection.Collection)
+		file, err := c.fs().Open(commitPath)
+		if err == nil {
+			err = gob.NewDecoder(file).Decode(cl)
+			file.Close()
+		}
+		if err == nil {
+			util.Warnf("Recovery: finishing the interrupted restore of a snapshot of collection %s", cl.Name)
+			err = c.finishRestore(cl)
+			if err != nil {
+				return n, err
+			}
+			n++
+			continue
+		}
+		if !os.IsNotExist(err) {
+			util.Warnf("Recovery: could not read %s, so the restore was not committed: %s", commitPath, err)
+		}
+
+		// Not committed: put the collection back the way it was
+		util.Warnf("Recovery: undoing the interrupted restore of a snapshot at %s", dirPath)
+		if _, err := c.fs().Stat(dirPath); os.IsNotExist(err) {
+			err = c.fs().Rename(oldDirPath, dirPath)
+			if err != nil && !os.IsNotExist(err) {
+				return n, err
+			}
+		}
+		for _, path := range []string{newDirPath, oldDirPath, commitPath} {
+			err = c.fs().RemoveAll(path)
+			if err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// ListSnapshots returns all the snapshots of the client, oldest first
+func (c *Client) ListSnapshots() ([]SnapshotInfo, error) {
+	fileInfos, err := util.ReadDir(c.fs(), c.getSnapshotsDirPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []SnapshotInfo
+	for _, fileInfo := range fileInfos {
+		if !fileInfo.IsDir() || strings.HasPrefix(fileInfo.Name(), collection.TEMP_FILE_PREFIX) {
+			continue
+		}
+		info, err := c.getSnapshotInfo(fileInfo.Name())
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, info)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt) })
+
+	return snapshots, nil
+}
+
+// DeleteSnapshot removes a snapshot. The collection it was taken of is not affected.
+func (c *Client) DeleteSnapshot(name string) error {
+	if c.isReadOnly() {
+		return ErrClientIsReadOnly
+	}
+
+	info, err := c.getSnapshotInfo(name)
+	if err != nil {
+		return err
+	}
+	err = c.fs().RemoveAll(util.JoinPath(c.getSnapshotsDirPath(), name))
+	if err != nil || !info.IsWALRetained {
+		return err
+	}
+
+	cl, err := c.getCollectionByName(info.CollectionName)
+	if err == ErrCollectionIsNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return c.pruneWALHistory(cl)
+}
+
+func (c *Client) getSnapshotInfo(name string) (SnapshotInfo, error) {
+	var info SnapshotInfo
+
+	err := validateSnapshotName(name)
+	if err != nil {
+		return info, err
+	}
+
+	file, err := c.fs().Open(util.JoinPath(c.getSnapshotsDirPath(), name, SNAPSHOT_INFO_FILE_NAME))
+	if os.IsNotExist(err) {
+		return info, ErrSnapshotIsNotExist
+	}
+	if err != nil {
+		return info, err
+	}
+	defer file.Close()
+
+	err = gob.NewDecoder(file).Decode(&info)
+	return info, err
+}
+
+func (c *Client) writeSnapshotInfo(path string, info SnapshotInfo) error {
+	file, err := c.fs().OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, util.FILE_PERM)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(file).Encode(info)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,217 @@
+package gofiledb
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/util"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+/********************************************************************************
+* S C H E D U L E D  S N A P S H O T S
+*********************************************************************************/
+
+// ScheduleSnapshots has the client take a snapshot of a collection every Interval in the background, e.g. every 6h, and
+// keep only the Keep latest ones, e.g. 8, once the AfterSnapshot hooks have run on the new one:
+//
+//	client.ScheduleSnapshots(SnapshotSchedule{
+//		CollectionName: "orders",
+//		Interval:       6 * time.Hour,
+//		Keep:           8,
+//		AfterSnapshot:  []SnapshotHook{CommandHook("/usr/local/bin/upload-snapshot")},
+//	})
+//
+// Scheduled snapshots are named SCHEDULED_SNAPSHOT_PREFIX, followed by the name of the collection and the time they are
+// taken at, and only those are pruned: the snapshots taken with Snapshot are left alone. Schedules are not saved with
+// the client, so they need to be set up again every time it is initialized, and they stop when it is closed. Errors in
+// the background are logged.
+
+const SCHEDULED_SNAPSHOT_PREFIX string = "scheduled_"
+
+var ErrInvalidSnapshotSchedule = fmt.Errorf("The Interval of a snapshot schedule must be > 0")
+var ErrSnapshotScheduleIsNotExist = fmt.Errorf("The collection has no snapshot schedule")
+
+type SnapshotSchedule struct {
+	CollectionName string
+	Interval       time.Duration
+	Keep           int // if > 0, the older scheduled snapshots of the collection are deleted once there are more than this many
+	// AfterSnapshot are run in order once each snapshot has been taken. An error is logged, and doesn't keep the next
+	// hooks from running.
+	AfterSnapshot []SnapshotHook
+}
+
+// SnapshotHook is run once a scheduled snapshot has been taken, with its info and the path of its dir, which is kept
+// until the hook returns
+type SnapshotHook func(info SnapshotInfo, dirPath string) error
+
+type snapshotScheduleStore struct {
+	Store map[string]*snapshotScheduler // collection name -> its scheduler
+	sync.Mutex
+}
+
+type snapshotScheduler struct {
+	schedule       SnapshotSchedule
+	stop           chan struct{}
+	done           chan struct{}
+	lastSnapshotAt time.Time // when the last scheduled snapshot was taken, zero if none has been yet
+	numFailures    int64     // scheduled snapshots that have failed
+	statusLock     sync.Mutex
+}
+
+// CommandHook returns a SnapshotHook that runs the command name with args, e.g. a script that uploads the snapshot. The
+// snapshot is described to the command by the GOFILEDB_SNAPSHOT_NAME, GOFILEDB_SNAPSHOT_COLLECTION and
+// GOFILEDB_SNAPSHOT_PATH environment variables. The hook fails if the command exits with an error, along with its output.
+func CommandHook(name string, args ...string) SnapshotHook {
+	return func(info SnapshotInfo, dirPath string) error {
+		cmd := exec.Command(name, args...)
+		cmd.Env = append(os.Environ(),
+			"GOFILEDB_SNAPSHOT_NAME="+info.Name,
+			"GOFILEDB_SNAPSHOT_COLLECTION="+info.CollectionName,
+			"GOFILEDB_SNAPSHOT_PATH="+dirPath,
+		)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("running %s: %w: %s", name, err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+}
+
+// ScheduleSnapshots starts taking snapshots of s.CollectionName every s.Interval, in place of its current schedule if any
+func (c *Client) ScheduleSnapshots(s SnapshotSchedule) error {
+	if c.isReadOnly() {
+		return ErrClientIsReadOnly
+	}
+	if s.Interval <= 0 {
+		return ErrInvalidSnapshotSchedule
+	}
+	cl, err := c.getCollectionByName(s.CollectionName)
+	if err != nil {
+		return err
+	}
+	s.CollectionName = cl.Name
+
+	c.UnscheduleSnapshots(cl.Name)
+
+	sch := &snapshotScheduler{schedule: s, stop: make(chan struct{}), done: make(chan struct{})}
+	c.snapshotSchedules.Lock()
+	if c.snapshotSchedules.Store == nil {
+		c.snapshotSchedules.Store = make(map[string]*snapshotScheduler)
+	}
+	c.snapshotSchedules.Store[cl.Name] = sch
+	c.snapshotSchedules.Unlock()
+
+	go func() {
+		defer close(sch.done)
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := c.takeScheduledSnapshot(sch.schedule)
+				sch.statusLock.Lock()
+				if err != nil {
+					sch.numFailures++
+				} else {
+					sch.lastSnapshotAt = time.Now()
+				}
+				sch.statusLock.Unlock()
+				if err != nil {
+					util.Warnf("Error while taking the scheduled snapshot of collection %s: %s", s.CollectionName, err)
+				}
+			case <-sch.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// UnscheduleSnapshots stops taking snapshots of the collection, and waits for the one in progress to finish. The
+// snapshots taken so far are kept.
+func (c *Client) UnscheduleSnapshots(collectionName string) error {
+	if c.snapshotSchedules == nil {
+		return ErrSnapshotScheduleIsNotExist
+	}
+	collectionName = collection.NormalizeName(collectionName)
+	c.snapshotSchedules.Lock()
+	sch, hasKey := c.snapshotSchedules.Store[collectionName]
+	delete(c.snapshotSchedules.Store, collectionName)
+	c.snapshotSchedules.Unlock()
+	if !hasKey {
+		return ErrSnapshotScheduleIsNotExist
+	}
+	close(sch.stop)
+	<-sch.done
+	return nil
+}
+
+// stopSnapshotSchedules stops all the snapshot schedules of the client
+func (c *Client) stopSnapshotSchedules() {
+	if c.snapshotSchedules == nil {
+		return
+	}
+	c.snapshotSchedules.Lock()
+	var names []string
+	for name := range c.snapshotSchedules.Store {
+		names = append(names, name)
+	}
+	c.snapshotSchedules.Unlock()
+	for _, name := range names {
+		c.UnscheduleSnapshots(name)
+	}
+}
+
+// takeScheduledSnapshot takes a snapshot of the collection of s, runs the hooks of s on it, and prunes the older ones
+func (c *Client) takeScheduledSnapshot(s SnapshotSchedule) error {
+	prefix := getScheduledSnapshotPrefix(s.CollectionName)
+	name := fmt.Sprintf("%s%d", prefix, time.Now().UnixNano())
+	err := c.Snapshot(s.CollectionName, name)
+	if err != nil {
+		return err
+	}
+	info, err := c.getSnapshotInfo(name)
+	if err != nil {
+		return err
+	}
+
+	dirPath := util.JoinPath(c.getSnapshotsDirPath(), name)
+	for i, hook := range s.AfterSnapshot {
+		err = hook(info, dirPath)
+		if err != nil {
+			util.Warnf("Error while running hook %d after snapshot %s: %s", i, name, err)
+		}
+	}
+
+	if s.Keep <= 0 {
+		return nil
+	}
+	snapshots, err := c.ListSnapshots()
+	if err != nil {
+		return err
+	}
+	var scheduled []SnapshotInfo // oldest first, as listed
+	for _, snapshot := range snapshots {
+		if snapshot.CollectionName == info.CollectionName && strings.HasPrefix(snapshot.Name, prefix) {
+			scheduled = append(scheduled, snapshot)
+		}
+	}
+	for i := 0; i < len(scheduled)-s.Keep; i++ {
+		err = c.DeleteSnapshot(scheduled[i].Name)
+		if err != nil && err != ErrSnapshotIsNotExist {
+			return err
+		}
+	}
+	return nil
+}
+
+// getScheduledSnapshotPrefix returns what the names of the scheduled snapshots of the collection start with. The
+// characters of the collection name that snapshot names can't have are replaced with '_'.
+func getScheduledSnapshotPrefix(collectionName string) string {
+	return SCHEDULED_SNAPSHOT_PREFIX + regexp.MustCompile("[^a-zA-Z0-9_-]").ReplaceAllString(collectionName, "_") + "_"
+}
@@ -0,0 +1,554 @@
+package gofiledb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/key"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/********************************************************************************
+* S Q L  D R I V E R
+*********************************************************************************/
+
+// The gofiledb driver of database/sql lets reporting tools, and ORMs with raw SQL, read the collections of a warehouse as
+// tables. Its DSN is the document root of the warehouse, as given to Initialize, which it opens read-only, so that it can
+// share it with other read-only clients, but not with one that writes to it:
+//
+//	db, err := sql.Open(SQL_DRIVER_NAME, "/var/lib/myapp")
+//	rows, err := db.Query("SELECT Name, Employees FROM Orgs WHERE Employees >= ? AND Country = 'NZ' LIMIT 10", 100)
+//
+// OpenDB gives a *sql.DB over a client that is already open instead, e.g. the one the application writes with.
+//
+// Only SELECT ... FROM <collection> [WHERE ...] [LIMIT n] is supported, and is read-only. The WHERE clause is a list of
+// conditions joined with AND, each comparing a field (e.g. Address.City) to a value with =, <, <=, > or >=, and is run as a
+// Search, so every field in it must be indexed. Without a WHERE clause, every document of the collection is read. The
+// columns are the top level fields of the documents, sorted by name for SELECT *, and nested fields can be selected by
+// their field locator. Objects and arrays are returned as JSON. The rows come in no particular order.
+
+const SQL_DRIVER_NAME string = "gofiledb"
+
+var ErrSQLNotSupported = fmt.Errorf("The SQL statement is not supported, only SELECT ... FROM ... [WHERE ...] [LIMIT ...] is")
+
+// errSQLLimitReached stops reading the documents of a SELECT without a WHERE clause once it has enough of them
+var errSQLLimitReached = fmt.Errorf("the LIMIT of the SELECT has been reached")
+
+func init() {
+	sql.Register(SQL_DRIVER_NAME, sqlDriver{})
+}
+
+// OpenDB returns a *sql.DB that reads the collections of c (see SQL_DRIVER_NAME). Closing it leaves c open.
+func OpenDB(c *Client) *sql.DB {
+	return sql.OpenDB(&sqlConnector{client: c})
+}
+
+type sqlDriver struct{}
+
+func (d sqlDriver) Open(dsn string) (driver.Conn, error) {
+	connector, err := d.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlConn{client: connector.(*sqlConnector).client, closer: connector.(*sqlConnector)}, nil
+}
+
+// OpenConnector opens the warehouse at the document root dsn read-only, for all the connections of the *sql.DB
+func (d sqlDriver) OpenConnector(dsn string) (driver.Connector, error) {
+	client, err := openClient(ClientInitOptions{DocumentRoot: dsn, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	return &sqlConnector{client: client, isOwned: true}, nil
+}
+
+type sqlConnector struct {
+	client  *Client
+	isOwned bool // whether the client was opened by the driver, and is closed with the connector
+}
+
+func (s *sqlConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &sqlConn{client: s.client}, nil
+}
+
+func (s *sqlConnector) Driver() driver.Driver {
+	return sqlDriver{}
+}
+
+// Close closes the client if it was opened by the driver. *sql.DB calls it once it is closed.
+func (s *sqlConnector) Close() error {
+	if !s.isOwned {
+		return nil
+	}
+	return s.client.Close()
+}
+
+// sqlConn is a connection of the driver, which only reads through the client, so connections share everything
+type sqlConn struct {
+	client *Client
+	closer io.Closer // the connector of a connection opened with Open, which it owns
+}
+
+func (conn *sqlConn) Prepare(query string) (driver.Stmt, error) {
+	q, err := parseSQLSelect(query)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStmt{conn: conn, query: q}, nil
+}
+
+func (conn *sqlConn) Close() error {
+	if conn.closer != nil {
+		return conn.closer.Close()
+	}
+	return nil
+}
+
+func (conn *sqlConn) Begin() (driver.Tx, error) {
+	return nil, ErrSQLNotSupported
+}
+
+func (conn *sqlConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, err := parseSQLSelect(query)
+	if err != nil {
+		return nil, err
+	}
+	return conn.client.runSQLSelect(ctx, q, args)
+}
+
+type sqlStmt struct {
+	conn  *sqlConn
+	query sqlSelect
+}
+
+func (s *sqlStmt) Close() error {
+	return nil
+}
+
+func (s *sqlStmt) NumInput() int {
+	return s.query.numParams
+}
+
+func (s *sqlStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, ErrSQLNotSupported
+}
+
+func (s *sqlStmt) Query(args []driver.Value) (driver.Rows, error) {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return s.QueryContext(context.Background(), named)
+}
+
+func (s *sqlStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.conn.client.runSQLSelect(ctx, s.query, args)
+}
+
+/********************************************************************************
+* S Q L  Q U E R I E S
+*********************************************************************************/
+
+// sqlSelect is a parsed SELECT statement
+type sqlSelect struct {
+	columns    []string // nil for *
+	table      string
+	conditions []sqlCondition
+	limit      int // -1 if there is no LIMIT
+	numParams  int
+}
+
+// sqlCondition is a condition of the WHERE clause of a sqlSelect
+type sqlCondition struct {
+	field    string
+	operator string // one of the QUERY_OP_ constants
+	value    sqlValue
+}
+
+// sqlValue is a literal of a statement, or a parameter (a '?') if param > 0
+type sqlValue struct {
+	literal  string
+	isNumber bool
+	param    int // the ordinal of the parameter
+}
+
+// runSQLSelect runs q with args for its parameters
+func (c *Client) runSQLSelect(ctx context.Context, q sqlSelect, args []driver.NamedValue) (driver.Rows, error) {
+	if len(args) != q.numParams {
+		return nil, fmt.Errorf("the statement has %d parameters, but %d arguments were given", q.numParams, len(args))
+	}
+
+	var docs []map[string]interface{}
+	if len(q.conditions) > 0 {
+		query, err := getSQLSearchQuery(q.conditions, args)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.SearchCtx(ctx, q.table, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range resp.Result {
+			doc, _ := result.(map[string]interface{})
+			docs = append(docs, doc)
+		}
+	} else {
+		cl, err := c.getCollectionByName(q.table)
+		if err != nil {
+			return nil, err
+		}
+		err = cl.ForEachKey(func(k key.Key) error {
+			if q.limit >= 0 && len(docs) >= q.limit {
+				return errSQLLimitReached
+			}
+			var doc map[string]interface{}
+			err := c.GetStructCtx(ctx, q.table, Key(k), &doc)
+			if IsNotExist(err) { // deleted or expired since it was listed
+				return nil
+			}
+			docs = append(docs, doc)
+			return err
+		})
+		if err != nil && err != errSQLLimitReached {
+			return nil, err
+		}
+	}
+	if q.limit >= 0 && len(docs) > q.limit {
+		docs = docs[:q.limit]
+	}
+
+	columns := q.columns
+	if columns == nil {
+		fields := make(map[string]bool)
+		for _, doc := range docs {
+			for field := range doc {
+				fields[field] = true
+			}
+		}
+		for field := range fields {
+			columns = append(columns, field)
+		}
+		sort.Strings(columns)
+	}
+	return &sqlRows{columns: columns, docs: docs}, nil
+}
+
+// getSQLSearchQuery returns the Search query for conditions, with args for their parameters. Equality with a number is
+// run as a range of that single number, so that it matches the value whatever its type and format in the index.
+func getSQLSearchQuery(conditions []sqlCondition, args []driver.NamedValue) (string, error) {
+	var parts []string
+	for _, cond := range conditions {
+		value, isNumber := cond.value.literal, cond.value.isNumber
+		if cond.value.param > 0 {
+			arg := args[cond.value.param-1].Value
+			switch arg := arg.(type) {
+			case int64, float64:
+				value, isNumber = fmt.Sprintf("%v", arg), true
+			case string:
+				value = arg
+			case []byte:
+				value = string(arg)
+			case bool:
+				value = strconv.FormatBool(arg)
+			default:
+				return "", fmt.Errorf("the argument %v for %s is not supported", arg, cond.field)
+			}
+		}
+		value = collection.EscapeQueryValue(value)
+
+		if cond.operator == collection.QUERY_OP_EQUAL && isNumber {
+			parts = append(parts, cond.field+collection.QUERY_OP_GREATER_EQUAL+value, cond.field+collection.QUERY_OP_LESS_EQUAL+value)
+			continue
+		}
+		parts = append(parts, cond.field+cond.operator+value)
+	}
+	return strings.Join(parts, collection.QUERY_AND_SEPARATOR), nil
+}
+
+// sqlRows are the rows of a SELECT, one per document
+type sqlRows struct {
+	columns []string
+	docs    []map[string]interface{}
+}
+
+func (r *sqlRows) Columns() []string {
+	return r.columns
+}
+
+func (r *sqlRows) Close() error {
+	r.docs = nil
+	return nil
+}
+
+func (r *sqlRows) Next(dest []driver.Value) error {
+	if len(r.docs) == 0 {
+		return io.EOF
+	}
+	doc := r.docs[0]
+	r.docs = r.docs[1:]
+	for i, column := range r.columns {
+		v, err := getSQLColumnValue(doc, column)
+		if err != nil {
+			return fmt.Errorf("column %s: %w", column, err)
+		}
+		dest[i] = v
+	}
+	return nil
+}
+
+// getSQLColumnValue returns the value of the field at fieldLocator (e.g. Address.City) in doc, as a driver.Value
+func getSQLColumnValue(doc map[string]interface{}, fieldLocator string) (driver.Value, error) {
+	var v interface{} = doc
+	for _, name := range strings.Split(fieldLocator, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		v = m[name]
+	}
+	if v == nil {
+		return nil, nil
+	}
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(v)
+		return string(data), err
+	}
+	return driver.DefaultParameterConverter.ConvertValue(v)
+}
+
+/********************************************************************************
+* S Q L  P A R S E R
+*********************************************************************************/
+
+// parseSQLSelect parses a statement of the form SELECT <* | field, ...> FROM <collection> [WHERE <field> <op> <value>
+// [AND ...]] [LIMIT <n>]. Keywords are case insensitive, and names can be quoted with double quotes or backticks.
+func parseSQLSelect(query string) (sqlSelect, error) {
+	q := sqlSelect{limit: -1}
+	tokens, err := tokenizeSQL(query)
+	if err != nil {
+		return q, err
+	}
+	p := &sqlParser{tokens: tokens}
+
+	if !p.acceptKeyword("SELECT") {
+		return q, ErrSQLNotSupported
+	}
+	if !p.accept("*") {
+		for {
+			name, ok := p.name()
+			if !ok {
+				return q, p.errorf("expected a field")
+			}
+			q.columns = append(q.columns, name)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if !p.acceptKeyword("FROM") {
+		return q, p.errorf("expected FROM")
+	}
+	var ok bool
+	q.table, ok = p.name()
+	if !ok {
+		return q, p.errorf("expected a collection")
+	}
+
+	if p.acceptKeyword("WHERE") {
+		for {
+			var cond sqlCondition
+			cond.field, ok = p.name()
+			if !ok {
+				return q, p.errorf("expected a field")
+			}
+			operator := p.next()
+			switch operator {
+			case "=":
+				cond.operator = collection.QUERY_OP_EQUAL
+			case "<", "<=", ">", ">=":
+				cond.operator = operator
+			default:
+				return q, p.errorf("the operator %s is not supported", operator)
+			}
+			cond.value, ok = p.value(&q.numParams)
+			if !ok {
+				return q, p.errorf("expected a value")
+			}
+			q.conditions = append(q.conditions, cond)
+			if !p.acceptKeyword("AND") {
+				break
+			}
+		}
+	}
+
+	if p.acceptKeyword("LIMIT") {
+		q.limit, err = strconv.Atoi(p.next())
+		if err != nil || q.limit < 0 {
+			return q, p.errorf("expected a number of rows")
+		}
+	}
+	p.accept(";")
+	if p.pos < len(p.tokens) {
+		return q, p.errorf("unexpected %s", p.tokens[p.pos].text)
+	}
+	return q, nil
+}
+
+type sqlToken struct {
+	text     string
+	isQuoted bool // a quoted name
+	isString bool // a string literal, text being its value
+}
+
+type sqlParser struct {
+	tokens []sqlToken
+	pos    int
+}
+
+func (p *sqlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrSQLNotSupported, fmt.Sprintf(format, args...))
+}
+
+// next returns the text of the next token, and moves past it
+func (p *sqlParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	p.pos++
+	return p.tokens[p.pos-1].text
+}
+
+// accept moves past the next token if it is the symbol s
+func (p *sqlParser) accept(s string) bool {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].isString && !p.tokens[p.pos].isQuoted && p.tokens[p.pos].text == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// acceptKeyword moves past the next token if it is the keyword
+func (p *sqlParser) acceptKeyword(keyword string) bool {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].isString && !p.tokens[p.pos].isQuoted && strings.EqualFold(p.tokens[p.pos].text, keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// name returns the next token if it is a name, quoted or not
+func (p *sqlParser) name() (string, bool) {
+	if p.pos >= len(p.tokens) {
+		return "", false
+	}
+	t := p.tokens[p.pos]
+	if t.isString || !(t.isQuoted || isSQLNameStart(rune(t.text[0]))) {
+		return "", false
+	}
+	p.pos++
+	return t.text, true
+}
+
+// value returns the next token if it is a literal or a parameter, counting the parameters in numParams
+func (p *sqlParser) value(numParams *int) (sqlValue, bool) {
+	if p.pos >= len(p.tokens) {
+		return sqlValue{}, false
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	switch {
+	case t.isString:
+		return sqlValue{literal: t.text}, true
+	case t.isQuoted:
+		return sqlValue{}, false
+	case t.text == "?":
+		*numParams++
+		return sqlValue{param: *numParams}, true
+	case strings.EqualFold(t.text, "TRUE"), strings.EqualFold(t.text, "FALSE"):
+		return sqlValue{literal: strings.ToLower(t.text)}, true
+	}
+	_, err := strconv.ParseFloat(t.text, 64)
+	if err != nil {
+		return sqlValue{}, false
+	}
+	return sqlValue{literal: t.text, isNumber: true}, true
+}
+
+func isSQLNameStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isSQLNamePart(r rune) bool {
+	return r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// tokenizeSQL splits query into names, numbers, string literals and symbols
+func tokenizeSQL(query string) ([]sqlToken, error) {
+	var tokens []sqlToken
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '\'' || r == '"' || r == '`':
+			// '' in a string, "" in a name quoted with "", etc. is the quote itself
+			var text []rune
+			j := i + 1
+			for {
+				if j >= len(runes) {
+					return nil, fmt.Errorf("%w: unterminated %c", ErrSQLNotSupported, r)
+				}
+				if runes[j] == r {
+					if j+1 < len(runes) && runes[j+1] == r {
+						text = append(text, r)
+						j += 2
+						continue
+					}
+					break
+				}
+				text = append(text, runes[j])
+				j++
+			}
+			tokens = append(tokens, sqlToken{text: string(text), isString: r == '\'', isQuoted: r != '\''})
+			i = j + 1
+
+		case isSQLNameStart(r):
+			j := i
+			for j < len(runes) && isSQLNamePart(runes[j]) {
+				j++
+			}
+			tokens = append(tokens, sqlToken{text: string(runes[i:j])})
+			i = j
+
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			j := i + 1
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.' || runes[j] == 'e' || runes[j] == 'E') {
+				j++
+			}
+			tokens = append(tokens, sqlToken{text: string(runes[i:j])})
+			i = j
+
+		case (r == '<' || r == '>') && i+1 < len(runes) && runes[i+1] == '=':
+			tokens = append(tokens, sqlToken{text: string(runes[i : i+2])})
+			i += 2
+
+		case strings.ContainsRune("*,=<>?;", r):
+			tokens = append(tokens, sqlToken{text: string(r)})
+			i++
+
+		default:
+			return nil, fmt.Errorf("%w: unexpected %c", ErrSQLNotSupported, r)
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,176 @@
+package gofiledb
+
+import (
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/key"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/********************************************************************************
+* S U B S C R I P T I O N S
+*********************************************************************************/
+
+// Subscribe lets an application react to the changes to a collection, e.g. to update a cache, without polling the
+// document root. Every change made through the client (sets, deletes, reverts, quarantines, and writes queued with
+// WriteBehindQueueSize once they are applied) is delivered to every subscriber of the collection, in the order in which
+// the changes to each document were made. Changes made by other processes are only seen once they are picked up by
+// WatchExternalChanges or SyncExternalChanges.
+//
+// Events are queued for each subscriber, so a slow subscriber never holds up writes, but its queue grows until it
+// catches up.
+
+// ChangeEvent describes a change to a document
+type ChangeEvent struct {
+	Collection string // the name of the collection, which is in lower case like all collection names
+	Key        Key
+	Op         string // one of the AUDIT_OP_ constants
+	Time       time.Time
+}
+
+// numQueuedChangeEvents is the number of events queued for all the subscribers of all the clients, see GetExpvars
+var numQueuedChangeEvents int64
+
+type subscriptionStore struct {
+	subs map[string]map[*subscription]bool // lower case collection name -> its subscribers
+	sync.RWMutex
+}
+
+type subscription struct {
+	ch    chan ChangeEvent
+	queue []ChangeEvent // events waiting to be received from ch
+	wake  chan struct{} // signalled when an event is queued
+	stop  chan struct{} // closed when the subscription is cancelled
+	sync.Mutex
+}
+
+// Subscribe returns a channel that receives an event for every change to the collection from now on, and the func that
+// cancels the subscription, which closes the channel. The collection doesn't need to exist yet.
+func (c *Client) Subscribe(collectionName string) (<-chan ChangeEvent, func()) {
+	s := &subscription{
+		ch:   make(chan ChangeEvent),
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+	if c.subscriptions == nil {
+		close(s.ch)
+		return s.ch, func() {}
+	}
+
+	name := collection.NormalizeName(collectionName)
+	c.subscriptions.add(name, s)
+
+	go s.run()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			c.subscriptions.remove(name, s)
+			close(s.stop)
+			s.drain()
+		})
+	}
+	return s.ch, cancel
+}
+
+// add has s receive the changes to the collection name, which is in lower case
+func (store *subscriptionStore) add(name string, s *subscription) {
+	store.Lock()
+	defer store.Unlock()
+	if store.subs == nil {
+		store.subs = make(map[string]map[*subscription]bool)
+	}
+	if store.subs[name] == nil {
+		store.subs[name] = make(map[*subscription]bool)
+	}
+	store.subs[name][s] = true
+}
+
+// remove stops s from receiving the changes to the collection name
+func (store *subscriptionStore) remove(name string, s *subscription) {
+	store.Lock()
+	defer store.Unlock()
+	delete(store.subs[name], s)
+	if len(store.subs[name]) == 0 {
+		delete(store.subs, name)
+	}
+}
+
+// publish queues e for all the subscribers of its collection
+func (store *subscriptionStore) publish(e ChangeEvent) {
+	store.RLock()
+	defer store.RUnlock()
+	for s := range store.subs[collection.NormalizeName(e.Collection)] {
+		s.push(e)
+	}
+}
+
+// getChangeHandler returns the collection.ChangeHandler that publishes the changes to the collection collectionName
+func (store *subscriptionStore) getChangeHandler(collectionName string) collection.ChangeHandler {
+	return func(op string, k key.Key) {
+		store.publish(ChangeEvent{Collection: collectionName, Key: Key(k), Op: op, Time: time.Now()})
+	}
+}
+
+func (s *subscription) push(e ChangeEvent) {
+	s.Lock()
+	s.queue = append(s.queue, e)
+	s.Unlock()
+	atomic.AddInt64(&numQueuedChangeEvents, 1)
+
+	select {
+	case s.wake <- struct{}{}:
+	default: // already signalled
+	}
+}
+
+// run delivers the queued events to ch, until the subscription is cancelled
+func (s *subscription) run() {
+	defer close(s.ch)
+	for {
+		e, ok := s.next()
+		if !ok {
+			return
+		}
+
+		select {
+		case s.ch <- e:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// next removes the next event from the queue and returns it, waiting for one if there is none. It returns false once the
+// subscription is cancelled.
+func (s *subscription) next() (ChangeEvent, bool) {
+	for {
+		s.Lock()
+		if len(s.queue) == 0 {
+			s.queue = nil // rather than keep the backing array of everything delivered so far
+			s.Unlock()
+			select {
+			case <-s.wake:
+				continue
+			case <-s.stop:
+				return ChangeEvent{}, false
+			}
+		}
+		e := s.queue[0]
+		s.queue = s.queue[1:]
+		s.Unlock()
+		atomic.AddInt64(&numQueuedChangeEvents, -1)
+		return e, true
+	}
+}
+
+// drain removes all the events from the queue and returns them
+func (s *subscription) drain() []ChangeEvent {
+	s.Lock()
+	defer s.Unlock()
+	queue := s.queue
+	s.queue = nil
+	atomic.AddInt64(&numQueuedChangeEvents, -int64(len(queue)))
+	return queue
+}
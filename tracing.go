@@ -0,0 +1,99 @@
+package gofiledb
+
+import (
+	"context"
+	"github.com/teejays/gofiledb/collection"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/********************************************************************************
+* T R A C I N G
+*********************************************************************************/
+
+// With ClientInitOptions.TracerProvider set, the client starts an OpenTelemetry span for every Set, Get, Delete and
+// Search (including their Struct and Ctx variants) and AddIndex, as a child of the span in the ctx of the call, if there
+// is one. The span covers the Middleware of the client, and the ctx given to them (and to everything the operation
+// calls) has the span in it. Spans are named after the operation, e.g. "gofiledb.set", and carry the collection, the
+// key, the number of bytes read or written, and for searches the query, a summary of its plan (see
+// collection.QueryPlan.Summary) and the number of documents found. A failed operation has its error recorded on the
+// span, and the status of the span set to Error.
+
+// TRACER_NAME is the name of the tracer that the client gets from its TracerProvider
+const TRACER_NAME string = "github.com/teejays/gofiledb"
+
+const (
+	TRACE_SPAN_PREFIX    string = "gofiledb."
+	TRACE_SPAN_ADD_INDEX string = TRACE_SPAN_PREFIX + "add_index"
+)
+
+// The attributes of the spans
+const (
+	TRACE_ATTR_SYSTEM      attribute.Key = "db.system" // always "gofiledb"
+	TRACE_ATTR_OPERATION   attribute.Key = "db.operation.name"
+	TRACE_ATTR_COLLECTION  attribute.Key = "db.collection.name"
+	TRACE_ATTR_QUERY       attribute.Key = "db.query.text"
+	TRACE_ATTR_KEY         attribute.Key = "gofiledb.key"
+	TRACE_ATTR_BYTES       attribute.Key = "gofiledb.bytes" // not set for the Struct variants, which don't see the data
+	TRACE_ATTR_PLAN        attribute.Key = "gofiledb.plan"
+	TRACE_ATTR_NUM_RESULTS attribute.Key = "gofiledb.num_results"
+	TRACE_ATTR_FIELD       attribute.Key = "gofiledb.field"
+)
+
+// startSpan starts a span named spanName for an operation on the collection collectionName, if the client has a
+// TracerProvider. The span is nil otherwise.
+func (c *Client) startSpan(ctx context.Context, spanName string, collectionName string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if c.tracer == nil {
+		return ctx, nil
+	}
+	attrs = append([]attribute.KeyValue{
+		TRACE_ATTR_SYSTEM.String("gofiledb"),
+		TRACE_ATTR_COLLECTION.String(collection.NormalizeName(collectionName)),
+	}, attrs...)
+	return c.tracer.Start(ctx, spanName, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, with err recorded on it if it isn't nil. A nil span is ignored.
+func endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startOpSpan starts the span of op, see runOp. For a search, ctx has the plan of the query added to the span once it
+// has been planned.
+func (c *Client) startOpSpan(ctx context.Context, op *Op) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{TRACE_ATTR_OPERATION.String(op.Type)}
+	if op.Type == OP_SEARCH {
+		attrs = append(attrs, TRACE_ATTR_QUERY.String(op.Query))
+	} else {
+		attrs = append(attrs, TRACE_ATTR_KEY.Int64(int64(op.Key)))
+	}
+	ctx, span := c.startSpan(ctx, TRACE_SPAN_PREFIX+op.Type, op.Collection, attrs...)
+	if span != nil && op.Type == OP_SEARCH {
+		ctx = collection.WithQueryPlanHandler(ctx, func(plan collection.QueryPlan) {
+			span.SetAttributes(TRACE_ATTR_PLAN.String(plan.Summary()))
+		})
+	}
+	return ctx, span
+}
+
+// endOpSpan adds what op has read or written to span, and ends it
+func endOpSpan(span trace.Span, op *Op, err error) {
+	if span == nil {
+		return
+	}
+	switch {
+	case op.Type == OP_SEARCH:
+		span.SetAttributes(TRACE_ATTR_NUM_RESULTS.Int(len(op.Result)))
+	case op.Data != nil:
+		span.SetAttributes(TRACE_ATTR_BYTES.Int(len(op.Data)))
+	}
+	endSpan(span, err)
+}
@@ -0,0 +1,105 @@
+package util
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/********************************************************************************
+* A R C H I V E S
+*********************************************************************************/
+
+// TarFile is a regular file written to an archive by WriteTarDir
+type TarFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"` // hex encoded
+}
+
+// WriteTarDir adds the dirs and regular files under dirPath in fsys to tw, named namePrefix followed by their path
+// relative to dirPath, and returns the regular files it added. If skip is not nil, the ones that it returns true for are
+// left out, with everything in them for dirs. Each file is written as it is when it is opened, so files that are replaced
+// while it runs (see writeFile in the collection package) are never torn, but files that are written in place should not
+// change until it returns.
+func WriteTarDir(fsys FS, tw *tar.Writer, dirPath string, namePrefix string, skip func(relPath string, info os.FileInfo) bool) ([]TarFile, error) {
+	var files []TarFile
+	err := Walk(fsys, dirPath, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path != dirPath { // removed while walking
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dirPath, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		if skip != nil && skip(relPath, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := namePrefix + filepath.ToSlash(relPath)
+
+		if info.IsDir() {
+			return tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     name + "/",
+				Mode:     DIR_PERM,
+				ModTime:  info.ModTime(),
+			})
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := writeTarFile(fsys, tw, path, name)
+		if err != nil || f == nil {
+			return err
+		}
+		files = append(files, *f)
+		return nil
+	})
+	return files, err
+}
+
+// writeTarFile adds the file at path in fsys to tw as name, and returns it, or nil if it has been removed
+func writeTarFile(fsys FS, tw *tar.Writer, path string, name string) (*TarFile, error) {
+	file, err := fsys.Open(path)
+	if os.IsNotExist(err) { // removed since it was listed
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// The size is taken from the open file, since the file at path may have been replaced since it was listed
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     FILE_PERM,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	_, err = io.CopyN(io.MultiWriter(tw, h), file, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	return &TarFile{Name: name, Size: info.Size(), SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
@@ -0,0 +1,186 @@
+package util
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/********************************************************************************
+* F I L E  S Y S T E M
+*********************************************************************************/
+
+// All the file operations of gofiledb go through an FS, so that the data can be kept somewhere other than the local
+// file system (e.g. in memory, in a chroot, or behind a network file system shim), and so that the handling of IO
+// errors can be tested by injecting them. OSFS, which is the default, is the local file system.
+//
+// Paths are always built with JoinPath, and are given to the FS as they are.
+
+// File is an open file of an FS. *os.File is a File.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+	Readdir(n int) ([]os.FileInfo, error)
+	Readdirnames(n int) ([]string, error)
+}
+
+// FS is a file system. Its methods behave like the os functions of the same name, and should return errors for which
+// os.IsNotExist and os.IsExist work.
+type FS interface {
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	RemoveAll(path string) error
+	Rename(oldpath, newpath string) error
+	Link(oldname, newname string) error
+	Truncate(name string, size int64) error
+	MkdirAll(path string, perm os.FileMode) error
+}
+
+// OSFS is the local file system
+type OSFS struct{}
+
+// numOpenFiles is the number of files opened through OSFS that haven't been closed yet, see NumOpenFiles
+var numOpenFiles int64
+
+func (OSFS) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return newOSFile(f), nil
+}
+
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return newOSFile(f), nil
+}
+
+// NumOpenFiles returns the number of files of the process that have been opened through OSFS, and not closed yet.
+// Files opened through other FS implementations are not counted.
+func NumOpenFiles() int64 {
+	return atomic.LoadInt64(&numOpenFiles)
+}
+
+// osFile is an *os.File that is counted in numOpenFiles until it is closed
+type osFile struct {
+	*os.File
+	isClosed int32
+}
+
+func newOSFile(f *os.File) *osFile {
+	atomic.AddInt64(&numOpenFiles, 1)
+	return &osFile{File: f}
+}
+
+func (f *osFile) Close() error {
+	if atomic.CompareAndSwapInt32(&f.isClosed, 0, 1) {
+		atomic.AddInt64(&numOpenFiles, -1)
+	}
+	return f.File.Close()
+}
+
+func (OSFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (OSFS) Remove(name string) error                     { return os.Remove(name) }
+func (OSFS) RemoveAll(path string) error                  { return os.RemoveAll(path) }
+func (OSFS) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+func (OSFS) Link(oldname, newname string) error           { return os.Link(oldname, newname) }
+func (OSFS) Truncate(name string, size int64) error       { return os.Truncate(name, size) }
+func (OSFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+
+// Create creates or truncates the file name in fsys, like os.Create
+func Create(fsys FS, name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, FILE_PERM)
+}
+
+// ReadFile returns the content of the file name in fsys, like ioutil.ReadFile
+func ReadFile(fsys FS, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// ReadDir returns the entries of the dir name in fsys, sorted by name, like ioutil.ReadDir
+func ReadDir(fsys FS, name string) ([]os.FileInfo, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+var tempFileSeq uint32
+
+// TempFile creates a new file in the dir in fsys, whose name starts with prefix, and opens it for reading and writing,
+// like ioutil.TempFile. Unlike ioutil.TempFile, the file is created with FILE_PERM.
+func TempFile(fsys FS, dir, prefix string) (File, error) {
+	seed := uint32(time.Now().UnixNano())
+	for i := 0; i < 10000; i++ {
+		name := JoinPath(dir, prefix+strconv.FormatUint(uint64(seed+atomic.AddUint32(&tempFileSeq, 1)), 10))
+		f, err := fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, FILE_PERM)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+	return nil, &os.PathError{Op: "createtemp", Path: JoinPath(dir, prefix+"*"), Err: os.ErrExist}
+}
+
+// Walk calls fn for root and everything under it in fsys, like filepath.Walk
+func Walk(fsys FS, root string, fn filepath.WalkFunc) error {
+	info, err := fsys.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walk(fsys, root, info, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walk(fsys FS, path string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+
+	infos, err := ReadDir(fsys, path)
+	err1 := fn(path, info, err)
+	if err != nil || err1 != nil {
+		// like filepath.Walk, fn is told about the error reading the dir, and decides whether to go on
+		return err1
+	}
+
+	for _, childInfo := range infos {
+		err = walk(fsys, filepath.Join(path, childInfo.Name()), childInfo, fn)
+		if err != nil && !(childInfo.IsDir() && err == filepath.SkipDir) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package util
+
+import (
+	"github.com/teejays/clog"
+	"sync/atomic"
+)
+
+/********************************************************************************
+* L O G G I N G
+*********************************************************************************/
+
+// All the logging of gofiledb goes through Debugf, Infof, Warnf and Errorf, which hand the messages to the Logger set
+// by SetLogger. By default, that is the clog package, whose LogLevel decides which messages are dropped. Like the
+// LogLevel, the Logger is global to the process.
+
+// Logger is what the log messages are written to, see SetLogger
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type clogLogger struct{}
+
+func (clogLogger) Debugf(format string, args ...interface{}) { clog.Debugf(format, args...) }
+func (clogLogger) Infof(format string, args ...interface{})  { clog.Infof(format, args...) }
+func (clogLogger) Warnf(format string, args ...interface{})  { clog.Warnf(format, args...) }
+func (clogLogger) Errorf(format string, args ...interface{}) { clog.Errorf(format, args...) }
+
+// loggerBox lets loggers of different types be kept in the same atomic.Value
+type loggerBox struct {
+	logger Logger
+}
+
+var logger atomic.Value
+
+// SetLogger makes l the Logger that all the log messages are written to. If l is nil, they go to clog again.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = clogLogger{}
+	}
+	logger.Store(loggerBox{l})
+}
+
+func getLogger() Logger {
+	box, ok := logger.Load().(loggerBox)
+	if !ok {
+		return clogLogger{}
+	}
+	return box.logger
+}
+
+func Debugf(format string, args ...interface{}) { getLogger().Debugf(format, args...) }
+func Infof(format string, args ...interface{})  { getLogger().Infof(format, args...) }
+func Warnf(format string, args ...interface{})  { getLogger().Warnf(format, args...) }
+func Errorf(format string, args ...interface{}) { getLogger().Errorf(format, args...) }
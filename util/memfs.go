@@ -0,0 +1,508 @@
+package util
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/********************************************************************************
+* M E M O R Y  F I L E  S Y S T E M
+*********************************************************************************/
+
+// MemFS is an FS that keeps all its files in memory, in a tree of maps, and loses them once it is no longer referenced.
+// Nothing is ever created on the local file system. Relative and absolute paths are the same to a MemFS, and the root
+// dir always exists. Hard links (Link) share the data of the file, like on a local file system.
+//
+// A MemFS is safe for concurrent use. All its files share one lock, so it is meant for tests and small data sets
+// rather than for throughput.
+type MemFS struct {
+	lock sync.RWMutex
+	root *memNode
+}
+
+// memNode is a file or a dir of a MemFS. A dir has children, a file has data.
+type memNode struct {
+	mode     os.FileMode
+	modTime  time.Time
+	data     []byte
+	children map[string]*memNode
+}
+
+func (n *memNode) isDir() bool {
+	return n.mode.IsDir()
+}
+
+// NewMemFS returns an empty MemFS
+func NewMemFS() *MemFS {
+	return &MemFS{root: &memNode{mode: os.ModeDir | DIR_PERM, modTime: time.Now(), children: map[string]*memNode{}}}
+}
+
+// splitMemPath returns the names of the dirs and file that make up path, from the root
+func splitMemPath(path string) []string {
+	path = filepath.ToSlash(filepath.Clean(path))
+	var parts []string
+	for _, part := range strings.Split(path, "/") {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// lookup returns the node at path, or an os.ErrNotExist error. The lock of the MemFS should be held.
+func (fsys *MemFS) lookup(op, path string) (*memNode, error) {
+	node := fsys.root
+	for _, part := range splitMemPath(path) {
+		if !node.isDir() {
+			return nil, &os.PathError{Op: op, Path: path, Err: syscall.ENOTDIR}
+		}
+		child, ok := node.children[part]
+		if !ok {
+			return nil, &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// lookupParent returns the dir that path is in, and the name of path in it. The lock of the MemFS should be held.
+func (fsys *MemFS) lookupParent(op, path string) (*memNode, string, error) {
+	parts := splitMemPath(path)
+	if len(parts) == 0 {
+		return nil, "", &os.PathError{Op: op, Path: path, Err: os.ErrInvalid}
+	}
+	parent, err := fsys.lookup(op, strings.Join(parts[:len(parts)-1], "/"))
+	if err != nil {
+		return nil, "", err
+	}
+	if !parent.isDir() {
+		return nil, "", &os.PathError{Op: op, Path: path, Err: syscall.ENOTDIR}
+	}
+	return parent, parts[len(parts)-1], nil
+}
+
+func (fsys *MemFS) Open(name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fsys *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fsys.lock.Lock()
+	defer fsys.lock.Unlock()
+
+	isWrite := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	node, err := fsys.lookup("open", name)
+	if os.IsNotExist(err) && flag&os.O_CREATE != 0 {
+		parent, base, err := fsys.lookupParent("open", name)
+		if err != nil {
+			return nil, err
+		}
+		node = &memNode{mode: perm.Perm(), modTime: time.Now()}
+		parent.children[base] = node
+		parent.modTime = node.modTime
+	} else if err != nil {
+		return nil, err
+	} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	} else if node.isDir() && isWrite {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	} else if flag&os.O_TRUNC != 0 && isWrite {
+		node.data = nil
+		node.modTime = time.Now()
+	}
+
+	return &memFile{fsys: fsys, node: node, name: name, flag: flag}, nil
+}
+
+func (fsys *MemFS) Stat(name string) (os.FileInfo, error) {
+	fsys.lock.RLock()
+	defer fsys.lock.RUnlock()
+	node, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return newMemFileInfo(name, node), nil
+}
+
+func (fsys *MemFS) Remove(name string) error {
+	fsys.lock.Lock()
+	defer fsys.lock.Unlock()
+	parent, base, err := fsys.lookupParent("remove", name)
+	if err != nil {
+		return err
+	}
+	node, ok := parent.children[base]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if node.isDir() && len(node.children) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(parent.children, base)
+	parent.modTime = time.Now()
+	return nil
+}
+
+func (fsys *MemFS) RemoveAll(path string) error {
+	fsys.lock.Lock()
+	defer fsys.lock.Unlock()
+	parent, base, err := fsys.lookupParent("removeall", path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	delete(parent.children, base)
+	parent.modTime = time.Now()
+	return nil
+}
+
+func (fsys *MemFS) Rename(oldpath, newpath string) error {
+	fsys.lock.Lock()
+	defer fsys.lock.Unlock()
+	oldParent, oldBase, err := fsys.lookupParent("rename", oldpath)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: underlyingMemError(err)}
+	}
+	node, ok := oldParent.children[oldBase]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	newParent, newBase, err := fsys.lookupParent("rename", newpath)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: underlyingMemError(err)}
+	}
+	if existing, ok := newParent.children[newBase]; ok && existing != node {
+		switch {
+		case existing.isDir() && !node.isDir():
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EISDIR}
+		case !existing.isDir() && node.isDir():
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.ENOTDIR}
+		case existing.isDir() && len(existing.children) > 0:
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.ENOTEMPTY}
+		}
+	}
+	if node.isDir() && isMemPathWithin(newpath, oldpath) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrInvalid}
+	}
+
+	delete(oldParent.children, oldBase)
+	newParent.children[newBase] = node
+	now := time.Now()
+	oldParent.modTime, newParent.modTime = now, now
+	return nil
+}
+
+func (fsys *MemFS) Link(oldname, newname string) error {
+	fsys.lock.Lock()
+	defer fsys.lock.Unlock()
+	node, err := fsys.lookup("link", oldname)
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: underlyingMemError(err)}
+	}
+	if node.isDir() {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+	parent, base, err := fsys.lookupParent("link", newname)
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: underlyingMemError(err)}
+	}
+	if _, ok := parent.children[base]; ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	parent.children[base] = node
+	parent.modTime = time.Now()
+	return nil
+}
+
+func (fsys *MemFS) Truncate(name string, size int64) error {
+	fsys.lock.Lock()
+	defer fsys.lock.Unlock()
+	node, err := fsys.lookup("truncate", name)
+	if err != nil {
+		return err
+	}
+	if node.isDir() {
+		return &os.PathError{Op: "truncate", Path: name, Err: syscall.EISDIR}
+	}
+	return node.truncate("truncate", name, size)
+}
+
+func (fsys *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	fsys.lock.Lock()
+	defer fsys.lock.Unlock()
+	node := fsys.root
+	for _, part := range splitMemPath(path) {
+		child, ok := node.children[part]
+		if !ok {
+			child = &memNode{mode: os.ModeDir | perm.Perm(), modTime: time.Now(), children: map[string]*memNode{}}
+			node.children[part] = child
+			node.modTime = child.modTime
+		} else if !child.isDir() {
+			return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+		}
+		node = child
+	}
+	return nil
+}
+
+// truncate changes the size of the file n to size, padding it with zeros if it grows. The lock of the MemFS should be
+// held.
+func (n *memNode) truncate(op, name string, size int64) error {
+	if size < 0 {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrInvalid}
+	}
+	if size <= int64(len(n.data)) {
+		n.data = n.data[:size]
+	} else {
+		n.data = append(n.data, make([]byte, size-int64(len(n.data)))...)
+	}
+	n.modTime = time.Now()
+	return nil
+}
+
+// isMemPathWithin tells whether path is dir, or is under it
+func isMemPathWithin(path, dir string) bool {
+	pathParts, dirParts := splitMemPath(path), splitMemPath(dir)
+	if len(pathParts) < len(dirParts) {
+		return false
+	}
+	for i := range dirParts {
+		if pathParts[i] != dirParts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// underlyingMemError returns the error that a *os.PathError wraps, so that it can be wrapped in an *os.LinkError instead
+func underlyingMemError(err error) error {
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err
+	}
+	return err
+}
+
+// memFile is an open file of a MemFS
+type memFile struct {
+	fsys     *MemFS
+	node     *memNode
+	name     string
+	flag     int
+	offset   int64
+	dirNames []string // the entries of a dir that haven't been returned by Readdir yet, once it has been called
+	isClosed bool
+}
+
+func (f *memFile) checkOpen(op string) error {
+	if f.isClosed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fsys.lock.Lock()
+	defer f.fsys.lock.Unlock()
+	n, err := f.readAt("read", p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fsys.lock.RLock()
+	defer f.fsys.lock.RUnlock()
+	n, err := f.readAt("read", p, off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// readAt reads from the file at off, without returning io.EOF for short reads. The lock of the MemFS should be held.
+func (f *memFile) readAt(op string, p []byte, off int64) (int, error) {
+	if err := f.checkOpen(op); err != nil {
+		return 0, err
+	}
+	if f.node.isDir() {
+		return 0, &os.PathError{Op: op, Path: f.name, Err: syscall.EISDIR}
+	}
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: op, Path: f.name, Err: os.ErrInvalid}
+	}
+	if off >= int64(len(f.node.data)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	return copy(p, f.node.data[off:]), nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fsys.lock.Lock()
+	defer f.fsys.lock.Unlock()
+	if err := f.checkOpen("write"); err != nil {
+		return 0, err
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.node.data))
+	}
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		f.node.truncate("write", f.name, end)
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset = end
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fsys.lock.Lock()
+	defer f.fsys.lock.Unlock()
+	if err := f.checkOpen("seek"); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.fsys.lock.Lock()
+	defer f.fsys.lock.Unlock()
+	if err := f.checkOpen("close"); err != nil {
+		return err
+	}
+	f.isClosed = true
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fsys.lock.RLock()
+	defer f.fsys.lock.RUnlock()
+	if err := f.checkOpen("stat"); err != nil {
+		return nil, err
+	}
+	return newMemFileInfo(f.name, f.node), nil
+}
+
+// Sync does nothing, since there is nothing to write the file to
+func (f *memFile) Sync() error {
+	f.fsys.lock.RLock()
+	defer f.fsys.lock.RUnlock()
+	return f.checkOpen("sync")
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fsys.lock.Lock()
+	defer f.fsys.lock.Unlock()
+	if err := f.checkOpen("truncate"); err != nil {
+		return err
+	}
+	if f.node.isDir() || f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+	return f.node.truncate("truncate", f.name, size)
+}
+
+func (f *memFile) Readdir(n int) ([]os.FileInfo, error) {
+	f.fsys.lock.Lock()
+	defer f.fsys.lock.Unlock()
+	names, err := f.readdirnames(n)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		child, ok := f.node.children[name]
+		if !ok {
+			continue // removed since the dir was opened
+		}
+		infos = append(infos, newMemFileInfo(name, child))
+	}
+	return infos, nil
+}
+
+func (f *memFile) Readdirnames(n int) ([]string, error) {
+	f.fsys.lock.Lock()
+	defer f.fsys.lock.Unlock()
+	return f.readdirnames(n)
+}
+
+// readdirnames returns the next n names of the dir, or all the remaining ones if n <= 0, like os.File.Readdirnames.
+// The lock of the MemFS should be held.
+func (f *memFile) readdirnames(n int) ([]string, error) {
+	if err := f.checkOpen("readdirent"); err != nil {
+		return nil, err
+	}
+	if !f.node.isDir() {
+		return nil, &os.PathError{Op: "readdirent", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	if f.dirNames == nil {
+		f.dirNames = make([]string, 0, len(f.node.children))
+		for name := range f.node.children {
+			f.dirNames = append(f.dirNames, name)
+		}
+		sort.Strings(f.dirNames)
+	}
+
+	if n <= 0 {
+		names := f.dirNames
+		f.dirNames = f.dirNames[len(f.dirNames):]
+		return names, nil
+	}
+	if len(f.dirNames) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.dirNames) {
+		n = len(f.dirNames)
+	}
+	names := f.dirNames[:n]
+	f.dirNames = f.dirNames[n:]
+	return names, nil
+}
+
+// memFileInfo is the os.FileInfo of a file or dir of a MemFS, as it was when it was stat'ed
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func newMemFileInfo(name string, n *memNode) memFileInfo {
+	return memFileInfo{name: filepath.Base(name), size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi memFileInfo) Sys() interface{}   { return nil }
@@ -1,7 +1,6 @@
 package util
 
 import (
-	"github.com/teejays/clog"
 	"os"
 	"strings"
 )
@@ -22,13 +21,27 @@ func JoinPath(dirs ...string) string {
 	return strings.Join(dirs, string(os.PathSeparator))
 }
 
-func CreateDirIfNotExist(path string) error {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		clog.Debugf("[GoFileDB] Creating dir at: %s", path)
-		err := os.MkdirAll(path, DIR_PERM)
+func CreateDirIfNotExist(fsys FS, path string) error {
+	if _, err := fsys.Stat(path); os.IsNotExist(err) {
+		Debugf("[GoFileDB] Creating dir at: %s", path)
+		err := fsys.MkdirAll(path, DIR_PERM)
 		if err != nil {
 			return nil
 		}
 	}
 	return nil
 }
+
+// SyncFile fsyncs the file or directory at path in fsys
+func SyncFile(fsys FS, path string) error {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
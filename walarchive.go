@@ -0,0 +1,55 @@
+package gofiledb
+
+import (
+	"github.com/teejays/gofiledb/collection"
+	"github.com/teejays/gofiledb/util"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/********************************************************************************
+* W A L  A R C H I V I N G
+*********************************************************************************/
+
+// With ClientInitOptions.WALArchiver, every segment of the WAL of the collections with EnableWAL is copied off before the
+// WAL is recycled, see collection.WALArchiver. NewWALArchiveDir returns a WALArchiver that keeps the segments in a dir,
+// e.g. one that is shipped to another machine, as <dir>/<collection name>/<segment name>.
+
+// WALArchiver is given the segments of the WAL of a collection before they are recycled
+type WALArchiver func(collectionName string, segmentName string, r io.Reader) error
+
+// NewWALArchiveDir returns a WALArchiver that copies the segments into dirPath, on the local file system. A segment only
+// shows up in the dir once it has been copied in full, and synced to disk.
+func NewWALArchiveDir(dirPath string) WALArchiver {
+	return func(collectionName string, segmentName string, r io.Reader) error {
+		fsys := util.OSFS{}
+		path := util.JoinPath(dirPath, collectionName, segmentName)
+		err := util.CreateDirIfNotExist(fsys, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+
+		tmpPath := util.JoinPath(filepath.Dir(path), collection.TEMP_FILE_PREFIX+segmentName)
+		file, err := fsys.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, util.FILE_PERM)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, r)
+		if err == nil {
+			err = file.Sync()
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			fsys.Remove(tmpPath)
+			return err
+		}
+		err = fsys.Rename(tmpPath, path)
+		if err != nil {
+			return err
+		}
+		return util.SyncFile(fsys, filepath.Dir(path))
+	}
+}
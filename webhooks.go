@@ -0,0 +1,423 @@
+package gofiledb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/teejays/gofiledb/util"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/********************************************************************************
+* W E B H O O K S
+*********************************************************************************/
+
+// AddWebhook has the client POST a WebhookPayload, as JSON, to a URL for every change to a collection made through it
+// (the same changes that Subscribe delivers), e.g. to let a downstream system know about them:
+//
+//	id, err := client.AddWebhook(Webhook{
+//		CollectionName: "orders",
+//		URL:            "https://example.com/hooks/orders",
+//		Ops:            []string{AUDIT_OP_SET, AUDIT_OP_DELETE},
+//		Secret:         secret,
+//	})
+//
+// With a Secret, the payload is signed with HMAC-SHA256, in the WEBHOOK_SIGNATURE_HEADER header, which receivers check
+// with VerifyWebhookSignature. The payloads of a webhook are sent one at a time, in the order of the changes. A payload
+// that isn't acknowledged with a 2xx status is sent again after RetryDelay, which doubles after every attempt up to
+// MaxRetryDelay, with the same ID, so that receivers can leave out the ones they already have. Once MaxAttempts have
+// failed, the payload is appended to the dead-letter log of the client (see GetWebhookDeadLetters), and the next one is
+// sent. The payloads that are still pending when the webhook is removed, or the client closed, go to the dead-letter
+// log as well.
+//
+// Webhooks are not saved with the client, so they need to be added again every time it is initialized. The document of
+// a set is read when its payload is first sent, so it may be newer than the change.
+
+const WEBHOOK_SIGNATURE_HEADER string = "X-Gofiledb-Signature" // "sha256=" followed by the hex encoded HMAC of the body
+const WEBHOOK_DELIVERY_HEADER string = "X-Gofiledb-Delivery"   // the ID of the payload
+const WEBHOOK_DEAD_LETTER_FILE_NAME string = "webhooks_dead_letter.log"
+
+const WEBHOOK_DEFAULT_MAX_ATTEMPTS int = 5
+const WEBHOOK_DEFAULT_RETRY_DELAY time.Duration = time.Second
+const WEBHOOK_DEFAULT_MAX_RETRY_DELAY time.Duration = time.Minute
+const WEBHOOK_DEFAULT_TIMEOUT time.Duration = 10 * time.Second
+
+var ErrWebhookIsNotExist = fmt.Errorf("Webhook not found")
+var ErrInvalidWebhook = fmt.Errorf("The webhook is not valid")
+
+type Webhook struct {
+	CollectionName string
+	URL            string
+	Ops            []string      // the AUDIT_OP_ constants of the changes that are sent, all of them if empty
+	Secret         []byte        // if set, the payloads are signed with it, see VerifyWebhookSignature
+	IncludeData    bool          // if true, the payloads of the sets have the document, as JSON
+	MaxAttempts    int           // defaults to WEBHOOK_DEFAULT_MAX_ATTEMPTS
+	RetryDelay     time.Duration // defaults to WEBHOOK_DEFAULT_RETRY_DELAY
+	MaxRetryDelay  time.Duration // defaults to WEBHOOK_DEFAULT_MAX_RETRY_DELAY
+	Timeout        time.Duration // of every attempt, defaults to WEBHOOK_DEFAULT_TIMEOUT
+	HTTPClient     *http.Client  // defaults to http.DefaultClient
+}
+
+// WebhookPayload is the body of the requests sent to webhooks
+type WebhookPayload struct {
+	ID         string          `json:"id"` // unique to every change, and kept by the retries
+	Collection string          `json:"collection"`
+	Key        Key             `json:"key"`
+	Op         string          `json:"op"` // one of the AUDIT_OP_ constants
+	Time       time.Time       `json:"time"`
+	Data       json.RawMessage `json:"data,omitempty"` // the document, if IncludeData and it still exists
+}
+
+// WebhookDeadLetter is a payload that could not be sent to a webhook
+type WebhookDeadLetter struct {
+	WebhookID string
+	URL       string
+	Payload   WebhookPayload
+	Attempts  int
+	Error     string // of the last attempt
+	Time      time.Time
+}
+
+type webhookStore struct {
+	Store          map[string]*webhookRunner // webhook ID -> its runner
+	deadLetterLock sync.Mutex                // held while the dead-letter log is appended to
+	sync.Mutex
+}
+
+type webhookRunner struct {
+	id             string
+	hook           Webhook
+	sub            *subscription
+	cancel         func() // stops sub from receiving the changes
+	done           chan struct{}
+	numSent        int64 // payloads acknowledged by the webhook, accessed atomically
+	numDeadLetters int64 // payloads added to the dead-letter log, accessed atomically
+}
+
+// AddWebhook starts sending the changes to w.CollectionName to w.URL, and returns the ID of the webhook, see
+// RemoveWebhook
+func (c *Client) AddWebhook(w Webhook) (string, error) {
+	if c.isReadOnly() {
+		return "", ErrClientIsReadOnly
+	}
+	if !strings.HasPrefix(w.URL, "http://") && !strings.HasPrefix(w.URL, "https://") {
+		return "", fmt.Errorf("%w: the URL must be http or https: %s", ErrInvalidWebhook, w.URL)
+	}
+	for _, op := range w.Ops {
+		switch op {
+		case AUDIT_OP_SET, AUDIT_OP_DELETE, AUDIT_OP_REVERT, AUDIT_OP_QUARANTINE:
+		default:
+			return "", fmt.Errorf("%w: unknown op %s", ErrInvalidWebhook, op)
+		}
+	}
+	cl, err := c.getCollectionByName(w.CollectionName)
+	if err != nil {
+		return "", err
+	}
+	w.CollectionName = cl.Name
+	if w.MaxAttempts <= 0 {
+		w.MaxAttempts = WEBHOOK_DEFAULT_MAX_ATTEMPTS
+	}
+	if w.RetryDelay <= 0 {
+		w.RetryDelay = WEBHOOK_DEFAULT_RETRY_DELAY
+	}
+	if w.MaxRetryDelay <= 0 {
+		w.MaxRetryDelay = WEBHOOK_DEFAULT_MAX_RETRY_DELAY
+	}
+	if w.Timeout <= 0 {
+		w.Timeout = WEBHOOK_DEFAULT_TIMEOUT
+	}
+	if w.HTTPClient == nil {
+		w.HTTPClient = http.DefaultClient
+	}
+
+	id, err := newWebhookID()
+	if err != nil {
+		return "", err
+	}
+	r := &webhookRunner{
+		id:   id,
+		hook: w,
+		sub:  &subscription{wake: make(chan struct{}, 1), stop: make(chan struct{})},
+		done: make(chan struct{}),
+	}
+	name := cl.Name // already normalized
+	c.subscriptions.add(name, r.sub)
+	r.cancel = func() { c.subscriptions.remove(name, r.sub) }
+
+	c.webhooks.Lock()
+	if c.webhooks.Store == nil {
+		c.webhooks.Store = make(map[string]*webhookRunner)
+	}
+	c.webhooks.Store[id] = r
+	c.webhooks.Unlock()
+
+	go c.runWebhook(r)
+	return id, nil
+}
+
+// RemoveWebhook stops sending changes to the webhook id. The pending payloads go to the dead-letter log.
+func (c *Client) RemoveWebhook(id string) error {
+	c.webhooks.Lock()
+	r, ok := c.webhooks.Store[id]
+	delete(c.webhooks.Store, id)
+	c.webhooks.Unlock()
+	if !ok {
+		return ErrWebhookIsNotExist
+	}
+
+	r.cancel()
+	close(r.sub.stop)
+	<-r.done
+	return nil
+}
+
+// ListWebhooks returns the webhooks of the client, by ID
+func (c *Client) ListWebhooks() map[string]Webhook {
+	c.webhooks.Lock()
+	defer c.webhooks.Unlock()
+	webhooks := make(map[string]Webhook, len(c.webhooks.Store))
+	for id, r := range c.webhooks.Store {
+		webhooks[id] = r.hook
+	}
+	return webhooks
+}
+
+// stopWebhooks removes all the webhooks of the client
+func (c *Client) stopWebhooks() {
+	if c.webhooks == nil {
+		return
+	}
+	for id := range c.ListWebhooks() {
+		c.RemoveWebhook(id)
+	}
+}
+
+// GetWebhookDeadLetters returns the payloads that could not be sent to the webhooks of the client, oldest first
+func (c *Client) GetWebhookDeadLetters() ([]WebhookDeadLetter, error) {
+	c.webhooks.deadLetterLock.Lock()
+	defer c.webhooks.deadLetterLock.Unlock()
+
+	file, err := c.fs().Open(c.getWebhookDeadLetterPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Lines that can't be parsed, e.g. one that was only partially written because of a crash, are skipped. The lines
+	// are read whole, rather than scanned, since they can have documents of any size.
+	var letters []WebhookDeadLetter
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		var letter WebhookDeadLetter
+		if len(line) > 0 && json.Unmarshal(line, &letter) == nil {
+			letters = append(letters, letter)
+		}
+		if err == io.EOF {
+			return letters, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// VerifyWebhookSignature tells whether signature, the WEBHOOK_SIGNATURE_HEADER header of a request sent to a webhook,
+// is the one of body with secret
+func VerifyWebhookSignature(secret []byte, body []byte, signature string) bool {
+	expected := getWebhookSignature(secret, body)
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
+
+func getWebhookSignature(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookID() (string, error) {
+	b := make([]byte, 12)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (c *Client) getWebhookDeadLetterPath() string {
+	return util.JoinPath(c.documentRoot, util.META_DIR_NAME, WEBHOOK_DEAD_LETTER_FILE_NAME)
+}
+
+// runWebhook sends the changes received by r to its webhook, until it is removed
+func (c *Client) runWebhook(r *webhookRunner) {
+	defer close(r.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.sub.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		e, ok := r.sub.next()
+		if !ok {
+			break
+		}
+		if !r.isSent(e.Op) {
+			continue
+		}
+		payload, err := c.newWebhookPayload(ctx, r.hook, e)
+		if err != nil {
+			c.addWebhookDeadLetter(r, payload, 0, err)
+			continue
+		}
+		attempts, err := r.send(ctx, payload)
+		if err != nil {
+			c.addWebhookDeadLetter(r, payload, attempts, err)
+			continue
+		}
+		atomic.AddInt64(&r.numSent, 1)
+	}
+
+	for _, e := range r.sub.drain() {
+		if r.isSent(e.Op) {
+			payload, _ := c.newWebhookPayload(nil, r.hook, e)
+			c.addWebhookDeadLetter(r, payload, 0, fmt.Errorf("the webhook was removed before the payload was sent"))
+		}
+	}
+}
+
+// isSent tells whether the changes with op are sent to the webhook
+func (r *webhookRunner) isSent(op string) bool {
+	if len(r.hook.Ops) == 0 {
+		return true
+	}
+	for _, o := range r.hook.Ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// newWebhookPayload returns the payload for e. The document is only read if ctx isn't nil.
+func (c *Client) newWebhookPayload(ctx context.Context, w Webhook, e ChangeEvent) (WebhookPayload, error) {
+	payload := WebhookPayload{Collection: e.Collection, Key: e.Key, Op: e.Op, Time: e.Time}
+	var err error
+	payload.ID, err = newWebhookID()
+	if err != nil || ctx == nil || !w.IncludeData || e.Op == AUDIT_OP_DELETE {
+		return payload, err
+	}
+
+	var doc interface{}
+	err = c.GetStructCtx(ctx, e.Collection, e.Key, &doc)
+	if IsNotExist(err) { // deleted since
+		return payload, nil
+	}
+	if err != nil {
+		return payload, err
+	}
+	payload.Data, err = json.Marshal(doc)
+	return payload, err
+}
+
+// send sends payload to the webhook, and retries until it is acknowledged, MaxAttempts have failed, or ctx is canceled.
+// It returns the number of attempts, and the error of the last one.
+func (r *webhookRunner) send(ctx context.Context, payload WebhookPayload) (int, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	delay := r.hook.RetryDelay
+	var attempts int
+	for {
+		attempts++
+		err = r.post(ctx, payload.ID, body)
+		if err == nil || attempts >= r.hook.MaxAttempts {
+			return attempts, err
+		}
+		util.Debugf("Attempt %d to send payload %s to webhook %s failed, retrying in %s: %s", attempts, payload.ID, r.id, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return attempts, err
+		}
+		delay *= 2
+		if delay > r.hook.MaxRetryDelay {
+			delay = r.hook.MaxRetryDelay
+		}
+	}
+}
+
+// post makes one attempt to send body, the payload id, to the webhook
+func (r *webhookRunner) post(ctx context.Context, id string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, r.hook.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_DELIVERY_HEADER, id)
+	if len(r.hook.Secret) > 0 {
+		req.Header.Set(WEBHOOK_SIGNATURE_HEADER, getWebhookSignature(r.hook.Secret, body))
+	}
+
+	resp, err := r.hook.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16)) // so that the connection can be reused
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// addWebhookDeadLetter appends payload to the dead-letter log, having failed to be sent to the webhook of r with err
+func (c *Client) addWebhookDeadLetter(r *webhookRunner, payload WebhookPayload, attempts int, err error) {
+	util.Warnf("Could not send payload %s to webhook %s after %d attempts, adding it to the dead-letter log: %s", payload.ID, r.id, attempts, err)
+	atomic.AddInt64(&r.numDeadLetters, 1)
+	letter := WebhookDeadLetter{WebhookID: r.id, URL: r.hook.URL, Payload: payload, Attempts: attempts, Error: err.Error(), Time: time.Now()}
+	line, err := json.Marshal(letter)
+	if err != nil {
+		util.Errorf("Could not encode the dead letter of payload %s: %s", payload.ID, err)
+		return
+	}
+
+	c.webhooks.deadLetterLock.Lock()
+	defer c.webhooks.deadLetterLock.Unlock()
+	file, err := c.fs().OpenFile(c.getWebhookDeadLetterPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, util.FILE_PERM)
+	if err == nil {
+		_, err = file.Write(append(line, '\n'))
+		if cErr := file.Close(); err == nil {
+			err = cErr
+		}
+	}
+	if err != nil {
+		util.Errorf("Could not add payload %s to the dead-letter log: %s", payload.ID, err)
+	}
+}